@@ -0,0 +1,381 @@
+// gateway/cache.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/cdn"
+	"platform/codec"
+	"platform/events"
+	"platform/middleware"
+)
+
+// Bodies larger than this are passed through without being cached
+const maxCacheBody = 1 << 20
+
+// Background refreshes get their own time, the client has gone by then
+const cacheRefreshTimeout = 5 * time.Second
+
+// cacheEntry is one stored GET response. vary holds the request's values
+// of the headers the response varies on.
+type cacheEntry struct {
+	path       string
+	vary       map[string]string
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	fresh      time.Duration
+	stale      time.Duration
+	refreshing bool
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(e.stored)
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return e.age(now) > e.fresh+e.stale
+}
+
+// matches checks the request against the headers the response varies on
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheControl holds the Cache-Control directives the cache acts on
+type cacheControl struct {
+	noStore, noCache, private bool
+	maxAge, sMaxAge, swr      time.Duration
+	hasMaxAge, hasSMaxAge     bool
+}
+
+func parseCacheControl(h string) cacheControl {
+	var cc cacheControl
+	for directive := range strings.SplitSeq(h, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		d := time.Duration(seconds) * time.Second
+		switch strings.ToLower(name) {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "private":
+			cc.private = true
+		case "max-age":
+			cc.maxAge, cc.hasMaxAge = d, err == nil
+		case "s-maxage":
+			cc.sMaxAge, cc.hasSMaxAge = d, err == nil
+		case "stale-while-revalidate":
+			if err == nil {
+				cc.swr = d
+			}
+		}
+	}
+	return cc
+}
+
+// freshness is how long a shared cache may serve the response, preferring
+// s-maxage; ok is false for responses it must not keep
+func (cc cacheControl) freshness() (time.Duration, bool) {
+	switch {
+	case cc.noStore, cc.noCache, cc.private:
+		return 0, false
+	case cc.hasSMaxAge:
+		return cc.sMaxAge, cc.sMaxAge > 0
+	case cc.hasMaxAge:
+		return cc.maxAge, cc.maxAge > 0
+	}
+	return 0, false
+}
+
+// purgePrefixes maps an event subject's kind to the paths it invalidates,
+// e.g. order/42 purges /orders/42 and everything under it
+var purgePrefixes = map[string]string{
+	"order": "/orders",
+	"user":  "/users",
+}
+
+// Cache keeps GET responses that allow it in memory, so repeated reads
+// don't reach the services. Services opt in with Cache-Control (s-maxage
+// or max-age, with stale-while-revalidate to serve a stale copy while it is
+// refreshed in the background); no-store, no-cache and private responses
+// are never kept. Entries are keyed by credentials as well as URL, so
+// nobody is served a response fetched for someone else. Events purge what
+// they change, here and at the CDN in front of the gateway, if any.
+type Cache struct {
+	mu         sync.Mutex
+	entries    map[string]*cacheEntry
+	maxEntries int
+	cdn        cdn.Purger
+	observers  []func(events.Event)
+	stop       chan struct{}
+
+	hits, misses, stale, purged int
+}
+
+func NewCache(maxEntries int) *Cache {
+	c := &Cache{
+		entries:    make(map[string]*cacheEntry),
+		maxEntries: maxEntries,
+		stop:       make(chan struct{}),
+	}
+	go c.evictLoop()
+	return c
+}
+
+func (c *Cache) Close() {
+	close(c.stop)
+}
+
+func (c *Cache) evictLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			c.mu.Lock()
+			for key, e := range c.entries {
+				if e.expired(now) {
+					delete(c.entries, key)
+				}
+			}
+			c.mu.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.RequestURI() + "\x00" + r.Header.Get("Authorization")
+}
+
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+		if reqCC.noStore {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cacheKey(r)
+		now := time.Now()
+		// A client asking for no-cache or max-age=0 gets a fresh copy,
+		// which is then kept for everyone else
+		revalidate := reqCC.noCache || (reqCC.hasMaxAge && reqCC.maxAge == 0)
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if ok && !revalidate && e.matches(r) && !e.expired(now) {
+			age := e.age(now)
+			refresh := age > e.fresh && !e.refreshing
+			if age > e.fresh {
+				c.stale++
+			} else {
+				c.hits++
+			}
+			if refresh {
+				e.refreshing = true
+			}
+			c.mu.Unlock()
+			if refresh {
+				go c.refresh(next, r, key)
+			}
+			c.serve(w, e, age)
+			return
+		}
+		c.misses++
+		c.mu.Unlock()
+
+		// Past maxCacheBody the copy is useless, and a streamed listing
+		// may be far larger
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK, max: maxCacheBody}
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(rec, r)
+		c.store(key, r, rec.status, w.Header(), rec.body.Bytes())
+	})
+}
+
+// serve writes a stored response, with its age as RFC 9111 asks
+func (c *Cache) serve(w http.ResponseWriter, e *cacheEntry, age time.Duration) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if age > e.fresh {
+		w.Header().Set("X-Cache", "STALE")
+	} else {
+		w.Header().Set("X-Cache", "HIT")
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// refresh fetches a stale entry again behind the client's back
+func (c *Cache) refresh(next http.Handler, r *http.Request, key string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), cacheRefreshTimeout)
+	defer cancel()
+
+	rec := &headerRecorder{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(rec, r.Clone(ctx))
+	if !c.store(key, r, rec.status, rec.header, rec.body.Bytes()) {
+		// Keep serving the stale copy until it runs out; the next
+		// request after that goes to the service
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// store keeps a response if its Cache-Control allows, reporting whether it did
+func (c *Cache) store(key string, r *http.Request, status int, header http.Header, body []byte) bool {
+	if status != http.StatusOK || len(body) > maxCacheBody || header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	fresh, ok := cc.freshness()
+	if !ok {
+		return false
+	}
+	e := &cacheEntry{
+		path:   r.URL.Path,
+		vary:   make(map[string]string),
+		status: status,
+		header: header.Clone(),
+		body:   body,
+		stored: time.Now(),
+		fresh:  fresh,
+		stale:  cc.swr,
+	}
+	// These belong to the request that fetched it
+	e.header.Del("X-Cache")
+	e.header.Del(middleware.RequestIDHeader)
+	e.header.Del("traceparent")
+	for _, v := range header.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return false
+			}
+			e.vary[name] = r.Header.Get(name)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		return false
+	}
+	c.entries[key] = e
+	return true
+}
+
+// Purge drops every entry for path and the paths under it
+func (c *Cache) Purge(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if e.path == path || strings.HasPrefix(e.path, path+"/") {
+			delete(c.entries, key)
+			c.purged++
+		}
+	}
+}
+
+// PurgeCDN has events purge the CDN as well
+func (c *Cache) PurgeCDN(p cdn.Purger) {
+	c.cdn = p
+}
+
+// Observe has the events the cache receives passed to fn as well, for
+// whatever else the gateway keeps of what they change
+func (c *Cache) Observe(fn func(events.Event)) {
+	c.observers = append(c.observers, fn)
+}
+
+// HandleEvent purges the cached responses an event makes out of date: an
+// event about order/42 purges /orders/42, and the order's public ID path
+// when the event carries it, and at the CDN whatever is tagged order/42.
+// A failed CDN purge fails the delivery, so it is tried again.
+func (c *Cache) HandleEvent(w http.ResponseWriter, r *http.Request) {
+	var event events.Event
+	if err := codec.Decode(r, &event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, fn := range c.observers {
+		fn(event)
+	}
+	kind, id, ok := strings.Cut(event.Subject, "/")
+	if prefix, known := purgePrefixes[kind]; ok && known && id != "" {
+		c.Purge(prefix + "/" + id)
+		data, _ := event.Data.(map[string]any)
+		if publicID, _ := data["public_id"].(string); publicID != "" {
+			c.Purge(prefix + "/" + publicID)
+		}
+		if c.cdn != nil {
+			if err := c.cdn.Purge(r.Context(), []string{event.Subject}); err != nil {
+				log.Printf("event %s: %v", event.ID, err)
+				http.Error(w, "CDN purge failed", http.StatusBadGateway)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Cache) WriteMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintln(w, "# TYPE gateway_cache_requests_total counter")
+	fmt.Fprintf(w, "gateway_cache_requests_total{result=\"hit\"} %d\n", c.hits)
+	fmt.Fprintf(w, "gateway_cache_requests_total{result=\"stale\"} %d\n", c.stale)
+	fmt.Fprintf(w, "gateway_cache_requests_total{result=\"miss\"} %d\n", c.misses)
+	fmt.Fprintln(w, "# TYPE gateway_cache_purged_total counter")
+	fmt.Fprintf(w, "gateway_cache_purged_total %d\n", c.purged)
+	fmt.Fprintln(w, "# TYPE gateway_cache_entries gauge")
+	fmt.Fprintf(w, "gateway_cache_entries %d\n", len(c.entries))
+}
+
+// headerRecorder captures a response nobody is waiting for
+type headerRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (h *headerRecorder) Header() http.Header {
+	return h.header
+}
+
+func (h *headerRecorder) WriteHeader(status int) {
+	h.status = status
+}
+
+func (h *headerRecorder) Write(b []byte) (int, error) {
+	return h.body.Write(b)
+}
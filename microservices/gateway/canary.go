@@ -0,0 +1,330 @@
+// gateway/canary.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/events"
+	"platform/middleware"
+)
+
+// Windows are kept in this many buckets, so old requests age out a slice
+// at a time
+const canaryBuckets = 12
+
+// CanaryConfig says when a canary counts as degraded: once both groups have
+// served MinRequests within Window, its error rate exceeds the baseline's
+// by more than ErrorMargin, or its mean latency is over LatencyFactor times
+// the baseline's
+type CanaryConfig struct {
+	Window        time.Duration
+	MinRequests   int64
+	ErrorMargin   float64
+	LatencyFactor float64
+}
+
+// canaryBucket is one slice of the window, for one group
+type canaryBucket struct {
+	slot     int64
+	requests int64
+	errors   int64
+	latency  time.Duration
+}
+
+// Canary sends a share of one service's requests to a canary deployment of
+// it, and takes the share back to nothing when the canary does worse than
+// the baseline
+type Canary struct {
+	service string
+	target  string
+	handler http.Handler
+
+	mu       sync.Mutex
+	percent  float64
+	baseline []canaryBucket
+	canary   []canaryBucket
+	// rolledBack says why the canary was last taken out, until it is given
+	// traffic again
+	rolledBack   string
+	rolledBackAt time.Time
+}
+
+// Canaries are the gateway's canaries, by the baseline URL they stand in for
+type Canaries struct {
+	cfg      CanaryConfig
+	events   *events.Emitter
+	clock    clock.Clock
+	byTarget map[string]*Canary
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewCanaries(cfg CanaryConfig, emitter *events.Emitter) *Canaries {
+	return &Canaries{cfg: cfg, events: emitter, clock: clock.System, byTarget: make(map[string]*Canary)}
+}
+
+// Add gives percent of the requests for baseline's service to target
+func (cs *Canaries) Add(service, baseline, target string, percent float64) {
+	cs.byTarget[baseline] = &Canary{
+		service:  service,
+		target:   target,
+		percent:  percent,
+		baseline: make([]canaryBucket, canaryBuckets),
+		canary:   make([]canaryBucket, canaryBuckets),
+	}
+}
+
+// Start judges the canaries every slice of the window until Close
+func (cs *Canaries) Start() {
+	cs.stop, cs.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(cs.done)
+		ticker := time.NewTicker(cs.cfg.Window / canaryBuckets)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, c := range cs.byTarget {
+					cs.judge(c)
+				}
+			case <-cs.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (cs *Canaries) Close() {
+	if cs.stop != nil {
+		close(cs.stop)
+		<-cs.done
+	}
+}
+
+// slot numbers the window slice t falls in
+func (cs *Canaries) slot(t time.Time) int64 {
+	return t.UnixNano() / int64(cs.cfg.Window/canaryBuckets)
+}
+
+// Route splits the requests baseline serves with the canary standing in
+// for target, if there is one
+func (cs *Canaries) Route(target string, baseline http.Handler) http.Handler {
+	c := cs.byTarget[target]
+	if c == nil {
+		return baseline
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		toCanary := rand.Float64()*100 < c.percent
+		c.mu.Unlock()
+		h, group := baseline, &c.baseline
+		if toCanary {
+			h, group = c.handler, &c.canary
+		}
+		start := cs.clock.Now()
+		rec := middleware.NewRecorder(w)
+		h.ServeHTTP(rec, r)
+		cs.record(c, group, rec.Status >= 500, cs.clock.Now().Sub(start))
+	})
+}
+
+func (cs *Canaries) record(c *Canary, group *[]canaryBucket, failed bool, latency time.Duration) {
+	slot := cs.slot(cs.clock.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := &(*group)[slot%canaryBuckets]
+	if b.slot != slot {
+		*b = canaryBucket{slot: slot}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	b.latency += latency
+}
+
+// canaryStats sums one group's buckets within the window
+type canaryStats struct {
+	Requests  int64   `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	LatencyMS float64 `json:"mean_latency_ms"`
+}
+
+func (cs *Canaries) stats(buckets []canaryBucket, now time.Time) canaryStats {
+	current := cs.slot(now)
+	var s canaryStats
+	var errors int64
+	var latency time.Duration
+	for _, b := range buckets {
+		if b.slot > current-canaryBuckets && b.slot <= current {
+			s.Requests += b.requests
+			errors += b.errors
+			latency += b.latency
+		}
+	}
+	if s.Requests > 0 {
+		s.ErrorRate = float64(errors) / float64(s.Requests)
+		s.LatencyMS = float64(latency.Microseconds()) / 1000 / float64(s.Requests)
+	}
+	return s
+}
+
+// degraded says how the canary is doing worse than the baseline, or ""
+func (cs *Canaries) degraded(baseline, canary canaryStats) string {
+	if baseline.Requests < cs.cfg.MinRequests || canary.Requests < cs.cfg.MinRequests {
+		return ""
+	}
+	if canary.ErrorRate > baseline.ErrorRate+cs.cfg.ErrorMargin {
+		return fmt.Sprintf("error rate %.2f%% against %.2f%%", canary.ErrorRate*100, baseline.ErrorRate*100)
+	}
+	if canary.LatencyMS > baseline.LatencyMS*cs.cfg.LatencyFactor {
+		return fmt.Sprintf("mean latency %.1fms against %.1fms", canary.LatencyMS, baseline.LatencyMS)
+	}
+	return ""
+}
+
+// CanaryAlert is emitted when a canary is rolled back
+type CanaryAlert struct {
+	Service     string      `json:"service"`
+	Canary      string      `json:"canary"`
+	Percent     float64     `json:"percent"`
+	Reason      string      `json:"reason"`
+	Baseline    canaryStats `json:"baseline"`
+	CanaryStats canaryStats `json:"canary_stats"`
+	RolledBack  time.Time   `json:"rolled_back_at"`
+}
+
+// judge rolls c back if it has degraded
+func (cs *Canaries) judge(c *Canary) {
+	now := cs.clock.Now()
+	c.mu.Lock()
+	if c.percent == 0 {
+		c.mu.Unlock()
+		return
+	}
+	baseline, canary := cs.stats(c.baseline, now), cs.stats(c.canary, now)
+	reason := cs.degraded(baseline, canary)
+	if reason == "" {
+		c.mu.Unlock()
+		return
+	}
+	alert := CanaryAlert{
+		Service:     c.service,
+		Canary:      c.target,
+		Percent:     c.percent,
+		Reason:      reason,
+		Baseline:    baseline,
+		CanaryStats: canary,
+		RolledBack:  now,
+	}
+	c.percent, c.rolledBack, c.rolledBackAt = 0, reason, now
+	c.mu.Unlock()
+
+	alertJSON, _ := json.Marshal(alert)
+	log.Printf("canary alert: %s", alertJSON)
+	cs.events.Emit(context.Background(), "canary.rolled_back", "canary/"+c.service, alert)
+}
+
+// canaryState is one canary as /admin/canaries shows it
+type canaryState struct {
+	Service      string      `json:"service"`
+	Canary       string      `json:"canary"`
+	Percent      float64     `json:"percent"`
+	Baseline     canaryStats `json:"baseline"`
+	CanaryStats  canaryStats `json:"canary_stats"`
+	RolledBack   string      `json:"rolled_back,omitempty"`
+	RolledBackAt *time.Time  `json:"rolled_back_at,omitempty"`
+}
+
+func (cs *Canaries) states() []canaryState {
+	now := cs.clock.Now()
+	states := []canaryState{}
+	for _, c := range cs.byTarget {
+		c.mu.Lock()
+		s := canaryState{
+			Service:     c.service,
+			Canary:      c.target,
+			Percent:     c.percent,
+			Baseline:    cs.stats(c.baseline, now),
+			CanaryStats: cs.stats(c.canary, now),
+			RolledBack:  c.rolledBack,
+		}
+		if c.rolledBack != "" {
+			at := c.rolledBackAt
+			s.RolledBackAt = &at
+		}
+		c.mu.Unlock()
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Service < states[j].Service })
+	return states
+}
+
+// ServeHTTP is the admin endpoint: GET reports the canaries, PUT sets the
+// share one of them gets, starting its comparison afresh
+func (cs *Canaries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Service string  `json:"service"`
+			Percent float64 `json:"percent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Percent < 0 || req.Percent > 100 {
+			http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		var c *Canary
+		for _, candidate := range cs.byTarget {
+			if candidate.service == req.Service {
+				c = candidate
+			}
+		}
+		if c == nil {
+			http.Error(w, fmt.Sprintf("no canary for %q", req.Service), http.StatusNotFound)
+			return
+		}
+		c.mu.Lock()
+		c.percent = req.Percent
+		if req.Percent > 0 {
+			c.rolledBack, c.rolledBackAt = "", time.Time{}
+			clear(c.baseline)
+			clear(c.canary)
+		}
+		c.mu.Unlock()
+		log.Printf("canary: %s gets %g%% of its traffic", req.Service, req.Percent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.states())
+}
+
+func (cs *Canaries) WriteMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# TYPE gateway_canary_percent gauge")
+	states := cs.states()
+	for _, s := range states {
+		fmt.Fprintf(w, "gateway_canary_percent{service=%q} %g\n", s.Service, s.Percent)
+	}
+	fmt.Fprintln(w, "# TYPE gateway_canary_error_rate gauge")
+	for _, s := range states {
+		fmt.Fprintf(w, "gateway_canary_error_rate{service=%q,group=\"baseline\"} %g\n", s.Service, s.Baseline.ErrorRate)
+		fmt.Fprintf(w, "gateway_canary_error_rate{service=%q,group=\"canary\"} %g\n", s.Service, s.CanaryStats.ErrorRate)
+	}
+}
@@ -0,0 +1,155 @@
+// gateway/clients.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/events"
+	"platform/middleware"
+)
+
+// defaultClientRateLimit is requests a minute for partner clients
+// registered without a limit of their own
+const defaultClientRateLimit = 600
+
+// ClientStatusSource says whether a tenant's OAuth client was revoked
+type ClientStatusSource interface {
+	ClientRevoked(ctx context.Context, tenant, id string) (bool, error)
+}
+
+// ClientLimits holds partner clients' tokens to their rate limit, which
+// the token carries, and refuses tokens of clients revoked since they were
+// issued. Revocations are heard of at /events, confirmed with source and
+// kept in memory, so after a restart a revoked client's tokens work until
+// they expire.
+type ClientLimits struct {
+	defaultRate int
+	source      ClientStatusSource
+
+	mu sync.Mutex
+	// limiters are shared by the clients with the same limit
+	limiters map[int]*middleware.RateLimiter
+	revoked  map[string]bool
+	refused  map[string]int
+}
+
+// clientLimitsFromEnv takes the default limit from CLIENT_RATE_LIMIT
+func clientLimitsFromEnv(source ClientStatusSource) *ClientLimits {
+	l := &ClientLimits{
+		defaultRate: defaultClientRateLimit,
+		source:      source,
+		limiters:    make(map[int]*middleware.RateLimiter),
+		revoked:     make(map[string]bool),
+		refused:     make(map[string]int),
+	}
+	if v := os.Getenv("CLIENT_RATE_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid CLIENT_RATE_LIMIT %q", v)
+		}
+		l.defaultRate = n
+	}
+	return l
+}
+
+// limiter returns the limiter for perMinute requests a minute, allowing
+// bursts of a tenth of that
+func (l *ClientLimits) limiter(perMinute int) *middleware.RateLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.limiters[perMinute]
+	if !ok {
+		rl = middleware.NewRateLimiter(float64(perMinute)/60, max(perMinute/10, 1))
+		l.limiters[perMinute] = rl
+	}
+	return rl
+}
+
+func (l *ClientLimits) refuse(reason string) {
+	l.mu.Lock()
+	l.refused[reason]++
+	l.mu.Unlock()
+}
+
+// Observe takes revocations from OAuth client events, once the source
+// confirms them: an event alone never locks a partner out
+func (l *ClientLimits) Observe(event events.Event) {
+	kind, id, ok := strings.Cut(event.Subject, "/")
+	if !ok || kind != "oauth_client" || event.Type != "oauth_client.revoked" {
+		return
+	}
+	data, _ := event.Data.(map[string]any)
+	tenant, _ := data["tenant"].(string)
+	if tenant == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		revoked, err := l.source.ClientRevoked(ctx, tenant, id)
+		if err != nil {
+			log.Printf("client %s: confirm revocation: %v", id, err)
+			return
+		}
+		if revoked {
+			l.mu.Lock()
+			l.revoked[id] = true
+			l.mu.Unlock()
+		}
+	}()
+}
+
+func (l *ClientLimits) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := middleware.PrincipalFromContext(r.Context())
+		if !ok || p.ClientID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		l.mu.Lock()
+		revoked := l.revoked[p.ClientID]
+		l.mu.Unlock()
+		if revoked {
+			l.refuse("revoked")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "client "+p.ClientID+" was revoked", http.StatusUnauthorized)
+			return
+		}
+		rate := p.RateLimit
+		if rate == 0 {
+			rate = l.defaultRate
+		}
+		if allowed, wait := l.limiter(rate).Allow(p.ClientID); !allowed {
+			l.refuse("rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *ClientLimits) WriteMetrics(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reasons := make([]string, 0, len(l.refused))
+	for r := range l.refused {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "# TYPE gateway_client_refused_total counter")
+	for _, r := range reasons {
+		fmt.Fprintf(w, "gateway_client_refused_total{reason=%q} %d\n", r, l.refused[r])
+	}
+}
@@ -0,0 +1,186 @@
+// gateway/dedupe.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Bodies larger than this are passed through without deduplication
+const maxDedupeBody = 1 << 20
+
+// dedupeEntry holds the response of the first request seen for a key.
+// done is closed once the response has been captured.
+type dedupeEntry struct {
+	done    chan struct{}
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// Deduplicator collapses identical non-idempotent POSTs sent within a short
+// window into a single downstream call. Clients that send an Idempotency-Key
+// are left to the services' own idempotency handling, and anonymous requests
+// aren't collapsed at all: with no credentials to tell them apart, two guests
+// posting the same checkout or login would get each other's response.
+type Deduplicator struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*dedupeEntry
+	stop    chan struct{}
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	d := &Deduplicator{
+		window:  window,
+		entries: make(map[string]*dedupeEntry),
+		stop:    make(chan struct{}),
+	}
+	go d.evictLoop()
+	return d
+}
+
+func (d *Deduplicator) Close() {
+	close(d.stop)
+}
+
+func (d *Deduplicator) evictLoop() {
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			d.mu.Lock()
+			for key, e := range d.entries {
+				if !e.expires.IsZero() && now.After(e.expires) {
+					delete(d.entries, key)
+				}
+			}
+			d.mu.Unlock()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// dedupeKey hashes method, path, body and credentials so different users
+// sending the same payload are never collapsed together
+func dedupeKey(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method)
+	h.Write([]byte{0})
+	io.WriteString(h, r.URL.RequestURI())
+	h.Write([]byte{0})
+	io.WriteString(h, r.Header.Get("Authorization"))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *Deduplicator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Idempotency-Key") != "" || r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxDedupeBody+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxDedupeBody {
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := dedupeKey(r, body)
+		d.mu.Lock()
+		if e, ok := d.entries[key]; ok && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+			d.mu.Unlock()
+			d.replay(w, r, e)
+			return
+		}
+		e := &dedupeEntry{done: make(chan struct{})}
+		d.entries[key] = e
+		d.mu.Unlock()
+
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		// Settle the entry even if next panics, so duplicates waiting on it
+		// are let go and it is evicted
+		completed := false
+		defer func() {
+			d.mu.Lock()
+			if !completed || rec.status >= 500 {
+				// Let the client retry failed requests downstream
+				delete(d.entries, key)
+			}
+			e.status, e.header, e.body = rec.status, w.Header().Clone(), rec.body.Bytes()
+			if !completed {
+				e.status, e.header, e.body = http.StatusBadGateway, http.Header{}, nil
+			}
+			e.expires = time.Now().Add(d.window)
+			d.mu.Unlock()
+			close(e.done)
+		}()
+		next.ServeHTTP(rec, r)
+		completed = true
+	})
+}
+
+// replay waits for the original request to finish and copies its response
+func (d *Deduplicator) replay(w http.ResponseWriter, r *http.Request, e *dedupeEntry) {
+	select {
+	case <-e.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Deduplicated", "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// responseCapture writes through to the client while keeping a copy of the
+// body, or of its first max bytes and a little more when max is set
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	max    int
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.max == 0 || c.body.Len() <= c.max {
+		c.body.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets streamed responses flush through to the client
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
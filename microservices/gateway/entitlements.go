@@ -0,0 +1,142 @@
+// gateway/entitlements.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/middleware"
+	"platform/quota"
+)
+
+// featureRoute gates the paths under prefix behind a feature; an empty
+// method matches any
+type featureRoute struct {
+	feature string
+	method  string
+	prefix  string
+}
+
+var featureRoutes = []featureRoute{
+	{feature: "bulk_orders", method: http.MethodPost, prefix: "/orders/bulk"},
+	{feature: "bulk_orders", method: http.MethodPost, prefix: "/orders/import"},
+	{feature: "exports", prefix: "/orders/export"},
+	{feature: "webhooks", prefix: "/notifications/webhooks"},
+}
+
+// featureFor finds the feature a request needs, if any
+func featureFor(r *http.Request) (string, bool) {
+	for _, f := range featureRoutes {
+		if (f.method == "" || f.method == r.Method) &&
+			(r.URL.Path == f.prefix || strings.HasPrefix(r.URL.Path, f.prefix+"/")) {
+			return f.feature, true
+		}
+	}
+	return "", false
+}
+
+// EntitlementSource says which plan a subject is on and what it includes
+type EntitlementSource interface {
+	Entitlements(ctx context.Context, subject string) (plan string, features []string, err error)
+}
+
+type entitlement struct {
+	plan     string
+	features []string
+	expires  time.Time
+}
+
+// Entitlements turns away requests for features the caller's plan doesn't
+// include with 403 and the upgrade_required code. Plans change rarely, so
+// each subject's entitlements are kept for ttl rather than asked for on
+// every request; admins are entitled to everything.
+type Entitlements struct {
+	source EntitlementSource
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	cached map[string]entitlement
+}
+
+func NewEntitlements(source EntitlementSource, ttl time.Duration) *Entitlements {
+	return &Entitlements{source: source, ttl: ttl, cached: make(map[string]entitlement)}
+}
+
+func (e *Entitlements) lookup(ctx context.Context, subject string) (entitlement, error) {
+	now := time.Now()
+	e.mu.Lock()
+	ent, ok := e.cached[subject]
+	e.mu.Unlock()
+	if ok && now.Before(ent.expires) {
+		return ent, nil
+	}
+
+	plan, features, err := e.source.Entitlements(ctx, subject)
+	if err != nil {
+		return entitlement{}, err
+	}
+	ent = entitlement{plan: plan, features: features, expires: now.Add(e.ttl)}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.cached) > 10000 {
+		for s, c := range e.cached {
+			if now.After(c.expires) {
+				delete(e.cached, s)
+			}
+		}
+	}
+	e.cached[subject] = ent
+	return ent, nil
+}
+
+// upgradeRequired is the 403 body clients can act on, e.g. by offering
+// an upgrade to a plan that includes Feature
+type upgradeRequired struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Feature string `json:"feature"`
+	Plan    string `json:"plan"`
+}
+
+// Middleware checks entitlements of authenticated callers. A failure to
+// look them up lets the request through; plans are a commercial matter,
+// the services still do their own authorization.
+func (e *Entitlements) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		feature, ok := featureFor(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := middleware.PrincipalFromContext(r.Context())
+		if !ok || p.HasRole("admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		subject := quota.Subject(p.Tenant, p.Subject)
+		ent, err := e.lookup(r.Context(), subject)
+		if err != nil {
+			log.Printf("entitlements for %s: %v", subject, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !slices.Contains(ent.features, feature) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(upgradeRequired{
+				Error:   "upgrade_required",
+				Message: "the " + ent.plan + " plan doesn't include " + feature,
+				Feature: feature,
+				Plan:    ent.plan,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
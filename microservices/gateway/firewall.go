@@ -0,0 +1,276 @@
+// gateway/firewall.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"platform/middleware"
+)
+
+// Only bodies up to this size are inspected; larger uploads such as bulk
+// imports pass through unchecked
+const maxInspectBody = 1 << 20
+
+// Patterns that have no business in API traffic
+var defaultSuspiciousPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bunion\b\s+(all\s+)?\bselect\b`),
+	regexp.MustCompile(`(?i);\s*(drop|truncate|alter)\s+table\b`),
+	regexp.MustCompile(`(?i)<\s*script\b`),
+	regexp.MustCompile(`(?i)\bjavascript:`),
+	regexp.MustCompile(`\.\./|\.\.\\`),
+}
+
+// GeoLookup resolves a client address to an ISO country code, or "" when
+// unknown. The gateway ships no GeoIP database; plug one in here.
+type GeoLookup func(r *http.Request, addr netip.Addr) string
+
+// HeaderCountry trusts a country header set by the CDN or load balancer in
+// front of the gateway, e.g. CF-IPCountry
+func HeaderCountry(header string) GeoLookup {
+	return func(r *http.Request, _ netip.Addr) string {
+		return strings.ToUpper(r.Header.Get(header))
+	}
+}
+
+// FirewallConfig holds the gateway's request filtering rules
+type FirewallConfig struct {
+	// Allow, when non-empty, admits only these networks; Deny always wins
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+
+	Geo              GeoLookup
+	BlockedCountries []string
+
+	// Payload rules; a zero limit disables that check
+	Patterns    []*regexp.Regexp
+	MaxArrayLen int
+	MaxDepth    int
+}
+
+// Firewall rejects requests by client IP, country and payload content,
+// logging and counting every block
+type Firewall struct {
+	cfg     FirewallConfig
+	mu      sync.Mutex
+	blocked map[string]int64
+}
+
+func NewFirewall(cfg FirewallConfig) *Firewall {
+	return &Firewall{cfg: cfg, blocked: make(map[string]int64)}
+}
+
+// ParsePrefixes reads a comma separated list of CIDRs or bare addresses
+func ParsePrefixes(spec string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// checkAddr applies the IP lists and geo rules; it returns the rule that
+// blocked the request, or ""
+func (f *Firewall) checkAddr(r *http.Request) string {
+	addr, ok := clientAddr(r)
+	if !ok {
+		if len(f.cfg.Allow) > 0 {
+			return "ip_allowlist"
+		}
+		return ""
+	}
+	if containsAddr(f.cfg.Deny, addr) {
+		return "ip_denylist"
+	}
+	if len(f.cfg.Allow) > 0 && !containsAddr(f.cfg.Allow, addr) {
+		return "ip_allowlist"
+	}
+	if f.cfg.Geo != nil && len(f.cfg.BlockedCountries) > 0 {
+		country := f.cfg.Geo(r, addr)
+		for _, c := range f.cfg.BlockedCountries {
+			if country != "" && strings.EqualFold(country, c) {
+				return "geo"
+			}
+		}
+	}
+	return ""
+}
+
+func (f *Firewall) matchesPattern(s string) bool {
+	for _, p := range f.cfg.Patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkJSON walks a JSON body token by token, enforcing array length and
+// nesting limits and scanning string values for suspicious patterns
+func (f *Firewall) checkJSON(body []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	type frame struct {
+		array bool
+		count int
+	}
+	var stack []frame
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return ""
+		}
+		if err != nil {
+			// Malformed JSON is the service's problem to report
+			return ""
+		}
+		if len(stack) > 0 && stack[len(stack)-1].array {
+			if d, ok := tok.(json.Delim); !ok || (d != ']' && d != '}') {
+				stack[len(stack)-1].count++
+				if f.cfg.MaxArrayLen > 0 && stack[len(stack)-1].count > f.cfg.MaxArrayLen {
+					return "payload_array"
+				}
+			}
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '[', '{':
+				stack = append(stack, frame{array: t == '['})
+				if f.cfg.MaxDepth > 0 && len(stack) > f.cfg.MaxDepth {
+					return "payload_depth"
+				}
+			case ']', '}':
+				stack = stack[:len(stack)-1]
+			}
+		case string:
+			if f.matchesPattern(t) {
+				return "payload_pattern"
+			}
+		}
+	}
+}
+
+// checkPayload applies the payload rules to the query string and body,
+// leaving the body readable for the upstream
+func (f *Firewall) checkPayload(r *http.Request) (string, error) {
+	if q, err := url.QueryUnescape(r.URL.RawQuery); err == nil && f.matchesPattern(q) {
+		return "payload_pattern", nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxInspectBody+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxInspectBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return "", nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || json.Valid(body) {
+		return f.checkJSON(body), nil
+	}
+	if f.matchesPattern(string(body)) {
+		return "payload_pattern", nil
+	}
+	return "", nil
+}
+
+func (f *Firewall) block(w http.ResponseWriter, r *http.Request, rule string) {
+	f.mu.Lock()
+	f.blocked[rule]++
+	f.mu.Unlock()
+
+	log.Printf("firewall: blocked %s %s from %s by %s rule (request %s)",
+		r.Method, r.URL.Path, r.RemoteAddr, rule, middleware.RequestID(r.Context()))
+	http.Error(w, "request blocked", http.StatusForbidden)
+}
+
+func (f *Firewall) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rule := f.checkAddr(r); rule != "" {
+			f.block(w, r, rule)
+			return
+		}
+		if len(f.cfg.Patterns) > 0 || f.cfg.MaxArrayLen > 0 || f.cfg.MaxDepth > 0 {
+			rule, err := f.checkPayload(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if rule != "" {
+				f.block(w, r, rule)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WriteMetrics serves the block counters alongside the request metrics
+func (f *Firewall) WriteMetrics(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules := make([]string, 0, len(f.blocked))
+	for rule := range f.blocked {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	fmt.Fprintln(w, "# TYPE gateway_firewall_blocked_total counter")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "gateway_firewall_blocked_total{rule=%q} %d\n", rule, f.blocked[rule])
+	}
+}
@@ -0,0 +1,50 @@
+// gateway/geo.go
+package main
+
+import (
+	"net/http"
+	"net/netip"
+
+	"platform/geoip"
+)
+
+// GeoIP looks countries up in the gateway's GeoIP database, for the
+// firewall's country rules
+func GeoIP(db *geoip.DB) GeoLookup {
+	return func(_ *http.Request, addr netip.Addr) string {
+		loc, _ := db.Lookup(addr)
+		return loc.Country
+	}
+}
+
+// GeoTagger tells the services where each client is, for orders' fraud
+// checks and taxes and for routing payments to the buyer's region
+type GeoTagger struct {
+	// db is nil without GEOIP_DB
+	db *geoip.DB
+	// country, when set, is asked for the country the database doesn't
+	// know, e.g. from the CDN's header
+	country GeoLookup
+}
+
+func NewGeoTagger(db *geoip.DB, country GeoLookup) *GeoTagger {
+	return &GeoTagger{db: db, country: country}
+}
+
+// Middleware replaces whatever location the client claimed with the one
+// its address resolves to
+func (t *GeoTagger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var loc geoip.Location
+		if addr, ok := clientAddr(r); ok {
+			if t.db != nil {
+				loc, _ = t.db.Lookup(addr)
+			}
+			if loc.Country == "" && t.country != nil {
+				loc.Country = t.country(r, addr)
+			}
+		}
+		loc.Set(r.Header)
+		next.ServeHTTP(w, r)
+	})
+}
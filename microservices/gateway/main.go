@@ -0,0 +1,405 @@
+// gateway/main.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/cdn"
+	"platform/deadline"
+	"platform/events"
+	"platform/geoip"
+	"platform/middleware"
+	"platform/quota"
+	"platform/router"
+	"platform/server"
+	"platform/signing"
+	"platform/startup"
+)
+
+type Gateway struct {
+	router *router.Router
+}
+
+// upstream maps a path prefix to the service that owns it
+type upstream struct {
+	name   string
+	prefix string
+	target string
+}
+
+// NewGateway proxies to the services through transport, which is shared so
+// requests to one service reuse its connections, and to their canaries
+func NewGateway(transport http.RoundTripper, canaries *Canaries, userServiceURL, orderServiceURL, paymentServiceURL, notificationServiceURL string) (*Gateway, error) {
+	g := &Gateway{router: router.New()}
+
+	upstreams := []upstream{
+		{name: "users", prefix: "/users", target: userServiceURL},
+		{name: "account-merges", prefix: "/account-merges", target: userServiceURL},
+		{name: "tenants", prefix: "/tenants", target: userServiceURL},
+		{name: "scim", prefix: "/scim", target: userServiceURL},
+		{name: "orgs", prefix: "/orgs", target: userServiceURL},
+		{name: "oauth", prefix: "/oauth", target: userServiceURL},
+		// Stored cards and store credit live with payments, under the user
+		// they belong to
+		{name: "payment-methods", prefix: "/users/{id}/payment-methods", target: paymentServiceURL},
+		{name: "store-credit", prefix: "/users/{id}/store-credit", target: paymentServiceURL},
+		// Order history is the user's, but order-service has it
+		{name: "order-history", prefix: "/users/{id}/orders", target: orderServiceURL},
+		// ...and notification-service their in-app inbox
+		{name: "notification-inbox", prefix: "/users/{id}/notifications", target: notificationServiceURL},
+		{name: "gift-cards", prefix: "/gift-cards", target: paymentServiceURL},
+		{name: "files", prefix: "/files", target: paymentServiceURL},
+		{name: "orders", prefix: "/orders", target: orderServiceURL},
+		{name: "subscriptions", prefix: "/subscriptions", target: orderServiceURL},
+		{name: "returns", prefix: "/returns", target: orderServiceURL},
+		{name: "billing", prefix: "/billing", target: orderServiceURL},
+		{name: "notifications", prefix: "/notifications", target: notificationServiceURL},
+	}
+	// Payments aren't served here, but customers come back from a payment
+	// challenge through the gateway
+	challenges, err := newProxy(paymentServiceURL, transport)
+	if err != nil {
+		return nil, err
+	}
+	g.router.Handle("return-from-payment-challenge", http.MethodGet, "/payments/{id}/challenge",
+		canaries.Route(paymentServiceURL, challenges))
+	for _, c := range canaries.byTarget {
+		proxy, err := newProxy(c.target, transport)
+		if err != nil {
+			return nil, err
+		}
+		c.handler = proxy
+	}
+	for _, u := range upstreams {
+		proxy, err := newProxy(u.target, transport)
+		if err != nil {
+			return nil, err
+		}
+		h := canaries.Route(u.target, proxy)
+		g.router.Handle(u.name, "", u.prefix, h)
+		g.router.Handle(u.name, "", u.prefix+"/", h)
+	}
+
+	return g, nil
+}
+
+func newProxy(target string, transport http.RoundTripper) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = timedTransport{upstream: u.Host, next: transport}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		middleware.Propagate(req.Context(), req)
+		deadline.Propagate(req.Context(), req)
+	}
+	// The gateway already set these for the client; don't repeat upstream's
+	// copies. Its own Server-Timing covers the upstream call.
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del(middleware.RequestIDHeader)
+		resp.Header.Del("traceparent")
+		resp.Header.Del("Server-Timing")
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("proxy %s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}
+	return proxy, nil
+}
+
+// timedTransport puts each proxied call on the request's cost
+type timedTransport struct {
+	upstream string
+	next     http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	middleware.RecordUpstream(req.Context(), t.upstream, time.Since(start))
+	return resp, err
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.router.ServeHTTP(w, r)
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// canariesFromEnv reads a canary for each service from its
+// <SERVICE>_CANARY_URL, e.g. ORDER_SERVICE_CANARY_URL, which gets
+// <SERVICE>_CANARY_PERCENT (5 by default) of its traffic. CANARY_WINDOW,
+// CANARY_MIN_REQUESTS, CANARY_ERROR_MARGIN and CANARY_LATENCY_FACTOR say
+// when a canary has degraded and is rolled back.
+func canariesFromEnv(baselines map[string]string) (*Canaries, error) {
+	var cfg CanaryConfig
+	var err error
+	if cfg.Window, err = time.ParseDuration(getEnv("CANARY_WINDOW", "5m")); err != nil || cfg.Window < time.Minute {
+		return nil, fmt.Errorf("invalid CANARY_WINDOW %q", os.Getenv("CANARY_WINDOW"))
+	}
+	if cfg.MinRequests, err = strconv.ParseInt(getEnv("CANARY_MIN_REQUESTS", "100"), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid CANARY_MIN_REQUESTS: %w", err)
+	}
+	if cfg.ErrorMargin, err = strconv.ParseFloat(getEnv("CANARY_ERROR_MARGIN", "0.01"), 64); err != nil {
+		return nil, fmt.Errorf("invalid CANARY_ERROR_MARGIN: %w", err)
+	}
+	if cfg.LatencyFactor, err = strconv.ParseFloat(getEnv("CANARY_LATENCY_FACTOR", "1.5"), 64); err != nil {
+		return nil, fmt.Errorf("invalid CANARY_LATENCY_FACTOR: %w", err)
+	}
+	canaries := NewCanaries(cfg, events.NewEmitter("gateway", events.FromEnv()))
+	for service, baseline := range baselines {
+		prefix := strings.ToUpper(strings.ReplaceAll(service, "-", "_")) + "_CANARY_"
+		target := os.Getenv(prefix + "URL")
+		if target == "" {
+			continue
+		}
+		percent, err := strconv.ParseFloat(getEnv(prefix+"PERCENT", "5"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid %sPERCENT %q", prefix, os.Getenv(prefix+"PERCENT"))
+		}
+		canaries.Add(service, baseline, target, percent)
+		log.Printf("canary for %s at %s gets %g%% of its traffic", service, target, percent)
+	}
+	return canaries, nil
+}
+
+// firewallFromEnv reads FIREWALL_ALLOW and FIREWALL_DENY (CIDR lists),
+// FIREWALL_GEO_HEADER and FIREWALL_BLOCK_COUNTRIES, and the payload limits
+// FIREWALL_MAX_ARRAY and FIREWALL_MAX_DEPTH. FIREWALL_PATTERNS=off disables
+// the suspicious pattern checks. Without FIREWALL_GEO_HEADER countries come
+// from geo, the GEOIP_DB database, if any.
+func firewallFromEnv(geo *geoip.DB) (*Firewall, error) {
+	var cfg FirewallConfig
+	var err error
+	if cfg.Allow, err = ParsePrefixes(os.Getenv("FIREWALL_ALLOW")); err != nil {
+		return nil, fmt.Errorf("invalid FIREWALL_ALLOW: %w", err)
+	}
+	if cfg.Deny, err = ParsePrefixes(os.Getenv("FIREWALL_DENY")); err != nil {
+		return nil, fmt.Errorf("invalid FIREWALL_DENY: %w", err)
+	}
+	if header := os.Getenv("FIREWALL_GEO_HEADER"); header != "" {
+		cfg.Geo = HeaderCountry(header)
+	} else if geo != nil {
+		cfg.Geo = GeoIP(geo)
+	}
+	for _, c := range strings.Split(os.Getenv("FIREWALL_BLOCK_COUNTRIES"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			cfg.BlockedCountries = append(cfg.BlockedCountries, c)
+		}
+	}
+	if getEnv("FIREWALL_PATTERNS", "on") != "off" {
+		cfg.Patterns = defaultSuspiciousPatterns
+	}
+	if cfg.MaxArrayLen, err = strconv.Atoi(getEnv("FIREWALL_MAX_ARRAY", "1000")); err != nil {
+		return nil, fmt.Errorf("invalid FIREWALL_MAX_ARRAY: %w", err)
+	}
+	if cfg.MaxDepth, err = strconv.Atoi(getEnv("FIREWALL_MAX_DEPTH", "32")); err != nil {
+		return nil, fmt.Errorf("invalid FIREWALL_MAX_DEPTH: %w", err)
+	}
+	return NewFirewall(cfg), nil
+}
+
+func main() {
+	userServiceURL := getEnv("USER_SERVICE_URL", "http://localhost:8081")
+	orderServiceURL := getEnv("ORDER_SERVICE_URL", "http://localhost:8082")
+	paymentServiceURL := getEnv("PAYMENT_SERVICE_URL", "http://localhost:8083")
+	notificationServiceURL := getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8085")
+
+	opts, err := server.OptionsFromEnv("Gateway", ":8080")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// With HTTP2=h2c the services are reached over a few multiplexed
+	// cleartext connections
+	upstreams, err := opts.HTTP2.Transport(opts.Conns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	canaries, err := canariesFromEnv(map[string]string{
+		"user-service":         userServiceURL,
+		"order-service":        orderServiceURL,
+		"payment-service":      paymentServiceURL,
+		"notification-service": notificationServiceURL,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	canaries.Start()
+	defer canaries.Close()
+	gateway, err := NewGateway(opts.Conns.Count(upstreams), canaries,
+		userServiceURL, orderServiceURL, paymentServiceURL, notificationServiceURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dedupeWindow, err := time.ParseDuration(getEnv("DEDUPE_WINDOW", "10s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dedupe := NewDeduplicator(dedupeWindow)
+	defer dedupe.Close()
+
+	// CACHE_MAX_ENTRIES=0 turns the response cache off
+	cacheEntries, err := strconv.Atoi(getEnv("CACHE_MAX_ENTRIES", "10000"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("invalid CACHE_MAX_ENTRIES: %w", err))
+	}
+	cache := NewCache(cacheEntries)
+	defer cache.Close()
+	// The event bus tells the cache what changed, and the cache the CDN
+	if purger := cdn.FromEnv(); purger != nil {
+		cache.PurgeCDN(purger)
+		opts.Features = append(opts.Features, "cdn_purge")
+	}
+	// Events suspend tenants, revoke clients and purge caches, so only the
+	// collector may post them, signing its deliveries with SIGNING_KEYS.
+	// Without keys the gateway takes no events, and hears of changes only
+	// as what it keeps expires.
+	receiveEvents := false
+	if spec := os.Getenv("SIGNING_KEYS"); spec != "" {
+		keys, err := signing.ParseKeyring(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		skew, err := time.ParseDuration(getEnv("SIGNING_SKEW", "30s"))
+		if err != nil {
+			log.Fatalf("invalid SIGNING_SKEW %q", os.Getenv("SIGNING_SKEW"))
+		}
+		gateway.router.Handle("receive-event", http.MethodPost, "/events",
+			signing.Require(keys, skew, "collector")(http.HandlerFunc(cache.HandleEvent)))
+		receiveEvents = true
+	} else {
+		log.Print("SIGNING_KEYS not set; not receiving events")
+	}
+	// Clients bootstrap a session from their user and unread count
+	gateway.router.Get("session", "/session", NewSession(userServiceURL, notificationServiceURL, upstreams).ServeHTTP)
+
+	tenantTTL, err := time.ParseDuration(getEnv("TENANT_STATUS_TTL", "30s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	userService := NewUserServiceTenants(userServiceURL, opts.Tokens, upstreams)
+	tenants := NewTenantGate(userService, tenantTTL)
+	cache.Observe(tenants.Observe)
+	// Partner clients are held to their own rate limits
+	clients := clientLimitsFromEnv(userService)
+	cache.Observe(clients.Observe)
+
+	meterFlush, err := time.ParseDuration(getEnv("METERING_FLUSH", "1m"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	meter := NewMeter(events.NewEmitter("gateway", events.FromEnv()), meterFlush)
+	defer meter.Close()
+
+	quotas, err := quota.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if quotas != nil {
+		gateway.router.Get("my-quota", "/quotas", quotas.Mine)
+		admin := middleware.RequireRole("admin")
+		gateway.router.Handle("list-quota-plans", http.MethodGet, "/admin/quotas/plans", admin(http.HandlerFunc(quotas.ListPlans)))
+		gateway.router.Handle("set-quota-limit", http.MethodPut, "/admin/quotas/plans/{plan}/{resource}", admin(http.HandlerFunc(quotas.PutLimit)))
+		gateway.router.Handle("get-quota-usage", http.MethodGet, "/admin/quotas/subjects/{subject}", admin(http.HandlerFunc(quotas.GetUsage)))
+		gateway.router.Handle("get-quota-plan", http.MethodGet, "/admin/quotas/subjects/{subject}/plan", admin(http.HandlerFunc(quotas.GetPlan)))
+		gateway.router.Handle("set-quota-plan", http.MethodPut, "/admin/quotas/subjects/{subject}/plan", admin(http.HandlerFunc(quotas.PutPlan)))
+		gateway.router.Handle("get-plan-features", http.MethodGet, "/admin/quotas/plans/{plan}/features", admin(http.HandlerFunc(quotas.GetFeatures)))
+		gateway.router.Handle("set-plan-features", http.MethodPut, "/admin/quotas/plans/{plan}/features", admin(http.HandlerFunc(quotas.PutFeatures)))
+	}
+	gateway.router.Handle("canaries", "", "/admin/canaries", middleware.RequireRole("admin")(canaries))
+	entitlementTTL, err := time.ParseDuration(getEnv("ENTITLEMENTS_TTL", "30s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// GEOIP_DB locates clients for the services and the firewall
+	var geo *geoip.DB
+	if path := os.Getenv("GEOIP_DB"); path != "" {
+		if geo, err = geoip.Open(path); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("GeoIP database %s: %d networks", path, geo.Len())
+	}
+	var geoCountry GeoLookup
+	if header := os.Getenv("FIREWALL_GEO_HEADER"); header != "" {
+		geoCountry = HeaderCountry(header)
+	}
+	firewall, err := firewallFromEnv(geo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The gateway starts every request's deadline budget
+	if opts.RequestBudget == 0 {
+		opts.RequestBudget = 5 * time.Second
+	}
+	// ...and classifies it as interactive or batch
+	opts.BatchPrefixes = strings.Split(getEnv("BATCH_PATHS", "/orders/import,/orders/export,/orders/bulk"), ",")
+	// Clients log in, or partners trade their credentials, to get a token
+	// in the first place
+	opts.PublicPaths = []string{"/users/login", "/users/login/verify", "/orders/guest", "/notifications/email/feedback", "/oauth/token",
+		"/payments/{id}/challenge"}
+	// The collector has no token; its signature stands for one
+	if receiveEvents {
+		opts.PublicPaths = append(opts.PublicPaths, "/events")
+	}
+	opts.Middleware = append(opts.Middleware, NewGeoTagger(geo, geoCountry).Middleware, firewall.Middleware, meter.Middleware)
+	// Suspended and deleted tenants are refused before they use any quota
+	opts.Middleware = append(opts.Middleware, tenants.Middleware, clients.Middleware)
+	// Every authenticated call counts against the caller's daily quota,
+	// cached answers included
+	if quotas != nil {
+		opts.Middleware = append(opts.Middleware, quotas.Middleware("api_calls"))
+		// ...and is checked against what their plan includes
+		opts.Middleware = append(opts.Middleware, NewEntitlements(quotas, entitlementTTL).Middleware)
+	}
+	opts.Middleware = append(opts.Middleware, dedupe.Middleware, cache.Middleware)
+	// The gateway serves what it can while a service is down, so downstreams
+	// are only reported on /readyz
+	opts.Startup = startup.New(0,
+		startup.Dependency{Name: "user-service", Check: startup.HTTP(userServiceURL + "/healthz"), Optional: true},
+		startup.Dependency{Name: "order-service", Check: startup.HTTP(orderServiceURL + "/healthz"), Optional: true},
+		startup.Dependency{Name: "payment-service", Check: startup.HTTP(paymentServiceURL + "/healthz"), Optional: true},
+		startup.Dependency{Name: "notification-service", Check: startup.HTTP(notificationServiceURL + "/healthz"), Optional: true},
+	)
+	if cacheEntries > 0 {
+		opts.Features = append(opts.Features, "response_cache")
+	}
+	if geo != nil {
+		opts.Features = append(opts.Features, "geoip")
+	}
+	if quotas != nil {
+		opts.Features = append(opts.Features, "quotas", "entitlements")
+	}
+	if len(canaries.byTarget) > 0 {
+		opts.Features = append(opts.Features, "canaries")
+	}
+	gateway.router.Limit(opts.Limits)
+	srv := server.NewServer(opts, gateway)
+	srv.Metrics.Register(firewall)
+	srv.Metrics.Register(cache)
+	srv.Metrics.Register(canaries)
+	srv.Metrics.Register(tenants)
+	srv.Metrics.Register(clients)
+	if err := srv.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+// gateway/metering.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/events"
+	"platform/middleware"
+)
+
+// meterKey is one tenant's calls in one hour; first-party callers have no
+// tenant
+type meterKey struct {
+	tenant string
+	hour   time.Time
+}
+
+// Meter counts API calls per tenant and hour and hands the counts to
+// order-service's billing as usage.metered events every flush interval, so
+// the event bus carries a handful of events a minute rather than one per
+// call. Each replica reports its own share; billing adds them up.
+type Meter struct {
+	mu     sync.Mutex
+	counts map[meterKey]int64
+	events *events.Emitter
+	clock  clock.Clock
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewMeter(emitter *events.Emitter, flushEvery time.Duration) *Meter {
+	m := &Meter{
+		counts: make(map[meterKey]int64),
+		events: emitter,
+		clock:  clock.System,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go m.flushLoop(flushEvery)
+	return m
+}
+
+// Close reports what is left, so a restart doesn't lose calls
+func (m *Meter) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *Meter) flushLoop(every time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-m.stop:
+			m.flush()
+			return
+		}
+	}
+}
+
+func (m *Meter) flush() {
+	m.mu.Lock()
+	counts := m.counts
+	m.counts = make(map[meterKey]int64)
+	m.mu.Unlock()
+
+	for key, n := range counts {
+		m.events.Emit(context.Background(), "usage.metered", "usage/"+key.tenant, map[string]any{
+			"tenant":   key.tenant,
+			"metric":   "api_calls",
+			"hour":     key.hour,
+			"quantity": n,
+		})
+	}
+}
+
+func (m *Meter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The event bus's deliveries aren't anyone's API calls
+		if r.URL.Path == "/events" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var tenant string
+		if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+			tenant = p.Tenant
+		}
+		key := meterKey{tenant: tenant, hour: m.clock.Now().Truncate(time.Hour)}
+		m.mu.Lock()
+		m.counts[key]++
+		m.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
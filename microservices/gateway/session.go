@@ -0,0 +1,105 @@
+// gateway/session.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"platform/middleware"
+)
+
+// Session serves GET /session, what a client loads once it has a token:
+// the caller's user, from user-service, and how many of their in-app
+// notifications are unread, from notification-service. Both are asked at
+// once with the caller's own token; the count is left out when
+// notification-service can't answer, the user can't be.
+type Session struct {
+	userServiceURL         string
+	notificationServiceURL string
+	client                 *http.Client
+}
+
+func NewSession(userServiceURL, notificationServiceURL string, transport http.RoundTripper) *Session {
+	return &Session{
+		userServiceURL:         userServiceURL,
+		notificationServiceURL: notificationServiceURL,
+		client:                 &http.Client{Transport: transport, Timeout: 2 * time.Second},
+	}
+}
+
+type sessionResponse struct {
+	User                json.RawMessage `json:"user"`
+	UnreadNotifications *int            `json:"unread_notifications,omitempty"`
+}
+
+// get fetches target as the caller, returning the status of anything but 200
+func (s *Session) get(ctx context.Context, r *http.Request, target string) (json.RawMessage, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	middleware.Propagate(ctx, req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("%s answered %s", target, resp.Status)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, 0, err
+	}
+	return body, http.StatusOK, nil
+}
+
+func (s *Session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no session without a token", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+
+	var unread *int
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		body, _, err := s.get(ctx, r, s.notificationServiceURL+"/users/"+url.PathEscape(p.Subject)+"/notifications/unread-count")
+		if err != nil {
+			log.Printf("session unread count: %v", err)
+			return
+		}
+		var count struct {
+			Unread int `json:"unread"`
+		}
+		if err := json.Unmarshal(body, &count); err == nil {
+			unread = &count.Unread
+		}
+	}()
+	user, status, err := s.get(ctx, r, s.userServiceURL+"/users/"+url.PathEscape(p.Subject))
+	wg.Wait()
+	switch {
+	case status == http.StatusNotFound:
+		// Tenant keys and service tokens have no user behind them
+		http.Error(w, "no user for this token", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("session user: %v", err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sessionResponse{User: user, UnreadNotifications: unread})
+}
@@ -0,0 +1,252 @@
+// gateway/tenants.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/events"
+	"platform/middleware"
+)
+
+// TenantStatusSource says what status a tenant is in, "" for a tenant it
+// doesn't know
+type TenantStatusSource interface {
+	TenantStatus(ctx context.Context, id string) (string, error)
+}
+
+// UserServiceTenants asks user-service, which provisions tenants
+type UserServiceTenants struct {
+	url string
+	// tokens sign the admin token user-service wants; nil when auth is off
+	tokens *auth.Tokens
+	client *http.Client
+}
+
+func NewUserServiceTenants(userServiceURL string, tokens *auth.Tokens, transport http.RoundTripper) *UserServiceTenants {
+	return &UserServiceTenants{url: userServiceURL, tokens: tokens, client: &http.Client{Transport: transport, Timeout: 2 * time.Second}}
+}
+
+// authorize adds the admin token user-service wants
+func (u *UserServiceTenants) authorize(req *http.Request) error {
+	if u.tokens == nil {
+		return nil
+	}
+	token, err := u.tokens.Issue(auth.Claims{Subject: "gateway", Roles: []string{"admin"}}, time.Minute)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (u *UserServiceTenants) TenantStatus(ctx context.Context, id string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url+"/tenants/"+url.PathEscape(id), nil)
+	if err != nil {
+		return "", err
+	}
+	if err := u.authorize(req); err != nil {
+		return "", err
+	}
+	middleware.Propagate(ctx, req)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("user-service answered %s", resp.Status)
+	}
+	var t struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	return t.Status, nil
+}
+
+// ClientRevoked finds the client among the tenant's; one user-service
+// doesn't know isn't revoked
+func (u *UserServiceTenants) ClientRevoked(ctx context.Context, tenant, id string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url+"/tenants/"+url.PathEscape(tenant)+"/oauth-clients", nil)
+	if err != nil {
+		return false, err
+	}
+	if err := u.authorize(req); err != nil {
+		return false, err
+	}
+	middleware.Propagate(ctx, req)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("user-service answered %s", resp.Status)
+	}
+	var clients []struct {
+		ID        string     `json:"client_id"`
+		RevokedAt *time.Time `json:"revoked_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return false, err
+	}
+	for _, c := range clients {
+		if c.ID == id {
+			return c.RevokedAt != nil, nil
+		}
+	}
+	return false, nil
+}
+
+type tenantStatus struct {
+	status  string
+	expires time.Time
+}
+
+// TenantGate turns away requests made with a tenant's keys unless the
+// tenant is active: suspended tenants are refused until they are resumed,
+// deleted ones for good, and new ones until provisioning is done. Tenants
+// user-service doesn't know predate provisioning and are let through.
+// Statuses are kept for ttl, and tenant events received at /events update
+// them at once.
+type TenantGate struct {
+	source TenantStatusSource
+	ttl    time.Duration
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	cached   map[string]tenantStatus
+	rejected map[string]int
+}
+
+func NewTenantGate(source TenantStatusSource, ttl time.Duration) *TenantGate {
+	return &TenantGate{
+		source:   source,
+		ttl:      ttl,
+		clock:    clock.System,
+		cached:   make(map[string]tenantStatus),
+		rejected: make(map[string]int),
+	}
+}
+
+// lookup returns the tenant's status. When the source can't be reached a
+// status kept past its ttl is still used, so suspensions hold through an
+// outage of user-service.
+func (g *TenantGate) lookup(ctx context.Context, id string) (string, error) {
+	now := g.clock.Now()
+	g.mu.Lock()
+	cached, ok := g.cached[id]
+	g.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.status, nil
+	}
+
+	status, err := g.source.TenantStatus(ctx, id)
+	if err != nil {
+		if ok {
+			return cached.status, nil
+		}
+		return "", err
+	}
+	g.set(id, status, now)
+	return status, nil
+}
+
+func (g *TenantGate) set(id, status string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.cached) > 10000 {
+		for t, c := range g.cached {
+			if now.After(c.expires) {
+				delete(g.cached, t)
+			}
+		}
+	}
+	g.cached[id] = tenantStatus{status: status, expires: now.Add(g.ttl)}
+}
+
+// Observe takes the status from tenant events, whose data is the tenant
+func (g *TenantGate) Observe(event events.Event) {
+	kind, id, ok := strings.Cut(event.Subject, "/")
+	if !ok || kind != "tenant" || id == "" {
+		return
+	}
+	data, _ := event.Data.(map[string]any)
+	if status, _ := data["status"].(string); status != "" {
+		g.set(id, status, g.clock.Now())
+		return
+	}
+	g.mu.Lock()
+	delete(g.cached, id)
+	g.mu.Unlock()
+}
+
+// tenantRefused is the 403 body, its error e.g. tenant_suspended
+type tenantRefused struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Tenant  string `json:"tenant"`
+}
+
+// Middleware checks the tenant of authenticated callers; admins act for no
+// tenant. A failure to look a tenant up with nothing kept lets the request
+// through, as entitlements do.
+func (g *TenantGate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := middleware.PrincipalFromContext(r.Context())
+		if !ok || p.Tenant == "" || p.HasRole("admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		status, err := g.lookup(r.Context(), p.Tenant)
+		if err != nil {
+			log.Printf("tenant %s: %v", p.Tenant, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if status == "" || status == "active" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g.mu.Lock()
+		g.rejected[status]++
+		g.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(tenantRefused{
+			Error:   "tenant_" + status,
+			Message: "tenant " + p.Tenant + " is " + status,
+			Tenant:  p.Tenant,
+		})
+	})
+}
+
+func (g *TenantGate) WriteMetrics(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	statuses := make([]string, 0, len(g.rejected))
+	for s := range g.rejected {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	fmt.Fprintln(w, "# TYPE gateway_tenant_rejected_total counter")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gateway_tenant_rejected_total{status=%q} %d\n", s, g.rejected[s])
+	}
+}
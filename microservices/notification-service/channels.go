@@ -0,0 +1,226 @@
+// notification-service/channels.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/middleware"
+)
+
+// Message is a rendered notification addressed to one recipient
+type Message struct {
+	// To is the address on the channel: an email address, a phone number,
+	// a device or a URL
+	To       string
+	Rendered *Rendered
+
+	// Where the message came from, kept with webhook deliveries
+	Tenant       string
+	Notification string
+	EventID      string
+}
+
+// Channel delivers messages over one medium
+type Channel interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPChannel sends multipart text/HTML email through an SMTP relay
+type SMTPChannel struct {
+	addr  string
+	from  string
+	auth  smtp.Auth
+	clock clock.Clock
+}
+
+func NewSMTPChannel(addr, from, username, password string) *SMTPChannel {
+	c := &SMTPChannel{addr: addr, from: from, clock: clock.System}
+	if username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		c.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return c
+}
+
+func (c *SMTPChannel) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return permanentError{fmt.Errorf("invalid recipient %q", msg.To)}
+	}
+	boundary := rand.Text()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", c.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Rendered.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", c.clock.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", msg.Rendered.Text},
+		{"text/html", msg.Rendered.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: %s; charset=utf-8\r\n\r\n", boundary, part.contentType)
+		b.WriteString(strings.ReplaceAll(part.body, "\n", "\r\n"))
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	err := smtp.SendMail(c.addr, c.auth, c.from, []string{msg.To}, b.Bytes())
+	// 5xx replies, like an unknown mailbox, won't succeed on a retry
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// WebhookChannel posts the rendered body to the recipient URL
+type WebhookChannel struct {
+	client *http.Client
+}
+
+func NewWebhookChannel() *WebhookChannel {
+	return &WebhookChannel{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (c *WebhookChannel) Send(ctx context.Context, msg Message) error {
+	_, _, err := c.Deliver(ctx, msg.To, msg.Rendered.Body, nil)
+	return err
+}
+
+// maxResponse is how much of a receiver's response is kept for inspection
+const maxResponse = 4 << 10
+
+// Deliver posts body to url and returns what the receiver answered
+func (c *WebhookChannel) Deliver(ctx context.Context, url, body string, header http.Header) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, permanentError{err}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	middleware.Propagate(ctx, req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if resp.StatusCode >= 300 {
+		// checkResponse reads what's left of the body for its message
+		resp.Body = io.NopCloser(bytes.NewReader(response))
+	}
+	return resp.StatusCode, response, checkResponse("webhook", resp)
+}
+
+// permanentError marks a failure retrying can't fix, such as a rejected
+// recipient
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// checkResponse turns a provider's error status into an error; client errors
+// other than timeouts and throttling are permanent
+func checkResponse(provider string, resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s returned %d: %s", provider, resp.StatusCode, bytes.TrimSpace(body))
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return permanentError{err}
+	}
+	return err
+}
+
+// TwilioChannel sends SMS through Twilio's Messages API, or any provider
+// that speaks it
+type TwilioChannel struct {
+	baseURL    string
+	accountSID string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+func NewTwilioChannel(baseURL, accountSID, authToken, from string) *TwilioChannel {
+	return &TwilioChannel{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *TwilioChannel) Send(ctx context.Context, msg Message) error {
+	form := url.Values{
+		"To":   {msg.To},
+		"From": {c.from},
+		"Body": {msg.Rendered.Text},
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", c.baseURL, url.PathEscape(c.accountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.accountSID, c.authToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse("twilio", resp)
+}
+
+// LogChannel prints messages instead of sending them, for local runs
+type LogChannel struct {
+	name string
+}
+
+func (c LogChannel) Send(ctx context.Context, msg Message) error {
+	r := msg.Rendered
+	switch {
+	case r.Body != "":
+		log.Printf("%s to %s: %s", c.name, msg.To, r.Body)
+	case r.Subject == "":
+		log.Printf("%s to %s: %s", c.name, msg.To, r.Text)
+	default:
+		log.Printf("%s to %s: %q\n%s", c.name, msg.To, r.Subject, r.Text)
+	}
+	return nil
+}
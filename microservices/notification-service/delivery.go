@@ -0,0 +1,133 @@
+// notification-service/delivery.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/middleware"
+)
+
+// Policy limits how fast a channel sends and how it retries failures
+type Policy struct {
+	// Rate is the sustained messages per second, with bursts up to Burst
+	Rate  float64
+	Burst int
+	// Attempts includes the first try; backoff doubles from Backoff up to
+	// MaxBackoff between attempts
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Providers bill and throttle SMS far more tightly than the other channels
+var defaultPolicies = map[string]Policy{
+	"email":   {Rate: 10, Burst: 20, Attempts: 3, Backoff: time.Second, MaxBackoff: 10 * time.Second},
+	"sms":     {Rate: 1, Burst: 5, Attempts: 3, Backoff: 2 * time.Second, MaxBackoff: 20 * time.Second},
+	"push":    {Rate: 50, Burst: 100, Attempts: 2, Backoff: 500 * time.Millisecond, MaxBackoff: 2 * time.Second},
+	"webhook": {Rate: 20, Burst: 40, Attempts: 5, Backoff: time.Second, MaxBackoff: 30 * time.Second},
+}
+
+// policyFromEnv overrides a channel's default policy with
+// <CHANNEL>_RATE, _BURST, _ATTEMPTS, _BACKOFF and _MAX_BACKOFF
+func policyFromEnv(channel string) (Policy, error) {
+	p := defaultPolicies[channel]
+	prefix := strings.ToUpper(channel) + "_"
+	for name, parse := range map[string]func(string) error{
+		"RATE": func(v string) (err error) {
+			p.Rate, err = strconv.ParseFloat(v, 64)
+			return err
+		},
+		"BURST": func(v string) (err error) {
+			p.Burst, err = strconv.Atoi(v)
+			return err
+		},
+		"ATTEMPTS": func(v string) (err error) {
+			p.Attempts, err = strconv.Atoi(v)
+			return err
+		},
+		"BACKOFF": func(v string) (err error) {
+			p.Backoff, err = time.ParseDuration(v)
+			return err
+		},
+		"MAX_BACKOFF": func(v string) (err error) {
+			p.MaxBackoff, err = time.ParseDuration(v)
+			return err
+		},
+	} {
+		if v := os.Getenv(prefix + name); v != "" {
+			if err := parse(v); err != nil {
+				return p, fmt.Errorf("%s%s: %w", prefix, name, err)
+			}
+		}
+	}
+	if p.Rate <= 0 || p.Burst < 1 || p.Attempts < 1 {
+		return p, fmt.Errorf("%s: rate, burst and attempts must be positive", channel)
+	}
+	return p, nil
+}
+
+// policyChannel applies a Policy to the channel it wraps
+type policyChannel struct {
+	name    string
+	next    Channel
+	policy  Policy
+	limiter *middleware.RateLimiter
+}
+
+func withPolicy(name string, next Channel, p Policy) *policyChannel {
+	return &policyChannel{
+		name:    name,
+		next:    next,
+		policy:  p,
+		limiter: middleware.NewRateLimiter(p.Rate, p.Burst),
+	}
+}
+
+// wait blocks until the channel's rate limit admits one more message
+func (c *policyChannel) wait(ctx context.Context) error {
+	for {
+		ok, wait := c.limiter.Allow(c.name)
+		if ok {
+			return nil
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *policyChannel) Send(ctx context.Context, msg Message) error {
+	backoff := c.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		if err := c.wait(ctx); err != nil {
+			return err
+		}
+		err := c.next.Send(ctx, msg)
+		if err == nil || isPermanent(err) || attempt >= c.policy.Attempts {
+			return err
+		}
+		log.Printf("%s delivery attempt %d/%d failed, retrying in %s: %v",
+			c.name, attempt, c.policy.Attempts, backoff, err)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(2*backoff, c.policy.MaxBackoff)
+	}
+}
@@ -0,0 +1,538 @@
+// notification-service/digest.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+)
+
+// Digest frequencies. Immediate sends every email as it happens; the others
+// gather a user's digestible emails into one sent at the end of the window
+// that began with the first of them.
+const (
+	DigestImmediate = "immediate"
+	DigestHourly    = "hourly"
+	DigestDaily     = "daily"
+)
+
+var digestWindows = map[string]time.Duration{
+	DigestImmediate: 0,
+	DigestHourly:    time.Hour,
+	DigestDaily:     24 * time.Hour,
+}
+
+// digested are the notifications whose emails may wait for a digest.
+// Transactional ones, such as order confirmations, always go out at once,
+// and only email is batched: push and SMS are for what can't wait.
+var digested = map[string]bool{"wishlist_price_drop": true}
+
+// digestTemplate is the notification rendered for a digest, with the
+// entries as .items
+const digestTemplate = "digest"
+
+// DigestEntry is an email waiting for its user's next digest
+type DigestEntry struct {
+	ID           int64     `json:"id"`
+	UserID       int       `json:"user_id"`
+	Tenant       string    `json:"tenant"`
+	Notification string    `json:"notification"`
+	EventID      string    `json:"event_id"`
+	Subject      string    `json:"subject"`
+	Text         string    `json:"text"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DigestRepository stores users' digest frequencies and pending digests
+type DigestRepository interface {
+	// Frequency returns the user's digest frequency, immediate when unset
+	Frequency(ctx context.Context, userID int) (string, error)
+	// SetFrequency changes it; a digest already pending goes out by dueBy
+	// at the latest
+	SetFrequency(ctx context.Context, userID int, frequency string, dueBy time.Time) error
+	// Queue adds e to its user's pending digest, which is due at due unless
+	// it was already pending. An event queued before is ignored, leaving
+	// e.ID zero.
+	Queue(ctx context.Context, e *DigestEntry, due time.Time) error
+	// ClaimDue returns the users whose digest is due and pushes it back by
+	// lease, so concurrent workers skip them
+	ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]int, error)
+	// Pending returns the user's queued entries, oldest first
+	Pending(ctx context.Context, userID int) ([]DigestEntry, error)
+	// Sent removes the user's entries up to through; any queued meanwhile
+	// make the digest due at next
+	Sent(ctx context.Context, userID int, through int64, next time.Time) error
+	// MergeUser moves user from's pending entries to user to, and their
+	// frequency where to has chosen none
+	MergeUser(ctx context.Context, from, to int) error
+}
+
+type PostgresDigestRepository struct {
+	db *dbretry.DB
+}
+
+func (r *PostgresDigestRepository) Frequency(ctx context.Context, userID int) (string, error) {
+	var frequency string
+	err := r.db.QueryRowContext(ctx, `SELECT frequency FROM digests WHERE user_id = $1`, userID).Scan(&frequency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DigestImmediate, nil
+	}
+	return frequency, err
+}
+
+func (r *PostgresDigestRepository) SetFrequency(ctx context.Context, userID int, frequency string, dueBy time.Time) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO digests (user_id, frequency) VALUES ($1, $2)
+              ON CONFLICT (user_id) DO UPDATE SET frequency = EXCLUDED.frequency,
+                  due_at = CASE WHEN digests.due_at > $3 THEN $3 ELSE digests.due_at END, updated_at = now()`,
+		userID, frequency, dueBy)
+	return err
+}
+
+func (r *PostgresDigestRepository) Queue(ctx context.Context, e *DigestEntry, due time.Time) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `INSERT INTO digest_entries (user_id, tenant, notification, event_id, subject, text)
+              VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_id, event_id) DO NOTHING
+              RETURNING id, created_at`,
+			e.UserID, e.Tenant, e.Notification, e.EventID, e.Subject, e.Text).Scan(&e.ID, &e.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE digests SET due_at = COALESCE(due_at, $2) WHERE user_id = $1`, e.UserID, due)
+		return err
+	})
+}
+
+func (r *PostgresDigestRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, `UPDATE digests SET due_at = $2
+              WHERE user_id IN (
+                  SELECT user_id FROM digests WHERE due_at <= $1
+                  ORDER BY due_at LIMIT $3
+                  FOR UPDATE SKIP LOCKED)
+              RETURNING user_id`,
+		now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		users = append(users, id)
+	}
+	return users, rows.Err()
+}
+
+func (r *PostgresDigestRepository) Pending(ctx context.Context, userID int) ([]DigestEntry, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, user_id, tenant, notification, event_id, subject, text, created_at
+              FROM digest_entries WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []DigestEntry
+	for rows.Next() {
+		var e DigestEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Tenant, &e.Notification, &e.EventID, &e.Subject, &e.Text, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (r *PostgresDigestRepository) Sent(ctx context.Context, userID int, through int64, next time.Time) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM digest_entries WHERE user_id = $1 AND id <= $2`, userID, through)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE digests SET due_at =
+                  CASE WHEN EXISTS (SELECT 1 FROM digest_entries WHERE user_id = $1) THEN $2::timestamptz END
+              WHERE user_id = $1`, userID, next)
+		return err
+	})
+}
+
+func (r *PostgresDigestRepository) MergeUser(ctx context.Context, from, to int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		statements := []string{
+			// LEAST ignores nulls, so either user's pending digest keeps its time
+			`INSERT INTO digests (user_id, frequency, due_at)
+         SELECT $2, frequency, due_at FROM digests WHERE user_id = $1
+         ON CONFLICT (user_id) DO UPDATE SET due_at = LEAST(digests.due_at, EXCLUDED.due_at), updated_at = now()`,
+			`UPDATE digest_entries SET user_id = $2 WHERE user_id = $1
+         AND event_id NOT IN (SELECT event_id FROM digest_entries WHERE user_id = $2)`,
+			`DELETE FROM digest_entries WHERE user_id = $1`,
+			`DELETE FROM digests WHERE user_id = $1`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type memoryDigest struct {
+	frequency string
+	due       *time.Time
+}
+
+// MemoryDigestRepository keeps digests in process memory
+type MemoryDigestRepository struct {
+	mu      sync.Mutex
+	digests map[int]*memoryDigest
+	entries []DigestEntry
+	nextID  int64
+}
+
+func NewMemoryDigestRepository() *MemoryDigestRepository {
+	return &MemoryDigestRepository{digests: make(map[int]*memoryDigest)}
+}
+
+func (r *MemoryDigestRepository) Frequency(ctx context.Context, userID int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d := r.digests[userID]; d != nil {
+		return d.frequency, nil
+	}
+	return DigestImmediate, nil
+}
+
+func (r *MemoryDigestRepository) SetFrequency(ctx context.Context, userID int, frequency string, dueBy time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := r.digests[userID]
+	if d == nil {
+		d = &memoryDigest{}
+		r.digests[userID] = d
+	}
+	d.frequency = frequency
+	if d.due != nil && d.due.After(dueBy) {
+		d.due = &dueBy
+	}
+	return nil
+}
+
+func (r *MemoryDigestRepository) Queue(ctx context.Context, e *DigestEntry, due time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, queued := range r.entries {
+		if queued.UserID == e.UserID && queued.EventID == e.EventID {
+			return nil
+		}
+	}
+	r.nextID++
+	e.ID = r.nextID
+	e.CreatedAt = clock.System.Now()
+	r.entries = append(r.entries, *e)
+	if d := r.digests[e.UserID]; d != nil && d.due == nil {
+		d.due = &due
+	}
+	return nil
+}
+
+func (r *MemoryDigestRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var users []int
+	for id, d := range r.digests {
+		if len(users) == limit {
+			break
+		}
+		if d.due == nil || d.due.After(now) {
+			continue
+		}
+		next := now.Add(lease)
+		d.due = &next
+		users = append(users, id)
+	}
+	return users, nil
+}
+
+func (r *MemoryDigestRepository) Pending(ctx context.Context, userID int) ([]DigestEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []DigestEntry
+	for _, e := range r.entries {
+		if e.UserID == userID {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (r *MemoryDigestRepository) Sent(ctx context.Context, userID int, through int64, next time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = slices.DeleteFunc(r.entries, func(e DigestEntry) bool {
+		return e.UserID == userID && e.ID <= through
+	})
+	d := r.digests[userID]
+	if d == nil {
+		return nil
+	}
+	d.due = nil
+	if slices.ContainsFunc(r.entries, func(e DigestEntry) bool { return e.UserID == userID }) {
+		d.due = &next
+	}
+	return nil
+}
+
+func (r *MemoryDigestRepository) MergeUser(ctx context.Context, from, to int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d := r.digests[from]; d != nil {
+		if into := r.digests[to]; into == nil {
+			r.digests[to] = d
+		} else if into.due == nil || (d.due != nil && d.due.Before(*into.due)) {
+			into.due = d.due
+		}
+		delete(r.digests, from)
+	}
+	var moved []DigestEntry
+	for _, e := range r.entries {
+		switch {
+		case e.UserID != from:
+			moved = append(moved, e)
+		case !slices.ContainsFunc(r.entries, func(q DigestEntry) bool { return q.UserID == to && q.EventID == e.EventID }):
+			e.UserID = to
+			moved = append(moved, e)
+		}
+	}
+	r.entries = moved
+	return nil
+}
+
+// Digests holds back digestible emails of users who asked for a digest
+// and sends each user's as one email when their window ends
+type Digests struct {
+	repo    DigestRepository
+	service *NotificationService
+	clock   clock.Clock
+}
+
+func NewDigests(repo DigestRepository, service *NotificationService) *Digests {
+	return &Digests{repo: repo, service: service, clock: clock.System}
+}
+
+// queue holds the rendered email back for the recipient's digest, if they
+// get one and the notification may wait for it
+func (d *Digests) queue(ctx context.Context, eventID, tenant, name string, recipient *Recipient, rendered *Rendered) (bool, error) {
+	if !digested[name] {
+		return false, nil
+	}
+	frequency, err := d.repo.Frequency(ctx, recipient.ID)
+	if err != nil {
+		return false, err
+	}
+	window := digestWindows[frequency]
+	if window == 0 {
+		return false, nil
+	}
+	e := &DigestEntry{
+		UserID:       recipient.ID,
+		Tenant:       tenant,
+		Notification: name,
+		EventID:      eventID,
+		Subject:      rendered.Subject,
+		Text:         rendered.Text,
+	}
+	if err := d.repo.Queue(ctx, e, d.clock.Now().Add(window)); err != nil {
+		return false, err
+	}
+	if e.ID == 0 {
+		// Redelivered; it is in the digest already
+		return true, nil
+	}
+	log.Printf("queued %s for user %d's %s digest", name, recipient.ID, frequency)
+	return true, nil
+}
+
+// flush sends the user's pending digest. The entries stay queued if it
+// fails, to be tried again once the claim's lease runs out.
+func (d *Digests) flush(ctx context.Context, userID int) error {
+	frequency, err := d.repo.Frequency(ctx, userID)
+	if err != nil {
+		return err
+	}
+	next := d.clock.Now().Add(digestWindows[frequency])
+	entries, err := d.repo.Pending(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return d.repo.Sent(ctx, userID, 0, next)
+	}
+	last := entries[len(entries)-1]
+
+	set, err := d.service.prefs.Preferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+	email, ok := d.service.channels["email"]
+	if !ok || !enabledChannels(set)["email"] {
+		log.Printf("dropped user %d's digest of %d emails: email is off", userID, len(entries))
+		return d.repo.Sent(ctx, userID, last.ID, next)
+	}
+	recipient, err := d.service.fetchRecipient(ctx, userID)
+	if err != nil {
+		return err
+	}
+	suppressed, err := d.service.suppressed(ctx, recipient.Email)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		log.Printf("dropped user %d's digest of %d emails: their address is suppressed", userID, len(entries))
+		return d.repo.Sent(ctx, userID, last.ID, next)
+	}
+	// Users belong to one tenant, whose digest template the latest entry names
+	t, err := resolveTemplate(ctx, d.service.templates, last.Tenant, digestTemplate, "email", recipient.Profile.Locale)
+	if err != nil {
+		return fmt.Errorf("digest template: %w", err)
+	}
+	items := make([]map[string]any, len(entries))
+	for i, e := range entries {
+		items[i] = map[string]any{
+			"notification": e.Notification,
+			"subject":      e.Subject,
+			"text":         e.Text,
+			"queued_at":    e.CreatedAt,
+		}
+	}
+	rendered, err := t.Render(map[string]any{
+		"user":      jsonMap(recipient),
+		"tenant":    last.Tenant,
+		"frequency": frequency,
+		"count":     len(entries),
+		"items":     items,
+	})
+	if err != nil {
+		return fmt.Errorf("render digest v%d: %w", t.Version, err)
+	}
+	msg := Message{
+		To:           recipient.Email,
+		Rendered:     rendered,
+		Tenant:       last.Tenant,
+		Notification: digestTemplate,
+		EventID:      fmt.Sprintf("digest/%d/%d", userID, last.ID),
+	}
+	if err := email.Send(ctx, msg); err != nil {
+		return fmt.Errorf("send digest: %w", err)
+	}
+	log.Printf("sent %s digest of %d emails to user %d (template v%d, locale %q)",
+		frequency, len(entries), userID, t.Version, t.Locale)
+	return d.repo.Sent(ctx, userID, last.ID, next)
+}
+
+// Run sends the digests that are due every interval until ctx is done
+func (d *Digests) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			users, err := d.repo.ClaimDue(ctx, d.clock.Now(), 5*time.Minute, 50)
+			if err != nil {
+				log.Printf("claim due digests: %v", err)
+				continue
+			}
+			for _, userID := range users {
+				if err := d.flush(ctx, userID); err != nil {
+					log.Printf("digest for user %d: %v", userID, err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DigestAPI serves /notifications/users/{id}/digest to the user themselves
+// and to admins
+type DigestAPI struct {
+	digests *Digests
+}
+
+type digestSetting struct {
+	UserID    int    `json:"user_id"`
+	Frequency string `json:"frequency"`
+	Pending   int    `json:"pending"`
+}
+
+func (a *DigestAPI) write(w http.ResponseWriter, r *http.Request, id int) {
+	frequency, err := a.digests.repo.Frequency(r.Context(), id)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	entries, err := a.digests.repo.Pending(r.Context(), id)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, digestSetting{UserID: id, Frequency: frequency, Pending: len(entries)})
+}
+
+func (a *DigestAPI) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	a.write(w, r, id)
+}
+
+// Put sets the user's frequency, {"frequency": "daily"}. A shorter window
+// brings a pending digest forward; immediate sends it now.
+func (a *DigestAPI) Put(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Frequency string `json:"frequency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window, ok := digestWindows[req.Frequency]
+	if !ok {
+		http.Error(w, "frequency must be immediate, hourly or daily", http.StatusUnprocessableEntity)
+		return
+	}
+	dueBy := a.digests.clock.Now().Add(window)
+	if err := a.digests.repo.SetFrequency(r.Context(), id, req.Frequency, dueBy); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.write(w, r, id)
+}
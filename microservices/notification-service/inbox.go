@@ -0,0 +1,368 @@
+// notification-service/inbox.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/router"
+)
+
+// Inbox pages are newest first
+const (
+	defaultInboxPage = 20
+	maxInboxPage     = 100
+)
+
+// InboxItem is a notification as the user's in-app inbox shows it
+type InboxItem struct {
+	ID           int64      `json:"id"`
+	UserID       int        `json:"user_id"`
+	Tenant       string     `json:"tenant,omitempty"`
+	Notification string     `json:"notification"`
+	EventID      string     `json:"event_id"`
+	Title        string     `json:"title"`
+	Body         string     `json:"body,omitempty"`
+	ReadAt       *time.Time `json:"read_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// InboxFilter selects a user's items newest first; Before pages by ID
+type InboxFilter struct {
+	UserID int
+	Unread bool
+	Before int64
+	Limit  int
+}
+
+// InboxRepository stores the users' inboxes
+type InboxRepository interface {
+	// Add stores item; an event already in the user's inbox is ignored
+	Add(ctx context.Context, item *InboxItem) error
+	List(ctx context.Context, f InboxFilter) ([]InboxItem, error)
+	Unread(ctx context.Context, userID int) (int, error)
+	// MarkRead marks the user's items read, all of them when ids is empty,
+	// and returns how many were unread
+	MarkRead(ctx context.Context, userID int, ids []int64, at time.Time) (int, error)
+	// MergeUser moves user from's inbox to user to
+	MergeUser(ctx context.Context, from, to int) error
+}
+
+type PostgresInboxRepository struct {
+	db *dbretry.DB
+}
+
+func (r *PostgresInboxRepository) Add(ctx context.Context, item *InboxItem) error {
+	err := r.db.QueryRowContext(ctx, `INSERT INTO inbox (user_id, tenant, notification, event_id, title, body)
+              VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_id, event_id) DO NOTHING
+              RETURNING id, created_at`,
+		item.UserID, item.Tenant, item.Notification, item.EventID, item.Title, item.Body).Scan(&item.ID, &item.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (r *PostgresInboxRepository) List(ctx context.Context, f InboxFilter) ([]InboxItem, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, user_id, tenant, notification, event_id, title, body, read_at, created_at
+              FROM inbox WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL) AND ($3 = 0 OR id < $3)
+              ORDER BY id DESC LIMIT $4`,
+		f.UserID, f.Unread, f.Before, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []InboxItem
+	for rows.Next() {
+		var item InboxItem
+		var readAt sql.NullTime
+		if err := rows.Scan(&item.ID, &item.UserID, &item.Tenant, &item.Notification, &item.EventID,
+			&item.Title, &item.Body, &readAt, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		if readAt.Valid {
+			item.ReadAt = &readAt.Time
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (r *PostgresInboxRepository) Unread(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM inbox WHERE user_id = $1 AND read_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+func (r *PostgresInboxRepository) MarkRead(ctx context.Context, userID int, ids []int64, at time.Time) (int, error) {
+	if len(ids) == 0 {
+		res, err := r.db.ExecContext(ctx, `UPDATE inbox SET read_at = $2 WHERE user_id = $1 AND read_at IS NULL`, userID, at)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}
+	marked := 0
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		marked = 0
+		for _, id := range ids {
+			res, err := tx.ExecContext(ctx, `UPDATE inbox SET read_at = $3 WHERE user_id = $1 AND id = $2 AND read_at IS NULL`,
+				userID, id, at)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil {
+				marked += int(n)
+			}
+		}
+		return nil
+	})
+	return marked, err
+}
+
+func (r *PostgresInboxRepository) MergeUser(ctx context.Context, from, to int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		statements := []string{
+			`UPDATE inbox SET user_id = $2 WHERE user_id = $1
+         AND event_id NOT IN (SELECT event_id FROM inbox WHERE user_id = $2)`,
+			`DELETE FROM inbox WHERE user_id = $1`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MemoryInboxRepository keeps the inboxes in process memory
+type MemoryInboxRepository struct {
+	mu     sync.Mutex
+	items  []InboxItem
+	nextID int64
+}
+
+func NewMemoryInboxRepository() *MemoryInboxRepository {
+	return &MemoryInboxRepository{}
+}
+
+func (r *MemoryInboxRepository) Add(ctx context.Context, item *InboxItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.items {
+		if existing.UserID == item.UserID && existing.EventID == item.EventID {
+			return nil
+		}
+	}
+	r.nextID++
+	item.ID = r.nextID
+	item.CreatedAt = clock.System.Now()
+	r.items = append(r.items, *item)
+	return nil
+}
+
+func (r *MemoryInboxRepository) List(ctx context.Context, f InboxFilter) ([]InboxItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var items []InboxItem
+	for i := len(r.items) - 1; i >= 0 && len(items) < f.Limit; i-- {
+		item := r.items[i]
+		if item.UserID != f.UserID || (f.Unread && item.ReadAt != nil) || (f.Before != 0 && item.ID >= f.Before) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (r *MemoryInboxRepository) Unread(ctx context.Context, userID int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, item := range r.items {
+		if item.UserID == userID && item.ReadAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemoryInboxRepository) MarkRead(ctx context.Context, userID int, ids []int64, at time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for i := range r.items {
+		item := &r.items[i]
+		if item.UserID == userID && item.ReadAt == nil && (len(ids) == 0 || slices.Contains(ids, item.ID)) {
+			item.ReadAt = &at
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemoryInboxRepository) MergeUser(ctx context.Context, from, to int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var kept []InboxItem
+	for _, item := range r.items {
+		switch {
+		case item.UserID != from:
+			kept = append(kept, item)
+		case !slices.ContainsFunc(r.items, func(i InboxItem) bool { return i.UserID == to && i.EventID == item.EventID }):
+			item.UserID = to
+			kept = append(kept, item)
+		}
+	}
+	r.items = kept
+	return nil
+}
+
+// InboxChannel delivers to the in-app inbox, addressed by user ID. Its
+// templates' Subject is the title and Text the body.
+type InboxChannel struct {
+	repo InboxRepository
+}
+
+func (c *InboxChannel) Send(ctx context.Context, msg Message) error {
+	userID, err := strconv.Atoi(msg.To)
+	if err != nil {
+		return permanentError{err}
+	}
+	return c.repo.Add(ctx, &InboxItem{
+		UserID:       userID,
+		Tenant:       msg.Tenant,
+		Notification: msg.Notification,
+		EventID:      msg.EventID,
+		Title:        msg.Rendered.Subject,
+		Body:         msg.Rendered.Text,
+	})
+}
+
+// InboxAPI serves /users/{id}/notifications to the user themselves and to
+// admins
+type InboxAPI struct {
+	repo  InboxRepository
+	clock clock.Clock
+}
+
+type unreadCount struct {
+	UserID int `json:"user_id"`
+	Unread int `json:"unread"`
+}
+
+// List pages through the inbox newest first: before=ID, limit=N, and
+// unread=true for only the unread items
+func (a *InboxAPI) List(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	f := InboxFilter{UserID: id, Unread: q.Get("unread") == "true", Limit: defaultInboxPage}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		f.Before = before
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(limit, maxInboxPage)
+	}
+
+	items, err := a.repo.List(r.Context(), f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if items == nil {
+		items = []InboxItem{}
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func (a *InboxAPI) UnreadCount(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	a.writeUnread(w, r, id)
+}
+
+func (a *InboxAPI) writeUnread(w http.ResponseWriter, r *http.Request, id int) {
+	n, err := a.repo.Unread(r.Context(), id)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, unreadCount{UserID: id, Unread: n})
+}
+
+// MarkRead marks the items in {"ids": [...]} read, or with no body or no
+// ids every item, and answers with what is still unread
+func (a *InboxAPI) MarkRead(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxInboxPage {
+		http.Error(w, "too many ids; leave them out to mark everything read", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := a.repo.MarkRead(r.Context(), id, req.IDs, a.clock.Now()); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writeUnread(w, r, id)
+}
+
+// MarkOneRead marks the path's item read. Marking an item read again, or
+// one that isn't the user's, changes nothing.
+func (a *InboxAPI) MarkOneRead(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	itemID, err := strconv.ParseInt(router.Param(r, "item"), 10, 64)
+	if err != nil {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if _, err := a.repo.MarkRead(r.Context(), id, []int64{itemID}, a.clock.Now()); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writeUnread(w, r, id)
+}
@@ -0,0 +1,520 @@
+// notification-service/main.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/backup"
+	"platform/clock"
+	"platform/codec"
+	"platform/dbretry"
+	"platform/events"
+	"platform/middleware"
+	"platform/router"
+	"platform/server"
+	"platform/startup"
+
+	_ "github.com/lib/pq"
+)
+
+// Recipient is the part of a user-service user a notification needs
+type Recipient struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Profile struct {
+		Phone          string `json:"phone"`
+		Locale         string `json:"locale"`
+		Timezone       string `json:"timezone"`
+		MarketingOptIn bool   `json:"marketing_opt_in"`
+	} `json:"profile"`
+}
+
+// notification maps an event type to the template sent for it
+type notification struct {
+	template string
+	// dataKey is where the event's data appears in the template data
+	dataKey string
+}
+
+var notifications = map[string]notification{
+	"order.completed":         {template: "order_confirmation", dataKey: "order"},
+	"wishlist.price_dropped":  {template: "wishlist_price_drop", dataKey: "item"},
+	"user.login_challenged":   {template: "login_code", dataKey: "login"},
+	"user.new_device_login":   {template: "new_device_login", dataKey: "login"},
+	"user.guest_claim_issued": {template: "guest_claim", dataKey: "guest"},
+}
+
+// essential are the notifications about the account's security, emailed
+// even to users who turned email off
+var essential = map[string]bool{"login_code": true, "new_device_login": true, "guest_claim": true}
+
+type NotificationService struct {
+	templates      TemplateRepository
+	prefs          PreferenceRepository
+	channels       map[string]Channel
+	userServiceURL string
+	// webhookURL receives every webhook notification, and subscriptions
+	// a tenant's; with neither there are no webhooks
+	webhookURL    string
+	subscriptions SubscriptionRepository
+	// digests hold emails back for users who want them batched; nil sends
+	// every one at once
+	digests *Digests
+	// suppressions are addresses no email goes to; nil emails everyone
+	suppressions SuppressionRepository
+	// events learns of self-test pings coming back
+	events *events.Emitter
+}
+
+func NewNotificationService(templates TemplateRepository, prefs PreferenceRepository, userServiceURL string) *NotificationService {
+	return &NotificationService{
+		templates:      templates,
+		prefs:          prefs,
+		channels:       make(map[string]Channel),
+		userServiceURL: userServiceURL,
+	}
+}
+
+// Service-to-service communication
+func (s *NotificationService) fetchRecipient(ctx context.Context, userID int) (*Recipient, error) {
+	url := fmt.Sprintf("%s/users/%d", s.userServiceURL, userID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	middleware.Propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	middleware.RecordUpstream(ctx, "user-service", time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("user service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	var recipient Recipient
+	if err := json.NewDecoder(resp.Body).Decode(&recipient); err != nil {
+		return nil, err
+	}
+	return &recipient, nil
+}
+
+// addresses lists where a channel delivers the tenant's notification name
+// to for a recipient: one address, for push every registered device, and
+// for webhooks every subscribed URL
+func (s *NotificationService) addresses(ctx context.Context, channel, tenant, name string, recipient *Recipient) ([]string, error) {
+	switch channel {
+	case "email":
+		suppressed, err := s.suppressed(ctx, recipient.Email)
+		if err != nil {
+			return nil, err
+		}
+		if suppressed {
+			log.Printf("not emailing %s to user %d: their address is suppressed", name, recipient.ID)
+			return nil, nil
+		}
+		return []string{recipient.Email}, nil
+	case "sms":
+		if recipient.Profile.Phone != "" {
+			return []string{recipient.Profile.Phone}, nil
+		}
+	case "inbox":
+		return []string{strconv.Itoa(recipient.ID)}, nil
+	case "push":
+		devices, err := s.prefs.Devices(ctx, recipient.ID)
+		if err != nil {
+			return nil, err
+		}
+		var to []string
+		for _, d := range devices {
+			to = append(to, d.Platform+":"+d.Token)
+		}
+		return to, nil
+	case "webhook":
+		var to []string
+		if s.webhookURL != "" {
+			to = append(to, s.webhookURL)
+		}
+		if s.subscriptions == nil || tenant == "" {
+			return to, nil
+		}
+		subs, err := s.subscriptions.List(ctx, tenant)
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range subs {
+			if sub.wants(name) && !slices.Contains(to, sub.URL) {
+				to = append(to, sub.URL)
+			}
+		}
+		return to, nil
+	}
+	return nil, nil
+}
+
+// notify renders the template for every configured channel the recipient
+// hasn't turned off and sends it; a failure on one channel doesn't stop
+// the others
+func (s *NotificationService) notify(ctx context.Context, eventID, tenant, name string, recipient *Recipient, data map[string]any) error {
+	set, err := s.prefs.Preferences(ctx, recipient.ID)
+	if err != nil {
+		return err
+	}
+	enabled := enabledChannels(set)
+
+	var errs []error
+	for channelName, channel := range s.channels {
+		if on, ok := enabled[channelName]; ok && !on && !(essential[name] && channelName == "email") {
+			continue
+		}
+		to, err := s.addresses(ctx, channelName, tenant, name, recipient)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(to) == 0 {
+			continue
+		}
+		t, err := resolveTemplate(ctx, s.templates, tenant, name, channelName, recipient.Profile.Locale)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rendered, err := t.Render(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("render %s/%s v%d: %w", name, channelName, t.Version, err))
+			continue
+		}
+		if channelName == "email" && s.digests != nil {
+			queued, err := s.digests.queue(ctx, eventID, tenant, name, recipient, rendered)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("queue %s for digest: %w", name, err))
+				continue
+			}
+			if queued {
+				continue
+			}
+		}
+		for _, addr := range to {
+			msg := Message{To: addr, Rendered: rendered, Tenant: tenant, Notification: name, EventID: eventID}
+			if err := channel.Send(ctx, msg); err != nil {
+				errs = append(errs, fmt.Errorf("send %s via %s: %w", name, channelName, err))
+				continue
+			}
+			log.Printf("sent %s via %s to user %d (template v%d, locale %q)",
+				name, channelName, recipient.ID, t.Version, t.Locale)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HandleEvent receives events from the broker and sends the notification
+// mapped to the event type; other events are acknowledged and ignored
+func (s *NotificationService) HandleEvent(w http.ResponseWriter, r *http.Request) {
+	var event events.Event
+	if err := codec.Decode(r, &event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.events.Received(event) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	n, ok := notifications[event.Type]
+	if !ok {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	data, _ := event.Data.(map[string]any)
+	userID, ok := data["user_id"].(float64)
+	if !ok {
+		http.Error(w, "event has no user_id", http.StatusUnprocessableEntity)
+		return
+	}
+	tenant, _ := data["tenant"].(string)
+
+	ctx := r.Context()
+	recipient, err := s.fetchRecipient(ctx, int(userID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	templateData := map[string]any{
+		"user":    jsonMap(recipient),
+		"tenant":  tenant,
+		"event":   map[string]any{"id": event.ID, "type": event.Type, "occurred_at": event.OccurredAt},
+		n.dataKey: data,
+	}
+	if err := s.notify(ctx, event.ID, tenant, n.template, recipient, templateData); err != nil {
+		log.Printf("event %s: %v", event.ID, err)
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// jsonMap gives templates the same field names as the JSON APIs
+func jsonMap(v any) map[string]any {
+	b, _ := json.Marshal(v)
+	var m map[string]any
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// channelsFromEnv configures the channels addressed to users. Email, SMS
+// and push fall back to logging when their provider isn't configured.
+func channelsFromEnv() (map[string]Channel, error) {
+	channels := make(map[string]Channel)
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		channels["email"] = NewSMTPChannel(addr, getEnv("SMTP_FROM", "no-reply@example.com"),
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	} else {
+		log.Print("SMTP_ADDR not set; emails are logged instead of sent")
+		channels["email"] = LogChannel{name: "email"}
+	}
+
+	if sid := os.Getenv("TWILIO_ACCOUNT_SID"); sid != "" {
+		channels["sms"] = NewTwilioChannel(getEnv("TWILIO_URL", "https://api.twilio.com"), sid,
+			os.Getenv("TWILIO_AUTH_TOKEN"), os.Getenv("TWILIO_FROM"))
+	} else {
+		log.Print("TWILIO_ACCOUNT_SID not set; text messages are logged instead of sent")
+		channels["sms"] = LogChannel{name: "sms"}
+	}
+
+	push := NewPushChannel()
+	if project := os.Getenv("FCM_PROJECT"); project != "" {
+		// The token file is rewritten by whatever refreshes the OAuth token
+		tokenFile := os.Getenv("FCM_ACCESS_TOKEN_FILE")
+		push.Add(PlatformFCM, NewFCMChannel(project, func() string {
+			b, err := os.ReadFile(tokenFile)
+			if err != nil {
+				log.Printf("fcm access token: %v", err)
+			}
+			return strings.TrimSpace(string(b))
+		}))
+	}
+	if keyFile := os.Getenv("APNS_KEY_FILE"); keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		apns, err := NewAPNsChannel(key, os.Getenv("APNS_KEY_ID"), os.Getenv("APNS_TEAM_ID"),
+			os.Getenv("APNS_TOPIC"), os.Getenv("APNS_SANDBOX") == "true")
+		if err != nil {
+			return nil, err
+		}
+		push.Add(PlatformAPNs, apns)
+	}
+	for _, platform := range []string{PlatformFCM, PlatformAPNs} {
+		if !push.Supports(platform) {
+			log.Printf("%s not configured; push notifications to %s devices are logged", platform, platform)
+			push.Add(platform, LogChannel{name: platform})
+		}
+	}
+	channels["push"] = push
+	return channels, nil
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	dbURL := os.Getenv("DATABASE_URL")
+	userServiceURL := getEnv("USER_SERVICE_URL", "http://localhost:8081")
+
+	// "backup [file]" and "restore [file]" dump and restore the schema, for
+	// disaster recovery drills
+	if len(os.Args) > 1 {
+		if err := backup.Command(context.Background(), os.Args[1:], "notification-service", dbURL, schema, migrations()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	repos, database, err := openRepository(os.Getenv("STORAGE"), dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	boot, err := startup.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if database != nil {
+		// Default templates go in once the database is migrated
+		ready := database.Check
+		database.Check = func(ctx context.Context) error {
+			if err := ready(ctx); err != nil {
+				return err
+			}
+			return seedDefaults(ctx, repos.Templates)
+		}
+		boot.Add(*database)
+	} else if err := seedDefaults(ctx, repos.Templates); err != nil {
+		log.Fatal(err)
+	}
+	boot.Add(startup.Dependency{Name: "user-service", Check: startup.HTTP(userServiceURL + "/healthz"), Optional: true})
+	emitter := events.NewEmitter("notification-service", events.FromEnv())
+	if url := os.Getenv("EVENTS_URL"); url != "" {
+		boot.Add(startup.Dependency{Name: "events", Check: startup.Reachable(url), SelfTest: emitter.SelfTest, Optional: true})
+	}
+
+	service := NewNotificationService(repos.Templates, repos.Preferences, userServiceURL)
+	channels, err := channelsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, channel := range channels {
+		policy, err := policyFromEnv(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		service.channels[name] = withPolicy(name, channel, policy)
+	}
+
+	// Webhooks keep a delivery log and retry from it in the background
+	webhookPolicy, err := policyFromEnv("webhook")
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks := NewWebhookDeliveries(repos.Deliveries, NewWebhookChannel(), webhookPolicy, emitter)
+	service.webhookURL = os.Getenv("WEBHOOK_URL")
+	service.subscriptions = repos.Subscriptions
+	service.suppressions = repos.Suppressions
+	service.events = emitter
+	service.channels["webhook"] = webhooks
+	// The inbox is this service's own table; nothing to throttle or retry
+	service.channels["inbox"] = &InboxChannel{repo: repos.Inbox}
+	retryCtx, stopRetries := context.WithCancel(ctx)
+	defer stopRetries()
+	go func() {
+		<-boot.Ready()
+		webhooks.Run(retryCtx, 5*time.Second)
+	}()
+	// Backfills and contractions wait until the service is up
+	if repos.Migrations != nil {
+		go func() {
+			<-boot.Ready()
+			repos.Migrations.Run(retryCtx, 30*time.Second)
+		}()
+	}
+
+	// Digests go out as their users' windows end
+	digests := NewDigests(repos.Digests, service)
+	service.digests = digests
+	digestInterval := time.Minute
+	if v := os.Getenv("DIGEST_INTERVAL"); v != "" {
+		if digestInterval, err = time.ParseDuration(v); err != nil || digestInterval <= 0 {
+			log.Fatalf("invalid DIGEST_INTERVAL %q", v)
+		}
+	}
+	go func() {
+		<-boot.Ready()
+		digests.Run(retryCtx, digestInterval)
+	}()
+
+	// Template edits are for admins and marketing
+	admin := &TemplateAdmin{repo: repos.Templates, clock: clock.System}
+	editor := middleware.RequireRole("admin", "marketing")
+	rt := router.New()
+	rt.Post("receive-event", "/events", service.HandleEvent)
+	rt.Get("list-templates", "/notifications/templates", admin.List)
+	rt.Get("get-template", "/notifications/templates/{name}/{channel}", admin.Get)
+	rt.Handle("put-template", http.MethodPut, "/notifications/templates/{name}/{channel}", editor(http.HandlerFunc(admin.Put)))
+	rt.Get("list-template-versions", "/notifications/templates/{name}/{channel}/versions", admin.Versions)
+	rt.Handle("activate-template-version", http.MethodPost, "/notifications/templates/{name}/{channel}/versions/{version}/activate",
+		editor(http.HandlerFunc(admin.Activate)))
+	rt.Post("preview-template", "/notifications/templates/{name}/{channel}/preview", admin.Preview)
+
+	preferences := &PreferenceAPI{repo: repos.Preferences, digests: repos.Digests, inbox: repos.Inbox}
+	rt.Get("get-preferences", "/notifications/users/{id}/preferences", preferences.Get)
+	rt.Put("update-preferences", "/notifications/users/{id}/preferences", preferences.Put)
+	rt.Get("list-devices", "/notifications/users/{id}/devices", preferences.ListDevices)
+	rt.Post("register-device", "/notifications/users/{id}/devices", preferences.AddDevice)
+	rt.Delete("remove-device", "/notifications/users/{id}/devices/{platform}/{token}", preferences.RemoveDevice)
+	// The gateway routes /users/{id}/notifications here
+	inbox := &InboxAPI{repo: repos.Inbox, clock: clock.System}
+	rt.Get("list-inbox", "/users/{id}/notifications", inbox.List)
+	rt.Get("count-unread-inbox", "/users/{id}/notifications/unread-count", inbox.UnreadCount)
+	rt.Post("mark-inbox-read", "/users/{id}/notifications/read", inbox.MarkRead)
+	rt.Post("mark-inbox-item-read", "/users/{id}/notifications/{item}/read", inbox.MarkOneRead)
+	digestAPI := &DigestAPI{digests: digests}
+	rt.Get("get-digest", "/notifications/users/{id}/digest", digestAPI.Get)
+	rt.Put("update-digest", "/notifications/users/{id}/digest", digestAPI.Put)
+	rt.Handle("merge-user-preferences", http.MethodPost, "/notifications/users/{id}/merge",
+		middleware.RequireRole("admin")(http.HandlerFunc(preferences.Merge)))
+
+	// Bounces and complaints come from the email provider, which has no
+	// token; it sends EMAIL_FEEDBACK_SECRET instead
+	feedbackSecret := os.Getenv("EMAIL_FEEDBACK_SECRET")
+	if feedbackSecret == "" {
+		log.Print("EMAIL_FEEDBACK_SECRET not set; refusing email feedback")
+	}
+	rt.Post("receive-email-feedback", feedbackPath, NewEmailFeedback(repos.Suppressions, feedbackSecret).Receive)
+	suppressions := &SuppressionAPI{repo: repos.Suppressions, clock: clock.System}
+	support := middleware.RequireRole("admin", "support")
+	rt.Handle("list-suppressions", http.MethodGet, "/notifications/suppressions", support(http.HandlerFunc(suppressions.List)))
+	rt.Handle("get-suppression", http.MethodGet, "/notifications/suppressions/{address}", support(http.HandlerFunc(suppressions.Get)))
+	rt.Handle("put-suppression", http.MethodPut, "/notifications/suppressions/{address}", support(http.HandlerFunc(suppressions.Put)))
+	rt.Handle("delete-suppression", http.MethodDelete, "/notifications/suppressions/{address}",
+		support(http.HandlerFunc(suppressions.Delete)))
+
+	// Integrators recover failed webhook deliveries themselves
+	deliveries := &DeliveryAPI{deliveries: webhooks}
+	integrator := middleware.RequireRole("admin", "integrator")
+	rt.Handle("list-webhook-deliveries", http.MethodGet, "/notifications/webhooks/deliveries",
+		integrator(http.HandlerFunc(deliveries.List)))
+	rt.Handle("get-webhook-delivery", http.MethodGet, "/notifications/webhooks/deliveries/{id}",
+		integrator(http.HandlerFunc(deliveries.Get)))
+	rt.Handle("replay-webhook-delivery", http.MethodPost, "/notifications/webhooks/deliveries/{id}/replay",
+		integrator(http.HandlerFunc(deliveries.Replay)))
+	rt.Handle("replay-webhook-deliveries", http.MethodPost, "/notifications/webhooks/deliveries/replay",
+		integrator(http.HandlerFunc(deliveries.ReplayBulk)))
+	// ...and say where their webhooks go
+	subscriptions := &SubscriptionAPI{repo: repos.Subscriptions}
+	rt.Handle("list-webhook-subscriptions", http.MethodGet, "/notifications/webhooks/subscriptions",
+		integrator(http.HandlerFunc(subscriptions.List)))
+	rt.Handle("get-webhook-subscription", http.MethodGet, "/notifications/webhooks/subscriptions/{id}",
+		integrator(http.HandlerFunc(subscriptions.Get)))
+	rt.Handle("put-webhook-subscription", http.MethodPut, "/notifications/webhooks/subscriptions/{id}",
+		integrator(http.HandlerFunc(subscriptions.Put)))
+	rt.Handle("delete-webhook-subscription", http.MethodDelete, "/notifications/webhooks/subscriptions/{id}",
+		integrator(http.HandlerFunc(subscriptions.Delete)))
+	rt.ServeOpenAPI("notification-service", "1.0")
+
+	opts, err := server.OptionsFromEnv("Notification service", ":8085")
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.PoolStats = repos.Stats
+	opts.PublicPaths = []string{feedbackPath}
+	opts.Startup = boot
+	rt.Limit(opts.Limits)
+	if err := server.NewServer(opts, rt).Run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,18 @@
+// notification-service/migrations.go
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Schema owned by notification-service; its migrations may not touch any other
+const schema = "notifications"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func migrations() fs.FS {
+	sub, _ := fs.Sub(migrationFiles, "migrations")
+	return sub
+}
@@ -0,0 +1,21 @@
+-- Every edit adds a version; exactly one version per template key is
+-- active. tenant '' holds the defaults, locale '' matches any language.
+CREATE TABLE IF NOT EXISTS templates (
+    id SERIAL PRIMARY KEY,
+    tenant TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    locale TEXT NOT NULL DEFAULT '',
+    version INTEGER NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    html TEXT NOT NULL DEFAULT '',
+    text TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT false,
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tenant, name, channel, locale, version)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS templates_active_idx
+    ON templates (tenant, name, channel, locale) WHERE active;
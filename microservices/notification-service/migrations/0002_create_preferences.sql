@@ -0,0 +1,20 @@
+-- Channels a user turned on or off; channels without a row use the
+-- service's defaults
+CREATE TABLE IF NOT EXISTS channel_preferences (
+    user_id INTEGER NOT NULL,
+    channel TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, channel)
+);
+
+-- Push devices; a token belongs to whichever user registered it last
+CREATE TABLE IF NOT EXISTS devices (
+    platform TEXT NOT NULL,
+    token TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (platform, token)
+);
+
+CREATE INDEX IF NOT EXISTS devices_user_idx ON devices (user_id);
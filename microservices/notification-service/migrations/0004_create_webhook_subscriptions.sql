@@ -0,0 +1,15 @@
+-- Where each tenant's webhooks go, managed declaratively: the ID is the
+-- caller's, and etag guards against overwriting a change made since it
+-- was read.
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id TEXT PRIMARY KEY,
+    tenant TEXT NOT NULL DEFAULT '',
+    url TEXT NOT NULL,
+    notifications JSONB NOT NULL DEFAULT '[]',
+    disabled BOOLEAN NOT NULL DEFAULT false,
+    etag TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_tenant_idx ON webhook_subscriptions (tenant);
@@ -0,0 +1,24 @@
+-- How often users want their digestible emails; users without a row get
+-- them as they happen. due_at is when the pending digest goes out, null
+-- while nothing is queued.
+CREATE TABLE IF NOT EXISTS digests (
+    user_id INTEGER PRIMARY KEY,
+    frequency TEXT NOT NULL,
+    due_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS digests_due_idx ON digests (due_at) WHERE due_at IS NOT NULL;
+
+-- Emails waiting for a user's next digest, rendered when they were queued
+CREATE TABLE IF NOT EXISTS digest_entries (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    notification TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    text TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, event_id)
+);
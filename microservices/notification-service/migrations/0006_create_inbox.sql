@@ -0,0 +1,16 @@
+-- The in-app inbox: every notification a user was sent, read or not
+CREATE TABLE IF NOT EXISTS inbox (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    notification TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL DEFAULT '',
+    read_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS inbox_user_idx ON inbox (user_id, id);
+CREATE INDEX IF NOT EXISTS inbox_unread_idx ON inbox (user_id) WHERE read_at IS NULL;
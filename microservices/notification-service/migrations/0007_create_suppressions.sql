@@ -0,0 +1,11 @@
+-- Email addresses nothing is sent to any more: they bounced for good, their
+-- owner marked a message as spam, or an operator put them here
+CREATE TABLE IF NOT EXISTS suppressions (
+    address TEXT PRIMARY KEY,
+    reason TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS suppressions_reason_idx ON suppressions (reason, address);
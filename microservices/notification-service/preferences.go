@@ -0,0 +1,409 @@
+// notification-service/preferences.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Users may opt out of email and push; SMS costs money per message, so it
+// needs an explicit opt-in. Webhooks aren't addressed to users and ignore
+// preferences, and the in-app inbox keeps everything a user was sent.
+var defaultPreferences = map[string]bool{
+	"email": true,
+	"push":  true,
+	"sms":   false,
+}
+
+// Device is a phone or browser registered for push notifications
+type Device struct {
+	UserID    int       `json:"user_id"`
+	Platform  string    `json:"platform"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PreferenceRepository stores channel choices and push devices per user
+type PreferenceRepository interface {
+	// Preferences returns only the channels the user set explicitly
+	Preferences(ctx context.Context, userID int) (map[string]bool, error)
+	SetPreferences(ctx context.Context, userID int, channels map[string]bool) error
+	Devices(ctx context.Context, userID int) ([]Device, error)
+	// AddDevice registers d, moving the token over if another user had it
+	AddDevice(ctx context.Context, d *Device) error
+	RemoveDevice(ctx context.Context, userID int, platform, token string) error
+	// MergeUser moves user from's devices to user to, and their channel
+	// choices where to has made none
+	MergeUser(ctx context.Context, from, to int) error
+}
+
+// enabledChannels merges a user's choices over the defaults
+func enabledChannels(set map[string]bool) map[string]bool {
+	channels := maps.Clone(defaultPreferences)
+	maps.Copy(channels, set)
+	return channels
+}
+
+type PostgresPreferenceRepository struct {
+	db *dbretry.DB
+}
+
+func (r *PostgresPreferenceRepository) Preferences(ctx context.Context, userID int) (map[string]bool, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT channel, enabled FROM channel_preferences WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := make(map[string]bool)
+	for rows.Next() {
+		var channel string
+		var enabled bool
+		if err := rows.Scan(&channel, &enabled); err != nil {
+			return nil, err
+		}
+		prefs[channel] = enabled
+	}
+	return prefs, rows.Err()
+}
+
+func (r *PostgresPreferenceRepository) SetPreferences(ctx context.Context, userID int, channels map[string]bool) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		for channel, enabled := range channels {
+			_, err := tx.ExecContext(ctx, `INSERT INTO channel_preferences (user_id, channel, enabled) VALUES ($1, $2, $3)
+              ON CONFLICT (user_id, channel) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = now()`,
+				userID, channel, enabled)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *PostgresPreferenceRepository) Devices(ctx context.Context, userID int) ([]Device, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT user_id, platform, token, created_at FROM devices
+              WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.UserID, &d.Platform, &d.Token, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (r *PostgresPreferenceRepository) AddDevice(ctx context.Context, d *Device) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO devices (platform, token, user_id) VALUES ($1, $2, $3)
+              ON CONFLICT (platform, token) DO UPDATE SET user_id = EXCLUDED.user_id, created_at = now()
+              RETURNING created_at`,
+		d.Platform, d.Token, d.UserID).Scan(&d.CreatedAt)
+}
+
+func (r *PostgresPreferenceRepository) RemoveDevice(ctx context.Context, userID int, platform, token string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM devices WHERE user_id = $1 AND platform = $2 AND token = $3`,
+		userID, platform, token)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresPreferenceRepository) MergeUser(ctx context.Context, from, to int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		statements := []string{
+			`INSERT INTO channel_preferences (user_id, channel, enabled)
+         SELECT $2, channel, enabled FROM channel_preferences WHERE user_id = $1
+         ON CONFLICT (user_id, channel) DO NOTHING`,
+			`DELETE FROM channel_preferences WHERE user_id = $1`,
+			`UPDATE devices SET user_id = $2 WHERE user_id = $1`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MemoryPreferenceRepository keeps preferences in process memory
+type MemoryPreferenceRepository struct {
+	mu      sync.RWMutex
+	prefs   map[int]map[string]bool
+	devices []Device
+}
+
+func NewMemoryPreferenceRepository() *MemoryPreferenceRepository {
+	return &MemoryPreferenceRepository{prefs: make(map[int]map[string]bool)}
+}
+
+func (r *MemoryPreferenceRepository) Preferences(ctx context.Context, userID int) (map[string]bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	prefs := maps.Clone(r.prefs[userID])
+	if prefs == nil {
+		prefs = make(map[string]bool)
+	}
+	return prefs, nil
+}
+
+func (r *MemoryPreferenceRepository) SetPreferences(ctx context.Context, userID int, channels map[string]bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.prefs[userID] == nil {
+		r.prefs[userID] = make(map[string]bool)
+	}
+	maps.Copy(r.prefs[userID], channels)
+	return nil
+}
+
+func (r *MemoryPreferenceRepository) Devices(ctx context.Context, userID int) ([]Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var devices []Device
+	for _, d := range r.devices {
+		if d.UserID == userID {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (r *MemoryPreferenceRepository) AddDevice(ctx context.Context, d *Device) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d.CreatedAt = clock.System.Now()
+	for i, existing := range r.devices {
+		if existing.Platform == d.Platform && existing.Token == d.Token {
+			r.devices[i] = *d
+			return nil
+		}
+	}
+	r.devices = append(r.devices, *d)
+	return nil
+}
+
+func (r *MemoryPreferenceRepository) RemoveDevice(ctx context.Context, userID int, platform, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, d := range r.devices {
+		if d.UserID == userID && d.Platform == platform && d.Token == token {
+			r.devices = append(r.devices[:i], r.devices[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *MemoryPreferenceRepository) MergeUser(ctx context.Context, from, to int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if prefs := r.prefs[from]; prefs != nil {
+		if r.prefs[to] == nil {
+			r.prefs[to] = make(map[string]bool)
+		}
+		for channel, enabled := range prefs {
+			if _, ok := r.prefs[to][channel]; !ok {
+				r.prefs[to][channel] = enabled
+			}
+		}
+		delete(r.prefs, from)
+	}
+	for i := range r.devices {
+		if r.devices[i].UserID == from {
+			r.devices[i].UserID = to
+		}
+	}
+	return nil
+}
+
+// PreferenceAPI serves /notifications/users/{id}/... to the user themselves
+// and to admins
+type PreferenceAPI struct {
+	repo PreferenceRepository
+	// digests and inboxes follow users into the account they are merged
+	// into
+	digests DigestRepository
+	inbox   InboxRepository
+}
+
+// userID reads the path's user and checks the caller may act for them
+func userID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok &&
+		p.Subject != strconv.Itoa(id) && !p.HasRole("admin") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return id, true
+}
+
+func (a *PreferenceAPI) writePreferences(w http.ResponseWriter, r *http.Request, id int) {
+	set, err := a.repo.Preferences(r.Context(), id)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"user_id": id, "channels": enabledChannels(set)})
+}
+
+func (a *PreferenceAPI) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	a.writePreferences(w, r, id)
+}
+
+// Put changes the channels in the body, e.g. {"sms": true, "email": false};
+// the others keep their current setting
+func (a *PreferenceAPI) Put(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var channels map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&channels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for channel := range channels {
+		if _, ok := defaultPreferences[channel]; !ok {
+			http.Error(w, fmt.Sprintf("unknown channel %q", channel), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if err := a.repo.SetPreferences(r.Context(), id, channels); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writePreferences(w, r, id)
+}
+
+func (a *PreferenceAPI) ListDevices(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	devices, err := a.repo.Devices(r.Context(), id)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if devices == nil {
+		devices = []Device{}
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (a *PreferenceAPI) AddDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var d Device
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if d.Platform != PlatformFCM && d.Platform != PlatformAPNs {
+		http.Error(w, "platform must be fcm or apns", http.StatusUnprocessableEntity)
+		return
+	}
+	if d.Token == "" {
+		http.Error(w, "token is required", http.StatusUnprocessableEntity)
+		return
+	}
+	d.UserID = id
+	if err := a.repo.AddDevice(r.Context(), &d); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, d)
+}
+
+func (a *PreferenceAPI) RemoveDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	err := a.repo.RemoveDevice(r.Context(), id, router.Param(r, "platform"), router.Param(r, "token"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Merge is user-service's account merge step for notification-service:
+// the path's user's devices, preferences, pending digest and inbox follow
+// them into the user in {"into": id}. Admins only.
+func (a *PreferenceAPI) Merge(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Into int `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Into <= 0 || req.Into == from {
+		http.Error(w, "into must be another user", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := a.repo.MergeUser(r.Context(), from, req.Into); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if err := a.digests.MergeUser(r.Context(), from, req.Into); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if err := a.inbox.MergeUser(r.Context(), from, req.Into); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,210 @@
+// notification-service/push.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Push devices are addressed as "<platform>:<token>"
+const (
+	PlatformFCM  = "fcm"
+	PlatformAPNs = "apns"
+)
+
+// PushChannel delivers to a device through the adapter for its platform
+type PushChannel struct {
+	adapters map[string]Channel
+}
+
+func NewPushChannel() *PushChannel {
+	return &PushChannel{adapters: make(map[string]Channel)}
+}
+
+// Add registers the adapter for a platform
+func (c *PushChannel) Add(platform string, adapter Channel) {
+	c.adapters[platform] = adapter
+}
+
+// Supports reports whether devices of platform can be reached
+func (c *PushChannel) Supports(platform string) bool {
+	_, ok := c.adapters[platform]
+	return ok
+}
+
+func (c *PushChannel) Send(ctx context.Context, msg Message) error {
+	platform, token, _ := strings.Cut(msg.To, ":")
+	adapter, ok := c.adapters[platform]
+	if !ok {
+		return permanentError{fmt.Errorf("no push adapter for %q", platform)}
+	}
+	msg.To = token
+	return adapter.Send(ctx, msg)
+}
+
+// FCMChannel sends through the Firebase Cloud Messaging HTTP v1 API. The
+// OAuth access token comes from outside, e.g. a sidecar that refreshes it.
+type FCMChannel struct {
+	endpoint    string
+	accessToken func() string
+	client      *http.Client
+}
+
+func NewFCMChannel(project string, accessToken func() string) *FCMChannel {
+	return &FCMChannel{
+		endpoint:    fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", project),
+		accessToken: accessToken,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *FCMChannel) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"token": msg.To,
+			"notification": map[string]string{
+				"title": msg.Rendered.Subject,
+				"body":  msg.Rendered.Text,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.accessToken())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse("fcm", resp)
+}
+
+// APNsChannel sends through Apple's HTTP/2 provider API, authenticating
+// with a token signed by the team's .p8 key
+type APNsChannel struct {
+	host   string
+	topic  string
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// APNs rejects provider tokens older than an hour and throttles ones
+// refreshed more often than every 20 minutes
+const apnsTokenTTL = 50 * time.Minute
+
+// NewAPNsChannel parses the PEM encoded .p8 key. sandbox selects Apple's
+// development environment.
+func NewAPNsChannel(keyPEM []byte, keyID, teamID, topic string, sandbox bool) (*APNsChannel, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("apns: key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("apns: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns: key is not an ECDSA key")
+	}
+	host := "https://api.push.apple.com"
+	if sandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+	return &APNsChannel{
+		host:   host,
+		topic:  topic,
+		keyID:  keyID,
+		teamID: teamID,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// providerToken returns the cached ES256 JWT, signing a new one when it
+// is about to expire
+func (c *APNsChannel) providerToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.token != "" && now.Sub(c.issuedAt) < apnsTokenTTL {
+		return c.token, nil
+	}
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": c.keyID})
+	claims, _ := json.Marshal(map[string]any{"iss": c.teamID, "iat": now.Unix()})
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants r and s as fixed width big-endian integers, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	c.token = signed + "." + enc.EncodeToString(sig)
+	c.issuedAt = now
+	return c.token, nil
+}
+
+func (c *APNsChannel) Send(ctx context.Context, msg Message) error {
+	token, err := c.providerToken()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{
+		"aps": map[string]any{
+			"alert": map[string]string{
+				"title": msg.Rendered.Subject,
+				"body":  msg.Rendered.Text,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host+"/3/device/"+msg.To, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", c.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse("apns", resp)
+}
@@ -0,0 +1,319 @@
+// notification-service/repository.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"platform/dbretry"
+	"platform/migrate"
+	"platform/startup"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// TemplateKey identifies a template whose versions replace one another
+type TemplateKey struct {
+	Tenant  string `json:"tenant"`
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	Locale  string `json:"locale"`
+}
+
+// TemplateRepository hides the storage backend from the handlers
+type TemplateRepository interface {
+	// Create stores t as the next version of its key and activates it
+	Create(ctx context.Context, t *Template) error
+	Active(ctx context.Context, key TemplateKey) (*Template, error)
+	Version(ctx context.Context, key TemplateKey, version int) (*Template, error)
+	Versions(ctx context.Context, key TemplateKey) ([]Template, error)
+	Activate(ctx context.Context, key TemplateKey, version int) error
+	// List returns the active version of every template of a tenant
+	List(ctx context.Context, tenant string) ([]Template, error)
+}
+
+// Repositories are the stores of one backend
+type Repositories struct {
+	Templates   TemplateRepository
+	Preferences PreferenceRepository
+	Deliveries  DeliveryRepository
+	// Subscriptions say where tenants' webhooks go
+	Subscriptions SubscriptionRepository
+	// Digests hold emails for users who want them batched
+	Digests DigestRepository
+	Inbox   InboxRepository
+	// Suppressions are addresses email bounced from or was complained of
+	Suppressions SuppressionRepository
+	// Stats exposes connection pool statistics for load shedding; nil for
+	// backends without a pool
+	Stats func() sql.DBStats
+	// Migrations applies the backfills and contractions startup leaves;
+	// nil for backends without a schema
+	Migrations *migrate.Online
+}
+
+// openRepository selects the backend: "postgres" (default) for production,
+// "memory" for running locally without any external dependencies. The
+// database dependency is readied by startup, which retries it until it is
+// up, and round-trips a query in self-tests; memory has none.
+func openRepository(storage, dbURL string) (*Repositories, *startup.Dependency, error) {
+	switch storage {
+	case "", "postgres":
+		db, err := dbretry.Open(dbURL, schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The database may still be coming up; startup retries this
+		database := &startup.Dependency{Name: "database", SelfTest: startup.SQL(db.DB), Check: func(ctx context.Context) error {
+			if err := db.PingContext(ctx); err != nil {
+				return err
+			}
+			return migrate.Run(ctx, db.DB, migrations(), schema)
+		}}
+		return &Repositories{
+			Templates:     &PostgresTemplateRepository{db: db},
+			Preferences:   &PostgresPreferenceRepository{db: db},
+			Deliveries:    &PostgresDeliveryRepository{db: db},
+			Subscriptions: &PostgresSubscriptionRepository{db: db},
+			Digests:       &PostgresDigestRepository{db: db},
+			Inbox:         &PostgresInboxRepository{db: db},
+			Suppressions:  &PostgresSuppressionRepository{db: db},
+			Stats:         db.Stats,
+			Migrations:    migrate.NewOnline(db.DB, migrations(), schema),
+		}, database, nil
+	case "memory":
+		return &Repositories{
+			Templates:     NewMemoryTemplateRepository(),
+			Preferences:   NewMemoryPreferenceRepository(),
+			Deliveries:    NewMemoryDeliveryRepository(),
+			Subscriptions: NewMemorySubscriptionRepository(),
+			Digests:       NewMemoryDigestRepository(),
+			Inbox:         NewMemoryInboxRepository(),
+			Suppressions:  NewMemorySuppressionRepository(),
+		}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+type PostgresTemplateRepository struct {
+	db *dbretry.DB
+}
+
+const templateColumns = `tenant, name, channel, locale, version, subject, html, text, body, active, created_by, created_at`
+
+func scanTemplate(scan func(...any) error, t *Template) error {
+	return scan(&t.Tenant, &t.Name, &t.Channel, &t.Locale, &t.Version,
+		&t.Subject, &t.HTML, &t.Text, &t.Body, &t.Active, &t.CreatedBy, &t.CreatedAt)
+}
+
+func (r *PostgresTemplateRepository) Create(ctx context.Context, t *Template) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		// Serialize writers of the same key so versions stay gapless
+		key := t.Key()
+		_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2 || '/' || $3 || '/' || $4))`,
+			key.Tenant, key.Name, key.Channel, key.Locale)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) + 1 FROM templates
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4`,
+			key.Tenant, key.Name, key.Channel, key.Locale).Scan(&t.Version)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE templates SET active = false
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4 AND active`,
+			key.Tenant, key.Name, key.Channel, key.Locale)
+		if err != nil {
+			return err
+		}
+		t.Active = true
+		_, err = tx.ExecContext(ctx, `INSERT INTO templates (`+templateColumns+`)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			t.Tenant, t.Name, t.Channel, t.Locale, t.Version,
+			t.Subject, t.HTML, t.Text, t.Body, t.Active, t.CreatedBy, t.CreatedAt)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *PostgresTemplateRepository) Active(ctx context.Context, key TemplateKey) (*Template, error) {
+	var t Template
+	err := scanTemplate(r.db.QueryRowContext(ctx, `SELECT `+templateColumns+` FROM templates
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4 AND active`,
+		key.Tenant, key.Name, key.Channel, key.Locale).Scan, &t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *PostgresTemplateRepository) Version(ctx context.Context, key TemplateKey, version int) (*Template, error) {
+	var t Template
+	err := scanTemplate(r.db.QueryRowContext(ctx, `SELECT `+templateColumns+` FROM templates
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4 AND version = $5`,
+		key.Tenant, key.Name, key.Channel, key.Locale, version).Scan, &t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *PostgresTemplateRepository) query(ctx context.Context, query string, args ...any) ([]Template, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []Template
+	for rows.Next() {
+		var t Template
+		if err := scanTemplate(rows.Scan, &t); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+func (r *PostgresTemplateRepository) Versions(ctx context.Context, key TemplateKey) ([]Template, error) {
+	return r.query(ctx, `SELECT `+templateColumns+` FROM templates
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4 ORDER BY version`,
+		key.Tenant, key.Name, key.Channel, key.Locale)
+}
+
+func (r *PostgresTemplateRepository) Activate(ctx context.Context, key TemplateKey, version int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE templates SET active = false
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4 AND active`,
+			key.Tenant, key.Name, key.Channel, key.Locale)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `UPDATE templates SET active = true
+              WHERE tenant = $1 AND name = $2 AND channel = $3 AND locale = $4 AND version = $5`,
+			key.Tenant, key.Name, key.Channel, key.Locale, version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresTemplateRepository) List(ctx context.Context, tenant string) ([]Template, error) {
+	return r.query(ctx, `SELECT `+templateColumns+` FROM templates
+              WHERE tenant = $1 AND active ORDER BY name, channel, locale`, tenant)
+}
+
+// MemoryTemplateRepository keeps templates in process memory
+type MemoryTemplateRepository struct {
+	mu       sync.RWMutex
+	versions map[TemplateKey][]Template
+}
+
+func NewMemoryTemplateRepository() *MemoryTemplateRepository {
+	return &MemoryTemplateRepository{versions: make(map[TemplateKey][]Template)}
+}
+
+func (r *MemoryTemplateRepository) Create(ctx context.Context, t *Template) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := t.Key()
+	versions := r.versions[key]
+	for i := range versions {
+		versions[i].Active = false
+	}
+	t.Version = len(versions) + 1
+	t.Active = true
+	r.versions[key] = append(versions, *t)
+	return nil
+}
+
+func (r *MemoryTemplateRepository) Active(ctx context.Context, key TemplateKey) (*Template, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, t := range r.versions[key] {
+		if t.Active {
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryTemplateRepository) Version(ctx context.Context, key TemplateKey, version int) (*Template, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.versions[key]
+	if version < 1 || version > len(versions) {
+		return nil, ErrNotFound
+	}
+	t := versions[version-1]
+	return &t, nil
+}
+
+func (r *MemoryTemplateRepository) Versions(ctx context.Context, key TemplateKey) ([]Template, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Template(nil), r.versions[key]...), nil
+}
+
+func (r *MemoryTemplateRepository) Activate(ctx context.Context, key TemplateKey, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := r.versions[key]
+	if version < 1 || version > len(versions) {
+		return ErrNotFound
+	}
+	for i := range versions {
+		versions[i].Active = versions[i].Version == version
+	}
+	return nil
+}
+
+func (r *MemoryTemplateRepository) List(ctx context.Context, tenant string) ([]Template, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var templates []Template
+	for key, versions := range r.versions {
+		if key.Tenant != tenant {
+			continue
+		}
+		for _, t := range versions {
+			if t.Active {
+				templates = append(templates, t)
+			}
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		a, b := templates[i], templates[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		return a.Locale < b.Locale
+	})
+	return templates, nil
+}
@@ -0,0 +1,320 @@
+// notification-service/subscriptions.go
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+
+	"platform/dbretry"
+	"platform/resource"
+	"platform/router"
+)
+
+// ErrConflict is a write that lost to another since its caller read
+var ErrConflict = errors.New("changed concurrently")
+
+// WebhookSubscription sends a tenant's webhook notifications to a URL. Its
+// ID is chosen by whoever creates it, so configuration tools can name it
+// before it exists and apply it again and again.
+type WebhookSubscription struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	URL    string `json:"url"`
+	// Notifications limits it to the notifications named, e.g.
+	// order_confirmation; empty is all of them
+	Notifications []string `json:"notifications"`
+	Disabled      bool     `json:"disabled,omitempty"`
+}
+
+// wants reports whether the subscription takes the notification name
+func (s *WebhookSubscription) wants(name string) bool {
+	return !s.Disabled && (len(s.Notifications) == 0 || slices.Contains(s.Notifications, name))
+}
+
+var subscriptionIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// SubscriptionRepository stores webhook subscriptions. Writes are
+// conditional on the ETag of what is stored, "" for nothing, and fail with
+// ErrConflict when it has changed.
+type SubscriptionRepository interface {
+	Get(ctx context.Context, id string) (*WebhookSubscription, error)
+	// List returns a tenant's subscriptions, or everyone's for ""
+	List(ctx context.Context, tenant string) ([]WebhookSubscription, error)
+	Put(ctx context.Context, s *WebhookSubscription, etag string) error
+	Delete(ctx context.Context, id, etag string) error
+}
+
+type PostgresSubscriptionRepository struct {
+	db *dbretry.DB
+}
+
+const subscriptionColumns = `id, tenant, url, notifications, disabled`
+
+func scanSubscription(scan func(...any) error, s *WebhookSubscription) error {
+	var notifications []byte
+	if err := scan(&s.ID, &s.Tenant, &s.URL, &notifications, &s.Disabled); err != nil {
+		return err
+	}
+	return json.Unmarshal(notifications, &s.Notifications)
+}
+
+func (r *PostgresSubscriptionRepository) Get(ctx context.Context, id string) (*WebhookSubscription, error) {
+	var s WebhookSubscription
+	err := scanSubscription(r.db.QueryRowContext(ctx, `SELECT `+subscriptionColumns+` FROM webhook_subscriptions WHERE id = $1`, id).Scan, &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *PostgresSubscriptionRepository) List(ctx context.Context, tenant string) ([]WebhookSubscription, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+subscriptionColumns+` FROM webhook_subscriptions
+              WHERE $1 = '' OR tenant = $1 ORDER BY id`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []WebhookSubscription
+	for rows.Next() {
+		var s WebhookSubscription
+		if err := scanSubscription(rows.Scan, &s); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func (r *PostgresSubscriptionRepository) Put(ctx context.Context, s *WebhookSubscription, etag string) error {
+	notifications, err := json.Marshal(s.Notifications)
+	if err != nil {
+		return err
+	}
+	var res sql.Result
+	if etag == "" {
+		res, err = r.db.ExecContext(ctx, `INSERT INTO webhook_subscriptions (`+subscriptionColumns+`, etag)
+              VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`,
+			s.ID, s.Tenant, s.URL, notifications, s.Disabled, resource.ETag(s))
+	} else {
+		res, err = r.db.ExecContext(ctx, `UPDATE webhook_subscriptions
+              SET tenant = $2, url = $3, notifications = $4, disabled = $5, etag = $6, updated_at = now()
+              WHERE id = $1 AND etag = $7`,
+			s.ID, s.Tenant, s.URL, notifications, s.Disabled, resource.ETag(s), etag)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return cmp.Or(err, ErrConflict)
+	}
+	return nil
+}
+
+func (r *PostgresSubscriptionRepository) Delete(ctx context.Context, id, etag string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1 AND etag = $2`, id, etag)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return cmp.Or(err, ErrConflict)
+	}
+	return nil
+}
+
+// MemorySubscriptionRepository keeps subscriptions in process memory
+type MemorySubscriptionRepository struct {
+	mu   sync.Mutex
+	subs map[string]WebhookSubscription
+}
+
+func NewMemorySubscriptionRepository() *MemorySubscriptionRepository {
+	return &MemorySubscriptionRepository{subs: make(map[string]WebhookSubscription)}
+}
+
+func (r *MemorySubscriptionRepository) Get(ctx context.Context, id string) (*WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s.Notifications = slices.Clone(s.Notifications)
+	return &s, nil
+}
+
+func (r *MemorySubscriptionRepository) List(ctx context.Context, tenant string) ([]WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var subs []WebhookSubscription
+	for _, s := range r.subs {
+		if tenant == "" || s.Tenant == tenant {
+			s.Notifications = slices.Clone(s.Notifications)
+			subs = append(subs, s)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// current is the stored subscription's ETag, "" for none; r.mu must be held
+func (r *MemorySubscriptionRepository) current(id string) string {
+	if s, ok := r.subs[id]; ok {
+		return resource.ETag(&s)
+	}
+	return ""
+}
+
+func (r *MemorySubscriptionRepository) Put(ctx context.Context, s *WebhookSubscription, etag string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current(s.ID) != etag {
+		return ErrConflict
+	}
+	stored := *s
+	stored.Notifications = slices.Clone(s.Notifications)
+	r.subs[s.ID] = stored
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) Delete(ctx context.Context, id, etag string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current(id) != etag {
+		return ErrConflict
+	}
+	delete(r.subs, id)
+	return nil
+}
+
+// SubscriptionAPI manages webhook subscriptions declaratively: PUT creates
+// or replaces one whole under the ID in its URL, and every response carries
+// the ETag that If-Match and If-None-Match compare against
+type SubscriptionAPI struct {
+	repo SubscriptionRepository
+}
+
+// List returns the subscriptions, a tenant's with ?tenant=
+func (a *SubscriptionAPI) List(w http.ResponseWriter, r *http.Request) {
+	subs, err := a.repo.List(r.Context(), r.URL.Query().Get("tenant"))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if subs == nil {
+		subs = []WebhookSubscription{}
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+func (a *SubscriptionAPI) Get(w http.ResponseWriter, r *http.Request) {
+	s, err := a.repo.Get(r.Context(), router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	resource.Write(w, r, http.StatusOK, s)
+}
+
+// Put creates the subscription (201) or replaces it (200); putting what is
+// already there changes nothing
+func (a *SubscriptionAPI) Put(w http.ResponseWriter, r *http.Request) {
+	var s WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := router.Param(r, "id")
+	if s.ID != "" && s.ID != id {
+		http.Error(w, "id doesn't match the URL", http.StatusUnprocessableEntity)
+		return
+	}
+	s.ID = id
+	if !subscriptionIDPattern.MatchString(s.ID) {
+		http.Error(w, "id must be up to 128 letters, digits, dots, dashes and underscores", http.StatusUnprocessableEntity)
+		return
+	}
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusUnprocessableEntity)
+		return
+	}
+	if s.Notifications == nil {
+		s.Notifications = []string{}
+	}
+	slices.Sort(s.Notifications)
+	s.Notifications = slices.Compact(s.Notifications)
+
+	ctx := r.Context()
+	current, err := a.repo.Get(ctx, s.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		dbretry.Error(w, err)
+		return
+	}
+	var etag string
+	if current != nil {
+		etag = resource.ETag(current)
+	}
+	if !resource.Preconditions(w, r, etag) {
+		return
+	}
+	if etag == resource.ETag(&s) {
+		resource.Write(w, r, http.StatusOK, &s)
+		return
+	}
+	err = a.repo.Put(ctx, &s, etag)
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "subscription changed concurrently", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	status := http.StatusOK
+	if current == nil {
+		status = http.StatusCreated
+	}
+	resource.Write(w, r, status, &s)
+}
+
+func (a *SubscriptionAPI) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current, err := a.repo.Get(ctx, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	etag := resource.ETag(current)
+	if !resource.Preconditions(w, r, etag) {
+		return
+	}
+	err = a.repo.Delete(ctx, current.ID, etag)
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "subscription changed concurrently", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,548 @@
+// notification-service/suppressions.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Why an address is suppressed
+const (
+	SuppressBounce    = "bounce"
+	SuppressComplaint = "complaint"
+	SuppressManual    = "manual"
+)
+
+var suppressionReasons = []string{SuppressBounce, SuppressComplaint, SuppressManual}
+
+// Suppression pages are in address order
+const (
+	defaultSuppressionPage = 100
+	maxSuppressionPage     = 500
+)
+
+// Suppression stops email to an address
+type Suppression struct {
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+	Detail  string `json:"detail,omitempty"`
+	// Source is the provider that reported it, or who added it by hand
+	Source    string    `json:"source,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// normalizeAddress is how addresses are keyed; providers report them in
+// whatever case they were sent in
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// SuppressionFilter selects suppressions by address; After pages
+type SuppressionFilter struct {
+	Reason string
+	After  string
+	Limit  int
+}
+
+// SuppressionRepository is the suppression list
+type SuppressionRepository interface {
+	// Suppress records s, replacing the reason an address already
+	// suppressed was suppressed for but keeping since when
+	Suppress(ctx context.Context, s *Suppression) error
+	Get(ctx context.Context, address string) (*Suppression, error)
+	List(ctx context.Context, f SuppressionFilter) ([]Suppression, error)
+	Delete(ctx context.Context, address string) error
+}
+
+type PostgresSuppressionRepository struct {
+	db *dbretry.DB
+}
+
+const suppressionColumns = `address, reason, detail, source, created_at`
+
+func scanSuppression(scan func(...any) error, s *Suppression) error {
+	return scan(&s.Address, &s.Reason, &s.Detail, &s.Source, &s.CreatedAt)
+}
+
+func (r *PostgresSuppressionRepository) Suppress(ctx context.Context, s *Suppression) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO suppressions (`+suppressionColumns+`) VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (address) DO UPDATE SET reason = EXCLUDED.reason, detail = EXCLUDED.detail, source = EXCLUDED.source
+              RETURNING created_at`,
+		s.Address, s.Reason, s.Detail, s.Source, s.CreatedAt).Scan(&s.CreatedAt)
+}
+
+func (r *PostgresSuppressionRepository) Get(ctx context.Context, address string) (*Suppression, error) {
+	var s Suppression
+	err := scanSuppression(r.db.QueryRowContext(ctx, `SELECT `+suppressionColumns+` FROM suppressions WHERE address = $1`,
+		address).Scan, &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *PostgresSuppressionRepository) List(ctx context.Context, f SuppressionFilter) ([]Suppression, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+suppressionColumns+` FROM suppressions
+              WHERE ($1 = '' OR reason = $1) AND address > $2 ORDER BY address LIMIT $3`,
+		f.Reason, f.After, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Suppression
+	for rows.Next() {
+		var s Suppression
+		if err := scanSuppression(rows.Scan, &s); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (r *PostgresSuppressionRepository) Delete(ctx context.Context, address string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM suppressions WHERE address = $1`, address)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MemorySuppressionRepository keeps the suppression list in process memory
+type MemorySuppressionRepository struct {
+	mu   sync.RWMutex
+	list map[string]Suppression
+}
+
+func NewMemorySuppressionRepository() *MemorySuppressionRepository {
+	return &MemorySuppressionRepository{list: make(map[string]Suppression)}
+}
+
+func (r *MemorySuppressionRepository) Suppress(ctx context.Context, s *Suppression) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.list[s.Address]; ok {
+		s.CreatedAt = existing.CreatedAt
+	}
+	r.list[s.Address] = *s
+	return nil
+}
+
+func (r *MemorySuppressionRepository) Get(ctx context.Context, address string) (*Suppression, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.list[address]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+func (r *MemorySuppressionRepository) List(ctx context.Context, f SuppressionFilter) ([]Suppression, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var list []Suppression
+	for _, s := range r.list {
+		if (f.Reason == "" || s.Reason == f.Reason) && s.Address > f.After {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	if len(list) > f.Limit {
+		list = list[:f.Limit]
+	}
+	return list, nil
+}
+
+func (r *MemorySuppressionRepository) Delete(ctx context.Context, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.list[address]; !ok {
+		return ErrNotFound
+	}
+	delete(r.list, address)
+	return nil
+}
+
+// suppressed says whether email to address is suppressed
+func (s *NotificationService) suppressed(ctx context.Context, address string) (bool, error) {
+	if s.suppressions == nil {
+		return false, nil
+	}
+	_, err := s.suppressions.Get(ctx, normalizeAddress(address))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// feedbackPath is where providers post feedback; it is public
+const feedbackPath = "/notifications/email/feedback"
+
+// feedback is what a provider reported about one address
+type feedback struct {
+	address string
+	reason  string
+	// permanent feedback suppresses the address; a transient bounce, such
+	// as a full mailbox, doesn't
+	permanent bool
+	detail    string
+}
+
+// EmailFeedback receives the email provider's bounce and complaint
+// reports at POST /notifications/email/feedback, and suppresses the
+// addresses that bounced for good or complained. It understands Amazon SES
+// notifications through SNS, SendGrid's event webhook and Postmark's bounce
+// and spam complaint webhooks, telling them apart by their shape.
+//
+// Providers can't get a token, so the endpoint is public; they send the
+// secret as the basic auth password or as token= instead. Without a secret
+// configured it answers 503, since anyone could suppress any address.
+type EmailFeedback struct {
+	repo   SuppressionRepository
+	secret string
+	client *http.Client
+	clock  clock.Clock
+}
+
+func NewEmailFeedback(repo SuppressionRepository, secret string) *EmailFeedback {
+	return &EmailFeedback{
+		repo:   repo,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		clock:  clock.System,
+	}
+}
+
+func (f *EmailFeedback) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(f.secret)) == 1
+}
+
+func (f *EmailFeedback) Receive(w http.ResponseWriter, r *http.Request) {
+	if f.secret == "" {
+		http.Error(w, "email feedback not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if !f.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var source, subscribeURL string
+	var reports []feedback
+	switch {
+	case r.Header.Get("X-Amz-Sns-Message-Type") != "":
+		source = "ses"
+		reports, subscribeURL, err = parseSNSFeedback(body)
+	case bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")):
+		source = "sendgrid"
+		reports, err = parseSendGridFeedback(body)
+	default:
+		source = "postmark"
+		reports, err = parsePostmarkFeedback(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	ctx := r.Context()
+	if subscribeURL != "" {
+		if err := f.confirm(ctx, subscribeURL); err != nil {
+			log.Printf("confirm SNS subscription: %v", err)
+			http.Error(w, "could not confirm the subscription", http.StatusBadGateway)
+			return
+		}
+		log.Print("confirmed SNS subscription for email feedback")
+	}
+
+	suppressed := 0
+	for _, fb := range reports {
+		address := normalizeAddress(fb.address)
+		if address == "" {
+			continue
+		}
+		if !fb.permanent {
+			log.Printf("%s reported a transient %s: %s", source, fb.reason, fb.detail)
+			continue
+		}
+		// Reports are retried and repeated; suppressing again changes nothing
+		s := &Suppression{Address: address, Reason: fb.reason, Detail: fb.detail, Source: source, CreatedAt: f.clock.Now()}
+		if err := f.repo.Suppress(ctx, s); err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		log.Printf("suppressed an email address after a %s reported by %s", fb.reason, source)
+		suppressed++
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"reports": len(reports), "suppressed": suppressed})
+}
+
+// confirm visits the URL SNS sends to confirm a subscription, which has to
+// be SNS's own
+func (f *EmailFeedback) confirm(ctx context.Context, subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Host, "sns.") || !strings.HasSuffix(u.Host, ".amazonaws.com") {
+		return fmt.Errorf("refusing to confirm at %q", subscribeURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse("sns", resp)
+}
+
+// parseSNSFeedback reads an SNS message carrying an SES bounce or
+// complaint notification, or event, and the URL to confirm a subscription
+func parseSNSFeedback(body []byte) ([]feedback, string, error) {
+	var envelope struct {
+		Type         string
+		Message      string
+		SubscribeURL string
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, "", err
+	}
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		return nil, envelope.SubscribeURL, nil
+	case "Notification":
+	default:
+		return nil, "", nil
+	}
+
+	type recipient struct {
+		EmailAddress   string `json:"emailAddress"`
+		DiagnosticCode string `json:"diagnosticCode"`
+	}
+	var msg struct {
+		NotificationType string `json:"notificationType"`
+		EventType        string `json:"eventType"`
+		Bounce           struct {
+			BounceType        string      `json:"bounceType"`
+			BounceSubType     string      `json:"bounceSubType"`
+			BouncedRecipients []recipient `json:"bouncedRecipients"`
+		} `json:"bounce"`
+		Complaint struct {
+			ComplainedRecipients  []recipient `json:"complainedRecipients"`
+			ComplaintFeedbackType string      `json:"complaintFeedbackType"`
+		} `json:"complaint"`
+	}
+	if err := json.Unmarshal([]byte(envelope.Message), &msg); err != nil {
+		return nil, "", fmt.Errorf("SNS message: %w", err)
+	}
+	var reports []feedback
+	// Notifications say notificationType, event publishing eventType
+	kind := msg.NotificationType
+	if kind == "" {
+		kind = msg.EventType
+	}
+	switch kind {
+	case "Bounce":
+		for _, rcpt := range msg.Bounce.BouncedRecipients {
+			reports = append(reports, feedback{
+				address:   rcpt.EmailAddress,
+				reason:    SuppressBounce,
+				permanent: msg.Bounce.BounceType == "Permanent",
+				detail:    strings.TrimSpace(msg.Bounce.BounceType + " " + msg.Bounce.BounceSubType + ": " + rcpt.DiagnosticCode),
+			})
+		}
+	case "Complaint":
+		for _, rcpt := range msg.Complaint.ComplainedRecipients {
+			reports = append(reports, feedback{
+				address:   rcpt.EmailAddress,
+				reason:    SuppressComplaint,
+				permanent: true,
+				detail:    msg.Complaint.ComplaintFeedbackType,
+			})
+		}
+	}
+	return reports, "", nil
+}
+
+// parseSendGridFeedback reads a batch of SendGrid events; only bounces and
+// spam reports matter, and a "blocked" bounce is transient
+func parseSendGridFeedback(body []byte) ([]feedback, error) {
+	var events []struct {
+		Email  string `json:"email"`
+		Event  string `json:"event"`
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+	var reports []feedback
+	for _, e := range events {
+		switch e.Event {
+		case "bounce":
+			reports = append(reports, feedback{address: e.Email, reason: SuppressBounce, permanent: e.Type != "blocked", detail: e.Reason})
+		case "spamreport":
+			reports = append(reports, feedback{address: e.Email, reason: SuppressComplaint, permanent: true})
+		}
+	}
+	return reports, nil
+}
+
+// parsePostmarkFeedback reads a Postmark bounce or spam complaint
+func parsePostmarkFeedback(body []byte) ([]feedback, error) {
+	var record struct {
+		RecordType  string
+		Type        string
+		Email       string
+		Description string
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, err
+	}
+	switch record.RecordType {
+	case "Bounce":
+		permanent := record.Type == "HardBounce" || record.Type == "BadEmailAddress"
+		return []feedback{{address: record.Email, reason: SuppressBounce, permanent: permanent,
+			detail: record.Type + ": " + record.Description}}, nil
+	case "SpamComplaint":
+		return []feedback{{address: record.Email, reason: SuppressComplaint, permanent: true, detail: record.Description}}, nil
+	case "":
+		return nil, errors.New("unrecognized feedback")
+	}
+	return nil, nil
+}
+
+// SuppressionAPI serves /notifications/suppressions to admins and support,
+// who add addresses by hand and take back those that work again
+type SuppressionAPI struct {
+	repo  SuppressionRepository
+	clock clock.Clock
+}
+
+// List pages through the list by address: reason=, after=ADDRESS, limit=N
+func (a *SuppressionAPI) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := SuppressionFilter{Reason: q.Get("reason"), After: normalizeAddress(q.Get("after")), Limit: defaultSuppressionPage}
+	if f.Reason != "" && !slices.Contains(suppressionReasons, f.Reason) {
+		http.Error(w, "reason must be one of "+strings.Join(suppressionReasons, ", "), http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(limit, maxSuppressionPage)
+	}
+	list, err := a.repo.List(r.Context(), f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if list == nil {
+		list = []Suppression{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *SuppressionAPI) Get(w http.ResponseWriter, r *http.Request) {
+	s, err := a.repo.Get(r.Context(), normalizeAddress(router.Param(r, "address")))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Address not suppressed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// Put suppresses the path's address, for {"reason"} (manual by default)
+// and {"detail"}
+func (a *SuppressionAPI) Put(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+		Detail string `json:"detail"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = SuppressManual
+	}
+	address := normalizeAddress(router.Param(r, "address"))
+	switch {
+	case !strings.Contains(address, "@"):
+		http.Error(w, "not an email address", http.StatusUnprocessableEntity)
+		return
+	case !slices.Contains(suppressionReasons, req.Reason):
+		http.Error(w, "reason must be one of "+strings.Join(suppressionReasons, ", "), http.StatusUnprocessableEntity)
+		return
+	}
+	s := &Suppression{Address: address, Reason: req.Reason, Detail: req.Detail, CreatedAt: a.clock.Now()}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+		s.Source = p.Subject
+	}
+	if err := a.repo.Suppress(r.Context(), s); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// Delete takes the path's address off the list, so it is sent to again
+func (a *SuppressionAPI) Delete(w http.ResponseWriter, r *http.Request) {
+	err := a.repo.Delete(r.Context(), normalizeAddress(router.Param(r, "address")))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Address not suppressed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
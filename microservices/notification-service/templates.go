@@ -0,0 +1,429 @@
+// notification-service/templates.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Templates are tried in the recipient's locale, its base language, then
+// this one, then any locale
+const defaultLocale = "en"
+
+// Template is one version of the content sent for a notification on one
+// channel. Email uses Subject, HTML and Text; SMS uses Text; push and the
+// in-app inbox use Subject as the title and Text; webhooks use Body, which
+// must render to JSON.
+type Template struct {
+	Tenant    string    `json:"tenant"`
+	Name      string    `json:"name"`
+	Channel   string    `json:"channel"`
+	Locale    string    `json:"locale"`
+	Version   int       `json:"version"`
+	Subject   string    `json:"subject,omitempty"`
+	HTML      string    `json:"html,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (t *Template) Key() TemplateKey {
+	return TemplateKey{Tenant: t.Tenant, Name: t.Name, Channel: t.Channel, Locale: t.Locale}
+}
+
+// Rendered is a template executed against a notification's data
+type Rendered struct {
+	Subject string `json:"subject,omitempty"`
+	HTML    string `json:"html,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+var templateFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"money": func(v any) string {
+		switch n := v.(type) {
+		case float64:
+			return strconv.FormatFloat(n, 'f', 2, 64)
+		case json.Number:
+			f, _ := n.Float64()
+			return strconv.FormatFloat(f, 'f', 2, 64)
+		}
+		return fmt.Sprint(v)
+	},
+	"upper": strings.ToUpper,
+}
+
+func executeText(name, src string, data any) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Parse(src)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func executeHTML(name, src string, data any) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+	t, err := htmltemplate.New(name).Funcs(templateFuncs).Parse(src)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Render executes every part of the template
+func (t *Template) Render(data any) (*Rendered, error) {
+	var r Rendered
+	var err error
+	if r.Subject, err = executeText("subject", t.Subject, data); err != nil {
+		return nil, err
+	}
+	if r.Text, err = executeText("text", t.Text, data); err != nil {
+		return nil, err
+	}
+	if r.HTML, err = executeHTML("html", t.HTML, data); err != nil {
+		return nil, err
+	}
+	if r.Body, err = executeText("body", t.Body, data); err != nil {
+		return nil, err
+	}
+	if t.Body != "" && !json.Valid([]byte(r.Body)) {
+		return nil, errors.New("body did not render to valid JSON")
+	}
+	return &r, nil
+}
+
+// Validate checks the parts a channel needs are present and parse
+func (t *Template) Validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	switch t.Channel {
+	case "email":
+		if t.Subject == "" || (t.Text == "" && t.HTML == "") {
+			return errors.New("email templates need a subject and a text or html body")
+		}
+	case "sms":
+		if t.Text == "" {
+			return errors.New("sms templates need a text")
+		}
+	case "push", "inbox":
+		if t.Subject == "" || t.Text == "" {
+			return fmt.Errorf("%s templates need a subject and a text", t.Channel)
+		}
+	case "webhook":
+		if t.Body == "" {
+			return errors.New("webhook templates need a body")
+		}
+	default:
+		return fmt.Errorf("unknown channel %q", t.Channel)
+	}
+
+	for part, src := range map[string]string{"subject": t.Subject, "text": t.Text, "body": t.Body} {
+		if _, err := template.New(part).Funcs(templateFuncs).Parse(src); err != nil {
+			return fmt.Errorf("%s: %w", part, err)
+		}
+	}
+	if _, err := htmltemplate.New("html").Funcs(templateFuncs).Parse(t.HTML); err != nil {
+		return fmt.Errorf("html: %w", err)
+	}
+	return nil
+}
+
+// localeChain lists the locales to try for a recipient, most specific first
+func localeChain(locale string) []string {
+	var chain []string
+	add := func(l string) {
+		for _, c := range chain {
+			if c == l {
+				return
+			}
+		}
+		chain = append(chain, l)
+	}
+	locale = strings.ReplaceAll(locale, "_", "-")
+	if locale != "" {
+		add(locale)
+		if base, _, ok := strings.Cut(locale, "-"); ok {
+			add(base)
+		}
+	}
+	add(defaultLocale)
+	add("")
+	return chain
+}
+
+// resolveTemplate finds the active template for a notification: a tenant's
+// override wins over the default, then the closest locale wins
+func resolveTemplate(ctx context.Context, repo TemplateRepository, tenant, name, channel, locale string) (*Template, error) {
+	tenants := []string{tenant}
+	if tenant != "" {
+		tenants = append(tenants, "")
+	}
+	for _, tn := range tenants {
+		for _, l := range localeChain(locale) {
+			t, err := repo.Active(ctx, TemplateKey{Tenant: tn, Name: name, Channel: channel, Locale: l})
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return t, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+//go:embed defaults/*.json
+var defaultFiles embed.FS
+
+// seedDefaults installs the built-in templates that don't exist yet, so a
+// fresh deployment can send notifications before anyone edits them
+func seedDefaults(ctx context.Context, repo TemplateRepository) error {
+	files, err := fs.Glob(defaultFiles, "defaults/*.json")
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		data, err := defaultFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var t Template
+		if err := json.Unmarshal(data, &t); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		_, err = repo.Active(ctx, t.Key())
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		t.CreatedBy = "seed"
+		t.CreatedAt = clock.System.Now()
+		if err := repo.Create(ctx, &t); err != nil {
+			return err
+		}
+		log.Printf("seeded template %s/%s/%s", t.Name, t.Channel, t.Locale)
+	}
+	return nil
+}
+
+// TemplateAdmin serves the template management API. Templates are keyed by
+// name and channel in the path, tenant and locale in the query.
+type TemplateAdmin struct {
+	repo  TemplateRepository
+	clock clock.Clock
+}
+
+func templateKey(r *http.Request) TemplateKey {
+	q := r.URL.Query()
+	return TemplateKey{
+		Tenant:  q.Get("tenant"),
+		Name:    router.Param(r, "name"),
+		Channel: router.Param(r, "channel"),
+		Locale:  q.Get("locale"),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *TemplateAdmin) List(w http.ResponseWriter, r *http.Request) {
+	templates, err := a.repo.List(r.Context(), r.URL.Query().Get("tenant"))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if templates == nil {
+		templates = []Template{}
+	}
+	writeJSON(w, http.StatusOK, templates)
+}
+
+func (a *TemplateAdmin) Get(w http.ResponseWriter, r *http.Request) {
+	t, err := a.repo.Active(r.Context(), templateKey(r))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+type templateContent struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+	Body    string `json:"body"`
+}
+
+// Put stores a new version and makes it active; earlier versions are kept
+// for rollback
+func (a *TemplateAdmin) Put(w http.ResponseWriter, r *http.Request) {
+	var content templateContent
+	if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := templateKey(r)
+	t := Template{
+		Tenant:    key.Tenant,
+		Name:      key.Name,
+		Channel:   key.Channel,
+		Locale:    key.Locale,
+		Subject:   content.Subject,
+		HTML:      content.HTML,
+		Text:      content.Text,
+		Body:      content.Body,
+		CreatedAt: a.clock.Now(),
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+		t.CreatedBy = p.Subject
+	}
+	if err := t.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := a.repo.Create(r.Context(), &t); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, t)
+}
+
+func (a *TemplateAdmin) Versions(w http.ResponseWriter, r *http.Request) {
+	versions, err := a.repo.Versions(r.Context(), templateKey(r))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// Activate rolls a template back (or forward) to an existing version
+func (a *TemplateAdmin) Activate(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(router.Param(r, "version"))
+	if err != nil {
+		http.Error(w, "Template version not found", http.StatusNotFound)
+		return
+	}
+	key := templateKey(r)
+	err = a.repo.Activate(r.Context(), key, version)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Template version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	t, err := a.repo.Version(r.Context(), key, version)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+type previewRequest struct {
+	// Data is what the template is rendered against, e.g. a sample order
+	Data map[string]any `json:"data"`
+	// Version picks a stored version; zero means the active one
+	Version int `json:"version,omitempty"`
+	// Draft renders unsaved content instead of a stored version
+	Draft *templateContent `json:"draft,omitempty"`
+}
+
+// Preview renders a stored version or a draft with sample data, so a
+// change can be checked before it goes live
+func (a *TemplateAdmin) Preview(w http.ResponseWriter, r *http.Request) {
+	var req previewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := templateKey(r)
+	var t *Template
+	var err error
+	switch {
+	case req.Draft != nil:
+		t = &Template{
+			Tenant: key.Tenant, Name: key.Name, Channel: key.Channel, Locale: key.Locale,
+			Subject: req.Draft.Subject, HTML: req.Draft.HTML, Text: req.Draft.Text, Body: req.Draft.Body,
+		}
+		err = t.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	case req.Version > 0:
+		t, err = a.repo.Version(r.Context(), key, req.Version)
+	default:
+		t, err = resolveTemplate(r.Context(), a.repo, key.Tenant, key.Name, key.Channel, key.Locale)
+	}
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	rendered, err := t.Render(req.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"template": t, "rendered": rendered})
+}
@@ -0,0 +1,588 @@
+// notification-service/webhooks.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Delivery states. Failed deliveries are retried in the background until
+// they succeed or run out of attempts and are dead-lettered; only a replay
+// sends a dead-lettered delivery again.
+const (
+	DeliveryPending      = "pending"
+	DeliveryDelivered    = "delivered"
+	DeliveryFailed       = "failed"
+	DeliveryDeadLettered = "dead_lettered"
+)
+
+// Delivery is one webhook notification sent to one URL
+type Delivery struct {
+	ID             int64             `json:"id"`
+	Tenant         string            `json:"tenant"`
+	Notification   string            `json:"notification"`
+	EventID        string            `json:"event_id,omitempty"`
+	URL            string            `json:"url"`
+	Payload        string            `json:"payload"`
+	Status         string            `json:"status"`
+	Attempts       int               `json:"attempts"`
+	LastStatusCode int               `json:"last_status_code,omitempty"`
+	LastError      string            `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time        `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	History        []DeliveryAttempt `json:"history,omitempty"`
+}
+
+// DeliveryAttempt records what the receiver answered to one try
+type DeliveryAttempt struct {
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  float64   `json:"duration_ms"`
+	Replay      bool      `json:"replay,omitempty"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// DeliveryFilter selects deliveries newest first; Before pages by ID
+type DeliveryFilter struct {
+	Tenant string
+	Status string
+	Before int64
+	Limit  int
+}
+
+// DeliveryRepository is the delivery log
+type DeliveryRepository interface {
+	Create(ctx context.Context, d *Delivery) error
+	// Get returns the delivery with its History
+	Get(ctx context.Context, id int64) (*Delivery, error)
+	List(ctx context.Context, filter DeliveryFilter) ([]Delivery, error)
+	// RecordAttempt saves d's new state together with the attempt
+	RecordAttempt(ctx context.Context, d *Delivery, a DeliveryAttempt) error
+	// ClaimDue returns failed deliveries whose retry is due and pushes their
+	// next attempt back by lease, so concurrent workers skip them
+	ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Delivery, error)
+}
+
+type PostgresDeliveryRepository struct {
+	db *dbretry.DB
+}
+
+const deliveryColumns = `id, tenant, notification, event_id, url, payload, status, attempts,
+              last_status_code, last_error, next_attempt_at, created_at, updated_at`
+
+func scanDelivery(scan func(...any) error, d *Delivery) error {
+	var next sql.NullTime
+	err := scan(&d.ID, &d.Tenant, &d.Notification, &d.EventID, &d.URL, &d.Payload, &d.Status, &d.Attempts,
+		&d.LastStatusCode, &d.LastError, &next, &d.CreatedAt, &d.UpdatedAt)
+	if next.Valid {
+		d.NextAttemptAt = &next.Time
+	}
+	return err
+}
+
+func (r *PostgresDeliveryRepository) Create(ctx context.Context, d *Delivery) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO webhook_deliveries (tenant, notification, event_id, url, payload, status)
+              VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at`,
+		d.Tenant, d.Notification, d.EventID, d.URL, d.Payload, d.Status).Scan(&d.ID, &d.CreatedAt, &d.UpdatedAt)
+}
+
+func (r *PostgresDeliveryRepository) Get(ctx context.Context, id int64) (*Delivery, error) {
+	var d Delivery
+	err := scanDelivery(r.db.QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = $1`, id).Scan, &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT attempt, status_code, response, error, duration_ms, replay, attempted_at
+              FROM webhook_attempts WHERE delivery_id = $1 ORDER BY attempt`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a DeliveryAttempt
+		if err := rows.Scan(&a.Attempt, &a.StatusCode, &a.Response, &a.Error, &a.DurationMS, &a.Replay, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		d.History = append(d.History, a)
+	}
+	return &d, rows.Err()
+}
+
+func (r *PostgresDeliveryRepository) query(ctx context.Context, query string, args ...any) ([]Delivery, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var d Delivery
+		if err := scanDelivery(rows.Scan, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (r *PostgresDeliveryRepository) List(ctx context.Context, f DeliveryFilter) ([]Delivery, error) {
+	return r.query(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries
+              WHERE tenant = $1 AND ($2 = '' OR status = $2) AND ($3 = 0 OR id < $3)
+              ORDER BY id DESC LIMIT $4`,
+		f.Tenant, f.Status, f.Before, f.Limit)
+}
+
+func (r *PostgresDeliveryRepository) RecordAttempt(ctx context.Context, d *Delivery, a DeliveryAttempt) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4,
+              last_error = $5, next_attempt_at = $6, updated_at = now() WHERE id = $1 RETURNING updated_at`,
+			d.ID, d.Status, d.Attempts, d.LastStatusCode, d.LastError, d.NextAttemptAt).Scan(&d.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO webhook_attempts
+              (delivery_id, attempt, status_code, response, error, duration_ms, replay, attempted_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			d.ID, a.Attempt, a.StatusCode, a.Response, a.Error, a.DurationMS, a.Replay, a.AttemptedAt)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *PostgresDeliveryRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Delivery, error) {
+	return r.query(ctx, `UPDATE webhook_deliveries SET next_attempt_at = $2
+              WHERE id IN (
+                  SELECT id FROM webhook_deliveries
+                  WHERE status = 'failed' AND next_attempt_at <= $1
+                  ORDER BY next_attempt_at LIMIT $3
+                  FOR UPDATE SKIP LOCKED)
+              RETURNING `+deliveryColumns,
+		now, now.Add(lease), limit)
+}
+
+// MemoryDeliveryRepository keeps the delivery log in process memory
+type MemoryDeliveryRepository struct {
+	mu         sync.Mutex
+	deliveries []*Delivery
+}
+
+func NewMemoryDeliveryRepository() *MemoryDeliveryRepository {
+	return &MemoryDeliveryRepository{}
+}
+
+// snapshot copies d so callers can't race with later attempts
+func snapshot(d *Delivery) Delivery {
+	c := *d
+	c.History = slices.Clone(d.History)
+	if d.NextAttemptAt != nil {
+		next := *d.NextAttemptAt
+		c.NextAttemptAt = &next
+	}
+	return c
+}
+
+func (r *MemoryDeliveryRepository) Create(ctx context.Context, d *Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d.ID = int64(len(r.deliveries) + 1)
+	d.CreatedAt = clock.System.Now()
+	d.UpdatedAt = d.CreatedAt
+	stored := snapshot(d)
+	r.deliveries = append(r.deliveries, &stored)
+	return nil
+}
+
+func (r *MemoryDeliveryRepository) Get(ctx context.Context, id int64) (*Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > int64(len(r.deliveries)) {
+		return nil, ErrNotFound
+	}
+	d := snapshot(r.deliveries[id-1])
+	return &d, nil
+}
+
+func (r *MemoryDeliveryRepository) List(ctx context.Context, f DeliveryFilter) ([]Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []Delivery
+	for i := len(r.deliveries) - 1; i >= 0 && len(deliveries) < f.Limit; i-- {
+		d := r.deliveries[i]
+		if d.Tenant != f.Tenant || (f.Status != "" && d.Status != f.Status) || (f.Before != 0 && d.ID >= f.Before) {
+			continue
+		}
+		c := snapshot(d)
+		c.History = nil
+		deliveries = append(deliveries, c)
+	}
+	return deliveries, nil
+}
+
+func (r *MemoryDeliveryRepository) RecordAttempt(ctx context.Context, d *Delivery, a DeliveryAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d.ID < 1 || d.ID > int64(len(r.deliveries)) {
+		return ErrNotFound
+	}
+	stored := r.deliveries[d.ID-1]
+	d.UpdatedAt = clock.System.Now()
+	history := append(stored.History, a)
+	*stored = snapshot(d)
+	stored.History = history
+	return nil
+}
+
+func (r *MemoryDeliveryRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []Delivery
+	for _, d := range r.deliveries {
+		if len(due) == limit {
+			break
+		}
+		if d.Status != DeliveryFailed || d.NextAttemptAt == nil || d.NextAttemptAt.After(now) {
+			continue
+		}
+		next := now.Add(lease)
+		d.NextAttemptAt = &next
+		c := snapshot(d)
+		c.History = nil
+		due = append(due, c)
+	}
+	return due, nil
+}
+
+// WebhookDeliveries is the webhook channel with a durable delivery log.
+// Each message is tried once when it is sent; failures are retried in the
+// background with the channel's Policy, so a slow receiver doesn't hold up
+// the event that triggered it.
+type WebhookDeliveries struct {
+	repo    DeliveryRepository
+	webhook *WebhookChannel
+	policy  Policy
+	limiter *middleware.RateLimiter
+	events  *events.Emitter
+	clock   clock.Clock
+}
+
+func NewWebhookDeliveries(repo DeliveryRepository, webhook *WebhookChannel, policy Policy, emitter *events.Emitter) *WebhookDeliveries {
+	return &WebhookDeliveries{
+		repo:    repo,
+		webhook: webhook,
+		policy:  policy,
+		limiter: middleware.NewRateLimiter(policy.Rate, policy.Burst),
+		events:  emitter,
+		clock:   clock.System,
+	}
+}
+
+// Send logs the delivery and makes the first attempt. A failed attempt
+// isn't an error to the caller: the delivery is retried from the log.
+func (w *WebhookDeliveries) Send(ctx context.Context, msg Message) error {
+	d := &Delivery{
+		Tenant:       msg.Tenant,
+		Notification: msg.Notification,
+		EventID:      msg.EventID,
+		URL:          msg.To,
+		Payload:      msg.Rendered.Body,
+		Status:       DeliveryPending,
+	}
+	if err := w.repo.Create(ctx, d); err != nil {
+		return err
+	}
+	if err := w.attempt(ctx, d, false); err != nil {
+		log.Printf("webhook delivery %d: %v", d.ID, err)
+	}
+	return nil
+}
+
+// backoff is the wait before the retry that follows attempt n
+func (w *WebhookDeliveries) backoff(n int) time.Duration {
+	d := w.policy.Backoff
+	for i := 1; i < n && d < w.policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, w.policy.MaxBackoff)
+}
+
+// attempt delivers d once and records the outcome. It returns the delivery
+// error, or an error recording it.
+func (w *WebhookDeliveries) attempt(ctx context.Context, d *Delivery, replay bool) error {
+	for {
+		ok, wait := w.limiter.Allow("webhook")
+		if ok {
+			break
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+
+	// Receivers can dedupe on the delivery ID, which a replay keeps
+	header := http.Header{"X-Webhook-Delivery": {strconv.FormatInt(d.ID, 10)}}
+	start := time.Now()
+	code, response, err := w.webhook.Deliver(ctx, d.URL, d.Payload, header)
+
+	d.Attempts++
+	a := DeliveryAttempt{
+		Attempt:     d.Attempts,
+		StatusCode:  code,
+		Response:    string(response),
+		DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+		Replay:      replay,
+		AttemptedAt: start,
+	}
+	previous := d.Status
+	d.LastStatusCode = code
+	d.LastError = ""
+	d.NextAttemptAt = nil
+	switch {
+	case err == nil:
+		d.Status = DeliveryDelivered
+	case replay && previous != DeliveryFailed:
+		// A failed replay leaves the delivery as it was
+		d.Status = previous
+	case isPermanent(err) || d.Attempts >= w.policy.Attempts:
+		d.Status = DeliveryDeadLettered
+	default:
+		d.Status = DeliveryFailed
+		next := w.clock.Now().Add(w.backoff(d.Attempts))
+		d.NextAttemptAt = &next
+	}
+	if err != nil {
+		a.Error = err.Error()
+		d.LastError = a.Error
+	}
+
+	// Record even if the request that triggered the attempt has gone away
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if rerr := w.repo.RecordAttempt(recordCtx, d, a); rerr != nil {
+		return fmt.Errorf("record attempt: %w", rerr)
+	}
+	if d.Status == DeliveryDeadLettered && previous != DeliveryDeadLettered {
+		log.Printf("webhook delivery %d dead-lettered after %d attempts: %s", d.ID, d.Attempts, d.LastError)
+		w.events.Emit(ctx, "webhook.dead_lettered", fmt.Sprintf("webhook_delivery/%d", d.ID), map[string]any{
+			"delivery_id":      d.ID,
+			"tenant":           d.Tenant,
+			"notification":     d.Notification,
+			"url":              d.URL,
+			"attempts":         d.Attempts,
+			"last_status_code": d.LastStatusCode,
+			"last_error":       d.LastError,
+		})
+	}
+	return err
+}
+
+// Run retries due deliveries every interval until ctx is done
+func (w *WebhookDeliveries) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			due, err := w.repo.ClaimDue(ctx, w.clock.Now(), time.Minute, 50)
+			if err != nil {
+				log.Printf("claim due webhook deliveries: %v", err)
+				continue
+			}
+			for _, d := range due {
+				if err := w.attempt(ctx, &d, false); err != nil {
+					log.Printf("webhook delivery %d: %v", d.ID, err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DeliveryAPI lets integrators inspect and replay webhook deliveries
+type DeliveryAPI struct {
+	deliveries *WebhookDeliveries
+}
+
+const (
+	defaultDeliveryPage = 50
+	maxDeliveryPage     = 500
+)
+
+func deliveryID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+	return id, err == nil
+}
+
+// List pages through a tenant's deliveries, newest first. Query: tenant,
+// status, before (an ID) and limit.
+func (a *DeliveryAPI) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := DeliveryFilter{Tenant: q.Get("tenant"), Status: q.Get("status"), Limit: defaultDeliveryPage}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		f.Before = before
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(limit, maxDeliveryPage)
+	}
+
+	deliveries, err := a.deliveries.repo.List(r.Context(), f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []Delivery{}
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// Get shows a delivery's payload and every response it got
+func (a *DeliveryAPI) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := deliveryID(r)
+	if !ok {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	d, err := a.deliveries.repo.Get(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+type replayResult struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// replay sends one delivery again, whatever its state
+func (a *DeliveryAPI) replay(ctx context.Context, id int64) (replayResult, error) {
+	d, err := a.deliveries.repo.Get(ctx, id)
+	if err != nil {
+		return replayResult{ID: id}, err
+	}
+	res := replayResult{ID: id}
+	if err := a.deliveries.attempt(ctx, d, true); err != nil {
+		res.Error = err.Error()
+	}
+	res.Status = d.Status
+	return res, nil
+}
+
+func (a *DeliveryAPI) Replay(w http.ResponseWriter, r *http.Request) {
+	id, ok := deliveryID(r)
+	if !ok {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	res, err := a.replay(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type bulkReplayRequest struct {
+	// IDs replays these deliveries; without them, up to Limit of the
+	// tenant's deliveries in Status (default dead_lettered) are replayed
+	IDs    []int64 `json:"ids"`
+	Tenant string  `json:"tenant"`
+	Status string  `json:"status"`
+	Limit  int     `json:"limit"`
+}
+
+// ReplayBulk replays many deliveries one after another, within the
+// channel's rate limit, and reports the outcome of each
+func (a *DeliveryAPI) ReplayBulk(w http.ResponseWriter, r *http.Request) {
+	var req bulkReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	ids := req.IDs
+	if len(ids) == 0 {
+		f := DeliveryFilter{Tenant: req.Tenant, Status: req.Status, Limit: defaultDeliveryPage}
+		if f.Status == "" {
+			f.Status = DeliveryDeadLettered
+		}
+		if req.Limit > 0 {
+			f.Limit = min(req.Limit, maxDeliveryPage)
+		}
+		deliveries, err := a.deliveries.repo.List(ctx, f)
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		for _, d := range deliveries {
+			ids = append(ids, d.ID)
+		}
+	}
+	if len(ids) > maxDeliveryPage {
+		http.Error(w, fmt.Sprintf("at most %d deliveries per replay", maxDeliveryPage), http.StatusUnprocessableEntity)
+		return
+	}
+
+	results := make([]replayResult, 0, len(ids))
+	for _, id := range ids {
+		res, err := a.replay(ctx, id)
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
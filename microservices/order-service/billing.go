@@ -0,0 +1,409 @@
+// order-service/billing.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/fields"
+	"platform/middleware"
+	"platform/projection"
+)
+
+// Metrics billing meters. api_calls come from the gateway's usage.metered
+// events; orders and order_value from orders completing.
+const (
+	MetricAPICalls   = "api_calls"
+	MetricOrders     = "orders"
+	MetricOrderValue = "order_value"
+)
+
+// UsageRecord is a tenant's use of one metric in one hour. First-party
+// usage has no tenant.
+type UsageRecord struct {
+	Tenant string `json:"tenant"`
+	Metric string `json:"metric"`
+	// Hour starts the hour, or the day in daily rollups
+	Hour     time.Time `json:"start"`
+	Quantity float64   `json:"quantity"`
+}
+
+type usageResponse struct {
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to"`
+	Granularity string        `json:"granularity"`
+	Usage       []UsageRecord `json:"usage"`
+}
+
+type UsageFilter struct {
+	// Tenant limits the records to one tenant's; nil means every tenant
+	Tenant   *string
+	From, To time.Time
+}
+
+type UsageRepository interface {
+	// MeterUsage adds what event stands for, each record's quantity to its
+	// tenant's metric in the hour of its start, unless the event was
+	// metered before; it reports whether it was
+	MeterUsage(ctx context.Context, event events.Event, records []UsageRecord) (bool, error)
+	// PruneMetered forgets which events were metered before before
+	PruneMetered(ctx context.Context, before time.Time) (int64, error)
+	// Usage returns the hourly records in [From, To), oldest first
+	Usage(ctx context.Context, filter UsageFilter) ([]UsageRecord, error)
+	// ClaimUnreported returns what hours before before gained since they
+	// were last reported, and marks it reported
+	ClaimUnreported(ctx context.Context, before time.Time, limit int) ([]UsageRecord, error)
+}
+
+func (r *PostgresOrderRepository) MeterUsage(ctx context.Context, event events.Event, records []UsageRecord) (bool, error) {
+	var metered bool
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		claimed, err := projection.Claim(ctx, tx, usageProjection, event)
+		if err != nil || !claimed {
+			return err
+		}
+		for _, u := range records {
+			_, err := tx.ExecContext(ctx, `INSERT INTO usage_hourly (tenant, metric, hour, quantity)
+              VALUES ($1, $2, $3, $4)
+              ON CONFLICT (tenant, metric, hour) DO UPDATE
+              SET quantity = usage_hourly.quantity + EXCLUDED.quantity`,
+				u.Tenant, u.Metric, u.Hour.UTC().Truncate(time.Hour), u.Quantity)
+			if err != nil {
+				return err
+			}
+		}
+		metered = true
+		return nil
+	})
+	return metered, err
+}
+
+func (r *PostgresOrderRepository) PruneMetered(ctx context.Context, before time.Time) (int64, error) {
+	return projection.Prune(ctx, r.db, before)
+}
+
+func (r *PostgresOrderRepository) Usage(ctx context.Context, filter UsageFilter) ([]UsageRecord, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT tenant, metric, hour, quantity FROM usage_hourly
+              WHERE ($1::text IS NULL OR tenant = $1) AND hour >= $2 AND hour < $3
+              ORDER BY hour, tenant, metric`, filter.Tenant, filter.From, filter.To)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsage(rows)
+}
+
+func (r *PostgresOrderRepository) ClaimUnreported(ctx context.Context, before time.Time, limit int) ([]UsageRecord, error) {
+	// SKIP LOCKED lets replicas report side by side without overlapping
+	rows, err := r.db.QueryContext(ctx, `WITH due AS (
+                  SELECT tenant, metric, hour, reported FROM usage_hourly
+                  WHERE hour < $1 AND quantity <> reported
+                  ORDER BY hour LIMIT $2
+                  FOR UPDATE SKIP LOCKED)
+              UPDATE usage_hourly u SET reported = u.quantity
+              FROM due
+              WHERE u.tenant = due.tenant AND u.metric = due.metric AND u.hour = due.hour
+              RETURNING u.tenant, u.metric, u.hour, u.quantity - due.reported`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsage(rows)
+}
+
+func scanUsage(rows interface {
+	Next() bool
+	Scan(...any) error
+	Err() error
+	Close() error
+}) ([]UsageRecord, error) {
+	defer rows.Close()
+	var records []UsageRecord
+	for rows.Next() {
+		var u UsageRecord
+		if err := rows.Scan(&u.Tenant, &u.Metric, &u.Hour, &u.Quantity); err != nil {
+			return nil, err
+		}
+		records = append(records, u)
+	}
+	return records, rows.Err()
+}
+
+// usageRow is a memory usage_hourly row
+type usageRow struct {
+	UsageRecord
+	reported float64
+}
+
+func (r *MemoryOrderRepository) MeterUsage(ctx context.Context, event events.Event, records []UsageRecord) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.metered.Claim(usageProjection, event) {
+		return false, nil
+	}
+	for _, rec := range records {
+		r.addUsage(rec.Tenant, rec.Metric, rec.Hour.UTC().Truncate(time.Hour), rec.Quantity)
+	}
+	return true, nil
+}
+
+// addUsage adds quantity to a usage row; r.mu must be held
+func (r *MemoryOrderRepository) addUsage(tenant, metric string, hour time.Time, quantity float64) {
+	for _, u := range r.usage {
+		if u.Tenant == tenant && u.Metric == metric && u.Hour.Equal(hour) {
+			u.Quantity += quantity
+			return
+		}
+	}
+	r.usage = append(r.usage, &usageRow{UsageRecord: UsageRecord{Tenant: tenant, Metric: metric, Hour: hour, Quantity: quantity}})
+}
+
+func (r *MemoryOrderRepository) PruneMetered(ctx context.Context, before time.Time) (int64, error) {
+	return r.metered.Prune(before), nil
+}
+
+func (r *MemoryOrderRepository) Usage(ctx context.Context, filter UsageFilter) ([]UsageRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var records []UsageRecord
+	for _, u := range r.usage {
+		if (filter.Tenant == nil || u.Tenant == *filter.Tenant) && !u.Hour.Before(filter.From) && u.Hour.Before(filter.To) {
+			records = append(records, u.UsageRecord)
+		}
+	}
+	sortUsage(records)
+	return records, nil
+}
+
+func (r *MemoryOrderRepository) ClaimUnreported(ctx context.Context, before time.Time, limit int) ([]UsageRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records []UsageRecord
+	for _, u := range r.usage {
+		if len(records) == limit {
+			break
+		}
+		if u.Hour.Before(before) && u.Quantity != u.reported {
+			delta := u.UsageRecord
+			delta.Quantity -= u.reported
+			u.reported = u.Quantity
+			records = append(records, delta)
+		}
+	}
+	sortUsage(records)
+	return records, nil
+}
+
+func sortUsage(records []UsageRecord) {
+	slices.SortFunc(records, func(a, b UsageRecord) int {
+		if c := a.Hour.Compare(b.Hour); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Tenant, b.Tenant); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Metric, b.Metric)
+	})
+}
+
+// Billing meters usage per tenant into hourly rollups and reports each
+// hour to the external billing system once it is over, as
+// billing.usage_reported events. Quantities in those events are increments:
+// usage metered late for an hour already reported goes out as another
+// event for that hour, so billing sums what it receives.
+type Billing struct {
+	repo    Repository
+	events  *events.Emitter
+	clock   clock.Clock
+	Metrics *projection.Metrics
+}
+
+// usageProjection names the usage rollups among projections
+const usageProjection = "billing_usage"
+
+func NewBilling(repo Repository, emitter *events.Emitter) *Billing {
+	return &Billing{repo: repo, events: emitter, clock: clock.System, Metrics: projection.NewMetrics()}
+}
+
+// Meter records the usage an event stands for, once however often it is
+// delivered; it ignores other events
+func (b *Billing) Meter(ctx context.Context, event events.Event) error {
+	records, err := b.usageOf(ctx, event)
+	if err == nil && records == nil {
+		return nil
+	}
+	metered := false
+	if err == nil {
+		metered, err = b.repo.MeterUsage(ctx, event, records)
+	}
+	switch {
+	case err != nil:
+		b.Metrics.Observe(usageProjection, event, projection.Failed)
+	case metered:
+		b.Metrics.Observe(usageProjection, event, projection.Applied)
+	default:
+		b.Metrics.Observe(usageProjection, event, projection.Duplicate)
+	}
+	return err
+}
+
+// usageOf returns the usage an event stands for, nil for none
+func (b *Billing) usageOf(ctx context.Context, event events.Event) ([]UsageRecord, error) {
+	switch event.Type {
+	case "usage.metered":
+		data, _ := event.Data.(map[string]any)
+		tenant, _ := data["tenant"].(string)
+		metric, _ := data["metric"].(string)
+		hour, _ := data["hour"].(string)
+		quantity, _ := data["quantity"].(float64)
+		at, err := time.Parse(time.RFC3339, hour)
+		if metric == "" || err != nil || quantity <= 0 {
+			return nil, fmt.Errorf("usage event %s needs a metric, hour and quantity", event.ID)
+		}
+		return []UsageRecord{{Tenant: tenant, Metric: metric, Hour: at, Quantity: quantity}}, nil
+	case "order.completed":
+		// The event leaves the tenant out, the order has it
+		id, err := strconv.Atoi(strings.TrimPrefix(event.Subject, "order/"))
+		if err != nil {
+			return nil, fmt.Errorf("order event %s has no order subject", event.ID)
+		}
+		order, err := b.repo.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return []UsageRecord{
+			{Tenant: order.Tenant, Metric: MetricOrders, Hour: event.OccurredAt, Quantity: 1},
+			{Tenant: order.Tenant, Metric: MetricOrderValue, Hour: event.OccurredAt, Quantity: order.Amount},
+		}, nil
+	}
+	return nil, nil
+}
+
+// Run reports finished hours every interval until ctx is done
+func (b *Billing) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			due, err := b.repo.ClaimUnreported(ctx, b.clock.Now().Truncate(time.Hour), 500)
+			if err != nil {
+				log.Printf("claim unreported usage: %v", err)
+				continue
+			}
+			for _, u := range due {
+				b.events.Emit(ctx, "billing.usage_reported", "usage/"+u.Tenant, u)
+			}
+			if _, err := b.repo.PruneMetered(ctx, b.clock.Now().Add(-projection.Retention)); err != nil {
+				log.Printf("prune metered events: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// billingTenant decides whose usage the caller may see: admins any
+// tenant's (or all, by leaving tenant out), tenants their own
+func billingTenant(r *http.Request) (*string, bool) {
+	requested, asked := r.URL.Query().Get("tenant"), r.URL.Query().Has("tenant")
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	switch {
+	case !ok || p.HasRole("admin"):
+		if !asked {
+			return nil, true
+		}
+		return &requested, true
+	case p.Tenant != "" && (!asked || requested == p.Tenant):
+		return &p.Tenant, true
+	}
+	return nil, false
+}
+
+// GetUsage returns metered usage, e.g.
+// GET /billing/usage?tenant=acme&from=2025-01-01T00:00:00Z&granularity=day.
+// from and to default to the current month so far; granularity is hour
+// (the rollups as stored) or day.
+func (b *Billing) GetUsage(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := billingTenant(r)
+	if !ok {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	now := b.clock.Now()
+	filter := UsageFilter{
+		Tenant: tenant,
+		From:   time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		To:     now.Add(time.Hour),
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	granularity := q.Get("granularity")
+	switch granularity {
+	case "":
+		granularity = "hour"
+	case "hour", "day":
+	default:
+		http.Error(w, "invalid granularity", http.StatusBadRequest)
+		return
+	}
+
+	records, err := b.repo.Usage(r.Context(), filter)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if granularity == "day" {
+		records = rollUpDays(records)
+	}
+	if records == nil {
+		records = []UsageRecord{}
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, usageResponse{
+		From:        filter.From,
+		To:          filter.To,
+		Granularity: granularity,
+		Usage:       records,
+	}))
+}
+
+// rollUpDays sums hourly records into days; records come sorted by hour
+func rollUpDays(hourly []UsageRecord) []UsageRecord {
+	var days []UsageRecord
+	index := make(map[UsageRecord]int)
+	for _, u := range hourly {
+		key := UsageRecord{Tenant: u.Tenant, Metric: u.Metric, Hour: u.Hour.Truncate(24 * time.Hour)}
+		if i, ok := index[key]; ok {
+			days[i].Quantity += u.Quantity
+			continue
+		}
+		index[key] = len(days)
+		days = append(days, UsageRecord{Tenant: u.Tenant, Metric: u.Metric, Hour: key.Hour, Quantity: u.Quantity})
+	}
+	return days
+}
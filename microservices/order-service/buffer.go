@@ -0,0 +1,196 @@
+// order-service/buffer.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"platform/dbretry"
+	"platform/quota"
+	"platform/spool"
+)
+
+// OrderBuffer takes orders in while the database refuses connections,
+// during a failover or a restart, instead of failing every checkout: the
+// order waits in a spool on local disk, the customer gets 202, and the
+// order is placed and paid once the database takes connections again.
+type OrderBuffer struct {
+	orders *OrderService
+	spool  *spool.Spool
+}
+
+// bufferedOrder is an order as it waits in the spool, with what placing
+// it needs that the order doesn't carry
+type bufferedOrder struct {
+	Order  Order     `json:"order"`
+	Tenant string    `json:"tenant,omitempty"`
+	Buyer  *Customer `json:"buyer"`
+}
+
+// orderBufferFromEnv buffers orders in ORDER_BUFFER_DIR, up to
+// ORDER_BUFFER_MAX of them (10000 by default); nil when the directory
+// isn't set, so a failed insert fails the checkout as before
+func orderBufferFromEnv(orders *OrderService) *OrderBuffer {
+	dir := os.Getenv("ORDER_BUFFER_DIR")
+	if dir == "" {
+		return nil
+	}
+	capacity := 10000
+	if v := os.Getenv("ORDER_BUFFER_MAX"); v != "" {
+		var err error
+		if capacity, err = strconv.Atoi(v); err != nil || capacity < 1 {
+			log.Fatalf("invalid ORDER_BUFFER_MAX %q", v)
+		}
+	}
+	s, err := spool.Open("orders", dir, capacity)
+	if err != nil {
+		log.Fatalf("order buffer: %v", err)
+	}
+	if n := s.Len(); n > 0 {
+		log.Printf("order buffer: %d orders from an earlier run wait to be placed", n)
+	}
+	return &OrderBuffer{orders: orders, spool: s}
+}
+
+// holds reports whether an order whose insert failed with err may wait in
+// the buffer: when the insert never reached the database, or when it may
+// have but the order's external ID keeps a replay from creating it twice
+func (b *OrderBuffer) holds(order *Order, err error) bool {
+	if b == nil {
+		return false
+	}
+	switch dbretry.Classify(err) {
+	case dbretry.Rejected:
+		return true
+	case dbretry.Lost:
+		return order.ExternalID != ""
+	}
+	return false
+}
+
+// take buffers order and answers 202 with it, status buffered. Orders
+// without an external ID get one, so the client can look the order up by
+// it once it's placed. It reports false, having answered nothing, when the
+// buffer can't take the order.
+func (b *OrderBuffer) take(w http.ResponseWriter, r *http.Request, order *Order, buyer *Customer) bool {
+	if order.ExternalID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		order.ExternalID = "buffered-" + hex.EncodeToString(id)
+	}
+	entry := bufferedOrder{Order: *order, Tenant: order.Tenant, Buyer: buyer}
+	entry.Order.Links = nil
+	if _, err := b.spool.Put(entry); err != nil {
+		log.Printf("order buffer: can't take order for user %d: %v", order.UserID, err)
+		return false
+	}
+	order.Status = "buffered"
+	self := b.orders.routes.Path("get-order-view", "by-external-id", order.ExternalID)
+	order.Links = map[string]string{"self": self}
+	w.Header().Set("Location", self)
+	writeJSON(w, http.StatusAccepted, order)
+	return true
+}
+
+// Run places the buffered orders every interval until ctx is done
+func (b *OrderBuffer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.replay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *OrderBuffer) replay(ctx context.Context) {
+	if b.spool.Len() == 0 {
+		return
+	}
+	n, err := b.spool.Drain(func(id string, raw json.RawMessage) error {
+		var entry bufferedOrder
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			log.Printf("order buffer: entry %s unreadable, dropped: %v", id, err)
+			return nil
+		}
+		return b.place(ctx, &entry)
+	})
+	if n > 0 {
+		log.Printf("order buffer: placed %d buffered orders", n)
+	}
+	if err != nil {
+		log.Printf("order buffer: %d orders still wait: %v", b.spool.Len(), err)
+	}
+}
+
+// place creates and pays a buffered order. It fails while the database
+// is still out of reach, or when the insert may or may not have gone
+// through, which the order's external ID makes safe to try again; an order
+// the database turns down is logged and given up, its quota handed back.
+// An earlier try that did go through is picked up and paid.
+func (b *OrderBuffer) place(ctx context.Context, entry *bufferedOrder) error {
+	order := &entry.Order
+	order.Tenant = entry.Tenant
+	order.Status = "pending"
+	switch err := b.orders.repo.Create(ctx, order); {
+	case errors.Is(err, errExternalIDTaken):
+		return b.placed(ctx, entry)
+	case errors.Is(err, dbretry.ErrCommitUnknown),
+		dbretry.Status(err) == http.StatusServiceUnavailable,
+		dbretry.Status(err) == http.StatusGatewayTimeout:
+		return err
+	case err != nil:
+		log.Printf("order buffer: order %s for user %d can't be created, dropped: %v", order.ExternalID, order.UserID, err)
+		b.release(ctx, order)
+		return nil
+	}
+	if _, err := b.orders.payOrder(ctx, order, entry.Buyer); err != nil {
+		log.Printf("order buffer: order %d: %v", order.ID, err)
+	}
+	return nil
+}
+
+// placed handles an entry whose external ID already has an order. An
+// earlier try whose commit went unanswered may have made it, and then it
+// still needs paying; an order of someone else's is a genuine conflict, and
+// the entry is dropped.
+func (b *OrderBuffer) placed(ctx context.Context, entry *bufferedOrder) error {
+	order := &entry.Order
+	existing, err := b.orders.repo.ByExternalID(ctx, order.Tenant, order.ExternalID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil || existing.UserID != order.UserID {
+		log.Printf("order buffer: external ID %s already has another order; buffered order dropped", order.ExternalID)
+		b.release(ctx, order)
+		return nil
+	}
+	if existing.Status != "pending" {
+		return nil
+	}
+	if _, err := b.orders.payOrder(ctx, existing, entry.Buyer); err != nil {
+		log.Printf("order buffer: order %d: %v", existing.ID, err)
+	}
+	return nil
+}
+
+func (b *OrderBuffer) release(ctx context.Context, order *Order) {
+	if b.orders.quotas == nil {
+		return
+	}
+	subject := quota.Subject(order.Tenant, strconv.Itoa(order.UserID))
+	if err := b.orders.quotas.Release(ctx, subject, "orders", 1); err != nil {
+		log.Printf("release quota orders for %s: %v", subject, err)
+	}
+}
@@ -0,0 +1,130 @@
+// order-service/callback.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"platform/i18n"
+	"platform/middleware"
+)
+
+// fetchPayment asks payment-service how a payment ended
+func (s *OrderService) fetchPayment(ctx context.Context, paymentID int) (*PaymentReceipt, error) {
+	url := fmt.Sprintf("%s/payments/%d", s.paymentServiceURL, paymentID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, "payment-service", time.Since(start))
+	if err != nil {
+		return nil, i18n.Wrap(err, "order.payment_service_unavailable")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, i18n.Wrap(fmt.Errorf("payment %d: %s", paymentID, resp.Status), "order.payment_service_unavailable")
+	}
+	var receipt PaymentReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+		return nil, i18n.Wrap(err, "order.payment_service_unavailable")
+	}
+	return &receipt, nil
+}
+
+// settle moves an unsettled order on by how its payment ended, completing
+// it for customer or failing it. An order settled meanwhile is
+// left as it was settled.
+func (s *OrderService) settle(ctx context.Context, order *Order, receipt *PaymentReceipt, customer *Customer) error {
+	to := "payment_failed"
+	if receipt.Status == "completed" {
+		to = "completed"
+	}
+	err := s.repo.Transition(ctx, order.ID, order.Status, to)
+	if errors.Is(err, errStatusChanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	order.Status = to
+	if to == "completed" {
+		s.completed(ctx, order, customer, receipt)
+	} else {
+		s.events.Emit(ctx, "order.payment_failed", fmt.Sprintf("order/%d", order.ID), order)
+	}
+	return nil
+}
+
+// PaymentCallback settles an order that was awaiting payment confirmation.
+// The client calls it once the customer is back at the return_url; the
+// outcome is read from payment-service, never taken from the caller.
+// Calling it again after the order settled returns the order unchanged.
+func (s *OrderService) PaymentCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+
+	orderID, err := s.orderIDParam(r)
+	var order *Order
+	if err == nil {
+		order, err = s.repo.Get(ctx, orderID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+	if p, ok := middleware.PrincipalFromContext(ctx); ok &&
+		p.Subject != strconv.Itoa(order.UserID) && !p.HasRole("admin") {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if order.Status != "awaiting_confirmation" {
+		s.writeOrder(w, http.StatusOK, order)
+		return
+	}
+
+	receipt, err := s.fetchPayment(ctx, order.PaymentID)
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadGateway)
+		return
+	}
+	if receipt.Status == "requires_action" {
+		i18n.Error(w, r, http.StatusConflict, "order.payment_awaiting_confirmation")
+		return
+	}
+	var customer *Customer
+	if receipt.Status == "completed" {
+		if customer, err = s.fetchCustomer(ctx, order.UserID); err != nil {
+			http.Error(w, loc.Text(err), http.StatusBadGateway)
+			return
+		}
+	}
+	bookkeeping := context.WithoutCancel(ctx)
+	if err := s.settle(bookkeeping, order, receipt, customer); err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+
+	// A concurrent callback may have settled it first; report what stuck
+	if order, err = s.repo.Get(bookkeeping, order.ID); err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+	s.writeOrder(w, http.StatusOK, order)
+}
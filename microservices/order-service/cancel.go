@@ -0,0 +1,115 @@
+// order-service/cancel.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"platform/i18n"
+	"platform/middleware"
+)
+
+// errPaymentSettled means the payment stopped waiting for the customer
+// before it could be canceled
+var errPaymentSettled = errors.New("payment no longer awaiting confirmation")
+
+// cancelPayment abandons an order's payment that is still waiting for the
+// customer to authenticate
+func (s *OrderService) cancelPayment(ctx context.Context, paymentID int) error {
+	url := fmt.Sprintf("%s/payments/%d/cancel", s.paymentServiceURL, paymentID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(req); err != nil {
+		return err
+	}
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, "payment-service", time.Since(start))
+	if err != nil {
+		return i18n.Wrap(err, "order.payment_service_unavailable")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errPaymentSettled
+	}
+	return i18n.Wrap(fmt.Errorf("payment %d: %s", paymentID, resp.Status), "order.payment_service_unavailable")
+}
+
+// canceled records that an order's payment was canceled. An order settled
+// meanwhile is left as it was settled.
+func (s *OrderService) canceled(ctx context.Context, order *Order) error {
+	err := s.repo.Transition(ctx, order.ID, order.Status, "canceled")
+	if errors.Is(err, errStatusChanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	order.Status = "canceled"
+	s.events.Emit(ctx, "order.canceled", fmt.Sprintf("order/%d", order.ID), order)
+	return nil
+}
+
+// CancelOrder drops an order the customer hasn't confirmed the payment
+// for yet, canceling that payment first so it can't be completed later.
+// Orders past that point are returned instead.
+func (s *OrderService) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+
+	orderID, err := s.orderIDParam(r)
+	var order *Order
+	if err == nil {
+		order, err = s.repo.Get(ctx, orderID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+	if !s.canManage(r, order) {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if order.Status != "awaiting_confirmation" {
+		i18n.Error(w, r, http.StatusConflict, "order.not_cancelable", order.Status)
+		return
+	}
+
+	err = s.cancelPayment(ctx, order.PaymentID)
+	if errors.Is(err, errPaymentSettled) {
+		// The customer finished paying meanwhile; the callback settles it
+		i18n.Error(w, r, http.StatusConflict, "order.not_cancelable", order.Status)
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadGateway)
+		return
+	}
+	bookkeeping := context.WithoutCancel(ctx)
+	if err := s.canceled(bookkeeping, order); err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+
+	// A concurrent callback may have settled it first; report what stuck
+	if order, err = s.repo.Get(bookkeeping, order.ID); err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+	s.writeOrder(w, http.StatusOK, order)
+}
@@ -0,0 +1,116 @@
+// order-service/confirmation.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"platform/dbretry"
+	"platform/fields"
+	"platform/i18n"
+	"platform/middleware"
+)
+
+// Customer is the part of a user-service user kept on a confirmation
+type Customer struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// PaymentReceipt is payment-service's answer to a charge
+type PaymentReceipt struct {
+	ID        int       `json:"id"`
+	Amount    float64   `json:"amount"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	// ConfirmationURL is set while the payment requires_action
+	ConfirmationURL string `json:"confirmation_url,omitempty"`
+	// CreditAmount is the part paid with store credit
+	CreditAmount float64 `json:"credit_amount,omitempty"`
+}
+
+type ConfirmationItem struct {
+	Product   string  `json:"product"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	LineTotal float64 `json:"line_total"`
+}
+
+// Confirmation is the document a customer was shown when their order
+// completed. It copies everything it shows instead of referring to it, so
+// it reads the same after the user, catalog or payment change.
+type Confirmation struct {
+	OrderID     int                `json:"order_id"`
+	Customer    Customer           `json:"customer"`
+	Items       []ConfirmationItem `json:"items"`
+	Total       float64            `json:"total"`
+	Payment     PaymentReceipt     `json:"payment"`
+	ConfirmedAt time.Time          `json:"confirmed_at"`
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// roundingProduct is the line making up the cents lost when an order's
+// amount doesn't split evenly into its unit price
+const roundingProduct = "rounding"
+
+func newConfirmation(order *Order, customer *Customer, payment *PaymentReceipt, confirmedAt time.Time) *Confirmation {
+	item := ConfirmationItem{
+		Product:   order.Product,
+		Quantity:  order.Quantity,
+		LineTotal: order.Amount,
+	}
+	items := []ConfirmationItem{item}
+	if order.Quantity > 0 {
+		item.UnitPrice = roundCents(order.Amount / float64(order.Quantity))
+		item.LineTotal = roundCents(item.UnitPrice * float64(order.Quantity))
+		items[0] = item
+		// Every line reads unit price times quantity, and the lines add up
+		// to the total
+		if diff := roundCents(order.Amount - item.LineTotal); diff != 0 {
+			items = append(items, ConfirmationItem{Product: roundingProduct, Quantity: 1, UnitPrice: diff, LineTotal: diff})
+		}
+	}
+	return &Confirmation{
+		OrderID:     order.ID,
+		Customer:    *customer,
+		Items:       items,
+		Total:       order.Amount,
+		Payment:     *payment,
+		ConfirmedAt: confirmedAt,
+	}
+}
+
+// GetConfirmation serves an order's confirmation to its customer or an
+// admin
+func (s *OrderService) GetConfirmation(w http.ResponseWriter, r *http.Request) {
+	orderID, err := s.orderIDParam(r)
+	var c *Confirmation
+	if err == nil {
+		c, err = s.repo.Confirmation(r.Context(), orderID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "order.confirmation_not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok &&
+		p.Subject != strconv.Itoa(c.Customer.ID) && !p.HasRole("admin") {
+		// Don't reveal that someone else's order exists
+		i18n.Error(w, r, http.StatusNotFound, "order.confirmation_not_found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields.Select(w, r, c))
+}
@@ -0,0 +1,487 @@
+// order-service/consistency.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/alert"
+	"platform/auth"
+	"platform/clock"
+	"platform/events"
+	"platform/middleware"
+)
+
+// Kinds of inconsistency between orders and payment-service's payments
+const (
+	// ViolationUnpaidOrder is a completed order whose payment wasn't
+	// captured or can't be found
+	ViolationUnpaidOrder = "unpaid_order"
+	// ViolationAmountMismatch is a completed order paid a different amount
+	ViolationAmountMismatch = "amount_mismatch"
+	// ViolationUnsettledOrder is an order still pending or awaiting
+	// confirmation when its payment has completed
+	ViolationUnsettledOrder = "unsettled_order"
+	// ViolationStrayPayment is a payment holding money that its order
+	// doesn't account for: the order is missing, failed, canceled or was
+	// paid by another payment
+	ViolationStrayPayment = "stray_payment"
+)
+
+// paidStatuses are those of payments that took the money, whatever has
+// been given back since; heldStatuses those still holding some of it
+var (
+	paidStatuses = map[string]bool{"completed": true, "partially_refunded": true, "refunded": true, "charged_back": true}
+	heldStatuses = map[string]bool{"completed": true, "partially_refunded": true}
+)
+
+// Repairs the checker makes
+const (
+	RepairCompleteOrder = "complete_order"
+	RepairRefundPayment = "refund_payment"
+)
+
+// Violation is one broken invariant; Repair says what was done about it
+type Violation struct {
+	Kind          string  `json:"kind"`
+	OrderID       int     `json:"order_id"`
+	PaymentID     int     `json:"payment_id,omitempty"`
+	OrderStatus   string  `json:"order_status,omitempty"`
+	PaymentStatus string  `json:"payment_status,omitempty"`
+	OrderAmount   float64 `json:"order_amount,omitempty"`
+	PaymentAmount float64 `json:"payment_amount,omitempty"`
+	Repair        string  `json:"repair,omitempty"`
+	RepairError   string  `json:"repair_error,omitempty"`
+}
+
+// ConsistencyReport is what a check found among the orders and payments
+// made in [From, To)
+type ConsistencyReport struct {
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	From       time.Time   `json:"from"`
+	To         time.Time   `json:"to"`
+	Repair     bool        `json:"repair"`
+	Orders     int         `json:"orders"`
+	Payments   int         `json:"payments"`
+	Violations []Violation `json:"violations"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// paymentRecord is payment-service's payment, as much as the checker reads
+type paymentRecord struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	Amount    float64   `json:"amount"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errCheckRunning = errors.New("a consistency check is already running")
+
+// ConsistencyChecker samples recent orders and payments and checks the two
+// services agree: every completed order has a captured payment of its
+// amount, and every payment holding money belongs to an order it paid for.
+// Orders younger than grace are left alone, as checkout may still be
+// settling them. With repair on it finishes what checkout left undone,
+// completing paid orders that were never settled and refunding stray
+// payments; amounts that disagree are only reported. Violations left
+// unrepaired and checks that fail are raised with alerts.
+type ConsistencyChecker struct {
+	service *OrderService
+	repo    OrderRepository
+	events  *events.Emitter
+	alerts  *alert.Alerter
+	clock   clock.Clock
+	// tokens sign the admin token payment-service wants; nil when auth is off
+	tokens *auth.Tokens
+
+	window, grace time.Duration
+	sample        int
+	repair        bool
+
+	running sync.Mutex
+
+	mu         sync.Mutex
+	last       *ConsistencyReport
+	checks     map[string]int64
+	violations map[string]int64
+	repairs    map[[2]string]int64
+}
+
+func NewConsistencyChecker(service *OrderService, repo OrderRepository) *ConsistencyChecker {
+	return &ConsistencyChecker{
+		service:    service,
+		repo:       repo,
+		events:     service.events,
+		clock:      service.clock,
+		window:     24 * time.Hour,
+		grace:      10 * time.Minute,
+		sample:     500,
+		checks:     make(map[string]int64),
+		violations: make(map[string]int64),
+		repairs:    make(map[[2]string]int64),
+	}
+}
+
+// Run checks every interval
+func (c *ConsistencyChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.Check(ctx, c.repair); err != nil && !errors.Is(err, errCheckRunning) {
+				log.Printf("consistency check: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check runs one check, repairing what it can when repair is set
+func (c *ConsistencyChecker) Check(ctx context.Context, repair bool) (*ConsistencyReport, error) {
+	if !c.running.TryLock() {
+		return nil, errCheckRunning
+	}
+	defer c.running.Unlock()
+
+	now := c.clock.Now()
+	report := &ConsistencyReport{StartedAt: now, To: now.Add(-c.grace), Repair: repair, Violations: []Violation{}}
+	report.From = report.To.Add(-c.window)
+	err := c.check(ctx, report)
+	report.FinishedAt = c.clock.Now()
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	c.last = report
+	switch {
+	case err != nil:
+		c.checks["failed"]++
+	case len(report.Violations) > 0:
+		c.checks["violations"]++
+	default:
+		c.checks["ok"]++
+	}
+	for _, v := range report.Violations {
+		c.violations[v.Kind]++
+		if v.Repair != "" {
+			outcome := "repaired"
+			if v.RepairError != "" {
+				outcome = "failed"
+			}
+			c.repairs[[2]string{v.Repair, outcome}]++
+		}
+	}
+	c.mu.Unlock()
+	c.alert(ctx, report)
+	return report, err
+}
+
+// alert raises what a check found that needs someone, and resolves what a
+// later check no longer finds
+func (c *ConsistencyChecker) alert(ctx context.Context, report *ConsistencyReport) {
+	if report.Error != "" {
+		// Payment-service being unreachable is the likely cause
+		c.alerts.Alert(ctx, alert.Alert{
+			Key:      "consistency/check",
+			Severity: alert.Warning,
+			Summary:  "orders couldn't be checked against their payments",
+			Details:  map[string]string{"error": report.Error},
+		})
+		return
+	}
+	c.alerts.Resolve(ctx, "consistency/check")
+
+	unrepaired := make(map[string]int)
+	total := 0
+	for _, v := range report.Violations {
+		if v.Repair == "" || v.RepairError != "" {
+			unrepaired[v.Kind]++
+			total++
+		}
+	}
+	if total == 0 {
+		c.alerts.Resolve(ctx, "consistency/violations")
+		return
+	}
+	details := make(map[string]string, len(unrepaired))
+	for kind, n := range unrepaired {
+		details[kind] = strconv.Itoa(n)
+	}
+	c.alerts.Alert(ctx, alert.Alert{
+		Key:      "consistency/violations",
+		Severity: alert.Warning,
+		Summary:  fmt.Sprintf("%d disagreements between orders and payments weren't repaired", total),
+		Details:  details,
+	})
+}
+
+func (c *ConsistencyChecker) check(ctx context.Context, report *ConsistencyReport) error {
+	orders := make(map[int]*Order)
+	err := c.repo.EachOrder(ctx, OrderFilter{CreatedFrom: report.From, CreatedTo: report.To, Limit: c.sample},
+		func(o *Order) error {
+			c := *o
+			orders[o.ID] = &c
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	report.Orders = len(orders)
+
+	listed, err := c.payments(ctx, report.From, report.To)
+	if err != nil {
+		return err
+	}
+	report.Payments = len(listed)
+	payments := make(map[int]*paymentRecord, len(listed))
+	for i := range listed {
+		payments[listed[i].ID] = &listed[i]
+	}
+
+	ids := make([]int, 0, len(orders))
+	for id := range orders {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		o := orders[id]
+		// Imported orders are completed without a payment
+		if o.Status != "completed" || o.PaymentID == 0 {
+			continue
+		}
+		p, ok := payments[o.PaymentID]
+		if !ok {
+			if p, err = c.payment(ctx, o.PaymentID); err != nil {
+				return err
+			}
+		}
+		v := Violation{OrderID: o.ID, PaymentID: o.PaymentID, OrderStatus: o.Status, OrderAmount: o.Amount}
+		switch {
+		case p == nil:
+			v.Kind = ViolationUnpaidOrder
+		case !paidStatuses[p.Status]:
+			v.Kind, v.PaymentStatus, v.PaymentAmount = ViolationUnpaidOrder, p.Status, p.Amount
+		case roundCents(p.Amount) != roundCents(o.Amount):
+			v.Kind, v.PaymentStatus, v.PaymentAmount = ViolationAmountMismatch, p.Status, p.Amount
+		default:
+			continue
+		}
+		c.violation(ctx, report, v)
+	}
+
+	for _, p := range listed {
+		if !heldStatuses[p.Status] {
+			continue
+		}
+		o, ok := orders[p.OrderID]
+		if !ok {
+			o, err = c.repo.Get(ctx, p.OrderID)
+			if errors.Is(err, ErrNotFound) {
+				o, err = nil, nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		v := Violation{OrderID: p.OrderID, PaymentID: p.ID, PaymentStatus: p.Status, PaymentAmount: p.Amount}
+		if o != nil {
+			v.OrderStatus, v.OrderAmount = o.Status, o.Amount
+		}
+		switch {
+		case o != nil && o.PaymentID == p.ID && o.Status == "completed":
+			continue
+		case o != nil && (o.PaymentID == p.ID || o.PaymentID == 0) &&
+			(o.Status == "pending" || o.Status == "awaiting_confirmation"):
+			v.Kind = ViolationUnsettledOrder
+			if report.Repair && p.Status == "completed" {
+				v.Repair = RepairCompleteOrder
+				if err := c.completeOrder(ctx, o, &p); err != nil {
+					v.RepairError = err.Error()
+				}
+			}
+		default:
+			v.Kind = ViolationStrayPayment
+			if report.Repair {
+				v.Repair = RepairRefundPayment
+				if err := c.refund(ctx, p.ID); err != nil {
+					v.RepairError = err.Error()
+				}
+			}
+		}
+		c.violation(ctx, report, v)
+	}
+	return nil
+}
+
+func (c *ConsistencyChecker) violation(ctx context.Context, report *ConsistencyReport, v Violation) {
+	report.Violations = append(report.Violations, v)
+	line, _ := json.Marshal(v)
+	log.Printf("consistency violation %s", line)
+	c.events.Emit(ctx, "consistency.violation", fmt.Sprintf("order/%d", v.OrderID), v)
+}
+
+// completeOrder settles an order as the payment callback would have
+func (c *ConsistencyChecker) completeOrder(ctx context.Context, o *Order, p *paymentRecord) error {
+	customer, err := c.service.fetchCustomer(ctx, o.UserID)
+	if err != nil {
+		return err
+	}
+	if err := c.repo.Transition(ctx, o.ID, o.Status, "completed"); err != nil {
+		return err
+	}
+	if o.PaymentID == 0 {
+		if err := c.repo.RecordPayment(ctx, o.ID, p.ID, "completed"); err != nil {
+			return err
+		}
+	}
+	o.Status, o.PaymentID = "completed", p.ID
+	c.service.completed(ctx, o, customer, &PaymentReceipt{ID: p.ID, Amount: p.Amount, Status: p.Status, CreatedAt: p.CreatedAt})
+	return nil
+}
+
+// call makes a request of payment-service as an admin
+func (c *ConsistencyChecker) call(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.service.paymentServiceURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokens != nil {
+		token, err := c.tokens.Issue(auth.Claims{Subject: "order-service", Roles: []string{"admin"}}, time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := c.service.client.Do(req)
+	middleware.RecordUpstream(ctx, "payment-service", time.Since(start))
+	return resp, err
+}
+
+// payments lists the payments made in [from, to), up to the sample size
+func (c *ConsistencyChecker) payments(ctx context.Context, from, to time.Time) ([]paymentRecord, error) {
+	q := url.Values{
+		"from":  {from.UTC().Format(time.RFC3339Nano)},
+		"to":    {to.UTC().Format(time.RFC3339Nano)},
+		"limit": {strconv.Itoa(c.sample)},
+	}
+	resp, err := c.call(ctx, http.MethodGet, "/payments?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list payments: %s", resp.Status)
+	}
+	var payments []paymentRecord
+	err = json.NewDecoder(resp.Body).Decode(&payments)
+	return payments, err
+}
+
+// payment looks one payment up, nil when payment-service doesn't have it
+func (c *ConsistencyChecker) payment(ctx context.Context, id int) (*paymentRecord, error) {
+	resp, err := c.call(ctx, http.MethodGet, fmt.Sprintf("/payments/%d", id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("payment %d: %s", id, resp.Status)
+	}
+	var p paymentRecord
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// refund gives back what is left of a payment
+func (c *ConsistencyChecker) refund(ctx context.Context, id int) error {
+	resp, err := c.call(ctx, http.MethodPost, fmt.Sprintf("/payments/%d/refunds", id))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refund payment %d: %s", id, resp.Status)
+	}
+	return nil
+}
+
+// Get returns the last check's report
+func (c *ConsistencyChecker) Get(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	last := c.last
+	c.mu.Unlock()
+	if last == nil {
+		http.Error(w, "no consistency check has run yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, last)
+}
+
+// RunNow checks at once, repairing with ?repair=true
+func (c *ConsistencyChecker) RunNow(w http.ResponseWriter, r *http.Request) {
+	repair := c.repair
+	if v := r.URL.Query().Get("repair"); v != "" {
+		var err error
+		if repair, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "repair must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := c.Check(context.WithoutCancel(r.Context()), repair)
+	switch {
+	case errors.Is(err, errCheckRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		writeJSON(w, http.StatusBadGateway, report)
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func (c *ConsistencyChecker) WriteMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintln(w, "# TYPE order_consistency_checks_total counter")
+	for _, outcome := range []string{"ok", "violations", "failed"} {
+		fmt.Fprintf(w, "order_consistency_checks_total{outcome=%q} %d\n", outcome, c.checks[outcome])
+	}
+	fmt.Fprintln(w, "# TYPE order_consistency_violations_total counter")
+	for _, kind := range []string{ViolationUnpaidOrder, ViolationAmountMismatch, ViolationUnsettledOrder, ViolationStrayPayment} {
+		fmt.Fprintf(w, "order_consistency_violations_total{kind=%q} %d\n", kind, c.violations[kind])
+	}
+	fmt.Fprintln(w, "# TYPE order_consistency_repairs_total counter")
+	for _, repair := range []string{RepairCompleteOrder, RepairRefundPayment} {
+		for _, outcome := range []string{"repaired", "failed"} {
+			fmt.Fprintf(w, "order_consistency_repairs_total{repair=%q,outcome=%q} %d\n", repair, outcome, c.repairs[[2]string{repair, outcome}])
+		}
+	}
+	if c.last != nil {
+		fmt.Fprintln(w, "# TYPE order_consistency_last_check_timestamp_seconds gauge")
+		fmt.Fprintf(w, "order_consistency_last_check_timestamp_seconds %d\n", c.last.FinishedAt.Unix())
+	}
+}
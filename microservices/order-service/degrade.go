@@ -0,0 +1,141 @@
+// order-service/degrade.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"platform/i18n"
+	"platform/middleware"
+)
+
+// degradations are the fallbacks DEGRADATION may pick: orders are taken
+// unpaid while payment-service is down and charged once it's back, and
+// customers are served from the last lookup while user-service is down
+var degradations = map[string][]string{
+	"payment-service": {"accept"},
+	"user-service":    {"cache"},
+}
+
+// errPaymentRefused is payment-service answering 503: it turned the payment
+// away before charging anything
+var errPaymentRefused = errors.New("payment-service refused the payment")
+
+// paymentNotTaken reports payment failures that surely left the customer
+// uncharged, so the order can be charged again later: payment-service
+// refused the connection or the payment, or the bulkhead never let the
+// call out. Timeouts and dropped connections may have charged, and don't
+// count.
+func paymentNotTaken(err error) bool {
+	var m *i18n.Message
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, errPaymentRefused) ||
+		errors.As(err, &m) && m.Key == "order.payment_service_busy"
+}
+
+// awaitPayment takes order unpaid, for payOrder when payment-service is
+// down and the policy accepts orders meanwhile
+func (s *OrderService) awaitPayment(ctx context.Context, order *Order, cause error) (int, error) {
+	s.degradation.Degraded(ctx, "payment-service")
+	middleware.Debugf(ctx, "order %d: payment-service down, awaiting payment: %v", order.ID, cause)
+	if err := s.repo.UpdateStatus(ctx, order.ID, "awaiting_payment"); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	order.Status = "awaiting_payment"
+	s.events.Emit(ctx, "order.awaiting_payment", fmt.Sprintf("order/%d", order.ID), order)
+	return http.StatusAccepted, nil
+}
+
+// chargeAwaiting charges the orders taken while payment-service was down,
+// every interval until ctx is done
+func (s *OrderService) chargeAwaiting(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var waiting []Order
+		err := s.repo.EachOrder(ctx, OrderFilter{Status: "awaiting_payment", Limit: stuckListed}, func(o *Order) error {
+			waiting = append(waiting, *o)
+			return nil
+		})
+		if err != nil {
+			log.Printf("orders awaiting payment: %v", err)
+			continue
+		}
+		for i := range waiting {
+			order := &waiting[i]
+			if err := s.chargeOrderLater(ctx, order); err != nil {
+				log.Printf("order %d: charge awaiting payment: %v", order.ID, err)
+			}
+			// payment-service is still down; the rest can wait too
+			if order.Status == "awaiting_payment" {
+				break
+			}
+		}
+	}
+}
+
+// chargeOrderLater charges an order taken unpaid, leaving it awaiting
+// payment again while payment-service is still down. Moving it back to
+// pending first claims it, so two replicas never both charge it.
+func (s *OrderService) chargeOrderLater(ctx context.Context, order *Order) error {
+	err := s.repo.Transition(ctx, order.ID, "awaiting_payment", "pending")
+	if errors.Is(err, errStatusChanged) {
+		order.Status = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	buyer, err := s.fetchCustomer(ctx, order.UserID)
+	if err != nil {
+		if err := s.repo.UpdateStatus(ctx, order.ID, "awaiting_payment"); err != nil {
+			log.Printf("order %d: back to awaiting payment: %v", order.ID, err)
+		}
+		return err
+	}
+	order.Status = "pending"
+	_, err = s.payOrder(ctx, order, buyer)
+	return err
+}
+
+// customerCache keeps the last answer user-service gave for each user, to
+// serve while it's down
+type customerCache struct {
+	mu        sync.Mutex
+	max       int
+	customers map[int]Customer
+}
+
+func newCustomerCache(max int) *customerCache {
+	return &customerCache{max: max, customers: make(map[int]Customer)}
+}
+
+func (c *customerCache) put(userID int, customer *Customer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.customers[userID]; !ok && len(c.customers) >= c.max {
+		// Make room by forgetting someone; which doesn't matter much
+		for id := range c.customers {
+			delete(c.customers, id)
+			break
+		}
+	}
+	c.customers[userID] = *customer
+}
+
+func (c *customerCache) get(userID int) (*Customer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	customer, ok := c.customers[userID]
+	return &customer, ok
+}
@@ -0,0 +1,55 @@
+// order-service/erp.go
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"platform/erp"
+	"platform/events"
+)
+
+// erpOrders are the completed orders placed on a day, which payment-service
+// exports the payments of. An order placed late in the day and completed
+// after ERP_EXPORT_DELAY waits for a retry of its day.
+func erpOrders(repo OrderRepository) erp.Source {
+	return erp.Source{
+		Kind: "orders",
+		Records: func(ctx context.Context, from, to time.Time) ([]any, error) {
+			var orders []any
+			err := repo.EachOrder(ctx, OrderFilter{Status: "completed", CreatedFrom: from, CreatedTo: to}, func(o *Order) error {
+				orders = append(orders, *o)
+				return nil
+			})
+			return orders, err
+		},
+		Mapping: []erp.Field{
+			{Name: "order_id", Value: "{{.public_id}}"},
+			{Name: "external_id", Value: "{{.external_id}}"},
+			{Name: "customer_id", Value: "{{.user_id}}"},
+			{Name: "product", Value: "{{.product}}"},
+			{Name: "quantity", Value: "{{.quantity}}"},
+			{Name: "amount", Value: "{{money .amount}}"},
+			{Name: "payment_id", Value: "{{.payment_id}}"},
+			{Name: "date", Value: "{{date .created_at}}"},
+		},
+	}
+}
+
+// erpExporter exports completed orders through the adapter ERP_ADAPTER
+// names; nil when it names none
+func erpExporter(repo OrderRepository, emitter *events.Emitter) *erp.Exporter {
+	var exports erp.Repository = erp.NewMemoryRepository()
+	if pg, ok := repo.(*PostgresOrderRepository); ok {
+		exports = erp.NewPostgresRepository(pg.db, "order_erp_exports")
+	}
+	exporter, err := erp.FromEnv(exports, emitter, erpOrders(repo))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if exporter == nil {
+		log.Print("ERP_ADAPTER not set; orders aren't exported to an ERP")
+	}
+	return exporter
+}
@@ -0,0 +1,193 @@
+// order-service/expand.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/cdn"
+	"platform/fields"
+	"platform/i18n"
+)
+
+// expansionGraph lists what each resource can embed. An expansion path
+// walks it from the order, e.g. payment.user; one that comes back to a
+// resource already on its path would embed it in itself.
+var expansionGraph = map[string][]string{
+	"order":    {"user", "payment", "shipment"},
+	"payment":  {"user", "order"},
+	"shipment": {"order"},
+}
+
+const maxExpandDepth = 2
+
+// The gateway and the CDN may keep an order for a while, its events purge
+// it; clients, which hear of no events, check again each time
+var orderCacheHint = cdn.Hint{SMaxAge: 30 * time.Second, StaleWhileRevalidate: 30 * time.Second}
+
+// expansionAllowed says who may see each embedded resource: customers
+// their own, support an order's shipment but not who paid or how
+var expansionAllowed = map[string]func(r *http.Request, order *Order) bool{
+	"user":     func(r *http.Request, o *Order) bool { return allowed(r, o.UserID) },
+	"payment":  func(r *http.Request, o *Order) bool { return allowed(r, o.UserID) },
+	"shipment": func(r *http.Request, o *Order) bool { return allowed(r, o.UserID) || staff(r) },
+}
+
+// parseExpand reads ?expand=user,payment.user into its paths
+func parseExpand(list string) ([]string, error) {
+	var paths []string
+	for path := range strings.SplitSeq(list, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		segs := strings.Split(path, ".")
+		if len(segs) > maxExpandDepth {
+			return nil, i18n.NewError("order.expand_too_deep", path, maxExpandDepth)
+		}
+		resource, seen := "order", []string{"order"}
+		for _, seg := range segs {
+			if !slices.Contains(expansionGraph[resource], seg) {
+				return nil, i18n.NewError("order.expand_unknown", path)
+			}
+			if slices.Contains(seen, seg) {
+				return nil, i18n.NewError("order.expand_cycle", path)
+			}
+			resource, seen = seg, append(seen, seg)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// OrderDetail is an order with the related resources asked for
+type OrderDetail struct {
+	*Order
+	User     *Customer        `json:"user,omitempty"`
+	Payment  *PaymentDetail   `json:"payment,omitempty"`
+	Shipment *ShipmentSummary `json:"shipment,omitempty"`
+	// ExpandErrors says why an expansion asked for is missing
+	ExpandErrors map[string]string `json:"expand_errors,omitempty"`
+}
+
+type PaymentDetail struct {
+	*PaymentReceipt
+	User *Customer `json:"user,omitempty"`
+}
+
+// Get returns an order by its public or numeric ID, embedding the related
+// resources in ?expand= (user, payment, shipment, payment.user), fetched
+// concurrently. Users see their own orders and their organizations' if
+// their role allows, admins and support anyone's; each expansion checks
+// the caller again for itself.
+func (h *OrderHistory) Get(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+
+	expand, err := parseExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadRequest)
+		return
+	}
+
+	orderID, err := h.orders.orderIDParam(r)
+	var order *Order
+	if err == nil {
+		order, err = h.orders.repo.Get(ctx, orderID)
+	}
+	if errors.Is(err, ErrNotFound) || (err == nil && !h.orders.canSee(r, order) && !staff(r)) {
+		// Don't reveal that someone else's order exists
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+	for _, path := range expand {
+		for seg := range strings.SplitSeq(path, ".") {
+			if !expansionAllowed[seg](r, order) {
+				i18n.Error(w, r, http.StatusForbidden, "order.expand_forbidden", path)
+				return
+			}
+		}
+	}
+
+	detail := h.expand(ctx, h.orders.withLinks(order), expand)
+	if detail.ExpandErrors == nil {
+		// Tagged by ID, so its events purge it under its public ID too
+		cdn.Set(w, orderCacheHint, cdn.Key("order", order.ID))
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, detail))
+}
+
+// expand fetches the order's expansions side by side. A payment's user is
+// the order's, so it is fetched once for both.
+func (h *OrderHistory) expand(ctx context.Context, order *Order, paths []string) *OrderDetail {
+	e := &OrderDetail{Order: order}
+	var mu sync.Mutex
+	fail := func(path string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.ExpandErrors == nil {
+			e.ExpandErrors = make(map[string]string)
+		}
+		e.ExpandErrors[path] = i18n.FromContext(ctx).Text(err)
+	}
+	customer := sync.OnceValues(func() (*Customer, error) {
+		return h.orders.fetchCustomer(ctx, order.UserID)
+	})
+
+	var wg sync.WaitGroup
+	if slices.Contains(paths, "user") {
+		wg.Go(func() {
+			user, err := customer()
+			if err != nil {
+				fail("user", err)
+			}
+			e.User = user
+		})
+	}
+	if slices.Contains(paths, "payment") || slices.Contains(paths, "payment.user") {
+		wg.Go(func() {
+			if order.PaymentID == 0 {
+				return
+			}
+			payment, err := h.orders.fetchPayment(ctx, order.PaymentID)
+			if err != nil {
+				fail("payment", err)
+				return
+			}
+			e.Payment = &PaymentDetail{PaymentReceipt: payment}
+			if slices.Contains(paths, "payment.user") {
+				user, err := customer()
+				if err != nil {
+					fail("payment.user", err)
+				}
+				e.Payment.User = user
+			}
+		})
+	}
+	if slices.Contains(paths, "shipment") {
+		wg.Go(func() {
+			if order.Status != "completed" {
+				return
+			}
+			if h.shippingServiceURL == "" {
+				fail("shipment", i18n.NewError("order.shipping_unavailable"))
+				return
+			}
+			shipment, err := h.fetchShipment(ctx, order.ID)
+			if err != nil {
+				fail("shipment", err)
+			}
+			e.Shipment = shipment
+		})
+	}
+	wg.Wait()
+	return e
+}
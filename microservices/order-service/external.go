@@ -0,0 +1,134 @@
+// order-service/external.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"platform/dbretry"
+	"platform/fields"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// errExternalIDTaken means the tenant already has an order with that
+// external ID
+var errExternalIDTaken = errors.New("external ID already used")
+
+// External IDs come from other systems, so they are allowed most of what
+// such IDs hold but have to fit in a path segment
+var externalIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,100}$`)
+
+func validateExternalID(id string) error {
+	if id != "" && !externalIDPattern.MatchString(id) {
+		return i18n.NewError("order.external_id_invalid")
+	}
+	return nil
+}
+
+// tenantOf is the tenant external IDs are looked up in; callers without
+// one share the default, empty tenant
+func tenantOf(r *http.Request) string {
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+		return p.Tenant
+	}
+	return ""
+}
+
+func (r *PostgresOrderRepository) ByExternalID(ctx context.Context, tenant, externalID string) (*Order, error) {
+	var order Order
+	err := scanOrder(r.db.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = (
+                  SELECT order_id FROM order_external_ids WHERE tenant = $1 AND external_id = $2)`,
+		tenant, externalID).Scan, &order)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (r *MemoryOrderRepository) ByExternalID(ctx context.Context, tenant, externalID string) (*Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, o := range r.orders {
+		if o.Tenant == tenant && o.ExternalID != "" && o.ExternalID == externalID {
+			return &o, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// replayOrder answers a create for an external ID that already has an
+// order with that order, as long as it is for the same user. It reports
+// whether there was one.
+func (s *OrderService) replayOrder(w http.ResponseWriter, r *http.Request, order *Order) bool {
+	existing, err := s.repo.ByExternalID(r.Context(), order.Tenant, order.ExternalID)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	// With the database away the order may still be buffered; placing it
+	// later finds an order made with the ID meanwhile
+	if err != nil && s.buffer != nil && dbretry.Classify(err) != dbretry.Permanent {
+		return false
+	}
+	if err != nil {
+		http.Error(w, i18n.FromContext(r.Context()).Text(err), http.StatusInternalServerError)
+		return true
+	}
+	if existing.UserID != order.UserID {
+		i18n.Error(w, r, http.StatusConflict, "order.external_id_conflict", order.ExternalID)
+		return true
+	}
+	s.writeOrder(w, http.StatusOK, existing)
+	return true
+}
+
+// orderView serves GET /orders/{id}/confirmation, /orders/{id}/wait and
+// /orders/by-external-id/{id}, which ServeMux can't tell apart as separate
+// patterns; each still reports its own route name
+func (s *OrderService) orderView(w http.ResponseWriter, r *http.Request) {
+	if router.Param(r, "id") == "by-external-id" {
+		middleware.SetRoute(r.Context(), "get-order-by-external-id")
+		s.orderByExternalID(w, r, router.Param(r, "view"))
+		return
+	}
+	if router.Param(r, "view") == "wait" {
+		middleware.SetRoute(r.Context(), "wait-order")
+		s.waitOrder(w, r)
+		return
+	}
+	if router.Param(r, "view") != "confirmation" {
+		http.NotFound(w, r)
+		return
+	}
+	middleware.SetRoute(r.Context(), "get-order-confirmation")
+	s.GetConfirmation(w, r)
+}
+
+// orderByExternalID finds an order by the ID the caller's tenant gave it.
+// Users see their own orders and, as their role allows, their
+// organizations'; admins anyone's in the tenant.
+func (s *OrderService) orderByExternalID(w http.ResponseWriter, r *http.Request, externalID string) {
+	order, err := s.repo.ByExternalID(r.Context(), tenantOf(r), externalID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if err != nil {
+		http.Error(w, i18n.FromContext(r.Context()).Text(err), http.StatusInternalServerError)
+		return
+	}
+	if !s.canSee(r, order) {
+		// Don't reveal that someone else's order exists
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, s.withLinks(order)))
+}
@@ -0,0 +1,220 @@
+// order-service/guest.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/codec"
+	"platform/dbretry"
+	"platform/deadline"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Guest is who is buying in a guest checkout
+type Guest struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Address string `json:"address"`
+}
+
+// guestUser is user-service's answer when it makes a guest
+type guestUser struct {
+	Customer
+	ClaimToken string `json:"claim_token"`
+}
+
+// createGuest has user-service make (or refresh) the guest user for the
+// checkout
+func (s *OrderService) createGuest(ctx context.Context, guest Guest) (*guestUser, error) {
+	body, _ := json.Marshal(guest)
+	url := fmt.Sprintf("%s/users/guests", s.userServiceURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, "user-service", time.Since(start))
+	if err != nil {
+		return nil, i18n.Wrap(err, "order.user_service_unavailable")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+	case http.StatusConflict:
+		return nil, i18n.NewError("order.guest_email_registered")
+	case http.StatusUnprocessableEntity:
+		return nil, i18n.NewError("order.guest_invalid")
+	default:
+		return nil, i18n.NewError("order.user_service_unavailable")
+	}
+
+	var user guestUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, i18n.Wrap(err, "order.user_service_unavailable")
+	}
+	return &user, nil
+}
+
+// CreateGuestOrder checks out without an account: the order carries a
+// guest (name, email, address) instead of a user_id, and user-service makes
+// a guest user to hold it. The response's guest_claim_token lets the buyer
+// register as, or merge into, a full account later; when the email already
+// has a guest, the token is emailed instead.
+func (s *OrderService) CreateGuestOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+	if err := deadline.Require(ctx, minCreateOrderBudget); err != nil {
+		http.Error(w, loc.Text(err), http.StatusGatewayTimeout)
+		return
+	}
+
+	var req struct {
+		Order
+		Guest Guest `json:"guest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadRequest)
+		return
+	}
+	guest := req.Guest
+	guest.Email = strings.TrimSpace(guest.Email)
+	guest.Address = strings.TrimSpace(guest.Address)
+	if guest.Email == "" || guest.Address == "" {
+		i18n.Error(w, r, http.StatusBadRequest, "order.guest_invalid")
+		return
+	}
+
+	// Guests have no stored cards or credit; card details come with the
+	// checkout
+	order := req.Order
+	order.PaymentMethodID, order.UseStoreCredit = 0, false
+	s.placeOrder(w, r, &order, func(ctx context.Context) (*Customer, error) {
+		user, err := s.createGuest(ctx, guest)
+		if err != nil {
+			return nil, err
+		}
+		order.UserID = user.ID
+		order.GuestClaimToken = user.ClaimToken
+		return &user.Customer, nil
+	})
+}
+
+// HandleEvent receives events from the broker. user.guest_claimed moves a
+// guest's orders, subscriptions and returns to the user who claimed it;
+// other events are acknowledged and ignored.
+func (s *OrderService) HandleEvent(w http.ResponseWriter, r *http.Request) {
+	var event events.Event
+	if err := codec.Decode(r, &event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.events.Received(event) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if s.billing != nil {
+		if err := s.billing.Meter(r.Context(), event); err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+	}
+	if id, ok := orderSettled(event.Type, event.Subject); ok {
+		s.waiters.Notify(id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if event.Type != "user.guest_claimed" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	data, _ := event.Data.(map[string]any)
+	guestID, _ := data["guest_id"].(float64)
+	userID, _ := data["user_id"].(float64)
+	if guestID <= 0 || userID <= 0 {
+		http.Error(w, "event needs a guest_id and user_id", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.repo.MergeUser(r.Context(), int(guestID), int(userID)); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// MergeUser is user-service's account merge step for order-service: it
+// moves everything of the path's user to the user in {"into": id}.
+// Running it again changes nothing.
+func (s *OrderService) MergeUser(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		i18n.Error(w, r, http.StatusNotFound, "order.user_not_found")
+		return
+	}
+	var req struct {
+		Into int `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Into <= 0 || req.Into == from {
+		http.Error(w, "into must be another user", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.repo.MergeUser(r.Context(), from, req.Into); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *PostgresOrderRepository) MergeUser(ctx context.Context, from, to int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		for _, table := range []string{"orders", "subscriptions", "returns"} {
+			if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET user_id = $2 WHERE user_id = $1`, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *MemoryOrderRepository) MergeUser(ctx context.Context, from, to int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, o := range r.orders {
+		if o.UserID == from {
+			o.UserID = to
+			r.orders[id] = o
+		}
+	}
+	for _, s := range r.subscriptions {
+		if s.UserID == from {
+			s.UserID = to
+		}
+	}
+	for _, ret := range r.returns {
+		if ret.UserID == from {
+			ret.UserID = to
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// order-service/history.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/cdn"
+	"platform/dbretry"
+	"platform/fields"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+const (
+	defaultHistoryPage = 20
+	maxHistoryPage     = 100
+	// summaryTTL is how long a payment or shipment summary is reused; a
+	// refund or delivery shows up in history at most this late
+	summaryTTL = 30 * time.Second
+)
+
+// ShipmentSummary is shipping-service's view of an order's parcel
+type ShipmentSummary struct {
+	Status            string     `json:"status"`
+	Carrier           string     `json:"carrier,omitempty"`
+	TrackingNumber    string     `json:"tracking_number,omitempty"`
+	EstimatedDelivery *time.Time `json:"estimated_delivery,omitempty"`
+}
+
+// HistoryEntry is an order with what other services know about it. A
+// summary is left out when its service has none or doesn't answer.
+type HistoryEntry struct {
+	Order
+	Payment  *PaymentReceipt  `json:"payment,omitempty"`
+	Shipment *ShipmentSummary `json:"shipment,omitempty"`
+}
+
+// summaryCache keeps recent summaries per key so paging back and forth
+// through history doesn't call other services for every order every time
+type summaryCache[K comparable, T any] struct {
+	mu      sync.Mutex
+	entries map[K]cachedSummary[T]
+}
+
+type cachedSummary[T any] struct {
+	value   *T
+	expires time.Time
+}
+
+func newSummaryCache[K comparable, T any]() *summaryCache[K, T] {
+	return &summaryCache[K, T]{entries: make(map[K]cachedSummary[T])}
+}
+
+// get returns the cached summary for key, else fetches and caches it.
+// Failures are not cached.
+func (c *summaryCache[K, T]) get(key K, fetch func() (*T, error)) (*T, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.value, nil
+	}
+
+	value, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedSummary[T]{value: value, expires: now.Add(summaryTTL)}
+	return value, nil
+}
+
+// OrderHistory serves GET /users/{id}/orders
+type OrderHistory struct {
+	orders *OrderService
+	// shippingServiceURL answers shipment summaries; empty leaves them out
+	shippingServiceURL string
+	payments           *summaryCache[int, PaymentReceipt]
+	shipments          *summaryCache[int, ShipmentSummary]
+}
+
+func NewOrderHistory(orders *OrderService, shippingServiceURL string) *OrderHistory {
+	return &OrderHistory{
+		orders:             orders,
+		shippingServiceURL: shippingServiceURL,
+		payments:           newSummaryCache[int, PaymentReceipt](),
+		shipments:          newSummaryCache[int, ShipmentSummary](),
+	}
+}
+
+// List pages through a user's orders, newest first. Query: before (an
+// order ID) and limit. Users see only their own history; admins anyone's.
+func (h *OrderHistory) List(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if !allowed(r, userID) {
+		i18n.Error(w, r, http.StatusForbidden, "order.history_forbidden")
+		return
+	}
+
+	q := r.URL.Query()
+	before, limit := 0, defaultHistoryPage
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxHistoryPage)
+	}
+
+	ctx := r.Context()
+	orders, err := h.orders.repo.UserOrders(ctx, userID, before, limit)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	history := make([]HistoryEntry, len(orders))
+	var wg sync.WaitGroup
+	for i, order := range orders {
+		history[i].Order = order
+		h.orders.withLinks(&history[i].Order)
+		wg.Go(func() { h.summarize(ctx, &history[i]) })
+	}
+	wg.Wait()
+
+	// Summaries may be a little stale, and the page is the user's alone
+	cdn.Set(w, cdn.Hint{Private: true, MaxAge: summaryTTL})
+	writeJSON(w, http.StatusOK, fields.Select(w, r, history))
+}
+
+// summarize fills in an entry's payment and shipment
+func (h *OrderHistory) summarize(ctx context.Context, e *HistoryEntry) {
+	if e.PaymentID != 0 {
+		payment, err := h.payments.get(e.PaymentID, func() (*PaymentReceipt, error) {
+			return h.orders.fetchPayment(ctx, e.PaymentID)
+		})
+		if err != nil {
+			log.Printf("order %d: payment summary: %v", e.ID, err)
+		}
+		e.Payment = payment
+	}
+	if h.shippingServiceURL != "" && e.Status == "completed" {
+		shipment, err := h.shipments.get(e.ID, func() (*ShipmentSummary, error) {
+			return h.fetchShipment(ctx, e.ID)
+		})
+		if err != nil {
+			log.Printf("order %d: shipment summary: %v", e.ID, err)
+		}
+		e.Shipment = shipment
+	}
+}
+
+// fetchShipment asks shipping-service about an order's parcel; an order
+// not shipped yet has none
+func (h *OrderHistory) fetchShipment(ctx context.Context, orderID int) (*ShipmentSummary, error) {
+	url := fmt.Sprintf("%s/orders/%d/shipment", h.shippingServiceURL, orderID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	middleware.RecordUpstream(ctx, "shipping-service", time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("shipment of order %d: %s", orderID, resp.Status)
+	}
+	var shipment ShipmentSummary
+	if err := json.NewDecoder(resp.Body).Decode(&shipment); err != nil {
+		return nil, err
+	}
+	return &shipment, nil
+}
+
+func (r *PostgresOrderRepository) UserOrders(ctx context.Context, userID, before, limit int) ([]Order, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+orderColumns+` FROM orders
+              WHERE user_id = $1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3`, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows.Scan, &o); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func (r *MemoryOrderRepository) UserOrders(ctx context.Context, userID, before, limit int) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var orders []Order
+	for _, o := range r.orders {
+		if o.UserID == userID && (before == 0 || o.ID < before) {
+			orders = append(orders, o)
+		}
+	}
+	slices.SortFunc(orders, func(a, b Order) int { return b.ID - a.ID })
+	return orders[:min(limit, len(orders))], nil
+}
@@ -0,0 +1,360 @@
+// order-service/import.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"platform/clock"
+	"platform/events"
+	"platform/i18n"
+	"platform/publicid"
+	"platform/router"
+)
+
+const (
+	// maxImportOrders caps one import request
+	maxImportOrders = 5000
+	// importChunk is how many orders go into one multi-row INSERT; at ten
+	// parameters each that stays well under Postgres' 65535
+	importChunk = 500
+)
+
+// ImportRepository stores orders decided elsewhere in bulk
+type ImportRepository interface {
+	// ImportOrders inserts orders, setting their IDs, and returns the
+	// indexes of the ones skipped because their external ID was taken
+	ImportOrders(ctx context.Context, orders []Order) ([]int, error)
+	CreateImportJob(ctx context.Context, j *ImportJob) error
+	ImportJob(ctx context.Context, id string) (*ImportJob, error)
+	// SaveImportProgress updates the job's counts and status and records
+	// what became of rows
+	SaveImportProgress(ctx context.Context, j *ImportJob, rows []ImportRow) error
+	// ImportRows returns up to limit rows after the given one, of one
+	// outcome unless that's empty
+	ImportRows(ctx context.Context, id, outcome string, after, limit int) ([]ImportRow, error)
+}
+
+// ImportOrders inserts each chunk of orders with a handful of statements
+// rather than one round trip per order: IDs are drawn from the sequence in
+// one go, external IDs claimed in one INSERT so duplicates drop out before
+// the orders go in with one multi-row INSERT.
+func (r *PostgresOrderRepository) ImportOrders(ctx context.Context, orders []Order) ([]int, error) {
+	var skipped []int
+	for start := 0; start < len(orders); start += importChunk {
+		chunk := orders[start:min(start+importChunk, len(orders))]
+		var dupes []int
+		err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+			var err error
+			dupes, err = importChunkTx(ctx, tx, chunk)
+			return err
+		})
+		if err != nil {
+			return skipped, err
+		}
+		for _, i := range dupes {
+			skipped = append(skipped, start+i)
+		}
+	}
+	return skipped, nil
+}
+
+func importChunkTx(ctx context.Context, tx *sql.Tx, orders []Order) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT nextval(pg_get_serial_sequence('orders', 'id'))
+              FROM generate_series(1, $1)`, len(orders))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(&orders[i].ID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Claim the external IDs first; the orders whose claim failed are
+	// duplicates and stay out
+	claimed := make(map[int]bool)
+	var values []string
+	var args []any
+	for _, o := range orders {
+		if o.ExternalID != "" {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d)", n+1, n+2, n+3))
+			args = append(args, o.Tenant, o.ExternalID, o.ID)
+		}
+	}
+	if len(values) > 0 {
+		rows, err := tx.QueryContext(ctx, `INSERT INTO order_external_ids (tenant, external_id, order_id)
+              VALUES `+strings.Join(values, ", ")+`
+              ON CONFLICT DO NOTHING RETURNING order_id`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			claimed[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var skipped []int
+	values, args = values[:0], args[:0]
+	index := make(map[int]int)
+	for i, o := range orders {
+		if o.ExternalID != "" && !claimed[o.ID] {
+			skipped = append(skipped, i)
+			continue
+		}
+		metadata, err := metadataJSON(o.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, NULLIF($%d, ''))",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10))
+		args = append(args, o.ID, o.UserID, o.Product, o.Quantity, o.Amount, o.Status, o.CreatedAt, metadata,
+			o.Tenant, o.ExternalID)
+		index[o.ID] = i
+	}
+	if len(values) == 0 {
+		return skipped, nil
+	}
+	rows, err = tx.QueryContext(ctx, `INSERT INTO orders (id, user_id, product, quantity, amount, status,
+                  created_at, metadata, tenant, external_id)
+              VALUES `+strings.Join(values, ", ")+`
+              RETURNING id, public_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var publicID string
+		if err := rows.Scan(&id, &publicID); err != nil {
+			return nil, err
+		}
+		orders[index[id]].PublicID = publicID
+	}
+	return skipped, rows.Err()
+}
+
+func (r *MemoryOrderRepository) ImportOrders(ctx context.Context, orders []Order) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	taken := make(map[[2]string]bool)
+	for _, o := range r.orders {
+		if o.ExternalID != "" {
+			taken[[2]string{o.Tenant, o.ExternalID}] = true
+		}
+	}
+	var skipped []int
+	for i := range orders {
+		o := &orders[i]
+		if o.ExternalID != "" {
+			key := [2]string{o.Tenant, o.ExternalID}
+			if taken[key] {
+				skipped = append(skipped, i)
+				continue
+			}
+			taken[key] = true
+		}
+		o.ID = r.nextID
+		r.nextID++
+		o.PublicID = publicid.New()
+		stored := *o
+		stored.GuestClaimToken = ""
+		stored.Metadata = maps.Clone(o.Metadata)
+		r.orders[o.ID] = stored
+	}
+	return skipped, nil
+}
+
+// importStatuses are the states an imported order may be in: imports are
+// of orders already settled elsewhere, nothing is charged
+var importStatuses = map[string]bool{"completed": true, "canceled": true}
+
+type importedOrder struct {
+	ID         int    `json:"id"`
+	PublicID   string `json:"public_id"`
+	ExternalID string `json:"external_id,omitempty"`
+}
+
+type skippedOrder struct {
+	Index      int    `json:"index"`
+	ExternalID string `json:"external_id"`
+}
+
+type importResponse struct {
+	Imported []importedOrder `json:"imported"`
+	// Skipped are orders whose external ID the tenant already has
+	Skipped []skippedOrder `json:"skipped"`
+}
+
+// ImportAPI ingests orders in bulk
+type ImportAPI struct {
+	repo   ImportRepository
+	events *events.Emitter
+	clock  clock.Clock
+	// paymentServiceURL is where files-service keeps uploaded files
+	paymentServiceURL string
+	client            *http.Client
+	routes            *router.Router
+}
+
+// checkImportedOrder validates an order to import, defaulting its status
+// and creation time
+func checkImportedOrder(o *Order, now time.Time) error {
+	if o.Status == "" {
+		o.Status = "completed"
+	}
+	if o.UserID <= 0 || o.Product == "" || o.Quantity < 1 || o.Amount < 0 || !importStatuses[o.Status] ||
+		o.CreatedAt.After(now) {
+		return errImportFields
+	}
+	for _, err := range []error{validateMetadata(o.Metadata), validateExternalID(o.ExternalID)} {
+		if err != nil {
+			return err
+		}
+	}
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = now
+	}
+	return nil
+}
+
+// Import takes orders settled in another system, e.g. a migration or a
+// marketplace sync, and stores them without charging. Orders with an
+// external ID the tenant already has are skipped, so an import can be
+// rerun.
+//
+// A JSON array of orders is imported there and then, announced by one
+// orders.imported event. A CSV or NDJSON body, or {"file_id": ...} naming
+// one uploaded to files-service, is imported in the background: the answer
+// is 202 with the job, whose progress, row results and error report are
+// at its links.
+func (a *ImportAPI) Import(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if format, ok := importFormats[mediaType]; ok {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportFileBytes))
+		if err != nil {
+			i18n.Error(w, r, http.StatusRequestEntityTooLarge, "order.import_too_big", maxImportFileBytes>>20)
+			return
+		}
+		a.startImport(w, r, format, "", func(context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		})
+		return
+	}
+	// An object rather than an array names a file to import
+	br := bufio.NewReader(r.Body)
+	first, err := br.Peek(1)
+	for err == nil && unicode.IsSpace(rune(first[0])) {
+		br.ReadByte()
+		first, err = br.Peek(1)
+	}
+	if err == nil && first[0] == '{' {
+		var ref struct {
+			FileID string `json:"file_id"`
+		}
+		if err := json.NewDecoder(br).Decode(&ref); err != nil || ref.FileID == "" {
+			http.Error(w, "file_id is required", http.StatusBadRequest)
+			return
+		}
+		format, source, err := a.fileSource(r, ref.FileID)
+		switch {
+		case errors.Is(err, errImportFileNotFound):
+			http.Error(w, loc.Text(err), http.StatusNotFound)
+			return
+		case err != nil:
+			var m *i18n.Message
+			status := http.StatusBadGateway
+			if errors.As(err, &m) && m.Key == "order.import_file_unavailable" {
+				status = http.StatusConflict
+			} else if errors.As(err, &m) && m.Key == "order.import_format" {
+				status = http.StatusUnprocessableEntity
+			}
+			http.Error(w, loc.Text(err), status)
+			return
+		}
+		a.startImport(w, r, format, ref.FileID, source)
+		return
+	}
+
+	var orders []Order
+	if err := json.NewDecoder(br).Decode(&orders); err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadRequest)
+		return
+	}
+	if len(orders) == 0 || len(orders) > maxImportOrders {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "order.import_size", maxImportOrders)
+		return
+	}
+	tenant := tenantOf(r)
+	now := a.clock.Now()
+	for i := range orders {
+		o := &orders[i]
+		if err := checkImportedOrder(o, now); errors.Is(err, errImportFields) {
+			i18n.Error(w, r, http.StatusUnprocessableEntity, "order.import_invalid", i)
+			return
+		} else if err != nil {
+			i18n.Error(w, r, http.StatusUnprocessableEntity, "order.import_row", i, loc.Text(err))
+			return
+		}
+		o.Tenant = tenant
+	}
+
+	skipped, err := a.repo.ImportOrders(ctx, orders)
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := importResponse{Imported: []importedOrder{}, Skipped: []skippedOrder{}}
+	skip := make(map[int]bool)
+	for _, i := range skipped {
+		skip[i] = true
+		resp.Skipped = append(resp.Skipped, skippedOrder{Index: i, ExternalID: orders[i].ExternalID})
+	}
+	ids := make([]int, 0, len(orders)-len(skipped))
+	for i, o := range orders {
+		if !skip[i] {
+			resp.Imported = append(resp.Imported, importedOrder{ID: o.ID, PublicID: o.PublicID, ExternalID: o.ExternalID})
+			ids = append(ids, o.ID)
+		}
+	}
+	if len(ids) > 0 {
+		a.events.Emit(context.WithoutCancel(ctx), "orders.imported", "orders", map[string]any{
+			"tenant":    tenant,
+			"order_ids": ids,
+		})
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
@@ -0,0 +1,688 @@
+// order-service/import_jobs.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/dbretry"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/publicid"
+	"platform/router"
+)
+
+// Import job states. Imports are queued until the file is read, then
+// running; a job whose worker went away, as in a restart, is failed once
+// it has made no progress for importStallAfter.
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// What became of a row
+const (
+	RowImported = "imported"
+	RowSkipped  = "skipped"
+	RowFailed   = "failed"
+)
+
+const (
+	// maxImportFileRows and maxImportFileBytes cap one file import
+	maxImportFileRows  = 100000
+	maxImportFileBytes = 32 << 20
+	importStallAfter   = 10 * time.Minute
+	defaultImportRows  = 100
+	maxImportRows      = 1000
+)
+
+// importFormats maps the media types imports are read from to their format
+var importFormats = map[string]string{
+	"text/csv":             "csv",
+	"application/x-ndjson": "ndjson",
+}
+
+// ImportJob is an import of a CSV or NDJSON file, sent in the request body
+// or stored with files-service, and how far it got
+type ImportJob struct {
+	ID         string     `json:"id"`
+	Tenant     string     `json:"-"`
+	CreatedBy  string     `json:"created_by"`
+	Format     string     `json:"format"`
+	FileID     string     `json:"file_id,omitempty"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Imported   int        `json:"imported"`
+	Skipped    int        `json:"skipped"`
+	Failed     int        `json:"failed"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Links are the job's progress, row results and error report
+	Links map[string]string `json:"links,omitempty"`
+}
+
+func (j *ImportJob) finished() bool {
+	return j.Status == ImportCompleted || j.Status == ImportFailed
+}
+
+// ImportRow is what became of one row of an import; rows count from 1,
+// after a CSV file's header
+type ImportRow struct {
+	Row        int    `json:"row"`
+	ExternalID string `json:"external_id,omitempty"`
+	Outcome    string `json:"outcome"`
+	OrderID    int    `json:"order_id,omitempty"`
+	PublicID   string `json:"public_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+const importJobColumns = `id, tenant, created_by, format, file_id, status, total, processed, imported, skipped,
+              failed, error, created_at, updated_at, finished_at`
+
+func scanImportJob(scan func(...any) error, j *ImportJob) error {
+	var finished sql.NullTime
+	if err := scan(&j.ID, &j.Tenant, &j.CreatedBy, &j.Format, &j.FileID, &j.Status, &j.Total, &j.Processed,
+		&j.Imported, &j.Skipped, &j.Failed, &j.Error, &j.CreatedAt, &j.UpdatedAt, &finished); err != nil {
+		return err
+	}
+	j.FinishedAt = nil
+	if finished.Valid {
+		j.FinishedAt = &finished.Time
+	}
+	return nil
+}
+
+func (r *PostgresOrderRepository) CreateImportJob(ctx context.Context, j *ImportJob) error {
+	j.ID = publicid.New()
+	return r.db.QueryRowContext(ctx, `INSERT INTO order_imports (id, tenant, created_by, format, file_id, status)
+              VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at`,
+		j.ID, j.Tenant, j.CreatedBy, j.Format, j.FileID, j.Status).Scan(&j.CreatedAt, &j.UpdatedAt)
+}
+
+func (r *PostgresOrderRepository) ImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	var j ImportJob
+	err := scanImportJob(r.db.QueryRowContext(ctx, `SELECT `+importJobColumns+` FROM order_imports WHERE id = $1`, id).Scan, &j)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (r *PostgresOrderRepository) SaveImportProgress(ctx context.Context, j *ImportJob, rows []ImportRow) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `UPDATE order_imports SET status = $2, total = $3, processed = $4,
+                  imported = $5, skipped = $6, failed = $7, error = $8, finished_at = $9, updated_at = now()
+              WHERE id = $1 RETURNING updated_at`,
+			j.ID, j.Status, j.Total, j.Processed, j.Imported, j.Skipped, j.Failed, j.Error, j.FinishedAt).Scan(&j.UpdatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+		var values []string
+		var args []any
+		for _, row := range rows {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, NULLIF($%d, 0), $%d, $%d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7))
+			args = append(args, j.ID, row.Row, row.ExternalID, row.Outcome, row.OrderID, row.PublicID, row.Error)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO order_import_rows (import_id, row, external_id, outcome, order_id,
+                  public_id, error)
+              VALUES `+strings.Join(values, ", ")+`
+              ON CONFLICT (import_id, row) DO NOTHING`, args...)
+		return err
+	})
+}
+
+func (r *PostgresOrderRepository) ImportRows(ctx context.Context, id, outcome string, after, limit int) ([]ImportRow, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT row, external_id, outcome, COALESCE(order_id, 0), public_id, error
+              FROM order_import_rows
+              WHERE import_id = $1 AND row > $2 AND ($3 = '' OR outcome = $3)
+              ORDER BY row LIMIT $4`, id, after, outcome, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ImportRow
+	for rows.Next() {
+		var row ImportRow
+		if err := rows.Scan(&row.Row, &row.ExternalID, &row.Outcome, &row.OrderID, &row.PublicID, &row.Error); err != nil {
+			return nil, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func (r *MemoryOrderRepository) CreateImportJob(ctx context.Context, j *ImportJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j.ID = publicid.New()
+	j.CreatedAt = time.Now()
+	j.UpdatedAt = j.CreatedAt
+	stored := *j
+	stored.Links = nil
+	r.importJobs[j.ID] = &stored
+	return nil
+}
+
+func (r *MemoryOrderRepository) ImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	j, ok := r.importJobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *j
+	return &c, nil
+}
+
+func (r *MemoryOrderRepository) SaveImportProgress(ctx context.Context, j *ImportJob, rows []ImportRow) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.importJobs[j.ID]; !ok {
+		return ErrNotFound
+	}
+	j.UpdatedAt = time.Now()
+	stored := *j
+	stored.Links = nil
+	r.importJobs[j.ID] = &stored
+	for _, row := range rows {
+		if !slices.ContainsFunc(r.importRows[j.ID], func(o ImportRow) bool { return o.Row == row.Row }) {
+			r.importRows[j.ID] = append(r.importRows[j.ID], row)
+		}
+	}
+	slices.SortFunc(r.importRows[j.ID], func(a, b ImportRow) int { return a.Row - b.Row })
+	return nil
+}
+
+func (r *MemoryOrderRepository) ImportRows(ctx context.Context, id, outcome string, after, limit int) ([]ImportRow, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var results []ImportRow
+	for _, row := range r.importRows[id] {
+		if row.Row > after && (outcome == "" || row.Outcome == outcome) {
+			results = append(results, row)
+			if len(results) == limit {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// importSource opens the content of an import
+type importSource func(ctx context.Context) (io.ReadCloser, error)
+
+// parsedRow is a row read from an import file, or why it couldn't be
+type parsedRow struct {
+	row   int
+	order Order
+	err   error
+}
+
+var (
+	errImportFields  = i18n.NewError("order.import_fields")
+	errImportTooMany = i18n.NewError("order.import_too_many", maxImportFileRows)
+	errImportTooBig  = i18n.NewError("order.import_too_big", maxImportFileBytes>>20)
+)
+
+// csvColumns are the columns a CSV import may have besides metadata.<key>
+// ones; the first four are required
+var csvColumns = []string{"user_id", "product", "quantity", "amount", "status", "created_at", "external_id"}
+
+// parseCSV reads orders from a CSV file with a header row
+func parseCSV(r io.Reader) ([]parsedRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, i18n.Wrap(err, "order.import_header")
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		if !slices.Contains(csvColumns, header[i]) && !strings.HasPrefix(header[i], "metadata.") {
+			return nil, i18n.NewError("order.import_column", header[i])
+		}
+	}
+	for _, required := range csvColumns[:4] {
+		if !slices.Contains(header, required) {
+			return nil, i18n.NewError("order.import_column_missing", required)
+		}
+	}
+
+	var rows []parsedRow
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if len(rows) == maxImportFileRows {
+			return nil, errImportTooMany
+		}
+		row := parsedRow{row: n}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, err
+			}
+			row.err = i18n.NewError("order.import_csv", parseErr.Err)
+			rows = append(rows, row)
+			continue
+		}
+		if len(record) != len(header) {
+			row.err = i18n.NewError("order.import_fields_count", len(header), len(record))
+			rows = append(rows, row)
+			continue
+		}
+		for i, value := range record {
+			if err := setImportField(&row.order, header[i], strings.TrimSpace(value)); err != nil {
+				row.err = err
+				break
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func setImportField(o *Order, column, value string) error {
+	var err error
+	switch column {
+	case "user_id":
+		o.UserID, err = strconv.Atoi(value)
+	case "product":
+		o.Product = value
+	case "quantity":
+		o.Quantity, err = strconv.Atoi(value)
+	case "amount":
+		o.Amount, err = strconv.ParseFloat(value, 64)
+	case "status":
+		o.Status = value
+	case "created_at":
+		if value != "" {
+			o.CreatedAt, err = time.Parse(time.RFC3339, value)
+		}
+	case "external_id":
+		o.ExternalID = value
+	default:
+		if value != "" {
+			if o.Metadata == nil {
+				o.Metadata = make(map[string]string)
+			}
+			o.Metadata[strings.TrimPrefix(column, "metadata.")] = value
+		}
+	}
+	if err != nil {
+		return i18n.NewError("order.import_value", column, value)
+	}
+	return nil
+}
+
+// parseNDJSON reads orders from one JSON object per line, skipping blank
+// lines
+func parseNDJSON(r io.Reader) ([]parsedRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var rows []parsedRow
+	for n := 0; scanner.Scan(); {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(rows) == maxImportFileRows {
+			return nil, errImportTooMany
+		}
+		n++
+		row := parsedRow{row: n}
+		if err := json.Unmarshal(line, &row.order); err != nil {
+			row.err = i18n.NewError("order.import_json", err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// startImport begins importing a file in the background and answers 202
+// with the job, whose progress is at its self link
+func (a *ImportAPI) startImport(w http.ResponseWriter, r *http.Request, format, fileID string, source importSource) {
+	ctx := r.Context()
+	job := &ImportJob{Tenant: tenantOf(r), Format: format, FileID: fileID, Status: ImportQueued}
+	if p, ok := middleware.PrincipalFromContext(ctx); ok {
+		job.CreatedBy = p.Subject
+	}
+	if err := a.repo.CreateImportJob(ctx, job); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	// Row errors are reported in the language of whoever started it
+	go a.run(context.WithoutCancel(ctx), i18n.FromContext(ctx), *job, source)
+	w.Header().Set("Location", a.routes.Path("get-order-import", job.ID))
+	writeJSON(w, http.StatusAccepted, a.withLinks(job))
+}
+
+func (a *ImportAPI) withLinks(j *ImportJob) *ImportJob {
+	j.Links = map[string]string{
+		"self":   a.routes.Path("get-order-import", j.ID),
+		"rows":   a.routes.Path("list-order-import-rows", j.ID),
+		"errors": a.routes.Path("get-order-import-errors", j.ID),
+	}
+	return j
+}
+
+// run reads the job's file and imports it a chunk at a time, saving what
+// became of each row as it goes
+func (a *ImportAPI) run(ctx context.Context, loc *i18n.Localizer, job ImportJob, source importSource) {
+	fail := func(err error) {
+		now := a.clock.Now()
+		job.Status, job.Error, job.FinishedAt = ImportFailed, loc.Text(err), &now
+		if err := a.repo.SaveImportProgress(ctx, &job, nil); err != nil {
+			log.Printf("import %s: %v", job.ID, err)
+		}
+		a.finished(ctx, &job)
+	}
+
+	rows, err := a.read(ctx, job.Format, source)
+	if err != nil {
+		fail(err)
+		return
+	}
+	job.Status, job.Total = ImportRunning, len(rows)
+	if err := a.repo.SaveImportProgress(ctx, &job, nil); err != nil {
+		log.Printf("import %s: %v", job.ID, err)
+		return
+	}
+
+	now := a.clock.Now()
+	for start := 0; start < len(rows); start += importChunk {
+		chunk := rows[start:min(start+importChunk, len(rows))]
+		results := make([]ImportRow, len(chunk))
+		var orders []Order
+		var index []int
+		for i, row := range chunk {
+			results[i] = ImportRow{Row: row.row, ExternalID: row.order.ExternalID}
+			err := row.err
+			if err == nil {
+				err = checkImportedOrder(&row.order, now)
+			}
+			if err != nil {
+				results[i].Outcome, results[i].Error = RowFailed, loc.Text(err)
+				job.Failed++
+				continue
+			}
+			row.order.Tenant = job.Tenant
+			orders = append(orders, row.order)
+			index = append(index, i)
+		}
+
+		skipped, err := a.repo.ImportOrders(ctx, orders)
+		if err != nil {
+			fail(err)
+			return
+		}
+		var ids []int
+		for k, o := range orders {
+			res := &results[index[k]]
+			if slices.Contains(skipped, k) {
+				res.Outcome, res.Error = RowSkipped, loc.T("order.import_duplicate", o.ExternalID)
+				job.Skipped++
+				continue
+			}
+			res.Outcome, res.OrderID, res.PublicID = RowImported, o.ID, o.PublicID
+			job.Imported++
+			ids = append(ids, o.ID)
+		}
+		job.Processed += len(chunk)
+		if err := a.repo.SaveImportProgress(ctx, &job, results); err != nil {
+			log.Printf("import %s: %v", job.ID, err)
+			return
+		}
+		if len(ids) > 0 {
+			a.events.Emit(ctx, "orders.imported", "orders", map[string]any{
+				"tenant":    job.Tenant,
+				"order_ids": ids,
+				"import_id": job.ID,
+			})
+		}
+	}
+
+	finished := a.clock.Now()
+	job.Status, job.FinishedAt = ImportCompleted, &finished
+	if err := a.repo.SaveImportProgress(ctx, &job, nil); err != nil {
+		log.Printf("import %s: %v", job.ID, err)
+		return
+	}
+	a.finished(ctx, &job)
+}
+
+// finished announces the job's outcome with its tenant, for webhooks
+func (a *ImportAPI) finished(ctx context.Context, job *ImportJob) {
+	a.events.Emit(ctx, "order_import.finished", "order_import/"+job.ID, struct {
+		Tenant string `json:"tenant,omitempty"`
+		*ImportJob
+	}{job.Tenant, job})
+}
+
+func (a *ImportAPI) read(ctx context.Context, format string, source importSource) ([]parsedRow, error) {
+	body, err := source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	limited := &io.LimitedReader{R: body, N: maxImportFileBytes + 1}
+	var rows []parsedRow
+	if format == "csv" {
+		rows, err = parseCSV(limited)
+	} else {
+		rows, err = parseNDJSON(limited)
+	}
+	if limited.N == 0 {
+		return nil, errImportTooBig
+	}
+	return rows, err
+}
+
+// importFile is a file stored with files-service as payment-service serves
+// it
+type importFile struct {
+	ContentType string `json:"content_type"`
+	Status      string `json:"status"`
+	URL         string `json:"download_url"`
+}
+
+// fileSource looks the file up in files-service as the caller, so only
+// files they may read are imported, and returns its format and where its
+// content is fetched from once the import runs
+func (a *ImportAPI) fileSource(r *http.Request, fileID string) (string, importSource, error) {
+	ctx := r.Context()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.paymentServiceURL+"/files/"+url.PathEscape(fileID), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	propagate(ctx, req)
+	start := time.Now()
+	resp, err := a.client.Do(req)
+	middleware.RecordUpstream(ctx, "payment-service", time.Since(start))
+	if err != nil {
+		return "", nil, i18n.Wrap(err, "order.payment_service_unavailable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil, errImportFileNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, i18n.NewError("order.payment_service_unavailable", resp.Status)
+	}
+	var f importFile
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return "", nil, i18n.Wrap(err, "order.payment_service_unavailable")
+	}
+	if f.URL == "" {
+		return "", nil, i18n.NewError("order.import_file_unavailable", f.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(f.ContentType)
+	format, ok := importFormats[mediaType]
+	if !ok {
+		return "", nil, i18n.NewError("order.import_format", f.ContentType)
+	}
+	return format, func(ctx context.Context) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return nil, i18n.Wrap(err, "order.import_download")
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, i18n.NewError("order.import_download", resp.Status)
+		}
+		return resp.Body, nil
+	}, nil
+}
+
+var errImportFileNotFound = i18n.NewError("order.import_file_not_found")
+
+// job finds the path's import for its tenant; others don't learn it exists.
+// A running job that stopped making progress is failed here.
+func (a *ImportAPI) job(w http.ResponseWriter, r *http.Request) (*ImportJob, bool) {
+	ctx := r.Context()
+	job, err := a.repo.ImportJob(ctx, router.Param(r, "id"))
+	if err == nil {
+		if p, ok := middleware.PrincipalFromContext(ctx); ok && !p.HasRole("admin") &&
+			(job.Tenant != p.Tenant || (job.Tenant == "" && job.CreatedBy != p.Subject)) {
+			err = ErrNotFound
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "order.import_not_found")
+		return nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	if now := a.clock.Now(); !job.finished() && now.Sub(job.UpdatedAt) > importStallAfter {
+		job.Status, job.Error, job.FinishedAt = ImportFailed, i18n.FromContext(ctx).T("order.import_interrupted"), &now
+		if err := a.repo.SaveImportProgress(ctx, job, nil); err != nil {
+			dbretry.Error(w, err)
+			return nil, false
+		}
+	}
+	return job, true
+}
+
+// GetJob serves GET /orders/imports/{id}
+func (a *ImportAPI) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.job(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.withLinks(job))
+}
+
+// Rows serves GET /orders/imports/{id}/rows, what became of each row in
+// row order. Query: outcome (imported, skipped or failed), after (a row)
+// and limit.
+func (a *ImportAPI) Rows(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.job(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	outcome := q.Get("outcome")
+	if outcome != "" && outcome != RowImported && outcome != RowSkipped && outcome != RowFailed {
+		http.Error(w, "invalid outcome", http.StatusBadRequest)
+		return
+	}
+	after, limit := 0, defaultImportRows
+	var err error
+	if v := q.Get("after"); v != "" {
+		if after, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxImportRows)
+	}
+	rows, err := a.repo.ImportRows(r.Context(), job.ID, outcome, after, limit)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if rows == nil {
+		rows = []ImportRow{}
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+// Errors serves GET /orders/imports/{id}/errors, a CSV of the rows that
+// were skipped or failed, to fix and import again
+func (a *ImportAPI) Errors(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.job(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import-%s-errors.csv"`, job.ID))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"row", "external_id", "outcome", "error"})
+	for after := 0; ; {
+		rows, err := a.repo.ImportRows(ctx, job.ID, "", after, maxImportRows)
+		if err != nil {
+			// The header is out; all that's left is to cut the report short
+			log.Printf("import %s: error report: %v", job.ID, err)
+			break
+		}
+		for _, row := range rows {
+			if row.Outcome != RowImported {
+				cw.Write([]string{strconv.Itoa(row.Row), row.ExternalID, row.Outcome, row.Error})
+			}
+		}
+		if len(rows) < maxImportRows {
+			break
+		}
+		after = rows[len(rows)-1].Row
+	}
+	cw.Flush()
+}
@@ -0,0 +1,58 @@
+// order-service/json.go
+package main
+
+import "platform/jsonenc"
+
+// AppendJSON appends o as encoding/json would marshal it, without the
+// reflection; listings encode many orders per request. Keep it in step
+// with Order's fields and tags.
+func (o *Order) AppendJSON(b []byte) []byte {
+	b = append(b, '{')
+	b = jsonenc.Int(jsonenc.Key(b, "id"), int64(o.ID))
+	if o.PublicID != "" {
+		b = jsonenc.String(jsonenc.Key(b, "public_id"), o.PublicID)
+	}
+	b = jsonenc.Int(jsonenc.Key(b, "user_id"), int64(o.UserID))
+	b = jsonenc.String(jsonenc.Key(b, "product"), o.Product)
+	b = jsonenc.Int(jsonenc.Key(b, "quantity"), int64(o.Quantity))
+	b = jsonenc.Float(jsonenc.Key(b, "amount"), o.Amount)
+	b = jsonenc.String(jsonenc.Key(b, "status"), o.Status)
+	b = jsonenc.Time(jsonenc.Key(b, "created_at"), o.CreatedAt)
+	if o.PaymentMethodID != 0 {
+		b = jsonenc.Int(jsonenc.Key(b, "payment_method_id"), o.PaymentMethodID)
+	}
+	if o.UseStoreCredit {
+		b = jsonenc.Bool(jsonenc.Key(b, "use_store_credit"), true)
+	}
+	if o.ReturnURL != "" {
+		b = jsonenc.String(jsonenc.Key(b, "return_url"), o.ReturnURL)
+	}
+	if o.ConfirmationURL != "" {
+		b = jsonenc.String(jsonenc.Key(b, "confirmation_url"), o.ConfirmationURL)
+	}
+	if o.PaymentID != 0 {
+		b = jsonenc.Int(jsonenc.Key(b, "payment_id"), int64(o.PaymentID))
+	}
+	if len(o.Metadata) > 0 {
+		b = jsonenc.StringMap(jsonenc.Key(b, "metadata"), o.Metadata)
+	}
+	if o.ExternalID != "" {
+		b = jsonenc.String(jsonenc.Key(b, "external_id"), o.ExternalID)
+	}
+	if len(o.Links) > 0 {
+		b = jsonenc.StringMap(jsonenc.Key(b, "links"), o.Links)
+	}
+	if o.GuestClaimToken != "" {
+		b = jsonenc.String(jsonenc.Key(b, "guest_claim_token"), o.GuestClaimToken)
+	}
+	if o.Country != "" {
+		b = jsonenc.String(jsonenc.Key(b, "country"), o.Country)
+	}
+	if o.Region != "" {
+		b = jsonenc.String(jsonenc.Key(b, "region"), o.Region)
+	}
+	if o.OrgID != "" {
+		b = jsonenc.String(jsonenc.Key(b, "org_id"), o.OrgID)
+	}
+	return append(b, '}')
+}
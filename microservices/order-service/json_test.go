@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"platform/jsonenc"
+)
+
+func testOrders() []Order {
+	created := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	return []Order{
+		{ID: 1, UserID: 2, Product: "Widget", Quantity: 1, Amount: 9.99, Status: "pending", CreatedAt: created},
+		{
+			ID: 3, PublicID: "ord_3", UserID: 4, Product: `<Gadget> "deluxe" & co`, Quantity: 3, Amount: 1e21,
+			Status: "completed", CreatedAt: created, PaymentMethodID: 5, UseStoreCredit: true,
+			ReturnURL: "https://shop.example/return?a=1&b=2", ConfirmationURL: "https://pay.example/3ds",
+			PaymentID: 6, Metadata: map[string]string{"z": "last", "campaign": "spring "},
+			ExternalID: "ext-7", Tenant: "acme", Links: map[string]string{"self": "/orders/ord_3"},
+			GuestClaimToken: "claim", Country: "DE", Region: "BE", OrgID: "org_8",
+		},
+	}
+}
+
+func TestAppendJSONMatchesMarshal(t *testing.T) {
+	for _, o := range testOrders() {
+		want, err := json.Marshal(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.AppendJSON(nil); string(got) != string(want) {
+			t.Errorf("AppendJSON = %s\nwant          %s", got, want)
+		}
+	}
+}
+
+func benchOrders() []Order {
+	orders := make([]Order, 100)
+	for i := range orders {
+		orders[i] = testOrders()[i%2]
+		orders[i].ID = i
+	}
+	return orders
+}
+
+func BenchmarkAppendJSON(b *testing.B) {
+	orders := benchOrders()
+	buf := make([]byte, 0, 64<<10)
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = jsonenc.Array(buf[:0], orders, (*Order).AppendJSON)
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	orders := benchOrders()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := json.Marshal(orders); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
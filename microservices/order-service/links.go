@@ -0,0 +1,44 @@
+// order-service/links.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// userPath is users' resource as the gateway serves it; it isn't in this
+// service's route table. The gateway doesn't serve payments, so an order's
+// payment is reached through ?expand=payment instead of a link.
+const userPath = "/users/"
+
+// withLinks adds the order's resource and the actions open on it, given
+// its status, so clients follow links instead of building URLs
+func (s *OrderService) withLinks(order *Order) *Order {
+	if s.routes == nil {
+		return order
+	}
+	id := order.PublicID
+	if id == "" {
+		id = strconv.Itoa(order.ID)
+	}
+	links := map[string]string{
+		"self": s.routes.Path("get-order", id),
+		"user": userPath + strconv.Itoa(order.UserID),
+	}
+	switch order.Status {
+	case "awaiting_confirmation":
+		links["cancel"] = s.routes.Path("cancel-order", id)
+		links["payment_callback"] = s.routes.Path("order-payment-callback", id)
+	case "completed":
+		links["invoice"] = s.routes.Path("get-order-view", id, "confirmation")
+		// Customers get money back on an order by returning it
+		links["refund"] = s.routes.Path("create-return")
+	}
+	order.Links = links
+	return order
+}
+
+// writeOrder answers with order and its links
+func (s *OrderService) writeOrder(w http.ResponseWriter, status int, order *Order) {
+	writeJSON(w, status, s.withLinks(order))
+}
@@ -3,140 +3,939 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
+	"platform/alert"
+	"platform/auth"
+	"platform/backup"
+	"platform/bulkhead"
+	"platform/clock"
+	"platform/coalesce"
+	"platform/codec"
+	"platform/dbretry"
+	"platform/deadline"
+	"platform/degrade"
+	"platform/events"
+	"platform/geoip"
+	"platform/i18n"
+	"platform/limit"
+	"platform/middleware"
+	"platform/migrate"
+	"platform/priority"
+	"platform/quota"
+	"platform/router"
+	"platform/server"
+	"platform/signing"
+	"platform/startup"
+	"platform/transport"
+	"platform/workflow"
+
 	_ "github.com/lib/pq"
 )
 
 type Order struct {
+	// PublicID is the ID to hand out; ID, the serial key, is still
+	// accepted in paths while clients move over
 	ID        int       `json:"id"`
+	PublicID  string    `json:"public_id,omitempty"`
 	UserID    int       `json:"user_id"`
 	Product   string    `json:"product"`
 	Quantity  int       `json:"quantity"`
 	Amount    float64   `json:"amount"`
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
+	// PaymentMethodID picks one of the user's stored cards; without it
+	// payment-service charges their default
+	PaymentMethodID int64 `json:"payment_method_id,omitempty"`
+	// UseStoreCredit pays from the user's store credit first, putting
+	// only the rest on the card
+	UseStoreCredit bool `json:"use_store_credit,omitempty"`
+	// ReturnURL is where the customer lands after confirming a payment
+	// that needs it (3-D Secure). The order is then awaiting_confirmation
+	// and ConfirmationURL is where to send them.
+	ReturnURL       string `json:"return_url,omitempty"`
+	ConfirmationURL string `json:"confirmation_url,omitempty"`
+	PaymentID       int    `json:"payment_id,omitempty"`
+	// Metadata is the client's own references, e.g. a campaign or an ID in
+	// their system; see validateMetadata for the limits
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ExternalID is the client's own ID for the order, unique within the
+	// caller's tenant. Creating an order with one that exists returns the
+	// existing order instead, so integrations can safely retry.
+	ExternalID string `json:"external_id,omitempty"`
+	Tenant     string `json:"-"`
+	// Links are the order's resource and the actions open on it
+	Links map[string]string `json:"links,omitempty"`
+	// GuestClaimToken is returned once, on the first guest checkout with
+	// an email; it is not stored. With it the guest can register or claim
+	// the order later.
+	GuestClaimToken string `json:"guest_claim_token,omitempty"`
+	// Country and Region are where the buyer was, as the gateway located
+	// them, for fraud checks and taxes; clients can't set them
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// OrgID is the organization the order was placed for; members whose
+	// role allows it see and manage it as well as the buyer
+	OrgID string `json:"org_id,omitempty"`
+}
+
+// budgetShare is the fraction of the remaining deadline budget a step of
+// CreateOrder may use, and the least it needs to be worth attempting
+type budgetShare struct {
+	fraction float64
+	need     time.Duration
 }
 
+var (
+	userBudget    = budgetShare{fraction: 0.25, need: 50 * time.Millisecond}
+	insertBudget  = budgetShare{fraction: 0.2, need: 20 * time.Millisecond}
+	paymentBudget = budgetShare{fraction: 0.9, need: 100 * time.Millisecond}
+)
+
+// Together the steps can't finish in less than this
+const minCreateOrderBudget = 200 * time.Millisecond
+
+// Default concurrent payment calls; batch traffic may use half
+const defaultPaymentConcurrency = 32
+
+// Most customers kept to stand in while user-service is down
+const knownCustomersMax = 10000
+
 type OrderService struct {
-	db                *sql.DB
+	repo              OrderRepository
 	userServiceURL    string
 	paymentServiceURL string
+	paymentBulkhead   *bulkhead.Bulkhead
+	// client calls user- and payment-service over connections kept warm
+	// between checkouts
+	client *http.Client
+	// codec is what those calls are sent in and ask to be answered in
+	codec codec.Codec
+	// customers coalesces concurrent lookups of the same user
+	customers coalesce.Group[int, *Customer]
+	// memberships are users' recent roles in organizations
+	memberships *summaryCache[orgMember, OrgMembership]
+	// tokens sign the admin token user-service wants for memberships; nil
+	// when auth is off
+	tokens *auth.Tokens
+	// signer signs calls to payment-service; nil leaves them unsigned
+	signer *signing.Keyring
+	events *events.Emitter
+	// routes builds the links in order responses
+	routes  *router.Router
+	waiters *OrderWaiters
+	// quotas limits orders per month by plan; nil when QUOTA_LIMITS=off
+	quotas *quota.Accountant
+	// billing meters the usage events it receives
+	billing *Billing
+	// buffer holds orders while the database refuses connections; nil
+	// unless ORDER_BUFFER_DIR is set
+	buffer *OrderBuffer
+	// degradation is what to do while user- or payment-service is down;
+	// nil fails the requests that need them
+	degradation *degrade.Policy
+	// knownCustomers are the last lookups, served while user-service is
+	// down if the policy says so
+	knownCustomers *customerCache
+	clock          clock.Clock
 }
 
-func NewOrderService(dbURL, userServiceURL, paymentServiceURL string) (*OrderService, error) {
-	db, err := sql.Open("postgres", dbURL)
-	if err != nil {
-		return nil, err
-	}
-
+func NewOrderService(repo OrderRepository, userServiceURL, paymentServiceURL string, emitter *events.Emitter) *OrderService {
 	return &OrderService{
-		db:                db,
+		repo:              repo,
 		userServiceURL:    userServiceURL,
 		paymentServiceURL: paymentServiceURL,
-	}, nil
+		paymentBulkhead:   bulkhead.New(defaultPaymentConcurrency, defaultPaymentConcurrency/2),
+		client:            http.DefaultClient,
+		codec:             codec.JSON,
+		events:            emitter,
+		waiters:           NewOrderWaiters(),
+		memberships:       newSummaryCache[orgMember, OrgMembership](),
+		clock:             clock.System,
+	}
+}
+
+// propagate copies request ID, trace, deadline budget and priority onto a
+// call to another service
+func propagate(ctx context.Context, req *http.Request) {
+	middleware.Propagate(ctx, req)
+	deadline.Propagate(ctx, req)
+	priority.Propagate(ctx, req)
 }
 
 // Service-to-service communication
-func (s *OrderService) validateUser(userID int) error {
-	url := fmt.Sprintf("%s/users/get?id=%d", s.userServiceURL, userID)
-	resp, err := http.Get(url)
+
+// authorize has req carry a short-lived admin token for order-service
+// itself, for calls made on the service's behalf rather than the caller's,
+// which user- and payment-service require once auth is on
+func (s *OrderService) authorize(req *http.Request) error {
+	if s.tokens == nil {
+		return nil
+	}
+	token, err := s.tokens.Issue(auth.Claims{Subject: "order-service", Roles: []string{"admin"}}, time.Minute)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// fetchCustomer looks a user up in user-service. Concurrent lookups of one
+// user, e.g. a burst of orders from one account, share a single call; it
+// carries no caller's credentials, so any caller can use its answer.
+// While user-service is down the last answer for the user stands in, if
+// the degradation policy caches it.
+func (s *OrderService) fetchCustomer(ctx context.Context, userID int) (*Customer, error) {
+	customer, err, _ := s.customers.Do(ctx, userID, func(ctx context.Context) (*Customer, error) {
+		return s.lookupCustomer(ctx, userID, "")
+	})
+	var m *i18n.Message
+	if s.knownCustomers != nil && errors.As(err, &m) && m.Key == "order.user_service_unavailable" {
+		if known, ok := s.knownCustomers.get(userID); ok {
+			s.degradation.Degraded(ctx, "user-service")
+			middleware.Debugf(ctx, "user %d: user-service down, using the last lookup: %v", userID, err)
+			return known, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.knownCustomers != nil {
+		s.knownCustomers.put(userID, customer)
+	}
+	c := *customer
+	return &c, nil
+}
+
+// lookupCustomer asks user-service for a user; with tenant set, a user of
+// another tenant isn't found
+func (s *OrderService) lookupCustomer(ctx context.Context, userID int, tenant string) (*Customer, error) {
+	u := fmt.Sprintf("%s/users/%d", s.userServiceURL, userID)
+	if tenant != "" {
+		u += "?tenant=" + url.QueryEscape(tenant)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		return fmt.Errorf("user service unavailable: %w", err)
+		return nil, err
+	}
+	req.Header.Set("Accept", s.codec.ContentType())
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, "user-service", time.Since(start))
+	if err != nil {
+		return nil, i18n.Wrap(err, "order.user_service_unavailable")
 	}
 	defer resp.Body.Close()
 
+	middleware.Debugf(ctx, "user-service answered %d for user %d", resp.StatusCode, userID)
+	// Turned away or failing, user-service says nothing about the user
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode >= http.StatusInternalServerError {
+		return nil, i18n.Wrap(fmt.Errorf("user %d: %s", userID, resp.Status), "order.user_service_unavailable")
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("user not found")
+		return nil, i18n.NewError("order.user_not_found")
 	}
 
-	return nil
+	var customer Customer
+	if err := codec.DecodeResponse(resp, &customer); err != nil {
+		return nil, i18n.Wrap(err, "order.user_service_unavailable")
+	}
+	return &customer, nil
 }
 
-func (s *OrderService) processPayment(orderID int, amount float64) error {
+// errPaymentMethodInvalid is the customer's to fix, unlike other payment
+// failures
+var errPaymentMethodInvalid = i18n.NewError("order.payment_method_invalid")
+
+func (s *OrderService) processPayment(ctx context.Context, order *Order) (*PaymentReceipt, error) {
 	payment := map[string]interface{}{
-		"order_id": orderID,
-		"amount":   amount,
+		"order_id": order.ID,
+		"user_id":  order.UserID,
+		"amount":   order.Amount,
+	}
+	if order.PaymentMethodID != 0 {
+		payment["payment_method_id"] = order.PaymentMethodID
+	}
+	if order.UseStoreCredit {
+		payment["use_store_credit"] = true
+	}
+	if order.ReturnURL != "" {
+		payment["return_url"] = order.ReturnURL
+	}
+	// payment-service picks the provider endpoint for the buyer's region
+	if order.Country != "" {
+		payment["country"] = order.Country
+	}
+	if order.Region != "" {
+		payment["region"] = order.Region
 	}
 
-	paymentJSON, _ := json.Marshal(payment)
+	var body bytes.Buffer
+	if err := s.codec.Encode(&body, payment); err != nil {
+		return nil, err
+	}
 	url := fmt.Sprintf("%s/payments", s.paymentServiceURL)
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(paymentJSON))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
 	if err != nil {
-		return fmt.Errorf("payment service unavailable: %w", err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", s.codec.ContentType())
+	req.Header.Set("Accept", s.codec.ContentType())
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+	propagate(ctx, req)
+	if s.signer != nil {
+		if err := s.signer.Sign(req, "order-service"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Interactive checkouts get first claim on payment-service capacity
+	release, err := s.paymentBulkhead.Track(ctx)
+	if err != nil {
+		return nil, i18n.Wrap(err, "order.payment_service_busy")
+	}
+	var overloaded bool
+	defer func() { release(overloaded) }()
+
+	middleware.Debugf(ctx, "order %d: requesting payment %v", order.ID, payment)
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, "payment-service", time.Since(start))
+	overloaded = limit.Overloaded(resp, err)
+	if err != nil {
+		middleware.Debugf(ctx, "order %d: payment-service unreachable after %s: %v", order.ID, time.Since(start), err)
+		return nil, i18n.Wrap(err, "order.payment_service_unavailable")
 	}
 	defer resp.Body.Close()
+	middleware.Debugf(ctx, "order %d: payment-service answered %d in %s", order.ID, resp.StatusCode, time.Since(start))
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("payment failed")
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return nil, errPaymentMethodInvalid
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, i18n.Wrap(errPaymentRefused, "order.payment_service_unavailable")
+	}
+	// 202 Accepted: the customer has to confirm the payment first
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, i18n.NewError("order.payment_failed")
 	}
 
-	return nil
+	var receipt PaymentReceipt
+	if err := codec.DecodeResponse(resp, &receipt); err != nil {
+		return nil, i18n.Wrap(err, "order.payment_service_unavailable")
+	}
+	return &receipt, nil
+}
+
+// step runs fn with its share of the request's remaining deadline budget
+func step(ctx context.Context, share budgetShare, fn func(context.Context) error) error {
+	stepCtx, cancel, err := deadline.Step(ctx, share.fraction, share.need)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return fn(stepCtx)
 }
 
 func (s *OrderService) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+	if err := deadline.Require(ctx, minCreateOrderBudget); err != nil {
+		http.Error(w, loc.Text(err), http.StatusGatewayTimeout)
+		return
+	}
+
 	var order Order
 	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, loc.Text(err), http.StatusBadRequest)
+		return
+	}
+
+	// The order is charged to the user's stored card and store credit, so
+	// only they, admins, and their own tenant's integrations may place it
+	p, authed := middleware.PrincipalFromContext(ctx)
+	integrator := authed && p.Tenant != "" && p.HasRole("integrator") && !allowed(r, order.UserID)
+	if !integrator && !allowed(r, order.UserID) {
+		i18n.Error(w, r, http.StatusForbidden, "order.user_forbidden")
 		return
 	}
 
 	// Validate user exists (call user service)
-	if err := s.validateUser(order.UserID); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	s.placeOrder(w, r, &order, func(ctx context.Context) (*Customer, error) {
+		if integrator {
+			return s.lookupCustomer(ctx, order.UserID, p.Tenant)
+		}
+		return s.fetchCustomer(ctx, order.UserID)
+	})
+}
+
+// placeOrder runs a checkout once the request is read: customer finds who
+// is buying, within the user step's budget, and sets order.UserID if it
+// wasn't known
+func (s *OrderService) placeOrder(w http.ResponseWriter, r *http.Request, order *Order,
+	customer func(context.Context) (*Customer, error)) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+
+	if err := validateMetadata(order.Metadata); err != nil {
+		http.Error(w, loc.Text(err), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := validateExternalID(order.ExternalID); err != nil {
+		http.Error(w, loc.Text(err), http.StatusUnprocessableEntity)
+		return
+	}
+	order.Tenant = tenantOf(r)
+	where := geoip.FromRequest(r)
+	order.Country, order.Region = where.Country, where.Region
+
+	var buyer *Customer
+	err := step(ctx, userBudget, func(ctx context.Context) (err error) {
+		if buyer, err = customer(ctx); err != nil {
+			return err
+		}
+		return s.checkOrgOrder(ctx, order)
+	})
+	if deadline.Exceeded(err) {
+		http.Error(w, loc.Text(err), http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errOrgForbidden) {
+		http.Error(w, loc.Text(err), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadRequest)
+		return
+	}
+
+	if order.ExternalID != "" && s.replayOrder(w, r, order) {
+		return
+	}
+
+	release, ok := s.chargeOrder(w, r, order)
+	if !ok {
 		return
 	}
 
 	// Create order
 	order.Status = "pending"
-	order.CreatedAt = time.Now()
+	order.CreatedAt = s.clock.Now()
+
+	err = step(ctx, insertBudget, func(ctx context.Context) error {
+		return s.repo.Create(ctx, order)
+	})
+	if err != nil && s.buffer.holds(order, err) && s.buffer.take(w, r, order, buyer) {
+		return
+	}
+	if err != nil {
+		release()
+	}
+	if deadline.Exceeded(err) {
+		http.Error(w, loc.Text(err), http.StatusGatewayTimeout)
+		return
+	}
+	// Lost a race with a create for the same external ID
+	if errors.Is(err, errExternalIDTaken) && s.replayOrder(w, r, order) {
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
 
-	query := `INSERT INTO orders (user_id, product, quantity, amount, status, created_at) 
-              VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
-	err := s.db.QueryRow(query,
-		order.UserID, order.Product, order.Quantity,
-		order.Amount, order.Status, order.CreatedAt).Scan(&order.ID)
+	status, err := s.payOrder(ctx, order, buyer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, loc.Text(err), status)
 		return
 	}
+	s.writeOrder(w, status, order)
+}
+
+// payOrder charges a created order and records how that went, returning
+// the status to answer with: 200 once paid, 202 while the customer has to
+// confirm the payment or, by the degradation policy, while payment-service
+// is down, and an error status with the error when it failed
+func (s *OrderService) payOrder(ctx context.Context, order *Order, buyer *Customer) (int, error) {
+	// Status bookkeeping must happen even if the budget ran out meanwhile
+	bookkeeping := context.WithoutCancel(ctx)
 
 	// Process payment (call payment service)
-	if err := s.processPayment(order.ID, order.Amount); err != nil {
+	var receipt *PaymentReceipt
+	err := step(ctx, paymentBudget, func(ctx context.Context) (err error) {
+		receipt, err = s.processPayment(ctx, order)
+		return err
+	})
+	if err != nil && paymentNotTaken(err) && s.degradation.Fallback("payment-service") == "accept" {
+		return s.awaitPayment(bookkeeping, order, err)
+	}
+	if err != nil {
 		// Update order status to failed
-		s.db.Exec("UPDATE orders SET status = $1 WHERE id = $2", "payment_failed", order.ID)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		s.repo.UpdateStatus(bookkeeping, order.ID, "payment_failed")
+		order.Status = "payment_failed"
+		s.events.Emit(bookkeeping, "order.payment_failed", fmt.Sprintf("order/%d", order.ID), order)
+		status := http.StatusInternalServerError
+		if deadline.Exceeded(err) {
+			status = http.StatusGatewayTimeout
+		} else if errors.Is(err, errPaymentMethodInvalid) {
+			status = http.StatusUnprocessableEntity
+		}
+		return status, err
+	}
+
+	if receipt.Status == "requires_action" {
+		order.Status = "awaiting_confirmation"
+		order.PaymentID = receipt.ID
+		order.ConfirmationURL = receipt.ConfirmationURL
+		if err := s.repo.RecordPayment(bookkeeping, order.ID, receipt.ID, order.Status); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusAccepted, nil
 	}
 
 	// Update order status
 	order.Status = "completed"
-	s.db.Exec("UPDATE orders SET status = $1 WHERE id = $2", order.Status, order.ID)
+	order.PaymentID = receipt.ID
+	s.repo.RecordPayment(bookkeeping, order.ID, receipt.ID, order.Status)
+	s.completed(bookkeeping, order, buyer, receipt)
+	return http.StatusOK, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
+// completed records what follows a paid order, whether it was paid at once
+// or confirmed later
+func (s *OrderService) completed(ctx context.Context, order *Order, customer *Customer, receipt *PaymentReceipt) {
+	receipt.ConfirmationURL = ""
+	if err := s.repo.SaveConfirmation(ctx, newConfirmation(order, customer, receipt, s.clock.Now())); err != nil {
+		log.Printf("order %d: save confirmation: %v", order.ID, err)
+	}
+	s.events.Emit(ctx, "order.completed", fmt.Sprintf("order/%d", order.ID), order)
 }
 
 func main() {
 	dbURL := os.Getenv("DATABASE_URL")
 	userServiceURL := os.Getenv("USER_SERVICE_URL")
 	paymentServiceURL := os.Getenv("PAYMENT_SERVICE_URL")
+	shippingServiceURL := os.Getenv("SHIPPING_SERVICE_URL")
+
+	// "backup [file]" and "restore [file]" dump and restore the schema, for
+	// disaster recovery drills
+	if len(os.Args) > 1 {
+		if err := backup.Command(context.Background(), os.Args[1:], "order-service", dbURL, schema, migrations()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	repo, database, err := openRepository(os.Getenv("STORAGE"), dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// DEGRADATION picks what checkout does while user- or payment-service
+	// is down; see degradations
+	degradation, err := degrade.FromEnv(degradations)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Take orders once the database and the services checkout calls are
+	// up, or those it can do without
+	boot, err := startup.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if database != nil {
+		boot.Add(*database)
+	}
+	if userServiceURL != "" {
+		boot.Add(startup.Dependency{Name: "user-service", Check: startup.HTTP(userServiceURL + "/healthz"),
+			Optional: degradation.Fallback("user-service") != ""})
+	}
+	if paymentServiceURL != "" {
+		boot.Add(startup.Dependency{Name: "payment-service", Check: startup.HTTP(paymentServiceURL + "/healthz"),
+			Optional: degradation.Fallback("payment-service") != ""})
+	}
+	service := NewOrderService(repo, userServiceURL, paymentServiceURL, events.NewEmitter("order-service", events.FromEnv()))
+	service.degradation = degradation
+	if degradation.Fallback("user-service") == "cache" {
+		service.knownCustomers = newCustomerCache(knownCustomersMax)
+	}
+	if url := os.Getenv("EVENTS_URL"); url != "" {
+		boot.Add(startup.Dependency{Name: "events", Check: startup.Reachable(url), SelfTest: service.events.SelfTest, Optional: true})
+	}
+	paymentConcurrency := defaultPaymentConcurrency
+	if v := os.Getenv("PAYMENT_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid PAYMENT_CONCURRENCY %q", v)
+		}
+		paymentConcurrency = n
+		service.paymentBulkhead = bulkhead.New(n, max(n/2, 1))
+	}
+	// PAYMENT_LIMIT, aimd or vegas, lets the payment calls' latency set how
+	// many run at once, up to PAYMENT_CONCURRENCY
+	paymentAlg, err := limit.Parse(os.Getenv("PAYMENT_LIMIT"))
+	if err != nil {
+		log.Fatalf("invalid PAYMENT_LIMIT: %v", err)
+	}
+	var paymentLimiter *limit.Limiter
+	if paymentAlg != nil {
+		paymentLimiter = limit.New("payment-service", paymentAlg, max(paymentConcurrency/2, 1), 1, paymentConcurrency)
+		service.paymentBulkhead = bulkhead.NewAdaptive(paymentLimiter, paymentConcurrency, max(paymentConcurrency/2, 1))
+	}
 
-	service, err := NewOrderService(dbURL, userServiceURL, paymentServiceURL)
+	// Keep WARM_CONNECTIONS connections to each service checkout calls open
+	// and exercised every WARM_INTERVAL (0 turns it off), so an order after
+	// a quiet spell isn't the one paying for new connections
+	warmConns := 4
+	if v := os.Getenv("WARM_CONNECTIONS"); v != "" {
+		if warmConns, err = strconv.Atoi(v); err != nil || warmConns < 1 {
+			log.Fatalf("invalid WARM_CONNECTIONS %q", v)
+		}
+	}
+	warmEvery := 30 * time.Second
+	if v := os.Getenv("WARM_INTERVAL"); v != "" {
+		if warmEvery, err = time.ParseDuration(v); err != nil || warmEvery < 0 {
+			log.Fatalf("invalid WARM_INTERVAL %q", v)
+		}
+	}
+	h2, err := transport.FromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
+	calls, err := h2.Transport(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Every call the bulkhead lets through may leave its connection idle
+	calls.MaxIdleConnsPerHost = max(warmConns, paymentConcurrency)
+	calls.IdleConnTimeout = max(calls.IdleConnTimeout, 3*warmEvery)
+	service.client = &http.Client{Transport: calls}
+	if service.codec, err = codec.FromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if service.quotas, err = quota.FromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if spec := os.Getenv("SIGNING_KEYS"); spec != "" {
+		if service.signer, err = signing.ParseKeyring(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/orders", service.CreateOrder)
+	dunning := defaultDunning
+	if v := os.Getenv("SUBSCRIPTION_DUNNING"); v != "" {
+		if dunning, err = parseDurations(v); err != nil {
+			log.Fatalf("invalid SUBSCRIPTION_DUNNING %q", v)
+		}
+	}
+	renewEvery := 30 * time.Second
+	if v := os.Getenv("SUBSCRIPTION_INTERVAL"); v != "" {
+		if renewEvery, err = time.ParseDuration(v); err != nil || renewEvery <= 0 {
+			log.Fatalf("invalid SUBSCRIPTION_INTERVAL %q", v)
+		}
+	}
+	renewCtx, stopRenewals := context.WithCancel(context.Background())
+	defer stopRenewals()
+	var warmURLs []string
+	for _, url := range []string{userServiceURL, paymentServiceURL} {
+		if url != "" {
+			warmURLs = append(warmURLs, url+"/healthz")
+		}
+	}
+	if warmEvery > 0 && len(warmURLs) > 0 {
+		warmer := transport.NewWarmer(calls, warmConns, warmURLs...)
+		go func() {
+			<-boot.Ready()
+			warmer.Run(renewCtx, warmEvery)
+		}()
+	}
+	go func() {
+		<-boot.Ready()
+		NewSubscriptions(service, repo, dunning).Run(renewCtx, renewEvery)
+	}()
 
-	log.Println("Order service starting on :8082")
-	log.Fatal(http.ListenAndServe(":8082", mux))
+	service.billing = NewBilling(repo, service.events)
+	reportEvery := time.Minute
+	if v := os.Getenv("BILLING_REPORT_INTERVAL"); v != "" {
+		if reportEvery, err = time.ParseDuration(v); err != nil || reportEvery <= 0 {
+			log.Fatalf("invalid BILLING_REPORT_INTERVAL %q", v)
+		}
+	}
+	go func() {
+		<-boot.Ready()
+		service.billing.Run(renewCtx, reportEvery)
+	}()
+
+	// Orders buffered while the database was away are placed every
+	// ORDER_BUFFER_INTERVAL
+	if service.buffer = orderBufferFromEnv(service); service.buffer != nil {
+		replayEvery := 5 * time.Second
+		if v := os.Getenv("ORDER_BUFFER_INTERVAL"); v != "" {
+			if replayEvery, err = time.ParseDuration(v); err != nil || replayEvery <= 0 {
+				log.Fatalf("invalid ORDER_BUFFER_INTERVAL %q", v)
+			}
+		}
+		go func() {
+			<-boot.Ready()
+			service.buffer.Run(renewCtx, replayEvery)
+		}()
+	}
+
+	// Orders taken while payment-service was down are charged every
+	// PAYMENT_RETRY_INTERVAL
+	if degradation.Fallback("payment-service") == "accept" {
+		retryEvery := 30 * time.Second
+		if v := os.Getenv("PAYMENT_RETRY_INTERVAL"); v != "" {
+			if retryEvery, err = time.ParseDuration(v); err != nil || retryEvery <= 0 {
+				log.Fatalf("invalid PAYMENT_RETRY_INTERVAL %q", v)
+			}
+		}
+		go func() {
+			<-boot.Ready()
+			service.chargeAwaiting(renewCtx, retryEvery)
+		}()
+	}
+
+	// Operational problems go to whoever ALERT_* names
+	alerts, err := alert.FromEnv("order-service")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check orders against their payments every CONSISTENCY_INTERVAL (0
+	// turns it off), repairing what it can with CONSISTENCY_REPAIR
+	consistency := NewConsistencyChecker(service, repo)
+	consistency.alerts = alerts
+	checkEvery := 15 * time.Minute
+	if v := os.Getenv("CONSISTENCY_INTERVAL"); v != "" {
+		if checkEvery, err = time.ParseDuration(v); err != nil || checkEvery < 0 {
+			log.Fatalf("invalid CONSISTENCY_INTERVAL %q", v)
+		}
+	}
+	if v := os.Getenv("CONSISTENCY_WINDOW"); v != "" {
+		if consistency.window, err = time.ParseDuration(v); err != nil || consistency.window <= 0 {
+			log.Fatalf("invalid CONSISTENCY_WINDOW %q", v)
+		}
+	}
+	if v := os.Getenv("CONSISTENCY_GRACE"); v != "" {
+		if consistency.grace, err = time.ParseDuration(v); err != nil || consistency.grace < 0 {
+			log.Fatalf("invalid CONSISTENCY_GRACE %q", v)
+		}
+	}
+	if v := os.Getenv("CONSISTENCY_SAMPLE"); v != "" {
+		// payment-service lists up to 1000 payments at a time
+		if consistency.sample, err = strconv.Atoi(v); err != nil || consistency.sample < 1 || consistency.sample > 1000 {
+			log.Fatalf("invalid CONSISTENCY_SAMPLE %q", v)
+		}
+	}
+	if v := os.Getenv("CONSISTENCY_REPAIR"); v != "" {
+		if consistency.repair, err = strconv.ParseBool(v); err != nil {
+			log.Fatalf("invalid CONSISTENCY_REPAIR %q", v)
+		}
+	}
+	if checkEvery > 0 && paymentServiceURL != "" {
+		go func() {
+			<-boot.Ready()
+			consistency.Run(renewCtx, checkEvery)
+		}()
+	}
+
+	if pg, ok := repo.(*PostgresOrderRepository); ok {
+		ahead := 3
+		if v := os.Getenv("ORDER_PARTITIONS_AHEAD"); v != "" {
+			if ahead, err = strconv.Atoi(v); err != nil || ahead < 1 {
+				log.Fatalf("invalid ORDER_PARTITIONS_AHEAD %q", v)
+			}
+		}
+		go func() {
+			<-boot.Ready()
+			NewPartitionMaintainer(pg, ahead).Run(renewCtx, 6*time.Hour)
+		}()
+		// Backfills and contractions wait until the service is up
+		online := migrate.NewOnline(pg.db.DB, migrations(), schema)
+		go func() {
+			<-boot.Ready()
+			online.Run(renewCtx, 30*time.Second)
+		}()
+	}
+
+	returns := &ReturnAPI{
+		repo:               repo,
+		events:             service.events,
+		clock:              service.clock,
+		window:             defaultReturnWindow,
+		paymentServiceURL:  paymentServiceURL,
+		shippingServiceURL: shippingServiceURL,
+	}
+	if v := os.Getenv("RETURN_WINDOW"); v != "" {
+		if returns.window, err = time.ParseDuration(v); err != nil || returns.window <= 0 {
+			log.Fatalf("invalid RETURN_WINDOW %q", v)
+		}
+	}
+	if shippingServiceURL == "" {
+		log.Print("SHIPPING_SERVICE_URL not set; returns get no labels and order history no shipments")
+	}
+
+	// Look for orders and returns stuck past their SLAs every
+	// WORKFLOW_INTERVAL (0 turns it off)
+	workflows, err := workflow.FromEnv(service.events, alerts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.watchOrderPayments(workflows)
+	returns.watchReturns(workflows)
+	watchEvery := time.Minute
+	if v := os.Getenv("WORKFLOW_INTERVAL"); v != "" {
+		if watchEvery, err = time.ParseDuration(v); err != nil || watchEvery < 0 {
+			log.Fatalf("invalid WORKFLOW_INTERVAL %q", v)
+		}
+	}
+	if watchEvery > 0 {
+		go func() {
+			<-boot.Ready()
+			workflows.Run(renewCtx, watchEvery)
+		}()
+	}
+
+	// Export completed orders to the ERP every ERP_INTERVAL (0 turns it
+	// off, leaving only retries from the API)
+	exporter := erpExporter(repo, service.events)
+	erpEvery := 5 * time.Minute
+	if v := os.Getenv("ERP_INTERVAL"); v != "" {
+		if erpEvery, err = time.ParseDuration(v); err != nil || erpEvery < 0 {
+			log.Fatalf("invalid ERP_INTERVAL %q", v)
+		}
+	}
+	if exporter != nil && erpEvery > 0 {
+		go func() {
+			<-boot.Ready()
+			exporter.Run(renewCtx, erpEvery)
+		}()
+	}
+
+	slo := NewSLOTracker([]Objective{
+		{Name: "create-order", Method: http.MethodPost, Path: "/orders", Target: 0.995, Latency: 800 * time.Millisecond},
+	}, alertSLO(alerts))
+
+	rt := router.New()
+	service.routes = rt
+	// Listings across orders and usage reports may scan a lot
+	rt.Handle("list-orders", http.MethodGet, "/orders", dbretry.ReportingQueries(http.HandlerFunc(service.ListOrders)))
+	rt.Post("create-order", "/orders", service.CreateOrder)
+	rt.Post("create-guest-order", "/orders/guest", service.CreateGuestOrder)
+	imports := &ImportAPI{repo: repo, events: service.events, clock: service.clock,
+		paymentServiceURL: paymentServiceURL, client: service.client, routes: rt}
+	rt.Handle("import-orders", http.MethodPost, "/orders/import",
+		middleware.RequireRole("admin", "integrator")(http.HandlerFunc(imports.Import)))
+	rt.Handle("get-order-import", http.MethodGet, "/orders/imports/{id}",
+		middleware.RequireRole("admin", "integrator")(http.HandlerFunc(imports.GetJob)))
+	rt.Handle("list-order-import-rows", http.MethodGet, "/orders/imports/{id}/rows",
+		middleware.RequireRole("admin", "integrator")(http.HandlerFunc(imports.Rows)))
+	rt.Handle("get-order-import-errors", http.MethodGet, "/orders/imports/{id}/errors",
+		middleware.RequireRole("admin", "integrator")(http.HandlerFunc(imports.Errors)))
+	rt.Handle("export-orders", http.MethodGet, "/orders/export", middleware.RequireRole("admin")(
+		dbretry.ReportingQueries(http.HandlerFunc(service.ExportOrders))))
+	rt.Post("cancel-order", "/orders/{id}/cancel", service.CancelOrder)
+	rt.Get("get-order-view", "/orders/{id}/{view}", service.orderView)
+	rt.Post("order-payment-callback", "/orders/{id}/payment-callback", service.PaymentCallback)
+	history := NewOrderHistory(service, shippingServiceURL)
+	rt.Get("get-order", "/orders/{id}", history.Get)
+	rt.Get("list-user-orders", "/users/{id}/orders", history.List)
+	subscriptionAPI := &SubscriptionAPI{repo: repo, events: service.events, clock: service.clock}
+	rt.Post("create-subscription", "/subscriptions", subscriptionAPI.Create)
+	rt.Get("list-subscriptions", "/subscriptions", subscriptionAPI.List)
+	rt.Get("get-subscription", "/subscriptions/{id}", subscriptionAPI.Get)
+	rt.Post("pause-subscription", "/subscriptions/{id}/pause", subscriptionAPI.change("subscription.paused", pauseSubscription))
+	rt.Post("resume-subscription", "/subscriptions/{id}/resume", subscriptionAPI.change("subscription.resumed", resumeSubscription))
+	rt.Post("cancel-subscription", "/subscriptions/{id}/cancel", subscriptionAPI.change("subscription.canceled", cancelSubscription))
+	support := middleware.RequireRole("admin", "support")
+	rt.Post("create-return", "/returns", returns.Create)
+	rt.Get("list-returns", "/returns", returns.List)
+	rt.Get("get-return", "/returns/{id}", returns.Get)
+	rt.Handle("approve-return", http.MethodPost, "/returns/{id}/approve",
+		support(returns.decide(ReturnApproved, "return.approved")))
+	rt.Handle("reject-return", http.MethodPost, "/returns/{id}/reject",
+		support(returns.decide(ReturnRejected, "return.rejected")))
+	rt.Post("cancel-return", "/returns/{id}/cancel", returns.decide(ReturnCanceled, "return.canceled"))
+	rt.Handle("refund-return", http.MethodPost, "/returns/{id}/refund", support(http.HandlerFunc(returns.Refund)))
+	rt.Handle("get-billing-usage", http.MethodGet, "/billing/usage",
+		dbretry.ReportingQueries(http.HandlerFunc(service.billing.GetUsage)))
+	rt.Post("receive-event", "/events", service.HandleEvent)
+	rt.Handle("merge-user", http.MethodPost, "/users/{id}/merge",
+		middleware.RequireRole("admin")(http.HandlerFunc(service.MergeUser)))
+	rt.Get("slo", "/slo", slo.ServeHTTP)
+	rt.Handle("get-consistency-report", http.MethodGet, "/admin/consistency",
+		middleware.RequireRole("admin")(http.HandlerFunc(consistency.Get)))
+	rt.Handle("run-consistency-check", http.MethodPost, "/admin/consistency",
+		middleware.RequireRole("admin")(http.HandlerFunc(consistency.RunNow)))
+	if exporter != nil {
+		finance := middleware.RequireRole("admin", "finance")
+		rt.Handle("list-erp-exports", http.MethodGet, "/admin/erp/exports", finance(http.HandlerFunc(exporter.List)))
+		rt.Handle("get-erp-exports", http.MethodGet, "/admin/erp/exports/{day}", finance(http.HandlerFunc(exporter.Day)))
+		rt.Handle("retry-erp-export", http.MethodPost, "/admin/erp/exports/{day}/{kind}/retry",
+			finance(http.HandlerFunc(exporter.Retry)))
+	}
+	rt.ServeOpenAPI("order-service", "1.0")
+
+	opts, err := server.OptionsFromEnv("Order service", ":8082")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pg, ok := repo.(*PostgresOrderRepository); ok {
+		opts.PoolStats = pg.Stats
+	}
+	opts.PublicPaths = []string{"/orders/guest"}
+	consistency.tokens = opts.Tokens
+	service.tokens = opts.Tokens
+	opts.Startup = boot
+	rt.Limit(opts.Limits)
+	opts.Workflows = workflows
+	opts.Alerts = alerts
+	opts.Degradation = degradation
+	if service.codec == codec.MsgPack {
+		opts.Features = append(opts.Features, "msgpack")
+	}
+	if service.quotas != nil {
+		opts.Features = append(opts.Features, "quotas")
+	}
+	if service.signer != nil {
+		opts.Features = append(opts.Features, "signed_links")
+	}
+	if service.buffer != nil {
+		opts.Features = append(opts.Features, "order_buffer")
+	}
+	messages, err := loadMessages()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Middleware = append(opts.Middleware, slo.Middleware, messages.Middleware)
+	srv := server.NewServer(opts, rt)
+	srv.Metrics.Register(service.billing.Metrics)
+	srv.Metrics.Register(consistency)
+	if paymentLimiter != nil {
+		srv.Metrics.Register(paymentLimiter)
+	}
+	if service.buffer != nil {
+		srv.Metrics.Register(service.buffer.spool)
+	}
+	if err := srv.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,283 @@
+// order-service/metadata.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"platform/dbretry"
+	"platform/fields"
+	"platform/i18n"
+	"platform/jsonenc"
+	"platform/middleware"
+)
+
+// Metadata limits keep it to references rather than a document store
+const (
+	maxMetadataKeys     = 20
+	maxMetadataValueLen = 500
+)
+
+// streamFlushInterval is the longest a streamed listing holds orders back
+const streamFlushInterval = 500 * time.Millisecond
+
+// Keys appear in query strings as metadata.<key>, so they can't hold dots
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,40}$`)
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return i18n.NewError("order.metadata_too_many", maxMetadataKeys)
+	}
+	for key, value := range metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return i18n.NewError("order.metadata_invalid_key", key)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLen {
+			return i18n.NewError("order.metadata_value_too_long", key, maxMetadataValueLen)
+		}
+	}
+	return nil
+}
+
+// metadataJSON encodes metadata for a JSONB parameter; none is {}
+func metadataJSON(metadata map[string]string) (string, error) {
+	if len(metadata) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(metadata)
+	return string(b), err
+}
+
+// OrderFilter selects orders for GET /orders. Zero fields don't filter.
+type OrderFilter struct {
+	UserID int
+	// OrgID selects the orders placed for an organization
+	OrgID string
+	// Metadata holds pairs an order's metadata must all contain
+	Metadata map[string]string
+	Status   string
+	Before   int
+	Limit    int
+	// CreatedFrom and CreatedTo bound created_at, [from, to). Orders are
+	// partitioned by it, so bounds keep a query to the months it needs.
+	CreatedFrom, CreatedTo time.Time
+}
+
+// createdRange turns a filter's bounds into parameters Postgres can prune
+// partitions with; an open end is infinite rather than left out
+func createdRange(filter OrderFilter) (from, to any) {
+	from, to = "-infinity", "infinity"
+	if !filter.CreatedFrom.IsZero() {
+		from = filter.CreatedFrom
+	}
+	if !filter.CreatedTo.IsZero() {
+		to = filter.CreatedTo
+	}
+	return from, to
+}
+
+// EachOrder reads the matching orders off the cursor one at a time,
+// reusing one Order, so fn must copy what it keeps
+func (r *PostgresOrderRepository) EachOrder(ctx context.Context, filter OrderFilter, fn func(*Order) error) error {
+	metadata, err := metadataJSON(filter.Metadata)
+	if err != nil {
+		return err
+	}
+	from, to := createdRange(filter)
+	rows, err := r.db.QueryContext(ctx, `SELECT `+orderColumns+` FROM orders
+              WHERE ($1 = 0 OR user_id = $1) AND metadata @> $2::jsonb
+                  AND ($3 = 0 OR id < $3)
+                  AND created_at >= $5::timestamptz AND created_at < $6::timestamptz
+                  AND ($7 = '' OR status = $7) AND ($8 = '' OR org_id = $8)
+              ORDER BY id DESC LIMIT NULLIF($4, 0)`, filter.UserID, metadata, filter.Before, filter.Limit, from, to, filter.Status,
+		filter.OrgID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var o Order
+	for rows.Next() {
+		o = Order{}
+		if err := scanOrder(rows.Scan, &o); err != nil {
+			return err
+		}
+		if err := fn(&o); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *MemoryOrderRepository) EachOrder(ctx context.Context, filter OrderFilter, fn func(*Order) error) error {
+	r.mu.RLock()
+	var orders []Order
+	for _, o := range r.orders {
+		if (filter.UserID != 0 && o.UserID != filter.UserID) || (filter.Before != 0 && o.ID >= filter.Before) ||
+			(filter.Status != "" && o.Status != filter.Status) || (filter.OrgID != "" && o.OrgID != filter.OrgID) {
+			continue
+		}
+		if o.CreatedAt.Before(filter.CreatedFrom) || (!filter.CreatedTo.IsZero() && !o.CreatedAt.Before(filter.CreatedTo)) {
+			continue
+		}
+		matches := true
+		for key, value := range filter.Metadata {
+			if v, ok := o.Metadata[key]; !ok || v != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			orders = append(orders, o)
+		}
+	}
+	r.mu.RUnlock()
+
+	slices.SortFunc(orders, func(a, b Order) int { return b.ID - a.ID })
+	if filter.Limit > 0 {
+		orders = orders[:min(filter.Limit, len(orders))]
+	}
+	for i := range orders {
+		if err := fn(&orders[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListOrders finds orders by metadata, e.g.
+// GET /orders?metadata.campaign=summer&user_id=7. Several metadata pairs
+// must all match. Users only ever see their own orders, admins anyone's,
+// and with org_id an organization's members whose role lets them view
+// its orders all of the organization's.
+// Pages like history: before (an order ID) and limit. created_from and
+// created_to (RFC 3339) narrow it to a period, which is much cheaper than
+// paging through every month.
+//
+// The orders stream out as they're read, as a JSON array or, with
+// Accept: application/x-ndjson, one per line.
+func (s *OrderService) ListOrders(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.orderFilter(w, r, defaultHistoryPage)
+	if !ok {
+		return
+	}
+	s.streamOrders(w, r, filter)
+}
+
+// ExportOrders streams every order matching the same filters as
+// ListOrders, e.g. to load them into a warehouse. There is no page size;
+// before and created_from/created_to still narrow it.
+func (s *OrderService) ExportOrders(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.orderFilter(w, r, 0)
+	if !ok {
+		return
+	}
+	s.streamOrders(w, r, filter)
+}
+
+// orderFilter reads the filters of GET /orders, answering for bad ones.
+// A limit of 0 lists everything.
+func (s *OrderService) orderFilter(w http.ResponseWriter, r *http.Request, limit int) (OrderFilter, bool) {
+	loc := i18n.FromContext(r.Context())
+	q := r.URL.Query()
+	filter := OrderFilter{Limit: limit}
+	var err error
+	for param, values := range q {
+		key, ok := strings.CutPrefix(param, "metadata.")
+		if !ok {
+			continue
+		}
+		if filter.Metadata == nil {
+			filter.Metadata = make(map[string]string)
+		}
+		filter.Metadata[key] = values[0]
+	}
+	if err := validateMetadata(filter.Metadata); err != nil {
+		http.Error(w, loc.Text(err), http.StatusBadRequest)
+		return filter, false
+	}
+	if v := q.Get("user_id"); v != "" {
+		if filter.UserID, err = strconv.Atoi(v); err != nil || filter.UserID <= 0 {
+			http.Error(w, "invalid user_id", http.StatusBadRequest)
+			return filter, false
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		if filter.Before, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return filter, false
+		}
+	}
+	for param, bound := range map[string]*time.Time{"created_from": &filter.CreatedFrom, "created_to": &filter.CreatedTo} {
+		if v := q.Get(param); v != "" {
+			if *bound, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "invalid "+param, http.StatusBadRequest)
+				return filter, false
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" && limit > 0 {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.Limit = min(filter.Limit, maxHistoryPage)
+	}
+
+	filter.OrgID = q.Get("org_id")
+	if filter.OrgID != "" {
+		if !s.orgAllows(r, filter.OrgID, permViewOrders) {
+			i18n.Error(w, r, http.StatusForbidden, "order.org_forbidden")
+			return filter, false
+		}
+		return filter, true
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok && !p.HasRole("admin") {
+		subject, err := strconv.Atoi(p.Subject)
+		if err != nil || (filter.UserID != 0 && filter.UserID != subject) {
+			i18n.Error(w, r, http.StatusForbidden, "order.history_forbidden")
+			return filter, false
+		}
+		filter.UserID = subject
+	}
+	return filter, true
+}
+
+// streamOrders writes the orders matching filter as they come off the
+// cursor. Unless fields picks some, each order writes itself out;
+// encoding them with reflection dominated the cost of a listing.
+func (s *OrderService) streamOrders(w http.ResponseWriter, r *http.Request, filter OrderFilter) {
+	names := fields.Requested(r)
+	w.Header().Add("Vary", fields.Header)
+	stream := jsonenc.NewStream(w, r, streamFlushInterval)
+	err := s.repo.EachOrder(r.Context(), filter, func(o *Order) error {
+		s.withLinks(o)
+		if len(names) == 0 {
+			return stream.Item(o.AppendJSON)
+		}
+		b, err := json.Marshal(fields.Project(o, names))
+		if err != nil {
+			return err
+		}
+		return stream.Item(func(buf []byte) []byte { return append(buf, b...) })
+	})
+	if err == nil {
+		err = stream.Close()
+	}
+	switch {
+	case err == nil:
+	case !stream.Started():
+		dbretry.Error(w, err)
+	case r.Context().Err() == nil:
+		log.Printf("list orders: %v", err)
+		stream.Abort()
+	}
+}
@@ -0,0 +1,18 @@
+// order-service/migrations.go
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Schema owned by order-service; its migrations may not touch any other
+const schema = "orders"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func migrations() fs.FS {
+	sub, _ := fs.Sub(migrationFiles, "migrations")
+	return sub
+}
@@ -0,0 +1,13 @@
+-- user_id refers to user-service; there is deliberately no foreign key
+-- across service boundaries.
+CREATE TABLE IF NOT EXISTS orders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    product TEXT NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    amount NUMERIC(12, 2) NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id);
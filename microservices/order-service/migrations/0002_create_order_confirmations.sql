@@ -0,0 +1,9 @@
+-- The confirmation a customer received, frozen when the order completed so
+-- later edits to users or prices can't rewrite history. Rows are only ever
+-- inserted.
+CREATE TABLE IF NOT EXISTS order_confirmations (
+    order_id INTEGER PRIMARY KEY REFERENCES orders (id),
+    user_id INTEGER NOT NULL,
+    document JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,3 @@
+-- The payment an order waits on while the customer confirms it (3-D
+-- Secure); payment_id refers to payment-service.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_id INTEGER;
@@ -0,0 +1,22 @@
+-- Recurring orders. user_id refers to user-service and payment_method_id
+-- to payment-service; neither has a foreign key across services.
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    product TEXT NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    amount NUMERIC(12, 2) NOT NULL,
+    billing_interval TEXT NOT NULL,
+    interval_count INTEGER NOT NULL DEFAULT 1,
+    payment_method_id BIGINT,
+    status TEXT NOT NULL DEFAULT 'active',
+    next_run_at TIMESTAMPTZ NOT NULL,
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    last_order_id INTEGER,
+    canceled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS subscriptions_user_id_idx ON subscriptions (user_id);
+CREATE INDEX IF NOT EXISTS subscriptions_due_idx ON subscriptions (next_run_at)
+    WHERE status IN ('active', 'past_due');
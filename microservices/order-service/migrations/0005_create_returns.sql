@@ -0,0 +1,21 @@
+-- Return requests (RMAs) for completed orders. Approved returns are
+-- refunded through payment-service; the label comes from shipping-service.
+CREATE TABLE IF NOT EXISTS returns (
+    id BIGSERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders (id),
+    user_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'requested',
+    refund_amount NUMERIC(12, 2) NOT NULL,
+    payment_id INTEGER NOT NULL,
+    resolution_note TEXT NOT NULL DEFAULT '',
+    tracking_number TEXT,
+    label_url TEXT,
+    refunded_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS returns_order_id_idx ON returns (order_id);
+CREATE INDEX IF NOT EXISTS returns_user_id_idx ON returns (user_id);
@@ -0,0 +1,5 @@
+-- Clients' own key/value references on an order. The GIN index serves
+-- containment (@>) lookups by key and value.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS orders_metadata_idx ON orders USING GIN (metadata jsonb_path_ops);
@@ -0,0 +1,8 @@
+-- Clients may give an order their own ID, unique within their tenant. It
+-- makes retried or re-synced creates land on the same order.
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS external_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS orders_tenant_external_id_idx ON orders (tenant, external_id)
+    WHERE external_id IS NOT NULL;
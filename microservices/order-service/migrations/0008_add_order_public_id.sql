@@ -0,0 +1,6 @@
+-- Orders get a random public ID for the API in place of the serial key,
+-- which leaks volume. Existing orders are given one by the default; the
+-- numeric ID keeps working alongside while clients move over.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS public_id UUID NOT NULL DEFAULT gen_random_uuid();
+
+CREATE UNIQUE INDEX IF NOT EXISTS orders_public_id_idx ON orders (public_id);
@@ -0,0 +1,12 @@
+-- Metered usage per tenant, rolled up by the hour. reported is how much of
+-- quantity has gone out to billing in billing.usage_reported events.
+CREATE TABLE IF NOT EXISTS usage_hourly (
+    tenant TEXT NOT NULL,
+    metric TEXT NOT NULL,
+    hour TIMESTAMPTZ NOT NULL,
+    quantity NUMERIC(14, 2) NOT NULL DEFAULT 0,
+    reported NUMERIC(14, 2) NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant, metric, hour)
+);
+
+CREATE INDEX IF NOT EXISTS usage_hourly_unreported_idx ON usage_hourly (hour) WHERE quantity <> reported;
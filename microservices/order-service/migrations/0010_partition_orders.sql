@@ -0,0 +1,63 @@
+-- Orders are range partitioned by the month they were created in, so
+-- queries bounded by created_at only touch the months they need and old
+-- months can later be detached whole. The existing table becomes the
+-- partition for everything up to the end of the current month; the
+-- partition maintainer creates the months after that ahead of time.
+--
+-- Unique keys of a partitioned table must include the partition key, so:
+-- the primary key becomes (id, created_at), with ids still from the one
+-- sequence; external IDs are kept unique per tenant in order_external_ids;
+-- public IDs, random UUIDs, are unique within their partition; and
+-- order_confirmations and returns lose their foreign keys to orders.
+-- Order events aren't kept here but on the event bus, so there is no
+-- events table to partition alongside.
+CREATE TABLE IF NOT EXISTS order_external_ids (
+    tenant TEXT NOT NULL,
+    external_id TEXT NOT NULL,
+    order_id INTEGER NOT NULL,
+    PRIMARY KEY (tenant, external_id)
+);
+
+DO $$
+DECLARE
+    -- Months are UTC months, as the maintainer reckons them
+    next_month TIMESTAMPTZ := (date_trunc('month', now() AT TIME ZONE 'UTC') + interval '1 month') AT TIME ZONE 'UTC';
+BEGIN
+    IF (SELECT relkind FROM pg_catalog.pg_class WHERE oid = 'orders'::regclass) = 'p' THEN
+        RETURN;
+    END IF;
+
+    ALTER TABLE order_confirmations DROP CONSTRAINT IF EXISTS order_confirmations_order_id_fkey;
+    ALTER TABLE returns DROP CONSTRAINT IF EXISTS returns_order_id_fkey;
+
+    INSERT INTO order_external_ids (tenant, external_id, order_id)
+        SELECT tenant, external_id, id FROM orders WHERE external_id IS NOT NULL
+        ON CONFLICT DO NOTHING;
+
+    ALTER TABLE orders RENAME TO orders_until_partitioning;
+    ALTER INDEX orders_user_id_idx RENAME TO orders_until_partitioning_user_id_idx;
+    ALTER INDEX orders_metadata_idx RENAME TO orders_until_partitioning_metadata_idx;
+    ALTER INDEX orders_tenant_external_id_idx RENAME TO orders_until_partitioning_tenant_external_id_idx;
+    ALTER INDEX orders_public_id_idx RENAME TO orders_until_partitioning_public_id_idx;
+
+    CREATE TABLE orders (LIKE orders_until_partitioning INCLUDING DEFAULTS)
+        PARTITION BY RANGE (created_at);
+    ALTER TABLE orders ADD PRIMARY KEY (id, created_at);
+    ALTER SEQUENCE orders_id_seq OWNED BY orders.id;
+    CREATE INDEX orders_user_id_idx ON orders (user_id);
+    CREATE INDEX orders_metadata_idx ON orders USING GIN (metadata jsonb_path_ops);
+    CREATE INDEX orders_public_id_idx ON orders (public_id);
+    CREATE INDEX orders_created_at_idx ON orders (created_at);
+
+    EXECUTE format('ALTER TABLE orders ATTACH PARTITION orders_until_partitioning
+                    FOR VALUES FROM (MINVALUE) TO (%L)', next_month);
+
+    -- A few months ahead, so orders can be taken before the maintainer runs
+    FOR i IN 0..2 LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF orders FOR VALUES FROM (%L) TO (%L)',
+            to_char((next_month + i * interval '1 month') AT TIME ZONE 'UTC', '"orders_y"YYYY"m"MM'),
+            next_month + i * interval '1 month',
+            next_month + (i + 1) * interval '1 month');
+    END LOOP;
+END
+$$;
@@ -0,0 +1,6 @@
+-- Where the buyer was when they ordered, as the gateway's GeoIP database
+-- placed them: an ISO country and subdivision code, for fraud checks and
+-- tax reporting. Orders from before are of unknown location.
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
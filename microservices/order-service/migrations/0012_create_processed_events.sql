@@ -0,0 +1,11 @@
+-- Events projections have applied, so a redelivered one is applied once.
+-- Rows go once the broker can no longer deliver their event again.
+CREATE TABLE IF NOT EXISTS processed_events (
+    projection TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (projection, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS processed_events_processed_at_idx ON processed_events (processed_at);
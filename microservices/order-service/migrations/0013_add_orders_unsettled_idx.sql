@@ -0,0 +1,4 @@
+-- Orders checkout hasn't settled, for the stuck-workflow watchdog to find
+-- without reading every order.
+CREATE INDEX IF NOT EXISTS orders_unsettled_idx ON orders (created_at)
+    WHERE status IN ('pending', 'awaiting_confirmation');
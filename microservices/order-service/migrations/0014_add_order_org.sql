@@ -0,0 +1,5 @@
+-- The organization an order was placed for, '' for personal orders; its
+-- members list the organization's orders by it.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS org_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS orders_org_id_idx ON orders (org_id, id) WHERE org_id <> '';
@@ -0,0 +1,30 @@
+-- Imports of CSV or NDJSON files run in the background; each keeps its
+-- progress and what became of every row, for the error report.
+CREATE TABLE IF NOT EXISTS order_imports (
+    id TEXT PRIMARY KEY,
+    tenant TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    format TEXT NOT NULL,
+    file_id TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    total INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    imported INTEGER NOT NULL DEFAULT 0,
+    skipped INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS order_import_rows (
+    import_id TEXT NOT NULL REFERENCES order_imports (id) ON DELETE CASCADE,
+    row INTEGER NOT NULL,
+    external_id TEXT NOT NULL DEFAULT '',
+    outcome TEXT NOT NULL,
+    order_id INTEGER,
+    public_id TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (import_id, row)
+);
@@ -0,0 +1,14 @@
+-- Each day's completed orders go to the ERP as one batch; see platform/erp.
+CREATE TABLE IF NOT EXISTS order_erp_exports (
+    kind TEXT NOT NULL,
+    day DATE NOT NULL,
+    status TEXT NOT NULL,
+    records INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ,
+    exported_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (kind, day)
+);
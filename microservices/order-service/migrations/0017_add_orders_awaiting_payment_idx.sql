@@ -0,0 +1,4 @@
+-- Orders taken while payment-service was down, for the retry loop and the
+-- watchdog to find without reading every order.
+CREATE INDEX IF NOT EXISTS orders_awaiting_payment_idx ON orders (created_at)
+    WHERE status = 'awaiting_payment';
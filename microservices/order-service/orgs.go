@@ -0,0 +1,130 @@
+// order-service/orgs.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"platform/codec"
+	"platform/i18n"
+	"platform/middleware"
+)
+
+// What an organization's members may do with its orders, as user-service
+// grants them by role
+const (
+	permPlaceOrders  = "place_orders"
+	permViewOrders   = "view_orders"
+	permManageOrders = "manage_orders"
+)
+
+// orgMember is whom a membership is cached for
+type orgMember struct {
+	orgID  string
+	userID int
+}
+
+// OrgMembership is a user's role in an organization and what it allows;
+// a user outside it has no permissions
+type OrgMembership struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// orgAllows reports whether the caller may do permission with orgID's
+// orders. Memberships are reused for summaryTTL, so a revoked role lasts
+// at most that long; when user-service can't say, the answer is no.
+func (s *OrderService) orgAllows(r *http.Request, orgID, permission string) bool {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	if !ok {
+		return true
+	}
+	userID, err := strconv.Atoi(p.Subject)
+	if err != nil || orgID == "" {
+		return false
+	}
+	m, err := s.orgMembership(r.Context(), orgID, userID)
+	if err != nil {
+		log.Printf("org %s: membership of user %d: %v", orgID, userID, err)
+		return false
+	}
+	return slices.Contains(m.Permissions, permission)
+}
+
+func (s *OrderService) orgMembership(ctx context.Context, orgID string, userID int) (*OrgMembership, error) {
+	return s.memberships.get(orgMember{orgID, userID}, func() (*OrgMembership, error) {
+		return s.lookupMembership(ctx, orgID, userID)
+	})
+}
+
+// lookupMembership asks user-service as an admin, since members only see
+// their own organizations
+func (s *OrderService) lookupMembership(ctx context.Context, orgID string, userID int) (*OrgMembership, error) {
+	u := fmt.Sprintf("%s/orgs/%s/members/%d", s.userServiceURL, url.PathEscape(orgID), userID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, "user-service", time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Not a member, or no such organization
+	if resp.StatusCode == http.StatusNotFound {
+		return &OrgMembership{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user-service answered %d", resp.StatusCode)
+	}
+	var m OrgMembership
+	if err := codec.DecodeResponse(resp, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// canSee reports whether the caller may see order: their own, any for
+// admins, and their organization's if their role lets them view its orders
+func (s *OrderService) canSee(r *http.Request, order *Order) bool {
+	return allowed(r, order.UserID) || (order.OrgID != "" && s.orgAllows(r, order.OrgID, permViewOrders))
+}
+
+// canManage is canSee for changing an order
+func (s *OrderService) canManage(r *http.Request, order *Order) bool {
+	return allowed(r, order.UserID) || (order.OrgID != "" && s.orgAllows(r, order.OrgID, permManageOrders))
+}
+
+// checkOrgOrder refuses an order placed for an organization the buyer
+// can't order for. Admins and integrators place orders for others, so the
+// buyer's membership counts, not the caller's.
+func (s *OrderService) checkOrgOrder(ctx context.Context, order *Order) error {
+	if order.OrgID == "" {
+		return nil
+	}
+	m, err := s.orgMembership(ctx, order.OrgID, order.UserID)
+	if err != nil {
+		return i18n.Wrap(err, "order.user_service_unavailable")
+	}
+	if !slices.Contains(m.Permissions, permPlaceOrders) {
+		return errOrgForbidden
+	}
+	return nil
+}
+
+var errOrgForbidden = i18n.NewError("order.org_order_forbidden")
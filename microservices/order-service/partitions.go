@@ -0,0 +1,82 @@
+// order-service/partitions.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+)
+
+// orderPartition names the partition of orders holding month's orders
+func orderPartition(month time.Time) string {
+	return fmt.Sprintf("orders_y%04dm%02d", month.Year(), int(month.Month()))
+}
+
+// EnsureOrderPartitions creates the monthly partitions of orders from the
+// month of now through ahead months after it, returning the ones it
+// created. Months already covered, by name or by the partition orders had
+// before partitioning, are left alone.
+func (r *PostgresOrderRepository) EnsureOrderPartitions(ctx context.Context, now time.Time, ahead int) ([]string, error) {
+	now = now.UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var created []string
+	for range ahead + 1 {
+		next := month.AddDate(0, 1, 0)
+		name := orderPartition(month)
+		var exists bool
+		if err := r.db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+			return created, err
+		}
+		if !exists {
+			// DDL takes no parameters; the name and bounds are our own
+			_, err := r.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF orders
+              FOR VALUES FROM ('%s') TO ('%s')`, name, month.Format(time.RFC3339), next.Format(time.RFC3339)))
+			switch {
+			case dbretry.SQLState(err) == "42P17": // overlaps an existing partition
+			case err != nil:
+				return created, fmt.Errorf("partition %s: %w", name, err)
+			default:
+				created = append(created, name)
+			}
+		}
+		month = next
+	}
+	return created, nil
+}
+
+// PartitionMaintainer keeps orders partitioned ahead of time, so an order
+// never arrives for a month without a partition
+type PartitionMaintainer struct {
+	repo  *PostgresOrderRepository
+	ahead int
+	clock clock.Clock
+}
+
+func NewPartitionMaintainer(repo *PostgresOrderRepository, ahead int) *PartitionMaintainer {
+	return &PartitionMaintainer{repo: repo, ahead: ahead, clock: clock.System}
+}
+
+// Run ensures the partitions now and every interval until ctx is done
+func (m *PartitionMaintainer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		created, err := m.repo.EnsureOrderPartitions(ctx, m.clock.Now(), m.ahead)
+		if err != nil {
+			log.Printf("ensure order partitions: %v", err)
+		}
+		for _, name := range created {
+			log.Printf("created order partition %s", name)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// order-service/publicid.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"platform/publicid"
+	"platform/router"
+)
+
+func (r *PostgresOrderRepository) OrderIDByPublicID(ctx context.Context, publicID string) (int, error) {
+	var id int
+	err := r.db.QueryRowContext(ctx, `SELECT id FROM orders WHERE public_id = $1`, publicID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (r *MemoryOrderRepository) OrderIDByPublicID(ctx context.Context, publicID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	publicID = strings.ToLower(publicID)
+	for id, o := range r.orders {
+		if o.PublicID == publicID {
+			return id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// orderIDParam reads the {id} path parameter, which is either an order's
+// public ID or, until clients have moved over, its numeric one. Anything
+// else is ErrNotFound.
+func (s *OrderService) orderIDParam(r *http.Request) (int, error) {
+	param := router.Param(r, "id")
+	if publicid.Valid(param) {
+		return s.repo.OrderIDByPublicID(r.Context(), param)
+	}
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
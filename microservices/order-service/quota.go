@@ -0,0 +1,44 @@
+// order-service/quota.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"platform/i18n"
+	"platform/quota"
+)
+
+// chargeOrder counts order against its buyer's orders per month, answering
+// 429 itself when the plan's limit is reached. release gives the order back
+// when it isn't created after all. Counter store failures let the order
+// through.
+func (s *OrderService) chargeOrder(w http.ResponseWriter, r *http.Request, order *Order) (release func(), ok bool) {
+	release = func() {}
+	if s.quotas == nil {
+		return release, true
+	}
+	ctx := r.Context()
+	subject := quota.Subject(order.Tenant, strconv.Itoa(order.UserID))
+	usage, err := s.quotas.Use(ctx, subject, "orders", 1)
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		msg := i18n.FromContext(ctx).T("order.quota_exceeded", exceeded.Limit, exceeded.Reset.Format(time.RFC3339))
+		quota.WriteExceeded(w, exceeded, msg)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("quota orders for %s: %v", subject, err)
+		return release, true
+	}
+	quota.SetHeaders(w, usage)
+	return func() {
+		if err := s.quotas.Release(context.WithoutCancel(ctx), subject, "orders", 1); err != nil {
+			log.Printf("release quota orders for %s: %v", subject, err)
+		}
+	}, true
+}
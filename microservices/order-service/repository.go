@@ -0,0 +1,347 @@
+// order-service/repository.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+
+	"platform/dbretry"
+	"platform/migrate"
+	"platform/projection"
+	"platform/publicid"
+	"platform/startup"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// errStatusChanged means the order left the expected status meanwhile
+var errStatusChanged = errors.New("order status changed")
+
+// OrderRepository hides the storage backend from the handlers
+type OrderRepository interface {
+	Create(ctx context.Context, order *Order) error
+	Get(ctx context.Context, id int) (*Order, error)
+	// UserOrders pages through a user's orders, newest first, starting
+	// below the order ID before (0 for the newest)
+	UserOrders(ctx context.Context, userID, before, limit int) ([]Order, error)
+	// EachOrder calls fn with each order matching filter, newest first,
+	// stopping at the first error
+	EachOrder(ctx context.Context, filter OrderFilter, fn func(*Order) error) error
+	UpdateStatus(ctx context.Context, id int, status string) error
+	// RecordPayment sets an order's status along with the payment that
+	// decided it
+	RecordPayment(ctx context.Context, id, paymentID int, status string) error
+	// Transition moves an order from one status to another, failing with
+	// errStatusChanged if it is no longer in from
+	Transition(ctx context.Context, id int, from, to string) error
+	// SaveConfirmation stores an order's confirmation once; later calls
+	// for the same order leave the first one in place
+	SaveConfirmation(ctx context.Context, c *Confirmation) error
+	Confirmation(ctx context.Context, orderID int) (*Confirmation, error)
+	// OrderIDByPublicID maps an order's public ID to its numeric one
+	OrderIDByPublicID(ctx context.Context, publicID string) (int, error)
+	// ByExternalID finds an order by the client's own ID for it
+	ByExternalID(ctx context.Context, tenant, externalID string) (*Order, error)
+	// MergeUser moves everything of user from, a claimed guest or a
+	// merged-away account, to user to
+	MergeUser(ctx context.Context, from, to int) error
+}
+
+// Repository is everything order-service stores
+type Repository interface {
+	OrderRepository
+	ImportRepository
+	SubscriptionRepository
+	ReturnRepository
+	UsageRepository
+}
+
+// openRepository selects the backend: "postgres" (default) for production,
+// "memory" for running locally without any external dependencies. The
+// database dependency is readied by startup, which retries it until it is
+// up, and round-trips a query in self-tests; memory has none.
+func openRepository(storage, dbURL string) (Repository, *startup.Dependency, error) {
+	switch storage {
+	case "", "postgres":
+		db, err := dbretry.Open(dbURL, schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The database may still be coming up; startup retries this
+		database := &startup.Dependency{Name: "database", SelfTest: startup.SQL(db.DB), Check: func(ctx context.Context) error {
+			if err := db.PingContext(ctx); err != nil {
+				return err
+			}
+			return migrate.Run(ctx, db.DB, migrations(), schema)
+		}}
+		return &PostgresOrderRepository{db: db}, database, nil
+	case "memory":
+		return NewMemoryOrderRepository(), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+type PostgresOrderRepository struct {
+	db *dbretry.DB
+}
+
+// Stats exposes connection pool statistics for load shedding
+func (r *PostgresOrderRepository) Stats() sql.DBStats {
+	return r.db.Stats()
+}
+
+func (r *PostgresOrderRepository) Create(ctx context.Context, order *Order) error {
+	metadata, err := metadataJSON(order.Metadata)
+	if err != nil {
+		return err
+	}
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `INSERT INTO orders (user_id, product, quantity, amount, status, created_at,
+                  metadata, tenant, external_id, country, region, org_id)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11, $12)
+              RETURNING id, public_id`,
+			order.UserID, order.Product, order.Quantity,
+			order.Amount, order.Status, order.CreatedAt, metadata,
+			order.Tenant, order.ExternalID, order.Country, order.Region, order.OrgID).Scan(&order.ID, &order.PublicID)
+		if err != nil || order.ExternalID == "" {
+			return err
+		}
+		// orders is partitioned, so external IDs are kept unique beside it;
+		// a concurrent create of the same one waits here for the first
+		res, err := tx.ExecContext(ctx, `INSERT INTO order_external_ids (tenant, external_id, order_id)
+              VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, order.Tenant, order.ExternalID, order.ID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return errExternalIDTaken
+		}
+		return nil
+	})
+}
+
+// orderColumns are scanned by scanOrder
+const orderColumns = `id, user_id, product, quantity, amount, status, created_at,
+              COALESCE(payment_id, 0), metadata, tenant, COALESCE(external_id, ''),
+              public_id, country, region, org_id`
+
+func scanOrder(scan func(...any) error, o *Order) error {
+	var metadata []byte
+	if err := scan(&o.ID, &o.UserID, &o.Product, &o.Quantity, &o.Amount, &o.Status,
+		&o.CreatedAt, &o.PaymentID, &metadata, &o.Tenant, &o.ExternalID,
+		&o.PublicID, &o.Country, &o.Region, &o.OrgID); err != nil {
+		return err
+	}
+	o.Metadata = nil
+	if err := json.Unmarshal(metadata, &o.Metadata); err != nil {
+		return err
+	}
+	if len(o.Metadata) == 0 {
+		o.Metadata = nil
+	}
+	return nil
+}
+
+func (r *PostgresOrderRepository) Get(ctx context.Context, id int) (*Order, error) {
+	var order Order
+	err := scanOrder(r.db.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = $1`, id).Scan, &order)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (r *PostgresOrderRepository) RecordPayment(ctx context.Context, id, paymentID int, status string) error {
+	res, err := r.db.ExecContext(ctx, `UPDATE orders SET status = $3, payment_id = $2 WHERE id = $1`,
+		id, paymentID, status)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresOrderRepository) Transition(ctx context.Context, id int, from, to string) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE orders SET status = $1 WHERE id = $2 AND status = $3", to, id, from)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errStatusChanged
+	}
+	return nil
+}
+
+func (r *PostgresOrderRepository) UpdateStatus(ctx context.Context, id int, status string) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE orders SET status = $1 WHERE id = $2", status, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresOrderRepository) SaveConfirmation(ctx context.Context, c *Confirmation) error {
+	doc, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO order_confirmations (order_id, user_id, document)
+              VALUES ($1, $2, $3) ON CONFLICT (order_id) DO NOTHING`,
+		c.OrderID, c.Customer.ID, doc)
+	return err
+}
+
+func (r *PostgresOrderRepository) Confirmation(ctx context.Context, orderID int) (*Confirmation, error) {
+	var doc []byte
+	err := r.db.QueryRowContext(ctx, `SELECT document FROM order_confirmations WHERE order_id = $1`, orderID).Scan(&doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Confirmation
+	if err := json.Unmarshal(doc, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// MemoryOrderRepository keeps orders in process memory
+type MemoryOrderRepository struct {
+	mu     sync.RWMutex
+	nextID int
+	orders map[int]Order
+	// confirmations are kept encoded, like the JSONB column
+	confirmations map[int][]byte
+	subscriptions []*Subscription
+	returns       []*Return
+	usage         []*usageRow
+	metered       projection.Seen
+	importJobs    map[string]*ImportJob
+	importRows    map[string][]ImportRow
+}
+
+func NewMemoryOrderRepository() *MemoryOrderRepository {
+	return &MemoryOrderRepository{
+		nextID:        1,
+		orders:        make(map[int]Order),
+		confirmations: make(map[int][]byte),
+		importJobs:    make(map[string]*ImportJob),
+		importRows:    make(map[string][]ImportRow),
+	}
+}
+
+func (r *MemoryOrderRepository) Create(ctx context.Context, order *Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if order.ExternalID != "" {
+		for _, o := range r.orders {
+			if o.Tenant == order.Tenant && o.ExternalID == order.ExternalID {
+				return errExternalIDTaken
+			}
+		}
+	}
+	order.ID = r.nextID
+	r.nextID++
+	order.PublicID = publicid.New()
+	stored := *order
+	stored.GuestClaimToken = ""
+	stored.Metadata = maps.Clone(order.Metadata)
+	r.orders[order.ID] = stored
+	return nil
+}
+
+func (r *MemoryOrderRepository) Get(ctx context.Context, id int) (*Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	order, ok := r.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &order, nil
+}
+
+func (r *MemoryOrderRepository) RecordPayment(ctx context.Context, id, paymentID int, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[id]
+	if !ok {
+		return ErrNotFound
+	}
+	order.Status = status
+	order.PaymentID = paymentID
+	r.orders[id] = order
+	return nil
+}
+
+func (r *MemoryOrderRepository) Transition(ctx context.Context, id int, from, to string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[id]
+	if !ok || order.Status != from {
+		return errStatusChanged
+	}
+	order.Status = to
+	r.orders[id] = order
+	return nil
+}
+
+func (r *MemoryOrderRepository) UpdateStatus(ctx context.Context, id int, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[id]
+	if !ok {
+		return ErrNotFound
+	}
+	order.Status = status
+	r.orders[id] = order
+	return nil
+}
+
+func (r *MemoryOrderRepository) SaveConfirmation(ctx context.Context, c *Confirmation) error {
+	doc, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.confirmations[c.OrderID]; !ok {
+		r.confirmations[c.OrderID] = doc
+	}
+	return nil
+}
+
+func (r *MemoryOrderRepository) Confirmation(ctx context.Context, orderID int) (*Confirmation, error) {
+	r.mu.RLock()
+	doc, ok := r.confirmations[orderID]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var c Confirmation
+	if err := json.Unmarshal(doc, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
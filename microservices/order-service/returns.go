@@ -0,0 +1,587 @@
+// order-service/returns.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/fields"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Return states. A customer requests a return, support approves or rejects
+// it, and approval refunds it; only requested returns can be canceled.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnCanceled  = "canceled"
+	ReturnRefunded  = "refunded"
+)
+
+// returnTransitions lists the states each state may move to
+var returnTransitions = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected, ReturnCanceled},
+	ReturnApproved:  {ReturnRefunded},
+}
+
+// defaultReturnWindow is how long after an order it may be returned
+const defaultReturnWindow = 30 * 24 * time.Hour
+
+var (
+	errReturnState     = errors.New("return is not in a state that allows this")
+	errNotReturnable   = i18n.NewError("return.not_eligible")
+	errReturnQuantity  = i18n.NewError("return.quantity_exceeded")
+	errReturnForbidden = errors.New("not the caller's order")
+)
+
+// Return (RMA) sends back some of an order's items for a refund of their
+// share of the order. PaymentID is the order's payment, refunded on approval.
+type Return struct {
+	ID             int64      `json:"id"`
+	OrderID        int        `json:"order_id"`
+	UserID         int        `json:"user_id"`
+	Quantity       int        `json:"quantity"`
+	Reason         string     `json:"reason,omitempty"`
+	Status         string     `json:"status"`
+	RefundAmount   float64    `json:"refund_amount"`
+	PaymentID      int        `json:"payment_id"`
+	ResolutionNote string     `json:"resolution_note,omitempty"`
+	TrackingNumber string     `json:"tracking_number,omitempty"`
+	LabelURL       string     `json:"label_url,omitempty"`
+	RefundedAt     *time.Time `json:"refunded_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (ret *Return) transition(to string, now time.Time) error {
+	if !slices.Contains(returnTransitions[ret.Status], to) {
+		return errReturnState
+	}
+	ret.Status = to
+	ret.UpdatedAt = now
+	return nil
+}
+
+// active reports whether the return still claims its items
+func (ret *Return) active() bool {
+	return ret.Status != ReturnRejected && ret.Status != ReturnCanceled
+}
+
+// ReturnRepository stores returns
+type ReturnRepository interface {
+	// CreateReturn locks the order, passes it to check with its active
+	// returns and stores ret unless check fails
+	CreateReturn(ctx context.Context, ret *Return, check func(order *Order, active []Return) error) error
+	Return(ctx context.Context, id int64) (*Return, error)
+	// Returns lists a user's returns, or everyone's for 0, optionally in
+	// one status
+	Returns(ctx context.Context, userID int, status string) ([]Return, error)
+	// UpdateReturn locks the return, lets fn change it and saves the
+	// result unless fn fails
+	UpdateReturn(ctx context.Context, id int64, fn func(*Return) error) (*Return, error)
+}
+
+const returnColumns = `id, order_id, user_id, quantity, reason, status, refund_amount, payment_id, resolution_note,
+              COALESCE(tracking_number, ''), COALESCE(label_url, ''), refunded_at, created_at, updated_at`
+
+func scanReturn(scan func(...any) error, ret *Return) error {
+	var refunded sql.NullTime
+	err := scan(&ret.ID, &ret.OrderID, &ret.UserID, &ret.Quantity, &ret.Reason, &ret.Status, &ret.RefundAmount,
+		&ret.PaymentID, &ret.ResolutionNote, &ret.TrackingNumber, &ret.LabelURL, &refunded, &ret.CreatedAt, &ret.UpdatedAt)
+	if refunded.Valid {
+		ret.RefundedAt = &refunded.Time
+	}
+	return err
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryReturns(ctx context.Context, q querier, query string, args ...any) ([]Return, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var returns []Return
+	for rows.Next() {
+		var ret Return
+		if err := scanReturn(rows.Scan, &ret); err != nil {
+			return nil, err
+		}
+		returns = append(returns, ret)
+	}
+	return returns, rows.Err()
+}
+
+func (r *PostgresOrderRepository) CreateReturn(ctx context.Context, ret *Return, check func(*Order, []Return) error) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var order Order
+		err := scanOrder(tx.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = $1 FOR UPDATE`,
+			ret.OrderID).Scan, &order)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		active, err := queryReturns(ctx, tx, `SELECT `+returnColumns+` FROM returns
+              WHERE order_id = $1 AND status NOT IN ('rejected', 'canceled')`, order.ID)
+		if err != nil {
+			return err
+		}
+		if err := check(&order, active); err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `INSERT INTO returns
+              (order_id, user_id, quantity, reason, status, refund_amount, payment_id, created_at, updated_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8) RETURNING id`,
+			ret.OrderID, ret.UserID, ret.Quantity, ret.Reason, ret.Status, ret.RefundAmount, ret.PaymentID, ret.CreatedAt).
+			Scan(&ret.ID)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrderRepository) Return(ctx context.Context, id int64) (*Return, error) {
+	var ret Return
+	err := scanReturn(r.db.QueryRowContext(ctx, `SELECT `+returnColumns+` FROM returns WHERE id = $1`, id).Scan, &ret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (r *PostgresOrderRepository) Returns(ctx context.Context, userID int, status string) ([]Return, error) {
+	return queryReturns(ctx, r.db, `SELECT `+returnColumns+` FROM returns
+              WHERE ($1 = 0 OR user_id = $1) AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT 500`, userID, status)
+}
+
+func (r *PostgresOrderRepository) UpdateReturn(ctx context.Context, id int64, fn func(*Return) error) (*Return, error) {
+	var updated *Return
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var ret Return
+		err := scanReturn(tx.QueryRowContext(ctx, `SELECT `+returnColumns+` FROM returns WHERE id = $1 FOR UPDATE`, id).Scan, &ret)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&ret); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE returns SET status = $2, resolution_note = $3, tracking_number = NULLIF($4, ''),
+                  label_url = NULLIF($5, ''), refunded_at = $6, updated_at = $7
+              WHERE id = $1`,
+			id, ret.Status, ret.ResolutionNote, ret.TrackingNumber, ret.LabelURL, ret.RefundedAt, ret.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		updated = &ret
+		return nil
+	})
+	return updated, err
+}
+
+func (r *MemoryOrderRepository) CreateReturn(ctx context.Context, ret *Return, check func(*Order, []Return) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[ret.OrderID]
+	if !ok {
+		return ErrNotFound
+	}
+	var active []Return
+	for _, c := range r.returns {
+		if c.OrderID == order.ID && c.active() {
+			active = append(active, *c)
+		}
+	}
+	if err := check(&order, active); err != nil {
+		return err
+	}
+	ret.ID = int64(len(r.returns) + 1)
+	c := *ret
+	r.returns = append(r.returns, &c)
+	return nil
+}
+
+func (r *MemoryOrderRepository) Return(ctx context.Context, id int64) (*Return, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id < 1 || id > int64(len(r.returns)) {
+		return nil, ErrNotFound
+	}
+	c := *r.returns[id-1]
+	return &c, nil
+}
+
+func (r *MemoryOrderRepository) Returns(ctx context.Context, userID int, status string) ([]Return, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var returns []Return
+	for i := len(r.returns) - 1; i >= 0; i-- {
+		if ret := r.returns[i]; (userID == 0 || ret.UserID == userID) && (status == "" || ret.Status == status) {
+			returns = append(returns, *ret)
+		}
+	}
+	return returns, nil
+}
+
+func (r *MemoryOrderRepository) UpdateReturn(ctx context.Context, id int64, fn func(*Return) error) (*Return, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > int64(len(r.returns)) {
+		return nil, ErrNotFound
+	}
+	c := *r.returns[id-1]
+	if err := fn(&c); err != nil {
+		return nil, err
+	}
+	*r.returns[id-1] = c
+	return &c, nil
+}
+
+// ReturnAPI serves /returns. Customers request and cancel returns of their
+// own orders; support and admins see all of them and decide.
+type ReturnAPI struct {
+	repo   ReturnRepository
+	events *events.Emitter
+	clock  clock.Clock
+	// window is how long after an order it may be returned
+	window time.Duration
+	// paymentServiceURL refunds approved returns
+	paymentServiceURL string
+	// shippingServiceURL issues return labels; empty skips them
+	shippingServiceURL string
+}
+
+// staff reports whether the caller handles returns for everyone
+func staff(r *http.Request) bool {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	return !ok || p.HasRole("admin") || p.HasRole("support")
+}
+
+func (a *ReturnAPI) emit(ctx context.Context, event string, ret *Return) {
+	a.events.Emit(ctx, event, fmt.Sprintf("return/%d", ret.ID), ret)
+}
+
+// Create requests a return of quantity items of a completed order
+func (a *ReturnAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var ret Return
+	if err := json.NewDecoder(r.Body).Decode(&ret); err != nil {
+		http.Error(w, i18n.FromContext(r.Context()).Text(err), http.StatusBadRequest)
+		return
+	}
+	if ret.Quantity == 0 {
+		ret.Quantity = 1
+	}
+	if ret.OrderID <= 0 || ret.Quantity < 0 {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "return.invalid")
+		return
+	}
+
+	now := a.clock.Now()
+	ret.Status = ReturnRequested
+	ret.ResolutionNote, ret.TrackingNumber, ret.LabelURL, ret.RefundedAt = "", "", "", nil
+	ret.CreatedAt, ret.UpdatedAt = now, now
+	err := a.repo.CreateReturn(r.Context(), &ret, func(order *Order, active []Return) error {
+		if !allowed(r, order.UserID) {
+			return errReturnForbidden
+		}
+		if order.Status != "completed" || order.PaymentID == 0 || now.Sub(order.CreatedAt) > a.window {
+			return errNotReturnable
+		}
+		left, refunded := order.Quantity, 0.0
+		for _, c := range active {
+			left -= c.Quantity
+			refunded += c.RefundAmount
+		}
+		if ret.Quantity > left {
+			return errReturnQuantity
+		}
+		// The last items take what is left so rounding never over- or
+		// under-refunds the order
+		ret.RefundAmount = roundCents(order.Amount * float64(ret.Quantity) / float64(order.Quantity))
+		if ret.Quantity == left {
+			ret.RefundAmount = roundCents(order.Amount - refunded)
+		}
+		ret.UserID, ret.PaymentID = order.UserID, order.PaymentID
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, errReturnForbidden):
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	case errors.Is(err, errNotReturnable), errors.Is(err, errReturnQuantity):
+		http.Error(w, i18n.FromContext(r.Context()).Text(err), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		dbretry.Error(w, err)
+		return
+	}
+	a.emit(r.Context(), "return.requested", &ret)
+	writeJSON(w, http.StatusCreated, ret)
+}
+
+// List returns the caller's returns; staff may filter by ?user_id= and
+// ?status=, or see everyone's
+func (a *ReturnAPI) List(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			i18n.Error(w, r, http.StatusBadRequest, "return.invalid")
+			return
+		}
+		userID = id
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok && !staff(r) {
+		id, err := strconv.Atoi(p.Subject)
+		if err != nil || (userID != 0 && userID != id) {
+			i18n.Error(w, r, http.StatusForbidden, "return.forbidden")
+			return
+		}
+		userID = id
+	}
+
+	returns, err := a.repo.Returns(r.Context(), userID, r.URL.Query().Get("status"))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if returns == nil {
+		returns = []Return{}
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, returns))
+}
+
+func (a *ReturnAPI) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+	if err != nil {
+		i18n.Error(w, r, http.StatusNotFound, "return.not_found")
+		return
+	}
+	ret, err := a.repo.Return(r.Context(), id)
+	if errors.Is(err, ErrNotFound) || (err == nil && !allowed(r, ret.UserID) && !staff(r)) {
+		i18n.Error(w, r, http.StatusNotFound, "return.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, ret))
+}
+
+type resolution struct {
+	Note string `json:"note"`
+}
+
+// decide moves a return to a new state. Only staff reach approve and
+// reject; customers may cancel their own.
+func (a *ReturnAPI) decide(to, event string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+		if err != nil {
+			i18n.Error(w, r, http.StatusNotFound, "return.not_found")
+			return
+		}
+		var req resolution
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx := r.Context()
+		ret, err := a.repo.UpdateReturn(ctx, id, func(c *Return) error {
+			if !allowed(r, c.UserID) && !staff(r) {
+				return ErrNotFound
+			}
+			if req.Note != "" {
+				c.ResolutionNote = req.Note
+			}
+			return c.transition(to, a.clock.Now())
+		})
+		if !a.writeError(w, r, err) {
+			return
+		}
+		a.emit(ctx, event, ret)
+
+		if to == ReturnApproved {
+			if ret, err = a.settle(ctx, ret); err != nil {
+				http.Error(w, i18n.FromContext(ctx).Text(err), http.StatusBadGateway)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, ret)
+	}
+}
+
+// Refund retries the label and refund of an approved return whose
+// approval could not finish them
+func (a *ReturnAPI) Refund(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+	if err != nil {
+		i18n.Error(w, r, http.StatusNotFound, "return.not_found")
+		return
+	}
+	ctx := r.Context()
+	ret, err := a.repo.Return(ctx, id)
+	if err == nil && ret.Status != ReturnApproved {
+		err = errReturnState
+	}
+	if !a.writeError(w, r, err) {
+		return
+	}
+	if ret, err = a.settle(ctx, ret); err != nil {
+		http.Error(w, i18n.FromContext(ctx).Text(err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// writeError answers for a failed lookup or update, reporting whether
+// there was none
+func (a *ReturnAPI) writeError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrNotFound):
+		i18n.Error(w, r, http.StatusNotFound, "return.not_found")
+	case errors.Is(err, errReturnState):
+		i18n.Error(w, r, http.StatusConflict, "return.invalid_transition")
+	default:
+		dbretry.Error(w, err)
+	}
+	return false
+}
+
+// settle finishes an approved return: it gets the return label, then
+// refunds the return's share of the order. Each step is saved as it
+// succeeds, so a retry picks up where a failure left off.
+func (a *ReturnAPI) settle(ctx context.Context, ret *Return) (*Return, error) {
+	if ret.LabelURL == "" && a.shippingServiceURL != "" {
+		label, err := a.requestLabel(ctx, ret)
+		if err != nil {
+			return nil, err
+		}
+		ret, err = a.repo.UpdateReturn(ctx, ret.ID, func(c *Return) error {
+			c.TrackingNumber, c.LabelURL = label.TrackingNumber, label.LabelURL
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The refund is made under the return's lock so two retries can't
+	// both pay it out
+	ret, err := a.repo.UpdateReturn(ctx, ret.ID, func(c *Return) error {
+		now := a.clock.Now()
+		if err := c.transition(ReturnRefunded, now); err != nil {
+			return err
+		}
+		if err := a.refund(ctx, c); err != nil {
+			return err
+		}
+		c.RefundedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.emit(ctx, "return.refunded", ret)
+	return ret, nil
+}
+
+type returnLabel struct {
+	TrackingNumber string `json:"tracking_number"`
+	LabelURL       string `json:"label_url"`
+}
+
+// requestLabel asks shipping-service for a prepaid label back to us
+func (a *ReturnAPI) requestLabel(ctx context.Context, ret *Return) (*returnLabel, error) {
+	body, _ := json.Marshal(map[string]any{
+		"return_id": ret.ID,
+		"order_id":  ret.OrderID,
+		"user_id":   ret.UserID,
+		"quantity":  ret.Quantity,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.shippingServiceURL+"/labels", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	middleware.RecordUpstream(ctx, "shipping-service", time.Since(start))
+	if err != nil {
+		return nil, i18n.Wrap(err, "return.label_failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, i18n.Wrap(fmt.Errorf("shipping-service: %s", resp.Status), "return.label_failed")
+	}
+	var label returnLabel
+	if err := json.NewDecoder(resp.Body).Decode(&label); err != nil {
+		return nil, i18n.Wrap(err, "return.label_failed")
+	}
+	return &label, nil
+}
+
+// refund gives the return's amount back on the order's payment
+func (a *ReturnAPI) refund(ctx context.Context, ret *Return) error {
+	body, _ := json.Marshal(map[string]any{"amount": ret.RefundAmount})
+	url := fmt.Sprintf("%s/payments/%d/refunds", a.paymentServiceURL, ret.PaymentID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	middleware.RecordUpstream(ctx, "payment-service", time.Since(start))
+	if err != nil {
+		return i18n.Wrap(err, "return.refund_failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return i18n.Wrap(fmt.Errorf("payment %d: %s", ret.PaymentID, resp.Status), "return.refund_failed")
+	}
+	return nil
+}
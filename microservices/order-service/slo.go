@@ -0,0 +1,292 @@
+// order-service/slo.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/alert"
+	"platform/clock"
+	"platform/middleware"
+)
+
+// Objective describes an availability/latency target for one endpoint,
+// e.g. 99.5% of POST /orders succeed in under 800ms.
+type Objective struct {
+	Name    string        `json:"name"`
+	Method  string        `json:"method"`
+	Path    string        `json:"path"`
+	Target  float64       `json:"target"`
+	Latency time.Duration `json:"latency"`
+}
+
+// BurnWindow pairs a long and a short window: an alert fires only when both
+// burn faster than Threshold, so short blips don't page anyone. It
+// resolves once the short window cools down.
+type BurnWindow struct {
+	Long      time.Duration
+	Short     time.Duration
+	Threshold float64
+	Severity  string
+}
+
+// Multi-window burn rate alerts from the SRE workbook: the fast burn pages,
+// the slow one is a ticket
+var defaultBurnWindows = []BurnWindow{
+	{Long: time.Hour, Short: 5 * time.Minute, Threshold: 14.4, Severity: alert.Critical},
+	{Long: 6 * time.Hour, Short: 30 * time.Minute, Threshold: 6, Severity: alert.Warning},
+}
+
+// SLOAlert is emitted when an objective's error budget burns too fast, and
+// again, Resolved, once it no longer does
+type SLOAlert struct {
+	Objective string    `json:"objective"`
+	Window    string    `json:"window"`
+	Severity  string    `json:"severity"`
+	BurnRate  float64   `json:"burn_rate"`
+	Threshold float64   `json:"threshold"`
+	FiredAt   time.Time `json:"fired_at"`
+	Resolved  bool      `json:"resolved,omitempty"`
+}
+
+type sloBucket struct {
+	minute int64
+	total  int64
+	bad    int64
+}
+
+type sloSeries struct {
+	objective Objective
+	buckets   []sloBucket
+	lastAlert map[string]time.Time
+	// burning are the windows alerted about and not yet resolved
+	burning map[string]bool
+}
+
+// SLOTracker records request outcomes per objective in one-minute buckets
+type SLOTracker struct {
+	mu       sync.Mutex
+	series   []*sloSeries
+	windows  []BurnWindow
+	retain   time.Duration
+	cooldown time.Duration
+	onAlert  func(SLOAlert)
+	clock    clock.Clock
+}
+
+func NewSLOTracker(objectives []Objective, onAlert func(SLOAlert)) *SLOTracker {
+	t := &SLOTracker{
+		windows:  defaultBurnWindows,
+		cooldown: 15 * time.Minute,
+		onAlert:  onAlert,
+		clock:    clock.System,
+	}
+	for _, w := range t.windows {
+		if w.Long > t.retain {
+			t.retain = w.Long
+		}
+	}
+	if t.onAlert == nil {
+		t.onAlert = logSLOAlert
+	}
+
+	buckets := int(t.retain / time.Minute)
+	for _, o := range objectives {
+		t.series = append(t.series, &sloSeries{
+			objective: o,
+			buckets:   make([]sloBucket, buckets),
+			lastAlert: make(map[string]time.Time),
+			burning:   make(map[string]bool),
+		})
+	}
+	return t
+}
+
+func logSLOAlert(a SLOAlert) {
+	alertJSON, _ := json.Marshal(a)
+	log.Printf("SLO alert: %s", alertJSON)
+}
+
+// alertSLO raises SLO alerts with alerts, one problem per objective and
+// window
+func alertSLO(alerts *alert.Alerter) func(SLOAlert) {
+	return func(a SLOAlert) {
+		ctx := context.Background()
+		key := "slo/" + a.Objective + "/" + a.Window
+		if a.Resolved {
+			alerts.Resolve(ctx, key)
+			return
+		}
+		alerts.Alert(ctx, alert.Alert{
+			Key:      key,
+			Severity: a.Severity,
+			Summary:  fmt.Sprintf("%s is burning its error budget %.1fx too fast over %s", a.Objective, a.BurnRate, a.Window),
+			Details: map[string]string{
+				"objective": a.Objective,
+				"window":    a.Window,
+				"burn_rate": strconv.FormatFloat(a.BurnRate, 'f', 2, 64),
+				"threshold": strconv.FormatFloat(a.Threshold, 'f', 2, 64),
+			},
+		})
+	}
+}
+
+// Middleware records the status and latency of requests matching an objective
+func (t *SLOTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		series := t.match(r)
+		if series == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := middleware.NewRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		bad := rec.Status >= 500 || time.Since(start) > series.objective.Latency
+		t.record(series, bad)
+	})
+}
+
+func (t *SLOTracker) match(r *http.Request) *sloSeries {
+	for _, s := range t.series {
+		if s.objective.Method == r.Method && s.objective.Path == r.URL.Path {
+			return s
+		}
+	}
+	return nil
+}
+
+func (t *SLOTracker) record(s *sloSeries, bad bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	minute := now.Unix() / 60
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+
+	t.checkBurn(s, now)
+}
+
+// counts sums the buckets that fall inside the window ending now
+func (t *SLOTracker) counts(s *sloSeries, now time.Time, window time.Duration) (total, bad int64) {
+	current := now.Unix() / 60
+	oldest := current - int64(window/time.Minute) + 1
+	for _, b := range s.buckets {
+		if b.minute >= oldest && b.minute <= current {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	return total, bad
+}
+
+func (t *SLOTracker) burnRate(s *sloSeries, now time.Time, window time.Duration) float64 {
+	total, bad := t.counts(s, now, window)
+	budget := 1 - s.objective.Target
+	if total == 0 || budget <= 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / budget
+}
+
+// checkBurn must be called with t.mu held
+func (t *SLOTracker) checkBurn(s *sloSeries, now time.Time) {
+	for _, w := range t.windows {
+		key := w.Long.String()
+		long := t.burnRate(s, now, w.Long)
+		alert := SLOAlert{
+			Objective: s.objective.Name,
+			Window:    key,
+			Severity:  w.Severity,
+			BurnRate:  long,
+			Threshold: w.Threshold,
+			FiredAt:   now,
+		}
+		if t.burnRate(s, now, w.Short) < w.Threshold {
+			if s.burning[key] {
+				delete(s.burning, key)
+				alert.Resolved = true
+				go t.onAlert(alert)
+			}
+			continue
+		}
+		if long < w.Threshold || now.Sub(s.lastAlert[key]) < t.cooldown {
+			continue
+		}
+		s.lastAlert[key] = now
+		s.burning[key] = true
+		go t.onAlert(alert)
+	}
+}
+
+type sloWindowStatus struct {
+	Window    string  `json:"window"`
+	Total     int64   `json:"total"`
+	Bad       int64   `json:"bad"`
+	ErrorRate float64 `json:"error_rate"`
+	BurnRate  float64 `json:"burn_rate"`
+}
+
+type sloStatus struct {
+	Objective       Objective         `json:"objective"`
+	BudgetRemaining float64           `json:"budget_remaining"`
+	Windows         []sloWindowStatus `json:"windows"`
+}
+
+// Status reports every objective's rolling window counts and burn rates
+func (t *SLOTracker) Status() []sloStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	var windows []time.Duration
+	for _, w := range t.windows {
+		windows = append(windows, w.Short, w.Long)
+	}
+
+	statuses := make([]sloStatus, 0, len(t.series))
+	for _, s := range t.series {
+		st := sloStatus{Objective: s.objective, BudgetRemaining: 1}
+		for _, window := range windows {
+			total, bad := t.counts(s, now, window)
+			ws := sloWindowStatus{Window: window.String(), Total: total, Bad: bad}
+			if total > 0 {
+				ws.ErrorRate = float64(bad) / float64(total)
+			}
+			ws.BurnRate = t.burnRate(s, now, window)
+			st.Windows = append(st.Windows, ws)
+		}
+
+		// Budget consumed over the longest retained window
+		if total, bad := t.counts(s, now, t.retain); total > 0 {
+			allowed := (1 - s.objective.Target) * float64(total)
+			if allowed > 0 {
+				st.BudgetRemaining = 1 - float64(bad)/allowed
+			} else if bad > 0 {
+				st.BudgetRemaining = 0
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+func (t *SLOTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Status())
+}
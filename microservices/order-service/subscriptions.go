@@ -0,0 +1,605 @@
+// order-service/subscriptions.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/fields"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/priority"
+	"platform/router"
+)
+
+// Subscription states. past_due subscriptions are retried on the dunning
+// schedule; paused and canceled ones are never charged.
+const (
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionPaused   = "paused"
+	SubscriptionCanceled = "canceled"
+)
+
+// Billing intervals; IntervalCount multiplies them ("every 2 weeks")
+var intervals = map[string]func(t time.Time, n int) time.Time{
+	"day":   func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) },
+	"week":  func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) },
+	"month": func(t time.Time, n int) time.Time { return t.AddDate(0, n, 0) },
+	"year":  func(t time.Time, n int) time.Time { return t.AddDate(n, 0, 0) },
+}
+
+// Subscription places the same order every interval, charged to a stored
+// payment method (the user's default when PaymentMethodID is zero)
+type Subscription struct {
+	ID              int64      `json:"id"`
+	UserID          int        `json:"user_id"`
+	Product         string     `json:"product"`
+	Quantity        int        `json:"quantity"`
+	Amount          float64    `json:"amount"`
+	Interval        string     `json:"interval"`
+	IntervalCount   int        `json:"interval_count"`
+	PaymentMethodID int64      `json:"payment_method_id,omitempty"`
+	Status          string     `json:"status"`
+	NextRunAt       time.Time  `json:"next_run_at"`
+	FailedAttempts  int        `json:"failed_attempts"`
+	LastOrderID     int        `json:"last_order_id,omitempty"`
+	CanceledAt      *time.Time `json:"canceled_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// after returns the first run following t
+func (s *Subscription) after(t time.Time) time.Time {
+	return intervals[s.Interval](t, s.IntervalCount)
+}
+
+var errSubscriptionState = errors.New("subscription is not in a state that allows this")
+
+// SubscriptionRepository stores subscriptions
+type SubscriptionRepository interface {
+	CreateSubscription(ctx context.Context, s *Subscription) error
+	Subscription(ctx context.Context, id int64) (*Subscription, error)
+	// Subscriptions lists a user's subscriptions, or everyone's for 0
+	Subscriptions(ctx context.Context, userID int) ([]Subscription, error)
+	// UpdateSubscription locks the subscription, lets fn change it and
+	// saves the result unless fn fails
+	UpdateSubscription(ctx context.Context, id int64, fn func(*Subscription) error) (*Subscription, error)
+	// ClaimDueSubscriptions returns active and past-due subscriptions whose
+	// run is due and pushes it back by lease, so concurrent schedulers
+	// skip them. The returned copies keep the run time they were due at.
+	ClaimDueSubscriptions(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Subscription, error)
+}
+
+const subscriptionColumns = `id, user_id, product, quantity, amount, billing_interval, interval_count,
+              COALESCE(payment_method_id, 0), status, next_run_at, failed_attempts, COALESCE(last_order_id, 0),
+              canceled_at, created_at`
+
+func scanSubscription(scan func(...any) error, s *Subscription) error {
+	var canceled sql.NullTime
+	err := scan(&s.ID, &s.UserID, &s.Product, &s.Quantity, &s.Amount, &s.Interval, &s.IntervalCount,
+		&s.PaymentMethodID, &s.Status, &s.NextRunAt, &s.FailedAttempts, &s.LastOrderID, &canceled, &s.CreatedAt)
+	if canceled.Valid {
+		s.CanceledAt = &canceled.Time
+	}
+	return err
+}
+
+func (r *PostgresOrderRepository) querySubscriptions(ctx context.Context, query string, args ...any) ([]Subscription, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var s Subscription
+		if err := scanSubscription(rows.Scan, &s); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func (r *PostgresOrderRepository) CreateSubscription(ctx context.Context, s *Subscription) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO subscriptions
+              (user_id, product, quantity, amount, billing_interval, interval_count, payment_method_id, status, next_run_at)
+              VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), $8, $9) RETURNING id, created_at`,
+		s.UserID, s.Product, s.Quantity, s.Amount, s.Interval, s.IntervalCount, s.PaymentMethodID, s.Status, s.NextRunAt).
+		Scan(&s.ID, &s.CreatedAt)
+}
+
+func (r *PostgresOrderRepository) Subscription(ctx context.Context, id int64) (*Subscription, error) {
+	var s Subscription
+	err := scanSubscription(r.db.QueryRowContext(ctx, `SELECT `+subscriptionColumns+` FROM subscriptions WHERE id = $1`, id).Scan, &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *PostgresOrderRepository) Subscriptions(ctx context.Context, userID int) ([]Subscription, error) {
+	return r.querySubscriptions(ctx, `SELECT `+subscriptionColumns+` FROM subscriptions
+              WHERE $1 = 0 OR user_id = $1 ORDER BY id DESC LIMIT 500`, userID)
+}
+
+func (r *PostgresOrderRepository) UpdateSubscription(ctx context.Context, id int64, fn func(*Subscription) error) (*Subscription, error) {
+	var sub *Subscription
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var s Subscription
+		err := scanSubscription(tx.QueryRowContext(ctx, `SELECT `+subscriptionColumns+` FROM subscriptions
+              WHERE id = $1 FOR UPDATE`, id).Scan, &s)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE subscriptions SET status = $2, next_run_at = $3, failed_attempts = $4,
+                  last_order_id = NULLIF($5, 0), canceled_at = $6, payment_method_id = NULLIF($7, 0)
+              WHERE id = $1`,
+			id, s.Status, s.NextRunAt, s.FailedAttempts, s.LastOrderID, s.CanceledAt, s.PaymentMethodID)
+		if err != nil {
+			return err
+		}
+		sub = &s
+		return nil
+	})
+	return sub, err
+}
+
+func (r *PostgresOrderRepository) ClaimDueSubscriptions(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Subscription, error) {
+	// The outer SELECT sees the rows as they were before the lease
+	return r.querySubscriptions(ctx, `WITH leased AS (
+                  UPDATE subscriptions SET next_run_at = $2
+                  WHERE id IN (
+                      SELECT id FROM subscriptions
+                      WHERE status IN ('active', 'past_due') AND next_run_at <= $1
+                      ORDER BY next_run_at LIMIT $3
+                      FOR UPDATE SKIP LOCKED)
+                  RETURNING id)
+              SELECT `+subscriptionColumns+` FROM subscriptions WHERE id IN (SELECT id FROM leased)`,
+		now, now.Add(lease), limit)
+}
+
+func (r *MemoryOrderRepository) CreateSubscription(ctx context.Context, s *Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s.ID = int64(len(r.subscriptions) + 1)
+	s.CreatedAt = clock.System.Now()
+	c := *s
+	r.subscriptions = append(r.subscriptions, &c)
+	return nil
+}
+
+func (r *MemoryOrderRepository) subscription(id int64) (*Subscription, error) {
+	if id < 1 || id > int64(len(r.subscriptions)) {
+		return nil, ErrNotFound
+	}
+	return r.subscriptions[id-1], nil
+}
+
+func (r *MemoryOrderRepository) Subscription(ctx context.Context, id int64) (*Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, err := r.subscription(id)
+	if err != nil {
+		return nil, err
+	}
+	c := *s
+	return &c, nil
+}
+
+func (r *MemoryOrderRepository) Subscriptions(ctx context.Context, userID int) ([]Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var subs []Subscription
+	for i := len(r.subscriptions) - 1; i >= 0; i-- {
+		if s := r.subscriptions[i]; userID == 0 || s.UserID == userID {
+			subs = append(subs, *s)
+		}
+	}
+	return subs, nil
+}
+
+func (r *MemoryOrderRepository) UpdateSubscription(ctx context.Context, id int64, fn func(*Subscription) error) (*Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, err := r.subscription(id)
+	if err != nil {
+		return nil, err
+	}
+	c := *s
+	if err := fn(&c); err != nil {
+		return nil, err
+	}
+	*s = c
+	return &c, nil
+}
+
+func (r *MemoryOrderRepository) ClaimDueSubscriptions(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []Subscription
+	for _, s := range r.subscriptions {
+		if len(due) == limit {
+			break
+		}
+		if (s.Status != SubscriptionActive && s.Status != SubscriptionPastDue) || s.NextRunAt.After(now) {
+			continue
+		}
+		due = append(due, *s)
+		s.NextRunAt = now.Add(lease)
+	}
+	return due, nil
+}
+
+// defaultDunning is how long after each failed renewal it is retried; the
+// subscription is canceled when the last retry fails too
+var defaultDunning = []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 7 * 24 * time.Hour}
+
+// parseDurations reads a comma-separated list such as "24h,72h,168h"
+func parseDurations(spec string) ([]time.Duration, error) {
+	var ds []time.Duration
+	for part := range strings.SplitSeq(spec, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", part)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Subscriptions renews due subscriptions by placing and charging an order
+// for each, the same way a checkout does
+type Subscriptions struct {
+	orders  *OrderService
+	repo    SubscriptionRepository
+	dunning []time.Duration
+}
+
+func NewSubscriptions(orders *OrderService, repo SubscriptionRepository, dunning []time.Duration) *Subscriptions {
+	return &Subscriptions{orders: orders, repo: repo, dunning: dunning}
+}
+
+// Run renews due subscriptions every interval until ctx is done
+func (s *Subscriptions) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			due, err := s.repo.ClaimDueSubscriptions(ctx, s.orders.clock.Now(), 5*time.Minute, 50)
+			if err != nil {
+				log.Printf("claim due subscriptions: %v", err)
+				continue
+			}
+			for _, sub := range due {
+				if err := s.renew(ctx, &sub); err != nil {
+					log.Printf("subscription %d: %v", sub.ID, err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// renew places one recurring order. Renewals queue behind interactive
+// checkouts for payment-service capacity.
+func (s *Subscriptions) renew(ctx context.Context, sub *Subscription) error {
+	ctx = priority.WithClass(ctx, priority.Batch)
+	subject := fmt.Sprintf("subscription/%d", sub.ID)
+
+	order := Order{
+		UserID:          sub.UserID,
+		Product:         sub.Product,
+		Quantity:        sub.Quantity,
+		Amount:          sub.Amount,
+		PaymentMethodID: sub.PaymentMethodID,
+		Status:          "pending",
+		CreatedAt:       s.orders.clock.Now(),
+	}
+	customer, err := s.orders.fetchCustomer(ctx, sub.UserID)
+	if transient(err) {
+		return err
+	}
+	if err != nil {
+		return s.failed(ctx, sub, 0, err)
+	}
+	if err := s.orders.repo.Create(ctx, &order); err != nil {
+		// Nothing was charged; try again once the lease runs out
+		return err
+	}
+	receipt, err := s.orders.processPayment(ctx, &order)
+	if err != nil {
+		s.orders.repo.UpdateStatus(ctx, order.ID, "payment_failed")
+		order.Status = "payment_failed"
+		s.orders.events.Emit(ctx, "order.payment_failed", fmt.Sprintf("order/%d", order.ID), &order)
+		if transient(err) {
+			return err
+		}
+		return s.failed(ctx, sub, order.ID, err)
+	}
+
+	if receipt.Status == "requires_action" {
+		// The customer has to confirm this one; the order settles through
+		// the payment callback like any other
+		if err := s.orders.repo.RecordPayment(ctx, order.ID, receipt.ID, "awaiting_confirmation"); err != nil {
+			return err
+		}
+		order.Status = "awaiting_confirmation"
+		order.ConfirmationURL = receipt.ConfirmationURL
+		s.orders.events.Emit(ctx, "subscription.action_required", subject, order)
+	} else {
+		order.Status = "completed"
+		order.PaymentID = receipt.ID
+		s.orders.repo.RecordPayment(ctx, order.ID, receipt.ID, order.Status)
+		s.orders.completed(ctx, &order, customer, receipt)
+	}
+
+	now := s.orders.clock.Now()
+	updated, err := s.repo.UpdateSubscription(ctx, sub.ID, func(c *Subscription) error {
+		// Skip the runs missed while nothing was renewing rather than
+		// placing them all at once
+		next := c.after(sub.NextRunAt)
+		if c.FailedAttempts > 0 || !next.After(now) {
+			next = c.after(now)
+		}
+		c.LastOrderID = order.ID
+		c.FailedAttempts = 0
+		c.NextRunAt = next
+		if c.Status == SubscriptionPastDue {
+			c.Status = SubscriptionActive
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.orders.events.Emit(ctx, "subscription.renewed", subject, updated)
+	return nil
+}
+
+// transient reports failures that say nothing about the customer's card;
+// those renewals are retried once their lease runs out, outside dunning
+func transient(err error) bool {
+	var m *i18n.Message
+	return errors.As(err, &m) &&
+		(m.Key == "order.user_service_unavailable" || m.Key == "order.payment_service_busy")
+}
+
+// failed schedules the next dunning retry, or cancels the subscription
+// when they are used up
+func (s *Subscriptions) failed(ctx context.Context, sub *Subscription, orderID int, cause error) error {
+	now := s.orders.clock.Now()
+	updated, err := s.repo.UpdateSubscription(ctx, sub.ID, func(c *Subscription) error {
+		if orderID != 0 {
+			c.LastOrderID = orderID
+		}
+		c.FailedAttempts++
+		if c.FailedAttempts > len(s.dunning) {
+			c.Status = SubscriptionCanceled
+			c.CanceledAt = &now
+			return nil
+		}
+		c.NextRunAt = now.Add(s.dunning[c.FailedAttempts-1])
+		if c.Status == SubscriptionActive {
+			c.Status = SubscriptionPastDue
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("subscription/%d", sub.ID)
+	data := map[string]any{"subscription": updated, "error": cause.Error()}
+	if updated.Status == SubscriptionCanceled {
+		s.orders.events.Emit(ctx, "subscription.canceled", subject, data)
+	} else {
+		s.orders.events.Emit(ctx, "subscription.renewal_failed", subject, data)
+	}
+	return fmt.Errorf("renewal failed: %w", cause)
+}
+
+// SubscriptionAPI serves /subscriptions to their users and admins
+type SubscriptionAPI struct {
+	repo   SubscriptionRepository
+	events *events.Emitter
+	clock  clock.Clock
+}
+
+// allowed reports whether the caller may see and change userID's
+// subscriptions
+func allowed(r *http.Request, userID int) bool {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	return !ok || p.Subject == strconv.Itoa(userID) || p.HasRole("admin")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Create subscribes a user. The first order is placed at start, or right
+// away when it is omitted.
+func (a *SubscriptionAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subscription
+		Start *time.Time `json:"start"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.FromContext(r.Context()).Text(err), http.StatusBadRequest)
+		return
+	}
+	sub := req.Subscription
+	if sub.IntervalCount == 0 {
+		sub.IntervalCount = 1
+	}
+	if sub.Quantity == 0 {
+		sub.Quantity = 1
+	}
+	if _, ok := intervals[sub.Interval]; !ok || sub.IntervalCount < 1 || sub.UserID <= 0 ||
+		sub.Product == "" || sub.Quantity < 1 || sub.Amount <= 0 {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "subscription.invalid")
+		return
+	}
+	if !allowed(r, sub.UserID) {
+		i18n.Error(w, r, http.StatusForbidden, "subscription.forbidden")
+		return
+	}
+
+	sub.Status = SubscriptionActive
+	sub.NextRunAt = a.clock.Now()
+	if req.Start != nil && req.Start.After(sub.NextRunAt) {
+		sub.NextRunAt = *req.Start
+	}
+	sub.FailedAttempts, sub.LastOrderID, sub.CanceledAt = 0, 0, nil
+	if err := a.repo.CreateSubscription(r.Context(), &sub); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.events.Emit(r.Context(), "subscription.created", fmt.Sprintf("subscription/%d", sub.ID), sub)
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+// List returns the caller's subscriptions; admins may pass ?user_id= or
+// omit it to see everyone's
+func (a *SubscriptionAPI) List(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			i18n.Error(w, r, http.StatusBadRequest, "subscription.invalid")
+			return
+		}
+		userID = id
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok && !p.HasRole("admin") {
+		id, err := strconv.Atoi(p.Subject)
+		if err != nil || (userID != 0 && userID != id) {
+			i18n.Error(w, r, http.StatusForbidden, "subscription.forbidden")
+			return
+		}
+		userID = id
+	}
+
+	subs, err := a.repo.Subscriptions(r.Context(), userID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if subs == nil {
+		subs = []Subscription{}
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, subs))
+}
+
+func (a *SubscriptionAPI) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+	if err != nil {
+		i18n.Error(w, r, http.StatusNotFound, "subscription.not_found")
+		return
+	}
+	sub, err := a.repo.Subscription(r.Context(), id)
+	if errors.Is(err, ErrNotFound) || (err == nil && !allowed(r, sub.UserID)) {
+		i18n.Error(w, r, http.StatusNotFound, "subscription.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, sub))
+}
+
+// change applies a pause, resume or cancel on behalf of the subscriber
+func (a *SubscriptionAPI) change(event string, fn func(*Subscription, time.Time) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+		if err != nil {
+			i18n.Error(w, r, http.StatusNotFound, "subscription.not_found")
+			return
+		}
+		sub, err := a.repo.UpdateSubscription(r.Context(), id, func(s *Subscription) error {
+			if !allowed(r, s.UserID) {
+				return ErrNotFound
+			}
+			return fn(s, a.clock.Now())
+		})
+		if errors.Is(err, ErrNotFound) {
+			i18n.Error(w, r, http.StatusNotFound, "subscription.not_found")
+			return
+		}
+		if errors.Is(err, errSubscriptionState) {
+			i18n.Error(w, r, http.StatusConflict, "subscription.invalid_transition")
+			return
+		}
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		a.events.Emit(r.Context(), event, fmt.Sprintf("subscription/%d", sub.ID), sub)
+		writeJSON(w, http.StatusOK, sub)
+	}
+}
+
+func pauseSubscription(s *Subscription, now time.Time) error {
+	if s.Status != SubscriptionActive && s.Status != SubscriptionPastDue {
+		return errSubscriptionState
+	}
+	s.Status = SubscriptionPaused
+	return nil
+}
+
+// resumeSubscription restarts billing; a run missed while paused happens
+// right away
+func resumeSubscription(s *Subscription, now time.Time) error {
+	if s.Status != SubscriptionPaused {
+		return errSubscriptionState
+	}
+	s.Status = SubscriptionActive
+	if s.FailedAttempts > 0 {
+		s.Status = SubscriptionPastDue
+	}
+	if s.NextRunAt.Before(now) {
+		s.NextRunAt = now
+	}
+	return nil
+}
+
+func cancelSubscription(s *Subscription, now time.Time) error {
+	if s.Status == SubscriptionCanceled {
+		return errSubscriptionState
+	}
+	s.Status = SubscriptionCanceled
+	s.CanceledAt = &now
+	return nil
+}
@@ -0,0 +1,147 @@
+// order-service/wait.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/deadline"
+	"platform/i18n"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 60 * time.Second
+	// waitMargin is kept from the request's budget to answer in time
+	waitMargin = 100 * time.Millisecond
+)
+
+// terminalStatuses are those an order never leaves on its own
+var terminalStatuses = []string{"completed", "payment_failed", "canceled"}
+
+func terminal(status string) bool {
+	return slices.Contains(terminalStatuses, status)
+}
+
+// OrderWaiters wakes requests waiting on an order once the event bus says
+// it settled. Each instance learns of settlements from the bus, whichever
+// instance settled the order.
+type OrderWaiters struct {
+	mu      sync.Mutex
+	waiters map[int][]chan struct{}
+}
+
+func NewOrderWaiters() *OrderWaiters {
+	return &OrderWaiters{waiters: make(map[int][]chan struct{})}
+}
+
+// Wait returns a channel closed when order id is next notified, and a
+// function to stop waiting
+func (o *OrderWaiters) Wait(id int) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	o.mu.Lock()
+	o.waiters[id] = append(o.waiters[id], ch)
+	o.mu.Unlock()
+	return ch, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		waiters := slices.DeleteFunc(o.waiters[id], func(c chan struct{}) bool { return c == ch })
+		if len(waiters) == 0 {
+			delete(o.waiters, id)
+		} else {
+			o.waiters[id] = waiters
+		}
+	}
+}
+
+// Notify wakes everyone waiting on order id
+func (o *OrderWaiters) Notify(id int) {
+	o.mu.Lock()
+	waiters := o.waiters[id]
+	delete(o.waiters, id)
+	o.mu.Unlock()
+	for _, ch := range waiters {
+		close(ch)
+	}
+}
+
+// orderSettled reads the order ID from the subject of a settlement event
+// (order/42), if it is one
+func orderSettled(eventType, subject string) (int, bool) {
+	switch eventType {
+	case "order.completed", "order.payment_failed", "order.canceled":
+	default:
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(subject, "order/"))
+	return id, err == nil
+}
+
+// waitOrder answers GET /orders/{id}/wait?timeout=30s once the order is
+// completed, payment_failed or canceled, or the timeout (at most a minute)
+// passes, for clients that can't hold an event stream open. Either way it
+// returns the order as it then is; a request whose deadline budget runs
+// out first gets an early answer, and the client asks again.
+func (s *OrderService) waitOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := i18n.FromContext(ctx)
+
+	timeout := defaultWaitTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(timeout, maxWaitTimeout)
+	}
+	if remaining, ok := deadline.Remaining(ctx); ok {
+		timeout = max(min(timeout, remaining-waitMargin), 0)
+	}
+
+	orderID, err := s.orderIDParam(r)
+	var order *Order
+	if err == nil {
+		order, err = s.repo.Get(ctx, orderID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+	if err != nil {
+		http.Error(w, loc.Text(err), http.StatusInternalServerError)
+		return
+	}
+	if !s.canSee(r, order) {
+		i18n.Error(w, r, http.StatusNotFound, "order.not_found")
+		return
+	}
+
+	if !terminal(order.Status) {
+		// Start listening before looking again, so a settlement in between
+		// isn't missed
+		settled, stop := s.waiters.Wait(order.ID)
+		defer stop()
+		if order, err = s.repo.Get(ctx, order.ID); err == nil && !terminal(order.Status) {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-settled:
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+			order, err = s.repo.Get(context.WithoutCancel(ctx), order.ID)
+		}
+		if err != nil {
+			http.Error(w, loc.Text(err), http.StatusInternalServerError)
+			return
+		}
+	}
+	s.writeOrder(w, http.StatusOK, order)
+}
@@ -0,0 +1,161 @@
+// order-service/workflows.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"platform/workflow"
+)
+
+// stuckListed caps how many stuck workflows of a kind are listed at once
+const stuckListed = 100
+
+// watchOrderPayments has the watchdog look for orders checkout left
+// unsettled: pending ones whose payment never got an answer, ones taken
+// while payment-service was down that it hasn't charged since, and ones
+// awaiting a confirmation the customer never came back from
+func (s *OrderService) watchOrderPayments(w *workflow.Watchdog) {
+	w.Add(workflow.Source{
+		Kind:    "order_payment",
+		Subject: "order",
+		SLA:     15 * time.Minute,
+		Find: func(ctx context.Context, before time.Time) ([]workflow.Workflow, error) {
+			var stuck []workflow.Workflow
+			for _, status := range []string{"pending", "awaiting_payment", "awaiting_confirmation"} {
+				err := s.repo.EachOrder(ctx, OrderFilter{Status: status, CreatedTo: before, Limit: stuckListed}, func(o *Order) error {
+					wf := workflow.Workflow{ID: strconv.Itoa(o.ID), State: o.Status, Since: o.CreatedAt}
+					if o.PaymentID != 0 {
+						wf.Detail = fmt.Sprintf("payment %d requires action", o.PaymentID)
+					}
+					stuck = append(stuck, wf)
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return stuck, nil
+		},
+		Resume: s.resumeOrderPayment,
+		Abort:  s.abortOrderPayment,
+	})
+}
+
+func (s *OrderService) unsettledOrder(ctx context.Context, id string) (*Order, error) {
+	orderID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, workflow.ErrNotFound
+	}
+	order, err := s.repo.Get(ctx, orderID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, workflow.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != "pending" && order.Status != "awaiting_payment" && order.Status != "awaiting_confirmation" {
+		return nil, workflow.ErrNotStuck
+	}
+	return order, nil
+}
+
+// resumeOrderPayment settles an order awaiting confirmation by how its
+// payment ended, as the payment callback would have, and charges one
+// awaiting payment. A pending order has no payment to ask about; the
+// consistency check finds any it was charged.
+func (s *OrderService) resumeOrderPayment(ctx context.Context, id string) error {
+	order, err := s.unsettledOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	if order.Status == "awaiting_payment" {
+		if err := s.chargeOrderLater(ctx, order); err != nil {
+			return err
+		}
+		if order.Status == "awaiting_payment" {
+			return fmt.Errorf("order %d: payment-service is still down", order.ID)
+		}
+		return nil
+	}
+	if order.PaymentID == 0 {
+		return fmt.Errorf("order %d has no payment to settle: %w", order.ID, workflow.ErrNotStuck)
+	}
+	receipt, err := s.fetchPayment(ctx, order.PaymentID)
+	if err != nil {
+		return err
+	}
+	if receipt.Status == "requires_action" {
+		return fmt.Errorf("payment %d still requires action: %w", receipt.ID, workflow.ErrNotStuck)
+	}
+	var customer *Customer
+	if receipt.Status == "completed" {
+		if customer, err = s.fetchCustomer(ctx, order.UserID); err != nil {
+			return err
+		}
+	}
+	return s.settle(ctx, order, receipt, customer)
+}
+
+// abortOrderPayment gives an unsettled order up: the payment awaiting
+// confirmation is canceled with it, and a pending order fails
+func (s *OrderService) abortOrderPayment(ctx context.Context, id string) error {
+	order, err := s.unsettledOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	if order.PaymentID == 0 {
+		return s.settle(ctx, order, &PaymentReceipt{Status: "failed"}, nil)
+	}
+	err = s.cancelPayment(ctx, order.PaymentID)
+	if errors.Is(err, errPaymentSettled) {
+		return fmt.Errorf("payment %d was settled meanwhile, resume instead: %w", order.PaymentID, workflow.ErrNotStuck)
+	}
+	if err != nil {
+		return err
+	}
+	return s.canceled(ctx, order)
+}
+
+// watchReturns has the watchdog look for approved returns whose label or
+// refund failed; resuming retries them
+func (a *ReturnAPI) watchReturns(w *workflow.Watchdog) {
+	w.Add(workflow.Source{
+		Kind:    "return_refund",
+		Subject: "return",
+		SLA:     time.Hour,
+		Find: func(ctx context.Context, before time.Time) ([]workflow.Workflow, error) {
+			returns, err := a.repo.Returns(ctx, 0, ReturnApproved)
+			if err != nil {
+				return nil, err
+			}
+			var stuck []workflow.Workflow
+			for _, ret := range returns {
+				if ret.UpdatedAt.Before(before) && len(stuck) < stuckListed {
+					stuck = append(stuck, workflow.Workflow{ID: strconv.FormatInt(ret.ID, 10), State: ret.Status, Since: ret.UpdatedAt})
+				}
+			}
+			return stuck, nil
+		},
+		Resume: func(ctx context.Context, id string) error {
+			returnID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return workflow.ErrNotFound
+			}
+			ret, err := a.repo.Return(ctx, returnID)
+			switch {
+			case errors.Is(err, ErrNotFound):
+				return workflow.ErrNotFound
+			case err != nil:
+				return err
+			case ret.Status != ReturnApproved:
+				return workflow.ErrNotStuck
+			}
+			_, err = a.settle(ctx, ret)
+			return err
+		},
+	})
+}
@@ -0,0 +1,210 @@
+// payment-service/challenge.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"platform/dbretry"
+	"platform/middleware"
+)
+
+// Challenge decides which payments need the customer to authenticate
+// (3-D Secure) before they are charged: those putting at least Threshold
+// on the card. The customer authenticates with the provider, whose result
+// alone settles the payment: it posts it to /payments/{id}/challenge,
+// signed with one of its keys. The provider then sends the customer back
+// to the same path, which forwards them to the payment's return_url.
+type Challenge struct {
+	// Threshold of zero challenges nothing
+	Threshold float64
+	// BaseURL is how customers' browsers reach this service
+	BaseURL string
+	// ProviderURL is where customers authenticate when their provider
+	// route has no endpoint of its own
+	ProviderURL string
+	// ReturnOrigins are the origins, e.g. https://shop.example, a
+	// payment's return_url may send customers to
+	ReturnOrigins []string
+}
+
+// returnAllowed says whether customers may be sent on to u once they
+// have authenticated, so a payment can't redirect them just anywhere
+func (c Challenge) returnAllowed(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	origin := parsed.Scheme + "://" + parsed.Host
+	return slices.ContainsFunc(c.ReturnOrigins, func(o string) bool { return strings.EqualFold(o, origin) })
+}
+
+func (c Challenge) required(p *Payment) bool {
+	card := p.Amount - p.CreditAmount
+	return c.Threshold > 0 && card > 0 && card >= c.Threshold
+}
+
+// begin parks p in requires_action with a fresh confirmation token
+func (c Challenge) begin(p *Payment) {
+	p.Status = "requires_action"
+	p.ConfirmationToken = rand.Text()
+}
+
+// url is where the customer authenticates p: on the provider endpoint at
+// base, the one for their region, or at ProviderURL when base is "".
+// return_to is where the provider sends them afterwards.
+func (c Challenge) url(p *Payment, base string) string {
+	if base == "" {
+		base = c.ProviderURL
+	}
+	back := fmt.Sprintf("%s/payments/%s/challenge?token=%s", c.BaseURL, p.PublicID, url.QueryEscape(p.ConfirmationToken))
+	return fmt.Sprintf("%s/payments/%s/challenge?token=%s&return_to=%s",
+		base, p.PublicID, url.QueryEscape(p.ConfirmationToken), url.QueryEscape(back))
+}
+
+var (
+	errNotAwaitingAction = errors.New("payment is not awaiting customer action")
+	errBadConfirmation   = errors.New("invalid confirmation token")
+)
+
+// challengeResult is what the provider posts once the customer has
+// authenticated, or failed to
+type challengeResult struct {
+	Token  string `json:"token"`
+	Result string `json:"result"`
+}
+
+// CompleteChallenge takes the provider's signed result of a challenge,
+// charging the payment when it is "approved" and failing it when it is
+// "declined"
+func (s *PaymentService) CompleteChallenge(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := s.paymentIDParam(r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	var result challengeResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if result.Result != "approved" && result.Result != "declined" {
+		http.Error(w, `result must be "approved" or "declined"`, http.StatusBadRequest)
+		return
+	}
+
+	payment, err := s.repo.Adjust(r.Context(), paymentID, func(p *Payment, ledger []LedgerEntry) ([]Journal, error) {
+		if subtle.ConstantTimeCompare([]byte(result.Token), []byte(p.ConfirmationToken)) != 1 {
+			return nil, errBadConfirmation
+		}
+		if p.Status != "requires_action" {
+			return nil, errNotAwaitingAction
+		}
+		if result.Result == "declined" {
+			p.Status = "failed"
+			return nil, nil
+		}
+		p.Status = "completed"
+		return s.chargeJournal(p), nil
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errBadConfirmation) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotAwaitingAction) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.withLinks(r, payment))
+}
+
+// ReturnFromChallenge is where the provider sends the customer after the
+// challenge. It changes nothing: once the provider's result has settled
+// the payment, the customer goes on to its return_url.
+func (s *PaymentService) ReturnFromChallenge(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := s.paymentIDParam(r)
+	var payment *Payment
+	if err == nil {
+		payment, err = s.repo.Get(r.Context(), paymentID)
+	}
+	if err == nil && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(payment.ConfirmationToken)) != 1 {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if payment.Status == "requires_action" {
+		http.Error(w, "payment is waiting for the provider's result", http.StatusConflict)
+		return
+	}
+
+	if payment.ReturnURL != "" {
+		http.Redirect(w, r, payment.ReturnURL, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.withLinks(r, payment))
+}
+
+// CancelPayment abandons a payment still waiting for the customer to
+// authenticate; nothing has moved yet, so nothing is reversed. Only the
+// payer or an admin may cancel.
+func (s *PaymentService) CancelPayment(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := s.paymentIDParam(r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	caller, authenticated := middleware.PrincipalFromContext(r.Context())
+	payment, err := s.repo.Adjust(r.Context(), paymentID, func(p *Payment, ledger []LedgerEntry) ([]Journal, error) {
+		if authenticated && caller.Subject != strconv.Itoa(p.UserID) && !caller.HasRole("admin") {
+			return nil, ErrNotFound
+		}
+		if p.Status != "requires_action" {
+			return nil, errNotAwaitingAction
+		}
+		p.Status = "canceled"
+		return nil, nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotAwaitingAction) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.withLinks(r, payment))
+}
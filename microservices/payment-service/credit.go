@@ -0,0 +1,381 @@
+// payment-service/credit.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/router"
+)
+
+// Store credit movements
+const (
+	// MovementStoreCredit spends credit on a payment
+	MovementStoreCredit    = "store_credit"
+	MovementCreditIssue    = "credit_issue"
+	MovementGiftCardIssue  = "gift_card_issue"
+	MovementGiftCardRedeem = "gift_card_redeem"
+	// MovementCreditTransfer moves a merged-away account's credit to the
+	// account it went into
+	MovementCreditTransfer = "credit_transfer"
+)
+
+// Store credit accounts. Credit is what we owe a user, so their account's
+// balance is negative; it may never go above zero.
+const (
+	// AccountCreditIssued is where issued credit and gift card value come
+	// from
+	AccountCreditIssued = "credit_issued"
+	// AccountGiftCards holds the value of gift cards not yet redeemed
+	AccountGiftCards = "gift_cards"
+
+	storeCreditPrefix = "store_credit:"
+)
+
+func storeCreditAccount(userID int) string {
+	return storeCreditPrefix + strconv.Itoa(userID)
+}
+
+func isStoreCreditAccount(account string) bool {
+	return strings.HasPrefix(account, storeCreditPrefix)
+}
+
+var (
+	errInsufficientCredit = errors.New("not enough store credit")
+	errGiftCardRedeemed   = errors.New("gift card already redeemed")
+)
+
+// GiftCard is credit waiting to be claimed by whoever has the code
+type GiftCard struct {
+	Code        string     `json:"code"`
+	AmountCents int64      `json:"amount_cents"`
+	RedeemedBy  int        `json:"redeemed_by,omitempty"`
+	RedeemedAt  *time.Time `json:"redeemed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CreditRepository keeps store credit and gift cards. Every change is a
+// ledger entry; a user's balance is their store_credit account's.
+type CreditRepository interface {
+	// CreditBalance is the store credit a user can spend, in cents
+	CreditBalance(ctx context.Context, userID int) (int64, error)
+	CreditLedger(ctx context.Context, userID int) ([]LedgerEntry, error)
+	IssueCredit(ctx context.Context, userID int, cents int64) error
+	CreateGiftCard(ctx context.Context, card *GiftCard) error
+	GiftCard(ctx context.Context, code string) (*GiftCard, error)
+	// RedeemGiftCard moves a card's value into the user's store credit
+	RedeemGiftCard(ctx context.Context, code string, userID int) (*GiftCard, error)
+}
+
+func (r *PostgresPaymentRepository) CreditBalance(ctx context.Context, userID int) (int64, error) {
+	var balance int64
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE((SELECT -balance_cents FROM ledger_accounts WHERE name = $1), 0)`,
+		storeCreditAccount(userID)).Scan(&balance)
+	return balance, err
+}
+
+func (r *PostgresPaymentRepository) CreditLedger(ctx context.Context, userID int) ([]LedgerEntry, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+ledgerColumns+` FROM ledger_entries WHERE account = $1 ORDER BY id`,
+		storeCreditAccount(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ledger []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err := scanLedgerEntry(rows.Scan, &e); err != nil {
+			return nil, err
+		}
+		ledger = append(ledger, e)
+	}
+	return ledger, rows.Err()
+}
+
+func (r *PostgresPaymentRepository) IssueCredit(ctx context.Context, userID int, cents int64) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		journal := transfer(MovementCreditIssue, AccountCreditIssued, storeCreditAccount(userID), cents)
+		if err := post(ctx, tx, ledgerRef{}, []Journal{journal}); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *PostgresPaymentRepository) CreateGiftCard(ctx context.Context, card *GiftCard) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `INSERT INTO gift_cards (code, amount_cents) VALUES ($1, $2) RETURNING created_at`,
+			card.Code, card.AmountCents).Scan(&card.CreatedAt)
+		if err != nil {
+			return err
+		}
+		journal := transfer(MovementGiftCardIssue, AccountCreditIssued, AccountGiftCards, card.AmountCents)
+		if err := post(ctx, tx, ledgerRef{}, []Journal{journal}); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func scanGiftCard(scan func(...any) error, c *GiftCard) error {
+	var redeemedBy sql.NullInt64
+	var redeemedAt sql.NullTime
+	err := scan(&c.Code, &c.AmountCents, &redeemedBy, &redeemedAt, &c.CreatedAt)
+	c.RedeemedBy = int(redeemedBy.Int64)
+	if redeemedAt.Valid {
+		c.RedeemedAt = &redeemedAt.Time
+	}
+	return err
+}
+
+func (r *PostgresPaymentRepository) GiftCard(ctx context.Context, code string) (*GiftCard, error) {
+	var c GiftCard
+	err := scanGiftCard(r.db.QueryRowContext(ctx, `SELECT code, amount_cents, redeemed_by, redeemed_at, created_at
+              FROM gift_cards WHERE code = $1`, code).Scan, &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *PostgresPaymentRepository) RedeemGiftCard(ctx context.Context, code string, userID int) (*GiftCard, error) {
+	var card *GiftCard
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var c GiftCard
+		err := scanGiftCard(tx.QueryRowContext(ctx, `SELECT code, amount_cents, redeemed_by, redeemed_at, created_at
+              FROM gift_cards WHERE code = $1 FOR UPDATE`, code).Scan, &c)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if c.RedeemedAt != nil {
+			return errGiftCardRedeemed
+		}
+
+		now := clock.System.Now()
+		c.RedeemedBy, c.RedeemedAt = userID, &now
+		if _, err := tx.ExecContext(ctx, `UPDATE gift_cards SET redeemed_by = $2, redeemed_at = $3 WHERE code = $1`,
+			code, userID, now); err != nil {
+			return err
+		}
+		journal := transfer(MovementGiftCardRedeem, AccountGiftCards, storeCreditAccount(userID), c.AmountCents)
+		if err := post(ctx, tx, ledgerRef{}, []Journal{journal}); err != nil {
+			return err
+		}
+		card = &c
+		return nil
+	})
+	return card, err
+}
+
+func (r *MemoryPaymentRepository) CreditBalance(ctx context.Context, userID int) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return -r.balances[storeCreditAccount(userID)], nil
+}
+
+func (r *MemoryPaymentRepository) CreditLedger(ctx context.Context, userID int) ([]LedgerEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	account := storeCreditAccount(userID)
+	var ledger []LedgerEntry
+	for _, e := range r.ledger {
+		if e.Account == account {
+			ledger = append(ledger, e)
+		}
+	}
+	return ledger, nil
+}
+
+func (r *MemoryPaymentRepository) IssueCredit(ctx context.Context, userID int, cents int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.post(ledgerRef{}, []Journal{transfer(MovementCreditIssue, AccountCreditIssued, storeCreditAccount(userID), cents)})
+}
+
+func (r *MemoryPaymentRepository) CreateGiftCard(ctx context.Context, card *GiftCard) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.giftCards[card.Code]; ok {
+		return fmt.Errorf("gift card %s exists", card.Code)
+	}
+	card.CreatedAt = clock.System.Now()
+	c := *card
+	r.giftCards[card.Code] = &c
+	return r.post(ledgerRef{}, []Journal{transfer(MovementGiftCardIssue, AccountCreditIssued, AccountGiftCards, card.AmountCents)})
+}
+
+func (r *MemoryPaymentRepository) GiftCard(ctx context.Context, code string) (*GiftCard, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.giftCards[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	card := *c
+	return &card, nil
+}
+
+func (r *MemoryPaymentRepository) RedeemGiftCard(ctx context.Context, code string, userID int) (*GiftCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.giftCards[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if c.RedeemedAt != nil {
+		return nil, errGiftCardRedeemed
+	}
+	journal := transfer(MovementGiftCardRedeem, AccountGiftCards, storeCreditAccount(userID), c.AmountCents)
+	if err := r.post(ledgerRef{}, []Journal{journal}); err != nil {
+		return nil, err
+	}
+	now := clock.System.Now()
+	c.RedeemedBy, c.RedeemedAt = userID, &now
+	card := *c
+	return &card, nil
+}
+
+// StoreCreditAPI serves /users/{id}/store-credit and /gift-cards
+type StoreCreditAPI struct {
+	repo CreditRepository
+}
+
+type creditRequest struct {
+	Amount float64 `json:"amount"`
+}
+
+func (a *StoreCreditAPI) writeBalance(w http.ResponseWriter, r *http.Request, userID int, status int) {
+	balance, err := a.repo.CreditBalance(r.Context(), userID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	ledger, err := a.repo.CreditLedger(r.Context(), userID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if ledger == nil {
+		ledger = []LedgerEntry{}
+	}
+	writeJSON(w, status, map[string]any{"user_id": userID, "balance_cents": balance, "entries": ledger})
+}
+
+// Get shows a user's balance and every change to it
+func (a *StoreCreditAPI) Get(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	a.writeBalance(w, r, user, http.StatusOK)
+}
+
+// Issue grants a user credit, e.g. as a goodwill gesture
+func (a *StoreCreditAPI) Issue(w http.ResponseWriter, r *http.Request) {
+	user, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	var req creditRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cents := toCents(req.Amount)
+	if cents <= 0 {
+		http.Error(w, "amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if err := a.repo.IssueCredit(r.Context(), user, cents); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writeBalance(w, r, user, http.StatusCreated)
+}
+
+// Redeem adds a gift card's value to the user's credit
+func (a *StoreCreditAPI) Redeem(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err := a.repo.RedeemGiftCard(r.Context(), normalizeGiftCode(req.Code), user)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Gift card not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errGiftCardRedeemed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writeBalance(w, r, user, http.StatusOK)
+}
+
+// Codes are printed on cards and typed back in; ignore case and spacing
+func normalizeGiftCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+func (a *StoreCreditAPI) CreateGiftCard(w http.ResponseWriter, r *http.Request) {
+	var req creditRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	card := GiftCard{Code: rand.Text(), AmountCents: toCents(req.Amount)}
+	if card.AmountCents <= 0 {
+		http.Error(w, "amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if err := a.repo.CreateGiftCard(r.Context(), &card); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, card)
+}
+
+func (a *StoreCreditAPI) GetGiftCard(w http.ResponseWriter, r *http.Request) {
+	card, err := a.repo.GiftCard(r.Context(), normalizeGiftCode(router.Param(r, "code")))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Gift card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, card)
+}
@@ -0,0 +1,65 @@
+// payment-service/erp.go
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"platform/erp"
+	"platform/events"
+)
+
+// capturedStatuses are the states of payments that were captured, even if
+// refunds or chargebacks followed, which the ERP gets as their own postings
+var capturedStatuses = []string{"completed", "partially_refunded", "refunded", "charged_back"}
+
+// erpPayments are the payments made on a day that were captured. A payment
+// confirmed after ERP_EXPORT_DELAY waits for a retry of its day.
+func erpPayments(repo PaymentRepository) erp.Source {
+	return erp.Source{
+		Kind: "payments",
+		Records: func(ctx context.Context, from, to time.Time) ([]any, error) {
+			payments, err := repo.Payments(ctx, PaymentFilter{CreatedFrom: from, CreatedTo: to})
+			if err != nil {
+				return nil, err
+			}
+			var captured []any
+			for _, p := range payments {
+				if slices.Contains(capturedStatuses, p.Status) {
+					captured = append(captured, p)
+				}
+			}
+			return captured, nil
+		},
+		Mapping: []erp.Field{
+			{Name: "payment_id", Value: "{{.public_id}}"},
+			{Name: "order_id", Value: "{{.order_id}}"},
+			{Name: "merchant", Value: "{{.merchant}}"},
+			{Name: "customer_id", Value: "{{.user_id}}"},
+			{Name: "amount", Value: "{{money .amount}}"},
+			{Name: "store_credit", Value: "{{with .credit_amount}}{{money .}}{{end}}"},
+			{Name: "provider", Value: "{{.provider}}"},
+			{Name: "status", Value: "{{.status}}"},
+			{Name: "date", Value: "{{date .created_at}}"},
+		},
+	}
+}
+
+// erpExporter exports captured payments through the adapter ERP_ADAPTER
+// names; nil when it names none
+func erpExporter(repo Repository, emitter *events.Emitter) *erp.Exporter {
+	var exports erp.Repository = erp.NewMemoryRepository()
+	if pg, ok := repo.(*PostgresPaymentRepository); ok {
+		exports = erp.NewPostgresRepository(pg.db, "payment_erp_exports")
+	}
+	exporter, err := erp.FromEnv(exports, emitter, erpPayments(repo))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if exporter == nil {
+		log.Print("ERP_ADAPTER not set; payments aren't exported to an ERP")
+	}
+	return exporter
+}
@@ -0,0 +1,50 @@
+// payment-service/json.go
+package main
+
+import "platform/jsonenc"
+
+// AppendJSON appends p as encoding/json would marshal it, without the
+// reflection. Keep it in step with Payment's fields and tags.
+func (p *Payment) AppendJSON(b []byte) []byte {
+	b = append(b, '{')
+	b = jsonenc.Int(jsonenc.Key(b, "id"), int64(p.ID))
+	if p.PublicID != "" {
+		b = jsonenc.String(jsonenc.Key(b, "public_id"), p.PublicID)
+	}
+	b = jsonenc.Int(jsonenc.Key(b, "order_id"), int64(p.OrderID))
+	b = jsonenc.String(jsonenc.Key(b, "merchant"), p.Merchant)
+	if p.UserID != 0 {
+		b = jsonenc.Int(jsonenc.Key(b, "user_id"), int64(p.UserID))
+	}
+	if p.PaymentMethodID != 0 {
+		b = jsonenc.Int(jsonenc.Key(b, "payment_method_id"), p.PaymentMethodID)
+	}
+	b = jsonenc.Float(jsonenc.Key(b, "amount"), p.Amount)
+	if p.UseStoreCredit {
+		b = jsonenc.Bool(jsonenc.Key(b, "use_store_credit"), true)
+	}
+	if p.CreditAmount != 0 {
+		b = jsonenc.Float(jsonenc.Key(b, "credit_amount"), p.CreditAmount)
+	}
+	b = jsonenc.String(jsonenc.Key(b, "status"), p.Status)
+	if p.ReturnURL != "" {
+		b = jsonenc.String(jsonenc.Key(b, "return_url"), p.ReturnURL)
+	}
+	if p.ConfirmationURL != "" {
+		b = jsonenc.String(jsonenc.Key(b, "confirmation_url"), p.ConfirmationURL)
+	}
+	b = jsonenc.Time(jsonenc.Key(b, "created_at"), p.CreatedAt)
+	if p.Country != "" {
+		b = jsonenc.String(jsonenc.Key(b, "country"), p.Country)
+	}
+	if p.Region != "" {
+		b = jsonenc.String(jsonenc.Key(b, "region"), p.Region)
+	}
+	if p.Provider != "" {
+		b = jsonenc.String(jsonenc.Key(b, "provider"), p.Provider)
+	}
+	if len(p.Links) > 0 {
+		b = jsonenc.StringMap(jsonenc.Key(b, "links"), p.Links)
+	}
+	return append(b, '}')
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testPayments() []Payment {
+	created := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	return []Payment{
+		{ID: 1, OrderID: 2, Merchant: "shop", Amount: 9.99, Status: "completed", CreatedAt: created},
+		{
+			ID: 3, PublicID: "pay_3", OrderID: 4, Merchant: `<Shop> "deluxe" & co`, UserID: 5,
+			PaymentMethodID: 6, Amount: 1e21, UseStoreCredit: true, CreditAmount: 2.5,
+			Status: "requires_action", ReturnURL: "https://shop.example/return?a=1&b=2",
+			ConfirmationURL:   "https://pay.example/payments/3/challenge?token=t&return_to=x",
+			ConfirmationToken: "t", CreatedAt: created, Country: "DE", Region: "BE", Provider: "stripe",
+			Links: map[string]string{"self": "/payments/pay_3", "order": "/orders/4"},
+		},
+	}
+}
+
+func TestAppendJSONMatchesMarshal(t *testing.T) {
+	for _, p := range testPayments() {
+		want, err := json.Marshal(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.AppendJSON(nil); string(got) != string(want) {
+			t.Errorf("AppendJSON = %s\nwant          %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// payment-service/ledger.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/dbretry"
+	"platform/fields"
+)
+
+// Money movements recorded in the ledger
+const (
+	MovementAuthorization = "authorization"
+	MovementCapture       = "capture"
+	MovementFee           = "fee"
+	MovementRefund        = "refund"
+	MovementChargeback    = "chargeback"
+	MovementPayout        = "payout"
+	// MovementPayoutReversal undoes the payout of a reopened batch
+	MovementPayoutReversal = "payout_reversal"
+)
+
+// Ledger accounts. Money flows from the card network (receivable) through
+// the authorization hold to what is owed to the merchant, less our fees.
+const (
+	AccountCardReceivable  = "card_receivable"
+	AccountAuthorizations  = "authorizations"
+	AccountMerchantPayable = "merchant_payable"
+	AccountFeeRevenue      = "fee_revenue"
+	// AccountPayouts is money sent to merchants' bank accounts
+	AccountPayouts = "payouts"
+)
+
+// Posting moves cents into (debit, positive) or out of (credit, negative)
+// an account
+type Posting struct {
+	Account string
+	Amount  int64
+}
+
+// Journal is one movement; its postings must balance
+type Journal struct {
+	Movement string
+	Postings []Posting
+}
+
+func transfer(movement, debit, credit string, cents int64) Journal {
+	return Journal{Movement: movement, Postings: []Posting{
+		{Account: debit, Amount: cents},
+		{Account: credit, Amount: -cents},
+	}}
+}
+
+func (j Journal) validate() error {
+	var sum int64
+	for _, p := range j.Postings {
+		sum += p.Amount
+	}
+	if sum != 0 || len(j.Postings) < 2 {
+		return fmt.Errorf("unbalanced %s entry", j.Movement)
+	}
+	return nil
+}
+
+// LedgerEntry is one posting as stored, with the account's balance after it
+type LedgerEntry struct {
+	ID           int64     `json:"id"`
+	EntryID      int64     `json:"entry_id"`
+	PaymentID    int       `json:"payment_id,omitempty"`
+	BatchID      int64     `json:"settlement_batch_id,omitempty"`
+	Movement     string    `json:"movement"`
+	Account      string    `json:"account"`
+	AmountCents  int64     `json:"amount_cents"`
+	BalanceCents int64     `json:"balance_cents"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// FeeSchedule is what we keep of each capture
+type FeeSchedule struct {
+	Percent    float64
+	FixedCents int64
+}
+
+// ParseFeeSchedule reads "2.9%+0.30", "2.9%" or "0.30"
+func ParseFeeSchedule(spec string) (FeeSchedule, error) {
+	var f FeeSchedule
+	for part := range strings.SplitSeq(spec, "+") {
+		part = strings.TrimSpace(part)
+		if pct, ok := strings.CutSuffix(part, "%"); ok {
+			v, err := strconv.ParseFloat(pct, 64)
+			if err != nil || v < 0 || v > 100 {
+				return f, fmt.Errorf("invalid fee percentage %q", part)
+			}
+			f.Percent = v
+			continue
+		}
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return f, fmt.Errorf("invalid fixed fee %q", part)
+		}
+		f.FixedCents = toCents(v)
+	}
+	return f, nil
+}
+
+// Fee never exceeds the amount it is charged on
+func (f FeeSchedule) Fee(cents int64) int64 {
+	fee := int64(math.Round(float64(cents)*f.Percent/100)) + f.FixedCents
+	return min(fee, cents)
+}
+
+// chargeJournal records an approved payment: any store credit spent, then
+// the card authorization, its immediate capture and our fee on the card part
+func (s *PaymentService) chargeJournal(p *Payment) []Journal {
+	credit := toCents(p.CreditAmount)
+	card := toCents(p.Amount) - credit
+	var journal []Journal
+	if credit > 0 {
+		journal = append(journal, transfer(MovementStoreCredit, storeCreditAccount(p.UserID), AccountMerchantPayable, credit))
+	}
+	if card > 0 {
+		journal = append(journal,
+			transfer(MovementAuthorization, AccountCardReceivable, AccountAuthorizations, card),
+			transfer(MovementCapture, AccountAuthorizations, AccountMerchantPayable, card))
+		if fee := s.fees.Fee(card); fee > 0 {
+			journal = append(journal, transfer(MovementFee, AccountMerchantPayable, AccountFeeRevenue, fee))
+		}
+	}
+	return journal
+}
+
+// reversible is what is left of a payment to refund or charge back, split
+// into the part paid with store credit and the part paid by card
+func reversible(payment *Payment, ledger []LedgerEntry) (credit, card int64) {
+	credit = toCents(payment.CreditAmount)
+	card = toCents(payment.Amount) - credit
+	for _, e := range ledger {
+		if e.Movement != MovementRefund && e.Movement != MovementChargeback {
+			continue
+		}
+		switch {
+		case isStoreCreditAccount(e.Account):
+			credit += e.AmountCents
+		case e.Account == AccountCardReceivable:
+			card += e.AmountCents
+		}
+	}
+	return credit, card
+}
+
+var (
+	errNothingToReverse = errors.New("amount exceeds what is left of the payment")
+	errNotCaptured      = errors.New("payment captured nothing to reverse")
+)
+
+func (s *PaymentService) Ledger(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := s.paymentIDParam(r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if _, err := s.repo.Get(r.Context(), paymentID); errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	ledger, err := s.repo.Ledger(r.Context(), paymentID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if ledger == nil {
+		ledger = []LedgerEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields.Select(w, r, ledger))
+}
+
+type reversalRequest struct {
+	// Amount defaults to everything not yet refunded or charged back
+	Amount float64 `json:"amount"`
+}
+
+// reverse returns money to the customer for a refund or chargeback
+func (s *PaymentService) reverse(movement string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paymentID, err := s.paymentIDParam(r)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		var req reversalRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Amount < 0 {
+			http.Error(w, "amount must be positive", http.StatusBadRequest)
+			return
+		}
+
+		payment, err := s.repo.Adjust(r.Context(), paymentID, func(p *Payment, ledger []LedgerEntry) ([]Journal, error) {
+			// Payments awaiting a challenge, failed or canceled captured
+			// nothing to give back
+			if p.Status != "completed" && p.Status != "partially_refunded" {
+				return nil, errNotCaptured
+			}
+			credit, card := reversible(p, ledger)
+			// Chargebacks come from the card network, so only reach the
+			// card part; refunds go back to store credit first
+			left := credit + card
+			if movement == MovementChargeback {
+				left, credit = card, 0
+			}
+			cents := toCents(req.Amount)
+			if cents == 0 {
+				cents = left
+			}
+			if cents == 0 || cents > left {
+				return nil, errNothingToReverse
+			}
+			switch {
+			case movement == MovementChargeback:
+				p.Status = "charged_back"
+			case cents == left:
+				p.Status = "refunded"
+			default:
+				p.Status = "partially_refunded"
+			}
+
+			toCredit := min(cents, credit)
+			journal := Journal{Movement: movement, Postings: []Posting{{Account: AccountMerchantPayable, Amount: cents}}}
+			if toCredit > 0 {
+				journal.Postings = append(journal.Postings, Posting{Account: storeCreditAccount(p.UserID), Amount: -toCredit})
+			}
+			if cents > toCredit {
+				journal.Postings = append(journal.Postings, Posting{Account: AccountCardReceivable, Amount: toCredit - cents})
+			}
+			return []Journal{journal}, nil
+		})
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errNothingToReverse) || errors.Is(err, errNotCaptured) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.withLinks(r, payment))
+	}
+}
+
+// journalAccounts lists the accounts journals touch, sorted, so concurrent
+// transactions lock account rows in the same order
+func journalAccounts(journals []Journal) []string {
+	var accounts []string
+	for _, j := range journals {
+		for _, p := range j.Postings {
+			accounts = append(accounts, p.Account)
+		}
+	}
+	slices.Sort(accounts)
+	return slices.Compact(accounts)
+}
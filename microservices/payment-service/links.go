@@ -0,0 +1,47 @@
+// payment-service/links.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"platform/middleware"
+)
+
+// Paths of other services' resources as the gateway serves them; they
+// aren't in this service's route table
+const (
+	orderPath = "/orders/"
+	userPath  = "/users/"
+)
+
+// withLinks adds the actions open on p to it, given its status and the
+// caller, so clients follow links instead of building URLs
+func (s *PaymentService) withLinks(r *http.Request, p *Payment) *Payment {
+	if s.routes == nil {
+		return p
+	}
+	id := p.PublicID
+	if id == "" {
+		id = strconv.Itoa(p.ID)
+	}
+	links := map[string]string{
+		"self":   s.routes.Path("get-payment", id),
+		"ledger": s.routes.Path("get-payment-ledger", id),
+		"order":  orderPath + strconv.Itoa(p.OrderID),
+	}
+	if p.UserID != 0 {
+		links["user"] = userPath + strconv.Itoa(p.UserID)
+	}
+	switch p.Status {
+	case "requires_action":
+		links["cancel"] = s.routes.Path("cancel-payment", id)
+	case "completed", "partially_refunded":
+		// Refunds are an operator action
+		if caller, ok := middleware.PrincipalFromContext(r.Context()); !ok || caller.HasRole("admin") {
+			links["refund"] = s.routes.Path("refund-payment", id)
+		}
+	}
+	p.Links = links
+	return p
+}
@@ -0,0 +1,532 @@
+// payment-service/main.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/backup"
+	"platform/clock"
+	"platform/codec"
+	"platform/dbretry"
+	"platform/events"
+	"platform/fields"
+	"platform/files"
+	"platform/jsonenc"
+	"platform/middleware"
+	"platform/migrate"
+	"platform/router"
+	"platform/server"
+	"platform/signing"
+	"platform/startup"
+
+	_ "github.com/lib/pq"
+)
+
+// Payments without a merchant settle to this one
+const defaultMerchant = "default"
+
+// Signed requests may be this far off our clock
+const defaultSigningSkew = 30 * time.Second
+
+// Payment is one charge of an order. A payment in requires_action waits for
+// the customer to authenticate at ConfirmationURL, which is only sent in the
+// response that creates it; they are then sent on to ReturnURL. With
+// UseStoreCredit the user's store credit pays first, CreditAmount of it, and
+// the card only the rest.
+type Payment struct {
+	// PublicID is the ID to hand out; ID, the serial key, is still
+	// accepted in paths while clients move over
+	ID                int       `json:"id"`
+	PublicID          string    `json:"public_id,omitempty"`
+	OrderID           int       `json:"order_id"`
+	Merchant          string    `json:"merchant"`
+	UserID            int       `json:"user_id,omitempty"`
+	PaymentMethodID   int64     `json:"payment_method_id,omitempty"`
+	Amount            float64   `json:"amount"`
+	UseStoreCredit    bool      `json:"use_store_credit,omitempty"`
+	CreditAmount      float64   `json:"credit_amount,omitempty"`
+	Status            string    `json:"status"`
+	ReturnURL         string    `json:"return_url,omitempty"`
+	ConfirmationURL   string    `json:"confirmation_url,omitempty"`
+	ConfirmationToken string    `json:"-"`
+	CreatedAt         time.Time `json:"created_at"`
+	// Country and Region are where the buyer was, as order-service was
+	// told; Provider is the name of the provider route they picked
+	Country  string `json:"country,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	// Links are the payment's resource and the actions open on it
+	Links map[string]string `json:"links,omitempty"`
+}
+
+type PaymentService struct {
+	repo      Repository
+	fees      FeeSchedule
+	challenge Challenge
+	// providers are the provider endpoints by buyer region; without any,
+	// customers authenticate at the challenge's ProviderURL
+	providers ProviderRoutes
+	// routes builds the links in payment responses
+	routes *router.Router
+	clock  clock.Clock
+}
+
+func NewPaymentService(repo Repository, fees FeeSchedule, challenge Challenge) *PaymentService {
+	return &PaymentService{repo: repo, fees: fees, challenge: challenge, clock: clock.System}
+}
+
+// CreatePayment charges an order. With a user_id it charges the stored
+// payment_method_id, or the user's default card when that is omitted.
+func (s *PaymentService) CreatePayment(w http.ResponseWriter, r *http.Request) {
+	var payment Payment
+	if err := codec.Decode(r, &payment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payment.OrderID <= 0 || payment.Amount <= 0 {
+		http.Error(w, "order_id and a positive amount are required", http.StatusBadRequest)
+		return
+	}
+	if payment.ReturnURL != "" && !s.challenge.returnAllowed(payment.ReturnURL) {
+		http.Error(w, "return_url is not on an allowed origin", http.StatusBadRequest)
+		return
+	}
+
+	if payment.Merchant == "" {
+		payment.Merchant = defaultMerchant
+	}
+	if payment.PaymentMethodID != 0 && payment.UserID == 0 {
+		http.Error(w, "payment_method_id needs user_id", http.StatusBadRequest)
+		return
+	}
+	// A user's stored cards and store credit are spent only by them, or by
+	// order-service, which checks the buyer and calls as an admin
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok && payment.UserID != 0 &&
+		p.Subject != strconv.Itoa(payment.UserID) && !p.HasRole("admin") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if payment.UserID != 0 {
+		method, err := s.paymentMethod(r.Context(), payment.UserID, payment.PaymentMethodID)
+		if errors.Is(err, errUnusableMethod) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		if method != nil {
+			payment.PaymentMethodID = method.ID
+		}
+	}
+	payment.CreditAmount = 0
+	if payment.UseStoreCredit {
+		if payment.UserID == 0 {
+			http.Error(w, "use_store_credit needs user_id", http.StatusBadRequest)
+			return
+		}
+		available, err := s.repo.CreditBalance(r.Context(), payment.UserID)
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		payment.CreditAmount = float64(min(available, toCents(payment.Amount))) / 100
+	}
+
+	payment.Provider = ""
+	if route, ok := s.providers.For(payment.Country, payment.Region); ok {
+		payment.Provider = route.Name
+	}
+	middleware.Debugf(r.Context(), "order %d: paying %.2f (%.2f from store credit) with method %d via provider %q",
+		payment.OrderID, payment.Amount, payment.CreditAmount, payment.PaymentMethodID, payment.Provider)
+
+	// No real provider yet: every payment is approved, some after a
+	// challenge. A provider would charge the stored method's token here,
+	// at the endpoint of payment.Provider's route.
+	payment.Status = "completed"
+	payment.ConfirmationURL = ""
+	payment.CreatedAt = s.clock.Now()
+	journals := s.chargeJournal(&payment)
+	if s.challenge.required(&payment) {
+		// Nothing moves until the customer has authenticated
+		s.challenge.begin(&payment)
+		journals = nil
+	}
+	err := s.repo.Create(r.Context(), &payment, journals)
+	if errors.Is(err, errInsufficientCredit) {
+		// Spent elsewhere since we read the balance
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if payment.Status == "requires_action" {
+		payment.ConfirmationURL = s.challenge.url(&payment, s.providers.URL(payment.Provider))
+		status = http.StatusAccepted
+	}
+	codec.Write(w, r, status, s.withLinks(r, &payment))
+}
+
+var errUnusableMethod = errors.New("payment method not found or expired")
+
+// paymentMethod picks the stored card to charge: the one asked for, else
+// the user's default, else none (card details came with the checkout)
+func (s *PaymentService) paymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error) {
+	var method *PaymentMethod
+	var err error
+	if id != 0 {
+		method, err = s.repo.PaymentMethod(ctx, userID, id)
+	} else {
+		method, err = s.repo.DefaultPaymentMethod(ctx, userID)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, errUnusableMethod
+	}
+	if err != nil {
+		return nil, err
+	}
+	if method.Expired(s.clock.Now()) {
+		return nil, errUnusableMethod
+	}
+	return method, nil
+}
+
+func (s *PaymentService) GetPayment(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := s.paymentIDParam(r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	payment, err := s.repo.Get(r.Context(), paymentID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	payment = s.withLinks(r, payment)
+	selected := fields.Select(w, r, payment)
+	if _, all := selected.(*Payment); all {
+		jsonenc.Write(w, http.StatusOK, payment.AppendJSON)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(selected)
+}
+
+const maxListedPayments = 1000
+
+// ListPayments returns payments made in [?from, ?to), RFC 3339 times, with
+// ?status and up to ?limit of them, oldest first
+func (s *PaymentService) ListPayments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := PaymentFilter{Status: q.Get("status"), Limit: 100}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.CreatedFrom}, {"to", &filter.CreatedTo}} {
+		if v := q.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, bound.name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListedPayments {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListedPayments), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	payments, err := s.repo.Payments(r.Context(), filter)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if payments == nil {
+		payments = []Payment{}
+	}
+	for i := range payments {
+		payments[i] = *s.withLinks(r, &payments[i])
+	}
+	writeJSON(w, http.StatusOK, payments)
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	dbURL := os.Getenv("DATABASE_URL")
+
+	// "backup [file]" and "restore [file]" dump and restore the schema, for
+	// disaster recovery drills
+	if len(os.Args) > 1 {
+		if err := backup.Command(context.Background(), os.Args[1:], "payment-service", dbURL, schema, migrations()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	repo, database, err := openRepository(os.Getenv("STORAGE"), dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	boot, err := startup.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if database != nil {
+		boot.Add(*database)
+	}
+	// Files and ERP exports publish events; payments themselves don't yet
+	emitter := events.NewEmitter("payment-service", events.FromEnv())
+	if url := os.Getenv("EVENTS_URL"); url != "" {
+		boot.Add(startup.Dependency{Name: "events", Check: startup.Reachable(url), SelfTest: emitter.Ping, Optional: true})
+	}
+	var fees FeeSchedule
+	if spec := os.Getenv("PAYMENT_FEE"); spec != "" {
+		if fees, err = ParseFeeSchedule(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	challenge := Challenge{
+		BaseURL:     getEnv("PAYMENT_PUBLIC_URL", "http://localhost:8083"),
+		ProviderURL: os.Getenv("THREE_DS_PROVIDER_URL"),
+	}
+	// PAYMENT_RETURN_ORIGINS lists the origins return_url may point at;
+	// without it payments take no return_url
+	for origin := range strings.SplitSeq(os.Getenv("PAYMENT_RETURN_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin == "" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			log.Fatalf("invalid PAYMENT_RETURN_ORIGINS origin %q", origin)
+		}
+		challenge.ReturnOrigins = append(challenge.ReturnOrigins, origin)
+	}
+	if v := os.Getenv("THREE_DS_THRESHOLD"); v != "" {
+		if challenge.Threshold, err = strconv.ParseFloat(v, 64); err != nil || challenge.Threshold < 0 {
+			log.Fatalf("invalid THREE_DS_THRESHOLD %q", v)
+		}
+	}
+	service := NewPaymentService(repo, fees, challenge)
+	skew := defaultSigningSkew
+	if v := os.Getenv("SIGNING_SKEW"); v != "" {
+		if skew, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid SIGNING_SKEW %q", v)
+		}
+	}
+	// Only the provider settles challenges, signing its results with
+	// THREE_DS_SIGNING_KEYS; without them nothing can be challenged
+	var completeChallenge http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "challenges are not configured", http.StatusServiceUnavailable)
+	})
+	if spec := os.Getenv("THREE_DS_SIGNING_KEYS"); spec != "" {
+		keys, err := signing.ParseKeyring(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		completeChallenge = signing.Require(keys, skew, "3ds-provider")(http.HandlerFunc(service.CompleteChallenge))
+	} else if challenge.Threshold > 0 {
+		log.Fatal("THREE_DS_THRESHOLD needs THREE_DS_SIGNING_KEYS")
+	}
+	// PAYMENT_PROVIDER_ROUTES routes payments by the buyer's region
+	if spec := os.Getenv("PAYMENT_PROVIDER_ROUTES"); spec != "" {
+		if service.providers, err = ParseProviderRoutes(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, fallback := service.providers.For("", ""); challenge.Threshold > 0 && challenge.ProviderURL == "" && !fallback {
+		log.Fatal("THREE_DS_THRESHOLD needs THREE_DS_PROVIDER_URL or a provider route without codes")
+	}
+
+	// Only order-service may charge; without SIGNING_KEYS (local
+	// development) requests are accepted unsigned
+	var createPayment http.Handler = http.HandlerFunc(service.CreatePayment)
+	if spec := os.Getenv("SIGNING_KEYS"); spec != "" {
+		keys, err := signing.ParseKeyring(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		createPayment = signing.Require(keys, skew, "order-service")(createPayment)
+	} else {
+		log.Print("SIGNING_KEYS not set; accepting unsigned payment requests")
+	}
+
+	rt := router.New()
+	service.routes = rt
+	rt.Handle("create-payment", http.MethodPost, "/payments", createPayment)
+	rt.Get("get-payment", "/payments/{id}", service.GetPayment)
+	rt.Get("get-payment-ledger", "/payments/{id}/ledger", service.Ledger)
+	rt.Handle("complete-payment-challenge", http.MethodPost, "/payments/{id}/challenge", completeChallenge)
+	rt.Get("return-from-payment-challenge", "/payments/{id}/challenge", service.ReturnFromChallenge)
+	rt.Post("cancel-payment", "/payments/{id}/cancel", service.CancelPayment)
+	// Refunds and chargebacks are operator actions until a provider
+	// integration reports chargebacks itself
+	admin := middleware.RequireRole("admin")
+	rt.Handle("list-payments", http.MethodGet, "/payments", admin(http.HandlerFunc(service.ListPayments)))
+	rt.Handle("refund-payment", http.MethodPost, "/payments/{id}/refunds",
+		admin(service.reverse(MovementRefund)))
+	rt.Handle("record-chargeback", http.MethodPost, "/payments/{id}/chargebacks",
+		admin(service.reverse(MovementChargeback)))
+
+	methods := &PaymentMethodAPI{repo: repo, clock: service.clock}
+	rt.Get("list-payment-methods", "/users/{id}/payment-methods", methods.List)
+	rt.Post("add-payment-method", "/users/{id}/payment-methods", methods.Add)
+	rt.Get("get-payment-method", "/users/{id}/payment-methods/{method}", methods.Get)
+	rt.Delete("delete-payment-method", "/users/{id}/payment-methods/{method}", methods.Delete)
+	rt.Put("set-default-payment-method", "/users/{id}/payment-methods/{method}/default", methods.SetDefault)
+
+	credit := &StoreCreditAPI{repo: repo}
+	rt.Get("get-store-credit", "/users/{id}/store-credit", credit.Get)
+	rt.Handle("issue-store-credit", http.MethodPost, "/users/{id}/store-credit",
+		middleware.RequireRole("admin", "support")(http.HandlerFunc(credit.Issue)))
+	rt.Post("redeem-gift-card", "/users/{id}/store-credit/redeem", credit.Redeem)
+	rt.Handle("create-gift-card", http.MethodPost, "/gift-cards", admin(http.HandlerFunc(credit.CreateGiftCard)))
+	rt.Handle("get-gift-card", http.MethodGet, "/gift-cards/{code}", admin(http.HandlerFunc(credit.GetGiftCard)))
+
+	rt.Handle("merge-user", http.MethodPost, "/users/{id}/merge", admin(http.HandlerFunc(service.MergeUser)))
+
+	settlements := &SettlementAPI{repo: repo, clock: service.clock}
+	finance := middleware.RequireRole("admin", "finance")
+	// Settling and exporting run over a day's ledger
+	report := dbretry.ReportingQueries
+	rt.Handle("run-settlement", http.MethodPost, "/settlements/run", finance(report(http.HandlerFunc(settlements.Run))))
+	rt.Handle("list-settlement-batches", http.MethodGet, "/settlements/batches", finance(http.HandlerFunc(settlements.List)))
+	rt.Handle("get-settlement-batch", http.MethodGet, "/settlements/batches/{id}", finance(http.HandlerFunc(settlements.Get)))
+	rt.Handle("export-settlement-batch", http.MethodGet, "/settlements/batches/{id}/export",
+		finance(report(http.HandlerFunc(settlements.Export))))
+	rt.Handle("close-settlement-batch", http.MethodPost, "/settlements/batches/{id}/close",
+		finance(http.HandlerFunc(settlements.Close)))
+	rt.Handle("reopen-settlement-batch", http.MethodPost, "/settlements/batches/{id}/reopen",
+		finance(http.HandlerFunc(settlements.Reopen)))
+
+	// Invoices are the buyer's to read and finance's to file; evidence for
+	// disputing a chargeback is attached to its payment ("payment/42");
+	// order imports are files for order-service to import in the background
+	bucket, err := files.BucketFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var documents *files.Service
+	if bucket != nil {
+		var store files.Repository = files.NewMemoryRepository()
+		if pg, ok := repo.(*PostgresPaymentRepository); ok {
+			store = files.NewPostgresRepository(pg.db)
+		}
+		documents = files.New(bucket, store, files.ScannerFromEnv(), emitter,
+			files.Kind{Name: "invoice", Retention: 10 * 365 * 24 * time.Hour, MaxSize: 10 << 20,
+				ContentTypes: []string{"application/pdf"}, Roles: []string{"finance"}},
+			files.Kind{Name: "evidence", Retention: 2 * 365 * 24 * time.Hour, MaxSize: 20 << 20,
+				ContentTypes: []string{"application/pdf", "image/png", "image/jpeg"}, Roles: []string{"support", "finance"}},
+			files.Kind{Name: "order_import", Retention: 30 * 24 * time.Hour, MaxSize: 32 << 20,
+				ContentTypes: []string{"text/csv", "application/x-ndjson"}, Roles: []string{"integrator"}},
+		)
+		rt.Post("create-file", "/files", documents.Create)
+		rt.Get("list-files", "/files", documents.List)
+		rt.Get("get-file", "/files/{id}", documents.Get)
+		rt.Post("complete-file", "/files/{id}/complete", documents.Complete)
+		rt.Delete("delete-file", "/files/{id}", documents.Delete)
+	} else {
+		log.Print("FILES_S3_ENDPOINT not set; file storage is off")
+	}
+	exporter := erpExporter(repo, emitter)
+	if exporter != nil {
+		rt.Handle("list-erp-exports", http.MethodGet, "/admin/erp/exports", finance(http.HandlerFunc(exporter.List)))
+		rt.Handle("get-erp-exports", http.MethodGet, "/admin/erp/exports/{day}", finance(http.HandlerFunc(exporter.Day)))
+		rt.Handle("retry-erp-export", http.MethodPost, "/admin/erp/exports/{day}/{kind}/retry",
+			finance(http.HandlerFunc(exporter.Retry)))
+	}
+	rt.ServeOpenAPI("payment-service", "1.0")
+
+	opts, err := server.OptionsFromEnv("Payment service", ":8083")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Backfills and contractions wait until the service is up
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	if pg, ok := repo.(*PostgresPaymentRepository); ok {
+		opts.PoolStats = pg.Stats
+		online := migrate.NewOnline(pg.db.DB, migrations(), schema)
+		go func() {
+			<-boot.Ready()
+			online.Run(jobsCtx, 30*time.Second)
+		}()
+	}
+	if documents != nil {
+		interval := 5 * time.Minute
+		if v := os.Getenv("FILES_INTERVAL"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+				log.Fatalf("invalid FILES_INTERVAL %q", v)
+			}
+		}
+		go func() {
+			<-boot.Ready()
+			documents.Run(jobsCtx, interval)
+		}()
+	}
+	// Export captured payments to the ERP every ERP_INTERVAL (0 turns it
+	// off, leaving only retries from the API)
+	if exporter != nil {
+		interval := 5 * time.Minute
+		if v := os.Getenv("ERP_INTERVAL"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil || interval < 0 {
+				log.Fatalf("invalid ERP_INTERVAL %q", v)
+			}
+		}
+		if interval > 0 {
+			go func() {
+				<-boot.Ready()
+				exporter.Run(jobsCtx, interval)
+			}()
+		}
+	}
+	opts.Startup = boot
+	// Providers send customers' browsers back from a challenge, and post
+	// its result, without a token; the result is signed instead
+	opts.PublicPaths = []string{"/payments/{id}/challenge"}
+	rt.Limit(opts.Limits)
+	srv := server.NewServer(opts, rt)
+	if documents != nil {
+		srv.Metrics.Register(documents)
+	}
+	if err := srv.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+// payment-service/merge.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"platform/dbretry"
+	"platform/router"
+)
+
+// MergeRepository follows user-service's account merges
+type MergeRepository interface {
+	// MergeUser moves user from's payments, cards and store credit to user
+	// to. The target keeps its default card. Running it again changes
+	// nothing.
+	MergeUser(ctx context.Context, from, to int) error
+}
+
+func (r *PostgresPaymentRepository) MergeUser(ctx context.Context, from, to int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		for _, id := range []int{min(from, to), max(from, to)} {
+			if err := lockUserMethods(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+		statements := []string{
+			`UPDATE payments SET user_id = $2 WHERE user_id = $1`,
+			`UPDATE payment_methods SET is_default = false
+         WHERE user_id = $1 AND EXISTS (SELECT 1 FROM payment_methods WHERE user_id = $2 AND is_default)`,
+			`UPDATE payment_methods SET user_id = $2 WHERE user_id = $1`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt, from, to); err != nil {
+				return err
+			}
+		}
+
+		// Credit balances are negative; whatever we owe the source moves over
+		var balance int64
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE((SELECT balance_cents FROM ledger_accounts WHERE name = $1 FOR UPDATE), 0)`,
+			storeCreditAccount(from)).Scan(&balance)
+		if err != nil {
+			return err
+		}
+		if balance < 0 {
+			journal := transfer(MovementCreditTransfer, storeCreditAccount(from), storeCreditAccount(to), -balance)
+			if err := post(ctx, tx, ledgerRef{}, []Journal{journal}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *MemoryPaymentRepository) MergeUser(ctx context.Context, from, to int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, p := range r.payments {
+		if p.UserID == from {
+			p.UserID = to
+			r.payments[id] = p
+		}
+	}
+	targetDefault := false
+	for _, m := range r.methods {
+		targetDefault = targetDefault || (m.UserID == to && m.Default)
+	}
+	for _, m := range r.methods {
+		if m.UserID == from {
+			m.UserID = to
+			m.Default = m.Default && !targetDefault
+		}
+	}
+
+	if balance := r.balances[storeCreditAccount(from)]; balance < 0 {
+		journal := transfer(MovementCreditTransfer, storeCreditAccount(from), storeCreditAccount(to), -balance)
+		return r.post(ledgerRef{}, []Journal{journal})
+	}
+	return nil
+}
+
+// MergeUser is user-service's account merge step for payment-service: it
+// moves the path's user's payments, cards and store credit to the user in
+// {"into": id}
+func (s *PaymentService) MergeUser(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Into int `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Into <= 0 || req.Into == from {
+		http.Error(w, "into must be another user", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.repo.MergeUser(r.Context(), from, req.Into); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
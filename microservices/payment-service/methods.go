@@ -0,0 +1,511 @@
+// payment-service/methods.go
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/fields"
+	"platform/middleware"
+	"platform/router"
+)
+
+// PaymentMethod is a card the customer saved with the provider. We keep the
+// provider's token and enough to show the card ("Visa •••• 4242"), never
+// the card number.
+type PaymentMethod struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Token     string    `json:"token"`
+	Brand     string    `json:"brand,omitempty"`
+	Last4     string    `json:"last4,omitempty"`
+	ExpMonth  int       `json:"exp_month,omitempty"`
+	ExpYear   int       `json:"exp_year,omitempty"`
+	Default   bool      `json:"default"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Expired reports whether the card's expiry month has passed at now
+func (m *PaymentMethod) Expired(now time.Time) bool {
+	if m.ExpYear == 0 {
+		return false
+	}
+	y, mo, _ := now.Date()
+	return m.ExpYear < y || (m.ExpYear == y && m.ExpMonth < int(mo))
+}
+
+var errDuplicateMethod = errors.New("payment method already saved")
+
+// PaymentMethodRepository stores users' tokenized cards. A user's first
+// card becomes the default, and deleting the default promotes the newest
+// remaining card.
+type PaymentMethodRepository interface {
+	PaymentMethods(ctx context.Context, userID int) ([]PaymentMethod, error)
+	PaymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error)
+	// DefaultPaymentMethod returns ErrNotFound when the user has no cards
+	DefaultPaymentMethod(ctx context.Context, userID int) (*PaymentMethod, error)
+	AddPaymentMethod(ctx context.Context, m *PaymentMethod) error
+	SetDefaultPaymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error)
+	DeletePaymentMethod(ctx context.Context, userID int, id int64) error
+}
+
+// looksLikePAN catches card numbers sent where a token belongs: 12 to 19
+// digits, ignoring spaces and dashes, that pass the Luhn check
+func looksLikePAN(s string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(digits) < 12 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range len(digits) {
+		c := digits[len(digits)-1-i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+const methodColumns = `id, user_id, provider, token, brand, last4, exp_month, exp_year, is_default, created_at`
+
+func scanMethod(scan func(...any) error, m *PaymentMethod) error {
+	return scan(&m.ID, &m.UserID, &m.Provider, &m.Token, &m.Brand, &m.Last4,
+		&m.ExpMonth, &m.ExpYear, &m.Default, &m.CreatedAt)
+}
+
+func (r *PostgresPaymentRepository) PaymentMethods(ctx context.Context, userID int) ([]PaymentMethod, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+methodColumns+` FROM payment_methods
+              WHERE user_id = $1 ORDER BY is_default DESC, created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var methods []PaymentMethod
+	for rows.Next() {
+		var m PaymentMethod
+		if err := scanMethod(rows.Scan, &m); err != nil {
+			return nil, err
+		}
+		methods = append(methods, m)
+	}
+	return methods, rows.Err()
+}
+
+func (r *PostgresPaymentRepository) queryMethod(ctx context.Context, query string, args ...any) (*PaymentMethod, error) {
+	var m PaymentMethod
+	err := scanMethod(r.db.QueryRowContext(ctx, query, args...).Scan, &m)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r *PostgresPaymentRepository) PaymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error) {
+	return r.queryMethod(ctx, `SELECT `+methodColumns+` FROM payment_methods WHERE user_id = $1 AND id = $2`, userID, id)
+}
+
+func (r *PostgresPaymentRepository) DefaultPaymentMethod(ctx context.Context, userID int) (*PaymentMethod, error) {
+	return r.queryMethod(ctx, `SELECT `+methodColumns+` FROM payment_methods WHERE user_id = $1 AND is_default`, userID)
+}
+
+// lockUserMethods serializes default changes for one user
+func lockUserMethods(ctx context.Context, tx *sql.Tx, userID int) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('payment_methods'), $1)`, userID)
+	return err
+}
+
+func (r *PostgresPaymentRepository) AddPaymentMethod(ctx context.Context, m *PaymentMethod) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		if err := lockUserMethods(ctx, tx, m.UserID); err != nil {
+			return err
+		}
+		var others int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM payment_methods WHERE user_id = $1`, m.UserID).Scan(&others); err != nil {
+			return err
+		}
+		m.Default = m.Default || others == 0
+		if m.Default {
+			if _, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = false WHERE user_id = $1 AND is_default`, m.UserID); err != nil {
+				return err
+			}
+		}
+		err := tx.QueryRowContext(ctx, `INSERT INTO payment_methods
+              (user_id, provider, token, brand, last4, exp_month, exp_year, is_default)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+              ON CONFLICT (provider, token) DO NOTHING
+              RETURNING id, created_at`,
+			m.UserID, m.Provider, m.Token, m.Brand, m.Last4, m.ExpMonth, m.ExpYear, m.Default).Scan(&m.ID, &m.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errDuplicateMethod
+		}
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *PostgresPaymentRepository) SetDefaultPaymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error) {
+	var method *PaymentMethod
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		if err := lockUserMethods(ctx, tx, userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = false
+              WHERE user_id = $1 AND is_default AND id <> $2`, userID, id); err != nil {
+			return err
+		}
+		var m PaymentMethod
+		err := scanMethod(tx.QueryRowContext(ctx, `UPDATE payment_methods SET is_default = true
+              WHERE user_id = $1 AND id = $2 RETURNING `+methodColumns, userID, id).Scan, &m)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		method = &m
+		return nil
+	})
+	return method, err
+}
+
+func (r *PostgresPaymentRepository) DeletePaymentMethod(ctx context.Context, userID int, id int64) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		if err := lockUserMethods(ctx, tx, userID); err != nil {
+			return err
+		}
+		var wasDefault bool
+		err := tx.QueryRowContext(ctx, `DELETE FROM payment_methods WHERE user_id = $1 AND id = $2 RETURNING is_default`,
+			userID, id).Scan(&wasDefault)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if wasDefault {
+			_, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = true WHERE id = (
+                  SELECT id FROM payment_methods WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1)`, userID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *MemoryPaymentRepository) userMethods(userID int) []PaymentMethod {
+	var methods []PaymentMethod
+	for _, m := range r.methods {
+		if m.UserID == userID {
+			methods = append(methods, *m)
+		}
+	}
+	// Default first, then newest first, as in Postgres
+	slices.SortStableFunc(methods, func(a, b PaymentMethod) int {
+		if a.Default != b.Default {
+			if a.Default {
+				return -1
+			}
+			return 1
+		}
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return methods
+}
+
+func (r *MemoryPaymentRepository) PaymentMethods(ctx context.Context, userID int) ([]PaymentMethod, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.userMethods(userID), nil
+}
+
+func (r *MemoryPaymentRepository) PaymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.methods[id]
+	if !ok || m.UserID != userID {
+		return nil, ErrNotFound
+	}
+	c := *m
+	return &c, nil
+}
+
+func (r *MemoryPaymentRepository) DefaultPaymentMethod(ctx context.Context, userID int) (*PaymentMethod, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	methods := r.userMethods(userID)
+	if len(methods) == 0 || !methods[0].Default {
+		return nil, ErrNotFound
+	}
+	return &methods[0], nil
+}
+
+// setDefault makes id the user's only default; r.mu must be held
+func (r *MemoryPaymentRepository) setDefault(userID int, id int64) {
+	for _, m := range r.methods {
+		if m.UserID == userID {
+			m.Default = m.ID == id
+		}
+	}
+}
+
+func (r *MemoryPaymentRepository) AddPaymentMethod(ctx context.Context, m *PaymentMethod) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.methods {
+		if existing.Provider == m.Provider && existing.Token == m.Token {
+			return errDuplicateMethod
+		}
+	}
+	r.nextMethodID++
+	m.ID = r.nextMethodID
+	m.CreatedAt = clock.System.Now()
+	m.Default = m.Default || len(r.userMethods(m.UserID)) == 0
+	c := *m
+	r.methods[m.ID] = &c
+	if m.Default {
+		r.setDefault(m.UserID, m.ID)
+	}
+	return nil
+}
+
+func (r *MemoryPaymentRepository) SetDefaultPaymentMethod(ctx context.Context, userID int, id int64) (*PaymentMethod, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.methods[id]
+	if !ok || m.UserID != userID {
+		return nil, ErrNotFound
+	}
+	r.setDefault(userID, id)
+	c := *m
+	return &c, nil
+}
+
+func (r *MemoryPaymentRepository) DeletePaymentMethod(ctx context.Context, userID int, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.methods[id]
+	if !ok || m.UserID != userID {
+		return ErrNotFound
+	}
+	delete(r.methods, id)
+	if m.Default {
+		if rest := r.userMethods(userID); len(rest) > 0 {
+			r.setDefault(userID, rest[0].ID)
+		}
+	}
+	return nil
+}
+
+// PaymentMethodAPI serves /users/{id}/payment-methods to the user and to
+// admins; the gateway routes it here rather than to user-service
+type PaymentMethodAPI struct {
+	repo  PaymentMethodRepository
+	clock clock.Clock
+}
+
+// userID reads the path's user and checks the caller may act for them
+func userID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(router.Param(r, "id"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok &&
+		p.Subject != strconv.Itoa(id) && !p.HasRole("admin") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return id, true
+}
+
+func methodID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(router.Param(r, "method"), 10, 64)
+	if err != nil {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func (a *PaymentMethodAPI) List(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	methods, err := a.repo.PaymentMethods(r.Context(), user)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if methods == nil {
+		methods = []PaymentMethod{}
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, methods))
+}
+
+func (a *PaymentMethodAPI) Get(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	id, ok := methodID(w, r)
+	if !ok {
+		return
+	}
+	m, err := a.repo.PaymentMethod(r.Context(), user, id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fields.Select(w, r, m))
+}
+
+type addMethodRequest struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+	Default  bool   `json:"default"`
+}
+
+// Add saves a card the client already tokenized with the provider. Unknown
+// fields are rejected so a card number or CVC can't slip in under another
+// name.
+func (a *PaymentMethodAPI) Add(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var req addMethodRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m := PaymentMethod{
+		UserID:   user,
+		Provider: strings.TrimSpace(req.Provider),
+		Token:    strings.TrimSpace(req.Token),
+		Brand:    req.Brand,
+		Last4:    req.Last4,
+		ExpMonth: req.ExpMonth,
+		ExpYear:  req.ExpYear,
+		Default:  req.Default,
+	}
+	switch {
+	case m.Provider == "" || m.Token == "":
+		http.Error(w, "provider and token are required", http.StatusUnprocessableEntity)
+		return
+	case looksLikePAN(m.Token):
+		http.Error(w, "token looks like a card number; tokenize the card with the provider first", http.StatusUnprocessableEntity)
+		return
+	case m.Last4 != "" && (len(m.Last4) != 4 || strings.Trim(m.Last4, "0123456789") != ""):
+		http.Error(w, "last4 must be four digits", http.StatusUnprocessableEntity)
+		return
+	case (m.ExpMonth != 0 || m.ExpYear != 0) && (m.ExpMonth < 1 || m.ExpMonth > 12 || m.ExpYear < 2000):
+		http.Error(w, "exp_month must be 1-12 and exp_year a four-digit year", http.StatusUnprocessableEntity)
+		return
+	case m.Expired(a.clock.Now()):
+		http.Error(w, "card has expired", http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := a.repo.AddPaymentMethod(r.Context(), &m)
+	if errors.Is(err, errDuplicateMethod) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, m)
+}
+
+func (a *PaymentMethodAPI) SetDefault(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	id, ok := methodID(w, r)
+	if !ok {
+		return
+	}
+	m, err := a.repo.SetDefaultPaymentMethod(r.Context(), user, id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (a *PaymentMethodAPI) Delete(w http.ResponseWriter, r *http.Request) {
+	user, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	id, ok := methodID(w, r)
+	if !ok {
+		return
+	}
+	err := a.repo.DeletePaymentMethod(r.Context(), user, id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
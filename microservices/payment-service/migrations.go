@@ -0,0 +1,18 @@
+// payment-service/migrations.go
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Schema owned by payment-service; its migrations may not touch any other
+const schema = "payments"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func migrations() fs.FS {
+	sub, _ := fs.Sub(migrationFiles, "migrations")
+	return sub
+}
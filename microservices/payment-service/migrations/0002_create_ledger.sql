@@ -0,0 +1,22 @@
+-- Double-entry ledger. Each money movement is an entry of postings that sum
+-- to zero; debits are positive, credits negative, all in cents. Rows are
+-- only ever inserted: corrections are new entries.
+CREATE TABLE IF NOT EXISTS ledger_accounts (
+    name TEXT PRIMARY KEY,
+    balance_cents BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    entry_id BIGINT NOT NULL,
+    payment_id INTEGER NOT NULL REFERENCES payments (id),
+    movement TEXT NOT NULL,
+    account TEXT NOT NULL REFERENCES ledger_accounts (name),
+    amount_cents BIGINT NOT NULL,
+    balance_cents BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE SEQUENCE IF NOT EXISTS ledger_entry_ids;
+CREATE INDEX IF NOT EXISTS ledger_entries_payment_idx ON ledger_entries (payment_id, id);
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account, id);
@@ -0,0 +1,30 @@
+-- Payments belong to a merchant (a tenant), whose captured money is paid
+-- out in daily settlement batches. Payouts are ledger entries without a
+-- payment.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS merchant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE ledger_entries ALTER COLUMN payment_id DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS settlement_batches (
+    id BIGSERIAL PRIMARY KEY,
+    merchant TEXT NOT NULL,
+    day DATE NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open',
+    gross_cents BIGINT NOT NULL DEFAULT 0,
+    fee_cents BIGINT NOT NULL DEFAULT 0,
+    refund_cents BIGINT NOT NULL DEFAULT 0,
+    chargeback_cents BIGINT NOT NULL DEFAULT 0,
+    net_cents BIGINT NOT NULL DEFAULT 0,
+    closed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (merchant, day)
+);
+
+ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS settlement_batch_id BIGINT REFERENCES settlement_batches (id);
+
+-- Which merchant_payable postings a batch settles; each settles once
+CREATE TABLE IF NOT EXISTS settlement_entries (
+    ledger_entry_id BIGINT PRIMARY KEY REFERENCES ledger_entries (id),
+    batch_id BIGINT NOT NULL REFERENCES settlement_batches (id)
+);
+
+CREATE INDEX IF NOT EXISTS settlement_entries_batch_idx ON settlement_entries (batch_id);
@@ -0,0 +1,23 @@
+-- Stored cards are the provider's token plus what a customer needs to
+-- recognise the card. Card numbers never reach this service. user_id
+-- refers to user-service.
+CREATE TABLE IF NOT EXISTS payment_methods (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    token TEXT NOT NULL,
+    brand TEXT NOT NULL DEFAULT '',
+    last4 TEXT NOT NULL DEFAULT '',
+    exp_month INTEGER NOT NULL DEFAULT 0,
+    exp_year INTEGER NOT NULL DEFAULT 0,
+    is_default BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (provider, token)
+);
+
+CREATE INDEX IF NOT EXISTS payment_methods_user_idx ON payment_methods (user_id);
+-- At most one default per user
+CREATE UNIQUE INDEX IF NOT EXISTS payment_methods_default_idx ON payment_methods (user_id) WHERE is_default;
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS user_id INTEGER;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS payment_method_id BIGINT REFERENCES payment_methods (id) ON DELETE SET NULL;
@@ -0,0 +1,5 @@
+-- Payments that need the customer to authenticate (3-D Secure) wait in
+-- requires_action. confirmation_token proves a challenge result belongs to
+-- the payment; return_url is where the customer goes afterwards.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS confirmation_token TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS return_url TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,12 @@
+-- Store credit lives in the ledger, one store_credit:<user_id> account per
+-- user. Gift cards hold value until a user redeems one into their credit.
+CREATE TABLE IF NOT EXISTS gift_cards (
+    code TEXT PRIMARY KEY,
+    amount_cents BIGINT NOT NULL,
+    redeemed_by INTEGER,
+    redeemed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- The part of a payment paid with store credit; the rest went to the card
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS credit_amount NUMERIC(12, 2) NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+-- Payments get a random public ID for the API in place of the serial key.
+-- Existing payments are given one by the default; the numeric ID keeps
+-- working alongside while clients move over.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS public_id UUID NOT NULL DEFAULT gen_random_uuid();
+
+CREATE UNIQUE INDEX IF NOT EXISTS payments_public_id_idx ON payments (public_id);
@@ -0,0 +1,6 @@
+-- Where the buyer was, as the gateway located them, and the provider route
+-- chosen for the payment. Payments from before have neither.
+ALTER TABLE payments
+    ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS provider TEXT NOT NULL DEFAULT '';
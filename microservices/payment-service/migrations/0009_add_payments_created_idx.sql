@@ -0,0 +1,3 @@
+-- Listing payments by when they were made, for reconciling them against
+-- orders.
+CREATE INDEX IF NOT EXISTS payments_created_at_idx ON payments (created_at, id);
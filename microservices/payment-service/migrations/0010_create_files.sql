@@ -0,0 +1,20 @@
+-- Invoices and dispute evidence kept in object storage; see platform/files.
+CREATE TABLE IF NOT EXISTS files (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    scan_detail TEXT NOT NULL DEFAULT '',
+    retain_until TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS files_owner_idx ON files (owner, created_at);
+CREATE INDEX IF NOT EXISTS files_subject_idx ON files (subject) WHERE subject <> '';
+CREATE INDEX IF NOT EXISTS files_status_idx ON files (status, updated_at);
+CREATE INDEX IF NOT EXISTS files_retain_until_idx ON files (retain_until);
@@ -0,0 +1,51 @@
+// payment-service/publicid.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"platform/publicid"
+	"platform/router"
+)
+
+func (r *PostgresPaymentRepository) PaymentIDByPublicID(ctx context.Context, publicID string) (int, error) {
+	var id int
+	err := r.db.QueryRowContext(ctx, `SELECT id FROM payments WHERE public_id = $1`, publicID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (r *MemoryPaymentRepository) PaymentIDByPublicID(ctx context.Context, publicID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	publicID = strings.ToLower(publicID)
+	for id, p := range r.payments {
+		if p.PublicID == publicID {
+			return id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// paymentIDParam reads the {id} path parameter, which is either a
+// payment's public ID or, until clients have moved over, its numeric one.
+// Anything else is ErrNotFound.
+func (s *PaymentService) paymentIDParam(r *http.Request) (int, error) {
+	param := router.Param(r, "id")
+	if publicid.Valid(param) {
+		return s.repo.PaymentIDByPublicID(r.Context(), param)
+	}
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
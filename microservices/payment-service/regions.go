@@ -0,0 +1,87 @@
+// payment-service/regions.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ProviderRoute is a provider endpoint and the buyer locations it serves:
+// ISO country codes, e.g. DE, or subdivision codes, e.g. US-CA
+type ProviderRoute struct {
+	Name  string
+	URL   string
+	Codes []string
+}
+
+// ProviderRoutes sends each payment to the provider endpoint for where the
+// buyer is, so cards are charged, and customers authenticate, in their
+// region. A route without codes takes everyone the others don't.
+type ProviderRoutes []ProviderRoute
+
+// ParseProviderRoutes reads "name url code...; ...", e.g.
+//
+//	eu https://pay-eu.example DE FR IT; us https://pay-us.example US; default https://pay.example
+func ParseProviderRoutes(spec string) (ProviderRoutes, error) {
+	var routes ProviderRoutes
+	fallbacks := 0
+	for entry := range strings.SplitSeq(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("provider route %q needs a name and a URL", strings.TrimSpace(entry))
+		}
+		if u, err := url.Parse(fields[1]); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("provider route %s: invalid URL %q", fields[0], fields[1])
+		}
+		route := ProviderRoute{Name: fields[0], URL: strings.TrimSuffix(fields[1], "/")}
+		for _, code := range fields[2:] {
+			route.Codes = append(route.Codes, strings.ToUpper(code))
+		}
+		if len(route.Codes) == 0 {
+			fallbacks++
+		}
+		routes = append(routes, route)
+	}
+	if fallbacks > 1 {
+		return nil, errors.New("more than one provider route without codes")
+	}
+	return routes, nil
+}
+
+// For picks the route for a buyer: one naming their region, then one
+// naming their country, then the fallback
+func (routes ProviderRoutes) For(country, region string) (ProviderRoute, bool) {
+	for _, code := range []string{region, country} {
+		if code == "" {
+			continue
+		}
+		for _, r := range routes {
+			for _, c := range r.Codes {
+				if strings.EqualFold(c, code) {
+					return r, true
+				}
+			}
+		}
+	}
+	for _, r := range routes {
+		if len(r.Codes) == 0 {
+			return r, true
+		}
+	}
+	return ProviderRoute{}, false
+}
+
+// URL is the endpoint of the named route, "" for an unknown one
+func (routes ProviderRoutes) URL(name string) string {
+	for _, r := range routes {
+		if r.Name == name {
+			return r.URL
+		}
+	}
+	return ""
+}
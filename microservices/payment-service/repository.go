@@ -0,0 +1,442 @@
+// payment-service/repository.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/migrate"
+	"platform/publicid"
+	"platform/startup"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// PaymentRepository hides the storage backend from the handlers. Every
+// change to a payment's money is written to the ledger in the same
+// transaction.
+type PaymentRepository interface {
+	Create(ctx context.Context, payment *Payment, journals []Journal) error
+	Get(ctx context.Context, id int) (*Payment, error)
+	// Payments returns the payments matching filter, oldest first
+	Payments(ctx context.Context, filter PaymentFilter) ([]Payment, error)
+	// PaymentIDByPublicID maps a payment's public ID to its numeric one
+	PaymentIDByPublicID(ctx context.Context, publicID string) (int, error)
+	// Adjust locks the payment and passes it with its ledger to fn, then
+	// saves the payment's new status and the journals fn returns
+	Adjust(ctx context.Context, id int, fn AdjustFunc) (*Payment, error)
+	Ledger(ctx context.Context, paymentID int) ([]LedgerEntry, error)
+}
+
+// Repository is everything payment-service stores
+type Repository interface {
+	PaymentRepository
+	SettlementRepository
+	PaymentMethodRepository
+	CreditRepository
+	MergeRepository
+}
+
+// PaymentFilter selects payments; zero fields match everything
+type PaymentFilter struct {
+	// CreatedFrom and CreatedTo bound created_at, [from, to)
+	CreatedFrom, CreatedTo time.Time
+	Status                 string
+	Limit                  int
+}
+
+// createdRange turns a filter's bounds into parameters, an open end being
+// infinite rather than left out
+func (f PaymentFilter) createdRange() (from, to any) {
+	from, to = "-infinity", "infinity"
+	if !f.CreatedFrom.IsZero() {
+		from = f.CreatedFrom
+	}
+	if !f.CreatedTo.IsZero() {
+		to = f.CreatedTo
+	}
+	return from, to
+}
+
+type AdjustFunc func(p *Payment, ledger []LedgerEntry) ([]Journal, error)
+
+func validateJournals(journals []Journal) error {
+	for _, j := range journals {
+		if err := j.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openRepository selects the backend: "postgres" (default) for production,
+// "memory" for running locally without any external dependencies. The
+// database dependency is readied by startup, which retries it until it is
+// up, and round-trips a query in self-tests; memory has none.
+func openRepository(storage, dbURL string) (Repository, *startup.Dependency, error) {
+	switch storage {
+	case "", "postgres":
+		db, err := dbretry.Open(dbURL, schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The database may still be coming up; startup retries this
+		database := &startup.Dependency{Name: "database", SelfTest: startup.SQL(db.DB), Check: func(ctx context.Context) error {
+			if err := db.PingContext(ctx); err != nil {
+				return err
+			}
+			return migrate.Run(ctx, db.DB, migrations(), schema)
+		}}
+		return &PostgresPaymentRepository{db: db}, database, nil
+	case "memory":
+		return NewMemoryPaymentRepository(), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+type PostgresPaymentRepository struct {
+	db *dbretry.DB
+}
+
+// Stats exposes connection pool statistics for load shedding
+func (r *PostgresPaymentRepository) Stats() sql.DBStats {
+	return r.db.Stats()
+}
+
+func (r *PostgresPaymentRepository) Create(ctx context.Context, payment *Payment, journals []Journal) error {
+	if err := validateJournals(journals); err != nil {
+		return err
+	}
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		query := `INSERT INTO payments (order_id, merchant, user_id, payment_method_id, amount, credit_amount,
+                  status, confirmation_token, return_url, created_at, country, region, provider)
+              VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, 0), $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id, public_id`
+		err := tx.QueryRowContext(ctx, query, payment.OrderID, payment.Merchant, payment.UserID, payment.PaymentMethodID,
+			payment.Amount, payment.CreditAmount, payment.Status, payment.ConfirmationToken, payment.ReturnURL, payment.CreatedAt,
+			payment.Country, payment.Region, payment.Provider).Scan(&payment.ID, &payment.PublicID)
+		if err != nil {
+			return err
+		}
+		if err := post(ctx, tx, ledgerRef{PaymentID: payment.ID}, journals); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+const paymentColumns = `id, order_id, merchant, COALESCE(user_id, 0), COALESCE(payment_method_id, 0),
+              amount, credit_amount, status, confirmation_token, return_url, created_at, public_id,
+              country, region, provider`
+
+func scanPayment(scan func(...any) error, p *Payment) error {
+	return scan(&p.ID, &p.OrderID, &p.Merchant, &p.UserID, &p.PaymentMethodID, &p.Amount, &p.CreditAmount, &p.Status,
+		&p.ConfirmationToken, &p.ReturnURL, &p.CreatedAt, &p.PublicID, &p.Country, &p.Region, &p.Provider)
+}
+
+func (r *PostgresPaymentRepository) Get(ctx context.Context, id int) (*Payment, error) {
+	var payment Payment
+	err := scanPayment(r.db.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM payments WHERE id = $1", id).Scan, &payment)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (r *PostgresPaymentRepository) Payments(ctx context.Context, filter PaymentFilter) ([]Payment, error) {
+	from, to := filter.createdRange()
+	rows, err := r.db.QueryContext(ctx, `SELECT `+paymentColumns+` FROM payments
+              WHERE created_at >= $1 AND created_at < $2 AND ($3 = '' OR status = $3)
+              ORDER BY created_at, id LIMIT NULLIF($4, 0)`, from, to, filter.Status, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var payments []Payment
+	for rows.Next() {
+		var p Payment
+		if err := scanPayment(rows.Scan, &p); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+func (r *PostgresPaymentRepository) Adjust(ctx context.Context, id int, fn AdjustFunc) (*Payment, error) {
+	var adjusted *Payment
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var payment Payment
+		err := scanPayment(tx.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM payments WHERE id = $1 FOR UPDATE", id).Scan, &payment)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		ledger, err := queryLedger(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		journals, err := fn(&payment, ledger)
+		if err != nil {
+			return err
+		}
+		if err := validateJournals(journals); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE payments SET status = $1 WHERE id = $2", payment.Status, id); err != nil {
+			return err
+		}
+		if err := post(ctx, tx, ledgerRef{PaymentID: id}, journals); err != nil {
+			return err
+		}
+		adjusted = &payment
+		return nil
+	})
+	return adjusted, err
+}
+
+func (r *PostgresPaymentRepository) Ledger(ctx context.Context, paymentID int) ([]LedgerEntry, error) {
+	return queryLedger(ctx, r.db, paymentID)
+}
+
+const ledgerColumns = `id, entry_id, COALESCE(payment_id, 0), COALESCE(settlement_batch_id, 0),
+              movement, account, amount_cents, balance_cents, created_at`
+
+func scanLedgerEntry(scan func(...any) error, e *LedgerEntry) error {
+	return scan(&e.ID, &e.EntryID, &e.PaymentID, &e.BatchID, &e.Movement, &e.Account,
+		&e.AmountCents, &e.BalanceCents, &e.CreatedAt)
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryLedger(ctx context.Context, q querier, paymentID int) ([]LedgerEntry, error) {
+	rows, err := q.QueryContext(ctx, `SELECT `+ledgerColumns+` FROM ledger_entries WHERE payment_id = $1 ORDER BY id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ledger []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err := scanLedgerEntry(rows.Scan, &e); err != nil {
+			return nil, err
+		}
+		ledger = append(ledger, e)
+	}
+	return ledger, rows.Err()
+}
+
+// ledgerRef is what ledger entries are about: a payment, or for payouts a
+// settlement batch
+type ledgerRef struct {
+	PaymentID int
+	BatchID   int64
+}
+
+// post writes journals, keeping each account's running balance. Accounts
+// are locked up front, in order, so two transactions can't deadlock on
+// them. Spending more store credit than a user has fails the whole post.
+func post(ctx context.Context, tx *sql.Tx, ref ledgerRef, journals []Journal) error {
+	for _, account := range journalAccounts(journals) {
+		_, err := tx.ExecContext(ctx, `INSERT INTO ledger_accounts (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, account)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `SELECT 1 FROM ledger_accounts WHERE name = $1 FOR UPDATE`, account)
+		if err != nil {
+			return err
+		}
+	}
+	for _, j := range journals {
+		var entryID int64
+		if err := tx.QueryRowContext(ctx, `SELECT nextval('ledger_entry_ids')`).Scan(&entryID); err != nil {
+			return err
+		}
+		for _, p := range j.Postings {
+			var balance int64
+			err := tx.QueryRowContext(ctx, `UPDATE ledger_accounts SET balance_cents = balance_cents + $2
+                  WHERE name = $1 RETURNING balance_cents`, p.Account, p.Amount).Scan(&balance)
+			if err != nil {
+				return err
+			}
+			if isStoreCreditAccount(p.Account) && balance > 0 {
+				return errInsufficientCredit
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO ledger_entries
+                  (entry_id, payment_id, settlement_batch_id, movement, account, amount_cents, balance_cents)
+                  VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5, $6, $7)`,
+				entryID, ref.PaymentID, ref.BatchID, j.Movement, p.Account, p.Amount, balance)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MemoryPaymentRepository keeps payments in process memory
+type MemoryPaymentRepository struct {
+	mu       sync.RWMutex
+	nextID   int
+	payments map[int]Payment
+	ledger   []LedgerEntry
+	balances map[string]int64
+	entries  int64
+	batches  []*SettlementBatch
+	// settled maps ledger entry IDs to their settlement batch
+	settled      map[int64]int64
+	methods      map[int64]*PaymentMethod
+	nextMethodID int64
+	giftCards    map[string]*GiftCard
+}
+
+func NewMemoryPaymentRepository() *MemoryPaymentRepository {
+	return &MemoryPaymentRepository{
+		nextID:    1,
+		payments:  make(map[int]Payment),
+		balances:  make(map[string]int64),
+		settled:   make(map[int64]int64),
+		methods:   make(map[int64]*PaymentMethod),
+		giftCards: make(map[string]*GiftCard),
+	}
+}
+
+func (r *MemoryPaymentRepository) Create(ctx context.Context, payment *Payment, journals []Journal) error {
+	if err := validateJournals(journals); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.post(ledgerRef{PaymentID: r.nextID}, journals); err != nil {
+		return err
+	}
+	payment.ID = r.nextID
+	r.nextID++
+	payment.PublicID = publicid.New()
+	r.payments[payment.ID] = *payment
+	return nil
+}
+
+// post appends journals to the ledger; r.mu must be held
+func (r *MemoryPaymentRepository) post(ref ledgerRef, journals []Journal) error {
+	after := make(map[string]int64)
+	for _, j := range journals {
+		for _, p := range j.Postings {
+			after[p.Account] += p.Amount
+		}
+	}
+	for account, change := range after {
+		if isStoreCreditAccount(account) && r.balances[account]+change > 0 {
+			return errInsufficientCredit
+		}
+	}
+
+	now := clock.System.Now()
+	for _, j := range journals {
+		r.entries++
+		for _, p := range j.Postings {
+			r.balances[p.Account] += p.Amount
+			r.ledger = append(r.ledger, LedgerEntry{
+				ID:           int64(len(r.ledger) + 1),
+				EntryID:      r.entries,
+				PaymentID:    ref.PaymentID,
+				BatchID:      ref.BatchID,
+				Movement:     j.Movement,
+				Account:      p.Account,
+				AmountCents:  p.Amount,
+				BalanceCents: r.balances[p.Account],
+				CreatedAt:    now,
+			})
+		}
+	}
+	return nil
+}
+
+func (r *MemoryPaymentRepository) paymentLedger(paymentID int) []LedgerEntry {
+	var ledger []LedgerEntry
+	for _, e := range r.ledger {
+		if e.PaymentID == paymentID {
+			ledger = append(ledger, e)
+		}
+	}
+	return ledger
+}
+
+func (r *MemoryPaymentRepository) Adjust(ctx context.Context, id int, fn AdjustFunc) (*Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payment, ok := r.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	journals, err := fn(&payment, r.paymentLedger(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := validateJournals(journals); err != nil {
+		return nil, err
+	}
+	if err := r.post(ledgerRef{PaymentID: id}, journals); err != nil {
+		return nil, err
+	}
+	r.payments[id] = payment
+	return &payment, nil
+}
+
+func (r *MemoryPaymentRepository) Ledger(ctx context.Context, paymentID int) ([]LedgerEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.paymentLedger(paymentID), nil
+}
+
+func (r *MemoryPaymentRepository) Payments(ctx context.Context, filter PaymentFilter) ([]Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var payments []Payment
+	for _, p := range r.payments {
+		if !filter.CreatedFrom.IsZero() && p.CreatedAt.Before(filter.CreatedFrom) ||
+			!filter.CreatedTo.IsZero() && !p.CreatedAt.Before(filter.CreatedTo) ||
+			filter.Status != "" && p.Status != filter.Status {
+			continue
+		}
+		payments = append(payments, p)
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		if !payments[i].CreatedAt.Equal(payments[j].CreatedAt) {
+			return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+		}
+		return payments[i].ID < payments[j].ID
+	})
+	if filter.Limit > 0 && len(payments) > filter.Limit {
+		payments = payments[:filter.Limit]
+	}
+	return payments, nil
+}
+
+func (r *MemoryPaymentRepository) Get(ctx context.Context, id int) (*Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payment, ok := r.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &payment, nil
+}
@@ -0,0 +1,558 @@
+// payment-service/settlement.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/router"
+)
+
+// Batch states. A closed batch has been paid out; reopening it reverses
+// the payout so late corrections can be included before closing again.
+const (
+	BatchOpen   = "open"
+	BatchClosed = "closed"
+)
+
+var errBatchState = errors.New("batch is not in a state that allows this")
+
+// SettlementBatch is what one merchant is paid for one day: every
+// merchant_payable posting up to the day's cut-off not settled before
+type SettlementBatch struct {
+	ID              int64      `json:"id"`
+	Merchant        string     `json:"merchant"`
+	Day             string     `json:"day"`
+	Status          string     `json:"status"`
+	GrossCents      int64      `json:"gross_cents"`
+	FeeCents        int64      `json:"fee_cents"`
+	RefundCents     int64      `json:"refund_cents"`
+	ChargebackCents int64      `json:"chargeback_cents"`
+	NetCents        int64      `json:"net_cents"`
+	ClosedAt        *time.Time `json:"closed_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// SettlementLine totals one payment's postings in a batch
+type SettlementLine struct {
+	PaymentID       int   `json:"payment_id"`
+	OrderID         int   `json:"order_id"`
+	GrossCents      int64 `json:"gross_cents"`
+	FeeCents        int64 `json:"fee_cents"`
+	RefundCents     int64 `json:"refund_cents"`
+	ChargebackCents int64 `json:"chargeback_cents"`
+	NetCents        int64 `json:"net_cents"`
+}
+
+// add counts a merchant_payable posting, which credits (negative) the
+// merchant for captures and store credit spent, and debits them for
+// everything else
+func (l *SettlementLine) add(movement string, cents int64) {
+	switch movement {
+	case MovementCapture, MovementStoreCredit:
+		l.GrossCents -= cents
+	case MovementFee:
+		l.FeeCents += cents
+	case MovementRefund:
+		l.RefundCents += cents
+	case MovementChargeback:
+		l.ChargebackCents += cents
+	}
+	l.NetCents -= cents
+}
+
+type BatchFilter struct {
+	Merchant string
+	Status   string
+	Day      string
+}
+
+// SettlementRepository groups ledger postings into payout batches
+type SettlementRepository interface {
+	// Settle creates or tops up the open batch of day for every merchant
+	// with unsettled postings up to the end of day (UTC)
+	Settle(ctx context.Context, day time.Time) ([]SettlementBatch, error)
+	Batches(ctx context.Context, filter BatchFilter) ([]SettlementBatch, error)
+	Batch(ctx context.Context, id int64) (*SettlementBatch, []SettlementLine, error)
+	// CloseBatch freezes an open batch and posts its payout
+	CloseBatch(ctx context.Context, id int64) (*SettlementBatch, error)
+	// ReopenBatch reverses a closed batch's payout
+	ReopenBatch(ctx context.Context, id int64) (*SettlementBatch, error)
+}
+
+func payoutJournal(movement string, net int64) []Journal {
+	if net == 0 {
+		return nil
+	}
+	if movement == MovementPayoutReversal {
+		return []Journal{transfer(movement, AccountPayouts, AccountMerchantPayable, net)}
+	}
+	return []Journal{transfer(movement, AccountMerchantPayable, AccountPayouts, net)}
+}
+
+const batchColumns = `id, merchant, to_char(day, 'YYYY-MM-DD'), status, gross_cents, fee_cents,
+              refund_cents, chargeback_cents, net_cents, closed_at, created_at`
+
+func scanBatch(scan func(...any) error, b *SettlementBatch) error {
+	var closed sql.NullTime
+	err := scan(&b.ID, &b.Merchant, &b.Day, &b.Status, &b.GrossCents, &b.FeeCents,
+		&b.RefundCents, &b.ChargebackCents, &b.NetCents, &closed, &b.CreatedAt)
+	if closed.Valid {
+		b.ClosedAt = &closed.Time
+	}
+	return err
+}
+
+func (r *PostgresPaymentRepository) queryBatches(ctx context.Context, q querier, query string, args ...any) ([]SettlementBatch, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []SettlementBatch
+	for rows.Next() {
+		var b SettlementBatch
+		if err := scanBatch(rows.Scan, &b); err != nil {
+			return nil, err
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+func (r *PostgresPaymentRepository) Settle(ctx context.Context, day time.Time) ([]SettlementBatch, error) {
+	var settled []SettlementBatch
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		// One settlement run at a time, so postings aren't claimed twice
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('settlement'))`); err != nil {
+			return err
+		}
+		cutoff := day.AddDate(0, 0, 1)
+		_, err := tx.ExecContext(ctx, `INSERT INTO settlement_batches (merchant, day)
+              SELECT DISTINCT p.merchant, $1::date FROM ledger_entries e
+              JOIN payments p ON p.id = e.payment_id
+              LEFT JOIN settlement_entries s ON s.ledger_entry_id = e.id
+              WHERE e.account = $3 AND e.created_at < $2 AND s.ledger_entry_id IS NULL
+              ON CONFLICT (merchant, day) DO NOTHING`,
+			day, cutoff, AccountMerchantPayable)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO settlement_entries (ledger_entry_id, batch_id)
+              SELECT e.id, b.id FROM ledger_entries e
+              JOIN payments p ON p.id = e.payment_id
+              JOIN settlement_batches b ON b.merchant = p.merchant AND b.day = $1::date AND b.status = 'open'
+              LEFT JOIN settlement_entries s ON s.ledger_entry_id = e.id
+              WHERE e.account = $3 AND e.created_at < $2 AND s.ledger_entry_id IS NULL`,
+			day, cutoff, AccountMerchantPayable)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE settlement_batches b SET
+                  gross_cents = t.gross, fee_cents = t.fee, refund_cents = t.refund,
+                  chargeback_cents = t.chargeback, net_cents = t.net
+              FROM (
+                  SELECT s.batch_id,
+                      COALESCE(SUM(-e.amount_cents) FILTER (WHERE e.movement IN ('capture', 'store_credit')), 0) AS gross,
+                      COALESCE(SUM(e.amount_cents) FILTER (WHERE e.movement = 'fee'), 0) AS fee,
+                      COALESCE(SUM(e.amount_cents) FILTER (WHERE e.movement = 'refund'), 0) AS refund,
+                      COALESCE(SUM(e.amount_cents) FILTER (WHERE e.movement = 'chargeback'), 0) AS chargeback,
+                      SUM(-e.amount_cents) AS net
+                  FROM settlement_entries s JOIN ledger_entries e ON e.id = s.ledger_entry_id
+                  GROUP BY s.batch_id) t
+              WHERE b.id = t.batch_id AND b.day = $1::date AND b.status = 'open'`, day)
+		if err != nil {
+			return err
+		}
+		batches, err := r.queryBatches(ctx, tx, `SELECT `+batchColumns+` FROM settlement_batches
+              WHERE day = $1::date ORDER BY merchant`, day)
+		if err != nil {
+			return err
+		}
+		settled = batches
+		return nil
+	})
+	return settled, err
+}
+
+func (r *PostgresPaymentRepository) Batches(ctx context.Context, f BatchFilter) ([]SettlementBatch, error) {
+	return r.queryBatches(ctx, r.db, `SELECT `+batchColumns+` FROM settlement_batches
+              WHERE ($1 = '' OR merchant = $1) AND ($2 = '' OR status = $2) AND ($3 = '' OR day = $3::date)
+              ORDER BY day DESC, merchant LIMIT 500`,
+		f.Merchant, f.Status, f.Day)
+}
+
+func (r *PostgresPaymentRepository) Batch(ctx context.Context, id int64) (*SettlementBatch, []SettlementLine, error) {
+	var b SettlementBatch
+	err := scanBatch(r.db.QueryRowContext(ctx, `SELECT `+batchColumns+` FROM settlement_batches WHERE id = $1`, id).Scan, &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT p.id, p.order_id, e.movement, e.amount_cents
+              FROM settlement_entries s
+              JOIN ledger_entries e ON e.id = s.ledger_entry_id
+              JOIN payments p ON p.id = e.payment_id
+              WHERE s.batch_id = $1 ORDER BY p.id, e.id`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var lines []SettlementLine
+	for rows.Next() {
+		var paymentID, orderID int
+		var movement string
+		var cents int64
+		if err := rows.Scan(&paymentID, &orderID, &movement, &cents); err != nil {
+			return nil, nil, err
+		}
+		if len(lines) == 0 || lines[len(lines)-1].PaymentID != paymentID {
+			lines = append(lines, SettlementLine{PaymentID: paymentID, OrderID: orderID})
+		}
+		lines[len(lines)-1].add(movement, cents)
+	}
+	return &b, lines, rows.Err()
+}
+
+// transition moves a batch from one status to the other and posts the
+// matching payout journal in the same transaction
+func (r *PostgresPaymentRepository) transition(ctx context.Context, id int64, from, to, movement string) (*SettlementBatch, error) {
+	var batch *SettlementBatch
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var b SettlementBatch
+		err := scanBatch(tx.QueryRowContext(ctx, `SELECT `+batchColumns+` FROM settlement_batches WHERE id = $1 FOR UPDATE`, id).Scan, &b)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if b.Status != from {
+			return errBatchState
+		}
+
+		b.Status = to
+		b.ClosedAt = nil
+		if to == BatchClosed {
+			now := clock.System.Now()
+			b.ClosedAt = &now
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE settlement_batches SET status = $2, closed_at = $3 WHERE id = $1`,
+			id, b.Status, b.ClosedAt)
+		if err != nil {
+			return err
+		}
+		if err := post(ctx, tx, ledgerRef{BatchID: id}, payoutJournal(movement, b.NetCents)); err != nil {
+			return err
+		}
+		batch = &b
+		return nil
+	})
+	return batch, err
+}
+
+func (r *PostgresPaymentRepository) CloseBatch(ctx context.Context, id int64) (*SettlementBatch, error) {
+	return r.transition(ctx, id, BatchOpen, BatchClosed, MovementPayout)
+}
+
+func (r *PostgresPaymentRepository) ReopenBatch(ctx context.Context, id int64) (*SettlementBatch, error) {
+	return r.transition(ctx, id, BatchClosed, BatchOpen, MovementPayoutReversal)
+}
+
+func (r *MemoryPaymentRepository) Settle(ctx context.Context, day time.Time) ([]SettlementBatch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dayString := day.Format(time.DateOnly)
+	cutoff := day.AddDate(0, 0, 1)
+	for _, e := range r.ledger {
+		if e.Account != AccountMerchantPayable || e.PaymentID == 0 || !e.CreatedAt.Before(cutoff) {
+			continue
+		}
+		if _, settled := r.settled[e.ID]; settled {
+			continue
+		}
+		merchant := r.payments[e.PaymentID].Merchant
+		i := slices.IndexFunc(r.batches, func(b *SettlementBatch) bool {
+			return b.Merchant == merchant && b.Day == dayString
+		})
+		if i < 0 {
+			r.batches = append(r.batches, &SettlementBatch{
+				ID:        int64(len(r.batches) + 1),
+				Merchant:  merchant,
+				Day:       dayString,
+				Status:    BatchOpen,
+				CreatedAt: clock.System.Now(),
+			})
+			i = len(r.batches) - 1
+		}
+		b := r.batches[i]
+		if b.Status != BatchOpen {
+			continue
+		}
+		r.settled[e.ID] = b.ID
+		var line SettlementLine
+		line.add(e.Movement, e.AmountCents)
+		b.GrossCents += line.GrossCents
+		b.FeeCents += line.FeeCents
+		b.RefundCents += line.RefundCents
+		b.ChargebackCents += line.ChargebackCents
+		b.NetCents += line.NetCents
+	}
+
+	var batches []SettlementBatch
+	for _, b := range r.batches {
+		if b.Day == dayString {
+			batches = append(batches, *b)
+		}
+	}
+	slices.SortFunc(batches, func(a, b SettlementBatch) int { return strings.Compare(a.Merchant, b.Merchant) })
+	return batches, nil
+}
+
+func (r *MemoryPaymentRepository) Batches(ctx context.Context, f BatchFilter) ([]SettlementBatch, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var batches []SettlementBatch
+	for i := len(r.batches) - 1; i >= 0; i-- {
+		b := r.batches[i]
+		if (f.Merchant != "" && b.Merchant != f.Merchant) || (f.Status != "" && b.Status != f.Status) ||
+			(f.Day != "" && b.Day != f.Day) {
+			continue
+		}
+		batches = append(batches, *b)
+	}
+	return batches, nil
+}
+
+func (r *MemoryPaymentRepository) Batch(ctx context.Context, id int64) (*SettlementBatch, []SettlementLine, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id < 1 || id > int64(len(r.batches)) {
+		return nil, nil, ErrNotFound
+	}
+	b := *r.batches[id-1]
+
+	var lines []SettlementLine
+	for _, e := range r.ledger {
+		if r.settled[e.ID] != id {
+			continue
+		}
+		i := slices.IndexFunc(lines, func(l SettlementLine) bool { return l.PaymentID == e.PaymentID })
+		if i < 0 {
+			lines = append(lines, SettlementLine{PaymentID: e.PaymentID, OrderID: r.payments[e.PaymentID].OrderID})
+			i = len(lines) - 1
+		}
+		lines[i].add(e.Movement, e.AmountCents)
+	}
+	return &b, lines, nil
+}
+
+func (r *MemoryPaymentRepository) transition(id int64, from, to, movement string) (*SettlementBatch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > int64(len(r.batches)) {
+		return nil, ErrNotFound
+	}
+	b := r.batches[id-1]
+	if b.Status != from {
+		return nil, errBatchState
+	}
+	b.Status = to
+	b.ClosedAt = nil
+	if to == BatchClosed {
+		now := clock.System.Now()
+		b.ClosedAt = &now
+	}
+	if err := r.post(ledgerRef{BatchID: id}, payoutJournal(movement, b.NetCents)); err != nil {
+		return nil, err
+	}
+	c := *b
+	return &c, nil
+}
+
+func (r *MemoryPaymentRepository) CloseBatch(ctx context.Context, id int64) (*SettlementBatch, error) {
+	return r.transition(id, BatchOpen, BatchClosed, MovementPayout)
+}
+
+func (r *MemoryPaymentRepository) ReopenBatch(ctx context.Context, id int64) (*SettlementBatch, error) {
+	return r.transition(id, BatchClosed, BatchOpen, MovementPayoutReversal)
+}
+
+// SettlementAPI serves /settlements to finance staff
+type SettlementAPI struct {
+	repo  SettlementRepository
+	clock clock.Clock
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type settleRequest struct {
+	// Day is YYYY-MM-DD (UTC); it defaults to yesterday
+	Day string `json:"day"`
+}
+
+// Run builds or tops up the day's open batches. It is safe to repeat,
+// e.g. from a nightly cron and again after late corrections.
+func (a *SettlementAPI) Run(w http.ResponseWriter, r *http.Request) {
+	var req settleRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	day := a.clock.Now().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if req.Day != "" {
+		parsed, err := time.Parse(time.DateOnly, req.Day)
+		if err != nil {
+			http.Error(w, "day must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+
+	batches, err := a.repo.Settle(r.Context(), day)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if batches == nil {
+		batches = []SettlementBatch{}
+	}
+	writeJSON(w, http.StatusOK, batches)
+}
+
+func (a *SettlementAPI) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	batches, err := a.repo.Batches(r.Context(), BatchFilter{
+		Merchant: q.Get("merchant"),
+		Status:   q.Get("status"),
+		Day:      q.Get("day"),
+	})
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if batches == nil {
+		batches = []SettlementBatch{}
+	}
+	writeJSON(w, http.StatusOK, batches)
+}
+
+func (a *SettlementAPI) batch(w http.ResponseWriter, r *http.Request) (*SettlementBatch, []SettlementLine, bool) {
+	id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	b, lines, err := a.repo.Batch(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, nil, false
+	}
+	if lines == nil {
+		lines = []SettlementLine{}
+	}
+	return b, lines, true
+}
+
+func (a *SettlementAPI) Get(w http.ResponseWriter, r *http.Request) {
+	b, lines, ok := a.batch(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"batch": b, "lines": lines})
+}
+
+func (a *SettlementAPI) change(fn func(context.Context, int64) (*SettlementBatch, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+		b, err := fn(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errBatchState) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+func (a *SettlementAPI) Close(w http.ResponseWriter, r *http.Request) {
+	a.change(a.repo.CloseBatch)(w, r)
+}
+
+func (a *SettlementAPI) Reopen(w http.ResponseWriter, r *http.Request) {
+	a.change(a.repo.ReopenBatch)(w, r)
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Export downloads a batch as CSV: one row per payment, then a total row
+func (a *SettlementAPI) Export(w http.ResponseWriter, r *http.Request) {
+	b, lines, ok := a.batch(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="settlement-%s-%s-%d.csv"`, b.Merchant, b.Day, b.ID))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"batch_id", "merchant", "day", "status", "payment_id", "order_id",
+		"gross", "fees", "refunds", "chargebacks", "net"})
+	batch := []string{strconv.FormatInt(b.ID, 10), b.Merchant, b.Day, b.Status}
+	for _, l := range lines {
+		cw.Write(append(slices.Clone(batch), strconv.Itoa(l.PaymentID), strconv.Itoa(l.OrderID),
+			formatCents(l.GrossCents), formatCents(l.FeeCents), formatCents(l.RefundCents),
+			formatCents(l.ChargebackCents), formatCents(l.NetCents)))
+	}
+	cw.Write(append(slices.Clone(batch), "total", "",
+		formatCents(b.GrossCents), formatCents(b.FeeCents), formatCents(b.RefundCents),
+		formatCents(b.ChargebackCents), formatCents(b.NetCents)))
+	cw.Flush()
+}
@@ -0,0 +1,369 @@
+// Package alert tells people about operational problems — an SLO burning
+// its error budget, orders disagreeing with their payments, workflows
+// piling up stuck — in Slack or Microsoft Teams channels and through
+// PagerDuty, without a monitoring system in between. Services raise an
+// Alert under a key naming the problem; a repeat of an open problem is
+// sent again only once Repeat has passed or its severity rose, and
+// resolving it tells the sinks that heard of it, which for PagerDuty
+// closes the incident.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/clock"
+)
+
+// Severities, least severe first
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+var severities = []string{Info, Warning, Critical}
+
+func rank(severity string) int {
+	return slices.Index(severities, severity)
+}
+
+// Alert is one problem, or the news that it cleared
+type Alert struct {
+	// Key names the problem, e.g. slo/create-order; PagerDuty dedupes
+	// incidents on it
+	Key      string
+	Severity string
+	Summary  string
+	// Details are shown with the summary, in key order
+	Details map[string]string
+	// Resolved says the problem cleared
+	Resolved bool
+	// Source is the service raising it; the Alerter fills it in
+	Source string
+}
+
+func (a Alert) detailKeys() []string {
+	keys := make([]string, 0, len(a.Details))
+	for k := range a.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sink delivers alerts somewhere people look
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, a Alert) error
+}
+
+// post sends body as JSON and fails on anything but a 2xx
+func post(ctx context.Context, client *http.Client, url string, body any) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("answered %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+func title(a Alert) string {
+	if a.Resolved {
+		return fmt.Sprintf("Resolved [%s] %s: %s", a.Severity, a.Source, a.Summary)
+	}
+	return fmt.Sprintf("[%s] %s: %s", a.Severity, a.Source, a.Summary)
+}
+
+// SlackSink posts to a Slack incoming webhook
+type SlackSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewSlackSink(url string) *SlackSink {
+	return &SlackSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *SlackSink) Name() string { return "slack" }
+
+var slackEmoji = map[string]string{Info: ":information_source:", Warning: ":warning:", Critical: ":rotating_light:"}
+
+func (s *SlackSink) Send(ctx context.Context, a Alert) error {
+	emoji := slackEmoji[a.Severity]
+	if a.Resolved {
+		emoji = ":white_check_mark:"
+	}
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s *%s*", emoji, title(a))
+	for _, k := range a.detailKeys() {
+		fmt.Fprintf(&text, "\n• %s: %s", k, a.Details[k])
+	}
+	return post(ctx, s.client, s.url, map[string]string{"text": text.String()})
+}
+
+// TeamsSink posts a message card to a Microsoft Teams incoming webhook
+type TeamsSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewTeamsSink(url string) *TeamsSink {
+	return &TeamsSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *TeamsSink) Name() string { return "teams" }
+
+var teamsColor = map[string]string{Info: "0078D7", Warning: "FFA500", Critical: "D70000"}
+
+func (s *TeamsSink) Send(ctx context.Context, a Alert) error {
+	color := teamsColor[a.Severity]
+	if a.Resolved {
+		color = "2EB886"
+	}
+	facts := []map[string]string{}
+	for _, k := range a.detailKeys() {
+		facts = append(facts, map[string]string{"name": k, "value": a.Details[k]})
+	}
+	return post(ctx, s.client, s.url, map[string]any{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    title(a),
+		"title":      title(a),
+		"themeColor": color,
+		"sections":   []map[string]any{{"facts": facts}},
+	})
+}
+
+// PagerDutySink triggers and resolves incidents with the Events API v2
+type PagerDutySink struct {
+	routingKey string
+	url        string
+	client     *http.Client
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+func NewPagerDutySink(routingKey string) *PagerDutySink {
+	return &PagerDutySink{routingKey: routingKey, url: pagerDutyEventsURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *PagerDutySink) Name() string { return "pagerduty" }
+
+func (s *PagerDutySink) Send(ctx context.Context, a Alert) error {
+	event := map[string]any{
+		"routing_key":  s.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    a.Source + "/" + a.Key,
+	}
+	if a.Resolved {
+		event["event_action"] = "resolve"
+	} else {
+		event["payload"] = map[string]any{
+			"summary":        a.Source + ": " + a.Summary,
+			"source":         a.Source,
+			"severity":       a.Severity,
+			"custom_details": a.Details,
+		}
+	}
+	return post(ctx, s.client, s.url, event)
+}
+
+// route is a sink and the least severe alerts it gets
+type route struct {
+	sink     Sink
+	severity string
+}
+
+// problem is an open problem: how bad it was when last sent, and when
+type problem struct {
+	severity string
+	sentAt   time.Time
+}
+
+// Alerter sends a service's alerts to its sinks. Sending happens in the
+// background, so raising an alert never holds up the caller.
+type Alerter struct {
+	source string
+	routes []route
+	clock  clock.Clock
+	// Repeat is how often a problem that stays open is sent again
+	Repeat time.Duration
+
+	mu       sync.Mutex
+	open     map[string]problem
+	outcomes map[[2]string]int64
+}
+
+// New sends source's alerts to sinks at or above each one's severity
+func New(source string) *Alerter {
+	return &Alerter{
+		source:   source,
+		clock:    clock.System,
+		Repeat:   time.Hour,
+		open:     make(map[string]problem),
+		outcomes: make(map[[2]string]int64),
+	}
+}
+
+// Add sends alerts of severity and above to sink
+func (a *Alerter) Add(sink Sink, severity string) {
+	a.routes = append(a.routes, route{sink: sink, severity: severity})
+}
+
+// FromEnv is New with the sinks configured by
+//
+//   - ALERT_SLACK_WEBHOOK_URL, a Slack incoming webhook
+//   - ALERT_TEAMS_WEBHOOK_URL, a Teams incoming webhook
+//   - ALERT_PAGERDUTY_ROUTING_KEY, an Events API v2 integration key, sent
+//     to ALERT_PAGERDUTY_URL if set, e.g. for the EU service region
+//
+// The chat sinks get warnings and worse unless ALERT_CHAT_SEVERITY says
+// otherwise, PagerDuty only critical alerts unless
+// ALERT_PAGERDUTY_SEVERITY does. ALERT_REPEAT is how often an open
+// problem is sent again. Without sinks alerts are only logged.
+func FromEnv(source string) (*Alerter, error) {
+	a := New(source)
+	chat, err := severityFromEnv("ALERT_CHAT_SEVERITY", Warning)
+	if err != nil {
+		return nil, err
+	}
+	paging, err := severityFromEnv("ALERT_PAGERDUTY_SEVERITY", Critical)
+	if err != nil {
+		return nil, err
+	}
+	if u := os.Getenv("ALERT_SLACK_WEBHOOK_URL"); u != "" {
+		a.Add(NewSlackSink(u), chat)
+	}
+	if u := os.Getenv("ALERT_TEAMS_WEBHOOK_URL"); u != "" {
+		a.Add(NewTeamsSink(u), chat)
+	}
+	if key := os.Getenv("ALERT_PAGERDUTY_ROUTING_KEY"); key != "" {
+		pd := NewPagerDutySink(key)
+		if u := os.Getenv("ALERT_PAGERDUTY_URL"); u != "" {
+			pd.url = u
+		}
+		a.Add(pd, paging)
+	}
+	if v := os.Getenv("ALERT_REPEAT"); v != "" {
+		if a.Repeat, err = time.ParseDuration(v); err != nil || a.Repeat <= 0 {
+			return nil, fmt.Errorf("invalid ALERT_REPEAT %q", v)
+		}
+	}
+	return a, nil
+}
+
+func severityFromEnv(name, fallback string) (string, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	if rank(v) < 0 {
+		return "", fmt.Errorf("invalid %s %q", name, v)
+	}
+	return v, nil
+}
+
+// Alert raises a problem, or resolves it when al.Resolved is set. A nil
+// Alerter drops alerts, so callers needn't check for one.
+func (a *Alerter) Alert(ctx context.Context, al Alert) {
+	if a == nil {
+		return
+	}
+	al.Source = a.source
+	if rank(al.Severity) < 0 {
+		al.Severity = Warning
+	}
+
+	now := a.clock.Now()
+	a.mu.Lock()
+	p, open := a.open[al.Key]
+	switch {
+	case al.Resolved:
+		if !open {
+			a.mu.Unlock()
+			return
+		}
+		// Resolve where the worst of it was sent
+		al.Severity = p.severity
+		delete(a.open, al.Key)
+	case open && rank(al.Severity) <= rank(p.severity) && now.Sub(p.sentAt) < a.Repeat:
+		a.mu.Unlock()
+		return
+	default:
+		a.open[al.Key] = problem{severity: al.Severity, sentAt: now}
+	}
+	a.mu.Unlock()
+
+	if al.Resolved {
+		log.Printf("alert resolved: %s", al.Key)
+	} else {
+		log.Printf("alert [%s] %s: %s", al.Severity, al.Key, al.Summary)
+	}
+	for _, r := range a.routes {
+		if rank(al.Severity) < rank(r.severity) {
+			continue
+		}
+		go a.send(context.WithoutCancel(ctx), r.sink, al)
+	}
+}
+
+// Resolve is Alert for the problem under key having cleared
+func (a *Alerter) Resolve(ctx context.Context, key string) {
+	a.Alert(ctx, Alert{Key: key, Resolved: true})
+}
+
+func (a *Alerter) send(ctx context.Context, sink Sink, al Alert) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	outcome := "sent"
+	if err := sink.Send(ctx, al); err != nil {
+		outcome = "failed"
+		log.Printf("alert %s to %s: %v", al.Key, sink.Name(), err)
+	}
+	a.mu.Lock()
+	a.outcomes[[2]string{sink.Name(), outcome}]++
+	a.mu.Unlock()
+}
+
+func (a *Alerter) WriteMetrics(w io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := make([][2]string, 0, len(a.outcomes))
+	for k := range a.outcomes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	fmt.Fprintln(w, "# TYPE alerts_sent_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "alerts_sent_total{sink=%q,outcome=%q} %d\n", k[0], k[1], a.outcomes[k])
+	}
+	fmt.Fprintln(w, "# TYPE alerts_open gauge")
+	fmt.Fprintf(w, "alerts_open %d\n", len(a.open))
+}
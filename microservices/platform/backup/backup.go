@@ -0,0 +1,456 @@
+// Package backup dumps a service's schema consistently and restores it, for
+// disaster recovery drills. Every service binary takes the commands:
+//
+//	order-service backup [file]
+//	order-service restore [file]
+//
+// reading DATABASE_URL, and stdout or stdin without a file. A dump is JSON
+// lines: a Header naming the migrations the schema was at and the tables
+// and columns taken, then one line per row. Every row comes from a single
+// read-only snapshot, so a dump taken while the service is serving is as
+// consistent as one taken with it stopped.
+//
+// Restore migrates the schema to where the dump was taken, replaces every
+// table's rows with the dump's, then applies the migrations since up to
+// the first the service applies online. The service should be stopped
+// while it runs.
+//
+// Services publish events straight to the collector rather than through an
+// outbox table, so a dump holds no publication position: events published
+// after the dump was taken are not published again by a restore, and
+// consumers may have seen changes the restored data no longer has.
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"platform/dbretry"
+	"platform/migrate"
+)
+
+// Rows are inserted this many to a statement on restore
+const restoreBatch = 500
+
+// Header is the first line of a dump
+type Header struct {
+	Service    string    `json:"service"`
+	Schema     string    `json:"schema"`
+	TakenAt    time.Time `json:"taken_at"`
+	Migrations []string  `json:"migrations"`
+	Tables     []Table   `json:"tables"`
+}
+
+// Table is one table in a dump, with the columns each of its rows holds
+// and how many rows follow
+type Table struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Rows    int64    `json:"rows"`
+}
+
+// row is every line of a dump after the header
+type row struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// Command runs "backup" or "restore" for the service owning schema against
+// the database at dsn; args are the command and an optional file
+func Command(ctx context.Context, args []string, service, dsn, schema string, migrations fs.FS) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: %s backup|restore [file]", service)
+	}
+	if dsn == "" {
+		return errors.New("DATABASE_URL is not set")
+	}
+	// Not dbretry.Open: its statement timeout is for requests, and a
+	// dump's reads take as long as the tables are big
+	dsn, err := dbretry.WithUTC(dsn)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "backup":
+		var h *Header
+		if len(args) == 1 {
+			h, err = Dump(ctx, db, service, schema, os.Stdout)
+		} else {
+			h, err = dumpFile(ctx, db, service, schema, args[1])
+		}
+		if err != nil {
+			return err
+		}
+		logTables("backup", h)
+		return nil
+	case "restore":
+		in := io.Reader(os.Stdin)
+		if len(args) == 2 {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		h, err := Restore(ctx, db, service, schema, migrations, in)
+		if err != nil {
+			return err
+		}
+		logTables("restore", h)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, want backup or restore", args[0])
+}
+
+// dumpFile dumps to path, leaving nothing there if the dump fails
+func dumpFile(ctx context.Context, db *sql.DB, service, schema, path string) (*Header, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := Dump(ctx, db, service, schema, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return h, nil
+}
+
+func logTables(command string, h *Header) {
+	for _, t := range h.Tables {
+		log.Printf("%s: %s.%s: %d rows", command, h.Schema, t.Name, t.Rows)
+	}
+	log.Printf("%s: %s at %s, taken %s", command, h.Schema, h.Migrations[len(h.Migrations)-1], h.TakenAt.Format(time.RFC3339))
+}
+
+// Dump writes every table of schema to w from one snapshot
+func Dump(ctx context.Context, db *sql.DB, service, schema string, w io.Writer) (*Header, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// Deferrable waits for a snapshot no concurrent transaction can
+	// invalidate, then reads without taking locks or risking a
+	// serialization failure
+	if _, err := tx.ExecContext(ctx, "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY, DEFERRABLE"); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Service: service, Schema: schema}
+	if err := tx.QueryRowContext(ctx, "SELECT now()").Scan(&h.TakenAt); err != nil {
+		return nil, err
+	}
+	h.TakenAt = h.TakenAt.UTC()
+	if h.Migrations, err = queryStrings(ctx, tx, fmt.Sprintf("SELECT version FROM %s.schema_migrations ORDER BY version", ident(schema))); err != nil {
+		return nil, err
+	}
+	if len(h.Migrations) == 0 {
+		return nil, fmt.Errorf("schema %s has no migrations applied", schema)
+	}
+	names, err := tables(ctx, tx, schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		t := Table{Name: name}
+		if t.Columns, err = columns(ctx, tx, schema, name); err != nil {
+			return nil, err
+		}
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s.%s", ident(schema), ident(name))).Scan(&t.Rows); err != nil {
+			return nil, err
+		}
+		h.Tables = append(h.Tables, t)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(h); err != nil {
+		return nil, err
+	}
+	for _, t := range h.Tables {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT row_to_json(r)::text FROM (SELECT %s FROM %s.%s) r",
+			identList(t.Columns), ident(schema), ident(t.Name)))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var data string
+			if err := rows.Scan(&data); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if err := enc.Encode(row{Table: t.Name, Row: json.RawMessage(data)}); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("dump %s: %w", t.Name, err)
+		}
+	}
+	return h, tx.Commit()
+}
+
+// Restore replaces the rows of every table in schema with a dump's, in one
+// transaction, and leaves the schema fully migrated
+func Restore(ctx context.Context, db *sql.DB, service, schema string, migrations fs.FS, r io.Reader) (*Header, error) {
+	dec := json.NewDecoder(r)
+	var h Header
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("read dump header: %w", err)
+	}
+	if h.Service != service || h.Schema != schema {
+		return nil, fmt.Errorf("dump is of %s (schema %s), not %s", h.Service, h.Schema, service)
+	}
+	if len(h.Migrations) == 0 {
+		return nil, errors.New("dump has no migrations")
+	}
+	known, err := migrate.Load(migrations)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range h.Migrations {
+		if !slices.ContainsFunc(known, func(m migrate.Migration) bool { return m.Version == v }) {
+			return nil, fmt.Errorf("dump was taken at migration %s, which this build doesn't have", v)
+		}
+	}
+	if err := migrate.RunTo(ctx, db, migrations, schema, h.Migrations[len(h.Migrations)-1]); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Foreign keys come off while the tables are refilled, so rows can go
+	// in table by table, and are checked against every row as they go back
+	fks, err := foreignKeys(ctx, tx, schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, fk := range fks {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s.%s DROP CONSTRAINT %s",
+			ident(schema), ident(fk.table), ident(fk.name))); err != nil {
+			return nil, err
+		}
+	}
+	names, err := tables(ctx, tx, schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		qualified := make([]string, len(names))
+		for i, name := range names {
+			qualified[i] = ident(schema) + "." + ident(name)
+		}
+		if _, err := tx.ExecContext(ctx, "TRUNCATE "+strings.Join(qualified, ", ")); err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make(map[string]int64)
+	var (
+		table *Table
+		batch []json.RawMessage
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		data, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		cols := identList(table.Columns)
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %[1]s.%[2]s (%[3]s) SELECT %[3]s FROM json_populate_recordset(NULL::%[1]s.%[2]s, $1)",
+			ident(schema), ident(table.Name), cols), string(data))
+		counts[table.Name] += int64(len(batch))
+		batch = batch[:0]
+		return err
+	}
+	for {
+		var rw row
+		if err := dec.Decode(&rw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read dump: %w", err)
+		}
+		if table == nil || rw.Table != table.Name {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			i := slices.IndexFunc(h.Tables, func(t Table) bool { return t.Name == rw.Table })
+			if i < 0 {
+				return nil, fmt.Errorf("dump has rows for %s, which its header doesn't list", rw.Table)
+			}
+			table = &h.Tables[i]
+		}
+		batch = append(batch, rw.Row)
+		if len(batch) == restoreBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	for _, t := range h.Tables {
+		if counts[t.Name] != t.Rows {
+			return nil, fmt.Errorf("dump is incomplete: %s has %d of %d rows", t.Name, counts[t.Name], t.Rows)
+		}
+	}
+
+	for _, fk := range fks {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s.%s ADD CONSTRAINT %s %s",
+			ident(schema), ident(fk.table), ident(fk.name), fk.def)); err != nil {
+			return nil, fmt.Errorf("restore %s: %w", fk.name, err)
+		}
+	}
+	if err := resetSequences(ctx, tx, schema); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &h, migrate.Run(ctx, db, migrations, schema)
+}
+
+// tables lists schema's tables but migrate's own, partitioned ones by
+// their parent alone
+func tables(ctx context.Context, tx *sql.Tx, schema string) ([]string, error) {
+	return queryStrings(ctx, tx, `SELECT c.relname FROM pg_catalog.pg_class c
+              JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+              WHERE n.nspname = $1 AND c.relkind IN ('r', 'p') AND NOT c.relispartition
+                AND c.relname <> ALL (string_to_array($2, ','))
+              ORDER BY c.relname`, schema, strings.Join(migrate.Tables, ","))
+}
+
+// columns lists a table's columns but generated ones, which restore
+// computes again
+func columns(ctx context.Context, tx *sql.Tx, schema, table string) ([]string, error) {
+	return queryStrings(ctx, tx, `SELECT a.attname FROM pg_catalog.pg_attribute a
+              WHERE a.attrelid = (quote_ident($1) || '.' || quote_ident($2))::regclass
+                AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = ''
+              ORDER BY a.attnum`, schema, table)
+}
+
+type foreignKey struct {
+	table, name, def string
+}
+
+// foreignKeys lists the foreign keys declared on schema's tables; those
+// partitions inherit from their parent come and go with it
+func foreignKeys(ctx context.Context, tx *sql.Tx, schema string) ([]foreignKey, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT c.relname, con.conname, pg_catalog.pg_get_constraintdef(con.oid)
+              FROM pg_catalog.pg_constraint con
+              JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+              JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+              WHERE n.nspname = $1 AND con.contype = 'f' AND con.conparentid = 0
+              ORDER BY c.relname, con.conname`, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		if err := rows.Scan(&fk.table, &fk.name, &fk.def); err != nil {
+			return nil, err
+		}
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// resetSequences sets each serial column's sequence past the highest value
+// restored, so new rows don't collide with them
+func resetSequences(ctx context.Context, tx *sql.Tx, schema string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT c.relname, a.attname, s.seq
+              FROM pg_catalog.pg_class c
+              JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+              JOIN pg_catalog.pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+              CROSS JOIN LATERAL pg_catalog.pg_get_serial_sequence(quote_ident(n.nspname) || '.' || quote_ident(c.relname), a.attname) AS s(seq)
+              WHERE n.nspname = $1 AND c.relkind IN ('r', 'p') AND NOT c.relispartition AND s.seq IS NOT NULL`, schema)
+	if err != nil {
+		return err
+	}
+	type serial struct{ table, column, seq string }
+	var serials []serial
+	for rows.Next() {
+		var s serial
+		if err := rows.Scan(&s.table, &s.column, &s.seq); err != nil {
+			rows.Close()
+			return err
+		}
+		serials = append(serials, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range serials {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("SELECT setval($1, COALESCE((SELECT max(%s) FROM %s.%s), 0) + 1, false)",
+			ident(s.column), ident(schema), ident(s.table)), s.seq)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strings1 runs a query of one text column
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func ident(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func identList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = ident(name)
+	}
+	return strings.Join(quoted, ", ")
+}
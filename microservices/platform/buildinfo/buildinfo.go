@@ -0,0 +1,74 @@
+// Package buildinfo says which build of a service is running, so incidents
+// can be matched to deploys. Release builds stamp it with -ldflags:
+//
+//	go build -ldflags "-X platform/buildinfo.Version=1.4.2 \
+//	    -X platform/buildinfo.Commit=$(git rev-parse HEAD) \
+//	    -X platform/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// A build without them falls back to the revision and commit time go build
+// records when run in a git checkout.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set with -ldflags -X
+var (
+	Version   = "dev"
+	Commit    string
+	BuildTime string
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+	// Modified is set for a build from a checkout with uncommitted changes
+	Modified bool `json:"modified,omitempty"`
+}
+
+var info = sync.OnceValue(func() Info {
+	i := Info{Version: Version, Commit: Commit, BuildTime: BuildTime, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return i
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if i.Commit == "" {
+				i.Commit = s.Value
+			}
+		case "vcs.time":
+			if i.BuildTime == "" {
+				i.BuildTime = s.Value
+			}
+		case "vcs.modified":
+			i.Modified = s.Value == "true" && Commit == ""
+		}
+	}
+	return i
+})
+
+// Get describes the running build
+func Get() Info {
+	return info()
+}
+
+// Short names the build in a word, for log lines: the version and the
+// first 12 characters of the commit, e.g. 1.4.2+3f9c2a1b7d4e
+func (i Info) Short() string {
+	s := i.Version
+	if c := i.Commit; c != "" {
+		s += "+" + c[:min(len(c), 12)]
+	}
+	if i.Modified {
+		s += ".dirty"
+	}
+	return s
+}
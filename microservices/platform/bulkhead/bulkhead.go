@@ -0,0 +1,174 @@
+// Package bulkhead limits concurrent calls to a dependency, reserving part of
+// the capacity for interactive traffic so batch work can't starve it. The
+// capacity is fixed, or follows an adaptive limiter that watches the calls'
+// latency.
+package bulkhead
+
+import (
+	"context"
+	"sync"
+
+	"platform/limit"
+	"platform/priority"
+)
+
+type waiter struct {
+	class   priority.Class
+	granted chan struct{}
+}
+
+type Bulkhead struct {
+	mu         sync.Mutex
+	capacity   int
+	batchMax   int
+	inUse      int
+	batchInUse int
+	queue      []*waiter
+	// limiter, when set, moves the capacity; batch keeps its share of it
+	limiter *limit.Limiter
+}
+
+// New allows capacity concurrent calls, at most batchMax of them batch
+func New(capacity, batchMax int) *Bulkhead {
+	return &Bulkhead{capacity: capacity, batchMax: min(batchMax, capacity)}
+}
+
+// NewAdaptive lets as many calls through as l's limit allows, batch ones
+// up to the share batchMax is of capacity, which should be l's maximum
+func NewAdaptive(l *limit.Limiter, capacity, batchMax int) *Bulkhead {
+	b := New(capacity, batchMax)
+	b.limiter = l
+	return b
+}
+
+// limits are the current capacity and batch share
+func (b *Bulkhead) limits() (capacity, batchMax int) {
+	if b.limiter == nil {
+		return b.capacity, b.batchMax
+	}
+	capacity = b.limiter.Limit()
+	return capacity, max(capacity*b.batchMax/b.capacity, 1)
+}
+
+func (b *Bulkhead) canGrant(c priority.Class) bool {
+	capacity, batchMax := b.limits()
+	if b.inUse >= capacity {
+		return false
+	}
+	return c == priority.Interactive || b.batchInUse < batchMax
+}
+
+// queued reports whether anyone of class c or higher priority is waiting
+func (b *Bulkhead) queued(c priority.Class) bool {
+	for _, w := range b.queue {
+		if w.class <= c {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bulkhead) grant(c priority.Class) {
+	b.inUse++
+	if c == priority.Batch {
+		b.batchInUse++
+	}
+}
+
+// Acquire waits for a slot, in priority order, until ctx is done. The
+// returned release must be called exactly once.
+func (b *Bulkhead) Acquire(ctx context.Context) (release func(), err error) {
+	done, err := b.Track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func() { done(false) }, nil
+}
+
+// Track is Acquire for calls that say how they went: done reports whether
+// the call timed out or the dependency refused it as overloaded, which
+// an adaptive bulkhead takes as the signal to back off
+func (b *Bulkhead) Track(ctx context.Context) (done func(dropped bool), err error) {
+	c := priority.FromContext(ctx)
+
+	b.mu.Lock()
+	if b.canGrant(c) && !b.queued(c) {
+		b.grant(c)
+		b.mu.Unlock()
+		return b.releaser(c), nil
+	}
+	w := &waiter{class: c, granted: make(chan struct{})}
+	b.queue = append(b.queue, w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return b.releaser(c), nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		select {
+		case <-w.granted:
+			// Granted while we were giving up; hand the slot on
+			b.release(c)
+		default:
+			b.remove(w)
+			if b.limiter != nil {
+				b.limiter.Rejected()
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (b *Bulkhead) releaser(c priority.Class) func(dropped bool) {
+	observe := func(bool) {}
+	if b.limiter != nil {
+		observe = b.limiter.Admit()
+	}
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			b.mu.Lock()
+			// The limit moves before the slot is handed on, so a rise lets
+			// more waiters in and a cut holds them back
+			observe(dropped)
+			b.release(c)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// release must be called with b.mu held
+func (b *Bulkhead) release(c priority.Class) {
+	b.inUse--
+	if c == priority.Batch {
+		b.batchInUse--
+	}
+	b.dispatch()
+}
+
+// dispatch grants free slots to waiters, interactive ones first
+func (b *Bulkhead) dispatch() {
+	for _, class := range []priority.Class{priority.Interactive, priority.Batch} {
+		for i := 0; i < len(b.queue); {
+			w := b.queue[i]
+			if w.class != class || !b.canGrant(class) {
+				i++
+				continue
+			}
+			b.grant(class)
+			close(w.granted)
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+		}
+	}
+}
+
+func (b *Bulkhead) remove(w *waiter) {
+	for i, q := range b.queue {
+		if q == w {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			return
+		}
+	}
+}
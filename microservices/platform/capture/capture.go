@@ -0,0 +1,343 @@
+// Package capture records the requests to chosen routes, or from chosen
+// users, with their responses, so a failure that is hard to trigger can be
+// replayed against staging with cmd/replay. It is opt in twice over: the
+// service needs CAPTURE_FILE to have somewhere to write, and admins turn
+// it on at /admin/capture for the routes and users they name and for a
+// limited number of exchanges.
+//
+// What is kept is sanitized: credentials and other sensitive headers are
+// dropped, and JSON fields whose names look secret are redacted. Bodies
+// that aren't JSON are not kept at all, only their size.
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/middleware"
+)
+
+// Bodies beyond this are cut short, and not kept
+const maxBody = 1 << 20
+
+// Redacted replaces the value of every sensitive field
+const Redacted = "[redacted]"
+
+// ReplayPrefix starts the request IDs of replayed requests, which aren't
+// captured again
+const ReplayPrefix = "replay-"
+
+// Headers kept with a request; everything else, credentials included, is
+// dropped
+var keptHeaders = []string{
+	"Accept", "Accept-Language", "Content-Type", "Idempotency-Key", "User-Agent",
+	"X-Geo-Country", "X-Geo-Region", middleware.RequestIDHeader,
+}
+
+// JSON fields whose names contain one of these are redacted
+var sensitiveFields = []string{"password", "secret", "token", "card", "cvv", "cvc", "iban", "authorization"}
+
+// Message is one side of an exchange
+type Message struct {
+	Header http.Header     `json:"header,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	// BodyBytes is the size of a body that wasn't kept
+	BodyBytes int `json:"body_bytes,omitempty"`
+}
+
+// Exchange is a request and the response the service gave it
+type Exchange struct {
+	ID         string    `json:"id"`
+	Service    string    `json:"service"`
+	Route      string    `json:"route"`
+	User       string    `json:"user,omitempty"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Request    Message   `json:"request"`
+	Status     int       `json:"status"`
+	Response   Message   `json:"response"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// Store keeps captured exchanges
+type Store interface {
+	Save(e *Exchange) error
+}
+
+// FileStore appends exchanges to a file, one JSON object a line
+type FileStore struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func OpenFile(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{f: f}, nil
+}
+
+func (s *FileStore) Save(e *Exchange) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+// Capturer records the exchanges admins asked for
+type Capturer struct {
+	service string
+	store   Store
+	clock   clock.Clock
+
+	mu        sync.Mutex
+	routes    []string
+	users     []string
+	remaining int
+}
+
+func New(service string, store Store) *Capturer {
+	return &Capturer{service: service, store: store, clock: clock.System}
+}
+
+// FromEnv captures to CAPTURE_FILE, or returns nil when it is unset
+func FromEnv(service string) (*Capturer, error) {
+	path := os.Getenv("CAPTURE_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	store, err := OpenFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CAPTURE_FILE: %w", err)
+	}
+	return New(service, store), nil
+}
+
+// active reports whether anything is to be captured
+func (c *Capturer) active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remaining > 0
+}
+
+// take claims one of the remaining captures for an exchange on route by
+// user, if they were asked for
+func (c *Capturer) take(route, user string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining == 0 || !(slices.Contains(c.routes, route) || user != "" && slices.Contains(c.users, user)) {
+		return false
+	}
+	c.remaining--
+	if c.remaining == 0 {
+		log.Print("capture: limit reached, capturing stopped")
+	}
+	return true
+}
+
+// Middleware records the exchanges asked for. It must run inside the auth
+// middleware, to know the user.
+func (c *Capturer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.active() || strings.HasPrefix(middleware.RequestID(r.Context()), ReplayPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The route is only known once the handler has run, so every
+		// request's body is kept until then
+		var reqBody []byte
+		if r.Body != nil {
+			var err error
+			if reqBody, err = readUpTo(r, maxBody+1); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		var user string
+		if claims, ok := middleware.PrincipalFromContext(r.Context()); ok {
+			user = claims.Subject
+		}
+		route := middleware.RouteName(r.Context())
+		if !c.take(route, user) {
+			return
+		}
+		e := &Exchange{
+			ID:         middleware.RequestID(r.Context()),
+			Service:    c.service,
+			Route:      route,
+			User:       user,
+			Time:       c.clock.Now().Add(-elapsed),
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Request:    message(r.Header, reqBody, max(len(reqBody), int(r.ContentLength))),
+			Status:     rec.status,
+			Response:   message(w.Header(), rec.body.Bytes(), rec.size),
+			DurationMS: float64(elapsed.Microseconds()) / 1000,
+		}
+		if err := c.store.Save(e); err != nil {
+			log.Printf("capture %s: %v", e.ID, err)
+		}
+	})
+}
+
+// readUpTo reads up to n bytes of r's body, leaving the whole body for the
+// handler
+func readUpTo(r *http.Request, n int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, n))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, nil
+}
+
+// message sanitizes one side of an exchange; size is the whole body's, of
+// which body may be the start
+func message(h http.Header, body []byte, size int) Message {
+	m := Message{Header: make(http.Header)}
+	for _, name := range keptHeaders {
+		if v := h.Values(name); len(v) > 0 {
+			m.Header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	if len(body) == 0 {
+		return m
+	}
+	var v any
+	if len(body) > maxBody || json.Unmarshal(body, &v) != nil {
+		m.BodyBytes = size
+		return m
+	}
+	m.Body, _ = json.Marshal(redact(v))
+	return m
+}
+
+// redact replaces the values of sensitive fields throughout a JSON value
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if sensitive(k) {
+				v[k] = Redacted
+			} else {
+				v[k] = redact(field)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+func sensitive(field string) bool {
+	field = strings.ToLower(field)
+	return slices.ContainsFunc(sensitiveFields, func(s string) bool { return strings.Contains(field, s) })
+}
+
+// recorder keeps a copy of the response, up to maxBody and a byte over
+type recorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.size += len(b)
+	if room := maxBody + 1 - r.body.Len(); room > 0 {
+		r.body.Write(b[:min(len(b), room)])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// captureState is what /admin/capture shows and takes
+type captureState struct {
+	Routes    []string `json:"routes"`
+	Users     []string `json:"users"`
+	Remaining int      `json:"remaining"`
+}
+
+// ServeHTTP is the admin endpoint: GET reports what is being captured, PUT
+// starts capturing the routes and users given, up to remaining exchanges
+// (100 by default), and DELETE stops
+func (c *Capturer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req captureState
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Routes) == 0 && len(req.Users) == 0 {
+			http.Error(w, "name the routes or users to capture", http.StatusBadRequest)
+			return
+		}
+		if req.Remaining <= 0 {
+			req.Remaining = 100
+		}
+		c.mu.Lock()
+		c.routes, c.users, c.remaining = req.Routes, req.Users, req.Remaining
+		c.mu.Unlock()
+		log.Printf("capture: capturing up to %d exchanges of routes %v and users %v", req.Remaining, req.Routes, req.Users)
+	case http.MethodDelete:
+		c.mu.Lock()
+		c.routes, c.users, c.remaining = nil, nil, 0
+		c.mu.Unlock()
+		log.Print("capture: stopped")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.mu.Lock()
+	state := captureState{
+		Routes:    append([]string{}, c.routes...),
+		Users:     append([]string{}, c.users...),
+		Remaining: c.remaining,
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
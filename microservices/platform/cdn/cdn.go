@@ -0,0 +1,133 @@
+// Package cdn lets the API sit behind a CDN without serving stale data.
+// Handlers say how long shared caches may keep a response with a Hint, and
+// tag it with surrogate keys naming what it shows, e.g. order/42; events
+// about order/42 then purge every response tagged with it, whatever its
+// URL. The keys follow event subjects, so the gateway can purge straight
+// from the events it receives.
+//
+// Like the gateway's own cache, the CDN must key cached responses on the
+// Authorization header as well as the URL; Set says so with Vary, so a
+// CDN configured without it doesn't hand one caller's response to another.
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyHeader carries a response's surrogate keys, space separated. CDNs
+// drop it before the response reaches clients.
+const KeyHeader = "Surrogate-Key"
+
+// Hint is what a route tells caches about its responses
+type Hint struct {
+	// MaxAge is for clients, who hear of no purges; SMaxAge for the
+	// gateway and the CDN, which do
+	MaxAge  time.Duration
+	SMaxAge time.Duration
+	// StaleWhileRevalidate lets shared caches serve a stale copy while
+	// they fetch a new one
+	StaleWhileRevalidate time.Duration
+	// Private responses are kept by clients only
+	Private bool
+}
+
+// String is the hint as a Cache-Control value
+func (h Hint) String() string {
+	if h.Private {
+		return fmt.Sprintf("private, max-age=%d", int(h.MaxAge.Seconds()))
+	}
+	cc := fmt.Sprintf("max-age=%d, s-maxage=%d", int(h.MaxAge.Seconds()), int(h.SMaxAge.Seconds()))
+	if h.StaleWhileRevalidate > 0 {
+		cc += fmt.Sprintf(", stale-while-revalidate=%d", int(h.StaleWhileRevalidate.Seconds()))
+	}
+	return cc
+}
+
+// Key names one resource, as its events' subject does
+func Key(kind string, id int) string {
+	return kind + "/" + strconv.Itoa(id)
+}
+
+// Set gives the response hint's Cache-Control and tags it with keys.
+// Shared caches keep a copy per Authorization header.
+func Set(w http.ResponseWriter, hint Hint, keys ...string) {
+	w.Header().Set("Cache-Control", hint.String())
+	if hint.Private {
+		return
+	}
+	w.Header().Add("Vary", "Authorization")
+	if len(keys) > 0 {
+		w.Header().Set(KeyHeader, strings.Join(keys, " "))
+	}
+}
+
+// Purger invalidates every cached response tagged with one of keys
+type Purger interface {
+	Purge(ctx context.Context, keys []string) error
+}
+
+// HTTPPurger purges through a CDN's API, posting
+// {"surrogate_keys": [...]} to its purge endpoint as Fastly's does
+type HTTPPurger struct {
+	url    string
+	header string
+	token  string
+	client *http.Client
+}
+
+// NewHTTPPurger purges at url, sending token in header; with header
+// Authorization the token is sent as a bearer token
+func NewHTTPPurger(url, header, token string) *HTTPPurger {
+	return &HTTPPurger{url: url, header: header, token: token, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (p *HTTPPurger) Purge(ctx context.Context, keys []string) error {
+	body, err := json.Marshal(map[string][]string{"surrogate_keys": keys})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		if strings.EqualFold(p.header, "Authorization") {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		} else {
+			req.Header.Set(p.header, p.token)
+		}
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("CDN purge: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("CDN purge returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FromEnv purges at CDN_PURGE_URL with CDN_PURGE_TOKEN, sent in the
+// CDN_PURGE_HEADER header (Authorization by default), or returns nil when
+// no CDN is configured
+func FromEnv() Purger {
+	url := os.Getenv("CDN_PURGE_URL")
+	if url == "" {
+		return nil
+	}
+	header := os.Getenv("CDN_PURGE_HEADER")
+	if header == "" {
+		header = "Authorization"
+	}
+	return NewHTTPPurger(url, header, os.Getenv("CDN_PURGE_TOKEN"))
+}
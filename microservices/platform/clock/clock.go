@@ -0,0 +1,59 @@
+// Package clock is the time services stamp and schedule by. Handlers and
+// workers ask their Clock rather than calling time.Now, so a test can pin
+// or advance it, and every service reads it in UTC: timestamps are stored
+// and serialized as RFC 3339 in UTC wherever they were made, and compare
+// equal as text across services.
+//
+// Measuring how long something took is not telling the time; latencies
+// still use time.Now and time.Since for their monotonic readings.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+type system struct{}
+
+func (system) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// System is the real time, in UTC
+var System Clock = system{}
+
+// Manual is a clock that only moves when told to, for tests
+type Manual struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManual starts a clock at now, in UTC
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now.UTC()}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Set moves the clock to now, which may be in its past
+func (m *Manual) Set(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now.UTC()
+}
+
+// Advance moves the clock on by d
+func (m *Manual) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = m.now.Add(d)
+}
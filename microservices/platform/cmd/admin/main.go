@@ -0,0 +1,311 @@
+// cmd/admin/main.go
+//
+// admin runs operational tasks against the services' admin APIs, so
+// operators don't write the JSON and curl it by hand. Each command is one
+// request to one service, made with the token in ADMIN_TOKEN, and prints
+// the response. The services are found at GATEWAY_URL, USER_SERVICE_URL,
+// ORDER_SERVICE_URL, PAYMENT_SERVICE_URL and NOTIFICATION_SERVICE_URL, with
+// the same defaults as the gateway's.
+//
+// Request fields follow the command's arguments as name=value for strings
+// and name:=value for JSON, e.g. numbers and lists:
+//
+//	go run ./cmd/admin quota set-limit pro api_calls max:=100000 period=month
+//	go run ./cmd/admin webhooks replay-all tenant=acme limit:=50
+//	go run ./cmd/admin logging set orders level=debug 'routes:=["create-order"]'
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// services maps the names commands use to where the service is found
+var services = map[string]struct{ env, fallback string }{
+	"gateway":       {"GATEWAY_URL", "http://localhost:8080"},
+	"users":         {"USER_SERVICE_URL", "http://localhost:8081"},
+	"orders":        {"ORDER_SERVICE_URL", "http://localhost:8082"},
+	"payments":      {"PAYMENT_SERVICE_URL", "http://localhost:8083"},
+	"notifications": {"NOTIFICATION_SERVICE_URL", "http://localhost:8085"},
+}
+
+// What a command does with the name=value pairs after its arguments
+const (
+	noFields = iota
+	// bodyFields sends them as a JSON object
+	bodyFields
+	// queryFields sends them as the query string
+	queryFields
+	// bodyList sends the remaining arguments as a JSON list of strings
+	bodyList
+)
+
+// command is one admin request. Its path names its arguments in braces.
+// Endpoints every service has leave service empty, and their first
+// argument names it.
+type command struct {
+	group, name string
+	service     string
+	method      string
+	path        string
+	fields      int
+	help        string
+}
+
+var commands = []command{
+	{"quota", "plans", "gateway", http.MethodGet, "/admin/quotas/plans", noFields, "list the plans and their limits"},
+	{"quota", "set-limit", "gateway", http.MethodPut, "/admin/quotas/plans/{plan}/{resource}", bodyFields, "set a plan's limit: max:=N period=day|month"},
+	{"quota", "usage", "gateway", http.MethodGet, "/admin/quotas/subjects/{subject}", noFields, "show a subject's plan and usage, e.g. tenant:acme"},
+	{"quota", "plan", "gateway", http.MethodGet, "/admin/quotas/subjects/{subject}/plan", noFields, "show the plan a subject is on"},
+	{"quota", "set-plan", "gateway", http.MethodPut, "/admin/quotas/subjects/{subject}/plan", bodyFields, "move a subject to plan=NAME"},
+	{"features", "show", "gateway", http.MethodGet, "/admin/quotas/plans/{plan}/features", noFields, "list the features a plan includes"},
+	{"features", "set", "gateway", http.MethodPut, "/admin/quotas/plans/{plan}/features", bodyList, "replace a plan's features with those given"},
+	{"canary", "show", "gateway", http.MethodGet, "/admin/canaries", noFields, "show the canaries and how they compare"},
+	{"canary", "set", "gateway", http.MethodPut, "/admin/canaries", bodyFields, "give service=NAME's canary percent:=N of its traffic"},
+	{"user", "impersonate", "users", http.MethodPost, "/users/{id}/impersonations", bodyFields, "get a token acting as a user: reason= minutes:=N (15 by default)"},
+	{"user", "activity", "users", http.MethodGet, "/users/{id}/activity", queryFields, "show a user's sign-ins, profile changes and impersonations: before= limit="},
+	{"user", "devices", "users", http.MethodGet, "/users/{id}/devices", noFields, "list the devices and networks a user signed in from"},
+	{"user", "forget-device", "users", http.MethodDelete, "/users/{id}/devices/{fingerprint}", noFields, "forget a device, so logins from it count as new"},
+	{"user", "two-factor", "users", http.MethodGet, "/users/{id}/two-factor", noFields, "show whether a user has a second factor"},
+	{"user", "reset-two-factor", "users", http.MethodDelete, "/users/{id}/two-factor", noFields, "remove a user's second factor once they proved who they are"},
+	{"webhooks", "list", "notifications", http.MethodGet, "/notifications/webhooks/deliveries", queryFields, "list deliveries: tenant= status= before= limit="},
+	{"webhooks", "show", "notifications", http.MethodGet, "/notifications/webhooks/deliveries/{id}", noFields, "show a delivery and its attempts"},
+	{"webhooks", "replay", "notifications", http.MethodPost, "/notifications/webhooks/deliveries/{id}/replay", noFields, "deliver a webhook again"},
+	{"webhooks", "replay-all", "notifications", http.MethodPost, "/notifications/webhooks/deliveries/replay", bodyFields, "replay ids:=[...] or a tenant= status= limit:= selection"},
+	{"webhooks", "subscriptions", "notifications", http.MethodGet, "/notifications/webhooks/subscriptions", queryFields, "list webhook subscriptions, tenant="},
+	{"webhooks", "subscribe", "notifications", http.MethodPut, "/notifications/webhooks/subscriptions/{id}", bodyFields, "create or replace a subscription: tenant= url= notifications:=[...]"},
+	{"webhooks", "unsubscribe", "notifications", http.MethodDelete, "/notifications/webhooks/subscriptions/{id}", noFields, "delete a webhook subscription"},
+	{"suppression", "list", "notifications", http.MethodGet, "/notifications/suppressions", queryFields, "list suppressed email addresses: reason= after= limit="},
+	{"suppression", "show", "notifications", http.MethodGet, "/notifications/suppressions/{address}", noFields, "show why an address is suppressed"},
+	{"suppression", "add", "notifications", http.MethodPut, "/notifications/suppressions/{address}", bodyFields, "stop emailing an address: reason=manual|bounce|complaint detail="},
+	{"suppression", "remove", "notifications", http.MethodDelete, "/notifications/suppressions/{address}", noFields, "email an address again"},
+	{"settlement", "run", "payments", http.MethodPost, "/settlements/run", bodyFields, "settle a day's ledger, day=YYYY-MM-DD (yesterday by default)"},
+	{"settlement", "list", "payments", http.MethodGet, "/settlements/batches", queryFields, "list settlement batches"},
+	{"settlement", "show", "payments", http.MethodGet, "/settlements/batches/{id}", noFields, "show a settlement batch"},
+	{"settlement", "close", "payments", http.MethodPost, "/settlements/batches/{id}/close", noFields, "close a settlement batch"},
+	{"settlement", "reopen", "payments", http.MethodPost, "/settlements/batches/{id}/reopen", noFields, "reopen a closed settlement batch"},
+	{"payment", "refund", "payments", http.MethodPost, "/payments/{id}/refunds", bodyFields, "refund a payment, amount:=N (all of it by default)"},
+	{"payment", "list", "payments", http.MethodGet, "/payments", queryFields, "list payments: from= to= (RFC 3339) status= limit="},
+	{"payment", "chargeback", "payments", http.MethodPost, "/payments/{id}/chargebacks", bodyFields, "record a chargeback, amount:=N"},
+	{"file", "list", "payments", http.MethodGet, "/files", queryFields, "list stored files: subject= kind= owner="},
+	{"file", "show", "payments", http.MethodGet, "/files/{id}", noFields, "show a stored file with a download URL"},
+	{"file", "delete", "payments", http.MethodDelete, "/files/{id}", noFields, "delete a stored file and its content"},
+	{"consistency", "show", "orders", http.MethodGet, "/admin/consistency", noFields, "show the last check of orders against payments"},
+	{"consistency", "run", "orders", http.MethodPost, "/admin/consistency", queryFields, "check orders against payments now, repair=true to fix what can be"},
+	{"import", "file", "gateway", http.MethodPost, "/orders/import", bodyFields, "import the orders in an uploaded file_id= in the background"},
+	{"import", "show", "gateway", http.MethodGet, "/orders/imports/{id}", noFields, "show an order import's progress"},
+	{"import", "rows", "gateway", http.MethodGet, "/orders/imports/{id}/rows", queryFields, "list what became of an import's rows: outcome= after= limit="},
+	{"import", "errors", "gateway", http.MethodGet, "/orders/imports/{id}/errors", noFields, "print the CSV of an import's skipped and failed rows"},
+	{"merge", "start", "gateway", http.MethodPost, "/account-merges", bodyFields, "merge source_id:=N into target_id:=N"},
+	{"merge", "list", "gateway", http.MethodGet, "/account-merges", queryFields, "list account merges, status="},
+	{"merge", "show", "gateway", http.MethodGet, "/account-merges/{id}", noFields, "show an account merge"},
+	{"merge", "resume", "gateway", http.MethodPost, "/account-merges/{id}/resume", noFields, "resume a failed account merge"},
+	{"tenant", "create", "gateway", http.MethodPost, "/tenants", bodyFields, "provision id= name= plan= webhook_url=; prints its first API key"},
+	{"tenant", "list", "gateway", http.MethodGet, "/tenants", queryFields, "list tenants, status="},
+	{"tenant", "show", "gateway", http.MethodGet, "/tenants/{id}", noFields, "show a tenant and its provisioning"},
+	{"tenant", "suspend", "gateway", http.MethodPost, "/tenants/{id}/suspend", noFields, "turn a tenant's API keys away"},
+	{"tenant", "resume", "gateway", http.MethodPost, "/tenants/{id}/resume", noFields, "let a suspended tenant back in"},
+	{"tenant", "delete", "gateway", http.MethodDelete, "/tenants/{id}", noFields, "tear a tenant down for good"},
+	{"tenant", "retry", "gateway", http.MethodPost, "/tenants/{id}/retry", noFields, "retry a stalled provisioning or deletion"},
+	{"tenant", "issue-key", "gateway", http.MethodPost, "/tenants/{id}/keys", noFields, "issue another API key for an active tenant"},
+	{"tenant", "two-factor", "gateway", http.MethodPut, "/tenants/{id}/two-factor", bodyFields, "require a second factor of a tenant's users: required:=true|false"},
+	{"tenant", "add-client", "gateway", http.MethodPost, "/tenants/{id}/oauth-clients", bodyFields, "register a partner's OAuth client: name= scopes:=[...] rate_limit:=N a minute; prints its secret"},
+	{"tenant", "clients", "gateway", http.MethodGet, "/tenants/{id}/oauth-clients", noFields, "list a tenant's OAuth clients"},
+	{"tenant", "revoke-client", "gateway", http.MethodDelete, "/tenants/{id}/oauth-clients/{client}", noFields, "revoke an OAuth client and the tokens it holds"},
+	{"org", "create", "gateway", http.MethodPost, "/orgs", bodyFields, "create an organization: name= owner_id:=N"},
+	{"org", "members", "gateway", http.MethodGet, "/orgs/{id}/members", noFields, "list an organization's members and their roles"},
+	{"org", "set-role", "gateway", http.MethodPut, "/orgs/{id}/members/{user}", bodyFields, "add a member or change their role=owner|manager|member|viewer"},
+	{"org", "remove", "gateway", http.MethodDelete, "/orgs/{id}/members/{user}", noFields, "take a member out of an organization"},
+	{"logging", "show", "", http.MethodGet, "/admin/logging", noFields, "show a service's log settings"},
+	{"logging", "set", "", http.MethodPut, "/admin/logging", bodyFields, "change level=, routes:=[...], users:=[...], sampling:={...}"},
+	{"logging", "reset", "", http.MethodDelete, "/admin/logging", noFields, "put back the log settings the service started with"},
+	{"capture", "show", "", http.MethodGet, "/admin/capture", noFields, "show what a service is capturing"},
+	{"capture", "start", "", http.MethodPut, "/admin/capture", bodyFields, "capture routes:=[...] users:=[...] remaining:=N"},
+	{"capture", "stop", "", http.MethodDelete, "/admin/capture", noFields, "stop capturing"},
+	{"workflows", "stuck", "", http.MethodGet, "/admin/workflows/stuck", queryFields, "list a service's workflows stuck past their SLA, kind="},
+	{"workflows", "resume", "", http.MethodPost, "/admin/workflows/{kind}/{id}/resume", noFields, "carry a stuck workflow on"},
+	{"workflows", "abort", "", http.MethodPost, "/admin/workflows/{kind}/{id}/abort", noFields, "give a stuck workflow up and undo what it did"},
+	{"erp", "list", "", http.MethodGet, "/admin/erp/exports", queryFields, "list a service's ERP exports, newest day first: status= limit="},
+	{"erp", "day", "", http.MethodGet, "/admin/erp/exports/{day}", noFields, "show how a day's ERP exports went"},
+	{"erp", "retry", "", http.MethodPost, "/admin/erp/exports/{day}/{kind}/retry", noFields, "export a day's orders or payments to the ERP again now"},
+	{"maintenance", "show", "", http.MethodGet, "/admin/maintenance", noFields, "show a service's maintenance mode"},
+	{"maintenance", "set", "", http.MethodPut, "/admin/maintenance", bodyFields, "enabled:=true|false retry_after=2m"},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin [-token T] GROUP COMMAND [ARGS] [name=value | name:=json ...]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-38s %s\n", strings.Join(append([]string{c.group, c.name}, c.args()...), " "), c.help)
+	}
+}
+
+func main() {
+	token := flag.String("token", os.Getenv("ADMIN_TOKEN"), "bearer token with the admin role")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := find(flag.Arg(0), flag.Arg(1))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0)+" "+flag.Arg(1))
+		usage()
+		os.Exit(2)
+	}
+	req, err := c.request(flag.Args()[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", c.group, c.name, err)
+		os.Exit(2)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := (&http.Client{Timeout: 60 * time.Second}).Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out := os.Stdout
+	if resp.StatusCode >= 300 {
+		out = os.Stderr
+		fmt.Fprintf(out, "%s %s: %s\n", req.Method, req.URL.Path, resp.Status)
+	}
+	var indented bytes.Buffer
+	if json.Indent(&indented, bytes.TrimSpace(body), "", "  ") == nil {
+		body = append(indented.Bytes(), '\n')
+	}
+	out.Write(body)
+	if resp.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
+
+func find(group, name string) (command, bool) {
+	for _, c := range commands {
+		if c.group == group && c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// args names the command's arguments, in order
+func (c command) args() []string {
+	var args []string
+	if c.service == "" {
+		args = append(args, "SERVICE")
+	}
+	for rest := c.path; ; {
+		_, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			break
+		}
+		name, tail, _ := strings.Cut(after, "}")
+		args = append(args, strings.ToUpper(name))
+		rest = tail
+	}
+	if c.fields == bodyList {
+		args = append(args, "...")
+	}
+	return args
+}
+
+// request builds the command's request from what followed it
+func (c command) request(args []string) (*http.Request, error) {
+	service := c.service
+	if service == "" {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("name the service, one of gateway, users, orders, payments or notifications")
+		}
+		service, args = args[0], args[1:]
+	}
+	s, ok := services[service]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", service)
+	}
+	base := os.Getenv(s.env)
+	if base == "" {
+		base = s.fallback
+	}
+
+	path := c.path
+	for strings.Contains(path, "{") {
+		if len(args) == 0 || strings.Contains(args[0], "=") {
+			return nil, fmt.Errorf("missing arguments, want %s", strings.Join(c.args(), " "))
+		}
+		before, after, _ := strings.Cut(path, "{")
+		_, after, _ = strings.Cut(after, "}")
+		path = before + url.PathEscape(args[0]) + after
+		args = args[1:]
+	}
+
+	var body io.Reader
+	query := url.Values{}
+	switch c.fields {
+	case bodyList:
+		list, err := json.Marshal(append([]string{}, args...))
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(list)
+	case bodyFields, queryFields:
+		fields := make(map[string]any)
+		for _, arg := range args {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("want name=value or name:=json, got %q", arg)
+			}
+			if raw, isJSON := strings.CutSuffix(name, ":"); isJSON {
+				var v any
+				if err := json.Unmarshal([]byte(value), &v); err != nil {
+					return nil, fmt.Errorf("%s: %v", raw, err)
+				}
+				fields[raw] = v
+				query.Set(raw, value)
+			} else {
+				fields[name] = value
+				query.Set(name, value)
+			}
+		}
+		if c.fields == bodyFields {
+			encoded, err := json.Marshal(fields)
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.NewReader(encoded)
+		}
+	default:
+		if len(args) > 0 {
+			return nil, fmt.Errorf("unexpected %q", args[0])
+		}
+	}
+	if c.fields == queryFields && len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(c.method, strings.TrimSuffix(base, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
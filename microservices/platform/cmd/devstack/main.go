@@ -0,0 +1,349 @@
+// cmd/devstack/main.go
+//
+// devstack runs the whole stack locally with zero external dependencies:
+// services use in-memory storage, the event broker is faked inside devstack
+// itself, and every service URL and the internal signing key are wired
+// automatically. Logs from all services are multiplexed onto stdout with a
+// per-service prefix.
+//
+// Services are separate modules with their own main packages, so devstack
+// builds them and supervises them as child processes.
+//
+//	go run ./cmd/devstack -root ..
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"platform/codec"
+	"platform/signing"
+)
+
+const fakeBrokerAddr = "localhost:8084"
+
+// component is a service devstack builds and runs
+type component struct {
+	name string
+	dir  string
+	env  []string
+}
+
+func stack(root, storage, signingKeys string) []component {
+	return []component{
+		{
+			name: "user-service",
+			dir:  filepath.Join(root, "user-service"),
+			env: []string{
+				"STORAGE=" + storage,
+				"TRUST_FORWARDED_FOR=true",
+				"ORDER_SERVICE_URL=http://localhost:8082",
+				"PAYMENT_SERVICE_URL=http://localhost:8083",
+				"NOTIFICATION_SERVICE_URL=http://localhost:8085",
+				"GATEWAY_URL=http://localhost:8080",
+			},
+		},
+		{
+			name: "payment-service",
+			dir:  filepath.Join(root, "payment-service"),
+			env: []string{
+				"STORAGE=" + storage,
+				"SIGNING_KEYS=" + signingKeys,
+			},
+		},
+		{
+			name: "order-service",
+			dir:  filepath.Join(root, "order-service"),
+			env: []string{
+				"STORAGE=" + storage,
+				"USER_SERVICE_URL=http://localhost:8081",
+				"PAYMENT_SERVICE_URL=http://localhost:8083",
+				"SIGNING_KEYS=" + signingKeys,
+			},
+		},
+		{
+			name: "notification-service",
+			dir:  filepath.Join(root, "notification-service"),
+			env: []string{
+				"STORAGE=" + storage,
+				"USER_SERVICE_URL=http://localhost:8081",
+			},
+		},
+		{
+			name: "gateway",
+			dir:  filepath.Join(root, "gateway"),
+			env: []string{
+				"USER_SERVICE_URL=http://localhost:8081",
+				"ORDER_SERVICE_URL=http://localhost:8082",
+				"PAYMENT_SERVICE_URL=http://localhost:8083",
+				"NOTIFICATION_SERVICE_URL=http://localhost:8085",
+				"SIGNING_KEYS=" + signingKeys,
+			},
+		},
+	}
+}
+
+// prefixWriter writes each complete line with a service prefix
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+}
+
+func (p *prefixWriter) pipe(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		p.mu.Lock()
+		fmt.Fprintf(p.out, "%-14s | %s\n", p.prefix, scanner.Text())
+		p.mu.Unlock()
+	}
+}
+
+func (p *prefixWriter) asWriter() io.Writer {
+	r, w := io.Pipe()
+	go p.pipe(r)
+	return w
+}
+
+// child is a running service process; done is closed when it exits
+type child struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+type devstack struct {
+	mu      sync.Mutex
+	binDir  string
+	procs   []*child
+	servers []*http.Server
+	// keys sign the broker's deliveries, as the collector signs them
+	keys *signing.Keyring
+}
+
+func (d *devstack) writer(name string) *prefixWriter {
+	return &prefixWriter{mu: &d.mu, out: os.Stdout, prefix: name}
+}
+
+func (d *devstack) logf(name, format string, args ...any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(os.Stdout, "%-14s | %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (d *devstack) build(ctx context.Context, c component) (string, error) {
+	bin := filepath.Join(d.binDir, c.name)
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", bin, ".")
+	cmd.Dir = c.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("build %s: %v\n%s", c.name, err, out)
+	}
+	return bin, nil
+}
+
+// start launches a built service; exited receives its name when it stops
+func (d *devstack) start(bin string, c component, exited chan<- string) error {
+	cmd := exec.Command(bin)
+	cmd.Dir = c.dir
+	cmd.Env = append(os.Environ(), c.env...)
+	cmd.Env = append(cmd.Env, "EVENTS_URL=http://"+fakeBrokerAddr+"/events")
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	w := d.writer(c.name)
+	go w.pipe(stdout)
+	go w.pipe(stderr)
+
+	proc := &child{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(proc.done)
+		exited <- c.name
+	}()
+
+	d.procs = append(d.procs, proc)
+	return nil
+}
+
+// serve runs one of the in-process fakes
+func (d *devstack) serve(name, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:     addr,
+		Handler:  handler,
+		ErrorLog: log.New(d.writer(name).asWriter(), "", 0),
+	}
+	d.servers = append(d.servers, server)
+	go func() {
+		d.logf(name, "listening on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			d.logf(name, "%v", err)
+		}
+	}()
+}
+
+// Services that consume events, fed by the fake broker
+var subscribers = []string{
+	"http://localhost:8080/events",
+	"http://localhost:8081/events",
+	"http://localhost:8082/events",
+	"http://localhost:8085/events",
+}
+
+// fakeBroker accepts published events, logs them and pushes each one to
+// every subscriber in the background, signed as the collector
+func (d *devstack) fakeBroker() http.Handler {
+	client := &http.Client{Timeout: 10 * time.Second}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		d.logf("broker", "%s", readable(contentType, body))
+		w.WriteHeader(http.StatusAccepted)
+
+		for _, url := range subscribers {
+			go func() {
+				req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+				if err != nil {
+					d.logf("broker", "deliver to %s: %v", url, err)
+					return
+				}
+				req.Header.Set("Content-Type", contentType)
+				if err := d.keys.Sign(req, "collector"); err != nil {
+					d.logf("broker", "deliver to %s: %v", url, err)
+					return
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					d.logf("broker", "deliver to %s: %v", url, err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					d.logf("broker", "deliver to %s: status %d", url, resp.StatusCode)
+				}
+			}()
+		}
+	})
+	return mux
+}
+
+// readable is an event body as JSON for the log, whatever codec it was
+// published in
+func readable(contentType string, body []byte) []byte {
+	c := codec.ForContentType(contentType)
+	if c == codec.JSON {
+		return body
+	}
+	var v any
+	if err := c.Decode(bytes.NewReader(body), &v); err != nil {
+		return fmt.Appendf(nil, "<%d bytes of %s: %v>", len(body), contentType, err)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+func (d *devstack) shutdown() {
+	for i := len(d.procs) - 1; i >= 0; i-- {
+		d.procs[i].cmd.Process.Signal(os.Interrupt)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for _, p := range d.procs {
+		select {
+		case <-p.done:
+		case <-deadline:
+			p.cmd.Process.Kill()
+			<-p.done
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, s := range d.servers {
+		s.Shutdown(ctx)
+	}
+}
+
+func main() {
+	root := flag.String("root", "..", "directory containing the service modules")
+	storage := flag.String("storage", "memory", "storage backend passed to services")
+	flag.Parse()
+
+	binDir, err := os.MkdirTemp("", "devstack")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// A fresh internal signing key per run
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	signingKeys := "devstack:" + hex.EncodeToString(secret)
+
+	keys, err := signing.ParseKeyring(signingKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d := &devstack{binDir: binDir, keys: keys}
+	components := stack(*root, *storage, signingKeys)
+
+	bins := make([]string, len(components))
+	for i, c := range components {
+		d.logf("devstack", "building %s", c.name)
+		if bins[i], err = d.build(ctx, c); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	d.serve("broker", fakeBrokerAddr, d.fakeBroker())
+
+	exited := make(chan string, len(components))
+	for i, c := range components {
+		if err := d.start(bins[i], c, exited); err != nil {
+			d.shutdown()
+			log.Fatal(err)
+		}
+	}
+	d.logf("devstack", "stack is up; gateway on http://localhost:8080")
+
+	select {
+	case <-ctx.Done():
+	case name := <-exited:
+		d.logf("devstack", "%s exited, stopping stack", name)
+	}
+	d.shutdown()
+	d.logf("devstack", "stopped")
+}
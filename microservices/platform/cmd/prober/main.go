@@ -0,0 +1,420 @@
+// cmd/prober/main.go
+//
+// prober places a synthetic order through the public API every interval,
+// the way a customer would: it logs in as a test user, orders a test
+// product and reads the order back, cancelling it when checkout left the
+// payment waiting for 3-D Secure. Payments here never reach a real
+// provider, so nothing is charged; the orders carry synthetic=true in
+// their metadata to tell them apart. The test user should have no second
+// factor.
+//
+// Each step's latency is exported at /metrics and the last run at
+// /status. /healthz answers 503 once -failures runs in a row broke the
+// golden path, until one passes again; the same flip is raised with the
+// alerter ALERT_* configures (see platform/alert).
+//
+//	PROBER_PASSWORD=... go run ./cmd/prober -target http://localhost:8080 -email prober@example.com
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/alert"
+	"platform/middleware"
+)
+
+// Steps of the golden path, in order
+const (
+	stepLogin  = "login"
+	stepOrder  = "create_order"
+	stepRead   = "get_order"
+	stepCancel = "cancel_order"
+)
+
+var steps = []string{stepLogin, stepOrder, stepRead, stepCancel}
+
+// StepResult is how one step of a run went
+type StepResult struct {
+	Step       string  `json:"step"`
+	OK         bool    `json:"ok"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Run is one pass over the golden path; it stops at the first step that
+// fails
+type Run struct {
+	StartedAt time.Time    `json:"started_at"`
+	OK        bool         `json:"ok"`
+	OrderID   string       `json:"order_id,omitempty"`
+	Steps     []StepResult `json:"steps"`
+}
+
+// failed is the step that broke the run
+func (r *Run) failed() StepResult {
+	return r.Steps[len(r.Steps)-1]
+}
+
+type prober struct {
+	target   string
+	email    string
+	password string
+	product  string
+	amount   float64
+	failures int
+	client   *http.Client
+	alerts   *alert.Alerter
+
+	mu sync.Mutex
+	// last is the latest run, lastOK the latest that passed
+	last, lastOK *Run
+	// failing counts the runs that failed in a row
+	failing int
+	healthy bool
+	runs    map[bool]int64
+	latency map[string]float64
+	broken  map[string]int64
+}
+
+// apiError is an answer the golden path didn't expect
+type apiError struct {
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("answered %d: %s", e.status, e.body)
+}
+
+// call sends body as JSON to path on the target and decodes the answer
+// into out, failing on any status but want
+func (p *prober) call(ctx context.Context, method, path, token string, body, out any, want ...int) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.target+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "prober")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	middleware.Propagate(ctx, req)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	for _, status := range want {
+		if resp.StatusCode == status {
+			if out == nil {
+				return resp.StatusCode, nil
+			}
+			return resp.StatusCode, json.Unmarshal(raw, out)
+		}
+	}
+	return resp.StatusCode, &apiError{status: resp.StatusCode, body: string(bytes.TrimSpace(raw[:min(len(raw), 512)]))}
+}
+
+type order struct {
+	ID       int    `json:"id"`
+	PublicID string `json:"public_id"`
+	Status   string `json:"status"`
+}
+
+// ref is how the order is addressed in paths
+func (o *order) ref() string {
+	if o.PublicID != "" {
+		return o.PublicID
+	}
+	return strconv.Itoa(o.ID)
+}
+
+// probe runs the golden path once
+func (p *prober) probe(ctx context.Context) *Run {
+	run := &Run{StartedAt: time.Now().UTC(), Steps: []StepResult{}}
+	step := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		result := StepResult{Step: name, OK: err == nil, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		run.Steps = append(run.Steps, result)
+		return err == nil
+	}
+
+	var login struct {
+		Token string `json:"token"`
+		User  struct {
+			ID int `json:"id"`
+		} `json:"user"`
+		TwoFactorSetupRequired bool `json:"two_factor_setup_required"`
+	}
+	if !step(stepLogin, func() error {
+		status, err := p.call(ctx, http.MethodPost, "/users/login", "",
+			map[string]string{"email": p.email, "password": p.password}, &login, http.StatusOK, http.StatusAccepted)
+		switch {
+		case err != nil:
+			return err
+		case status == http.StatusAccepted || login.TwoFactorSetupRequired:
+			return errors.New("the test user is asked for a second factor")
+		case login.Token == "":
+			return errors.New("no token in the login answer")
+		}
+		return nil
+	}) {
+		return run
+	}
+
+	var placed order
+	if !step(stepOrder, func() error {
+		_, err := p.call(ctx, http.MethodPost, "/orders", login.Token, map[string]any{
+			"user_id":     login.User.ID,
+			"product":     p.product,
+			"quantity":    1,
+			"amount":      p.amount,
+			"external_id": fmt.Sprintf("probe-%d", run.StartedAt.UnixNano()),
+			"metadata":    map[string]string{"synthetic": "true"},
+		}, &placed, http.StatusOK, http.StatusCreated, http.StatusAccepted)
+		if err != nil {
+			return err
+		}
+		if placed.Status != "completed" && placed.Status != "awaiting_confirmation" {
+			return fmt.Errorf("order is %s", placed.Status)
+		}
+		return nil
+	}) {
+		return run
+	}
+	run.OrderID = placed.ref()
+
+	if !step(stepRead, func() error {
+		var read order
+		if _, err := p.call(ctx, http.MethodGet, "/orders/"+placed.ref(), login.Token, nil, &read, http.StatusOK); err != nil {
+			return err
+		}
+		if read.Status != placed.Status {
+			return fmt.Errorf("order reads back %s, was placed %s", read.Status, placed.Status)
+		}
+		return nil
+	}) {
+		return run
+	}
+
+	if placed.Status == "awaiting_confirmation" && !step(stepCancel, func() error {
+		_, err := p.call(ctx, http.MethodPost, "/orders/"+placed.ref()+"/cancel", login.Token, nil, nil, http.StatusOK)
+		return err
+	}) {
+		return run
+	}
+	run.OK = true
+	return run
+}
+
+// record keeps the run and flips health after enough failures in a row
+func (p *prober) record(ctx context.Context, run *Run) {
+	p.mu.Lock()
+	p.last = run
+	p.runs[run.OK]++
+	for _, s := range run.Steps {
+		if s.OK {
+			p.latency[s.Step] = s.DurationMS / 1000
+		} else {
+			p.broken[s.Step]++
+		}
+	}
+	wasHealthy := p.healthy
+	if run.OK {
+		p.lastOK = run
+		p.failing = 0
+		p.healthy = true
+	} else {
+		p.failing++
+		if p.failing >= p.failures {
+			p.healthy = false
+		}
+	}
+	failing, healthy := p.failing, p.healthy
+	p.mu.Unlock()
+
+	if run.OK {
+		if !wasHealthy {
+			log.Printf("golden path passes again")
+		}
+		p.alerts.Resolve(ctx, "prober/golden-path")
+		return
+	}
+	failed := run.failed()
+	log.Printf("golden path broke at %s: %s", failed.Step, failed.Error)
+	if healthy {
+		return
+	}
+	p.alerts.Alert(ctx, alert.Alert{
+		Key:      "prober/golden-path",
+		Severity: alert.Critical,
+		Summary:  fmt.Sprintf("synthetic orders fail at %s", failed.Step),
+		Details: map[string]string{
+			"step":     failed.Step,
+			"error":    failed.Error,
+			"failures": strconv.Itoa(failing),
+			"target":   p.target,
+		},
+	})
+}
+
+func (p *prober) loop(ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		run := p.probe(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		p.record(ctx, run)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// healthz is 200 while the golden path works, and until the first run
+// has had its say
+func (p *prober) healthz(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	healthy := p.healthy
+	p.mu.Unlock()
+	if !healthy {
+		http.Error(w, "golden path broken", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+func (p *prober) status(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"target":               p.target,
+		"healthy":              p.healthy,
+		"consecutive_failures": p.failing,
+		"last_run":             p.last,
+		"last_success":         p.lastOK,
+	})
+}
+
+func (p *prober) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.mu.Lock()
+	fmt.Fprintln(w, "# TYPE prober_healthy gauge")
+	healthy := 0
+	if p.healthy {
+		healthy = 1
+	}
+	fmt.Fprintf(w, "prober_healthy %d\n", healthy)
+	fmt.Fprintln(w, "# TYPE prober_runs_total counter")
+	fmt.Fprintf(w, "prober_runs_total{outcome=\"ok\"} %d\n", p.runs[true])
+	fmt.Fprintf(w, "prober_runs_total{outcome=\"failed\"} %d\n", p.runs[false])
+	fmt.Fprintln(w, "# TYPE prober_step_duration_seconds gauge")
+	for _, s := range steps {
+		if v, ok := p.latency[s]; ok {
+			fmt.Fprintf(w, "prober_step_duration_seconds{step=%q} %g\n", s, v)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE prober_step_failures_total counter")
+	for _, s := range steps {
+		fmt.Fprintf(w, "prober_step_failures_total{step=%q} %d\n", s, p.broken[s])
+	}
+	p.mu.Unlock()
+	p.alerts.WriteMetrics(w)
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "base URL of the public API (the gateway)")
+	email := flag.String("email", os.Getenv("PROBER_EMAIL"), "test user's email")
+	product := flag.String("product", "synthetic-probe", "test product to order")
+	amount := flag.Float64("amount", 1, "amount to order it for")
+	interval := flag.Duration("interval", time.Minute, "time between runs")
+	timeout := flag.Duration("timeout", 30*time.Second, "time a run may take")
+	failures := flag.Int("failures", 2, "failed runs in a row that make the prober unhealthy")
+	addr := flag.String("addr", ":8090", "address to serve /healthz, /status and /metrics on")
+	flag.Parse()
+	// The password stays out of the process list
+	password := os.Getenv("PROBER_PASSWORD")
+	if *email == "" || password == "" || *interval <= 0 || *timeout <= 0 || *failures < 1 {
+		fmt.Fprintln(os.Stderr, "usage: PROBER_PASSWORD=... prober -email E [-target URL] [-interval D] [-failures N]")
+		os.Exit(2)
+	}
+
+	alerts, err := alert.FromEnv("prober")
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &prober{
+		target:   *target,
+		email:    *email,
+		password: password,
+		product:  *product,
+		amount:   *amount,
+		failures: *failures,
+		client:   &http.Client{},
+		alerts:   alerts,
+		healthy:  true,
+		runs:     make(map[bool]int64),
+		latency:  make(map[string]float64),
+		broken:   make(map[string]int64),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", p.healthz)
+	mux.HandleFunc("GET /status", p.status)
+	mux.HandleFunc("GET /metrics", p.metrics)
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("probing %s every %s; status on %s", *target, *interval, *addr)
+
+	p.loop(ctx, *interval, *timeout)
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdown)
+}
@@ -0,0 +1,174 @@
+// cmd/schemalint/main.go
+//
+// schemalint scans every service under a directory and fails if one service
+// references a table created by another service's migrations. Services own
+// their data; reaching into someone else's tables is how a set of
+// microservices turns into a distributed monolith.
+//
+//	go run ./cmd/schemalint ..
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"platform/migrate"
+)
+
+var looksLikeSQL = regexp.MustCompile(`(?is)^\s*(SELECT|INSERT|UPDATE|DELETE|CREATE|ALTER|DROP|WITH)\s`)
+
+// snippet is a piece of SQL and where it was found
+type snippet struct {
+	file string
+	line int
+	sql  string
+}
+
+type service struct {
+	name     string
+	dir      string
+	owned    map[string]bool
+	snippets []snippet
+}
+
+func main() {
+	root := "."
+	if len(os.Args) > 1 {
+		root = os.Args[1]
+	}
+
+	services, err := findServices(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	owners := make(map[string]string)
+	for _, svc := range services {
+		for table := range svc.owned {
+			if other, ok := owners[table]; ok && other != svc.name {
+				fmt.Printf("table %s is created by both %s and %s\n", table, other, svc.name)
+				os.Exit(1)
+			}
+			owners[table] = svc.name
+		}
+	}
+
+	var violations []string
+	for _, svc := range services {
+		for _, sn := range svc.snippets {
+			for _, ref := range migrate.TableRefs(sn.sql) {
+				owner, ok := owners[ref.Table]
+				if !ok || owner == svc.name {
+					continue
+				}
+				violations = append(violations, fmt.Sprintf("%s:%d: %s references %s, owned by %s",
+					sn.file, sn.line+ref.Line-1, svc.name, ref, owner))
+			}
+		}
+	}
+
+	sort.Strings(violations)
+	for _, v := range violations {
+		fmt.Println(v)
+	}
+	if len(violations) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("schemalint: %d services, %d tables, no cross-service references\n", len(services), len(owners))
+}
+
+// findServices treats every directory with both a go.mod and a migrations
+// directory as a service
+func findServices(root string) ([]*service, error) {
+	var services []*service
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !exists(filepath.Join(path, "go.mod")) || !exists(filepath.Join(path, "migrations")) {
+			return nil
+		}
+
+		svc, err := loadService(path)
+		if err != nil {
+			return err
+		}
+		services = append(services, svc)
+		return filepath.SkipDir
+	})
+	return services, err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func loadService(dir string) (*service, error) {
+	svc := &service{name: filepath.Base(dir), dir: dir, owned: make(map[string]bool)}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".sql":
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sn := snippet{file: path, line: 1, sql: string(content)}
+			svc.snippets = append(svc.snippets, sn)
+			if strings.Contains(filepath.ToSlash(path), "/migrations/") {
+				for _, ref := range migrate.CreatedTables(sn.sql) {
+					svc.owned[ref.Table] = true
+				}
+			}
+		case ".go":
+			snippets, err := goSQL(path)
+			if err != nil {
+				return err
+			}
+			svc.snippets = append(svc.snippets, snippets...)
+		}
+		return nil
+	})
+	return svc, err
+}
+
+// goSQL returns the string literals in a Go file that look like SQL
+func goSQL(path string) ([]snippet, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	var snippets []snippet
+	ast.Inspect(file, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		s, err := strconv.Unquote(lit.Value)
+		if err != nil || !looksLikeSQL.MatchString(s) {
+			return true
+		}
+		snippets = append(snippets, snippet{file: path, line: fset.Position(lit.Pos()).Line, sql: s})
+		return true
+	})
+	return snippets, nil
+}
@@ -0,0 +1,67 @@
+// Package coalesce lets concurrent identical calls share one execution:
+// the first caller for a key runs the call and the others arriving before
+// it returns wait for its result, like x/sync/singleflight.
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errPanicked is what waiters get when the call they waited on panicked
+var errPanicked = errors.New("coalesced call panicked")
+
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Group coalesces calls by key. The zero Group is ready to use.
+type Group[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*call[V]
+}
+
+// Do runs fn for key unless a call for key is already running, in which
+// case it waits for that call's result instead. shared reports whether the
+// result came from another caller's call, so callers must treat a shared V
+// as read-only. A waiter whose context ends stops waiting; when the running
+// call fails because its own caller's context ended, waiters whose
+// contexts are still live run fn themselves rather than inherit that.
+func (g *Group[K, V]) Do(ctx context.Context, key K, fn func(ctx context.Context) (V, error)) (v V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*call[V])
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return v, ctx.Err(), false
+		}
+		if isContextErr(c.err) && ctx.Err() == nil {
+			v, err = fn(ctx)
+			return v, err, false
+		}
+		return c.value, c.err, true
+	}
+	c := &call[V]{done: make(chan struct{}), err: errPanicked}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.value, c.err = fn(ctx)
+	return c.value, c.err, false
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
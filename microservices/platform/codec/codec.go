@@ -0,0 +1,121 @@
+// Package codec picks the wire format of calls between services and of the
+// event bus: JSON, or MessagePack for high-volume paths where encoding cost
+// and size matter. The sender names the format in Content-Type and asks for
+// one in Accept; anything unrecognised is JSON, so services that don't know
+// a codec keep working.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Codec encodes and decodes one wire format
+type Codec interface {
+	ContentType() string
+	Encode(w io.Writer, v any) error
+	Decode(r io.Reader, v any) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	MsgPack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Encode(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) }
+
+func (jsonCodec) Decode(r io.Reader, v any) error { return json.NewDecoder(r).Decode(v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Encode(w io.Writer, v any) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (msgpackCodec) Decode(r io.Reader, v any) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(b, v)
+}
+
+// ByName looks a codec up by its INTERNAL_CODEC name
+func ByName(name string) (Codec, bool) {
+	switch name {
+	case "", "json":
+		return JSON, true
+	case "msgpack":
+		return MsgPack, true
+	}
+	return nil, false
+}
+
+// FromEnv is the codec named by INTERNAL_CODEC: json, the default, or
+// msgpack. Services send in it and ask for it; they answer in whatever
+// they are asked for, so it can be switched one service at a time.
+func FromEnv() (Codec, error) {
+	v := os.Getenv("INTERNAL_CODEC")
+	c, ok := ByName(v)
+	if !ok {
+		return JSON, fmt.Errorf("invalid INTERNAL_CODEC %q", v)
+	}
+	return c, nil
+}
+
+// ForContentType is the codec of a Content-Type header, JSON for anything
+// it doesn't know
+func ForContentType(contentType string) Codec {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		return MsgPack
+	}
+	return JSON
+}
+
+// Accepted is the codec r's Accept header asks for, JSON unless it names
+// MessagePack
+func Accepted(r *http.Request) Codec {
+	for part := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		if c := ForContentType(strings.TrimSpace(part)); c != JSON {
+			return c
+		}
+	}
+	return JSON
+}
+
+// Decode reads r's body in the codec its Content-Type names
+func Decode(r *http.Request, v any) error {
+	return ForContentType(r.Header.Get("Content-Type")).Decode(r.Body, v)
+}
+
+// Write answers r with v in the codec r accepts
+func Write(w http.ResponseWriter, r *http.Request, status int, v any) {
+	c := Accepted(r)
+	w.Header().Set("Content-Type", c.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	c.Encode(w, v)
+}
+
+// DecodeResponse reads resp's body in the codec its Content-Type names
+func DecodeResponse(resp *http.Response, v any) error {
+	return ForContentType(resp.Header.Get("Content-Type")).Decode(resp.Body, v)
+}
@@ -0,0 +1,978 @@
+package codec
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessagePack follows encoding/json's rules for what goes on the wire, so a
+// type encodes the same in both apart from the format: struct fields by
+// their json tags, honouring omitempty and "-"; []byte as binary; maps with
+// string or integer keys; time.Time as the timestamp extension. Types with
+// their own MarshalJSON or MarshalText go through those. Decoding into an
+// interface gives what encoding/json would: numbers as float64, objects as
+// map[string]any and arrays as []any.
+
+var (
+	timeType            = reflect.TypeFor[time.Time]()
+	jsonMarshalerType   = reflect.TypeFor[json.Marshaler]()
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// timestampExt is MessagePack's extension type for timestamps
+const timestampExt = -1
+
+// Marshal encodes v as MessagePack
+func Marshal(v any) ([]byte, error) {
+	var e encoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Unmarshal decodes MessagePack data into v, which must be a non-nil pointer
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+	d := decoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: trailing data")
+	}
+	return nil
+}
+
+// field is a struct field as encoding/json sees it
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []field
+
+// fieldsOf lists t's fields by JSON name, those of embedded structs
+// included; a shallower field shadows deeper ones of the same name
+func fieldsOf(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	seen := make(map[string]bool)
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+	current := []level{{t: t}}
+	for len(current) > 0 {
+		var next []level
+		named := make(map[string]bool)
+		for _, l := range current {
+			for i := range l.t.NumField() {
+				sf := l.t.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(slices.Clone(l.index), i)
+				if sf.Anonymous && name == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Pointer {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, level{t: ft, index: index})
+						continue
+					}
+				}
+				if !sf.IsExported() {
+					continue
+				}
+				if name == "" {
+					name = sf.Name
+				}
+				if seen[name] {
+					continue
+				}
+				named[name] = true
+				fields = append(fields, field{name: name, index: index, omitEmpty: strings.Contains(opts, "omitempty")})
+			}
+		}
+		for name := range named {
+			seen[name] = true
+		}
+		current = next
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex is v.FieldByIndex, but it stops at a nil embedded pointer
+// rather than panicking, or allocates it when alloc is set
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	t := v.Type()
+	if t == timeType {
+		e.writeTime(v.Interface().(time.Time))
+		return nil
+	}
+	if t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface {
+		switch {
+		case t.Implements(jsonMarshalerType):
+			return e.encodeViaJSON(v)
+		case reflect.PointerTo(t).Implements(jsonMarshalerType) && v.CanAddr():
+			return e.encodeViaJSON(v.Addr())
+		case t.Implements(textMarshalerType):
+			text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				return err
+			}
+			e.writeString(string(text))
+			return nil
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.writeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.writeLen(v.Len(), 0x90, 0xdc, 0xdd)
+		for i := range v.Len() {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", t)
+	}
+	return nil
+}
+
+// encodeViaJSON encodes a type with its own JSON form as that form's value
+func (e *encoder) encodeViaJSON(v reflect.Value) error {
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	b, err := v.Interface().(json.Marshaler).MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var generic any
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return e.encode(reflect.ValueOf(generic))
+}
+
+func (e *encoder) encodeMap(v reflect.Value) error {
+	keys := make([]string, 0, v.Len())
+	values := make(map[string]reflect.Value, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k, err := mapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+		values[k] = iter.Value()
+	}
+	// Sorted like encoding/json, so equal maps encode equally
+	slices.Sort(keys)
+	e.writeLen(len(keys), 0x80, 0xde, 0xdf)
+	for _, k := range keys {
+		e.writeString(k)
+		if err := e.encode(values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapKey(k reflect.Value) (string, error) {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key type %s", k.Type())
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := fieldsOf(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || (f.omitEmpty && isEmpty(fv)) {
+			continue
+		}
+		names = append(names, f.name)
+		values = append(values, fv)
+	}
+	e.writeLen(len(values), 0x80, 0xde, 0xdf)
+	for i, fv := range values {
+		e.writeString(names[i])
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) writeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.writeUint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(n))
+	}
+}
+
+func (e *encoder) writeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+	}
+}
+
+func (e *encoder) writeString(s string) {
+	switch n := len(s); {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+// writeLen writes an array or map header: fix holds up to 15 entries,
+// then 16 and 32 bit lengths
+func (e *encoder) writeLen(n int, fix, len16, len32 byte) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, len16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, len32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+// writeTime uses the smallest timestamp form that holds t. The location
+// isn't kept, so t decodes as UTC.
+func (e *encoder) writeTime(t time.Time) {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	switch {
+	case sec>>34 == 0 && nsec == 0 && sec <= math.MaxUint32:
+		e.buf = append(e.buf, 0xd6, byte(0xff))
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(sec))
+	case sec>>34 == 0:
+		e.buf = append(e.buf, 0xd7, byte(0xff))
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(nsec)<<34|uint64(sec))
+	default:
+		e.buf = append(e.buf, 0xc7, 12, byte(0xff))
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(nsec))
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(sec))
+	}
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+var errShort = errors.New("msgpack: unexpected end of data")
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errShort
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *decoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// value reads the next value the way decoding into an interface should
+// see it; exact keeps integers as int64 or uint64 rather than float64
+func (d *decoder) value(exact bool) (any, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f || c >= 0xe0 || (c >= 0xcc && c <= 0xd3):
+		n, err := d.number()
+		if err != nil || exact {
+			return n, err
+		}
+		return toFloat(n), nil
+	case c == 0xca || c == 0xcb:
+		return d.number()
+	case c == 0xc0:
+		d.pos++
+		return nil, nil
+	case c == 0xc2 || c == 0xc3:
+		d.pos++
+		return c == 0xc3, nil
+	case c >= 0xa0 && c <= 0xbf, c == 0xd9, c == 0xda, c == 0xdb:
+		return d.str()
+	case c == 0xc4 || c == 0xc5 || c == 0xc6:
+		return d.bin()
+	case c >= 0x90 && c <= 0x9f, c == 0xdc, c == 0xdd:
+		n, err := d.arrayLen()
+		if err != nil {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = d.value(exact); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case c >= 0x80 && c <= 0x8f, c == 0xde, c == 0xdf:
+		n, err := d.mapLen()
+		if err != nil {
+			return nil, err
+		}
+		out := make(map[string]any, n)
+		for range n {
+			k, err := d.value(true)
+			if err != nil {
+				return nil, err
+			}
+			key, err := keyString(k)
+			if err != nil {
+				return nil, err
+			}
+			if out[key], err = d.value(exact); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case c == 0xd6 || c == 0xd7 || c == 0xc7:
+		t, err := d.time()
+		if err != nil || exact {
+			return t, err
+		}
+		// As the string encoding/json would leave
+		return t.Format(time.RFC3339Nano), nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func keyString(k any) (string, error) {
+	switch k := k.(type) {
+	case string:
+		return k, nil
+	case int64:
+		return strconv.FormatInt(k, 10), nil
+	case uint64:
+		return strconv.FormatUint(k, 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key %T", k)
+}
+
+func toFloat(n any) float64 {
+	switch n := n.(type) {
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// number reads an integer as int64 (uint64 past its range) or a float as
+// float64
+func (d *decoder) number() (any, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	d.pos++
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0xcc && c <= 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if err != nil || n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), nil
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded width
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case c == 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case c == 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	}
+	d.pos--
+	return nil, fmt.Errorf("msgpack: expected a number, got 0x%02x", c)
+}
+
+// length reads the length in a str, bin, array or map header; fix types
+// carry it in the type byte, up to fixMax past fix
+func (d *decoder) length(c, fix byte, fixMax int, widths map[byte]int) (int, error) {
+	d.pos++
+	if c >= fix && int(c-fix) <= fixMax {
+		return int(c - fix), nil
+	}
+	size, ok := widths[c]
+	if !ok {
+		d.pos--
+		return 0, fmt.Errorf("msgpack: unexpected type byte 0x%02x", c)
+	}
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, errShort
+	}
+	return int(n), nil
+}
+
+var (
+	strWidths   = map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4}
+	binWidths   = map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4}
+	arrayWidths = map[byte]int{0xdc: 2, 0xdd: 4}
+	mapWidths   = map[byte]int{0xde: 2, 0xdf: 4}
+)
+
+func (d *decoder) str() (string, error) {
+	c, err := d.peek()
+	if err != nil {
+		return "", err
+	}
+	if c == 0xc4 || c == 0xc5 || c == 0xc6 {
+		b, err := d.bin()
+		return string(b), err
+	}
+	n, err := d.length(c, 0xa0, 31, strWidths)
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *decoder) bin() ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if (c >= 0xa0 && c <= 0xbf) || c == 0xd9 || c == 0xda || c == 0xdb {
+		s, err := d.str()
+		return []byte(s), err
+	}
+	// bin has no fix form
+	n, err := d.length(c, 0xff, -1, binWidths)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.next(n)
+	return slices.Clone(b), err
+}
+
+func (d *decoder) arrayLen() (int, error) {
+	c, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	return d.length(c, 0x90, 15, arrayWidths)
+}
+
+func (d *decoder) mapLen() (int, error) {
+	c, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	return d.length(c, 0x80, 15, mapWidths)
+}
+
+func (d *decoder) time() (time.Time, error) {
+	c, err := d.peek()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if (c >= 0xa0 && c <= 0xbf) || c == 0xd9 || c == 0xda || c == 0xdb {
+		// Sent as text by a type that marshals itself
+		s, err := d.str()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	d.pos++
+	var size int
+	switch c {
+	case 0xd6:
+		size = 4
+	case 0xd7:
+		size = 8
+	case 0xc7:
+		n, err := d.uint(1)
+		if err != nil {
+			return time.Time{}, err
+		}
+		size = int(n)
+	default:
+		d.pos--
+		return time.Time{}, fmt.Errorf("msgpack: expected a timestamp, got 0x%02x", c)
+	}
+	ext, err := d.next(1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if int8(ext[0]) != timestampExt {
+		return time.Time{}, fmt.Errorf("msgpack: unsupported extension %d", int8(ext[0]))
+	}
+	b, err := d.next(size)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch size {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0).UTC(), nil
+	case 8:
+		n := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(n&(1<<34-1)), int64(n>>34)).UTC(), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(b)
+		sec := int64(binary.BigEndian.Uint64(b[4:]))
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("msgpack: bad timestamp length %d", size)
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == 0xc0 {
+		// nil leaves values alone and clears what can be nil, as in JSON
+		d.pos++
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	t := v.Type()
+	if t.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+	if t == timeType {
+		tm, err := d.time()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	}
+	if v.CanAddr() {
+		pt := reflect.PointerTo(t)
+		switch {
+		case pt.Implements(jsonUnmarshalerType):
+			generic, err := d.value(false)
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(generic)
+			if err != nil {
+				return err
+			}
+			return v.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(b)
+		case pt.Implements(textUnmarshalerType) && t.Kind() != reflect.Slice:
+			s, err := d.str()
+			if err != nil {
+				return err
+			}
+			return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: can't decode into %s", t)
+		}
+		x, err := d.value(false)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Bool:
+		x, err := d.value(false)
+		if err != nil {
+			return err
+		}
+		b, ok := x.(bool)
+		if !ok {
+			return fmt.Errorf("msgpack: can't decode %T into %s", x, t)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := d.number()
+		if err != nil {
+			return err
+		}
+		var i int64
+		switch n := n.(type) {
+		case int64:
+			i = n
+		case float64:
+			if n != math.Trunc(n) {
+				return fmt.Errorf("msgpack: can't decode %v into %s", n, t)
+			}
+			i = int64(n)
+		default:
+			return fmt.Errorf("msgpack: %v overflows %s", n, t)
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s", i, t)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := d.number()
+		if err != nil {
+			return err
+		}
+		var u uint64
+		switch n := n.(type) {
+		case int64:
+			if n < 0 {
+				return fmt.Errorf("msgpack: %d overflows %s", n, t)
+			}
+			u = uint64(n)
+		case uint64:
+			u = n
+		case float64:
+			if n < 0 || n != math.Trunc(n) {
+				return fmt.Errorf("msgpack: can't decode %v into %s", n, t)
+			}
+			u = uint64(n)
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, t)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		n, err := d.number()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(toFloat(n))
+	case reflect.String:
+		s, err := d.str()
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b, err := d.bin()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+			return nil
+		}
+		n, err := d.arrayLen()
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(t, n, n)
+		for i := range n {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		n, err := d.arrayLen()
+		if err != nil {
+			return err
+		}
+		for i := range n {
+			if i >= v.Len() {
+				if _, err := d.value(false); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return d.decodeMap(v)
+	case reflect.Struct:
+		return d.decodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", t)
+	}
+	return nil
+}
+
+func (d *decoder) decodeMap(v reflect.Value) error {
+	t := v.Type()
+	n, err := d.mapLen()
+	if err != nil {
+		return err
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, n))
+	}
+	for range n {
+		k, err := d.value(true)
+		if err != nil {
+			return err
+		}
+		key := reflect.New(t.Key()).Elem()
+		s, err := keyString(k)
+		if err != nil {
+			return err
+		}
+		switch t.Key().Kind() {
+		case reflect.String:
+			key.SetString(s)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || key.OverflowInt(i) {
+				return fmt.Errorf("msgpack: bad map key %q for %s", s, t)
+			}
+			key.SetInt(i)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			u, err := strconv.ParseUint(s, 10, 64)
+			if err != nil || key.OverflowUint(u) {
+				return fmt.Errorf("msgpack: bad map key %q for %s", s, t)
+			}
+			key.SetUint(u)
+		default:
+			return fmt.Errorf("msgpack: unsupported map key type %s", t.Key())
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+func (d *decoder) decodeStruct(v reflect.Value) error {
+	fields := fieldsOf(v.Type())
+	n, err := d.mapLen()
+	if err != nil {
+		return err
+	}
+	for range n {
+		name, err := d.str()
+		if err != nil {
+			return err
+		}
+		// An exact match first, then any case, as encoding/json matches
+		i := slices.IndexFunc(fields, func(f field) bool { return f.name == name })
+		if i < 0 {
+			i = slices.IndexFunc(fields, func(f field) bool { return strings.EqualFold(f.name, name) })
+		}
+		if i < 0 {
+			if _, err := d.value(true); err != nil {
+				return err
+			}
+			continue
+		}
+		fv, _ := fieldByIndex(v, fields[i].index, true)
+		if err := d.decode(fv); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Package cost keeps a running account of what one request costs the
+// service: the database queries it ran and the downstream calls it made,
+// with how long each took. The record rides in the request's context, so
+// the database layer and the HTTP clients add to it without the handlers
+// passing anything along; the middleware reads it back when the request
+// is done.
+package cost
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Calls is how often a request called one downstream service, and for how
+// long in all
+type Calls struct {
+	Count int
+	Time  time.Duration
+}
+
+// Cost is a snapshot of a record
+type Cost struct {
+	// Client is who made the request, as the auth middleware saw it; ""
+	// for anonymous requests
+	Client string
+	// Queries counts statements run outside transactions, and each
+	// transaction once
+	Queries   int
+	QueryTime time.Duration
+	// Calls is keyed by downstream service
+	Calls map[string]Calls
+}
+
+// Record accumulates one request's cost; it's safe for the concurrent
+// steps of a request to add to it
+type Record struct {
+	mu   sync.Mutex
+	cost Cost
+}
+
+type recordKey struct{}
+
+// With gives ctx a record to account its request's cost in, or finds the
+// one it already has
+func With(ctx context.Context) (context.Context, *Record) {
+	if r, ok := ctx.Value(recordKey{}).(*Record); ok {
+		return ctx, r
+	}
+	r := &Record{cost: Cost{Calls: make(map[string]Calls)}}
+	return context.WithValue(ctx, recordKey{}, r), r
+}
+
+func fromContext(ctx context.Context) *Record {
+	r, _ := ctx.Value(recordKey{}).(*Record)
+	return r
+}
+
+// Query adds a database query that took d to ctx's request; outside a
+// request it does nothing
+func Query(ctx context.Context, d time.Duration) {
+	if r := fromContext(ctx); r != nil {
+		r.mu.Lock()
+		r.cost.Queries++
+		r.cost.QueryTime += d
+		r.mu.Unlock()
+	}
+}
+
+// Call adds a call to service that took d to ctx's request
+func Call(ctx context.Context, service string, d time.Duration) {
+	if r := fromContext(ctx); r != nil {
+		r.mu.Lock()
+		c := r.cost.Calls[service]
+		c.Count++
+		c.Time += d
+		r.cost.Calls[service] = c
+		r.mu.Unlock()
+	}
+}
+
+// SetClient names who made ctx's request once they're known
+func SetClient(ctx context.Context, client string) {
+	if r := fromContext(ctx); r != nil {
+		r.mu.Lock()
+		r.cost.Client = client
+		r.mu.Unlock()
+	}
+}
+
+// Cost is what the request has cost so far
+func (r *Record) Cost() Cost {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.cost
+	c.Calls = maps.Clone(r.cost.Calls)
+	return c
+}
@@ -0,0 +1,529 @@
+// Package dbretry retries database operations that failed for a passing
+// reason — a dropped connection, a serialization failure, a deadlock — with
+// backoff, and gives every other error back at once. Errors are told apart
+// by their SQLSTATE, read through the SQLState method drivers provide, so
+// callers don't depend on a driver's error type.
+//
+// Every statement also runs under a time limit for its query class, so a
+// runaway listing or report is canceled rather than holding a pool
+// connection for good. Postgres' statement_timeout backs the limit up on
+// the server side.
+//
+// Open configures all that from the environment, including whether the
+// services reach Postgres directly or through pgbouncer in transaction
+// pooling mode.
+package dbretry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"platform/cost"
+	"platform/migrate"
+	"platform/priority"
+)
+
+// Class says whether an operation that failed may be tried again
+type Class int
+
+const (
+	// Permanent errors come back the same however often they're retried
+	Permanent Class = iota
+	// Rejected means the database didn't apply the operation: it couldn't
+	// be reached, or it rolled the transaction back to break a deadlock or
+	// serialization conflict. Retrying is always safe.
+	Rejected
+	// Lost means the connection dropped while the operation was underway,
+	// so it may or may not have been applied. Retrying is safe for reads
+	// and for transactions that hadn't committed yet.
+	Lost
+)
+
+func (c Class) String() string {
+	switch c {
+	case Rejected:
+		return "rejected"
+	case Lost:
+		return "lost"
+	}
+	return "permanent"
+}
+
+// SQLState returns the SQLSTATE code of a database error, or ""
+func SQLState(err error) string {
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		return state.SQLState()
+	}
+	return ""
+}
+
+// Classify sorts an error into the ways it can be retried
+func Classify(err error) Class {
+	if err == nil || errors.Is(err, ErrCommitUnknown) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Permanent
+	}
+	switch code := SQLState(err); {
+	case code == "40001", // serialization_failure
+		code == "40P01", // deadlock_detected
+		code == "55P03", // lock_not_available
+		code == "53300", // too_many_connections
+		code == "57P03", // cannot_connect_now
+		code == "08001", // sqlclient_unable_to_establish_sqlconnection
+		code == "08004": // sqlserver_rejected_establishment_of_sqlconnection
+		return Rejected
+	case code == "57P01", // admin_shutdown
+		code == "57P02", // crash_shutdown
+		strings.HasPrefix(code, "08"):
+		return Lost
+	case code != "":
+		return Permanent
+	}
+	// database/sql returns ErrBadConn only for connections that failed
+	// before the statement went out
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) {
+		return Rejected
+	}
+	var netErr net.Error
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return Lost
+	}
+	return Permanent
+}
+
+// Policy is how often and how far apart operations are tried
+type Policy struct {
+	// Attempts counts the first try; 1 turns retrying off
+	Attempts   int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultPolicy = Policy{Attempts: 4, MinBackoff: 50 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// PolicyFromEnv reads DB_RETRY_ATTEMPTS and DB_RETRY_MAX_BACKOFF over
+// DefaultPolicy
+func PolicyFromEnv() (Policy, error) {
+	p := DefaultPolicy
+	if v := os.Getenv("DB_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("invalid DB_RETRY_ATTEMPTS %q", v)
+		}
+		p.Attempts = n
+	}
+	if v := os.Getenv("DB_RETRY_MAX_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < p.MinBackoff {
+			return p, fmt.Errorf("invalid DB_RETRY_MAX_BACKOFF %q", v)
+		}
+		p.MaxBackoff = d
+	}
+	return p, nil
+}
+
+// Do runs fn until it succeeds, fails for good, or runs out of attempts.
+// Errors of the classes in retry are tried again after jittered
+// exponential backoff; anything else is returned straight away.
+func (p Policy) Do(ctx context.Context, retry func(Class) bool, fn func(ctx context.Context) error) error {
+	backoff := p.MinBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.Attempts || !retry(Classify(err)) {
+			return err
+		}
+		select {
+		case <-time.After(backoff/2 + rand.N(backoff/2+1)):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, p.MaxBackoff)
+	}
+}
+
+func rejected(c Class) bool { return c == Rejected }
+
+func transient(c Class) bool { return c != Permanent }
+
+// reads reports whether a statement only reads, so running it again after
+// a lost connection can't apply anything twice
+func reads(query string) bool {
+	q := strings.TrimLeft(query, " \t\r\n(")
+	return len(q) >= 6 && strings.EqualFold(q[:6], "SELECT")
+}
+
+func retryFor(query string) func(Class) bool {
+	if reads(query) {
+		return transient
+	}
+	return rejected
+}
+
+// QueryClass sets how long a statement may run
+type QueryClass int
+
+const (
+	// OLTP statements serve interactive requests and should be quick
+	OLTP QueryClass = iota
+	// Reporting statements scan a lot, for listings, exports and reports
+	Reporting
+)
+
+func (c QueryClass) String() string {
+	if c == Reporting {
+		return "reporting"
+	}
+	return "oltp"
+}
+
+type classKey struct{}
+
+// WithQueryClass marks the statements run with ctx as class c
+func WithQueryClass(ctx context.Context, c QueryClass) context.Context {
+	return context.WithValue(ctx, classKey{}, c)
+}
+
+// QueryClassFromContext returns the class ctx was marked with. Unmarked
+// batch requests are reporting, everything else OLTP.
+func QueryClassFromContext(ctx context.Context) QueryClass {
+	if c, ok := ctx.Value(classKey{}).(QueryClass); ok {
+		return c
+	}
+	if priority.FromContext(ctx) == priority.Batch {
+		return Reporting
+	}
+	return OLTP
+}
+
+// ReportingQueries marks the database work of the requests it wraps as
+// reporting, e.g. for an admin listing across all users
+func ReportingQueries(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithQueryClass(r.Context(), Reporting)))
+	})
+}
+
+// Timeouts bound each statement by its class; zero leaves it unbounded
+type Timeouts struct {
+	OLTP      time.Duration
+	Reporting time.Duration
+}
+
+var DefaultTimeouts = Timeouts{OLTP: 5 * time.Second, Reporting: time.Minute}
+
+func (t Timeouts) For(c QueryClass) time.Duration {
+	if c == Reporting {
+		return t.Reporting
+	}
+	return t.OLTP
+}
+
+// Longest is the limit of the longest running class, zero if any is
+// unbounded
+func (t Timeouts) Longest() time.Duration {
+	if t.OLTP == 0 || t.Reporting == 0 {
+		return 0
+	}
+	return max(t.OLTP, t.Reporting)
+}
+
+// TimeoutsFromEnv reads DB_TIMEOUT_OLTP and DB_TIMEOUT_REPORTING over
+// DefaultTimeouts
+func TimeoutsFromEnv() (Timeouts, error) {
+	t := DefaultTimeouts
+	for name, d := range map[string]*time.Duration{"DB_TIMEOUT_OLTP": &t.OLTP, "DB_TIMEOUT_REPORTING": &t.Reporting} {
+		if v := os.Getenv(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+				return t, fmt.Errorf("invalid %s %q", name, v)
+			}
+		}
+	}
+	return t, nil
+}
+
+// WithStatementTimeout sets Postgres' statement_timeout on every
+// connection of dsn, so the server cancels statements its clients failed
+// to. It should be Timeouts.Longest; zero leaves dsn as it is.
+func WithStatementTimeout(dsn string, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		return dsn, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("statement_timeout", strconv.FormatInt(timeout.Milliseconds(), 10))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// WithUTC has Postgres hand timestamps back in UTC, as services stamp
+// them, whatever the server's own time zone. pgbouncer passes TimeZone
+// through in either pool mode.
+func WithUTC(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("timezone", "UTC")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// PoolMode is how connections reach Postgres
+type PoolMode int
+
+const (
+	// SessionPooling is a connection of our own for as long as we hold it,
+	// direct or through pgbouncer in session mode
+	SessionPooling PoolMode = iota
+	// TransactionPooling shares server connections between clients at
+	// transaction boundaries, as pgbouncer's transaction mode does. Nothing
+	// set on a session survives past the statement or transaction, and
+	// pgbouncer refuses startup parameters it doesn't know, so search_path
+	// and statement_timeout must be set on the pgbouncer database entry
+	// instead, e.g. connect_query='SET search_path TO orders'.
+	TransactionPooling
+)
+
+// PoolModeFromEnv reads DB_POOL_MODE: session (the default) or transaction
+func PoolModeFromEnv() (PoolMode, error) {
+	switch v := os.Getenv("DB_POOL_MODE"); v {
+	case "", "session":
+		return SessionPooling, nil
+	case "transaction":
+		return TransactionPooling, nil
+	default:
+		return SessionPooling, fmt.Errorf("invalid DB_POOL_MODE %q", v)
+	}
+}
+
+// ForTransactionPooling has lib/pq send each statement with its parameters
+// in one go. Otherwise it prepares an unnamed statement and binds it in a
+// second exchange, which pgbouncer may route to another server connection
+// that never saw the statement.
+func ForTransactionPooling(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("binary_parameters", "yes")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Open opens the Postgres pool of the service owning schema, configured
+// from the environment: retry policy, query timeouts and pool mode. Its
+// sessions are in UTC.
+func Open(dsn, schema string) (*DB, error) {
+	policy, err := PolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	timeouts, err := TimeoutsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	mode, err := PoolModeFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if mode == TransactionPooling {
+		dsn, err = ForTransactionPooling(dsn)
+	} else if dsn, err = migrate.WithSearchPath(dsn, schema); err == nil {
+		dsn, err = WithStatementTimeout(dsn, timeouts.Longest())
+	}
+	if err == nil {
+		dsn, err = WithUTC(dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, policy, timeouts), nil
+}
+
+// DB wraps a pool so each statement is retried per the policy and bounded
+// by its class's timeout. Statements inside transactions aren't retried one
+// by one; Tx retries the whole transaction instead.
+type DB struct {
+	*sql.DB
+	policy   Policy
+	timeouts Timeouts
+}
+
+func New(db *sql.DB, policy Policy, timeouts Timeouts) *DB {
+	return &DB{DB: db, policy: policy, timeouts: timeouts}
+}
+
+// bound applies the statement's time limit to ctx
+func (db *DB) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := db.timeouts.For(QueryClassFromContext(ctx)); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	var res sql.Result
+	err := db.policy.Do(ctx, retryFor(query), func(ctx context.Context) error {
+		ctx, cancel := db.bound(ctx)
+		defer cancel()
+		start := time.Now()
+		var err error
+		res, err = db.DB.ExecContext(ctx, query, args...)
+		cost.Query(ctx, time.Since(start))
+		return err
+	})
+	return res, err
+}
+
+// QueryContext bounds the whole read of the rows, not just the query:
+// rows still open when the limit passes are canceled along with it
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := db.policy.Do(ctx, retryFor(query), func(ctx context.Context) error {
+		ctx, cancel := db.bound(ctx)
+		start := time.Now()
+		var err error
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		cost.Query(ctx, time.Since(start))
+		if err != nil {
+			cancel()
+			return err
+		}
+		// The rows outlive this call; the limit's timer releases ctx
+		return nil
+	})
+	return rows, err
+}
+
+// Row is QueryRowContext's result, scanned like sql.Row
+type Row struct {
+	rows *sql.Rows
+	err  error
+}
+
+func (r *Row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	return r.rows.Close()
+}
+
+func (r *Row) Err() error {
+	return r.err
+}
+
+// QueryRowContext retries the query itself; errors that only show while
+// reading the row come back from Scan untried
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	rows, err := db.QueryContext(ctx, query, args...)
+	return &Row{rows: rows, err: err}
+}
+
+// BeginTx retries starting the transaction, nothing after it
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := db.policy.Do(ctx, transient, func(ctx context.Context) error {
+		var err error
+		tx, err = db.DB.BeginTx(ctx, opts)
+		return err
+	})
+	return tx, err
+}
+
+// ErrCommitUnknown means the connection dropped during COMMIT, so the
+// transaction may have been applied; it isn't retried
+var ErrCommitUnknown = errors.New("connection lost during commit")
+
+// Tx runs fn in a transaction and commits it, running it again from the
+// start in a new transaction if it fails for a passing reason. fn may run
+// more than once, so it mustn't have effects outside the transaction. Each
+// attempt costs the request one query, for as long as it took.
+func (db *DB) Tx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	return db.policy.Do(ctx, transient, func(ctx context.Context) error {
+		ctx, cancel := db.bound(ctx)
+		defer cancel()
+		start := time.Now()
+		defer func() { cost.Query(ctx, time.Since(start)) }()
+		tx, err := db.DB.BeginTx(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			if Classify(err) == Lost {
+				return fmt.Errorf("%w: %w", ErrCommitUnknown, err)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// Status maps an error to the HTTP status it should be answered with:
+// conflicts and bad input for the constraint and data errors clients can
+// act on, 503 for passing failures that outlasted the retries
+func Status(err error) int {
+	switch code := SQLState(err); {
+	case errors.Is(err, ErrCommitUnknown):
+		return http.StatusInternalServerError
+	case code == "23505", code == "23503": // unique_violation, foreign_key_violation
+		return http.StatusConflict
+	case code == "23502", code == "23514", strings.HasPrefix(code, "22"): // not_null, check, data exceptions
+		return http.StatusBadRequest
+	case code == "57014", errors.Is(err, context.DeadlineExceeded): // query_canceled, e.g. statement_timeout
+		return http.StatusGatewayTimeout
+	}
+	if Classify(err) != Permanent {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Error answers a failed request with err and the status Status picks for
+// it, asking clients to come back shortly when the failure is passing
+func Error(w http.ResponseWriter, err error) {
+	status := Status(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, err.Error(), status)
+}
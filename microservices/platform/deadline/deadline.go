@@ -0,0 +1,101 @@
+// Package deadline propagates a request's remaining time budget between
+// services and lets handlers split it across their downstream steps, so a
+// request that can no longer finish in time fails fast with 504 instead of
+// doing useless work.
+//
+// The budget travels as remaining milliseconds rather than an absolute time,
+// so clock skew between hosts doesn't matter.
+package deadline
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const Header = "X-Request-Budget-Ms"
+
+var ErrInsufficientBudget = errors.New("deadline budget exhausted")
+
+// Middleware applies the budget from the incoming header, capped by
+// defaultBudget when it is non-zero. Requests without a header get
+// defaultBudget; zero means no deadline.
+func Middleware(defaultBudget time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			budget := defaultBudget
+			if h := r.Header.Get(Header); h != "" {
+				ms, err := strconv.ParseInt(h, 10, 64)
+				if err != nil {
+					http.Error(w, "invalid "+Header, http.StatusBadRequest)
+					return
+				}
+				if ms <= 0 {
+					http.Error(w, ErrInsufficientBudget.Error(), http.StatusGatewayTimeout)
+					return
+				}
+				if b := time.Duration(ms) * time.Millisecond; defaultBudget == 0 || b < defaultBudget {
+					budget = b
+				}
+			}
+			if budget == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Remaining reports the time left before ctx's deadline; ok is false when
+// ctx has no deadline
+func Remaining(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(d), true
+}
+
+// Propagate writes the remaining budget onto an outgoing request
+func Propagate(ctx context.Context, req *http.Request) {
+	if remaining, ok := Remaining(ctx); ok {
+		req.Header.Set(Header, strconv.FormatInt(max(remaining.Milliseconds(), 0), 10))
+	}
+}
+
+// Require fails with ErrInsufficientBudget unless at least need remains
+func Require(ctx context.Context, need time.Duration) error {
+	if remaining, ok := Remaining(ctx); ok && remaining < need {
+		return ErrInsufficientBudget
+	}
+	return nil
+}
+
+// Step derives a context for one step of a handler, limited to fraction of
+// the remaining budget. It fails with ErrInsufficientBudget when that share
+// is smaller than need, the least the step could possibly finish in.
+func Step(ctx context.Context, fraction float64, need time.Duration) (context.Context, context.CancelFunc, error) {
+	remaining, ok := Remaining(ctx)
+	if !ok {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+
+	share := time.Duration(float64(remaining) * fraction)
+	if share < need {
+		return nil, nil, ErrInsufficientBudget
+	}
+	ctx, cancel := context.WithTimeout(ctx, share)
+	return ctx, cancel, nil
+}
+
+// Exceeded reports whether err came from running out of budget
+func Exceeded(err error) bool {
+	return errors.Is(err, ErrInsufficientBudget) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,188 @@
+// Package degrade decides what a service does when a dependency is down,
+// instead of failing every request that needs it. The policy is declared
+// in config, one rule per dependency naming its fallback, e.g.
+//
+//	DEGRADATION=payment-service=accept,user-service=cache
+//
+// and each service enforces the fallbacks it supports where it calls the
+// dependency. A request served by a fallback says so in an X-Degraded
+// response header, and is counted in the metrics.
+package degrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/middleware"
+)
+
+// Header lists the fallbacks that served a response, as
+// dependency=fallback pairs
+const Header = "X-Degraded"
+
+type usage struct {
+	requests int64
+	last     time.Time
+}
+
+// Policy is the fallback for each dependency that has one
+type Policy struct {
+	rules map[string]string
+
+	mu    sync.Mutex
+	usage map[string]*usage
+}
+
+// Parse reads comma-separated dependency=fallback rules, accepting only the
+// fallbacks supported lists for each dependency
+func Parse(spec string, supported map[string][]string) (*Policy, error) {
+	p := &Policy{rules: make(map[string]string), usage: make(map[string]*usage)}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		dep, fallback, ok := strings.Cut(rule, "=")
+		if !ok || dep == "" || fallback == "" {
+			return nil, fmt.Errorf("invalid degradation rule %q", rule)
+		}
+		if !slices.Contains(supported[dep], fallback) {
+			return nil, fmt.Errorf("unsupported degradation rule %q", rule)
+		}
+		if _, dup := p.rules[dep]; dup {
+			return nil, fmt.Errorf("duplicate degradation rule for %q", dep)
+		}
+		p.rules[dep] = fallback
+	}
+	return p, nil
+}
+
+// FromEnv reads the policy from DEGRADATION; nil when it isn't set, so
+// every dependency failure fails the request
+func FromEnv(supported map[string][]string) (*Policy, error) {
+	spec := os.Getenv("DEGRADATION")
+	if spec == "" {
+		return nil, nil
+	}
+	return Parse(spec, supported)
+}
+
+// Fallback is dep's fallback, or "" when it has none
+func (p *Policy) Fallback(dep string) string {
+	if p == nil {
+		return ""
+	}
+	return p.rules[dep]
+}
+
+type marksKey struct{}
+
+// marks are the fallbacks that served one request
+type marks struct {
+	mu    sync.Mutex
+	rules []string
+}
+
+// Degraded records that ctx's request was served by dep's fallback
+// because dep was down
+func (p *Policy) Degraded(ctx context.Context, dep string) {
+	fallback := p.Fallback(dep)
+	if fallback == "" {
+		return
+	}
+	p.mu.Lock()
+	u, ok := p.usage[dep]
+	if !ok {
+		u = &usage{}
+		p.usage[dep] = u
+	}
+	u.requests++
+	u.last = time.Now()
+	p.mu.Unlock()
+
+	if m, ok := ctx.Value(marksKey{}).(*marks); ok {
+		rule := dep + "=" + fallback
+		m.mu.Lock()
+		if !slices.Contains(m.rules, rule) {
+			m.rules = append(m.rules, rule)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Middleware lets handlers mark their requests degraded, and puts the
+// marks on the response as its header goes out
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := &marks{}
+		r = r.WithContext(context.WithValue(r.Context(), marksKey{}, m))
+		next.ServeHTTP(&degradedWriter{ResponseRecorder: middleware.NewRecorder(w), marks: m}, r)
+	})
+}
+
+type degradedWriter struct {
+	*middleware.ResponseRecorder
+	marks *marks
+	sent  bool
+}
+
+func (w *degradedWriter) setHeader() {
+	if w.sent {
+		return
+	}
+	w.sent = true
+	w.marks.mu.Lock()
+	defer w.marks.mu.Unlock()
+	if len(w.marks.rules) > 0 {
+		w.Header().Set(Header, strings.Join(w.marks.rules, ", "))
+	}
+}
+
+func (w *degradedWriter) WriteHeader(status int) {
+	w.setHeader()
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *degradedWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseRecorder.Write(b)
+}
+
+func (p *Policy) WriteMetrics(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deps := make([]string, 0, len(p.rules))
+	for dep := range p.rules {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	fmt.Fprintln(w, "# TYPE degradation_rule gauge")
+	for _, dep := range deps {
+		fmt.Fprintf(w, "degradation_rule{dependency=%q,fallback=%q} 1\n", dep, p.rules[dep])
+	}
+	fmt.Fprintln(w, "# TYPE degraded_requests_total counter")
+	for _, dep := range deps {
+		var n int64
+		if u := p.usage[dep]; u != nil {
+			n = u.requests
+		}
+		fmt.Fprintf(w, "degraded_requests_total{dependency=%q,fallback=%q} %d\n", dep, p.rules[dep], n)
+	}
+	// Alert on time() minus this to see which dependencies are being
+	// covered for right now
+	fmt.Fprintln(w, "# TYPE degraded_last_timestamp_seconds gauge")
+	for _, dep := range deps {
+		if u := p.usage[dep]; u != nil {
+			fmt.Fprintf(w, "degraded_last_timestamp_seconds{dependency=%q,fallback=%q} %d\n", dep, p.rules[dep], u.last.Unix())
+		}
+	}
+}
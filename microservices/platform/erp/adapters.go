@@ -0,0 +1,99 @@
+package erp
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"platform/middleware"
+)
+
+// RESTAdapter posts each batch as {"batch_id", "kind", "day", "records"},
+// a record being an object of the mapped fields. The batch ID is also the
+// Idempotency-Key, so an ERP that honours it takes a retried batch once.
+type RESTAdapter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewRESTAdapter(url, token string) *RESTAdapter {
+	return &RESTAdapter{url: url, token: token, client: &http.Client{Timeout: time.Minute}}
+}
+
+func (a *RESTAdapter) Push(ctx context.Context, b *Batch) error {
+	records := make([]map[string]string, len(b.Rows))
+	for i, row := range b.Rows {
+		records[i] = make(map[string]string, len(b.Fields))
+		for j, field := range b.Fields {
+			records[i][field] = row[j]
+		}
+	}
+	body, err := json.Marshal(map[string]any{"batch_id": b.ID, "kind": b.Kind, "day": b.Day, "records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", b.ID)
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	middleware.Propagate(ctx, req)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("ERP answered %s: %s", resp.Status, bytes.TrimSpace(detail))
+	// The ERP refused the batch itself; sending it again won't change that
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// FileAdapter writes each batch as a CSV file named after it, with a
+// header row of the mapped fields. The file appears whole, by rename, so
+// whatever collects it never reads half a batch; a retry replaces it.
+type FileAdapter struct {
+	dir string
+}
+
+func NewFileAdapter(dir string) *FileAdapter {
+	return &FileAdapter{dir: dir}
+}
+
+func (a *FileAdapter) Push(ctx context.Context, b *Batch) error {
+	tmp, err := os.CreateTemp(a.dir, "."+b.ID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	cw := csv.NewWriter(tmp)
+	cw.Write(b.Fields)
+	cw.WriteAll(b.Rows)
+	if err := cw.Error(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(a.dir, b.ID+".csv"))
+}
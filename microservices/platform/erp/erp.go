@@ -0,0 +1,634 @@
+// Package erp exports a service's settled records to an ERP or accounting
+// system a day (UTC) at a time: order-service its completed orders,
+// payment-service its captured payments. Each day's records of a kind are
+// rendered through a mapping of ERP fields to templates and pushed as one
+// batch by an Adapter, which posts it to a REST endpoint or drops it as a
+// CSV file in a directory. A failed export is retried with backoff until
+// it runs out of attempts and is dead-lettered; once the ERP is fixed,
+// finance retries it from /admin/erp/exports.
+//
+// The service's schema needs a table for the Postgres repository, named
+// after the service as the services may share a database:
+//
+//	CREATE TABLE order_erp_exports (
+//	    kind TEXT NOT NULL,
+//	    day DATE NOT NULL,
+//	    status TEXT NOT NULL,
+//	    records INTEGER NOT NULL DEFAULT 0,
+//	    attempts INTEGER NOT NULL DEFAULT 0,
+//	    last_error TEXT NOT NULL DEFAULT '',
+//	    next_attempt_at TIMESTAMPTZ,
+//	    exported_at TIMESTAMPTZ,
+//	    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//	    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//	    PRIMARY KEY (kind, day)
+//	);
+package erp
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+)
+
+// Export states. A pending export waits for the worker; a failed one for
+// its retry. Only a retry from the API exports a dead-lettered one again.
+const (
+	Pending      = "pending"
+	Exported     = "exported"
+	Failed       = "failed"
+	DeadLettered = "dead_lettered"
+)
+
+var (
+	ErrNotFound = errors.New("export not found")
+	errRecord   = errors.New("record attempt")
+)
+
+// Export is the export of one kind of record for one day
+type Export struct {
+	Kind          string     `json:"kind"`
+	Day           string     `json:"day"`
+	Status        string     `json:"status"`
+	Records       int        `json:"records"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	ExportedAt    *time.Time `json:"exported_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// BatchID names the export's batch the same on every attempt, so the ERP
+// can tell a retry from a new batch
+func (e *Export) BatchID() string {
+	return e.Kind + "-" + e.Day
+}
+
+// Field is one field of the ERP's format and the text/template that
+// renders it from a record, e.g. {"name": "Amount", "value": "{{money .amount}}"}.
+// Records are their JSON form, so templates use the JSON field names.
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Source is one kind of record a service exports
+type Source struct {
+	Kind string
+	// Records returns the kind's records of [from, to), as values that
+	// encode to JSON objects
+	Records func(ctx context.Context, from, to time.Time) ([]any, error)
+	// Mapping is used unless ERP_MAPPING has one for Kind
+	Mapping []Field
+
+	templates []*template.Template
+}
+
+var funcs = template.FuncMap{
+	// money formats an amount with two decimals
+	"money": func(v any) (string, error) {
+		f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+		if err != nil {
+			return "", fmt.Errorf("money: %v is not a number", v)
+		}
+		return strconv.FormatFloat(f, 'f', 2, 64), nil
+	},
+	// date cuts an RFC 3339 time down to its day
+	"date": func(v any) string {
+		s := fmt.Sprint(v)
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t.UTC().Format(time.DateOnly)
+		}
+		return s
+	},
+	"upper": strings.ToUpper,
+}
+
+func (s *Source) compile() error {
+	if len(s.Mapping) == 0 {
+		return fmt.Errorf("erp: %s has no mapping", s.Kind)
+	}
+	s.templates = s.templates[:0]
+	for _, f := range s.Mapping {
+		t, err := template.New(f.Name).Funcs(funcs).Parse(f.Value)
+		if err != nil {
+			return fmt.Errorf("erp: %s mapping of %s: %w", s.Kind, f.Name, err)
+		}
+		s.templates = append(s.templates, t)
+	}
+	return nil
+}
+
+// render maps records to the rows of a batch. A field the record doesn't
+// have renders empty.
+func (s *Source) render(e *Export, records []any) (*Batch, error) {
+	b := &Batch{ID: e.BatchID(), Kind: e.Kind, Day: e.Day, Rows: [][]string{}}
+	for _, f := range s.Mapping {
+		b.Fields = append(b.Fields, f.Name)
+	}
+	var buf bytes.Buffer
+	for i, record := range records {
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]any
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(s.templates))
+		for j, t := range s.templates {
+			buf.Reset()
+			if err := t.Execute(&buf, fields); err != nil {
+				return nil, Permanent(fmt.Errorf("record %d: %w", i, err))
+			}
+			row[j] = strings.ReplaceAll(buf.String(), "<no value>", "")
+		}
+		b.Rows = append(b.Rows, row)
+	}
+	return b, nil
+}
+
+// Batch is a day's records of one kind as the ERP gets them
+type Batch struct {
+	ID     string
+	Kind   string
+	Day    string
+	Fields []string
+	Rows   [][]string
+}
+
+// Adapter delivers batches to the ERP. Pushing a batch again replaces
+// what an earlier push of the same ID delivered.
+type Adapter interface {
+	Push(ctx context.Context, b *Batch) error
+}
+
+type permanent struct{ error }
+
+func (p permanent) Unwrap() error { return p.error }
+
+// Permanent marks an error retrying won't fix, such as the ERP rejecting
+// the batch, so the export is dead-lettered straight away
+func Permanent(err error) error {
+	return permanent{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanent
+	return errors.As(err, &p)
+}
+
+// Filter selects exports, newest day first; empty fields match any
+type Filter struct {
+	Day    string
+	Status string
+	Limit  int
+}
+
+// Repository keeps the exports
+type Repository interface {
+	// Ensure records a pending export of kind for day unless there is one
+	Ensure(ctx context.Context, kind, day string) error
+	Get(ctx context.Context, kind, day string) (*Export, error)
+	List(ctx context.Context, f Filter) ([]Export, error)
+	Save(ctx context.Context, e *Export) error
+	// ClaimDue returns pending exports and failed ones whose retry is due,
+	// pushing their next attempt back by lease so other replicas skip them
+	ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Export, error)
+}
+
+type PostgresRepository struct {
+	db    *dbretry.DB
+	table string
+}
+
+// NewPostgresRepository keeps the exports in table
+func NewPostgresRepository(db *dbretry.DB, table string) *PostgresRepository {
+	return &PostgresRepository{db: db, table: table}
+}
+
+const columns = `kind, to_char(day, 'YYYY-MM-DD'), status, records, attempts, last_error, next_attempt_at,
+              exported_at, created_at, updated_at`
+
+func scanExport(scan func(...any) error, e *Export) error {
+	var next, exported sql.NullTime
+	err := scan(&e.Kind, &e.Day, &e.Status, &e.Records, &e.Attempts, &e.LastError, &next, &exported,
+		&e.CreatedAt, &e.UpdatedAt)
+	if next.Valid {
+		e.NextAttemptAt = &next.Time
+	}
+	if exported.Valid {
+		e.ExportedAt = &exported.Time
+	}
+	return err
+}
+
+func (r *PostgresRepository) Ensure(ctx context.Context, kind, day string) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO `+r.table+` (kind, day, status) VALUES ($1, $2::date, $3)
+              ON CONFLICT (kind, day) DO NOTHING`, kind, day, Pending)
+	return err
+}
+
+func (r *PostgresRepository) Get(ctx context.Context, kind, day string) (*Export, error) {
+	var e Export
+	err := scanExport(r.db.QueryRowContext(ctx, `SELECT `+columns+` FROM `+r.table+`
+              WHERE kind = $1 AND day = $2::date`, kind, day).Scan, &e)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (r *PostgresRepository) query(ctx context.Context, query string, args ...any) ([]Export, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []Export
+	for rows.Next() {
+		var e Export
+		if err := scanExport(rows.Scan, &e); err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+func (r *PostgresRepository) List(ctx context.Context, f Filter) ([]Export, error) {
+	return r.query(ctx, `SELECT `+columns+` FROM `+r.table+`
+              WHERE ($1 = '' OR day = $1::date) AND ($2 = '' OR status = $2)
+              ORDER BY day DESC, kind LIMIT $3`, f.Day, f.Status, f.Limit)
+}
+
+func (r *PostgresRepository) Save(ctx context.Context, e *Export) error {
+	err := r.db.QueryRowContext(ctx, `UPDATE `+r.table+` SET status = $3, records = $4, attempts = $5,
+                  last_error = $6, next_attempt_at = $7, exported_at = $8, updated_at = now()
+              WHERE kind = $1 AND day = $2::date RETURNING updated_at`,
+		e.Kind, e.Day, e.Status, e.Records, e.Attempts, e.LastError, e.NextAttemptAt, e.ExportedAt).Scan(&e.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *PostgresRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Export, error) {
+	return r.query(ctx, `UPDATE `+r.table+` SET next_attempt_at = $2
+              WHERE (kind, day) IN (
+                  SELECT kind, day FROM `+r.table+`
+                  WHERE status IN ('pending', 'failed') AND (next_attempt_at IS NULL OR next_attempt_at <= $1)
+                  ORDER BY day, kind LIMIT $3
+                  FOR UPDATE SKIP LOCKED)
+              RETURNING `+columns,
+		now, now.Add(lease), limit)
+}
+
+// MemoryRepository keeps the exports in process memory
+type MemoryRepository struct {
+	mu      sync.Mutex
+	exports []*Export
+	clock   clock.Clock
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{clock: clock.System}
+}
+
+func (r *MemoryRepository) find(kind, day string) *Export {
+	for _, e := range r.exports {
+		if e.Kind == kind && e.Day == day {
+			return e
+		}
+	}
+	return nil
+}
+
+// snapshot copies e so callers can't race with later attempts
+func snapshot(e *Export) Export {
+	c := *e
+	if e.NextAttemptAt != nil {
+		next := *e.NextAttemptAt
+		c.NextAttemptAt = &next
+	}
+	if e.ExportedAt != nil {
+		exported := *e.ExportedAt
+		c.ExportedAt = &exported
+	}
+	return c
+}
+
+func (r *MemoryRepository) Ensure(ctx context.Context, kind, day string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.find(kind, day) == nil {
+		now := r.clock.Now()
+		r.exports = append(r.exports, &Export{Kind: kind, Day: day, Status: Pending, CreatedAt: now, UpdatedAt: now})
+	}
+	return nil
+}
+
+func (r *MemoryRepository) Get(ctx context.Context, kind, day string) (*Export, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := r.find(kind, day)
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	c := snapshot(e)
+	return &c, nil
+}
+
+func (r *MemoryRepository) List(ctx context.Context, f Filter) ([]Export, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var exports []Export
+	for _, e := range r.exports {
+		if (f.Day == "" || e.Day == f.Day) && (f.Status == "" || e.Status == f.Status) {
+			exports = append(exports, snapshot(e))
+		}
+	}
+	slices.SortFunc(exports, func(a, b Export) int {
+		if c := strings.Compare(b.Day, a.Day); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Kind, b.Kind)
+	})
+	return exports[:min(len(exports), f.Limit)], nil
+}
+
+func (r *MemoryRepository) Save(ctx context.Context, e *Export) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := r.find(e.Kind, e.Day)
+	if stored == nil {
+		return ErrNotFound
+	}
+	e.UpdatedAt = r.clock.Now()
+	*stored = snapshot(e)
+	return nil
+}
+
+func (r *MemoryRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Export, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []Export
+	for _, e := range r.exports {
+		if len(due) == limit {
+			break
+		}
+		if (e.Status != Pending && e.Status != Failed) || (e.NextAttemptAt != nil && e.NextAttemptAt.After(now)) {
+			continue
+		}
+		next := now.Add(lease)
+		e.NextAttemptAt = &next
+		due = append(due, snapshot(e))
+	}
+	return due, nil
+}
+
+// Exporter exports its sources' records every day once Delay has passed
+// since midnight, giving late completions and confirmations time to land
+type Exporter struct {
+	repo    Repository
+	adapter Adapter
+	sources []*Source
+	events  *events.Emitter
+	clock   clock.Clock
+
+	// Attempts is how many times an export is tried before it is
+	// dead-lettered; retries wait Backoff, doubling up to MaxBackoff
+	Attempts            int
+	Backoff, MaxBackoff time.Duration
+	Delay               time.Duration
+}
+
+// New exports sources through adapter; it fails on a mapping that doesn't
+// parse
+func New(repo Repository, adapter Adapter, emitter *events.Emitter, sources ...Source) (*Exporter, error) {
+	e := &Exporter{
+		repo:       repo,
+		adapter:    adapter,
+		events:     emitter,
+		clock:      clock.System,
+		Attempts:   8,
+		Backoff:    time.Minute,
+		MaxBackoff: time.Hour,
+		Delay:      time.Hour,
+	}
+	for _, s := range sources {
+		if err := s.compile(); err != nil {
+			return nil, err
+		}
+		e.sources = append(e.sources, &s)
+	}
+	return e, nil
+}
+
+// FromEnv is New with the adapter ERP_ADAPTER names, nil when it is unset:
+//
+//   - rest posts each batch as JSON to ERP_URL, with ERP_TOKEN as a bearer
+//     token if set
+//   - file writes each batch as <kind>-<day>.csv to ERP_DROP_DIR, e.g. the
+//     inbox of an SFTP server the ERP collects from
+//
+// ERP_MAPPING is a JSON file of mappings by kind replacing the sources'
+// own, ERP_ATTEMPTS the attempts before an export is dead-lettered and
+// ERP_EXPORT_DELAY how long after midnight (UTC) a day is exported.
+func FromEnv(repo Repository, emitter *events.Emitter, sources ...Source) (*Exporter, error) {
+	var adapter Adapter
+	switch kind := os.Getenv("ERP_ADAPTER"); kind {
+	case "":
+		return nil, nil
+	case "rest":
+		u := os.Getenv("ERP_URL")
+		if u == "" {
+			return nil, errors.New("ERP_ADAPTER=rest needs ERP_URL")
+		}
+		adapter = NewRESTAdapter(u, os.Getenv("ERP_TOKEN"))
+	case "file":
+		dir := os.Getenv("ERP_DROP_DIR")
+		if dir == "" {
+			return nil, errors.New("ERP_ADAPTER=file needs ERP_DROP_DIR")
+		}
+		adapter = NewFileAdapter(dir)
+	default:
+		return nil, fmt.Errorf("invalid ERP_ADAPTER %q", kind)
+	}
+
+	if path := os.Getenv("ERP_MAPPING"); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ERP_MAPPING: %w", err)
+		}
+		var mappings map[string][]Field
+		if err := json.Unmarshal(raw, &mappings); err != nil {
+			return nil, fmt.Errorf("ERP_MAPPING: %w", err)
+		}
+		for i, s := range sources {
+			if m, ok := mappings[s.Kind]; ok {
+				sources[i].Mapping = m
+			}
+		}
+	}
+
+	e, err := New(repo, adapter, emitter, sources...)
+	if err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("ERP_ATTEMPTS"); v != "" {
+		if e.Attempts, err = strconv.Atoi(v); err != nil || e.Attempts < 1 {
+			return nil, fmt.Errorf("invalid ERP_ATTEMPTS %q", v)
+		}
+	}
+	if v := os.Getenv("ERP_EXPORT_DELAY"); v != "" {
+		if e.Delay, err = time.ParseDuration(v); err != nil || e.Delay < 0 || e.Delay >= 24*time.Hour {
+			return nil, fmt.Errorf("invalid ERP_EXPORT_DELAY %q", v)
+		}
+	}
+	return e, nil
+}
+
+func (e *Exporter) source(kind string) *Source {
+	for _, s := range e.sources {
+		if s.Kind == kind {
+			return s
+		}
+	}
+	return nil
+}
+
+// backoff is the wait before the retry that follows attempt n
+func (e *Exporter) backoff(n int) time.Duration {
+	d := e.Backoff
+	for i := 1; i < n && d < e.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, e.MaxBackoff)
+}
+
+// exportable reports whether day is over and Delay has passed since
+func (e *Exporter) exportable(day time.Time) bool {
+	return !e.clock.Now().Before(day.AddDate(0, 0, 1).Add(e.Delay))
+}
+
+// attempt exports x once and records the outcome. It returns the export
+// error, or an error recording it. A retry from the API exports x whatever
+// its state and only a failed one is scheduled for another try.
+func (e *Exporter) attempt(ctx context.Context, x *Export, retry bool) error {
+	s := e.source(x.Kind)
+	if s == nil {
+		return fmt.Errorf("no source of %s", x.Kind)
+	}
+	day, err := time.Parse(time.DateOnly, x.Day)
+	if err != nil {
+		return err
+	}
+
+	records, err := s.Records(ctx, day, day.AddDate(0, 0, 1))
+	var batch *Batch
+	if err == nil {
+		batch, err = s.render(x, records)
+	}
+	if err == nil {
+		err = e.adapter.Push(ctx, batch)
+	}
+
+	x.Attempts++
+	x.LastError = ""
+	x.NextAttemptAt = nil
+	previous := x.Status
+	switch {
+	case err == nil:
+		now := e.clock.Now()
+		x.Status, x.Records, x.ExportedAt = Exported, len(records), &now
+	case retry && previous != Failed && previous != Pending:
+		// A failed retry leaves an exported or dead-lettered export as it was
+	case isPermanent(err) || x.Attempts >= e.Attempts:
+		x.Status = DeadLettered
+	default:
+		x.Status = Failed
+		next := e.clock.Now().Add(e.backoff(x.Attempts))
+		x.NextAttemptAt = &next
+	}
+	if err != nil {
+		x.LastError = err.Error()
+	}
+
+	// Record even if the request that triggered the attempt has gone away
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if rerr := e.repo.Save(recordCtx, x); rerr != nil {
+		return fmt.Errorf("%w: %w", errRecord, rerr)
+	}
+	subject := "erp_export/" + x.BatchID()
+	switch {
+	case x.Status == Exported:
+		e.events.Emit(ctx, "erp.exported", subject, x)
+	case x.Status == DeadLettered && previous != DeadLettered:
+		log.Printf("erp export %s dead-lettered after %d attempts: %s", x.BatchID(), x.Attempts, x.LastError)
+		e.events.Emit(ctx, "erp.export_dead_lettered", subject, x)
+	}
+	return err
+}
+
+// Run schedules each finished day's exports and attempts the due ones
+// every interval until ctx is done
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			yesterday := e.clock.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+			if e.exportable(yesterday) {
+				for _, s := range e.sources {
+					if err := e.repo.Ensure(ctx, s.Kind, yesterday.Format(time.DateOnly)); err != nil {
+						log.Printf("erp export %s: %v", s.Kind, err)
+					}
+				}
+			}
+			due, err := e.repo.ClaimDue(ctx, e.clock.Now(), 10*time.Minute, 10)
+			if err != nil {
+				log.Printf("claim due erp exports: %v", err)
+				continue
+			}
+			for _, x := range due {
+				if err := e.attempt(ctx, &x, false); err != nil {
+					log.Printf("erp export %s: %v", x.BatchID(), err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package erp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"platform/dbretry"
+	"platform/router"
+)
+
+const (
+	defaultListed = 30
+	maxListed     = 500
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// List serves GET /admin/erp/exports, newest day first. Query: status
+// and limit.
+func (e *Exporter) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := Filter{Status: q.Get("status"), Limit: defaultListed}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(limit, maxListed)
+	}
+	exports, err := e.repo.List(r.Context(), f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if exports == nil {
+		exports = []Export{}
+	}
+	writeJSON(w, http.StatusOK, exports)
+}
+
+// DayStatus is how a day's exports went: exported once every kind is,
+// otherwise the worst of its exports' states
+type DayStatus struct {
+	Day     string   `json:"day"`
+	Status  string   `json:"status"`
+	Exports []Export `json:"exports"`
+}
+
+// rank orders the states from best to worst
+var rank = map[string]int{Exported: 0, Pending: 1, Failed: 2, DeadLettered: 3}
+
+func day(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	d, err := time.Parse(time.DateOnly, router.Param(r, "day"))
+	if err != nil {
+		http.Error(w, "day must be YYYY-MM-DD", http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	return d, true
+}
+
+// Day serves GET /admin/erp/exports/{day}. A kind the worker hasn't got
+// to yet shows as pending.
+func (e *Exporter) Day(w http.ResponseWriter, r *http.Request) {
+	d, ok := day(w, r)
+	if !ok {
+		return
+	}
+	status := DayStatus{Day: d.Format(time.DateOnly), Status: Exported, Exports: []Export{}}
+	exports, err := e.repo.List(r.Context(), Filter{Day: status.Day, Limit: len(e.sources)})
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	for _, s := range e.sources {
+		x := Export{Kind: s.Kind, Day: status.Day, Status: Pending}
+		for _, found := range exports {
+			if found.Kind == s.Kind {
+				x = found
+			}
+		}
+		if rank[x.Status] > rank[status.Status] {
+			status.Status = x.Status
+		}
+		status.Exports = append(status.Exports, x)
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Retry serves POST /admin/erp/exports/{day}/{kind}/retry: it exports the
+// day's records of kind now, whatever became of earlier attempts, e.g.
+// after a dead-lettered export's cause was fixed or to send a day again
+// under a new mapping. The answer is the export as it now stands.
+func (e *Exporter) Retry(w http.ResponseWriter, r *http.Request) {
+	d, ok := day(w, r)
+	if !ok {
+		return
+	}
+	kind := router.Param(r, "kind")
+	if e.source(kind) == nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if !e.exportable(d) {
+		http.Error(w, "the day isn't over yet", http.StatusConflict)
+		return
+	}
+
+	ctx := r.Context()
+	dayString := d.Format(time.DateOnly)
+	if err := e.repo.Ensure(ctx, kind, dayString); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	x, err := e.repo.Get(ctx, kind, dayString)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	// The outcome is in the export; only failing to record it is an error
+	if err := e.attempt(ctx, x, true); err != nil && errors.Is(err, errRecord) {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, x)
+}
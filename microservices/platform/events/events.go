@@ -0,0 +1,221 @@
+// Package events publishes domain events from services to the event
+// collector at EVENTS_URL, so other services can react without being
+// called directly.
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/codec"
+	"platform/middleware"
+)
+
+// Event is the envelope every service publishes
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Source     string    `json:"source"`
+	Subject    string    `json:"subject,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Data       any       `json:"data,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// HTTPPublisher posts each event to a collector endpoint, as JSON unless
+// given another codec
+type HTTPPublisher struct {
+	url    string
+	client *http.Client
+	codec  codec.Codec
+}
+
+func NewHTTPPublisher(url string) *HTTPPublisher {
+	return &HTTPPublisher{url: url, client: &http.Client{Timeout: 5 * time.Second}, codec: codec.JSON}
+}
+
+// WithCodec encodes events with c; receivers decode whatever their
+// Content-Type names
+func (p *HTTPPublisher) WithCodec(c codec.Codec) *HTTPPublisher {
+	p.codec = c
+	return p
+}
+
+func (p *HTTPPublisher) Publish(ctx context.Context, event Event) error {
+	var body bytes.Buffer
+	if err := p.codec.Encode(&body, event); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", p.codec.ContentType())
+	middleware.Propagate(ctx, req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("event collector unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// LogPublisher writes events to stdout, useful when no collector is configured
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(ctx context.Context, event Event) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("event: %s", eventJSON)
+	return nil
+}
+
+// FromEnv publishes to EVENTS_URL in the INTERNAL_CODEC format, or logs
+// events when it is unset
+func FromEnv() Publisher {
+	if url := os.Getenv("EVENTS_URL"); url != "" {
+		c, err := codec.FromEnv()
+		if err != nil {
+			log.Printf("events: %v, publishing JSON", err)
+		}
+		return NewHTTPPublisher(url).WithCodec(c)
+	}
+	return LogPublisher{}
+}
+
+// Emitter stamps events with their source and request, and publishes them
+// on a best-effort basis: a failed publish is logged, never returned to the
+// client whose request already succeeded
+type Emitter struct {
+	source    string
+	publisher Publisher
+	clock     clock.Clock
+	// echo has self-tests wait for their ping to come back
+	echo bool
+
+	mu sync.Mutex
+	// pings are the self-test pings waiting to come back, by event ID
+	pings map[string]chan struct{}
+}
+
+// NewEmitter publishes source's events; SELFTEST_ECHO=true makes its
+// SelfTest wait for the broker to deliver the ping back
+func NewEmitter(source string, publisher Publisher) *Emitter {
+	return &Emitter{
+		source:    source,
+		publisher: publisher,
+		clock:     clock.System,
+		echo:      os.Getenv("SELFTEST_ECHO") == "true",
+		pings:     make(map[string]chan struct{}),
+	}
+}
+
+func (e *Emitter) Emit(ctx context.Context, eventType, subject string, data any) {
+	event := Event{
+		ID:         rand.Text(),
+		Type:       eventType,
+		Source:     e.source,
+		Subject:    subject,
+		RequestID:  middleware.RequestID(ctx),
+		Data:       data,
+		OccurredAt: e.clock.Now(),
+	}
+	// The request may be cancelled once the response is written
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := e.publisher.Publish(ctx, event); err != nil {
+		log.Printf("publish %s event %s: %v", event.Type, event.ID, err)
+	}
+}
+
+// PingType is the event self-tests publish to see the broker deliver
+const PingType = "selftest.ping"
+
+func (e *Emitter) ping(ctx context.Context) Event {
+	return Event{
+		ID:         rand.Text(),
+		Type:       PingType,
+		Source:     e.source,
+		RequestID:  middleware.RequestID(ctx),
+		OccurredAt: e.clock.Now(),
+	}
+}
+
+// Ping publishes a ping, returning what became of it rather than logging
+// it, for services that publish events but receive none
+func (e *Emitter) Ping(ctx context.Context) error {
+	return e.publisher.Publish(ctx, e.ping(ctx))
+}
+
+// SelfTest is Echo when SELFTEST_ECHO is on and Ping otherwise. Echo only
+// suits brokers that deliver each event to every replica, or services
+// running one: behind a load balancer the ping may reach another replica
+// than the one waiting for it.
+func (e *Emitter) SelfTest(ctx context.Context) error {
+	if e.echo {
+		return e.Echo(ctx)
+	}
+	return e.Ping(ctx)
+}
+
+// Echo publishes a ping and waits until the broker has delivered it back
+// to this service, which must pass the events it receives to Received
+func (e *Emitter) Echo(ctx context.Context) error {
+	event := e.ping(ctx)
+	back := make(chan struct{})
+	e.mu.Lock()
+	e.pings[event.ID] = back
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.pings, event.ID)
+		e.mu.Unlock()
+	}()
+
+	if err := e.publisher.Publish(ctx, event); err != nil {
+		return err
+	}
+	select {
+	case <-back:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("ping %s published but not delivered back: %w", event.ID, ctx.Err())
+	}
+}
+
+// Received reports whether event is a self-test ping, for the handler to
+// acknowledge and otherwise ignore, noting the arrival of this service's own
+func (e *Emitter) Received(event Event) bool {
+	if event.Type != PingType {
+		return false
+	}
+	if event.Source == e.source {
+		e.mu.Lock()
+		if back, ok := e.pings[event.ID]; ok {
+			close(back)
+			delete(e.pings, event.ID)
+		}
+		e.mu.Unlock()
+	}
+	return true
+}
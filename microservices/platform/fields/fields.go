@@ -0,0 +1,143 @@
+// Package fields trims responses to the fields a client asks for, with
+// ?fields=id,status,amount or an X-Fields header, so clients listing many
+// resources don't download what they won't show. Fields are top-level JSON
+// names; unknown ones are ignored.
+package fields
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Header carries the field list for clients that can't change the query
+const Header = "X-Fields"
+
+// Requested returns the fields r asks for, the query taking precedence over
+// the header, or nil for all of them
+func Requested(r *http.Request) []string {
+	list := r.URL.Query().Get("fields")
+	if list == "" {
+		list = r.Header.Get(Header)
+	}
+	var names []string
+	for name := range strings.SplitSeq(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Select projects v onto the fields r asks for, ready to be encoded. The
+// answer then depends on the header, which w is told for caches.
+func Select(w http.ResponseWriter, r *http.Request, v any) any {
+	w.Header().Add("Vary", Header)
+	return Project(v, Requested(r))
+}
+
+// Project keeps only the named fields of v: a struct (by its JSON names,
+// including those of embedded structs), a map with string keys, or a slice
+// of either. Anything else, or no names, is returned as is.
+func Project(v any, names []string) any {
+	if len(names) == 0 {
+		return v
+	}
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+	}
+	return project(reflect.ValueOf(v), want)
+}
+
+func project(v reflect.Value, want map[string]bool) any {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = project(v.Index(i), want)
+		}
+		return out
+	case reflect.Struct:
+		out := make(map[string]any)
+		collect(v, want, out)
+		return out
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		out := make(map[string]any)
+		for name := range want {
+			if value := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key())); value.IsValid() {
+				out[name] = value.Interface()
+			}
+		}
+		return out
+	}
+	return v.Interface()
+}
+
+// collect copies v's wanted fields into out the way encoding/json names
+// them. A struct's own fields shadow those of structs it embeds.
+func collect(v reflect.Value, want map[string]bool, out map[string]any) {
+	t := v.Type()
+	var embedded []reflect.Value
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+		if sf.Anonymous && name == "" {
+			for fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					break
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				embedded = append(embedded, fv)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if !want[name] || (strings.Contains(opts, "omitempty") && empty(fv)) {
+			continue
+		}
+		out[name] = fv.Interface()
+	}
+	for _, fv := range embedded {
+		inner := make(map[string]any)
+		collect(fv, want, inner)
+		for name, value := range inner {
+			if _, ok := out[name]; !ok {
+				out[name] = value
+			}
+		}
+	}
+}
+
+// empty is encoding/json's test for omitempty
+func empty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
@@ -0,0 +1,530 @@
+// Package files keeps documents such as invoices and dispute evidence in
+// S3-compatible object storage. Files never pass through the services:
+// clients are handed a presigned URL to upload straight to the bucket,
+// and another to download from it. The service keeps a row per file
+// saying who owns it, what it is attached to, until when it is kept and
+// what the virus scanner made of it, and hands out no download URL until
+// the scanner has passed the file, when there is a scanner.
+//
+// The service's schema needs the table the Postgres repository uses:
+//
+//	CREATE TABLE files (
+//	    id TEXT PRIMARY KEY,
+//	    kind TEXT NOT NULL,
+//	    owner TEXT NOT NULL,
+//	    subject TEXT NOT NULL DEFAULT '',
+//	    name TEXT NOT NULL,
+//	    content_type TEXT NOT NULL,
+//	    size BIGINT NOT NULL DEFAULT 0,
+//	    status TEXT NOT NULL,
+//	    scan_detail TEXT NOT NULL DEFAULT '',
+//	    retain_until TIMESTAMPTZ NOT NULL,
+//	    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//	    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+//	);
+package files
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/middleware"
+)
+
+// File states. A file is pending until its upload is confirmed, then
+// uploaded until scanned, and then available or quarantined. Without a
+// scanner uploads are available at once.
+const (
+	Pending     = "pending"
+	Uploaded    = "uploaded"
+	Available   = "available"
+	Quarantined = "quarantined"
+)
+
+// URLTTL is how long presigned URLs stay valid
+const URLTTL = 15 * time.Minute
+
+var ErrNotFound = errors.New("file not found")
+
+// Kind is one kind of file a service keeps
+type Kind struct {
+	Name string
+	// Retention is how long files are kept after they are created
+	Retention time.Duration
+	// MaxSize is in bytes
+	MaxSize      int64
+	ContentTypes []string
+	// Roles may upload files of the kind, for others to own; anyone may
+	// upload their own when it is empty
+	Roles []string
+}
+
+// File is the metadata of one stored file
+type File struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Owner is the user it belongs to, who may download and delete it
+	Owner string `json:"owner"`
+	// Subject is what it is attached to, e.g. payment/42
+	Subject     string    `json:"subject,omitempty"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Status      string    `json:"status"`
+	ScanDetail  string    `json:"scan_detail,omitempty"`
+	RetainUntil time.Time `json:"retain_until"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// key is where the object is stored
+func (f *File) key() string {
+	return f.Kind + "/" + f.ID
+}
+
+// Filter selects files, newest first; empty fields match any
+type Filter struct {
+	Owner   string
+	Subject string
+	Kind    string
+	Limit   int
+}
+
+// Repository stores the files' metadata
+type Repository interface {
+	Create(ctx context.Context, f *File) error
+	Get(ctx context.Context, id string) (*File, error)
+	List(ctx context.Context, f Filter) ([]File, error)
+	// SetStatus records f's Status, Size and ScanDetail
+	SetStatus(ctx context.Context, f *File) error
+	// InStatus returns files in status last updated before before
+	InStatus(ctx context.Context, status string, before time.Time, limit int) ([]File, error)
+	// Expired returns files retained until before now
+	Expired(ctx context.Context, now time.Time, limit int) ([]File, error)
+	Delete(ctx context.Context, id string) error
+}
+
+type PostgresRepository struct {
+	db *dbretry.DB
+}
+
+func NewPostgresRepository(db *dbretry.DB) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+const columns = `id, kind, owner, subject, name, content_type, size, status, scan_detail, retain_until, created_at, updated_at`
+
+func scanFile(scan func(...any) error, f *File) error {
+	return scan(&f.ID, &f.Kind, &f.Owner, &f.Subject, &f.Name, &f.ContentType, &f.Size,
+		&f.Status, &f.ScanDetail, &f.RetainUntil, &f.CreatedAt, &f.UpdatedAt)
+}
+
+func (r *PostgresRepository) Create(ctx context.Context, f *File) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO files (id, kind, owner, subject, name, content_type, size, status, retain_until)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING created_at, updated_at`,
+		f.ID, f.Kind, f.Owner, f.Subject, f.Name, f.ContentType, f.Size, f.Status, f.RetainUntil).Scan(&f.CreatedAt, &f.UpdatedAt)
+}
+
+func (r *PostgresRepository) Get(ctx context.Context, id string) (*File, error) {
+	var f File
+	err := scanFile(r.db.QueryRowContext(ctx, `SELECT `+columns+` FROM files WHERE id = $1`, id).Scan, &f)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (r *PostgresRepository) query(ctx context.Context, query string, args ...any) ([]File, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		var f File
+		if err := scanFile(rows.Scan, &f); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func (r *PostgresRepository) List(ctx context.Context, f Filter) ([]File, error) {
+	return r.query(ctx, `SELECT `+columns+` FROM files
+              WHERE ($1 = '' OR owner = $1) AND ($2 = '' OR subject = $2) AND ($3 = '' OR kind = $3)
+              ORDER BY created_at DESC, id LIMIT $4`,
+		f.Owner, f.Subject, f.Kind, f.Limit)
+}
+
+func (r *PostgresRepository) SetStatus(ctx context.Context, f *File) error {
+	err := r.db.QueryRowContext(ctx, `UPDATE files SET status = $2, size = $3, scan_detail = $4, updated_at = now()
+              WHERE id = $1 RETURNING updated_at`,
+		f.ID, f.Status, f.Size, f.ScanDetail).Scan(&f.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *PostgresRepository) InStatus(ctx context.Context, status string, before time.Time, limit int) ([]File, error) {
+	return r.query(ctx, `SELECT `+columns+` FROM files WHERE status = $1 AND updated_at < $2
+              ORDER BY updated_at LIMIT $3`, status, before, limit)
+}
+
+func (r *PostgresRepository) Expired(ctx context.Context, now time.Time, limit int) ([]File, error) {
+	return r.query(ctx, `SELECT `+columns+` FROM files WHERE retain_until < $1
+              ORDER BY retain_until LIMIT $2`, now, limit)
+}
+
+func (r *PostgresRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM files WHERE id = $1`, id)
+	return err
+}
+
+// MemoryRepository keeps the metadata in process memory
+type MemoryRepository struct {
+	mu    sync.Mutex
+	files []File
+	clock clock.Clock
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{clock: clock.System}
+}
+
+func (r *MemoryRepository) Create(ctx context.Context, f *File) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f.CreatedAt = r.clock.Now()
+	f.UpdatedAt = f.CreatedAt
+	r.files = append(r.files, *f)
+	return nil
+}
+
+func (r *MemoryRepository) Get(ctx context.Context, id string) (*File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.files {
+		if f.ID == id {
+			return &f, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryRepository) List(ctx context.Context, filter Filter) ([]File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var files []File
+	for i := len(r.files) - 1; i >= 0 && len(files) < filter.Limit; i-- {
+		f := r.files[i]
+		if (filter.Owner == "" || f.Owner == filter.Owner) && (filter.Subject == "" || f.Subject == filter.Subject) &&
+			(filter.Kind == "" || f.Kind == filter.Kind) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (r *MemoryRepository) SetStatus(ctx context.Context, f *File) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.files {
+		if r.files[i].ID == f.ID {
+			f.UpdatedAt = r.clock.Now()
+			r.files[i].Status, r.files[i].Size, r.files[i].ScanDetail, r.files[i].UpdatedAt = f.Status, f.Size, f.ScanDetail, f.UpdatedAt
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *MemoryRepository) InStatus(ctx context.Context, status string, before time.Time, limit int) ([]File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var files []File
+	for _, f := range r.files {
+		if len(files) < limit && f.Status == status && f.UpdatedAt.Before(before) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (r *MemoryRepository) Expired(ctx context.Context, now time.Time, limit int) ([]File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var files []File
+	for _, f := range r.files {
+		if len(files) < limit && f.RetainUntil.Before(now) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (r *MemoryRepository) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.files = slices.DeleteFunc(r.files, func(f File) bool { return f.ID == id })
+	return nil
+}
+
+// Verdict is what a scanner made of a file
+type Verdict struct {
+	Clean  bool   `json:"clean"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Scanner checks uploaded files for malware. It is given a download URL
+// rather than the file, so it fetches what it scans itself.
+type Scanner interface {
+	Scan(ctx context.Context, f *File, downloadURL string) (Verdict, error)
+}
+
+// HTTPScanner posts {"id", "kind", "content_type", "size", "url"} to a
+// scanning service, which answers with a Verdict
+type HTTPScanner struct {
+	url    string
+	client *http.Client
+}
+
+// ScannerFromEnv reads FILES_SCAN_URL; nil without one
+func ScannerFromEnv() Scanner {
+	u := os.Getenv("FILES_SCAN_URL")
+	if u == "" {
+		return nil
+	}
+	return &HTTPScanner{url: u, client: &http.Client{Timeout: time.Minute}}
+}
+
+func (s *HTTPScanner) Scan(ctx context.Context, f *File, downloadURL string) (Verdict, error) {
+	body, _ := json.Marshal(map[string]any{
+		"id": f.ID, "kind": f.Kind, "content_type": f.ContentType, "size": f.Size, "url": downloadURL,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	middleware.Propagate(ctx, req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Verdict{}, fmt.Errorf("scanner answered %s", resp.Status)
+	}
+	var v Verdict
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&v)
+	return v, err
+}
+
+// Service is a service's files: their metadata, objects and scanning
+type Service struct {
+	bucket  *Bucket
+	repo    Repository
+	scanner Scanner
+	kinds   map[string]Kind
+	events  *events.Emitter
+	clock   clock.Clock
+
+	mu      sync.Mutex
+	uploads map[string]int64
+	scans   map[string]int64
+	pruned  int64
+}
+
+// New keeps kinds of files in bucket; scanner may be nil
+func New(bucket *Bucket, repo Repository, scanner Scanner, emitter *events.Emitter, kinds ...Kind) *Service {
+	s := &Service{
+		bucket:  bucket,
+		repo:    repo,
+		scanner: scanner,
+		kinds:   make(map[string]Kind),
+		events:  emitter,
+		clock:   clock.System,
+		uploads: make(map[string]int64),
+		scans:   make(map[string]int64),
+	}
+	for _, k := range kinds {
+		s.kinds[k.Name] = k
+	}
+	return s
+}
+
+// downloadURL presigns a download that saves the file under its name
+func (s *Service) downloadURL(f *File) string {
+	return s.bucket.Presign(http.MethodGet, f.key(), URLTTL, url.Values{
+		"response-content-disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": f.Name})},
+		"response-content-type":        {f.ContentType},
+	})
+}
+
+// complete confirms f was uploaded as announced and scans it. An upload
+// that breaks its kind's limits is deleted.
+func (s *Service) complete(ctx context.Context, f *File) error {
+	obj, err := s.bucket.Head(ctx, f.key())
+	if err != nil {
+		return err
+	}
+	kind := s.kinds[f.Kind]
+	if obj.Size > kind.MaxSize || (obj.ContentType != "" && !slices.Contains(kind.ContentTypes, obj.ContentType)) {
+		if err := s.bucket.Delete(ctx, f.key()); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: upload of %d bytes of %s breaks the limits of %s files",
+			errRejected, obj.Size, obj.ContentType, f.Kind)
+	}
+	f.Size = obj.Size
+	f.Status = Uploaded
+	if s.scanner == nil {
+		f.Status = Available
+	}
+	if err := s.repo.SetStatus(ctx, f); err != nil {
+		return err
+	}
+	s.count(s.uploads, f.Kind)
+	if s.scanner != nil {
+		// A scanner that is down leaves the file to Run
+		if err := s.scan(ctx, f); err != nil {
+			log.Printf("scan file %s: %v", f.ID, err)
+		}
+	}
+	return nil
+}
+
+var errRejected = errors.New("upload rejected")
+
+func (s *Service) scan(ctx context.Context, f *File) error {
+	v, err := s.scanner.Scan(ctx, f, s.downloadURL(f))
+	if err != nil {
+		s.count(s.scans, "error")
+		return err
+	}
+	f.ScanDetail = v.Detail
+	f.Status = Available
+	if !v.Clean {
+		f.Status = Quarantined
+	}
+	if err := s.repo.SetStatus(ctx, f); err != nil {
+		return err
+	}
+	s.count(s.scans, f.Status)
+	if f.Status == Quarantined {
+		log.Printf("file %s (%s) quarantined: %s", f.ID, f.Kind, f.ScanDetail)
+		s.events.Emit(ctx, "file.quarantined", "file/"+f.ID, map[string]any{
+			"id": f.ID, "kind": f.Kind, "owner": f.Owner, "subject": f.Subject, "detail": f.ScanDetail,
+		})
+	}
+	return nil
+}
+
+func (s *Service) count(m map[string]int64, key string) {
+	s.mu.Lock()
+	m[key]++
+	s.mu.Unlock()
+}
+
+// remove deletes the object, then the row, so nothing is left unaccounted
+// for if the first fails
+func (s *Service) remove(ctx context.Context, f *File) error {
+	if err := s.bucket.Delete(ctx, f.key()); err != nil {
+		return err
+	}
+	return s.repo.Delete(ctx, f.ID)
+}
+
+// Run scans files the scanner missed and deletes expired files and
+// abandoned uploads every interval until ctx is done
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Service) sweep(ctx context.Context) {
+	now := s.clock.Now()
+	if s.scanner != nil {
+		uploaded, err := s.repo.InStatus(ctx, Uploaded, now.Add(-time.Minute), 50)
+		if err != nil {
+			log.Printf("files to scan: %v", err)
+		}
+		for i := range uploaded {
+			if err := s.scan(ctx, &uploaded[i]); err != nil {
+				log.Printf("scan file %s: %v", uploaded[i].ID, err)
+			}
+		}
+	}
+	expired, err := s.repo.Expired(ctx, now, 100)
+	if err != nil {
+		log.Printf("expired files: %v", err)
+	}
+	// Upload URLs are long dead by then
+	abandoned, err := s.repo.InStatus(ctx, Pending, now.Add(-24*time.Hour), 100)
+	if err != nil {
+		log.Printf("abandoned uploads: %v", err)
+	}
+	for _, f := range append(expired, abandoned...) {
+		if err := s.remove(ctx, &f); err != nil {
+			log.Printf("delete file %s: %v", f.ID, err)
+			continue
+		}
+		s.mu.Lock()
+		s.pruned++
+		s.mu.Unlock()
+	}
+}
+
+func (s *Service) WriteMetrics(out io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(out, "# TYPE files_uploads_total counter")
+	for name := range s.kinds {
+		fmt.Fprintf(out, "files_uploads_total{kind=%q} %d\n", name, s.uploads[name])
+	}
+	fmt.Fprintln(out, "# TYPE files_scans_total counter")
+	for _, outcome := range []string{Available, Quarantined, "error"} {
+		fmt.Fprintf(out, "files_scans_total{outcome=%q} %d\n", outcome, s.scans[outcome])
+	}
+	fmt.Fprintln(out, "# TYPE files_pruned_total counter")
+	fmt.Fprintf(out, "files_pruned_total %d\n", s.pruned)
+}
@@ -0,0 +1,243 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/auth"
+	"platform/dbretry"
+	"platform/middleware"
+	"platform/publicid"
+)
+
+const maxListed = 100
+
+// caller is the request's principal; nil only when auth is off, and then
+// everyone may do anything
+func caller(r *http.Request) *auth.Claims {
+	p, _ := middleware.PrincipalFromContext(r.Context())
+	return p
+}
+
+// manages says whether p may upload files of kind for others, and complete
+// and delete them
+func manages(p *auth.Claims, kind Kind) bool {
+	return p == nil || p.HasRole("admin") || slices.ContainsFunc(kind.Roles, p.HasRole)
+}
+
+// mayManage says whether p may complete or delete f: those who manage its
+// kind, and its owner when the kind has no roles
+func (s *Service) mayManage(p *auth.Claims, f *File) bool {
+	kind := s.kinds[f.Kind]
+	return manages(p, kind) || (len(kind.Roles) == 0 && f.Owner == p.Subject)
+}
+
+// mayRead adds the owner to those who may manage f
+func (s *Service) mayRead(p *auth.Claims, f *File) bool {
+	return s.mayManage(p, f) || f.Owner == p.Subject
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type createRequest struct {
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Subject     string `json:"subject"`
+	// Owner defaults to the caller; only those who manage the kind may
+	// upload for someone else
+	Owner string `json:"owner"`
+}
+
+// Upload is where to put a new file's content
+type Upload struct {
+	File      *File     `json:"file"`
+	URL       string    `json:"upload_url"`
+	Method    string    `json:"upload_method"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Download is a file with where to get its content
+type Download struct {
+	*File
+	URL       string     `json:"download_url,omitempty"`
+	ExpiresAt *time.Time `json:"download_expires_at,omitempty"`
+}
+
+// Create serves POST /files: it records a pending file and answers with
+// the URL to PUT its content to, then to be confirmed with Complete
+func (s *Service) Create(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind, ok := s.kinds[req.Kind]
+	if !ok {
+		http.Error(w, "unknown kind "+strconv.Quote(req.Kind), http.StatusUnprocessableEntity)
+		return
+	}
+	p := caller(r)
+	switch {
+	case p != nil && req.Owner == "":
+		req.Owner = p.Subject
+	case req.Owner == "":
+		http.Error(w, "owner is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if !manages(p, kind) && (len(kind.Roles) > 0 || req.Owner != p.Subject) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case req.Name == "" || len(req.Name) > 255 || strings.ContainsAny(req.Name, "/\\\x00\r\n"):
+		http.Error(w, "name must be a plain file name", http.StatusUnprocessableEntity)
+		return
+	case !slices.Contains(kind.ContentTypes, req.ContentType):
+		http.Error(w, kind.Name+" files must be one of "+strings.Join(kind.ContentTypes, ", "), http.StatusUnprocessableEntity)
+		return
+	case req.Size <= 0 || req.Size > kind.MaxSize:
+		http.Error(w, "size must be from 1 to "+strconv.FormatInt(kind.MaxSize, 10)+" bytes", http.StatusUnprocessableEntity)
+		return
+	}
+
+	now := s.clock.Now()
+	f := &File{
+		ID:          publicid.New(),
+		Kind:        kind.Name,
+		Owner:       req.Owner,
+		Subject:     req.Subject,
+		Name:        req.Name,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		Status:      Pending,
+		RetainUntil: now.Add(kind.Retention),
+	}
+	if err := s.repo.Create(r.Context(), f); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, Upload{
+		File:      f,
+		URL:       s.bucket.Presign(http.MethodPut, f.key(), URLTTL, nil),
+		Method:    http.MethodPut,
+		ExpiresAt: now.Add(URLTTL),
+	})
+}
+
+// file loads the path's file for p, answering 404 for files p may not
+// read so as not to reveal they exist
+func (s *Service) file(w http.ResponseWriter, r *http.Request) (*File, bool) {
+	f, err := s.repo.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && !s.mayRead(caller(r), f)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	return f, true
+}
+
+func (s *Service) download(f *File) Download {
+	d := Download{File: f}
+	if f.Status == Available {
+		expires := s.clock.Now().Add(URLTTL)
+		d.URL, d.ExpiresAt = s.downloadURL(f), &expires
+	}
+	return d
+}
+
+// Complete serves POST /files/{id}/complete, which the uploader calls once
+// the content is in place; the file is then scanned
+func (s *Service) Complete(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.file(w, r)
+	if !ok {
+		return
+	}
+	if !s.mayManage(caller(r), f) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if f.Status != Pending {
+		http.Error(w, "file is "+f.Status+" already", http.StatusConflict)
+		return
+	}
+	// The upload is checked and scanned even if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	err := s.complete(ctx, f)
+	switch {
+	case errors.Is(err, ErrNoObject):
+		http.Error(w, "nothing was uploaded yet", http.StatusConflict)
+		return
+	case errors.Is(err, errRejected):
+		if err := s.repo.Delete(ctx, f.ID); err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		dbretry.Error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.download(f))
+}
+
+// Get serves GET /files/{id}, with a download URL once it is available
+func (s *Service) Get(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.file(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.download(f))
+}
+
+// List serves GET /files, newest first, filtered by subject=, kind= and,
+// for admins, owner=; others see only their own
+func (s *Service) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := Filter{Owner: q.Get("owner"), Subject: q.Get("subject"), Kind: q.Get("kind"), Limit: maxListed}
+	p := caller(r)
+	if p != nil && !p.HasRole("admin") {
+		filter.Owner = p.Subject
+	}
+	files, err := s.repo.List(r.Context(), filter)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if files == nil {
+		files = []File{}
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// Delete serves DELETE /files/{id}, removing the content with the row
+func (s *Service) Delete(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.file(w, r)
+	if !ok {
+		return
+	}
+	if !s.mayManage(caller(r), f) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := s.remove(context.WithoutCancel(r.Context()), f); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
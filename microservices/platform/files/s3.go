@@ -0,0 +1,194 @@
+package files
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+)
+
+// ErrNoObject is a key with nothing stored under it
+var ErrNoObject = errors.New("no such object")
+
+// Bucket is one bucket of an S3-compatible store, addressed path-style
+// (endpoint/bucket/key) so MinIO and the like work as well as S3. Requests
+// are signed with AWS Signature Version 4 in the query string, which is
+// what lets a URL be handed to a client to use without the credentials.
+type Bucket struct {
+	endpoint  *url.URL
+	region    string
+	name      string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	clock     clock.Clock
+}
+
+func NewBucket(endpoint, region, name, accessKey, secretKey string) (*Bucket, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if name == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("bucket, access key and secret key are required")
+	}
+	return &Bucket{
+		endpoint:  u,
+		region:    region,
+		name:      name,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		clock:     clock.System,
+	}, nil
+}
+
+// BucketFromEnv reads FILES_S3_ENDPOINT, FILES_S3_REGION (us-east-1 by
+// default), FILES_S3_BUCKET, FILES_S3_ACCESS_KEY_ID and
+// FILES_S3_SECRET_ACCESS_KEY; nil without an endpoint
+func BucketFromEnv() (*Bucket, error) {
+	endpoint := os.Getenv("FILES_S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+	region := os.Getenv("FILES_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return NewBucket(endpoint, region, os.Getenv("FILES_S3_BUCKET"),
+		os.Getenv("FILES_S3_ACCESS_KEY_ID"), os.Getenv("FILES_S3_SECRET_ACCESS_KEY"))
+}
+
+// Presign returns a URL that lets whoever holds it make the request for
+// ttl, at most a week. query adds parameters such as
+// response-content-disposition, which are signed with the rest.
+func (b *Bucket) Presign(method, key string, ttl time.Duration, query url.Values) string {
+	now := b.clock.Now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + b.region + "/s3/aws4_request"
+
+	q := url.Values{}
+	for k, vs := range query {
+		q[k] = vs
+	}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", b.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(min(ttl, 7*24*time.Hour).Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	path := strings.TrimSuffix(b.endpoint.Path, "/") + "/" + uriEncode(b.name, true) + "/" + uriEncode(key, false)
+	canonicalQuery := canonicalQueryString(q)
+	canonical := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery,
+		"host:" + b.endpoint.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	k := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	k = hmacSHA256(k, b.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	return b.endpoint.Scheme + "://" + b.endpoint.Host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// Object is what Head learns of a stored object
+type Object struct {
+	Size        int64
+	ContentType string
+}
+
+// Head returns the object stored under key, or ErrNoObject
+func (b *Bucket) Head(ctx context.Context, key string) (*Object, error) {
+	resp, err := b.do(ctx, http.MethodHead, key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNoObject
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("head %s: %s", key, resp.Status)
+	}
+	return &Object{Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// Delete removes the object under key; deleting nothing isn't an error
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (b *Bucket) do(ctx context.Context, method, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.Presign(method, key, time.Minute, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.client.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes everything but the unreserved characters, as SigV4
+// wants; slashes stay when they separate a key's segments
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQueryString(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,146 @@
+// Package geoip resolves client addresses to where they are, from a
+// database of networks the gateway loads at GEOIP_DB. The gateway puts
+// what it finds on each request in the X-Geo-Country and X-Geo-Region
+// headers, having dropped any the client sent, and services read it back
+// with FromRequest.
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	CountryHeader = "X-Geo-Country"
+	RegionHeader  = "X-Geo-Region"
+)
+
+// Location is an ISO 3166-1 country code, e.g. US, and an ISO 3166-2
+// subdivision code, e.g. US-CA, either empty when unknown
+type Location struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+}
+
+// FromRequest is the location the gateway put on r
+func FromRequest(r *http.Request) Location {
+	return Location{
+		Country: r.Header.Get(CountryHeader),
+		Region:  r.Header.Get(RegionHeader),
+	}
+}
+
+// Set puts l on a request's headers, clearing what it doesn't know
+func (l Location) Set(h http.Header) {
+	h.Del(CountryHeader)
+	h.Del(RegionHeader)
+	if l.Country != "" {
+		h.Set(CountryHeader, l.Country)
+	}
+	if l.Region != "" {
+		h.Set(RegionHeader, l.Region)
+	}
+}
+
+// DB maps networks to locations; the most specific network holding an
+// address wins
+type DB struct {
+	// networks by prefix length, longest first
+	bits     []int
+	networks map[netip.Prefix]Location
+}
+
+// Open loads a CSV database of network,country,region lines, e.g.
+//
+//	network,country,region
+//	81.2.69.0/24,GB,GB-ENG
+//	2001:db8::/32,DE,
+//
+// A network is a CIDR or a bare address; a header line and lines starting
+// with # are skipped. Exports of the commercial databases convert to this
+// with a join on their location IDs.
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &DB{networks: make(map[netip.Prefix]Location)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || (n == 1 && strings.HasPrefix(line, "network")) {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want network,country,region", path, n)
+		}
+		prefix, err := parseNetwork(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		loc := Location{Country: strings.ToUpper(strings.TrimSpace(fields[1]))}
+		if len(fields) > 2 {
+			loc.Region = strings.ToUpper(strings.TrimSpace(fields[2]))
+		}
+		if _, ok := db.networks[prefix]; !ok && !slices.Contains(db.bits, prefix.Bits()) {
+			db.bits = append(db.bits, prefix.Bits())
+		}
+		db.networks[prefix] = loc
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(db.bits)
+	slices.Reverse(db.bits)
+	return db, nil
+}
+
+func parseNetwork(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// Len is how many networks db holds
+func (db *DB) Len() int {
+	return len(db.networks)
+}
+
+// Lookup finds where addr is
+func (db *DB) Lookup(addr netip.Addr) (Location, bool) {
+	addr = addr.Unmap()
+	for _, bits := range db.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if loc, ok := db.networks[p]; ok {
+			return loc, true
+		}
+	}
+	return Location{}, false
+}
@@ -0,0 +1,230 @@
+// Package i18n resolves user-facing text from per-service message catalogs.
+// Each service embeds a directory of <language-tag>.json files mapping
+// message keys to fmt format strings; a lookup walks a fallback chain such
+// as pt-BR -> pt -> en until some catalog has the key.
+package i18n
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bundle holds every catalog of one service
+type Bundle struct {
+	fallback string
+	catalogs map[string]map[string]string
+}
+
+// Load reads all *.json catalogs in fsys. fallback is the language used
+// when none of the client's preferences has a message, and must exist.
+func Load(fsys fs.FS, fallback string) (*Bundle, error) {
+	b := &Bundle{fallback: normalize(fallback), catalogs: make(map[string]map[string]string)}
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", name, err)
+		}
+		b.catalogs[normalize(strings.TrimSuffix(path.Base(name), ".json"))] = messages
+	}
+	if _, ok := b.catalogs[b.fallback]; !ok {
+		return nil, fmt.Errorf("no catalog for fallback language %q", fallback)
+	}
+	return b, nil
+}
+
+func normalize(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// Languages lists the catalogs in the bundle
+func (b *Bundle) Languages() []string {
+	langs := make([]string, 0, len(b.catalogs))
+	for lang := range b.catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Localizer resolves messages for one client's language preferences
+type Localizer struct {
+	bundle *Bundle
+	chain  []string
+}
+
+// Localizer builds the fallback chain for prefs, most preferred first:
+// each tag is followed by its base language, and the bundle's fallback
+// language comes last
+func (b *Bundle) Localizer(prefs ...string) *Localizer {
+	var chain []string
+	add := func(tag string) {
+		if _, ok := b.catalogs[tag]; ok && !slices.Contains(chain, tag) {
+			chain = append(chain, tag)
+		}
+	}
+	for _, p := range prefs {
+		tag := normalize(p)
+		add(tag)
+		if base, _, ok := strings.Cut(tag, "-"); ok {
+			add(base)
+		}
+	}
+	add(b.fallback)
+	return &Localizer{bundle: b, chain: chain}
+}
+
+// Language is the catalog most messages will come from
+func (l *Localizer) Language() string {
+	if l == nil || len(l.chain) == 0 {
+		return ""
+	}
+	return l.chain[0]
+}
+
+// T formats the message for key; a key missing from every catalog is
+// returned as is so the gap is visible rather than silent
+func (l *Localizer) T(key string, args ...any) string {
+	msg, lang := l.lookup(key)
+	if lang == "" || len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+func (l *Localizer) lookup(key string) (string, string) {
+	if l != nil {
+		for _, lang := range l.chain {
+			if msg, ok := l.bundle.catalogs[lang][key]; ok {
+				return msg, lang
+			}
+		}
+	}
+	return key, ""
+}
+
+// Message is an error carrying a catalog key, so code deep in a service can
+// fail with text that is localized only when it reaches the client
+type Message struct {
+	Key  string
+	Args []any
+	err  error
+}
+
+func NewError(key string, args ...any) error {
+	return &Message{Key: key, Args: args}
+}
+
+// Wrap localizes err's context while keeping it inspectable with errors.Is;
+// err is passed to the message as its last argument
+func Wrap(err error, key string, args ...any) error {
+	return &Message{Key: key, Args: append(args, err), err: err}
+}
+
+func (m *Message) Error() string {
+	if m.err != nil {
+		return m.Key + ": " + m.err.Error()
+	}
+	return m.Key
+}
+
+func (m *Message) Unwrap() error {
+	return m.err
+}
+
+// Text localizes err if it is, or wraps, a Message
+func (l *Localizer) Text(err error) string {
+	var m *Message
+	if errors.As(err, &m) {
+		if _, lang := l.lookup(m.Key); lang != "" {
+			return l.T(m.Key, m.Args...)
+		}
+	}
+	return err.Error()
+}
+
+// ParseAcceptLanguage returns the tags of an Accept-Language header ordered
+// by quality, dropping the wildcard and anything with q=0
+func ParseAcceptLanguage(header string) []string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			prefs = append(prefs, pref{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	tags := make([]string, len(prefs))
+	for i, p := range prefs {
+		tags[i] = p.tag
+	}
+	return tags
+}
+
+type localizerKey struct{}
+
+// Middleware picks a Localizer from the request's Accept-Language header
+func (b *Bundle) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := b.Localizer(ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(WithLocalizer(r.Context(), l)))
+	})
+}
+
+func WithLocalizer(ctx context.Context, l *Localizer) context.Context {
+	return context.WithValue(ctx, localizerKey{}, l)
+}
+
+// FromContext returns the request's Localizer. Without one, messages come
+// back as their keys.
+func FromContext(ctx context.Context) *Localizer {
+	l, _ := ctx.Value(localizerKey{}).(*Localizer)
+	return l
+}
+
+// Error is http.Error with a localized message
+func Error(w http.ResponseWriter, r *http.Request, code int, key string, args ...any) {
+	l := FromContext(r.Context())
+	msg, lang := l.lookup(key)
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,292 @@
+// Package jsonenc appends JSON to byte slices without reflection, for the
+// hot endpoints whose types write themselves out field by field. The output
+// matches encoding/json's byte for byte, HTML escaping included, so a type
+// can move to it without clients noticing.
+//
+// Stream sends a listing as it is read, as a JSON array or NDJSON.
+package jsonenc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxPooled keeps the odd huge response from pinning its buffer in the pool
+const maxPooled = 1 << 20
+
+var buffers = sync.Pool{New: func() any { b := make([]byte, 0, 4096); return &b }}
+
+// Write sends the JSON appendBody appends as the response, with the
+// trailing newline json.Encoder would add, from a pooled buffer
+func Write(w http.ResponseWriter, status int, appendBody func([]byte) []byte) {
+	bp := buffers.Get().(*[]byte)
+	b := append(appendBody((*bp)[:0]), '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	if cap(b) <= maxPooled {
+		*bp = b
+		buffers.Put(bp)
+	}
+}
+
+// Array appends items as a JSON array, each with appendItem, e.g. a method
+// expression such as (*Order).AppendJSON
+func Array[T any](b []byte, items []T, appendItem func(*T, []byte) []byte) []byte {
+	b = append(b, '[')
+	for i := range items {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendItem(&items[i], b)
+	}
+	return append(b, ']')
+}
+
+// Key appends "name": after a comma unless it is the object's first key,
+// i.e. b ends with {
+func Key(b []byte, name string) []byte {
+	if len(b) > 0 && b[len(b)-1] != '{' {
+		b = append(b, ',')
+	}
+	b = String(b, name)
+	return append(b, ':')
+}
+
+func Int(b []byte, n int64) []byte {
+	return strconv.AppendInt(b, n, 10)
+}
+
+func Bool(b []byte, v bool) []byte {
+	return strconv.AppendBool(b, v)
+}
+
+// Float formats f as encoding/json does: plain decimals, switching to an
+// exponent only for very small or large magnitudes. JSON has no NaN or
+// infinity, which encoding/json refuses; they are written as null.
+func Float(b []byte, f float64) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(b, "null"...)
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// e-09 to e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// Time appends t in RFC 3339 with nanoseconds, as time.Time marshals
+func Time(b []byte, t time.Time) []byte {
+	b = append(b, '"')
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// StringMap appends m as an object with its keys sorted, as encoding/json
+// orders them
+func StringMap(b []byte, m map[string]string) []byte {
+	if m == nil {
+		return append(b, "null"...)
+	}
+	var small [16]string
+	keys := small[:0]
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	b = append(b, '{')
+	for _, k := range keys {
+		b = Key(b, k)
+		b = String(b, m[k])
+	}
+	return append(b, '}')
+}
+
+const hex = "0123456789abcdef"
+
+// String appends s quoted, escaping as encoding/json does by default:
+// control characters, <, > and & (so the JSON is safe inside HTML), and
+// U+2028 and U+2029; invalid UTF-8 becomes U+FFFD.
+func String(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// NDJSON is newline-delimited JSON, one value per line
+const NDJSON = "application/x-ndjson"
+
+// streamBuffer is how much of a stream collects before it is written
+const streamBuffer = 32 << 10
+
+// Stream writes a listing item by item as the items are read, as a JSON
+// array or, for clients accepting it, NDJSON, so the listing never sits
+// whole in memory. The status and headers go out with the first item.
+type Stream struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	ctx      context.Context
+	ndjson   bool
+	interval time.Duration
+	flushed  time.Time
+	buf      []byte
+	items    int
+	started  bool
+}
+
+// NewStream streams the response to r, flushing at least every interval
+// so slow listings still trickle through proxies
+func NewStream(w http.ResponseWriter, r *http.Request, interval time.Duration) *Stream {
+	return &Stream{
+		w:        w,
+		rc:       http.NewResponseController(w),
+		ctx:      r.Context(),
+		ndjson:   strings.Contains(r.Header.Get("Accept"), NDJSON),
+		interval: interval,
+	}
+}
+
+// Started reports whether the status has gone out; after that a failure
+// can only be signalled with Abort
+func (s *Stream) Started() bool {
+	return s.started
+}
+
+func (s *Stream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.flushed = time.Now()
+	if s.ndjson {
+		s.w.Header().Set("Content-Type", NDJSON)
+	} else {
+		s.w.Header().Set("Content-Type", "application/json")
+		s.buf = append(s.buf, '[')
+	}
+	s.w.Header().Add("Vary", "Accept")
+	// A stream is too big to be worth keeping in a cache
+	s.w.Header().Set("Cache-Control", "no-store")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// Item adds the item appendItem appends. It fails once the client has gone
+// or can no longer be written to, so the caller stops reading.
+func (s *Stream) Item(appendItem func([]byte) []byte) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.start()
+	if !s.ndjson && s.items > 0 {
+		s.buf = append(s.buf, ',')
+	}
+	s.buf = appendItem(s.buf)
+	if s.ndjson {
+		s.buf = append(s.buf, '\n')
+	}
+	s.items++
+
+	if len(s.buf) >= streamBuffer {
+		if err := s.write(); err != nil {
+			return err
+		}
+	}
+	if time.Since(s.flushed) >= s.interval {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *Stream) write() error {
+	_, err := s.w.Write(s.buf)
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *Stream) flush() error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	s.flushed = time.Now()
+	// Writers that can't flush still get everything, just later
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Close ends the listing, which may be empty
+func (s *Stream) Close() error {
+	s.start()
+	if !s.ndjson {
+		s.buf = append(s.buf, ']', '\n')
+	}
+	return s.flush()
+}
+
+// Abort ends a stream that failed midway by dropping the connection, so
+// the client can't take the truncated listing for a complete one
+func (s *Stream) Abort() {
+	panic(http.ErrAbortHandler)
+}
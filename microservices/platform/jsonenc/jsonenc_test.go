@@ -0,0 +1,104 @@
+package jsonenc
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+var testStrings = []string{
+	"",
+	"plain",
+	`quote " and backslash \`,
+	"<script>alert('x') && 1</script>",
+	"tab\tnewline\nreturn\rbell\a\x00\x1f",
+	"héllo wörld ✓ 日本",
+	"line para ",
+	"bad \xff utf-8 \xc3",
+}
+
+var testFloats = []float64{0, 1, -1, 0.1, 12.34, 1e20, 1e21, 123456789e15, 1e-6, 1e-7, -2.5e-9, math.MaxFloat64, math.SmallestNonzeroFloat64}
+
+func marshal(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMatchesEncodingJSON(t *testing.T) {
+	for _, s := range testStrings {
+		if got, want := string(String(nil, s)), marshal(t, s); got != want {
+			t.Errorf("String(%q) = %s, want %s", s, got, want)
+		}
+	}
+	for _, f := range testFloats {
+		if got, want := string(Float(nil, f)), marshal(t, f); got != want {
+			t.Errorf("Float(%v) = %s, want %s", f, got, want)
+		}
+	}
+	for _, tm := range []time.Time{
+		time.Date(2024, 2, 29, 23, 59, 59, 123456789, time.UTC),
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("", -5*3600)),
+	} {
+		if got, want := string(Time(nil, tm)), marshal(t, tm); got != want {
+			t.Errorf("Time(%v) = %s, want %s", tm, got, want)
+		}
+	}
+	for _, m := range []map[string]string{nil, {}, {"b": "2", "a": "<1>", "é": "x"}} {
+		if got, want := string(StringMap(nil, m)), marshal(t, m); got != want {
+			t.Errorf("StringMap(%v) = %s, want %s", m, got, want)
+		}
+	}
+	if got, want := string(Int(nil, math.MinInt64)), marshal(t, int64(math.MinInt64)); got != want {
+		t.Errorf("Int = %s, want %s", got, want)
+	}
+}
+
+func BenchmarkString(b *testing.B) {
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, s := range testStrings {
+			buf = String(buf[:0], s)
+		}
+	}
+}
+
+func BenchmarkStringEncodingJSON(b *testing.B) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, s := range testStrings {
+			buf.Reset()
+			enc.Encode(s)
+		}
+	}
+}
+
+func BenchmarkFloat(b *testing.B) {
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, f := range testFloats {
+			buf = Float(buf[:0], f)
+		}
+	}
+}
+
+func BenchmarkFloatEncodingJSON(b *testing.B) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, f := range testFloats {
+			buf.Reset()
+			enc.Encode(f)
+		}
+	}
+}
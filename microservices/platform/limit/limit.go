@@ -0,0 +1,325 @@
+// Package limit caps concurrent work at a limit that follows the latency
+// it observes, instead of a size fixed at deploy time. While calls finish
+// about as fast as they do unloaded the limit creeps up; once they slow
+// down — a queue is forming at the database or the payment provider — or
+// start timing out, it comes down, and work beyond it is turned away or
+// waits rather than deepening the queue.
+//
+// Two algorithms decide the changes: AIMD, which adds one while calls are
+// healthy and cuts by a factor when they aren't, and Vegas, which
+// estimates the queue from how far latency has climbed above its unloaded
+// minimum and steers it between bounds.
+package limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/middleware"
+	"platform/priority"
+)
+
+// Sample is one call's outcome, as an algorithm sees it
+type Sample struct {
+	RTT time.Duration
+	// MinRTT is the fastest call lately, standing in for the unloaded
+	// latency
+	MinRTT   time.Duration
+	InFlight int
+	// Dropped says the call timed out or was refused for overload
+	Dropped bool
+}
+
+// Algorithm turns a sample into a new limit
+type Algorithm interface {
+	Name() string
+	Update(limit float64, s Sample) float64
+}
+
+// AIMD adds one to the limit per round of healthy calls made while at
+// least half of it is used, and multiplies it by Backoff when a call is
+// dropped or takes more than Tolerance times MinRTT
+type AIMD struct {
+	Backoff   float64
+	Tolerance float64
+}
+
+func (AIMD) Name() string { return "aimd" }
+
+func (a AIMD) Update(limit float64, s Sample) float64 {
+	if s.Dropped || float64(s.RTT) > a.Tolerance*float64(s.MinRTT) {
+		return limit * a.Backoff
+	}
+	if float64(s.InFlight)*2 >= limit {
+		return limit + 1/limit
+	}
+	return limit
+}
+
+// Vegas estimates the calls queued as limit × (1 − MinRTT/RTT) and grows
+// the limit by log10(limit) per round while fewer than 3·log10(limit)
+// queue, shrinking it as much past 6·log10(limit) or on a drop
+type Vegas struct{}
+
+func (Vegas) Name() string { return "vegas" }
+
+func (Vegas) Update(limit float64, s Sample) float64 {
+	step := math.Max(math.Log10(limit), 1)
+	if s.Dropped {
+		return limit - step
+	}
+	// A limit that isn't being used says nothing about how much more the
+	// dependency would take
+	if float64(s.InFlight)*2 < limit {
+		return limit
+	}
+	queue := limit * (1 - float64(s.MinRTT)/float64(s.RTT))
+	switch {
+	case queue < 3*step:
+		return limit + step/limit
+	case queue > 6*step:
+		return limit - step
+	}
+	return limit
+}
+
+// Parse names an algorithm: aimd, vegas, or "" for none
+func Parse(name string) (Algorithm, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "aimd":
+		return AIMD{Backoff: 0.9, Tolerance: 2}, nil
+	case "vegas":
+		return Vegas{}, nil
+	}
+	return nil, fmt.Errorf("unknown limit algorithm %q", name)
+}
+
+// Overloaded reports whether a call's outcome says its dependency is
+// overloaded: it timed out, or was answered 429, 503 or 504
+func Overloaded(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// minWindow is how long the fastest call counts as the unloaded latency;
+// older minimums age out so the limiter follows a dependency that got
+// slower for good, after a deploy or a move
+const minWindow = time.Minute
+
+// Limiter tracks one dependency's or handler's limit
+type Limiter struct {
+	name     string
+	alg      Algorithm
+	min, max float64
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// minRTT is the fastest call in the current window, prevMin in the
+	// one before it
+	minRTT, prevMin time.Duration
+	windowStart     time.Time
+	// cutAt is when the limit last came down; calls already running then
+	// saw the old limit, so they don't cut it again
+	cutAt    time.Time
+	rejected int64
+	dropped  int64
+}
+
+// New starts name's limit at initial and keeps it between min and max
+func New(name string, alg Algorithm, initial, min, max int) *Limiter {
+	return &Limiter{
+		name:        name,
+		alg:         alg,
+		min:         float64(min),
+		max:         float64(max),
+		limit:       float64(initial),
+		windowStart: time.Now(),
+	}
+}
+
+// Limit is the current limit, rounded down
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Observe feeds the limiter a call that took rtt with inFlight calls
+// running, counting it as a drop if dropped
+func (l *Limiter) Observe(rtt time.Duration, inFlight int, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.windowStart) >= minWindow {
+		l.prevMin, l.minRTT, l.windowStart = l.minRTT, 0, now
+	}
+	if rtt > 0 && (l.minRTT == 0 || rtt < l.minRTT) {
+		l.minRTT = rtt
+	}
+	minRTT := l.minRTT
+	if l.prevMin > 0 && l.prevMin < minRTT {
+		minRTT = l.prevMin
+	}
+	if dropped {
+		l.dropped++
+	}
+	if rtt <= 0 {
+		return
+	}
+	s := Sample{RTT: rtt, MinRTT: minRTT, InFlight: inFlight, Dropped: dropped}
+	limit := l.alg.Update(l.limit, s)
+	if limit < l.limit {
+		if now.Add(-rtt).Before(l.cutAt) {
+			return
+		}
+		l.cutAt = now
+	}
+	l.limit = math.Min(math.Max(limit, l.min), l.max)
+}
+
+// TryAcquire admits a call while fewer than the limit are running, or
+// fewer than half of it for batch work; done must be called once the call
+// is over, saying whether it was dropped
+func (l *Limiter) TryAcquire(ctx context.Context) (done func(dropped bool), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := int(l.limit)
+	if priority.FromContext(ctx) == priority.Batch {
+		limit = max(limit/2, 1)
+	}
+	if l.inFlight >= limit {
+		l.rejected++
+		return nil, false
+	}
+	return l.admit(), true
+}
+
+// Admit counts a call let through by a caller that keeps to Limit itself,
+// such as a bulkhead queuing for it; done is as for TryAcquire
+func (l *Limiter) Admit() (done func(dropped bool)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.admit()
+}
+
+// admit must be called with l.mu held
+func (l *Limiter) admit() func(dropped bool) {
+	l.inFlight++
+	inFlight := l.inFlight
+	start := time.Now()
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			l.mu.Unlock()
+			l.Observe(time.Since(start), inFlight, dropped)
+		})
+	}
+}
+
+// Rejected counts a call turned away by something queuing in front of the
+// limiter
+func (l *Limiter) Rejected() {
+	l.mu.Lock()
+	l.rejected++
+	l.mu.Unlock()
+}
+
+// WriteMetrics reports the limiter as a dependency's, under its name
+func (l *Limiter) WriteMetrics(w io.Writer) {
+	writeMetrics(w, "dependency", []*Limiter{l})
+}
+
+// writeMetrics reports limiters as <kind>_concurrency_* series labelled
+// with kind and their names
+func writeMetrics(w io.Writer, kind string, limiters []*Limiter) {
+	series := func(name, typ string, value func(l *Limiter) string) {
+		fmt.Fprintf(w, "# TYPE %s_concurrency_%s %s\n", kind, name, typ)
+		for _, l := range limiters {
+			l.mu.Lock()
+			fmt.Fprintf(w, "%s_concurrency_%s{%s=%q} %s\n", kind, name, kind, l.name, value(l))
+			l.mu.Unlock()
+		}
+	}
+	series("limit", "gauge", func(l *Limiter) string { return strconv.Itoa(int(l.limit)) })
+	series("in_flight", "gauge", func(l *Limiter) string { return strconv.Itoa(l.inFlight) })
+	series("min_rtt_seconds", "gauge", func(l *Limiter) string { return strconv.FormatFloat(l.minRTT.Seconds(), 'g', -1, 64) })
+	series("rejected_total", "counter", func(l *Limiter) string { return strconv.FormatInt(l.rejected, 10) })
+	series("dropped_total", "counter", func(l *Limiter) string { return strconv.FormatInt(l.dropped, 10) })
+}
+
+// Routes gives each handler its own limiter, so a slow route backing up
+// on the database is held back without starving the fast ones
+type Routes struct {
+	alg      Algorithm
+	initial  int
+	min, max int
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+func NewRoutes(alg Algorithm, initial, min, max int) *Routes {
+	return &Routes{alg: alg, initial: initial, min: min, max: max, limiters: make(map[string]*Limiter)}
+}
+
+func (rs *Routes) limiter(route string) *Limiter {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	l, ok := rs.limiters[route]
+	if !ok {
+		l = New(route, rs.alg, rs.initial, rs.min, rs.max)
+		rs.limiters[route] = l
+	}
+	return l
+}
+
+// Serve runs h for route under its limit, answering 503 when it's full.
+// Responses of 503 and 504 and requests that ran out of time count as
+// drops.
+func (rs *Routes) Serve(route string, h http.Handler, w http.ResponseWriter, r *http.Request) {
+	done, ok := rs.limiter(route).TryAcquire(r.Context())
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server overloaded, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	rec := middleware.NewRecorder(w)
+	dropped := false
+	defer func() { done(dropped) }()
+	h.ServeHTTP(rec, r)
+	dropped = rec.Status == http.StatusServiceUnavailable || rec.Status == http.StatusGatewayTimeout ||
+		errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+func (rs *Routes) WriteMetrics(w io.Writer) {
+	rs.mu.Lock()
+	limiters := make([]*Limiter, 0, len(rs.limiters))
+	for _, l := range rs.limiters {
+		limiters = append(limiters, l)
+	}
+	rs.mu.Unlock()
+	sort.Slice(limiters, func(i, j int) bool { return limiters[i].name < limiters[j].name })
+	writeMetrics(w, "route", limiters)
+}
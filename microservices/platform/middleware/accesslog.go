@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/buildinfo"
+	"platform/cost"
+)
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+)
+
+// RecordUpstream adds a downstream call and its duration to the request's
+// cost, so access logs show where a request spent its time
+func RecordUpstream(ctx context.Context, service string, d time.Duration) {
+	cost.Call(ctx, service, d)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func upstreamMillis(calls map[string]cost.Calls) map[string]float64 {
+	ms := make(map[string]float64, len(calls))
+	for service, c := range calls {
+		ms[service] = millis(c.Time)
+	}
+	return ms
+}
+
+type accessLogEntry struct {
+	Time       time.Time          `json:"time"`
+	RemoteAddr string             `json:"remote_addr"`
+	RequestID  string             `json:"request_id,omitempty"`
+	TraceID    string             `json:"trace_id,omitempty"`
+	Method     string             `json:"method"`
+	Route      string             `json:"route"`
+	Path       string             `json:"path"`
+	Proto      string             `json:"proto"`
+	Status     int                `json:"status"`
+	Bytes      int                `json:"bytes"`
+	DurationMS float64            `json:"duration_ms"`
+	Referer    string             `json:"referer,omitempty"`
+	UserAgent  string             `json:"user_agent,omitempty"`
+	Queries    int                `json:"db_queries,omitempty"`
+	QueryMS    float64            `json:"db_ms,omitempty"`
+	Upstream   map[string]float64 `json:"upstream_ms,omitempty"`
+	Calls      map[string]int     `json:"upstream_calls,omitempty"`
+	Build      string             `json:"build"`
+}
+
+// AccessLogger writes one line per request in the configured format.
+// Sampling is per route path; server errors and requests being debugged
+// are always logged.
+type AccessLogger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	format   string
+	sampling map[string]float64
+	// build goes on every line, so a trace can be matched to a deploy
+	build string
+}
+
+func NewAccessLogger(out io.Writer, format string, sampling map[string]float64) *AccessLogger {
+	if format != AccessLogCombined {
+		format = AccessLogJSON
+	}
+	return &AccessLogger{out: out, format: format, sampling: sampling, build: buildinfo.Get().Short()}
+}
+
+// ParseSampling parses "path=rate" pairs, e.g. "/slo=0,/orders=0.5"
+func ParseSampling(spec string) (map[string]float64, error) {
+	sampling := make(map[string]float64)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		path, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid sampling rule %q", pair)
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("invalid sampling rate in %q", pair)
+		}
+		sampling[path] = r
+	}
+	return sampling, nil
+}
+
+// Sampling is the rate for each path sampled
+func (l *AccessLogger) Sampling() map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.sampling)
+}
+
+// SetSampling replaces the sampling rates
+func (l *AccessLogger) SetSampling(sampling map[string]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sampling = maps.Clone(sampling)
+}
+
+func (l *AccessLogger) sampled(r *http.Request, status int) bool {
+	if status >= 500 || logs.Debugging(r.Context()) {
+		return true
+	}
+	l.mu.Lock()
+	rate, ok := l.sampling[r.URL.Path]
+	l.mu.Unlock()
+	if !ok {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+func (l *AccessLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, record := cost.With(r.Context())
+		r, route := withRouteHolder(r.WithContext(ctx))
+		rec := NewRecorder(w)
+
+		next.ServeHTTP(rec, r)
+
+		if !l.sampled(r, rec.Status) {
+			return
+		}
+		spent := record.Cost()
+		entry := accessLogEntry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			RequestID:  RequestID(r.Context()),
+			Method:     r.Method,
+			Route:      routeName(r, route),
+			Path:       r.URL.RequestURI(),
+			Proto:      r.Proto,
+			Status:     rec.Status,
+			Bytes:      rec.Bytes,
+			DurationMS: millis(time.Since(start)),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Queries:    spent.Queries,
+			QueryMS:    millis(spent.QueryTime),
+			Upstream:   upstreamMillis(spent.Calls),
+			Calls:      make(map[string]int, len(spent.Calls)),
+			Build:      l.build,
+		}
+		for service, c := range spent.Calls {
+			entry.Calls[service] = c.Count
+		}
+		if sc, ok := SpanFromContext(r.Context()); ok {
+			entry.TraceID = sc.TraceID
+		}
+		l.write(entry)
+	})
+}
+
+func (l *AccessLogger) write(e accessLogEntry) {
+	var line []byte
+	if l.format == AccessLogCombined {
+		line = []byte(combinedLine(e))
+	} else {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	}
+
+	l.mu.Lock()
+	l.out.Write(line)
+	l.mu.Unlock()
+}
+
+// combinedLine renders the Apache combined format with the database time,
+// upstream timings and the build appended
+func combinedLine(e accessLogEntry) string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	referer, userAgent := e.Referer, e.UserAgent
+	if referer == "" {
+		referer = "-"
+	}
+	if userAgent == "" {
+		userAgent = "-"
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %q %q %.3fms",
+		host, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, e.Bytes, referer, userAgent, e.DurationMS)
+
+	if e.Queries > 0 {
+		line += fmt.Sprintf(" db=%d/%.3fms", e.Queries, e.QueryMS)
+	}
+	services := make([]string, 0, len(e.Upstream))
+	for service := range e.Upstream {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		line += fmt.Sprintf(" %s=%.3fms", service, e.Upstream[service])
+	}
+	return line + " build=" + e.Build + "\n"
+}
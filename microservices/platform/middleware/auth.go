@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"platform/auth"
+	"platform/cost"
+)
+
+type principalKey struct{}
+
+func PrincipalFromContext(ctx context.Context) (*auth.Claims, bool) {
+	c, ok := ctx.Value(principalKey{}).(*auth.Claims)
+	return c, ok
+}
+
+// publicPath reports whether path is one of the public paths, whose
+// {name} segments match any one segment, e.g. /payments/{id}/challenge
+func publicPath(public []string, path string) bool {
+	if slices.Contains(public, path) {
+		return true
+	}
+	segs := strings.Split(path, "/")
+	return slices.ContainsFunc(public, func(pattern string) bool {
+		want := strings.Split(pattern, "/")
+		if len(want) != len(segs) {
+			return false
+		}
+		for i, seg := range want {
+			wild := strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}")
+			if wild && segs[i] == "" || !wild && seg != segs[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Auth requires a valid bearer token on every request except those to the
+// public paths, such as the login endpoint that hands tokens out. A public
+// path may name segments, as router patterns do.
+func Auth(tokens *auth.Tokens, public ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if publicPath(public, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+			claims, err := tokens.Verify(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if !claims.Allows(r.URL.Path) {
+				http.Error(w, "token is only good for "+claims.Scope, http.StatusForbidden)
+				return
+			}
+			if !claims.Permits(r.Method, r.URL.Path) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				http.Error(w, "token's scopes don't cover "+r.Method+" "+r.URL.Path, http.StatusForbidden)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, claims))
+			cost.SetClient(r.Context(), "sub:"+claims.Subject)
+			if claims.Actor != nil {
+				audit(w, r, next, claims)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// audit serves a request made under an impersonation token and logs who
+// did what as whom, whatever the access log samples
+func audit(w http.ResponseWriter, r *http.Request, next http.Handler, claims *auth.Claims) {
+	rec := NewRecorder(w)
+	next.ServeHTTP(rec, r)
+	log.Printf("audit: %s impersonating %s (session %s): %s %s %d request_id=%s",
+		claims.Actor.Subject, claims.Subject, claims.Actor.Session, r.Method, r.URL.RequestURI(), rec.Status, RequestID(r.Context()))
+}
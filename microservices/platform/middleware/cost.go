@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/cost"
+)
+
+// otherClients is where clients past the cap are counted
+const otherClients = "other"
+
+type costKey struct {
+	route  string
+	client string
+}
+
+type costTotals struct {
+	requests  int64
+	queries   int64
+	queryTime time.Duration
+	bytes     int64
+	calls     map[string]cost.Calls
+}
+
+// Costs adds up what requests cost — database queries, downstream calls
+// and response bytes — per route and client, so a client hammering an
+// expensive route shows in the metrics. Clients are the authenticated
+// subject, or the remote address for anonymous requests; past maxClients
+// distinct ones the rest are counted together as "other".
+//
+// With header set every response says what it cost in a Server-Timing
+// header; without it only requests being debugged do, since it tells
+// callers how the service spends its time.
+type Costs struct {
+	service    string
+	header     bool
+	maxClients int
+
+	mu      sync.Mutex
+	clients map[string]bool
+	totals  map[costKey]*costTotals
+}
+
+func NewCosts(service string, header bool, maxClients int) *Costs {
+	return &Costs{
+		service:    service,
+		header:     header,
+		maxClients: maxClients,
+		clients:    make(map[string]bool),
+		totals:     make(map[costKey]*costTotals),
+	}
+}
+
+func (c *Costs) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, record := cost.With(r.Context())
+		r, route := withRouteHolder(r.WithContext(ctx))
+		cw := &costWriter{ResponseRecorder: NewRecorder(w), r: r, costs: c, record: record}
+
+		next.ServeHTTP(cw, r)
+
+		spent := record.Cost()
+		client := spent.Client
+		if client == "" {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			client = "ip:" + host
+		}
+		c.add(costKey{route: routeName(r, route), client: client}, spent, cw.Bytes)
+	})
+}
+
+func (c *Costs) add(key costKey, spent cost.Cost, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.clients[key.client] {
+		if len(c.clients) >= c.maxClients {
+			key.client = otherClients
+		} else {
+			c.clients[key.client] = true
+		}
+	}
+	t, ok := c.totals[key]
+	if !ok {
+		t = &costTotals{calls: make(map[string]cost.Calls)}
+		c.totals[key] = t
+	}
+	t.requests++
+	t.queries += int64(spent.Queries)
+	t.queryTime += spent.QueryTime
+	t.bytes += int64(bytes)
+	for service, calls := range spent.Calls {
+		sum := t.calls[service]
+		sum.Count += calls.Count
+		sum.Time += calls.Time
+		t.calls[service] = sum
+	}
+}
+
+// costWriter puts the cost so far on the response as its header goes out;
+// the bytes aren't known by then, so only the access log and metrics have
+// those
+type costWriter struct {
+	*ResponseRecorder
+	r      *http.Request
+	costs  *Costs
+	record *cost.Record
+	sent   bool
+}
+
+func (w *costWriter) setHeader() {
+	if w.sent {
+		return
+	}
+	w.sent = true
+	if w.costs.header || logs.Debugging(w.r.Context()) {
+		if timing := serverTiming(w.record.Cost()); timing != "" {
+			w.Header().Add("Server-Timing", timing)
+		}
+	}
+}
+
+func (w *costWriter) WriteHeader(status int) {
+	w.setHeader()
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *costWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseRecorder.Write(b)
+}
+
+// serverTiming renders a cost as Server-Timing metrics, e.g.
+// db;dur=4.2;desc="3 queries", user-service;dur=12.5;desc="1 call"
+func serverTiming(spent cost.Cost) string {
+	var parts []string
+	if spent.Queries > 0 {
+		parts = append(parts, fmt.Sprintf("db;dur=%.1f;desc=\"%s\"", millis(spent.QueryTime), plural(spent.Queries, "query", "queries")))
+	}
+	for _, service := range sortedServices(spent.Calls) {
+		calls := spent.Calls[service]
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f;desc=\"%s\"", service, millis(calls.Time), plural(calls.Count, "call", "calls")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+func (c *Costs) WriteMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]costKey, 0, len(c.totals))
+	for k := range c.totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].client < keys[j].client
+	})
+	labels := func(k costKey) string {
+		return fmt.Sprintf("service=%q,route=%q,client=%q", c.service, k.route, k.client)
+	}
+
+	fmt.Fprintln(w, "# TYPE request_cost_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "request_cost_requests_total{%s} %d\n", labels(k), c.totals[k].requests)
+	}
+	fmt.Fprintln(w, "# TYPE request_cost_db_queries_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "request_cost_db_queries_total{%s} %d\n", labels(k), c.totals[k].queries)
+	}
+	fmt.Fprintln(w, "# TYPE request_cost_db_seconds_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "request_cost_db_seconds_total{%s} %g\n", labels(k), c.totals[k].queryTime.Seconds())
+	}
+	fmt.Fprintln(w, "# TYPE request_cost_response_bytes_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "request_cost_response_bytes_total{%s} %d\n", labels(k), c.totals[k].bytes)
+	}
+	fmt.Fprintln(w, "# TYPE request_cost_upstream_calls_total counter")
+	for _, k := range keys {
+		for _, service := range sortedServices(c.totals[k].calls) {
+			fmt.Fprintf(w, "request_cost_upstream_calls_total{%s,upstream=%q} %d\n", labels(k), service, c.totals[k].calls[service].Count)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE request_cost_upstream_seconds_total counter")
+	for _, k := range keys {
+		for _, service := range sortedServices(c.totals[k].calls) {
+			fmt.Fprintf(w, "request_cost_upstream_seconds_total{%s,upstream=%q} %g\n", labels(k), service, c.totals[k].calls[service].Time.Seconds())
+		}
+	}
+}
+
+func sortedServices(calls map[string]cost.Calls) []string {
+	services := make([]string, 0, len(calls))
+	for service := range calls {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Log levels
+const (
+	LogInfo  = "info"
+	LogDebug = "debug"
+)
+
+// LogControl changes what a service logs while it runs, so a problem can be
+// looked into without a restart that loses its reproduction: the level, the
+// routes and users whose requests log at debug whatever the level, and the
+// access log's sampling. Admins change it at /admin/logging; SIGUSR1 turns
+// debug on and off, SIGUSR2 puts back what the service started with.
+type LogControl struct {
+	mu      sync.RWMutex
+	level   string
+	routes  map[string]bool
+	users   map[string]bool
+	access  *AccessLogger
+	initial logState
+}
+
+// logState is LogControl's settings as /admin/logging shows them
+type logState struct {
+	Level    string             `json:"level"`
+	Routes   []string           `json:"routes"`
+	Users    []string           `json:"users"`
+	Sampling map[string]float64 `json:"sampling,omitempty"`
+}
+
+var logs = &LogControl{level: LogInfo, routes: map[string]bool{}, users: map[string]bool{}}
+
+// Logs is the process's log control
+func Logs() *LogControl {
+	return logs
+}
+
+// Configure sets the level the service starts at, "" for info, and the
+// access logger whose sampling the control adjusts
+func (c *LogControl) Configure(level string, access *AccessLogger) error {
+	if level == "" {
+		level = LogInfo
+	}
+	if level != LogInfo && level != LogDebug {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.level = level
+	c.access = access
+	c.initial = c.stateLocked()
+	return nil
+}
+
+func (c *LogControl) stateLocked() logState {
+	s := logState{
+		Level:  c.level,
+		Routes: append([]string{}, slices.Sorted(maps.Keys(c.routes))...),
+		Users:  append([]string{}, slices.Sorted(maps.Keys(c.users))...),
+	}
+	if c.access != nil {
+		s.Sampling = c.access.Sampling()
+	}
+	return s
+}
+
+func (c *LogControl) set(s logState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.level = s.Level
+	c.routes = make(map[string]bool)
+	for _, route := range s.Routes {
+		c.routes[route] = true
+	}
+	c.users = make(map[string]bool)
+	for _, user := range s.Users {
+		c.users[user] = true
+	}
+	if c.access != nil && s.Sampling != nil {
+		c.access.SetSampling(s.Sampling)
+	}
+}
+
+// ToggleDebug switches between debug and info
+func (c *LogControl) ToggleDebug() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.level == LogDebug {
+		c.level = LogInfo
+	} else {
+		c.level = LogDebug
+	}
+	return c.level
+}
+
+// Reset puts back the settings the service started with
+func (c *LogControl) Reset() {
+	c.mu.RLock()
+	initial := c.initial
+	c.mu.RUnlock()
+	c.set(initial)
+}
+
+// Debugging reports whether ctx's request logs at debug: everything does at
+// the debug level, otherwise requests to the routes or from the users
+// picked out
+func (c *LogControl) Debugging(ctx context.Context) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.level == LogDebug {
+		return true
+	}
+	if len(c.routes) > 0 && c.routes[RouteName(ctx)] {
+		return true
+	}
+	if len(c.users) > 0 {
+		if claims, ok := PrincipalFromContext(ctx); ok && c.users[claims.Subject] {
+			return true
+		}
+	}
+	return false
+}
+
+// Debugf logs when ctx's request is being debugged, with its request ID
+func Debugf(ctx context.Context, format string, args ...any) {
+	if !logs.Debugging(ctx) {
+		return
+	}
+	if id := RequestID(ctx); id != "" {
+		format = "debug [" + id + "] " + format
+	} else {
+		format = "debug " + format
+	}
+	log.Printf(format, args...)
+}
+
+// ServeHTTP is the admin endpoint: GET reports the settings, PUT changes
+// those given, DELETE puts back the ones the service started with
+func (c *LogControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Level    string             `json:"level"`
+			Routes   []string           `json:"routes"`
+			Users    []string           `json:"users"`
+			Sampling map[string]float64 `json:"sampling"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Level != "" && req.Level != LogInfo && req.Level != LogDebug {
+			http.Error(w, "level must be info or debug", http.StatusBadRequest)
+			return
+		}
+		for path, rate := range req.Sampling {
+			if rate < 0 || rate > 1 {
+				http.Error(w, fmt.Sprintf("invalid sampling rate for %s", path), http.StatusBadRequest)
+				return
+			}
+		}
+		c.mu.RLock()
+		s := c.stateLocked()
+		c.mu.RUnlock()
+		// Lists given replace the current ones, [] clears them
+		if req.Level != "" {
+			s.Level = req.Level
+		}
+		if req.Routes != nil {
+			s.Routes = req.Routes
+		}
+		if req.Users != nil {
+			s.Users = req.Users
+		}
+		if req.Sampling != nil {
+			s.Sampling = req.Sampling
+		}
+		c.set(s)
+		log.Printf("logging changed: level %s, debugging routes %v and users %v", s.Level, s.Routes, s.Users)
+	case http.MethodDelete:
+		c.Reset()
+		log.Print("logging reset")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.mu.RLock()
+	s := c.stateLocked()
+	c.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
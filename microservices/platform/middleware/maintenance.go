@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maintenance rejects writes with 503 while enabled; reads keep working
+type Maintenance struct {
+	mu         sync.RWMutex
+	enabled    bool
+	retryAfter time.Duration
+}
+
+func NewMaintenance(enabled bool) *Maintenance {
+	return &Maintenance{enabled: enabled, retryAfter: time.Minute}
+}
+
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	RetryAfter string `json:"retry_after"`
+}
+
+func (m *Maintenance) Set(enabled bool, retryAfter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = enabled
+	if retryAfter > 0 {
+		m.retryAfter = retryAfter
+	}
+}
+
+func (m *Maintenance) state() (bool, time.Duration) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.enabled, m.retryAfter
+}
+
+func isRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func (m *Maintenance) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enabled, retryAfter := m.state(); enabled && !isRead(r.Method) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, "service is in maintenance mode", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP is the admin endpoint: GET reports the state, PUT changes it
+func (m *Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var retryAfter time.Duration
+		if req.RetryAfter != "" {
+			d, err := time.ParseDuration(req.RetryAfter)
+			if err != nil {
+				http.Error(w, "invalid retry_after", http.StatusBadRequest)
+				return
+			}
+			retryAfter = d
+		}
+		m.Set(req.Enabled, retryAfter)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, retryAfter := m.state()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceState{Enabled: enabled, RetryAfter: retryAfter.String()})
+}
+
+// RequireRole rejects authenticated callers that have none of roles.
+// Requests only carry no principal when auth is disabled for the whole
+// service.
+func RequireRole(roles ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := PrincipalFromContext(r.Context()); ok && !slices.ContainsFunc(roles, p.HasRole) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Latency buckets in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricKey struct {
+	route  string
+	method string
+	status int
+}
+
+// Collector contributes extra series to a Metrics endpoint
+type Collector interface {
+	WriteMetrics(w io.Writer)
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+// Metrics counts requests and records latency per route, method and status,
+// and serves them in the Prometheus text format
+type Metrics struct {
+	mu       sync.Mutex
+	service  string
+	buckets  []float64
+	requests map[metricKey]*histogram
+	inFlight int64
+	extra    []Collector
+}
+
+func NewMetrics(service string) *Metrics {
+	return &Metrics{
+		service:  service,
+		buckets:  defaultBuckets,
+		requests: make(map[metricKey]*histogram),
+	}
+}
+
+// Register adds a collector whose series are served after the request metrics
+func (m *Metrics) Register(c Collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.extra = append(m.extra, c)
+}
+
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.inFlight++
+		m.mu.Unlock()
+
+		start := time.Now()
+		r, route := withRouteHolder(r)
+		rec := NewRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		m.observe(metricKey{route: routeName(r, route), method: r.Method, status: rec.Status}, time.Since(start))
+	})
+}
+
+func (m *Metrics) observe(key metricKey, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight--
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.requests[key] = h
+	}
+	seconds := d.Seconds()
+	for i, b := range m.buckets {
+		if seconds <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.total++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := make([]metricKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(w, "http_requests_in_flight{service=%q} %d\n", m.service, m.inFlight)
+
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total{%s} %d\n", m.labels(k), m.requests[k].total)
+	}
+
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, k := range keys {
+		h := m.requests[k]
+		labels := m.labels(k)
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=%q} %d\n",
+				labels, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.total)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, h.total)
+	}
+
+	for _, c := range m.extra {
+		c.WriteMetrics(w)
+	}
+}
+
+func (m *Metrics) labels(k metricKey) string {
+	return fmt.Sprintf("service=%q,route=%q,method=%q,status=\"%d\"", m.service, k.route, k.method, k.status)
+}
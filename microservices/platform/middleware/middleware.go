@@ -0,0 +1,155 @@
+// Package middleware holds the HTTP middleware shared by every service, so
+// bootstrap behavior (recovery, request IDs, tracing, logging, metrics,
+// auth, rate limiting) doesn't diverge between services.
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// Chain composes middleware so the first one is the outermost
+func Chain(mws ...Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			if mws[i] != nil {
+				h = mws[i](h)
+			}
+		}
+		return h
+	}
+}
+
+// Recovery turns a panicking handler into a 500 instead of a dropped connection
+func Recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("panic serving %s %s (request %s): %v\n%s",
+					r.Method, r.URL.Path, RequestID(r.Context()), err, debug.Stack())
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID reuses the caller's X-Request-ID or generates a new one, and
+// echoes it on the response
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = randomHex(16)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Propagate copies the request ID and trace context onto an outgoing request
+func Propagate(ctx context.Context, req *http.Request) {
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if sc, ok := SpanFromContext(ctx); ok {
+		req.Header.Set(traceparentHeader, sc.traceparent())
+	}
+}
+
+type routeKey struct{}
+
+// SetRoute names the route that handled a request; metrics and logs use it
+// instead of the raw path to keep label cardinality bounded
+func SetRoute(ctx context.Context, name string) {
+	if route, ok := ctx.Value(routeKey{}).(*string); ok {
+		*route = name
+	}
+}
+
+// RouteName is the name SetRoute gave ctx's request, "" before a route
+// has matched
+func RouteName(ctx context.Context) string {
+	if route, ok := ctx.Value(routeKey{}).(*string); ok {
+		return *route
+	}
+	return ""
+}
+
+func withRouteHolder(r *http.Request) (*http.Request, *string) {
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		return r, route
+	}
+	route := new(string)
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, route)), route
+}
+
+func routeName(r *http.Request, route *string) string {
+	if *route != "" {
+		return *route
+	}
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	// Never fall back to the raw path: 404 scans would explode label cardinality
+	return "unmatched"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ResponseRecorder captures the status code and body size written by a handler
+type ResponseRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int
+}
+
+func NewRecorder(w http.ResponseWriter) *ResponseRecorder {
+	if rec, ok := w.(*ResponseRecorder); ok {
+		return rec
+	}
+	return &ResponseRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *ResponseRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += n
+	return n, err
+}
+
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *ResponseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"platform/priority"
+)
+
+// Shedder rejects excess traffic with 503 before it queues up: when too many
+// requests are already in flight, or when callers are waiting too long for
+// a database connection from the pool. Batch requests are shed at half the
+// thresholds so interactive traffic keeps the remaining headroom.
+type Shedder struct {
+	maxInFlight int64
+	maxPoolWait time.Duration
+	poolStats   func() sql.DBStats
+
+	inFlight atomic.Int64
+
+	mu       sync.Mutex
+	last     sql.DBStats
+	lastAt   time.Time
+	avgWait  time.Duration
+	interval time.Duration
+}
+
+// NewShedder limits in-flight requests to maxInFlight (0 disables) and sheds
+// while the average pool wait over the last second exceeds maxPoolWait
+// (0 or a nil poolStats disables)
+func NewShedder(maxInFlight int, maxPoolWait time.Duration, poolStats func() sql.DBStats) *Shedder {
+	return &Shedder{
+		maxInFlight: int64(maxInFlight),
+		maxPoolWait: maxPoolWait,
+		poolStats:   poolStats,
+		interval:    time.Second,
+	}
+}
+
+// poolWait returns the average time spent waiting for a connection over the
+// last sampling interval
+func (s *Shedder) poolWait() time.Duration {
+	if s.poolStats == nil || s.maxPoolWait == 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastAt) < s.interval {
+		return s.avgWait
+	}
+	stats := s.poolStats()
+	if waits := stats.WaitCount - s.last.WaitCount; waits > 0 {
+		s.avgWait = (stats.WaitDuration - s.last.WaitDuration) / time.Duration(waits)
+	} else {
+		s.avgWait = 0
+	}
+	s.last, s.lastAt = stats, now
+	return s.avgWait
+}
+
+// admit reports whether a request may proceed; the caller must call done
+// when it does
+func (s *Shedder) admit(r *http.Request) bool {
+	maxInFlight, maxPoolWait := s.maxInFlight, s.maxPoolWait
+	if priority.FromContext(r.Context()) == priority.Batch {
+		maxInFlight, maxPoolWait = max(maxInFlight/2, 1), maxPoolWait/2
+	}
+
+	n := s.inFlight.Add(1)
+	if s.maxInFlight > 0 && n > maxInFlight {
+		s.inFlight.Add(-1)
+		return false
+	}
+	if s.maxPoolWait > 0 && s.poolWait() > maxPoolWait {
+		s.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *Shedder) done() {
+	s.inFlight.Add(-1)
+}
+
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.admit(r) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server overloaded, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.done()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const traceparentHeader = "traceparent"
+
+// SpanContext follows the W3C trace context format
+type SpanContext struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Sampled  bool
+}
+
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+type spanKey struct{}
+
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Tracing continues the caller's trace from the traceparent header, or
+// starts a new one, and opens a span for this request
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc := SpanContext{Sampled: true}
+		if parent, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			sc.TraceID = parent.TraceID
+			sc.ParentID = parent.SpanID
+			sc.Sampled = parent.Sampled
+		} else {
+			sc.TraceID = randomHex(16)
+		}
+		sc.SpanID = randomHex(8)
+
+		w.Header().Set(traceparentHeader, sc.traceparent())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), spanKey{}, sc)))
+	})
+}
+
+func parseTraceparent(h string) (SpanContext, bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) || strings.Trim(parts[1], "0") == "" {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: parts[3] == "01"}, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
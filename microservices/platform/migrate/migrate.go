@@ -0,0 +1,267 @@
+// Package migrate applies a service's embedded SQL migrations inside the
+// schema the service owns.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var schemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// Phase is where a migration falls in an expand-contract change, taken from
+// its file name, e.g. 0012_split_name.contract.sql. Plain migrations have
+// none and are applied at startup like expansions.
+type Phase string
+
+const (
+	// Expand adds what new code needs beside what old code still uses
+	Expand Phase = "expand"
+	// Backfill is one statement filling a batch of at most $1 rows, run
+	// again until it changes none, in the background once the service is
+	// up; the migrations after it wait until it is done
+	Backfill Phase = "backfill"
+	// Contract drops what only old code used, once no instance running
+	// code older than the migration is registered
+	Contract Phase = "contract"
+)
+
+// Migration is one .sql file, identified by its file name
+type Migration struct {
+	Version string
+	Phase   Phase
+	SQL     string
+}
+
+// online reports whether m waits for the service to be up
+func (m Migration) online() bool {
+	return m.Phase == Backfill || m.Phase == Contract
+}
+
+// Load reads every .sql file in fsys, ordered by name
+func Load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	migrations := make([]Migration, 0, len(names))
+	for _, name := range names {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		m := Migration{Version: strings.TrimSuffix(name, ".sql"), SQL: string(content)}
+		if i := strings.LastIndexByte(m.Version, '.'); i >= 0 {
+			m.Phase = Phase(m.Version[i+1:])
+			if m.Phase != Expand && m.Phase != Backfill && m.Phase != Contract {
+				return nil, fmt.Errorf("migration %s: unknown phase %q", name, m.Phase)
+			}
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// Run verifies that the migrations in fsys only touch schema, then applies
+// the ones not yet recorded in schema.schema_migrations, up to the first
+// backfill or contraction, which Online applies once the service is up.
+// Each migration runs in its own transaction with search_path set to
+// schema. Each transaction takes an advisory lock first, keeping concurrent
+// replicas from migrating at the same time; nothing is left on the session,
+// so Run works behind pgbouncer in transaction pooling mode too.
+func Run(ctx context.Context, db *sql.DB, fsys fs.FS, schema string) error {
+	migrations, applied, err := prepare(ctx, db, fsys, schema)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		if m.online() {
+			return nil
+		}
+		if err := apply(ctx, db, schema, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// RunTo applies every migration through version last, backfills and
+// contractions included, without waiting for other instances. It is for
+// tools run with the service stopped: restoring a backup loads its rows
+// into the schema they were taken from before later migrations convert
+// them.
+func RunTo(ctx context.Context, db *sql.DB, fsys fs.FS, schema, last string) error {
+	migrations, applied, err := prepare(ctx, db, fsys, schema)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > last {
+			break
+		}
+		if applied[m.Version] {
+			continue
+		}
+		if m.Phase == Backfill {
+			for {
+				done, _, err := backfillBatch(ctx, db, schema, m, defaultBatch)
+				if err != nil {
+					return fmt.Errorf("migration %s: %w", m.Version, err)
+				}
+				if done {
+					break
+				}
+			}
+			continue
+		}
+		if err := apply(ctx, db, schema, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// prepare loads and checks the migrations in fsys and returns them with
+// the versions already applied
+func prepare(ctx context.Context, db *sql.DB, fsys fs.FS, schema string) ([]Migration, map[string]bool, error) {
+	if !schemaName.MatchString(schema) {
+		return nil, nil, fmt.Errorf("invalid schema name %q", schema)
+	}
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := CheckOwnership(schema, migrations); err != nil {
+		return nil, nil, err
+	}
+	applied, err := setup(ctx, db, schema)
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrations, applied, nil
+}
+
+// lock begins a transaction holding the schema's advisory lock until it
+// ends. The lock is transaction scoped rather than held by the session, so
+// it works behind a pooler handing out connections per transaction.
+func lock(ctx context.Context, db *sql.DB, schema string) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", schema); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Tables are the bookkeeping tables migrate keeps in each schema, which
+// aren't the service's data
+var Tables = []string{"schema_migrations", "schema_backfills", "schema_instances"}
+
+// setup creates the schema and its bookkeeping tables and returns the
+// versions already applied
+func setup(ctx context.Context, db *sql.DB, schema string) (map[string]bool, error) {
+	tx, err := lock(ctx, db, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ddl := fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %[1]s;
+		CREATE TABLE IF NOT EXISTS %[1]s.schema_migrations (
+			version TEXT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS %[1]s.schema_backfills (
+			version TEXT PRIMARY KEY,
+			batches BIGINT NOT NULL DEFAULT 0,
+			rows BIGINT NOT NULL DEFAULT 0,
+			started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS %[1]s.schema_instances (
+			instance TEXT PRIMARY KEY,
+			latest TEXT NOT NULL,
+			seen_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, schema)
+	if _, err := tx.ExecContext(ctx, ddl); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]bool)
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT version FROM %s.schema_migrations", schema))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return applied, tx.Commit()
+}
+
+func apply(ctx context.Context, db *sql.DB, schema string, m Migration) error {
+	tx, err := lock(ctx, db, schema)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Another replica may have applied it since setup read the versions
+	var done bool
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s.schema_migrations WHERE version = $1)", schema),
+		m.Version).Scan(&done)
+	if err != nil || done {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path TO %s", schema)); err != nil {
+		return err
+	}
+	// Migrations may rewrite whole tables; the pool's statement timeout is
+	// meant for queries
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// WithSearchPath adds a search_path run-time parameter to a postgres:// URL
+// so unqualified table names resolve to the service's schema
+func WithSearchPath(dsn, schema string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
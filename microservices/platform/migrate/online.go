@@ -0,0 +1,216 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBatch = 1000
+	// Registrations not renewed for this long are instances that died
+	// without saying so
+	defaultInstanceTTL = 2 * time.Minute
+)
+
+// Online applies the migrations Run leaves for when the service is up:
+// backfills, a batch at a time with progress kept in schema_backfills, and
+// contractions, once every registered instance runs code that has them.
+// It registers its own instance in schema_instances with the newest
+// migration the code has, and renews that until stopped, so a later
+// deploy's contractions wait for this one to be replaced.
+type Online struct {
+	db       *sql.DB
+	fsys     fs.FS
+	schema   string
+	instance string
+	// batch is the $1 given each backfill statement
+	batch int
+	// pause between batches leaves room for the service's own queries
+	pause time.Duration
+	ttl   time.Duration
+}
+
+func NewOnline(db *sql.DB, fsys fs.FS, schema string) *Online {
+	host, _ := os.Hostname()
+	return &Online{
+		db:       db,
+		fsys:     fsys,
+		schema:   schema,
+		instance: fmt.Sprintf("%s/%d", host, os.Getpid()),
+		batch:    defaultBatch,
+		pause:    100 * time.Millisecond,
+		ttl:      defaultInstanceTTL,
+	}
+}
+
+// Run registers the instance and applies what it can every interval,
+// deregistering when ctx is done. interval should be well under a minute,
+// or registrations lapse between renewals.
+func (o *Online) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := o.register(ctx); err != nil {
+			log.Printf("migrate: register %s: %v", o.instance, err)
+		} else if err := o.Step(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("migrate: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			o.deregister()
+			return
+		}
+	}
+}
+
+// Step applies the pending migrations in order, stopping at a contraction
+// older code still stands in the way of
+func (o *Online) Step(ctx context.Context) error {
+	migrations, applied, err := prepare(ctx, o.db, o.fsys, o.schema)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		switch m.Phase {
+		case Backfill:
+			if err := o.backfill(ctx, m); err != nil {
+				return fmt.Errorf("migration %s: %w", m.Version, err)
+			}
+			continue
+		case Contract:
+			older, err := o.olderInstances(ctx, m.Version)
+			if err != nil {
+				return err
+			}
+			if len(older) > 0 {
+				log.Printf("migrate: %s waits for instances without it: %s", m.Version, strings.Join(older, ", "))
+				return nil
+			}
+		}
+		if err := apply(ctx, o.db, o.schema, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.Version, err)
+		}
+		log.Printf("migrate: applied %s", m.Version)
+	}
+	return nil
+}
+
+// backfill runs m's batches until one changes nothing
+func (o *Online) backfill(ctx context.Context, m Migration) error {
+	for {
+		done, rows, err := backfillBatch(ctx, o.db, o.schema, m, o.batch)
+		if err != nil || done {
+			if done {
+				log.Printf("migrate: backfilled %s, %d rows", m.Version, rows)
+			}
+			return err
+		}
+		select {
+		case <-time.After(o.pause):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// backfillBatch runs one batch of m, recording its progress, and marks m
+// applied when the batch changes no rows. It reports whether m is done and
+// how many rows it has changed in all.
+func backfillBatch(ctx context.Context, db *sql.DB, schema string, m Migration, batch int) (bool, int64, error) {
+	tx, err := lock(ctx, db, schema)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	var done bool
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s.schema_migrations WHERE version = $1)", schema),
+		m.Version).Scan(&done)
+	if err != nil || done {
+		return done, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path TO %s", schema)); err != nil {
+		return false, 0, err
+	}
+	res, err := tx.ExecContext(ctx, m.SQL, batch)
+	if err != nil {
+		return false, 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, 0, err
+	}
+	var total int64
+	err = tx.QueryRowContext(ctx, `INSERT INTO schema_backfills (version, batches, rows) VALUES ($1, 1, $2)
+              ON CONFLICT (version) DO UPDATE SET batches = schema_backfills.batches + 1,
+                  rows = schema_backfills.rows + $2, updated_at = now()
+              RETURNING rows`, m.Version, n).Scan(&total)
+	if err != nil {
+		return false, 0, err
+	}
+	if n == 0 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", m.Version); err != nil {
+			return false, 0, err
+		}
+	}
+	return n == 0, total, tx.Commit()
+}
+
+// olderInstances lists the live instances whose code predates version
+func (o *Online) olderInstances(ctx context.Context, version string) ([]string, error) {
+	rows, err := o.db.QueryContext(ctx, fmt.Sprintf(`SELECT instance || ' (at ' || latest || ')' FROM %s.schema_instances
+              WHERE latest < $1 AND seen_at > now() - $2 * interval '1 second'
+              ORDER BY instance`, o.schema), version, o.ttl.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var older []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		older = append(older, s)
+	}
+	return older, rows.Err()
+}
+
+// register records the instance with the newest migration its code has,
+// and forgets instances long gone
+func (o *Online) register(ctx context.Context) error {
+	migrations, err := Load(o.fsys)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+	latest := migrations[len(migrations)-1].Version
+	_, err = o.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %[1]s.schema_instances (instance, latest) VALUES ($1, $2)
+              ON CONFLICT (instance) DO UPDATE SET latest = $2, seen_at = now()`, o.schema), o.instance, latest)
+	if err != nil {
+		return err
+	}
+	_, err = o.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s.schema_instances WHERE seen_at < now() - interval '1 day'`, o.schema))
+	return err
+}
+
+func (o *Online) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := o.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s.schema_instances WHERE instance = $1", o.schema), o.instance); err != nil {
+		log.Printf("migrate: deregister %s: %v", o.instance, err)
+	}
+}
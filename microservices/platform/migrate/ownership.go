@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Schemas every service may reference
+var systemSchemas = map[string]bool{
+	"pg_catalog":         true,
+	"information_schema": true,
+}
+
+// Words that can follow FROM/UPDATE without naming a table,
+// e.g. ON CONFLICT ... DO UPDATE SET
+var sqlKeywords = map[string]bool{
+	"set":     true,
+	"select":  true,
+	"lateral": true,
+	"only":    true,
+}
+
+// TableRef is a table named in a SQL statement
+type TableRef struct {
+	Schema string
+	Table  string
+	Line   int
+}
+
+func (t TableRef) String() string {
+	if t.Schema == "" {
+		return t.Table
+	}
+	return t.Schema + "." + t.Table
+}
+
+var (
+	ident    = `"?[A-Za-z_][A-Za-z0-9_]*"?`
+	tableRef = regexp.MustCompile(`(?i)\b(FROM|JOIN|INTO|UPDATE|REFERENCES|TABLE(?:\s+IF\s+(?:NOT\s+)?EXISTS)?(?:\s+ONLY)?|INDEX\s+(?:CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?` + ident + `\s+ON(?:\s+ONLY)?)\s+(` + ident + `(?:\.` + ident + `)?)(\s*\()?`)
+	createRe = regexp.MustCompile(`(?i)\bCREATE\s+(?:UNLOGGED\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?(` + ident + `(?:\.` + ident + `)?)`)
+)
+
+// TableRefs extracts the tables a SQL snippet reads or writes. It is a
+// lexical scan, good enough for linting hand-written queries.
+func TableRefs(query string) []TableRef {
+	var refs []TableRef
+	for _, m := range tableRef.FindAllStringSubmatchIndex(query, -1) {
+		// FROM/JOIN followed by a parenthesis is a function call such as
+		// unnest(...); after INTO or TABLE it is a column list
+		keyword := strings.ToUpper(query[m[2]:m[3]])
+		if m[6] >= 0 && (keyword == "FROM" || keyword == "JOIN") {
+			continue
+		}
+		name := query[m[4]:m[5]]
+		if sqlKeywords[strings.ToLower(name)] {
+			continue
+		}
+		line := strings.Count(query[:m[4]], "\n") + 1
+		refs = append(refs, newTableRef(name, line))
+	}
+	return refs
+}
+
+// CreatedTables returns the tables a SQL snippet creates
+func CreatedTables(query string) []TableRef {
+	var refs []TableRef
+	for _, m := range createRe.FindAllStringSubmatchIndex(query, -1) {
+		line := strings.Count(query[:m[2]], "\n") + 1
+		refs = append(refs, newTableRef(query[m[2]:m[3]], line))
+	}
+	return refs
+}
+
+func newTableRef(name string, line int) TableRef {
+	name = strings.ReplaceAll(name, `"`, "")
+	schema, table, ok := strings.Cut(name, ".")
+	if !ok {
+		schema, table = "", name
+	}
+	return TableRef{Schema: strings.ToLower(schema), Table: strings.ToLower(table), Line: line}
+}
+
+// CheckOwnership fails if any migration names a table in a schema other
+// than the service's own
+func CheckOwnership(schema string, migrations []Migration) error {
+	var violations []string
+	for _, m := range migrations {
+		for _, ref := range TableRefs(m.SQL) {
+			if ref.Schema == "" || ref.Schema == schema || systemSchemas[ref.Schema] {
+				continue
+			}
+			violations = append(violations, fmt.Sprintf("%s:%d references %s", m.Version, ref.Line, ref))
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("migrations must only touch schema %q: %s", schema, strings.Join(violations, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Package priority carries a request's priority class between services so
+// overload protection can favor interactive customers over batch work such
+// as imports and exports.
+package priority
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const Header = "X-Request-Priority"
+
+type Class int
+
+const (
+	Interactive Class = iota
+	Batch
+)
+
+func (c Class) String() string {
+	if c == Batch {
+		return "batch"
+	}
+	return "interactive"
+}
+
+func Parse(s string) Class {
+	if strings.EqualFold(s, "batch") {
+		return Batch
+	}
+	return Interactive
+}
+
+type classKey struct{}
+
+func FromContext(ctx context.Context) Class {
+	c, _ := ctx.Value(classKey{}).(Class)
+	return c
+}
+
+func WithClass(ctx context.Context, c Class) context.Context {
+	return context.WithValue(ctx, classKey{}, c)
+}
+
+// Middleware reads the class set upstream by the gateway
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := Parse(r.Header.Get(Header))
+		next.ServeHTTP(w, r.WithContext(WithClass(r.Context(), c)))
+	})
+}
+
+// Propagate writes the class onto an outgoing request
+func Propagate(ctx context.Context, req *http.Request) {
+	req.Header.Set(Header, FromContext(ctx).String())
+}
+
+// Tagger classifies requests at the edge. Paths under batchPrefixes are
+// always batch; clients may also downgrade themselves to batch, but never
+// claim interactive priority for a batch path.
+func Tagger(batchPrefixes []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := Parse(r.Header.Get(Header))
+			for _, prefix := range batchPrefixes {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					c = Batch
+					break
+				}
+			}
+			r.Header.Set(Header, c.String())
+			next.ServeHTTP(w, r.WithContext(WithClass(r.Context(), c)))
+		})
+	}
+}
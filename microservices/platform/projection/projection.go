@@ -0,0 +1,170 @@
+// Package projection keeps the books of event consumers that build state
+// from events, such as read models and usage rollups. The broker delivers
+// at least once and pushes events rather than letting consumers read from
+// an offset, so a consumer can't tell a redelivery from a new event by
+// position. Instead each projection records the IDs of the events it has
+// applied, in the same transaction as what they change: an event whose ID
+// is already there is a duplicate and is acknowledged without being
+// applied again, however the consumer was restarted in between.
+//
+// The service's schema needs the table Claim writes to:
+//
+//	CREATE TABLE processed_events (
+//	    projection TEXT NOT NULL,
+//	    event_id TEXT NOT NULL,
+//	    occurred_at TIMESTAMPTZ NOT NULL,
+//	    processed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//	    PRIMARY KEY (projection, event_id)
+//	);
+package projection
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/events"
+)
+
+// Retention is how long event IDs are kept. The broker gives up on an
+// event well within it, so nothing older comes round again.
+const Retention = 7 * 24 * time.Hour
+
+// Claim records that projection is applying event within tx, reporting
+// false when it already has; the caller then leaves the event alone
+func Claim(ctx context.Context, tx *sql.Tx, projection string, event events.Event) (bool, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO processed_events (projection, event_id, occurred_at)
+              VALUES ($1, $2, $3) ON CONFLICT (projection, event_id) DO NOTHING`,
+		projection, event.ID, event.OccurredAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Prune forgets the event IDs processed before before
+func Prune(ctx context.Context, db interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, `DELETE FROM processed_events WHERE processed_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Seen is Claim for projections kept in memory; the zero Seen is ready
+type Seen struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// Claim reports false for an event projection has already claimed; the
+// caller must hold whatever lock guards the projection's state
+func (s *Seen) Claim(projection string, event events.Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := projection + "/" + event.ID
+	if _, ok := s.ids[key]; ok {
+		return false
+	}
+	if s.ids == nil {
+		s.ids = make(map[string]time.Time)
+	}
+	s.ids[key] = clock.System.Now()
+	return true
+}
+
+// Prune forgets the event IDs claimed before before
+func (s *Seen) Prune(before time.Time) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, at := range s.ids {
+		if at.Before(before) {
+			delete(s.ids, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Outcomes of handing a projection an event
+const (
+	Applied   = "applied"
+	Duplicate = "duplicate"
+	Failed    = "failed"
+)
+
+type stats struct {
+	outcomes map[string]int64
+	// lag is how long after it occurred the last event was applied
+	lag time.Duration
+	// last is when the last event applied had occurred
+	last time.Time
+}
+
+// Metrics counts what each projection did with the events it was handed
+// and how far behind them it runs
+type Metrics struct {
+	clock clock.Clock
+
+	mu          sync.Mutex
+	projections map[string]*stats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{clock: clock.System, projections: make(map[string]*stats)}
+}
+
+// Observe records the outcome of handing projection event
+func (m *Metrics) Observe(projection string, event events.Event, outcome string) {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.projections[projection]
+	if !ok {
+		s = &stats{outcomes: make(map[string]int64)}
+		m.projections[projection] = s
+	}
+	s.outcomes[outcome]++
+	if outcome == Applied && !event.OccurredAt.IsZero() {
+		s.lag = max(now.Sub(event.OccurredAt), 0)
+		if event.OccurredAt.After(s.last) {
+			s.last = event.OccurredAt
+		}
+	}
+}
+
+func (m *Metrics) WriteMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.projections))
+	for name := range m.projections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# TYPE projection_events_total counter")
+	for _, name := range names {
+		for _, outcome := range []string{Applied, Duplicate, Failed} {
+			fmt.Fprintf(w, "projection_events_total{projection=%q,outcome=%q} %d\n", name, outcome, m.projections[name].outcomes[outcome])
+		}
+	}
+	fmt.Fprintln(w, "# TYPE projection_lag_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "projection_lag_seconds{projection=%q} %g\n", name, m.projections[name].lag.Seconds())
+	}
+	fmt.Fprintln(w, "# TYPE projection_last_event_timestamp_seconds gauge")
+	for _, name := range names {
+		if last := m.projections[name].last; !last.IsZero() {
+			fmt.Fprintf(w, "projection_last_event_timestamp_seconds{projection=%q} %d\n", name, last.Unix())
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Package publicid makes the opaque IDs services expose in their APIs in
+// place of serial keys, which leak volume and are easy to guess. They are
+// random (version 4) UUIDs, the same as Postgres' gen_random_uuid().
+package publicid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// New returns a random UUID in its canonical, lower-case form
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
+
+// Valid reports whether s is a UUID in canonical form. Path parameters are
+// checked with it to tell public IDs from the numeric ones still accepted.
+func Valid(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
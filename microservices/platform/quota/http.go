@@ -0,0 +1,220 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"platform/middleware"
+	"platform/resource"
+)
+
+// SubjectFromRequest charges the caller; requests carry no principal only
+// when auth is off, and then nobody is charged
+func SubjectFromRequest(r *http.Request) (string, bool) {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	if !ok {
+		return "", false
+	}
+	return Subject(p.Tenant, p.Subject), true
+}
+
+// SetHeaders tells the client where it stands
+func SetHeaders(w http.ResponseWriter, u Usage) {
+	if u.Limit == 0 && u.Period == "" {
+		return
+	}
+	w.Header().Set("X-Quota-Limit", strconv.FormatInt(u.Limit, 10))
+	w.Header().Set("X-Quota-Remaining", strconv.FormatInt(u.Remaining(), 10))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(u.Reset.Unix(), 10))
+}
+
+// WriteExceeded answers 429 with the limit and when it resets
+func WriteExceeded(w http.ResponseWriter, err *ExceededError, message string) {
+	SetHeaders(w, err.Usage)
+	retry := time.Until(err.Reset).Seconds()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(retry, 0)))))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// Middleware charges every request by an authenticated caller one unit of
+// resource. Accounting failures let the request through; an outage of the
+// counter store shouldn't take the API down with it.
+func (a *Accountant) Middleware(resource string) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subject, ok := SubjectFromRequest(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			usage, err := a.Use(r.Context(), subject, resource, 1)
+			var exceeded *ExceededError
+			if errors.As(err, &exceeded) {
+				WriteExceeded(w, exceeded, exceeded.Error())
+				return
+			}
+			if err != nil {
+				log.Printf("quota %s for %s: %v", resource, subject, err)
+			} else {
+				SetHeaders(w, usage)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type usageResponse struct {
+	Subject string  `json:"subject"`
+	Plan    string  `json:"plan"`
+	Usage   []Usage `json:"usage"`
+}
+
+func (a *Accountant) writeUsage(w http.ResponseWriter, r *http.Request, subject string) {
+	plan, usage, err := a.Usage(r.Context(), subject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if usage == nil {
+		usage = []Usage{}
+	}
+	writeJSON(w, usageResponse{Subject: subject, Plan: plan, Usage: usage})
+}
+
+// Mine returns the caller's own plan and usage
+func (a *Accountant) Mine(w http.ResponseWriter, r *http.Request) {
+	subject, ok := SubjectFromRequest(r)
+	if !ok {
+		http.Error(w, "no caller to report on while auth is off", http.StatusNotFound)
+		return
+	}
+	a.writeUsage(w, r, subject)
+}
+
+// The handlers below are the admin API; mount them behind
+// middleware.RequireRole("admin").
+
+// ListPlans returns every plan's limits
+func (a *Accountant) ListPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := a.Plans(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, plans)
+}
+
+// PutLimit sets {plan}'s limit on {resource} from {"max": 100, "period": "month"}
+func (a *Accountant) PutLimit(w http.ResponseWriter, r *http.Request) {
+	var l Limit
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.SetLimit(r.Context(), r.PathValue("plan"), r.PathValue("resource"), l); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, l)
+}
+
+// GetUsage returns {subject}'s plan and usage, e.g. /tenant:acme or /user:7
+func (a *Accountant) GetUsage(w http.ResponseWriter, r *http.Request) {
+	a.writeUsage(w, r, r.PathValue("subject"))
+}
+
+// subjectPlan is a subject's plan as a resource of its own, which is how
+// tenants are managed declaratively
+type subjectPlan struct {
+	Subject string `json:"subject"`
+	Plan    string `json:"plan"`
+}
+
+// GetPlan returns the plan {subject} is on, with its ETag
+func (a *Accountant) GetPlan(w http.ResponseWriter, r *http.Request) {
+	subject := r.PathValue("subject")
+	plan, err := a.PlanOf(r.Context(), subject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resource.Write(w, r, http.StatusOK, subjectPlan{Subject: subject, Plan: plan})
+}
+
+// PutPlan moves {subject} to the plan in {"plan": "pro"}. Settings are
+// checked and then set, so If-Match catches an earlier change, not one
+// racing this.
+func (a *Accountant) PutPlan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Plan == "" {
+		http.Error(w, "plan is required", http.StatusUnprocessableEntity)
+		return
+	}
+	ctx, subject := r.Context(), r.PathValue("subject")
+	current, err := a.PlanOf(ctx, subject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !resource.Preconditions(w, r, resource.ETag(subjectPlan{Subject: subject, Plan: current})) {
+		return
+	}
+	if err := a.SetPlan(ctx, subject, req.Plan); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resource.Write(w, r, http.StatusOK, subjectPlan{Subject: subject, Plan: req.Plan})
+}
+
+// GetFeatures returns {plan}'s features, with their ETag
+func (a *Accountant) GetFeatures(w http.ResponseWriter, r *http.Request) {
+	features, err := a.Features(r.Context(), r.PathValue("plan"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resource.Write(w, r, http.StatusOK, features)
+}
+
+// PutFeatures replaces {plan}'s features with the list in the body, e.g.
+// ["webhooks", "exports"]; If-Match works as for PutPlan
+func (a *Accountant) PutFeatures(w http.ResponseWriter, r *http.Request) {
+	var features []string
+	if err := json.NewDecoder(r.Body).Decode(&features); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if features == nil {
+		features = []string{}
+	}
+	ctx, plan := r.Context(), r.PathValue("plan")
+	current, err := a.Features(ctx, plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !resource.Preconditions(w, r, resource.ETag(current)) {
+		return
+	}
+	if err := a.SetFeatures(ctx, plan, features); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	resource.Write(w, r, http.StatusOK, features)
+}
@@ -0,0 +1,576 @@
+// Package quota accounts for what tenants and users consume over calendar
+// periods (orders per month, API calls per day) against the limits of the
+// plan they are on, and which features that plan includes. Counters and the
+// admin's settings live in Redis so every service and replica sees the same
+// totals; without it they are per process.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/clock"
+	"platform/redis"
+)
+
+// DefaultPlan is the plan of subjects nobody has assigned one
+const DefaultPlan = "default"
+
+// DefaultLimits are used when QUOTA_LIMITS is unset
+const DefaultLimits = "default:api_calls=10000/day,default:orders=1000/month"
+
+// DefaultFeatures are used when PLAN_FEATURES is unset
+const DefaultFeatures = "default:webhooks,pro:webhooks,pro:bulk_orders,pro:exports"
+
+// Period is the calendar window a limit applies to, in UTC
+type Period string
+
+const (
+	Day   Period = "day"
+	Month Period = "month"
+)
+
+// Window returns the start of the period around t and when it resets
+func (p Period) Window(t time.Time) (start, reset time.Time, err error) {
+	t = t.UTC()
+	switch p {
+	case Day:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1), nil
+	case Month:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("quota: unknown period %q", p)
+}
+
+// Limit caps a resource at Max per Period
+type Limit struct {
+	Max    int64  `json:"max"`
+	Period Period `json:"period"`
+}
+
+// ParseLimit reads a limit written as 100/month
+func ParseLimit(s string) (Limit, error) {
+	max, period, ok := strings.Cut(s, "/")
+	n, err := strconv.ParseInt(max, 10, 64)
+	if !ok || err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("quota: invalid limit %q", s)
+	}
+	l := Limit{Max: n, Period: Period(period)}
+	if _, _, err := l.Period.Window(time.Now()); err != nil {
+		return Limit{}, err
+	}
+	return l, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Max, l.Period)
+}
+
+// Plans holds each plan's limit per resource
+type Plans map[string]map[string]Limit
+
+// ParsePlans reads plan:resource=limit pairs separated by commas, e.g.
+// default:orders=100/month,pro:orders=10000/month
+func ParsePlans(s string) (Plans, error) {
+	plans := make(Plans)
+	for entry := range strings.SplitSeq(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, limit, ok := strings.Cut(entry, "=")
+		plan, resource, ok2 := strings.Cut(name, ":")
+		if !ok || !ok2 || plan == "" || resource == "" {
+			return nil, fmt.Errorf("quota: invalid limit %q", entry)
+		}
+		l, err := ParseLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		if plans[plan] == nil {
+			plans[plan] = make(map[string]Limit)
+		}
+		plans[plan][resource] = l
+	}
+	return plans, nil
+}
+
+// Features holds the features each plan includes
+type Features map[string][]string
+
+// ParseFeatures reads plan:feature pairs separated by commas, e.g.
+// default:webhooks,pro:webhooks,pro:exports
+func ParseFeatures(s string) (Features, error) {
+	features := make(Features)
+	for entry := range strings.SplitSeq(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		plan, feature, ok := strings.Cut(entry, ":")
+		if !ok || plan == "" || feature == "" {
+			return nil, fmt.Errorf("quota: invalid feature %q", entry)
+		}
+		features[plan] = append(features[plan], feature)
+	}
+	return features, nil
+}
+
+// Usage is a subject's consumption of one resource in the current period
+type Usage struct {
+	Resource string    `json:"resource"`
+	Used     int64     `json:"used"`
+	Limit    int64     `json:"limit"`
+	Period   Period    `json:"period"`
+	Reset    time.Time `json:"reset"`
+}
+
+func (u Usage) Remaining() int64 {
+	return max(u.Limit-u.Used, 0)
+}
+
+// ExceededError is returned when using a resource would go over the limit
+type ExceededError struct {
+	Usage
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota of %d per %s exceeded; it resets at %s",
+		e.Resource, e.Limit, e.Period, e.Reset.Format(time.RFC3339))
+}
+
+// Store keeps usage counters and the admin's settings
+type Store interface {
+	// Add adds n to the counter at key, which expires at expires, and
+	// returns the new total
+	Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error)
+	Get(ctx context.Context, key string) (int64, error)
+	// Settings are plan limits and features, and plan assignments; ""
+	// means unset
+	Setting(ctx context.Context, name string) (string, error)
+	SetSetting(ctx context.Context, name, value string) error
+	Settings(ctx context.Context) (map[string]string, error)
+}
+
+// RedisStore shares counters between replicas; INCRBY keeps them atomic
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+const settingsKey = "quota:settings"
+
+func (s *RedisStore) Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error) {
+	total, err := s.client.Int(ctx, "INCRBY", key, strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	if total == n {
+		at := strconv.FormatInt(expires.UnixMilli(), 10)
+		if _, err := s.client.Do(ctx, "PEXPIREAT", key, at); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (int64, error) {
+	n, err := s.client.Int(ctx, "GET", key)
+	if errors.Is(err, redis.ErrNil) {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *RedisStore) Setting(ctx context.Context, name string) (string, error) {
+	v, err := s.client.String(ctx, "HGET", settingsKey, name)
+	if errors.Is(err, redis.ErrNil) {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *RedisStore) SetSetting(ctx context.Context, name, value string) error {
+	var err error
+	if value == "" {
+		_, err = s.client.Do(ctx, "HDEL", settingsKey, name)
+	} else {
+		_, err = s.client.Do(ctx, "HSET", settingsKey, name, value)
+	}
+	return err
+}
+
+func (s *RedisStore) Settings(ctx context.Context) (map[string]string, error) {
+	reply, err := s.client.Do(ctx, "HGETALL", settingsKey)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]any)
+	settings := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		name, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+type counter struct {
+	n       int64
+	expires time.Time
+}
+
+// MemoryStore is for single-replica and local use only
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+	settings map[string]string
+	clock    clock.Clock
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters: make(map[string]*counter),
+		settings: make(map[string]string),
+		clock:    clock.System,
+	}
+}
+
+func (s *MemoryStore) Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expires) {
+		c = &counter{expires: expires}
+		s.counters[key] = c
+	}
+	c.n += n
+	if len(s.counters) > 10000 {
+		for k, c := range s.counters {
+			if now.After(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+	}
+	return c.n, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok || s.clock.Now().After(c.expires) {
+		return 0, nil
+	}
+	return c.n, nil
+}
+
+func (s *MemoryStore) Setting(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings[name], nil
+}
+
+func (s *MemoryStore) SetSetting(ctx context.Context, name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value == "" {
+		delete(s.settings, name)
+	} else {
+		s.settings[name] = value
+	}
+	return nil
+}
+
+func (s *MemoryStore) Settings(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := make(map[string]string, len(s.settings))
+	for k, v := range s.settings {
+		settings[k] = v
+	}
+	return settings, nil
+}
+
+// Subject names who a quota is charged to: the tenant when there is one,
+// since its users share its plan, otherwise the user
+func Subject(tenant, userID string) string {
+	if tenant != "" {
+		return "tenant:" + tenant
+	}
+	return "user:" + userID
+}
+
+// Accountant charges subjects for what they use. Plans start with the
+// configured defaults; the admin API overrides them in the store.
+type Accountant struct {
+	store    Store
+	defaults Plans
+	// features are each plan's default entitlements
+	features Features
+	clock    clock.Clock
+}
+
+func New(store Store, defaults Plans, features Features) *Accountant {
+	return &Accountant{store: store, defaults: defaults, features: features, clock: clock.System}
+}
+
+// FromEnv keeps counters in REDIS_URL when set, with the default limits in
+// QUOTA_LIMITS (see ParsePlans) and features in PLAN_FEATURES (see
+// ParseFeatures); QUOTA_LIMITS=off turns accounting off and returns nil
+func FromEnv() (*Accountant, error) {
+	limits := os.Getenv("QUOTA_LIMITS")
+	if limits == "off" {
+		return nil, nil
+	}
+	if limits == "" {
+		limits = DefaultLimits
+	}
+	defaults, err := ParsePlans(limits)
+	if err != nil {
+		return nil, err
+	}
+	featureSpec, ok := os.LookupEnv("PLAN_FEATURES")
+	if !ok {
+		featureSpec = DefaultFeatures
+	}
+	features, err := ParseFeatures(featureSpec)
+	if err != nil {
+		return nil, err
+	}
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		client, err := redis.Open(url)
+		if err != nil {
+			return nil, err
+		}
+		return New(NewRedisStore(client), defaults, features), nil
+	}
+	log.Print("REDIS_URL not set; quota counters and settings are per replica")
+	return New(NewMemoryStore(), defaults, features), nil
+}
+
+func planSetting(subject string) string {
+	return "plan/" + subject
+}
+
+func limitSetting(plan, resource string) string {
+	return "limit/" + plan + "/" + resource
+}
+
+// PlanOf returns the plan subject is on
+func (a *Accountant) PlanOf(ctx context.Context, subject string) (string, error) {
+	plan, err := a.store.Setting(ctx, planSetting(subject))
+	if plan == "" && err == nil {
+		plan = DefaultPlan
+	}
+	return plan, err
+}
+
+// SetPlan moves subject to plan; the default plan clears the assignment
+func (a *Accountant) SetPlan(ctx context.Context, subject, plan string) error {
+	if plan == DefaultPlan {
+		plan = ""
+	}
+	return a.store.SetSetting(ctx, planSetting(subject), plan)
+}
+
+// Plans returns every plan's limits, the admin's overrides included
+func (a *Accountant) Plans(ctx context.Context) (Plans, error) {
+	settings, err := a.store.Settings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plans := make(Plans)
+	for plan, limits := range a.defaults {
+		plans[plan] = make(map[string]Limit, len(limits))
+		for resource, l := range limits {
+			plans[plan][resource] = l
+		}
+	}
+	for name, value := range settings {
+		rest, ok := strings.CutPrefix(name, "limit/")
+		plan, resource, ok2 := strings.Cut(rest, "/")
+		if !ok || !ok2 {
+			continue
+		}
+		l, err := ParseLimit(value)
+		if err != nil {
+			continue
+		}
+		if plans[plan] == nil {
+			plans[plan] = make(map[string]Limit)
+		}
+		plans[plan][resource] = l
+	}
+	return plans, nil
+}
+
+// SetLimit overrides plan's limit on resource for every replica
+func (a *Accountant) SetLimit(ctx context.Context, plan, resource string, l Limit) error {
+	if _, _, err := l.Period.Window(a.clock.Now()); err != nil {
+		return err
+	}
+	if l.Max < 0 {
+		return fmt.Errorf("quota: invalid limit %d", l.Max)
+	}
+	return a.store.SetSetting(ctx, limitSetting(plan, resource), l.String())
+}
+
+// limit finds plan's limit on resource; ok is false when it has none
+func (a *Accountant) limit(ctx context.Context, plan, resource string) (Limit, bool, error) {
+	v, err := a.store.Setting(ctx, limitSetting(plan, resource))
+	if err != nil {
+		return Limit{}, false, err
+	}
+	if v != "" {
+		l, err := ParseLimit(v)
+		return l, err == nil, err
+	}
+	l, ok := a.defaults[plan][resource]
+	return l, ok, nil
+}
+
+func featuresSetting(plan string) string {
+	return "features/" + plan
+}
+
+// Features returns the features plan includes, the admin's list if they
+// set one
+func (a *Accountant) Features(ctx context.Context, plan string) ([]string, error) {
+	v, err := a.store.Setting(ctx, featuresSetting(plan))
+	if err != nil {
+		return nil, err
+	}
+	if v == "" {
+		return slices.Clone(a.features[plan]), nil
+	}
+	// "-" is an admin's explicitly empty list
+	if v == "-" {
+		return []string{}, nil
+	}
+	return strings.Split(v, ","), nil
+}
+
+// SetFeatures replaces plan's features for every replica
+func (a *Accountant) SetFeatures(ctx context.Context, plan string, features []string) error {
+	for _, f := range features {
+		if f == "" || strings.ContainsAny(f, ", ") {
+			return fmt.Errorf("quota: invalid feature %q", f)
+		}
+	}
+	v := strings.Join(features, ",")
+	if v == "" {
+		v = "-"
+	}
+	return a.store.SetSetting(ctx, featuresSetting(plan), v)
+}
+
+// Entitlements returns subject's plan and the features it includes
+func (a *Accountant) Entitlements(ctx context.Context, subject string) (string, []string, error) {
+	plan, err := a.PlanOf(ctx, subject)
+	if err != nil {
+		return "", nil, err
+	}
+	features, err := a.Features(ctx, plan)
+	return plan, features, err
+}
+
+func counterKey(subject, resource string, start time.Time) string {
+	return fmt.Sprintf("quota:%s:%s:%d", subject, resource, start.Unix())
+}
+
+// Use charges subject n of resource, failing with *ExceededError when that
+// would go over its plan's limit. Resources the plan doesn't limit are
+// free and report a zero Limit.
+func (a *Accountant) Use(ctx context.Context, subject, resource string, n int64) (Usage, error) {
+	plan, err := a.PlanOf(ctx, subject)
+	if err != nil {
+		return Usage{}, err
+	}
+	l, ok, err := a.limit(ctx, plan, resource)
+	if err != nil || !ok {
+		return Usage{Resource: resource}, err
+	}
+	start, reset, err := l.Period.Window(a.clock.Now())
+	if err != nil {
+		return Usage{}, err
+	}
+	usage := Usage{Resource: resource, Limit: l.Max, Period: l.Period, Reset: reset}
+
+	key := counterKey(subject, resource, start)
+	// Expire a little after the reset, so a late Release finds the counter
+	total, err := a.store.Add(ctx, key, n, reset.Add(time.Hour))
+	if err != nil {
+		return Usage{}, err
+	}
+	if total > l.Max {
+		// Take it back; two racing callers may both be refused near the
+		// limit, never both let over it
+		total, err = a.store.Add(ctx, key, -n, reset.Add(time.Hour))
+		usage.Used = total
+		if err != nil {
+			return usage, err
+		}
+		return usage, &ExceededError{Usage: usage}
+	}
+	usage.Used = total
+	return usage, nil
+}
+
+// Release gives back what Use charged, for work that then didn't happen
+func (a *Accountant) Release(ctx context.Context, subject, resource string, n int64) error {
+	plan, err := a.PlanOf(ctx, subject)
+	if err != nil {
+		return err
+	}
+	l, ok, err := a.limit(ctx, plan, resource)
+	if err != nil || !ok {
+		return err
+	}
+	start, reset, err := l.Period.Window(a.clock.Now())
+	if err != nil {
+		return err
+	}
+	_, err = a.store.Add(ctx, counterKey(subject, resource, start), -n, reset.Add(time.Hour))
+	return err
+}
+
+// Usage reports subject's consumption of every resource its plan limits
+func (a *Accountant) Usage(ctx context.Context, subject string) (string, []Usage, error) {
+	plan, err := a.PlanOf(ctx, subject)
+	if err != nil {
+		return "", nil, err
+	}
+	plans, err := a.Plans(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var usage []Usage
+	for resource, l := range plans[plan] {
+		start, reset, err := l.Period.Window(a.clock.Now())
+		if err != nil {
+			continue
+		}
+		used, err := a.store.Get(ctx, counterKey(subject, resource, start))
+		if err != nil {
+			return "", nil, err
+		}
+		usage = append(usage, Usage{Resource: resource, Used: used, Limit: l.Max, Period: l.Period, Reset: reset})
+	}
+	slices.SortFunc(usage, func(a, b Usage) int { return strings.Compare(a.Resource, b.Resource) })
+	return plan, usage, nil
+}
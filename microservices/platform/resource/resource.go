@@ -0,0 +1,66 @@
+// Package resource helps configuration endpoints behave the way
+// infrastructure-as-code tools expect: a resource lives at a stable URL
+// named by its caller, PUT creates or replaces it whole and can be
+// repeated, and every representation carries an ETag, so a tool can tell
+// whether what it last applied is still there (If-None-Match on GET) and
+// refuse to overwrite someone else's change (If-Match on PUT and DELETE).
+package resource
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ETag is a strong validator for v, a hash of its JSON
+func ETag(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matches reports whether an If-Match or If-None-Match value names etag
+func matches(header, etag string) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Preconditions checks a PUT's or DELETE's If-Match and If-None-Match
+// against the resource's current ETag, "" when it doesn't exist yet, and
+// answers 412 when they don't hold: If-Match: * asks for the resource to
+// exist, If-None-Match: * for it not to.
+func Preconditions(w http.ResponseWriter, r *http.Request, current string) bool {
+	if h := r.Header.Get("If-Match"); h != "" && (current == "" || !matches(h, current)) {
+		http.Error(w, "resource has changed", http.StatusPreconditionFailed)
+		return false
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && current != "" && matches(h, current) {
+		http.Error(w, "resource already exists", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// Write sends v with its ETag, or just 304 to a GET whose If-None-Match
+// names it
+func Write(w http.ResponseWriter, r *http.Request, status int, v any) {
+	etag := ETag(v)
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodGet && matches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type openAPIDoc struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	OperationID string             `json:"operationId"`
+	Parameters  []openAPIParameter `json:"parameters,omitempty"`
+	Responses   map[string]any     `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   map[string]any `json:"schema"`
+}
+
+// OpenAPI generates a skeleton OpenAPI 3 document from the route table.
+// Routes without a method or with subtree patterns are left out.
+func (rt *Router) OpenAPI(title, version string) any {
+	doc := openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: title, Version: version},
+		Paths:   make(map[string]map[string]openAPIOperation),
+	}
+	for _, r := range rt.routes {
+		if r.Method == "" || strings.HasSuffix(r.Pattern, "/") && r.Pattern != "/" {
+			continue
+		}
+		path := strings.TrimSuffix(strings.ReplaceAll(r.Pattern, "...}", "}"), "{$}")
+
+		op := openAPIOperation{
+			OperationID: r.Name,
+			Responses:   map[string]any{"default": map[string]string{"description": "response"}},
+		}
+		for _, p := range params(r.Pattern) {
+			op.Parameters = append(op.Parameters, openAPIParameter{
+				Name: p, In: "path", Required: true, Schema: map[string]any{"type": "string"},
+			})
+		}
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]openAPIOperation)
+		}
+		doc.Paths[path][strings.ToLower(r.Method)] = op
+	}
+	return doc
+}
+
+// ServeOpenAPI registers GET /openapi.json describing every route
+func (rt *Router) ServeOpenAPI(title, version string) {
+	rt.Get("openapi", "/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rt.OpenAPI(title, version))
+	})
+}
@@ -0,0 +1,139 @@
+// Package router registers handlers by method and path pattern, with path
+// parameters (/users/{id}) and a named route table that feeds metrics, logs
+// and the generated OpenAPI document.
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"platform/limit"
+	"platform/middleware"
+)
+
+// Route describes one registered endpoint
+type Route struct {
+	Name    string
+	Method  string
+	Pattern string
+}
+
+// Router wraps http.ServeMux, which already matches methods and path
+// wildcards and answers 405 with an Allow header for known paths
+type Router struct {
+	mux    *http.ServeMux
+	routes []Route
+	limits *limit.Routes
+}
+
+func New() *Router {
+	return &Router{mux: http.NewServeMux()}
+}
+
+// Handle registers h for method and pattern; an empty method matches any
+func (rt *Router) Handle(name, method, pattern string, h http.Handler) {
+	muxPattern := pattern
+	if method != "" {
+		muxPattern = method + " " + pattern
+	}
+	rt.routes = append(rt.routes, Route{Name: name, Method: method, Pattern: pattern})
+	rt.mux.Handle(muxPattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.SetRoute(r.Context(), name)
+		if rt.limits != nil {
+			rt.limits.Serve(name, h, w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// Limit runs each route under its own adaptive concurrency limit from
+// limits; nil leaves routes unlimited
+func (rt *Router) Limit(limits *limit.Routes) {
+	rt.limits = limits
+}
+
+func (rt *Router) HandleFunc(name, method, pattern string, h http.HandlerFunc) {
+	rt.Handle(name, method, pattern, h)
+}
+
+func (rt *Router) Get(name, pattern string, h http.HandlerFunc) {
+	rt.Handle(name, http.MethodGet, pattern, h)
+}
+
+func (rt *Router) Post(name, pattern string, h http.HandlerFunc) {
+	rt.Handle(name, http.MethodPost, pattern, h)
+}
+
+func (rt *Router) Put(name, pattern string, h http.HandlerFunc) {
+	rt.Handle(name, http.MethodPut, pattern, h)
+}
+
+func (rt *Router) Patch(name, pattern string, h http.HandlerFunc) {
+	rt.Handle(name, http.MethodPatch, pattern, h)
+}
+
+func (rt *Router) Delete(name, pattern string, h http.HandlerFunc) {
+	rt.Handle(name, http.MethodDelete, pattern, h)
+}
+
+// Routes returns the route table in registration order
+func (rt *Router) Routes() []Route {
+	return append([]Route(nil), rt.routes...)
+}
+
+// Lookup finds a route by name
+func (rt *Router) Lookup(name string) (Route, bool) {
+	for _, r := range rt.routes {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// Path builds a path to the named route, filling its wildcards in order
+// with values, e.g. Path("get-user", "7") for /users/{id}. It returns ""
+// for an unknown route or too few values, so callers can leave such links
+// out.
+func (rt *Router) Path(name string, values ...string) string {
+	route, ok := rt.Lookup(name)
+	if !ok {
+		return ""
+	}
+	segs := strings.Split(strings.TrimSuffix(route.Pattern, "{$}"), "/")
+	for i, seg := range segs {
+		if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+			continue
+		}
+		if len(values) == 0 {
+			return ""
+		}
+		segs[i], values = url.PathEscape(values[0]), values[1:]
+	}
+	return strings.Join(segs, "/")
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// Param returns a path parameter, e.g. Param(r, "id") for /users/{id}
+func Param(r *http.Request, name string) string {
+	return r.PathValue(name)
+}
+
+// params lists the wildcard names in a pattern
+func params(pattern string) []string {
+	var names []string
+	for _, seg := range strings.Split(pattern, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			name := strings.TrimSuffix(strings.TrimSuffix(seg[1:len(seg)-1], "..."), "$")
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
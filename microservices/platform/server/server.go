@@ -0,0 +1,417 @@
+// Package server is the shared HTTP bootstrap: the standard middleware chain,
+// a /metrics endpoint and graceful shutdown.
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"platform/alert"
+	"platform/auth"
+	"platform/buildinfo"
+	"platform/capture"
+	"platform/deadline"
+	"platform/degrade"
+	"platform/limit"
+	"platform/middleware"
+	"platform/priority"
+	"platform/startup"
+	"platform/transport"
+	"platform/workflow"
+)
+
+type Options struct {
+	// Name is used in log lines and as the metrics service label
+	Name string
+	Addr string
+
+	AccessLog *middleware.AccessLogger
+	// Costs, when set, adds up what requests cost per route and client
+	// for the metrics
+	Costs     *middleware.Costs
+	RateLimit *middleware.RateLimiter
+	Tokens    *auth.Tokens
+
+	// PublicPaths are served without a bearer token when auth is on; a
+	// {name} segment matches any one, e.g. /payments/{id}/challenge
+	PublicPaths []string
+
+	// Capture, when set, records the exchanges admins ask for at
+	// /admin/capture
+	Capture *capture.Capturer
+
+	// Maintenance, when set, gates writes and is exposed at
+	// /admin/maintenance for admins
+	Maintenance *middleware.Maintenance
+
+	// Workflows, when set, lists the service's stuck workflows to admins
+	// at /admin/workflows/stuck and resumes or aborts them
+	Workflows *workflow.Watchdog
+
+	// Alerts, when set, has what it sent to Slack, Teams and PagerDuty
+	// counted in the metrics
+	Alerts *alert.Alerter
+
+	// Load shedding: MaxInFlight caps concurrent requests; MaxPoolWait sheds
+	// while the average wait for a connection from PoolStats exceeds it
+	MaxInFlight int
+	MaxPoolWait time.Duration
+	PoolStats   func() sql.DBStats
+
+	// Limits, when set, holds each route to a concurrency limit that adapts
+	// to its latency; the service's router applies it and the server
+	// reports it
+	Limits *limit.Routes
+
+	// Degradation, when set, is the service's fallbacks for dependencies
+	// that are down; the server marks responses they served and reports
+	// them
+	Degradation *degrade.Policy
+
+	// BatchPrefixes makes this server the edge that assigns priority
+	// classes; other servers trust the class they receive
+	BatchPrefixes []string
+
+	// RequestBudget is the deadline given to requests that arrive without
+	// a budget header, and the cap for those that do; zero means none
+	RequestBudget time.Duration
+
+	// Middleware runs inside the standard chain, closest to the handler
+	Middleware []middleware.Middleware
+
+	// Startup, when set, holds requests back with 503 until the service's
+	// dependencies answer and backs /readyz; without it the service is
+	// ready as soon as it listens
+	Startup *startup.Startup
+
+	// SelfTest serves Startup's self-test at /internal/selftest to admins,
+	// for deploy pipelines to verify a fresh rollout
+	SelfTest bool
+
+	// HTTP2 sets the HTTP versions accepted and whether to serve TLS;
+	// Conns counts the connections for /metrics
+	HTTP2 transport.Config
+	Conns *transport.Conns
+
+	// Features names the optional behaviour the service has switched on,
+	// reported at /version beside the server's own
+	Features []string
+
+	ShutdownTimeout time.Duration
+}
+
+// OptionsFromEnv reads the standard settings shared by all services, and
+// prefixes the standard logger's lines with the build: LOG_LEVEL,
+// ACCESS_LOG_FORMAT, ACCESS_LOG_SAMPLING, COST_HEADER, COST_MAX_CLIENTS,
+// RATE_LIMIT_RPS, RATE_LIMIT_BURST, AUTH_SECRET, REQUEST_BUDGET, MAINTENANCE, SELFTEST, SHED_MAX_IN_FLIGHT,
+// SHED_MAX_POOL_WAIT, ROUTE_LIMIT, ROUTE_LIMIT_MAX and CAPTURE_FILE, and the HTTP versions (see transport.FromEnv). Rate
+// limiting, auth and shedding stay off unless configured.
+func OptionsFromEnv(name, addr string) (Options, error) {
+	opts := Options{Name: name, Addr: addr, ShutdownTimeout: 5 * time.Second, Conns: transport.NewConns(name)}
+	// Every log line from here on names the build
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix(buildinfo.Get().Short() + " ")
+
+	var err error
+	if opts.HTTP2, err = transport.FromEnv(); err != nil {
+		return opts, err
+	}
+
+	sampling, err := middleware.ParseSampling(os.Getenv("ACCESS_LOG_SAMPLING"))
+	if err != nil {
+		return opts, err
+	}
+	opts.AccessLog = middleware.NewAccessLogger(os.Stdout, os.Getenv("ACCESS_LOG_FORMAT"), sampling)
+	if err := middleware.Logs().Configure(os.Getenv("LOG_LEVEL"), opts.AccessLog); err != nil {
+		return opts, err
+	}
+
+	maxClients := 100
+	if v := os.Getenv("COST_MAX_CLIENTS"); v != "" {
+		if maxClients, err = strconv.Atoi(v); err != nil || maxClients < 0 {
+			return opts, fmt.Errorf("invalid COST_MAX_CLIENTS %q", v)
+		}
+	}
+	opts.Costs = middleware.NewCosts(name, os.Getenv("COST_HEADER") == "true", maxClients)
+
+	if rps := os.Getenv("RATE_LIMIT_RPS"); rps != "" {
+		rate, err := strconv.ParseFloat(rps, 64)
+		if err != nil || rate <= 0 {
+			return opts, fmt.Errorf("invalid RATE_LIMIT_RPS %q", rps)
+		}
+		burst := int(rate)
+		if b := os.Getenv("RATE_LIMIT_BURST"); b != "" {
+			if burst, err = strconv.Atoi(b); err != nil {
+				return opts, fmt.Errorf("invalid RATE_LIMIT_BURST %q", b)
+			}
+		}
+		opts.RateLimit = middleware.NewRateLimiter(rate, max(burst, 1))
+	}
+
+	if secret := os.Getenv("AUTH_SECRET"); secret != "" {
+		opts.Tokens = auth.NewTokens([]byte(secret))
+	}
+
+	if b := os.Getenv("REQUEST_BUDGET"); b != "" {
+		if opts.RequestBudget, err = time.ParseDuration(b); err != nil {
+			return opts, fmt.Errorf("invalid REQUEST_BUDGET %q", b)
+		}
+	}
+
+	if opts.Capture, err = capture.FromEnv(name); err != nil {
+		return opts, err
+	}
+
+	opts.Maintenance = middleware.NewMaintenance(os.Getenv("MAINTENANCE") == "true")
+	opts.SelfTest = os.Getenv("SELFTEST") == "true"
+	if v := os.Getenv("SHED_MAX_IN_FLIGHT"); v != "" {
+		if opts.MaxInFlight, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("invalid SHED_MAX_IN_FLIGHT %q", v)
+		}
+	}
+	if v := os.Getenv("SHED_MAX_POOL_WAIT"); v != "" {
+		if opts.MaxPoolWait, err = time.ParseDuration(v); err != nil {
+			return opts, fmt.Errorf("invalid SHED_MAX_POOL_WAIT %q", v)
+		}
+	}
+	if opts.Limits, err = routeLimitsFromEnv(); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// routeLimitsFromEnv reads the algorithm adapting each route's concurrency
+// limit from ROUTE_LIMIT, aimd or vegas, and its ceiling from
+// ROUTE_LIMIT_MAX; nil when ROUTE_LIMIT isn't set
+func routeLimitsFromEnv() (*limit.Routes, error) {
+	alg, err := limit.Parse(os.Getenv("ROUTE_LIMIT"))
+	if err != nil || alg == nil {
+		return nil, err
+	}
+	ceiling := 1000
+	if v := os.Getenv("ROUTE_LIMIT_MAX"); v != "" {
+		if ceiling, err = strconv.Atoi(v); err != nil || ceiling < 1 {
+			return nil, fmt.Errorf("invalid ROUTE_LIMIT_MAX %q", v)
+		}
+	}
+	return limit.NewRoutes(alg, min(20, ceiling), 1, ceiling), nil
+}
+
+type Server struct {
+	opts    Options
+	http    *http.Server
+	Metrics *middleware.Metrics
+}
+
+// NewServer wraps handler in the standard chain:
+// recovery, request ID, tracing, costs, degradation, access log, priority, metrics, load shedding,
+// startup, deadline, auth, rate limit, capture, maintenance.
+// /metrics, /healthz, /readyz and /version are served outside the chain so
+// scrapes and probes need no credentials.
+func NewServer(opts Options, handler http.Handler) *Server {
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = 5 * time.Second
+	}
+	metrics := middleware.NewMetrics(opts.Name)
+
+	chain := []middleware.Middleware{
+		middleware.Recovery,
+		middleware.WithRequestID,
+		middleware.Tracing,
+	}
+	if opts.Costs != nil {
+		chain = append(chain, opts.Costs.Middleware)
+		metrics.Register(opts.Costs)
+	}
+	if opts.Degradation != nil {
+		chain = append(chain, opts.Degradation.Middleware)
+		metrics.Register(opts.Degradation)
+	}
+	if opts.AccessLog != nil {
+		chain = append(chain, opts.AccessLog.Middleware)
+	}
+	if opts.BatchPrefixes != nil {
+		chain = append(chain, priority.Tagger(opts.BatchPrefixes))
+	} else {
+		chain = append(chain, priority.Middleware)
+	}
+	chain = append(chain, metrics.Middleware)
+	if opts.MaxInFlight > 0 || (opts.MaxPoolWait > 0 && opts.PoolStats != nil) {
+		chain = append(chain, middleware.NewShedder(opts.MaxInFlight, opts.MaxPoolWait, opts.PoolStats).Middleware)
+	}
+	if opts.Startup != nil {
+		chain = append(chain, opts.Startup.Middleware)
+	}
+	chain = append(chain, deadline.Middleware(opts.RequestBudget))
+	if opts.Tokens != nil {
+		chain = append(chain, middleware.Auth(opts.Tokens, opts.PublicPaths...))
+	}
+	if opts.RateLimit != nil {
+		chain = append(chain, opts.RateLimit.Middleware)
+	}
+	if opts.Capture != nil {
+		chain = append(chain, opts.Capture.Middleware)
+	}
+
+	root := http.NewServeMux()
+	root.Handle("/metrics", metrics)
+	// Liveness says the process serves; readiness that it can do its job
+	root.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Status string `json:"status"`
+			Build  string `json:"build"`
+		}{"ok", buildinfo.Get().Short()})
+	})
+	root.Handle("/version", versionHandler(opts))
+	if opts.Startup != nil {
+		root.Handle("/readyz", opts.Startup)
+	} else {
+		root.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		})
+	}
+	admin := middleware.Chain(append(slices.Clone(chain), middleware.RequireRole("admin"))...)
+	root.Handle("/admin/logging", admin(middleware.Logs()))
+	if opts.Startup != nil && opts.SelfTest {
+		root.Handle("/internal/selftest", admin(http.HandlerFunc(opts.Startup.ServeSelfTest)))
+	}
+	if opts.Capture != nil {
+		root.Handle("/admin/capture", admin(opts.Capture))
+	}
+	if opts.Maintenance != nil {
+		root.Handle("/admin/maintenance", admin(opts.Maintenance))
+		chain = append(chain, opts.Maintenance.Middleware)
+	}
+	if opts.Workflows != nil {
+		root.Handle("/admin/workflows/", admin(opts.Workflows))
+		metrics.Register(opts.Workflows)
+	}
+	if opts.Alerts != nil {
+		metrics.Register(opts.Alerts)
+	}
+	if opts.Limits != nil {
+		metrics.Register(opts.Limits)
+	}
+	chain = append(chain, opts.Middleware...)
+	root.Handle("/", middleware.Chain(chain...)(handler))
+
+	srv := &http.Server{Addr: opts.Addr, Handler: root, Protocols: opts.HTTP2.ServerProtocols()}
+	if opts.Conns != nil {
+		srv.ConnState = opts.Conns.ConnState
+		metrics.Register(opts.Conns)
+	}
+	return &Server{
+		opts:    opts,
+		http:    srv,
+		Metrics: metrics,
+	}
+}
+
+// Run serves until SIGINT or SIGTERM, then shuts down gracefully. It fails
+// if Startup gives up on the service's dependencies.
+func (s *Server) Run() error {
+	errc := make(chan error, 2)
+	go func() {
+		log.Printf("%s starting on %s", s.opts.Name, s.opts.Addr)
+		var err error
+		if s.opts.HTTP2.ServesTLS() {
+			err = s.http.ListenAndServeTLS(s.opts.HTTP2.CertFile, s.opts.HTTP2.KeyFile)
+		} else {
+			err = s.http.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errc <- err
+		}
+	}()
+	if s.opts.Startup != nil {
+		startCtx, stopStartup := context.WithCancel(context.Background())
+		defer stopStartup()
+		go func() {
+			if err := s.opts.Startup.Run(startCtx); err != nil {
+				if startCtx.Err() == nil {
+					errc <- err
+				}
+				return
+			}
+			log.Printf("%s ready", s.opts.Name)
+		}()
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(quit)
+	defer handleLogSignals()()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-quit:
+	}
+
+	log.Printf("Shutting down %s...", s.opts.Name)
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Printf("%s stopped", s.opts.Name)
+	return nil
+}
+
+// versionHandler answers /version with the build and the features the
+// server and service have switched on
+func versionHandler(opts Options) http.Handler {
+	features := slices.Clone(opts.Features)
+	if opts.Tokens != nil {
+		features = append(features, "auth")
+	}
+	if opts.RateLimit != nil {
+		features = append(features, "rate_limit")
+	}
+	if opts.MaxInFlight > 0 || (opts.MaxPoolWait > 0 && opts.PoolStats != nil) {
+		features = append(features, "load_shedding")
+	}
+	if opts.Limits != nil {
+		features = append(features, "route_limits")
+	}
+	if opts.Degradation != nil {
+		features = append(features, "degradation")
+	}
+	if opts.HTTP2.ServesTLS() {
+		features = append(features, "tls")
+	}
+	if opts.Capture != nil {
+		features = append(features, "capture")
+	}
+	if opts.Workflows != nil {
+		features = append(features, "workflows")
+	}
+	if opts.SelfTest && opts.Startup != nil {
+		features = append(features, "selftest")
+	}
+	slices.Sort(features)
+	body := struct {
+		Service string `json:"service"`
+		buildinfo.Info
+		Features []string `json:"features"`
+	}{opts.Name, buildinfo.Get(), slices.Compact(features)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(body)
+	})
+}
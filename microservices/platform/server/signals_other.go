@@ -0,0 +1,8 @@
+//go:build !unix
+
+package server
+
+// handleLogSignals does nothing where there are no SIGUSR1 and SIGUSR2
+func handleLogSignals() (stop func()) {
+	return func() {}
+}
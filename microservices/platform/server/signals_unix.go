@@ -0,0 +1,39 @@
+//go:build unix
+
+package server
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"platform/middleware"
+)
+
+// handleLogSignals turns debug logging on and off on SIGUSR1 and resets
+// logging on SIGUSR2, until the returned func is called
+func handleLogSignals() (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGUSR1 {
+					log.Printf("log level %s", middleware.Logs().ToggleDebug())
+				} else {
+					middleware.Logs().Reset()
+					log.Print("logging reset")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,235 @@
+// Package signing authenticates service-to-service calls with HMAC request
+// signatures, so a service can verify which peer sent a request. Keys carry
+// IDs for rotation: sign with the newest key, accept any key still listed.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/clock"
+)
+
+const (
+	HeaderKeyID     = "X-Signature-Key-Id"
+	HeaderTimestamp = "X-Signature-Timestamp"
+	HeaderCaller    = "X-Signature-Caller"
+	HeaderNonce     = "X-Signature-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrClockSkew    = errors.New("signature timestamp outside tolerance")
+	ErrBadSignature = errors.New("invalid request signature")
+	ErrReplayed     = errors.New("request signature already used")
+)
+
+// MaxBody is the largest body Require reads to check a signature
+const MaxBody = 1 << 20
+
+type key struct {
+	id     string
+	secret []byte
+}
+
+// Keyring holds signing keys; the first key is the active one. It also
+// remembers the nonces of the requests it accepted until their timestamp
+// falls out of the skew window, so a captured request can't be sent again.
+// That memory is per process: each replica only refuses replays of what it
+// has seen.
+type Keyring struct {
+	keys  []key
+	clock clock.Clock
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	nextPrune time.Time
+}
+
+// ParseKeyring reads "id:secret" pairs separated by commas, newest first,
+// e.g. "k2:newsecret,k1:oldsecret" while rotating from k1 to k2
+func ParseKeyring(spec string) (*Keyring, error) {
+	kr := &Keyring{clock: clock.System, seen: make(map[string]time.Time)}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid signing key %q", id)
+		}
+		kr.keys = append(kr.keys, key{id: id, secret: []byte(secret)})
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) lookup(id string) ([]byte, bool) {
+	for _, k := range kr.keys {
+		if k.id == id {
+			return k.secret, true
+		}
+	}
+	return nil, false
+}
+
+// canonical is what gets signed: method, path and query, timestamp, caller,
+// nonce and a hash of the body
+func canonical(r *http.Request, timestamp, caller, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		timestamp,
+		caller,
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\n"))
+}
+
+func mac(secret, msg []byte) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write(msg)
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+// readBody drains and restores a request body
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// Sign adds signature headers to an outgoing request from caller
+func (kr *Keyring) Sign(r *http.Request, caller string) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	active := kr.keys[0]
+	timestamp := strconv.FormatInt(kr.clock.Now().Unix(), 10)
+	n := make([]byte, 16)
+	rand.Read(n)
+	nonce := hex.EncodeToString(n)
+
+	r.Header.Set(HeaderKeyID, active.id)
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderCaller, caller)
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderSignature, mac(active.secret, canonical(r, timestamp, caller, nonce, body)))
+	return nil
+}
+
+// Verify checks a request's signature and returns the calling service; a
+// nonce it already accepted from the same key is ErrReplayed. It reads the whole body,
+// which callers bound, as Require does with MaxBody.
+func (kr *Keyring) Verify(r *http.Request, skew time.Duration) (string, error) {
+	keyID := r.Header.Get(HeaderKeyID)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	caller := r.Header.Get(HeaderCaller)
+	nonce := r.Header.Get(HeaderNonce)
+	signature := r.Header.Get(HeaderSignature)
+	if keyID == "" || timestamp == "" || caller == "" || nonce == "" || signature == "" {
+		return "", ErrUnsigned
+	}
+
+	secret, ok := kr.lookup(keyID)
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	now := kr.clock.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > skew || d < -skew {
+		return "", ErrClockSkew
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return "", err
+	}
+	expected := mac(secret, canonical(r, timestamp, caller, nonce, body))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", ErrBadSignature
+	}
+	if !kr.remember(keyID+"\x00"+nonce, time.Unix(ts, 0).Add(skew), now) {
+		return "", ErrReplayed
+	}
+	return caller, nil
+}
+
+// remember records an accepted key ID and nonce until expires, reporting
+// false when they were already seen
+func (kr *Keyring) remember(nonce string, expires, now time.Time) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if now.After(kr.nextPrune) {
+		for n, exp := range kr.seen {
+			if now.After(exp) {
+				delete(kr.seen, n)
+			}
+		}
+		kr.nextPrune = now.Add(time.Minute)
+	}
+	if exp, ok := kr.seen[nonce]; ok && !now.After(exp) {
+		return false
+	}
+	kr.seen[nonce] = expires
+	return true
+}
+
+// Require only lets through requests signed by one of the allowed callers
+func Require(kr *Keyring, skew time.Duration, callers ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, MaxBody)
+			}
+			caller, err := kr.Verify(r, skew)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if len(callers) > 0 && !slices.Contains(callers, caller) {
+				http.Error(w, fmt.Sprintf("caller %s may not call this endpoint", caller), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
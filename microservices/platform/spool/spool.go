@@ -0,0 +1,195 @@
+// Package spool keeps work a service accepted but couldn't carry out yet —
+// writes that arrived while its database was down — in files on local
+// disk, and hands it back in the order it came once the work can be done.
+//
+// Each entry is a file of its own, synced and renamed into place before
+// Put returns, so an entry survives a crash whole or not at all, and is
+// removed only once it has been carried out. Entries live on the replica
+// that took them; one whose disk is lost loses its entries with it.
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrFull means the spool holds as many entries as it may
+var ErrFull = errors.New("spool is full")
+
+// Spool is a directory of pending entries
+type Spool struct {
+	name string
+	dir  string
+	max  int
+
+	// drain is held while entries are handed back, so they're done one
+	// at a time and in order
+	drain sync.Mutex
+
+	mu       sync.Mutex
+	next     uint64
+	pending  int
+	spooled  int64
+	drained  int64
+	rejected int64
+}
+
+// Open uses dir, creating it if need be, for name's entries and takes up
+// to max of them; entries left by an earlier run are kept
+func Open(name, dir string, max int) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &Spool{name: name, dir: dir, max: max}
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+	s.pending = len(entries)
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		seq, _ := strconv.ParseUint(strings.TrimSuffix(last, ".json"), 10, 64)
+		s.next = seq + 1
+	}
+	return s, nil
+}
+
+// entries are the entry files, oldest first
+func (s *Spool) entries() ([]string, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	// Names are zero-padded sequence numbers, so they sort in order
+	sort.Strings(names)
+	return names, nil
+}
+
+// Put stores v, returning the entry's ID once it's on disk
+func (s *Spool) Put(v any) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	if s.pending >= s.max {
+		s.rejected++
+		s.mu.Unlock()
+		return "", ErrFull
+	}
+	seq := s.next
+	s.next++
+	s.pending++
+	s.mu.Unlock()
+
+	id := fmt.Sprintf("%020d", seq)
+	if err := s.write(id, raw); err != nil {
+		s.mu.Lock()
+		s.pending--
+		s.mu.Unlock()
+		return "", err
+	}
+	s.mu.Lock()
+	s.spooled++
+	s.mu.Unlock()
+	return id, nil
+}
+
+func (s *Spool) write(id string, raw []byte) error {
+	tmp, err := os.CreateTemp(s.dir, "."+id+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, id+".json")); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory is
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Len is how many entries are waiting
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Drain hands the entries to fn, oldest first, removing each one fn
+// carries out. It stops at the first error, leaving that entry and the
+// ones after it for the next Drain, and returns how many were done.
+// Entries fn can never carry out are fn's to deal with, e.g. by logging
+// them and returning nil.
+func (s *Spool) Drain(fn func(id string, raw json.RawMessage) error) (int, error) {
+	s.drain.Lock()
+	defer s.drain.Unlock()
+
+	names, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+	done := 0
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return done, err
+		}
+		if err := fn(strings.TrimSuffix(name, ".json"), raw); err != nil {
+			return done, err
+		}
+		if err := os.Remove(path); err != nil {
+			return done, err
+		}
+		done++
+		s.mu.Lock()
+		s.pending--
+		s.drained++
+		s.mu.Unlock()
+	}
+	return done, nil
+}
+
+func (s *Spool) WriteMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(w, "# TYPE spool_pending gauge")
+	fmt.Fprintf(w, "spool_pending{spool=%q} %d\n", s.name, s.pending)
+	fmt.Fprintln(w, "# TYPE spool_spooled_total counter")
+	fmt.Fprintf(w, "spool_spooled_total{spool=%q} %d\n", s.name, s.spooled)
+	fmt.Fprintln(w, "# TYPE spool_drained_total counter")
+	fmt.Fprintf(w, "spool_drained_total{spool=%q} %d\n", s.name, s.drained)
+	fmt.Fprintln(w, "# TYPE spool_rejected_total counter")
+	fmt.Fprintf(w, "spool_rejected_total{spool=%q} %d\n", s.name, s.rejected)
+}
@@ -0,0 +1,352 @@
+// Package startup holds a service back from taking traffic until its
+// dependencies (database, broker, required downstreams) answer, retrying
+// each with backoff instead of exiting on the first failure. /readyz reports
+// each dependency's state; a service whose required dependencies are still
+// down after the startup timeout gives up so its supervisor can restart it.
+// Once running, the same dependencies back the self-test deploy pipelines
+// run at /internal/selftest.
+package startup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"platform/buildinfo"
+)
+
+const (
+	minBackoff = 200 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// Check reports whether a dependency is usable
+type Check func(ctx context.Context) error
+
+type Dependency struct {
+	Name  string
+	Check Check
+	// SelfTest is what the self-test runs instead of Check, for
+	// dependencies whose Check does more than look, e.g. migrating the
+	// database; nil runs Check
+	SelfTest Check
+	// Optional dependencies are reported but don't hold up readiness
+	Optional bool
+}
+
+// Status is a dependency's state as /readyz shows it
+type Status struct {
+	Name     string     `json:"name"`
+	Ready    bool       `json:"ready"`
+	Optional bool       `json:"optional,omitempty"`
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+type Startup struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	deps   []Dependency
+	status []Status
+	ready  chan struct{}
+}
+
+// New waits up to timeout for the required dependencies; zero waits forever
+func New(timeout time.Duration, deps ...Dependency) *Startup {
+	s := &Startup{timeout: timeout, ready: make(chan struct{})}
+	for _, d := range deps {
+		s.Add(d)
+	}
+	return s
+}
+
+// FromEnv reads the timeout from STARTUP_TIMEOUT, two minutes by default
+func FromEnv(deps ...Dependency) (*Startup, error) {
+	timeout := 2 * time.Minute
+	if v := os.Getenv("STARTUP_TIMEOUT"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid STARTUP_TIMEOUT %q", v)
+		}
+	}
+	return New(timeout, deps...), nil
+}
+
+// Add registers a dependency; call it before Run
+func (s *Startup) Add(d Dependency) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deps = append(s.deps, d)
+	s.status = append(s.status, Status{Name: d.Name, Optional: d.Optional})
+}
+
+// Run checks every dependency side by side until it answers, marking the
+// service ready once the required ones have. It fails if they haven't
+// within the timeout; optional ones keep being retried until ctx is done.
+func (s *Startup) Run(ctx context.Context) error {
+	s.mu.Lock()
+	deps := slices.Clone(s.deps)
+	s.mu.Unlock()
+
+	required := make(chan struct{}, len(deps))
+	pending := 0
+	for i, d := range deps {
+		if !d.Optional {
+			pending++
+		}
+		go func() {
+			s.wait(ctx, i, d)
+			if !d.Optional && ctx.Err() == nil {
+				required <- struct{}{}
+			}
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for pending > 0 {
+		select {
+		case <-required:
+			pending--
+		case <-timeout:
+			return fmt.Errorf("dependencies not ready after %s: %v", s.timeout, s.waitingOn())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	close(s.ready)
+	return nil
+}
+
+// wait retries one dependency with jittered exponential backoff
+func (s *Startup) wait(ctx context.Context, i int, d Dependency) {
+	backoff := minBackoff
+	for {
+		err := d.Check(ctx)
+		now := time.Now()
+		s.mu.Lock()
+		st := &s.status[i]
+		st.Attempts++
+		if err == nil {
+			st.Ready, st.Error, st.Since = true, "", &now
+		} else {
+			st.Error = err.Error()
+		}
+		s.mu.Unlock()
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-time.After(backoff/2 + rand.N(backoff/2)):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (s *Startup) waitingOn() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, st := range s.status {
+		if !st.Ready && !st.Optional {
+			names = append(names, st.Name)
+		}
+	}
+	return names
+}
+
+// Ready is closed once the required dependencies have answered
+func (s *Startup) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Startup) IsReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// ServeHTTP answers /readyz: 200 once ready, 503 before, with each
+// dependency's status either way
+func (s *Startup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := append([]Status{}, s.status...)
+	s.mu.Unlock()
+
+	ready := s.IsReady()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Ready        bool     `json:"ready"`
+		Build        string   `json:"build"`
+		Dependencies []Status `json:"dependencies"`
+	}{ready, buildinfo.Get().Short(), status})
+}
+
+// Middleware turns requests away with 503 until the service is ready
+func (s *Startup) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.IsReady() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "service starting", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// selfTestTimeout bounds the whole self-test
+const selfTestTimeout = 10 * time.Second
+
+// Result is how one dependency fared in a self-test
+type Result struct {
+	Name       string  `json:"name"`
+	Pass       bool    `json:"pass"`
+	Optional   bool    `json:"optional,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Report is a self-test's outcome. It passes only if every dependency
+// does: optional ones don't hold up readiness, but a deploy that can't
+// reach them is still worth failing.
+type Report struct {
+	Pass       bool      `json:"pass"`
+	Build      string    `json:"build"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS float64   `json:"duration_ms"`
+	Checks     []Result  `json:"checks"`
+}
+
+func since(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// SelfTest checks every dependency once, now, side by side
+func (s *Startup) SelfTest(ctx context.Context) Report {
+	s.mu.Lock()
+	deps := slices.Clone(s.deps)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	start := time.Now()
+	report := Report{Pass: true, Build: buildinfo.Get().Short(), StartedAt: start.UTC(), Checks: make([]Result, len(deps))}
+	var wg sync.WaitGroup
+	for i, d := range deps {
+		check := d.SelfTest
+		if check == nil {
+			check = d.Check
+		}
+		wg.Go(func() {
+			begun := time.Now()
+			err := check(ctx)
+			r := Result{Name: d.Name, Pass: err == nil, Optional: d.Optional, DurationMS: since(begun)}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			report.Checks[i] = r
+		})
+	}
+	wg.Wait()
+	for _, r := range report.Checks {
+		report.Pass = report.Pass && r.Pass
+	}
+	report.DurationMS = since(start)
+	return report
+}
+
+// ServeSelfTest answers /internal/selftest: 200 when every dependency
+// passed, 503 when one didn't, with the report either way
+func (s *Startup) ServeSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := s.SelfTest(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Pass {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// SQL checks that the database answers a query, a full round trip where
+// a ping may be answered by the pool
+func SQL(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		var one int
+		return db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	}
+}
+
+// HTTP checks that GET url answers 2xx, e.g. a downstream's /healthz
+func HTTP(url string) Check {
+	client := &http.Client{Timeout: 2 * time.Second}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// Reachable checks that the host of rawURL accepts TCP connections, for
+// dependencies with no health endpoint such as the event collector
+func Reachable(rawURL string) Check {
+	return func(ctx context.Context) error {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+		d := net.Dialer{Timeout: 2 * time.Second}
+		conn, err := d.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,229 @@
+// Package transport sets the HTTP versions spoken between the gateway and
+// the services. HTTP/2 lets the gateway multiplex many concurrent requests
+// over a few connections: over TLS it is negotiated as usual, and inside a
+// trusted network it can run in cleartext (h2c, with prior knowledge).
+// Conns counts the connections either way for /metrics, and a Warmer keeps
+// the connections on a hot path ready.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mode is which HTTP versions servers accept and the gateway speaks
+type Mode string
+
+const (
+	// TLS negotiates HTTP/2 on TLS connections and speaks HTTP/1.1 on
+	// cleartext ones, Go's default
+	TLS Mode = "tls"
+	// H2C also speaks HTTP/2 on cleartext connections. Servers still
+	// accept HTTP/1.1, so turn it on for the services before the gateway,
+	// which then only speaks HTTP/2 to them.
+	H2C Mode = "h2c"
+	// Off is HTTP/1.1 only
+	Off Mode = "off"
+)
+
+type Config struct {
+	Mode Mode
+	// CertFile and KeyFile make servers listen with TLS
+	CertFile, KeyFile string
+	// CAFile verifies the services' certificates; empty uses the system's
+	CAFile string
+}
+
+// FromEnv reads HTTP2 (tls, the default, h2c or off), TLS_CERT_FILE,
+// TLS_KEY_FILE and UPSTREAM_CA_FILE
+func FromEnv() (Config, error) {
+	c := Config{
+		Mode:     Mode(os.Getenv("HTTP2")),
+		CertFile: os.Getenv("TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("TLS_KEY_FILE"),
+		CAFile:   os.Getenv("UPSTREAM_CA_FILE"),
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = TLS
+	case TLS, H2C, Off:
+	default:
+		return c, fmt.Errorf("invalid HTTP2 %q", c.Mode)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return c, errors.New("TLS_CERT_FILE and TLS_KEY_FILE go together")
+	}
+	return c, nil
+}
+
+// ServesTLS reports whether servers listen with TLS
+func (c Config) ServesTLS() bool {
+	return c.CertFile != ""
+}
+
+// ServerProtocols are the versions a server accepts
+func (c Config) ServerProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	switch c.Mode {
+	case H2C:
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	case TLS, "":
+		p.SetHTTP2(true)
+	}
+	return p
+}
+
+// Transport is a client to the services, the gateway's or another
+// service's. In H2C mode it speaks HTTP/2 only, on http:// and https://
+// alike.
+func (c Config) Transport(conns *Conns) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Protocols = new(http.Protocols)
+	switch c.Mode {
+	case H2C:
+		t.Protocols.SetUnencryptedHTTP2(true)
+		t.Protocols.SetHTTP2(true)
+	case Off:
+		t.Protocols.SetHTTP1(true)
+	default:
+		t.Protocols.SetHTTP1(true)
+		t.Protocols.SetHTTP2(true)
+	}
+	// With every request on a few connections, notice a dead one quickly
+	t.HTTP2 = &http.HTTP2Config{SendPingTimeout: 30 * time.Second, PingTimeout: 15 * time.Second}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	if conns != nil {
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			conns.dialed()
+			return &countedConn{Conn: conn, conns: conns}, nil
+		}
+	}
+	return t, nil
+}
+
+// Conns counts the connections a service accepts and the gateway opens,
+// and the gateway's requests by protocol version
+type Conns struct {
+	service string
+
+	mu           sync.Mutex
+	serverOpen   int64
+	serverTotal  uint64
+	clientOpen   int64
+	clientTotal  uint64
+	clientByProt map[string]uint64
+}
+
+func NewConns(service string) *Conns {
+	return &Conns{service: service, clientByProt: make(map[string]uint64)}
+}
+
+// ConnState is an http.Server's ConnState hook
+func (c *Conns) ConnState(_ net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		c.serverOpen++
+		c.serverTotal++
+	case http.StateClosed, http.StateHijacked:
+		c.serverOpen--
+	}
+}
+
+func (c *Conns) dialed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clientOpen++
+	c.clientTotal++
+}
+
+// Count wraps a client's RoundTripper to count its requests by the
+// protocol version they were answered in
+func (c *Conns) Count(next http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err == nil {
+			c.mu.Lock()
+			c.clientByProt[resp.Proto]++
+			c.mu.Unlock()
+		}
+		return resp, err
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type countedConn struct {
+	net.Conn
+	conns *Conns
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.conns.mu.Lock()
+		c.conns.clientOpen--
+		c.conns.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *Conns) WriteMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintln(w, "# TYPE http_server_connections_open gauge")
+	fmt.Fprintf(w, "http_server_connections_open{service=%q} %d\n", c.service, c.serverOpen)
+	fmt.Fprintln(w, "# TYPE http_server_connections_total counter")
+	fmt.Fprintf(w, "http_server_connections_total{service=%q} %d\n", c.service, c.serverTotal)
+	if c.clientTotal == 0 && len(c.clientByProt) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# TYPE http_client_connections_open gauge")
+	fmt.Fprintf(w, "http_client_connections_open{service=%q} %d\n", c.service, c.clientOpen)
+	fmt.Fprintln(w, "# TYPE http_client_connections_total counter")
+	fmt.Fprintf(w, "http_client_connections_total{service=%q} %d\n", c.service, c.clientTotal)
+
+	protos := make([]string, 0, len(c.clientByProt))
+	for p := range c.clientByProt {
+		protos = append(protos, p)
+	}
+	sort.Strings(protos)
+	fmt.Fprintln(w, "# TYPE http_client_requests_total counter")
+	for _, p := range protos {
+		fmt.Fprintf(w, "http_client_requests_total{service=%q,protocol=%q} %d\n", c.service, p, c.clientByProt[p])
+	}
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Warmer keeps connections to the services a hot path calls open and
+// recently used, so the first call after a quiet spell doesn't pay for the
+// TCP and TLS handshakes, or find its idle connection closed by the peer
+type Warmer struct {
+	client *http.Client
+	urls   []string
+	conns  int
+}
+
+// NewWarmer exercises conns connections to each of urls, cheap endpoints
+// such as /healthz, through t. t must keep at least conns idle connections
+// per host, and keep them longer than the interval Run is given.
+func NewWarmer(t http.RoundTripper, conns int, urls ...string) *Warmer {
+	return &Warmer{client: &http.Client{Transport: t, Timeout: 5 * time.Second}, urls: urls, conns: max(conns, 1)}
+}
+
+// Warm sends conns requests to each URL at once: the transport opens what
+// it lacks, and every idle connection gets used.
+func (w *Warmer) Warm(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, url := range w.urls {
+		for range w.conns {
+			wg.Go(func() {
+				if err := w.ping(ctx, url); err != nil && ctx.Err() == nil {
+					log.Printf("keep warm %s: %v", url, err)
+				}
+			})
+		}
+	}
+	wg.Wait()
+}
+
+func (w *Warmer) ping(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Read to the end so the connection goes back to the pool
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// Run warms now and every interval until ctx is done
+func (w *Warmer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.Warm(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Package workflow watches the sagas and other multi-step workflows a
+// service runs for ones stuck in an intermediate state, such as an order
+// awaiting payment confirmation for longer than anyone would take to
+// confirm it. Each kind of workflow has an SLA for how long it may sit in
+// such a state; the watchdog alerts with a workflow.stuck event once one
+// is past it, and again, critical, once it is past it Escalation times
+// over. A kind with a workflow gone critical, or with Spike of them stuck
+// at once, is also raised with the service's alerter, critical for a
+// spike. Admins list what is stuck at /admin/workflows/stuck and resume
+// or abort a workflow at /admin/workflows/{kind}/{id}/resume and /abort.
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/alert"
+	"platform/clock"
+	"platform/events"
+)
+
+// Escalation is how many SLAs over a workflow turns critical
+const Escalation = 4
+
+// defaultSpike is how many workflows of a kind stuck at once page someone
+const defaultSpike = 10
+
+// Alert levels
+const (
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// Actions on a stuck workflow
+const (
+	Resume = "resume"
+	Abort  = "abort"
+)
+
+// done names what an action did, for messages and event types
+var done = map[string]string{Resume: "resumed", Abort: "aborted"}
+
+var (
+	ErrNotFound = errors.New("workflow not found")
+	// ErrNotStuck is an action on a workflow that has moved on, or that
+	// isn't in a state the action applies to
+	ErrNotStuck = errors.New("workflow is not stuck")
+)
+
+// Workflow is one workflow in an intermediate state
+type Workflow struct {
+	Kind  string `json:"kind"`
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// Since is when it entered State, or as near as its service knows
+	Since time.Time `json:"since"`
+	// Detail is what its service knows of why, e.g. the last error
+	Detail string `json:"detail,omitempty"`
+}
+
+// Source is one kind of workflow a service runs
+type Source struct {
+	Kind string
+	// Subject is the kind of the events' subject, e.g. order for order/42
+	Subject string
+	// SLA is how long a workflow may stay in an intermediate state
+	SLA time.Duration
+	// Find returns the workflows in an intermediate state since before
+	Find func(ctx context.Context, before time.Time) ([]Workflow, error)
+	// Resume carries a workflow on, Abort gives it up and undoes what it
+	// did; either is nil when the kind doesn't allow it
+	Resume, Abort func(ctx context.Context, id string) error
+}
+
+// Stuck is a workflow past its SLA
+type Stuck struct {
+	Workflow
+	Subject  string   `json:"subject"`
+	SLA      string   `json:"sla"`
+	StuckFor string   `json:"stuck_for"`
+	Level    string   `json:"level"`
+	Actions  []string `json:"actions"`
+}
+
+// Watchdog finds the stuck workflows of the sources added to it
+type Watchdog struct {
+	events  *events.Emitter
+	alerter *alert.Alerter
+	clock   clock.Clock
+	// spike is how many stuck workflows of a kind make a critical alert
+	spike int
+	// slas override the SLAs sources are added with, by kind
+	slas map[string]time.Duration
+
+	mu      sync.Mutex
+	sources []*Source
+	// alerted is the level each stuck workflow was last alerted at
+	alerted map[string]string
+	stuck   map[string]int
+	alerts  map[[2]string]int64
+	actions map[[3]string]int64
+}
+
+func New(emitter *events.Emitter, alerts *alert.Alerter) *Watchdog {
+	return &Watchdog{
+		events:  emitter,
+		alerter: alerts,
+		clock:   clock.System,
+		spike:   defaultSpike,
+		slas:    make(map[string]time.Duration),
+		alerted: make(map[string]string),
+		stuck:   make(map[string]int),
+		alerts:  make(map[[2]string]int64),
+		actions: make(map[[3]string]int64),
+	}
+}
+
+// FromEnv is New with the SLAs in WORKFLOW_SLAS, e.g.
+// "order_payment=15m,account_merge=2h", overriding those sources come with,
+// and the spike size in WORKFLOW_ALERT_SPIKE
+func FromEnv(emitter *events.Emitter, alerts *alert.Alerter) (*Watchdog, error) {
+	w := New(emitter, alerts)
+	if v := os.Getenv("WORKFLOW_ALERT_SPIKE"); v != "" {
+		spike, err := strconv.Atoi(v)
+		if err != nil || spike < 1 {
+			return nil, fmt.Errorf("invalid WORKFLOW_ALERT_SPIKE %q", v)
+		}
+		w.spike = spike
+	}
+	spec := os.Getenv("WORKFLOW_SLAS")
+	if spec == "" {
+		return w, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kind, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		sla, err := time.ParseDuration(v)
+		if !ok || kind == "" || err != nil || sla <= 0 {
+			return nil, fmt.Errorf("invalid WORKFLOW_SLAS entry %q", pair)
+		}
+		w.slas[kind] = sla
+	}
+	return w, nil
+}
+
+// Add watches another kind of workflow
+func (w *Watchdog) Add(s Source) {
+	if sla, ok := w.slas[s.Kind]; ok {
+		s.SLA = sla
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sources = append(w.sources, &s)
+}
+
+func (w *Watchdog) source(kind string) *Source {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.sources {
+		if s.Kind == kind {
+			return s
+		}
+	}
+	return nil
+}
+
+// Stuck returns the workflows past their SLA, of one kind or, for "", of
+// every kind, longest stuck first
+func (w *Watchdog) Stuck(ctx context.Context, kind string) ([]Stuck, error) {
+	w.mu.Lock()
+	sources := slices.Clone(w.sources)
+	w.mu.Unlock()
+
+	now := w.clock.Now()
+	var stuck []Stuck
+	for _, s := range sources {
+		if kind != "" && s.Kind != kind {
+			continue
+		}
+		found, err := s.Find(ctx, now.Add(-s.SLA))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Kind, err)
+		}
+		actions := []string{}
+		if s.Resume != nil {
+			actions = append(actions, Resume)
+		}
+		if s.Abort != nil {
+			actions = append(actions, Abort)
+		}
+		for _, wf := range found {
+			wf.Kind = s.Kind
+			level := Warning
+			if now.Sub(wf.Since) >= Escalation*s.SLA {
+				level = Critical
+			}
+			stuck = append(stuck, Stuck{
+				Workflow: wf,
+				Subject:  s.Subject + "/" + wf.ID,
+				SLA:      s.SLA.String(),
+				StuckFor: now.Sub(wf.Since).Round(time.Second).String(),
+				Level:    level,
+				Actions:  actions,
+			})
+		}
+	}
+	slices.SortFunc(stuck, func(a, b Stuck) int { return a.Since.Compare(b.Since) })
+	return stuck, nil
+}
+
+// Run looks for stuck workflows every interval, alerting about each one
+// once when it is past its SLA and once more when it turns critical
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watchdog) check(ctx context.Context) {
+	stuck, err := w.Stuck(ctx, "")
+	if err != nil {
+		log.Printf("stuck workflows: %v", err)
+		return
+	}
+	var fresh []Stuck
+	critical := make(map[string]int)
+	w.mu.Lock()
+	alerted := make(map[string]string, len(stuck))
+	clear(w.stuck)
+	for _, s := range stuck {
+		key := s.Kind + "/" + s.ID
+		w.stuck[s.Kind]++
+		if s.Level == Critical {
+			critical[s.Kind]++
+		}
+		if previous := w.alerted[key]; previous != s.Level && previous != Critical {
+			fresh = append(fresh, s)
+			w.alerts[[2]string{s.Kind, s.Level}]++
+		}
+		alerted[key] = s.Level
+	}
+	// Workflows that moved on are forgotten, to be alerted about anew
+	w.alerted = alerted
+	counts := make(map[string]int, len(w.sources))
+	for _, s := range w.sources {
+		counts[s.Kind] = w.stuck[s.Kind]
+	}
+	w.mu.Unlock()
+
+	for _, s := range fresh {
+		log.Printf("workflow %s %s stuck %s for %s (%s)", s.Kind, s.ID, s.State, s.StuckFor, s.Level)
+		w.events.Emit(ctx, "workflow.stuck", s.Subject, s)
+	}
+	for kind, n := range counts {
+		key := "workflow/" + kind
+		severity := alert.Warning
+		switch {
+		case n >= w.spike:
+			severity = alert.Critical
+		case critical[kind] == 0:
+			w.alerter.Resolve(ctx, key)
+			continue
+		}
+		w.alerter.Alert(ctx, alert.Alert{
+			Key:      key,
+			Severity: severity,
+			Summary:  fmt.Sprintf("%d %s workflows stuck, %d of them critical", n, kind, critical[kind]),
+			Details:  map[string]string{"kind": kind, "stuck": strconv.Itoa(n), "critical": strconv.Itoa(critical[kind])},
+		})
+	}
+}
+
+// act runs the action on the workflow, counting the outcome of those it
+// applied to
+func (w *Watchdog) act(ctx context.Context, kind, id, action string) error {
+	s := w.source(kind)
+	if s == nil {
+		return ErrNotFound
+	}
+	fn := s.Resume
+	if action == Abort {
+		fn = s.Abort
+	}
+	if fn == nil {
+		return fmt.Errorf("%s workflows can't be %s: %w", kind, done[action], ErrNotStuck)
+	}
+	err := fn(ctx, id)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrNotStuck) {
+		return err
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "failed"
+	}
+	w.mu.Lock()
+	w.actions[[3]string{kind, action, outcome}]++
+	w.mu.Unlock()
+	if err == nil {
+		w.events.Emit(ctx, "workflow."+done[action], s.Subject+"/"+id,
+			map[string]string{"kind": kind, "id": id})
+	}
+	return err
+}
+
+type actionResult struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// ServeHTTP serves GET /admin/workflows/stuck, optionally ?kind=, and
+// POST /admin/workflows/{kind}/{id}/resume and /abort
+func (w *Watchdog) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/workflows"), "/")
+	if path == "stuck" {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", "GET")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stuck, err := w.Stuck(r.Context(), r.URL.Query().Get("kind"))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if stuck == nil {
+			stuck = []Stuck{}
+		}
+		writeJSON(rw, http.StatusOK, stuck)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || (parts[2] != Resume && parts[2] != Abort) {
+		http.NotFound(rw, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind, id, action := parts[0], parts[1], parts[2]
+	err := w.act(context.WithoutCancel(r.Context()), kind, id, action)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotStuck):
+		http.Error(rw, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+	default:
+		writeJSON(rw, http.StatusOK, actionResult{Kind: kind, ID: id, Action: action})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (w *Watchdog) WriteMetrics(out io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintln(out, "# TYPE workflow_stuck gauge")
+	for _, s := range w.sources {
+		fmt.Fprintf(out, "workflow_stuck{kind=%q} %d\n", s.Kind, w.stuck[s.Kind])
+	}
+	fmt.Fprintln(out, "# TYPE workflow_alerts_total counter")
+	for _, s := range w.sources {
+		for _, level := range []string{Warning, Critical} {
+			fmt.Fprintf(out, "workflow_alerts_total{kind=%q,level=%q} %d\n", s.Kind, level, w.alerts[[2]string{s.Kind, level}])
+		}
+	}
+	fmt.Fprintln(out, "# TYPE workflow_actions_total counter")
+	for _, s := range w.sources {
+		for _, action := range []string{Resume, Abort} {
+			for _, outcome := range []string{"ok", "failed"} {
+				fmt.Fprintf(out, "workflow_actions_total{kind=%q,action=%q,outcome=%q} %d\n",
+					s.Kind, action, outcome, w.actions[[3]string{s.Kind, action, outcome}])
+			}
+		}
+	}
+}
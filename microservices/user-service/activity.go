@@ -0,0 +1,256 @@
+// user-service/activity.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Activity types; there are no password changes or user API keys to
+// record yet
+const (
+	activityAccountCreated = "account_created"
+	activityLogin          = "login"
+	activityLoginFailed    = "login_failed"
+	// A login from a new device waiting for the code emailed for it
+	activityLoginChallenged = "login_challenged"
+	activityProfileUpdated  = "profile_updated"
+	activityImpersonation   = "impersonation"
+)
+
+const (
+	defaultActivityPage = 20
+	maxActivityPage     = 100
+)
+
+// Activity is a security-relevant event on a user's account
+type Activity struct {
+	ID     int64  `json:"id"`
+	UserID int    `json:"user_id"`
+	Type   string `json:"type"`
+	// Actor is who acted when it wasn't the user: an admin, or support for
+	// the user's own view
+	Actor string `json:"actor,omitempty"`
+	// Session is the impersonation it happened in
+	Session   string `json:"session,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Device is a readable summary of UserAgent
+	Device     string         `json:"device,omitempty"`
+	Detail     map[string]any `json:"detail,omitempty"`
+	OccurredAt time.Time      `json:"occurred_at"`
+}
+
+// ActivityFilter selects a user's activity newest first; Before pages by ID
+type ActivityFilter struct {
+	UserID int
+	Before int64
+	Limit  int
+}
+
+type ActivityRepository interface {
+	RecordActivity(ctx context.Context, a *Activity) error
+	Activity(ctx context.Context, f ActivityFilter) ([]Activity, error)
+}
+
+func (r *PostgresUserRepository) RecordActivity(ctx context.Context, a *Activity) error {
+	detail, err := json.Marshal(a.Detail)
+	if err != nil {
+		return err
+	}
+	if a.Detail == nil {
+		detail = []byte("{}")
+	}
+	return r.db.QueryRowContext(ctx, `INSERT INTO account_activity (user_id, type, actor, session, ip, user_agent, detail)
+              VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		a.UserID, a.Type, a.Actor, a.Session, a.IP, a.UserAgent, detail).Scan(&a.ID, &a.OccurredAt)
+}
+
+func (r *PostgresUserRepository) Activity(ctx context.Context, f ActivityFilter) ([]Activity, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, user_id, type, actor, session, ip, user_agent, detail, created_at
+              FROM account_activity WHERE user_id = $1 AND ($2 = 0 OR id < $2)
+              ORDER BY id DESC LIMIT $3`,
+		f.UserID, f.Before, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activity []Activity
+	for rows.Next() {
+		var a Activity
+		var detail []byte
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Type, &a.Actor, &a.Session, &a.IP, &a.UserAgent,
+			&detail, &a.OccurredAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(detail, &a.Detail); err != nil {
+			return nil, err
+		}
+		if len(a.Detail) == 0 {
+			a.Detail = nil
+		}
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
+}
+
+func (r *MemoryUserRepository) RecordActivity(ctx context.Context, a *Activity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[a.UserID]; !ok {
+		return ErrNotFound
+	}
+	a.ID = int64(len(r.activity) + 1)
+	a.OccurredAt = clock.System.Now()
+	r.activity = append(r.activity, *a)
+	return nil
+}
+
+func (r *MemoryUserRepository) Activity(ctx context.Context, f ActivityFilter) ([]Activity, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var activity []Activity
+	for i := len(r.activity) - 1; i >= 0 && len(activity) < f.Limit; i-- {
+		a := r.activity[i]
+		if a.UserID != f.UserID || (f.Before != 0 && a.ID >= f.Before) {
+			continue
+		}
+		activity = append(activity, a)
+	}
+	return activity, nil
+}
+
+// ActivityLog records what is done on accounts and shows it to their users
+type ActivityLog struct {
+	repo  Repository
+	guard *LoginGuard
+}
+
+// Record adds a to its user's activity as done by r's principal from r's
+// client. Failing to is logged; what was done is done either way.
+func (l *ActivityLog) Record(r *http.Request, a Activity) {
+	a.IP, a.UserAgent = l.guard.clientIP(r), r.UserAgent()
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+		switch {
+		case p.Actor != nil:
+			a.Actor, a.Session = p.Actor.Subject, p.Actor.Session
+		case p.Subject != strconv.Itoa(a.UserID):
+			a.Actor = p.Subject
+		}
+	}
+	if err := l.repo.RecordActivity(context.WithoutCancel(r.Context()), &a); err != nil {
+		log.Printf("recording %s for user %d: %v", a.Type, a.UserID, err)
+	}
+}
+
+// List serves GET /users/{id}/activity to the user and admins, newest
+// first: before=ID, limit=N. Users see that support acted on their
+// account, but not which admin or from where.
+func (l *ActivityLog) List(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := resolveUserID(ctx, l.repo, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	p, ok := middleware.PrincipalFromContext(ctx)
+	admin := !ok || p.HasRole("admin")
+	if !admin && p.Subject != strconv.Itoa(userID) {
+		i18n.Error(w, r, http.StatusForbidden, "activity.forbidden")
+		return
+	}
+
+	q := r.URL.Query()
+	f := ActivityFilter{UserID: userID, Limit: defaultActivityPage}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		f.Before = before
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(limit, maxActivityPage)
+	}
+
+	activity, err := l.repo.Activity(ctx, f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if activity == nil {
+		activity = []Activity{}
+	}
+	for i := range activity {
+		a := &activity[i]
+		a.Device = device(a.UserAgent)
+		if a.Actor != "" && !admin {
+			a.Actor, a.IP, a.UserAgent, a.Device = "support", "", "", ""
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(activity)
+}
+
+// Checked in order: Chrome's user agent names Safari, Edge's both
+var (
+	browsers = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"},
+	}
+	systems = []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// device names the browser and system of a user agent, such as "Firefox
+// on Linux"; "" when it knows neither
+func device(userAgent string) string {
+	var browser, system string
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	}
+	return system
+}
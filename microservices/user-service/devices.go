@@ -0,0 +1,607 @@
+// user-service/devices.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/publicid"
+	"platform/router"
+)
+
+// A login challenge's code is good for a while and a few tries
+const (
+	challengeTTL      = 10 * time.Minute
+	challengeAttempts = 5
+)
+
+// KnownDevice is a device a user signed in from, on one network
+type KnownDevice struct {
+	UserID      int       `json:"-"`
+	Fingerprint string    `json:"fingerprint"`
+	Device      string    `json:"device"`
+	Network     string    `json:"network"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Ways a held back login is confirmed
+const (
+	challengeEmail = "email"
+	challengeTOTP  = "totp"
+)
+
+// LoginChallenge is a login held back until the user enters the code
+// emailed to them or, with a second factor, one from their authenticator
+type LoginChallenge struct {
+	ID     string
+	UserID int
+	Method string
+	// CodeHash is the emailed code's
+	CodeHash    string
+	Fingerprint string
+	Network     string
+	Device      string
+	Attempts    int
+	ExpiresAt   time.Time
+}
+
+// Familiarity is what a user's past logins say of a new one
+type Familiarity struct {
+	// Any is false for a user's first login
+	Any     bool
+	Device  bool
+	Network bool
+}
+
+type DeviceRepository interface {
+	Familiar(ctx context.Context, userID int, fingerprint, network string) (Familiarity, error)
+	// TrustDevice adds d or, already known, updates when it was last seen
+	TrustDevice(ctx context.Context, d *KnownDevice) error
+	// Devices lists a user's devices, most recently seen first
+	Devices(ctx context.Context, userID int) ([]KnownDevice, error)
+	ForgetDevice(ctx context.Context, userID int, fingerprint string) error
+	CreateChallenge(ctx context.Context, c *LoginChallenge) error
+	Challenge(ctx context.Context, id string) (*LoginChallenge, error)
+	// FailChallenge counts a wrong code and returns the tries so far
+	FailChallenge(ctx context.Context, id string) (int, error)
+	DeleteChallenge(ctx context.Context, id string) error
+}
+
+func (r *PostgresUserRepository) Familiar(ctx context.Context, userID int, fingerprint, network string) (Familiarity, error) {
+	var f Familiarity
+	err := r.db.QueryRowContext(ctx, `SELECT count(*) > 0, COALESCE(bool_or(fingerprint = $2), false),
+              COALESCE(bool_or(network = $3), false) FROM known_devices WHERE user_id = $1`,
+		userID, fingerprint, network).Scan(&f.Any, &f.Device, &f.Network)
+	return f, err
+}
+
+func (r *PostgresUserRepository) TrustDevice(ctx context.Context, d *KnownDevice) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO known_devices (user_id, fingerprint, network, device)
+              VALUES ($1, $2, $3, $4)
+              ON CONFLICT (user_id, fingerprint, network) DO UPDATE SET device = EXCLUDED.device, last_seen = now()
+              RETURNING first_seen, last_seen`,
+		d.UserID, d.Fingerprint, d.Network, d.Device).Scan(&d.FirstSeen, &d.LastSeen)
+}
+
+func (r *PostgresUserRepository) Devices(ctx context.Context, userID int) ([]KnownDevice, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT user_id, fingerprint, network, device, first_seen, last_seen
+              FROM known_devices WHERE user_id = $1 ORDER BY last_seen DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []KnownDevice
+	for rows.Next() {
+		var d KnownDevice
+		if err := rows.Scan(&d.UserID, &d.Fingerprint, &d.Network, &d.Device, &d.FirstSeen, &d.LastSeen); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (r *PostgresUserRepository) ForgetDevice(ctx context.Context, userID int, fingerprint string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM known_devices WHERE user_id = $1 AND fingerprint = $2`, userID, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *PostgresUserRepository) CreateChallenge(ctx context.Context, c *LoginChallenge) error {
+	// The user's expired challenges go with each new one
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM login_challenges WHERE user_id = $1 AND expires_at < now()`, c.UserID); err != nil {
+		return err
+	}
+	_, err := r.db.ExecContext(ctx, `INSERT INTO login_challenges (id, user_id, method, code_hash, fingerprint, network, device, expires_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		c.ID, c.UserID, c.Method, c.CodeHash, c.Fingerprint, c.Network, c.Device, c.ExpiresAt)
+	return err
+}
+
+func (r *PostgresUserRepository) Challenge(ctx context.Context, id string) (*LoginChallenge, error) {
+	var c LoginChallenge
+	err := r.db.QueryRowContext(ctx, `SELECT id, user_id, method, code_hash, fingerprint, network, device, attempts, expires_at
+              FROM login_challenges WHERE id = $1`, id).
+		Scan(&c.ID, &c.UserID, &c.Method, &c.CodeHash, &c.Fingerprint, &c.Network, &c.Device, &c.Attempts, &c.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *PostgresUserRepository) FailChallenge(ctx context.Context, id string) (int, error) {
+	var attempts int
+	err := r.db.QueryRowContext(ctx, `UPDATE login_challenges SET attempts = attempts + 1 WHERE id = $1
+              RETURNING attempts`, id).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return attempts, err
+}
+
+func (r *PostgresUserRepository) DeleteChallenge(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM login_challenges WHERE id = $1`, id)
+	return err
+}
+
+func (r *MemoryUserRepository) Familiar(ctx context.Context, userID int, fingerprint, network string) (Familiarity, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var f Familiarity
+	for _, d := range r.devices {
+		if d.UserID == userID {
+			f.Any = true
+			f.Device = f.Device || d.Fingerprint == fingerprint
+			f.Network = f.Network || d.Network == network
+		}
+	}
+	return f, nil
+}
+
+func (r *MemoryUserRepository) TrustDevice(ctx context.Context, d *KnownDevice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[d.UserID]; !ok {
+		return ErrNotFound
+	}
+	now := clock.System.Now()
+	for i, known := range r.devices {
+		if known.UserID == d.UserID && known.Fingerprint == d.Fingerprint && known.Network == d.Network {
+			known.Device, known.LastSeen = d.Device, now
+			r.devices[i] = known
+			*d = known
+			return nil
+		}
+	}
+	d.FirstSeen, d.LastSeen = now, now
+	r.devices = append(r.devices, *d)
+	return nil
+}
+
+func (r *MemoryUserRepository) Devices(ctx context.Context, userID int) ([]KnownDevice, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var devices []KnownDevice
+	for _, d := range r.devices {
+		if d.UserID == userID {
+			devices = append(devices, d)
+		}
+	}
+	slices.SortFunc(devices, func(a, b KnownDevice) int { return b.LastSeen.Compare(a.LastSeen) })
+	return devices, nil
+}
+
+func (r *MemoryUserRepository) ForgetDevice(ctx context.Context, userID int, fingerprint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.devices)
+	r.devices = slices.DeleteFunc(r.devices, func(d KnownDevice) bool {
+		return d.UserID == userID && d.Fingerprint == fingerprint
+	})
+	if len(r.devices) == n {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateChallenge(ctx context.Context, c *LoginChallenge) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := clock.System.Now()
+	for id, old := range r.challenges {
+		if now.After(old.ExpiresAt) {
+			delete(r.challenges, id)
+		}
+	}
+	stored := *c
+	r.challenges[c.ID] = &stored
+	return nil
+}
+
+func (r *MemoryUserRepository) Challenge(ctx context.Context, id string) (*LoginChallenge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.challenges[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *c
+	return &found, nil
+}
+
+func (r *MemoryUserRepository) FailChallenge(ctx context.Context, id string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.challenges[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	c.Attempts++
+	return c.Attempts, nil
+}
+
+func (r *MemoryUserRepository) DeleteChallenge(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.challenges, id)
+	return nil
+}
+
+// DeviceCheck notices logins from devices and networks a user hasn't
+// signed in from before. It tells the user of them or, with StepUp, has
+// them confirm the login with a code sent by email first.
+type DeviceCheck struct {
+	repo   Repository
+	events *events.Emitter
+	StepUp bool
+	clock  clock.Clock
+}
+
+// deviceCheckFromEnv reads LOGIN_STEP_UP: "email" to confirm logins from
+// new devices by email, "off" (the default) only to tell of them
+func deviceCheckFromEnv(repo Repository, emitter *events.Emitter) *DeviceCheck {
+	c := &DeviceCheck{repo: repo, events: emitter, clock: clock.System}
+	switch v := os.Getenv("LOGIN_STEP_UP"); v {
+	case "", "off":
+	case "email":
+		c.StepUp = true
+	default:
+		log.Fatalf("invalid LOGIN_STEP_UP %q", v)
+	}
+	return c
+}
+
+// sighting is a login's device and how familiar it is
+type sighting struct {
+	KnownDevice
+	IP       string
+	Familiar Familiarity
+}
+
+// unfamiliar is a login from a new device or network; a user's first login
+// is from neither
+func (s *sighting) unfamiliar() bool {
+	return s.Familiar.Any && (!s.Familiar.Device || !s.Familiar.Network)
+}
+
+func (s *sighting) detail() map[string]any {
+	if !s.unfamiliar() {
+		return nil
+	}
+	return map[string]any{"new_device": !s.Familiar.Device, "new_location": !s.Familiar.Network}
+}
+
+// fingerprint identifies a device by the ID its client keeps, if it sends
+// one, and its browser and system. Not by the whole user agent, or every
+// browser update would make a new device.
+func fingerprint(deviceID, userAgent string) string {
+	label := device(userAgent)
+	if label == "" {
+		label = userAgent
+	}
+	sum := sha256.Sum256([]byte(deviceID + "\x00" + label))
+	return hex.EncodeToString(sum[:16])
+}
+
+// network stands in for where a login came from, there being no
+// geolocation: the IP's /16, or /32 for IPv6, roughly a provider's block
+func network(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	bits := 32
+	if addr.Unmap().Is4() {
+		addr, bits = addr.Unmap(), 16
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// sight fingerprints the login of userID from r
+func (c *DeviceCheck) sight(ctx context.Context, r *http.Request, ip string, userID int, deviceID string) (*sighting, error) {
+	s := &sighting{
+		KnownDevice: KnownDevice{
+			UserID:      userID,
+			Fingerprint: fingerprint(deviceID, r.UserAgent()),
+			Device:      device(r.UserAgent()),
+			Network:     network(ip),
+		},
+		IP: ip,
+	}
+	var err error
+	s.Familiar, err = c.repo.Familiar(ctx, userID, s.Fingerprint, s.Network)
+	return s, err
+}
+
+// trust remembers the device, and tells the user if it was new to them
+func (c *DeviceCheck) trust(ctx context.Context, s *sighting, alert bool) error {
+	if err := c.repo.TrustDevice(ctx, &s.KnownDevice); err != nil {
+		return err
+	}
+	if alert && s.unfamiliar() {
+		c.events.Emit(ctx, "user.new_device_login", fmt.Sprintf("user/%d", s.UserID), map[string]any{
+			"user_id":      s.UserID,
+			"device":       s.Device,
+			"ip":           s.IP,
+			"new_device":   !s.Familiar.Device,
+			"new_location": !s.Familiar.Network,
+			"occurred_at":  s.LastSeen,
+		})
+	}
+	return nil
+}
+
+// challenge holds the login back for a code. An emailed one travels in
+// the event, as the notification service sends the email.
+func (c *DeviceCheck) challenge(ctx context.Context, s *sighting, method string) (*LoginChallenge, error) {
+	ch := &LoginChallenge{
+		ID:          publicid.New(),
+		UserID:      s.UserID,
+		Method:      method,
+		Fingerprint: s.Fingerprint,
+		Network:     s.Network,
+		Device:      s.Device,
+		ExpiresAt:   c.clock.Now().Add(challengeTTL),
+	}
+	if method == challengeTOTP {
+		return ch, c.repo.CreateChallenge(ctx, ch)
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return nil, err
+	}
+	code := fmt.Sprintf("%06d", n)
+	ch.CodeHash = hashChallengeCode(ch.ID, code)
+	if err := c.repo.CreateChallenge(ctx, ch); err != nil {
+		return nil, err
+	}
+	c.events.Emit(ctx, "user.login_challenged", fmt.Sprintf("user/%d", s.UserID), map[string]any{
+		"user_id":    s.UserID,
+		"code":       code,
+		"device":     s.Device,
+		"ip":         s.IP,
+		"expires_in": int(challengeTTL.Minutes()),
+	})
+	return ch, nil
+}
+
+func hashChallengeCode(id, code string) string {
+	return hashClaimToken(id + ":" + code)
+}
+
+type challengeResponse struct {
+	Challenge string `json:"challenge"`
+	Method    string `json:"method"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+type verifyRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// VerifyLogin serves POST /users/login/verify: the code emailed for a
+// challenged login or, for users with a second factor, one from their
+// authenticator or a recovery code; answered like a login
+func (s *UserService) VerifyLogin(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		i18n.Error(w, r, http.StatusServiceUnavailable, "login.not_configured")
+		return
+	}
+	var req verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	ch, err := s.devices.repo.Challenge(ctx, req.Challenge)
+	if errors.Is(err, ErrNotFound) || (err == nil && s.clock.Now().After(ch.ExpiresAt)) {
+		i18n.Error(w, r, http.StatusUnauthorized, "login.code_invalid")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	user, err := s.repo.Get(ctx, ch.UserID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if user.DeactivatedAt != nil {
+		i18n.Error(w, r, http.StatusForbidden, "login.deactivated")
+		return
+	}
+	ip := s.guard.clientIP(r)
+	// The CAPTCHA was solved for the password, if it had to be
+	wait, err := s.guard.check(ctx, user.Email, ip, "")
+	if errors.Is(err, errLockedOut) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		i18n.Error(w, r, http.StatusTooManyRequests, "login.locked_out")
+		return
+	}
+	if err != nil && !errors.Is(err, errCaptchaRequired) {
+		dbretry.Error(w, err)
+		return
+	}
+
+	var passed, recovery bool
+	switch ch.Method {
+	case challengeTOTP:
+		factor, err := s.twoFactor.enabled(ctx, user.ID)
+		if err == nil && factor != nil {
+			passed, recovery, err = s.twoFactor.check(ctx, factor, req.Code)
+		}
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+	default:
+		passed = subtle.ConstantTimeCompare([]byte(hashChallengeCode(ch.ID, req.Code)), []byte(ch.CodeHash)) == 1
+	}
+	if !passed {
+		attempts, err := s.devices.repo.FailChallenge(ctx, ch.ID)
+		if err == nil && attempts >= challengeAttempts {
+			err = s.devices.repo.DeleteChallenge(ctx, ch.ID)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			dbretry.Error(w, err)
+			return
+		}
+		// Wrong codes count towards the lockout like wrong passwords, which
+		// is only lifted once a login gets all the way through
+		s.guard.fail(ctx, user.Email, ip)
+		s.activity.Record(r, Activity{UserID: ch.UserID, Type: activityLoginFailed, Detail: map[string]any{"step_up": ch.Method}})
+		i18n.Error(w, r, http.StatusUnauthorized, "login.code_invalid")
+		return
+	}
+	if err := s.devices.repo.DeleteChallenge(ctx, ch.ID); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	s.guard.succeed(ctx, user.Email)
+
+	sighted := &sighting{
+		KnownDevice: KnownDevice{UserID: user.ID, Fingerprint: ch.Fingerprint, Network: ch.Network, Device: ch.Device},
+		IP:          ip,
+	}
+	sighted.Familiar, err = s.devices.repo.Familiar(ctx, user.ID, ch.Fingerprint, ch.Network)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	// Users who confirmed by email know of the login already
+	if err := s.devices.trust(ctx, sighted, ch.Method == challengeTOTP); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	detail := map[string]any{"step_up": ch.Method}
+	amr := []string{"pwd"}
+	if ch.Method == challengeTOTP {
+		amr = append(amr, "otp")
+		detail["recovery_code"] = recovery
+	}
+	s.activity.Record(r, Activity{UserID: user.ID, Type: activityLogin, Detail: detail})
+	s.issueLogin(w, r, user, amr)
+}
+
+// authorizeDevices lets the user and admins at a user's devices
+func authorizeDevices(w http.ResponseWriter, r *http.Request, repo Repository) (int, bool) {
+	ctx := r.Context()
+	userID, err := resolveUserID(ctx, repo, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return 0, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return 0, false
+	}
+	p, ok := middleware.PrincipalFromContext(ctx)
+	if ok && p.Subject != strconv.Itoa(userID) && !p.HasRole("admin") {
+		i18n.Error(w, r, http.StatusForbidden, "devices.forbidden")
+		return 0, false
+	}
+	return userID, true
+}
+
+// ListDevices serves GET /users/{id}/devices
+func (c *DeviceCheck) ListDevices(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authorizeDevices(w, r, c.repo)
+	if !ok {
+		return
+	}
+	devices, err := c.repo.Devices(r.Context(), userID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if devices == nil {
+		devices = []KnownDevice{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// ForgetDevice serves DELETE /users/{id}/devices/{fingerprint}, for a lost
+// device: logins from it are new again
+func (c *DeviceCheck) ForgetDevice(w http.ResponseWriter, r *http.Request) {
+	if refuseImpersonation(w, r) {
+		return
+	}
+	userID, ok := authorizeDevices(w, r, c.repo)
+	if !ok {
+		return
+	}
+	err := c.repo.ForgetDevice(r.Context(), userID, router.Param(r, "fingerprint"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "device.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+// user-service/external.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"platform/dbretry"
+	"platform/i18n"
+	"platform/middleware"
+)
+
+// errExternalIDTaken means the tenant already has a user with that
+// external ID
+var errExternalIDTaken = errors.New("external ID already used")
+
+// External IDs come from other systems; they are kept to what fits in a
+// path segment as is
+var externalIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,100}$`)
+
+// tenantOf is the tenant external IDs are looked up in; callers without
+// one share the default, empty tenant
+func tenantOf(r *http.Request) string {
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+		return p.Tenant
+	}
+	return ""
+}
+
+// isUniqueViolation spots Postgres' unique_violation without tying the
+// repository to the driver's error type
+func isUniqueViolation(err error) bool {
+	var state interface{ SQLState() string }
+	return errors.As(err, &state) && state.SQLState() == "23505"
+}
+
+func (r *PostgresUserRepository) ByExternalID(ctx context.Context, tenant, externalID string) (*User, error) {
+	var user User
+	err := scanUser(r.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = (
+                  SELECT COALESCE(a.user_id, u.id) FROM users u LEFT JOIN user_aliases a ON a.alias_id = u.id
+                  WHERE u.tenant = $1 AND u.external_id = $2)`, tenant, externalID), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) ByExternalID(ctx context.Context, tenant, externalID string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for id, u := range r.users {
+		if u.Tenant != tenant || u.ExternalID == "" || u.ExternalID != externalID {
+			continue
+		}
+		if to, ok := r.aliases[id]; ok {
+			u = r.users[to]
+		}
+		return &u, nil
+	}
+	return nil, ErrNotFound
+}
+
+// replayUser answers a registration for an external ID that already has a
+// user with that user, as long as the email matches. It reports whether
+// there was one.
+func (s *UserService) replayUser(w http.ResponseWriter, r *http.Request, user *User) bool {
+	existing, err := s.repo.ByExternalID(r.Context(), user.Tenant, user.ExternalID)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return true
+	}
+	if existing.Email != user.Email {
+		i18n.Error(w, r, http.StatusConflict, "user.external_id_conflict", user.ExternalID)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(existing)
+	return true
+}
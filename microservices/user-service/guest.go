@@ -0,0 +1,229 @@
+// user-service/guest.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/publicid"
+	"platform/router"
+)
+
+var errEmailRegistered = errors.New("email already registered")
+
+// GuestRepository keeps the shadow users made for guest checkouts
+type GuestRepository interface {
+	// SaveGuest makes the guest user for user.Email, or updates the one
+	// there is, reporting which, and gives it user.ClaimTokenHash. An email
+	// that belongs to a registered user fails with errEmailRegistered.
+	SaveGuest(ctx context.Context, user *User) (existed bool, err error)
+	// ClaimGuest merges the guest holding the claim token into userID and
+	// returns the guest's ID; the token can't be used again
+	ClaimGuest(ctx context.Context, claimTokenHash string, userID int) (int, error)
+}
+
+// Claim tokens are random, so a fast hash is enough to keep a leaked table
+// from handing out guests
+func hashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *PostgresUserRepository) SaveGuest(ctx context.Context, user *User) (bool, error) {
+	query := `INSERT INTO users (name, email, guest, address, claim_token_hash, created_at)
+              VALUES ($1, $2, true, NULLIF($3, ''), $4, $5)
+              ON CONFLICT (email) DO UPDATE
+              SET name = EXCLUDED.name, address = EXCLUDED.address,
+                  claim_token_hash = EXCLUDED.claim_token_hash, merged_into = NULL
+              WHERE users.guest
+              RETURNING id, public_id, created_at, xmax <> 0`
+	// xmax is set on a row the upsert updated rather than inserted
+	var existed bool
+	err := r.db.QueryRowContext(ctx, query, user.Name, user.Email, user.Address, user.ClaimTokenHash, user.CreatedAt).
+		Scan(&user.ID, &user.PublicID, &user.CreatedAt, &existed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errEmailRegistered
+	}
+	return existed, err
+}
+
+func (r *PostgresUserRepository) ClaimGuest(ctx context.Context, claimTokenHash string, userID int) (int, error) {
+	var guestID int
+	err := r.db.QueryRowContext(ctx, `UPDATE users SET merged_into = $2, claim_token_hash = NULL
+              WHERE claim_token_hash = $1 AND guest AND id <> $2 RETURNING id`, claimTokenHash, userID).Scan(&guestID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return guestID, err
+}
+
+func (r *MemoryUserRepository) SaveGuest(ctx context.Context, user *User) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, u := range r.users {
+		if u.Email != user.Email {
+			continue
+		}
+		if !u.Guest {
+			return false, errEmailRegistered
+		}
+		for hash, guest := range r.claims {
+			if guest == id {
+				delete(r.claims, hash)
+			}
+		}
+		u.Name, u.Address = user.Name, user.Address
+		r.users[id] = u
+		r.claims[user.ClaimTokenHash] = id
+		user.ID, user.PublicID, user.CreatedAt = id, u.PublicID, u.CreatedAt
+		return true, nil
+	}
+	user.ID = r.nextID
+	r.nextID++
+	user.PublicID = publicid.New()
+	stored := *user
+	stored.ClaimToken, stored.ClaimTokenHash = "", ""
+	r.users[user.ID] = stored
+	r.claims[user.ClaimTokenHash] = user.ID
+	return false, nil
+}
+
+func (r *MemoryUserRepository) ClaimGuest(ctx context.Context, claimTokenHash string, userID int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	guestID, ok := r.claims[claimTokenHash]
+	if !ok || guestID == userID {
+		return 0, ErrNotFound
+	}
+	delete(r.claims, claimTokenHash)
+	return guestID, nil
+}
+
+// GuestAPI serves the guest users order-service makes at guest checkout,
+// and their claiming by registered users
+type GuestAPI struct {
+	repo   Repository
+	events *events.Emitter
+	clock  clock.Clock
+}
+
+// Create makes (or refreshes) the shadow user for a guest checkout. Each
+// call issues a new claim token and voids the previous one. Only a new
+// guest's token is in the response: anyone may check out with an email,
+// so the token for a guest with earlier orders, and with them its
+// addresses, goes to the email address alone.
+func (a *GuestAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var guest User
+	if err := json.NewDecoder(r.Body).Decode(&guest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	guest.Email = strings.TrimSpace(guest.Email)
+	if !strings.Contains(guest.Email, "@") {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "guest.invalid_email")
+		return
+	}
+
+	guest.Guest = true
+	guest.ClaimToken = rand.Text()
+	guest.ClaimTokenHash = hashClaimToken(guest.ClaimToken)
+	guest.Password, guest.PasswordHash, guest.Profile = "", "", Profile{}
+	guest.CreatedAt = a.clock.Now()
+	existed, err := a.repo.SaveGuest(r.Context(), &guest)
+	if errors.Is(err, errEmailRegistered) {
+		i18n.Error(w, r, http.StatusConflict, "user.email_registered")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if existed {
+		// notification-service emails it to the guest
+		a.events.Emit(r.Context(), "user.guest_claim_issued", fmt.Sprintf("user/%d", guest.ID), map[string]any{
+			"user_id":     guest.ID,
+			"claim_token": guest.ClaimToken,
+		})
+		guest.ClaimToken = ""
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(guest)
+}
+
+// Claim lets a registered user take over the orders they placed as a guest
+// under another email, proving it with the guest's claim token
+func (a *GuestAPI) Claim(w http.ResponseWriter, r *http.Request) {
+	userID, err := resolveUserID(r.Context(), a.repo, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok &&
+		p.Subject != strconv.Itoa(userID) && !p.HasRole("admin") {
+		i18n.Error(w, r, http.StatusForbidden, "guest.forbidden")
+		return
+	}
+	var req struct {
+		ClaimToken string `json:"claim_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := a.repo.Get(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if user.Guest {
+		i18n.Error(w, r, http.StatusConflict, "guest.claim_by_guest")
+		return
+	}
+
+	guestID, err := a.repo.ClaimGuest(ctx, hashClaimToken(req.ClaimToken), userID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "guest.invalid_claim")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	// order-service moves the guest's orders over when it sees this
+	claim := map[string]any{"guest_id": guestID, "user_id": userID}
+	a.events.Emit(ctx, "user.guest_claimed", fmt.Sprintf("user/%d", userID), claim)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claim)
+}
@@ -0,0 +1,169 @@
+// user-service/impersonation.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/publicid"
+	"platform/router"
+)
+
+// Impersonation tokens are short-lived; there is no revoking them
+const (
+	defaultImpersonationTTL = 15 * time.Minute
+	maxImpersonationTTL     = time.Hour
+)
+
+// Impersonation is a support session in which an admin acts as a user.
+// Its token carries the admin in its act claim, so every service
+// audit-logs the requests made with it.
+type Impersonation struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Admin     string    `json:"admin"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ImpersonationRepository interface {
+	CreateImpersonation(ctx context.Context, im *Impersonation) error
+}
+
+func (r *PostgresUserRepository) CreateImpersonation(ctx context.Context, im *Impersonation) error {
+	return r.db.QueryRowContext(ctx, `INSERT INTO impersonations (id, user_id, admin, reason, expires_at)
+              VALUES ($1, $2, $3, $4, $5) RETURNING created_at`,
+		im.ID, im.UserID, im.Admin, im.Reason, im.ExpiresAt).Scan(&im.CreatedAt)
+}
+
+func (r *MemoryUserRepository) CreateImpersonation(ctx context.Context, im *Impersonation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[im.UserID]; !ok {
+		return ErrNotFound
+	}
+	im.CreatedAt = clock.System.Now()
+	r.impersonations = append(r.impersonations, *im)
+	return nil
+}
+
+// ImpersonationAPI lets admins act as a user to see what they see
+type ImpersonationAPI struct {
+	repo     Repository
+	tokens   *auth.Tokens
+	events   *events.Emitter
+	clock    clock.Clock
+	activity *ActivityLog
+}
+
+type impersonationRequest struct {
+	Reason string `json:"reason"`
+	// Minutes the token lasts, 15 by default and 60 at most
+	Minutes int `json:"minutes"`
+}
+
+type impersonationResponse struct {
+	Session   *Impersonation `json:"session"`
+	Token     string         `json:"token"`
+	ExpiresIn int            `json:"expires_in"`
+}
+
+// Create serves POST /users/{id}/impersonations: it records a session for
+// the reason given and issues a token acting as the user for it
+func (a *ImpersonationAPI) Create(w http.ResponseWriter, r *http.Request) {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	if a.tokens == nil || !ok {
+		i18n.Error(w, r, http.StatusNotImplemented, "impersonation.unavailable")
+		return
+	}
+	var req impersonationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	ttl := defaultImpersonationTTL
+	if req.Minutes != 0 {
+		ttl = time.Duration(req.Minutes) * time.Minute
+	}
+	if req.Reason == "" || len(req.Reason) > 500 || ttl < time.Minute || ttl > maxImpersonationTTL {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "impersonation.invalid")
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := resolveUserID(ctx, a.repo, router.Param(r, "id"))
+	var user *User
+	if err == nil {
+		user, err = a.repo.Get(ctx, userID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	im := &Impersonation{
+		ID:        publicid.New(),
+		UserID:    user.ID,
+		Admin:     p.Subject,
+		Reason:    req.Reason,
+		ExpiresAt: a.clock.Now().Add(ttl),
+	}
+	if err := a.repo.CreateImpersonation(ctx, im); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	token, err := a.tokens.Issue(auth.Claims{
+		Subject: strconv.Itoa(user.ID),
+		Actor:   &auth.Actor{Subject: p.Subject, Session: im.ID},
+	}, ttl)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	log.Printf("%s impersonating user %d until %s (session %s): %s",
+		p.Subject, user.ID, im.ExpiresAt.Format(time.RFC3339), im.ID, im.Reason)
+	a.activity.Record(r, Activity{
+		UserID:  user.ID,
+		Type:    activityImpersonation,
+		Session: im.ID,
+		Detail:  map[string]any{"reason": im.Reason, "until": im.ExpiresAt},
+	})
+	a.events.Emit(ctx, "user.impersonated", fmt.Sprintf("user/%d", user.ID), im)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(impersonationResponse{Session: im, Token: token, ExpiresIn: int(ttl.Seconds())})
+}
+
+// refuseImpersonation answers 403 to a request made under an impersonation
+// token, for the endpoints that change how the user signs in; support acts
+// as the user but doesn't get to keep their account. It reports whether it
+// did.
+func refuseImpersonation(w http.ResponseWriter, r *http.Request) bool {
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok && p.Actor != nil {
+		i18n.Error(w, r, http.StatusForbidden, "impersonation.forbidden")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// user-service/json.go
+package main
+
+import "platform/jsonenc"
+
+// AppendJSON appends u as encoding/json would marshal it, without the
+// reflection. Keep it in step with User's and Profile's fields and tags.
+func (u *User) AppendJSON(b []byte) []byte {
+	b = append(b, '{')
+	b = jsonenc.Int(jsonenc.Key(b, "id"), int64(u.ID))
+	if u.PublicID != "" {
+		b = jsonenc.String(jsonenc.Key(b, "public_id"), u.PublicID)
+	}
+	b = jsonenc.String(jsonenc.Key(b, "name"), u.Name)
+	b = jsonenc.String(jsonenc.Key(b, "email"), u.Email)
+	if u.Password != "" {
+		b = jsonenc.String(jsonenc.Key(b, "password"), u.Password)
+	}
+	b = u.Profile.AppendJSON(jsonenc.Key(b, "profile"))
+	b = jsonenc.Time(jsonenc.Key(b, "created_at"), u.CreatedAt)
+	if u.Guest {
+		b = jsonenc.Bool(jsonenc.Key(b, "guest"), true)
+	}
+	if u.Address != "" {
+		b = jsonenc.String(jsonenc.Key(b, "address"), u.Address)
+	}
+	if u.ClaimToken != "" {
+		b = jsonenc.String(jsonenc.Key(b, "claim_token"), u.ClaimToken)
+	}
+	if u.ExternalID != "" {
+		b = jsonenc.String(jsonenc.Key(b, "external_id"), u.ExternalID)
+	}
+	if u.DeactivatedAt != nil {
+		b = jsonenc.Time(jsonenc.Key(b, "deactivated_at"), *u.DeactivatedAt)
+	}
+	if u.DeletedAt != nil {
+		b = jsonenc.Time(jsonenc.Key(b, "deleted_at"), *u.DeletedAt)
+	}
+	return append(b, '}')
+}
+
+func (p *Profile) AppendJSON(b []byte) []byte {
+	b = append(b, '{')
+	if p.Phone != "" {
+		b = jsonenc.String(jsonenc.Key(b, "phone"), p.Phone)
+	}
+	if p.Locale != "" {
+		b = jsonenc.String(jsonenc.Key(b, "locale"), p.Locale)
+	}
+	if p.Timezone != "" {
+		b = jsonenc.String(jsonenc.Key(b, "timezone"), p.Timezone)
+	}
+	b = jsonenc.Bool(jsonenc.Key(b, "marketing_opt_in"), p.MarketingOptIn)
+	return append(b, '}')
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testUsers() []User {
+	created := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	deactivated := created.Add(time.Hour)
+	deleted := created.Add(2 * time.Hour)
+	return []User{
+		{ID: 1, Name: "Ada", Email: "ada@example.com", CreatedAt: created},
+		{
+			ID: 2, PublicID: "usr_2", Name: `<Bob> "the builder" & co`, Email: "bob@example.com",
+			Password: "secret", PasswordHash: "hash", CreatedAt: created, Guest: true,
+			Address: "1 Main St\nSpringfield", ClaimToken: "claim", ClaimTokenHash: "claimhash",
+			ExternalID: "ext-3", Tenant: "acme", DeactivatedAt: &deactivated, DeletedAt: &deleted,
+			Profile: Profile{Phone: "+4915112345678", Locale: "de", Timezone: "Europe/Berlin", MarketingOptIn: true},
+		},
+	}
+}
+
+func TestAppendJSONMatchesMarshal(t *testing.T) {
+	for _, u := range testUsers() {
+		want, err := json.Marshal(&u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.AppendJSON(nil); string(got) != string(want) {
+			t.Errorf("AppendJSON = %s\nwant          %s", got, want)
+		}
+	}
+}
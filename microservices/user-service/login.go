@@ -0,0 +1,481 @@
+// user-service/login.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/dbretry"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/redis"
+)
+
+const tokenTTL = time.Hour
+
+// AttemptStore counts failed logins per key within a window. It must be
+// shared between replicas, or an attacker just spreads attempts over them.
+type AttemptStore interface {
+	// Fail records a failure and returns the count within the window
+	Fail(ctx context.Context, key string, window time.Duration) (int64, error)
+	// Count returns the failures so far and how long until they expire
+	Count(ctx context.Context, key string) (int64, time.Duration, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// RedisAttemptStore keeps counters in Redis with the window as their TTL
+type RedisAttemptStore struct {
+	client *redis.Client
+}
+
+func (s *RedisAttemptStore) Fail(ctx context.Context, key string, window time.Duration) (int64, error) {
+	n, err := s.client.Int(ctx, "INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		ms := strconv.FormatInt(window.Milliseconds(), 10)
+		if _, err := s.client.Do(ctx, "PEXPIRE", key, ms); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (s *RedisAttemptStore) Count(ctx context.Context, key string) (int64, time.Duration, error) {
+	n, err := s.client.Int(ctx, "GET", key)
+	if errors.Is(err, redis.ErrNil) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	ms, err := s.client.Int(ctx, "PTTL", key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, time.Duration(max(ms, 0)) * time.Millisecond, nil
+}
+
+func (s *RedisAttemptStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx)
+}
+
+func (s *RedisAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := s.client.Do(ctx, "DEL", key)
+	return err
+}
+
+type attempts struct {
+	count   int64
+	expires time.Time
+}
+
+// MemoryAttemptStore is for single-replica and local use only
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*attempts
+	clock    clock.Clock
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]*attempts), clock: clock.System}
+}
+
+func (s *MemoryAttemptStore) Fail(ctx context.Context, key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	a, ok := s.attempts[key]
+	if !ok || now.After(a.expires) {
+		a = &attempts{expires: now.Add(window)}
+		s.attempts[key] = a
+	}
+	a.count++
+	if len(s.attempts) > 10000 {
+		for k, a := range s.attempts {
+			if now.After(a.expires) {
+				delete(s.attempts, k)
+			}
+		}
+	}
+	return a.count, nil
+}
+
+func (s *MemoryAttemptStore) Count(ctx context.Context, key string) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok || s.clock.Now().After(a.expires) {
+		return 0, 0, nil
+	}
+	return a.count, a.expires.Sub(s.clock.Now()), nil
+}
+
+func (s *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// CaptchaVerifier checks a CAPTCHA response token for the client at ip
+type CaptchaVerifier func(ctx context.Context, token, ip string) (bool, error)
+
+// LockoutHook is told when an account or IP gets locked out, e.g. to alert
+// the security team or email the account owner
+type LockoutHook func(ctx context.Context, kind, subject string, until time.Time)
+
+// LoginGuard throttles password guessing: every failure delays the next
+// response a little longer, repeated failures require a CAPTCHA, and too
+// many lock the account or IP out until the window expires.
+type LoginGuard struct {
+	store AttemptStore
+
+	Window       time.Duration
+	AccountLimit int64
+	IPLimit      int64
+	CaptchaAfter int64
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+
+	// TrustForwardedFor takes the client IP from the X-Forwarded-For entry
+	// added by the gateway; without it every client looks like the gateway
+	TrustForwardedFor bool
+
+	Captcha   CaptchaVerifier
+	OnLockout LockoutHook
+
+	clock clock.Clock
+}
+
+func NewLoginGuard(store AttemptStore) *LoginGuard {
+	return &LoginGuard{
+		store:        store,
+		Window:       15 * time.Minute,
+		AccountLimit: 5,
+		IPLimit:      50,
+		CaptchaAfter: 3,
+		BaseDelay:    250 * time.Millisecond,
+		MaxDelay:     4 * time.Second,
+		clock:        clock.System,
+	}
+}
+
+var (
+	errLockedOut       = i18n.NewError("login.locked_out")
+	errCaptchaRequired = i18n.NewError("login.captcha_required")
+)
+
+func accountKey(email string) string {
+	return "login:account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "login:ip:" + ip
+}
+
+// check runs before the password is verified. It returns how long the
+// client must wait when locked out.
+func (g *LoginGuard) check(ctx context.Context, email, ip, captchaToken string) (time.Duration, error) {
+	accountFails, accountTTL, err := g.store.Count(ctx, accountKey(email))
+	if err != nil {
+		return 0, err
+	}
+	ipFails, ipTTL, err := g.store.Count(ctx, ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	if accountFails >= g.AccountLimit {
+		return accountTTL, errLockedOut
+	}
+	if ipFails >= g.IPLimit {
+		return ipTTL, errLockedOut
+	}
+
+	if g.Captcha != nil && max(accountFails, ipFails) >= g.CaptchaAfter {
+		if captchaToken == "" {
+			return 0, errCaptchaRequired
+		}
+		ok, err := g.Captcha(ctx, captchaToken, ip)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, errCaptchaRequired
+		}
+	}
+	return 0, nil
+}
+
+// fail records a failed attempt and returns the delay before answering
+func (g *LoginGuard) fail(ctx context.Context, email, ip string) time.Duration {
+	accountFails, err := g.store.Fail(ctx, accountKey(email), g.Window)
+	if err != nil {
+		log.Printf("login guard: %v", err)
+	}
+	ipFails, err := g.store.Fail(ctx, ipKey(ip), g.Window)
+	if err != nil {
+		log.Printf("login guard: %v", err)
+	}
+
+	until := g.clock.Now().Add(g.Window)
+	if accountFails == g.AccountLimit {
+		g.lockout(ctx, "account", email, until)
+	}
+	if ipFails == g.IPLimit {
+		g.lockout(ctx, "ip", ip, until)
+	}
+
+	fails := max(accountFails, ipFails)
+	delay := time.Duration(float64(g.BaseDelay) * math.Pow(2, float64(max(fails-1, 0))))
+	return min(delay, g.MaxDelay)
+}
+
+func (g *LoginGuard) lockout(ctx context.Context, kind, subject string, until time.Time) {
+	log.Printf("login guard: %s %s locked out until %s", kind, subject, until.Format(time.RFC3339))
+	if g.OnLockout != nil {
+		go g.OnLockout(context.WithoutCancel(ctx), kind, subject, until)
+	}
+}
+
+func (g *LoginGuard) succeed(ctx context.Context, email string) {
+	if err := g.store.Reset(ctx, accountKey(email)); err != nil {
+		log.Printf("login guard: %v", err)
+	}
+}
+
+// WebhookCaptcha posts {"token", "remote_ip"} to a verification endpoint
+// and treats a 2xx answer as a solved CAPTCHA
+func WebhookCaptcha(url string) CaptchaVerifier {
+	return func(ctx context.Context, token, ip string) (bool, error) {
+		body, _ := json.Marshal(map[string]string{"token": token, "remote_ip": ip})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, fmt.Errorf("captcha verifier unavailable: %w", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode/100 == 2, nil
+	}
+}
+
+// WebhookLockout posts lockout events as JSON to url
+func WebhookLockout(url string) LockoutHook {
+	return func(ctx context.Context, kind, subject string, until time.Time) {
+		body, _ := json.Marshal(map[string]any{
+			"event":   "login.lockout",
+			"kind":    kind,
+			"subject": subject,
+			"until":   until,
+		})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("lockout webhook: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		middleware.Propagate(ctx, req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("lockout webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+}
+
+type loginRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	CaptchaToken string `json:"captcha_token,omitempty"`
+	// DeviceID is an ID the client keeps, e.g. in local storage, to tell
+	// its device from others of the same kind
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+type loginResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in"`
+	User      *User  `json:"user"`
+	// TwoFactorSetupRequired says the token is only good for setting up
+	// the second factor the user's tenant requires
+	TwoFactorSetupRequired bool `json:"two_factor_setup_required,omitempty"`
+}
+
+func (g *LoginGuard) clientIP(r *http.Request) string {
+	if g.TrustForwardedFor {
+		// Only the last entry was written by the proxy; earlier ones are
+		// whatever the client claimed
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			entries := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *UserService) Login(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		i18n.Error(w, r, http.StatusServiceUnavailable, "login.not_configured")
+		return
+	}
+
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Email == "" || req.Password == "" {
+		i18n.Error(w, r, http.StatusBadRequest, "login.missing_credentials")
+		return
+	}
+
+	ctx := r.Context()
+	ip := s.guard.clientIP(r)
+	wait, err := s.guard.check(ctx, req.Email, ip, req.CaptchaToken)
+	if errors.Is(err, errLockedOut) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		i18n.Error(w, r, http.StatusTooManyRequests, "login.locked_out")
+		return
+	}
+	if errors.Is(err, errCaptchaRequired) {
+		i18n.Error(w, r, http.StatusPreconditionRequired, "login.captcha_required")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	user, err := s.repo.GetByEmail(ctx, req.Email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		dbretry.Error(w, err)
+		return
+	}
+	// Hash even for unknown accounts so timing doesn't reveal which exist
+	hash := dummyHash()
+	if user != nil && user.PasswordHash != "" {
+		hash = user.PasswordHash
+	}
+	ok, err := checkPassword(hash, req.Password)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if !ok || user == nil || user.PasswordHash == "" {
+		// Same answer whether the account exists or not
+		delay := s.guard.fail(ctx, req.Email, ip)
+		if user != nil {
+			s.activity.Record(r, Activity{UserID: user.ID, Type: activityLoginFailed})
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		i18n.Error(w, r, http.StatusUnauthorized, "login.invalid_credentials")
+		return
+	}
+	// Tokens already issued run out on their own
+	if user.DeactivatedAt != nil {
+		s.activity.Record(r, Activity{UserID: user.ID, Type: activityLoginFailed, Detail: map[string]any{"deactivated": true}})
+		i18n.Error(w, r, http.StatusForbidden, "login.deactivated")
+		return
+	}
+	sighted, err := s.devices.sight(ctx, r, ip, user.ID, req.DeviceID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	// A second factor takes the place of the emailed code. Either way the
+	// lockout counts stand until the code is entered.
+	factor, err := s.twoFactor.enabled(ctx, user.ID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	method := ""
+	switch {
+	case factor != nil:
+		method = challengeTOTP
+	case sighted.unfamiliar() && s.devices.StepUp:
+		method = challengeEmail
+	}
+	if method != "" {
+		ch, err := s.devices.challenge(ctx, sighted, method)
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		s.activity.Record(r, Activity{UserID: user.ID, Type: activityLoginChallenged, Detail: sighted.detail()})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(challengeResponse{Challenge: ch.ID, Method: method, ExpiresIn: int(challengeTTL.Seconds())})
+		return
+	}
+	s.guard.succeed(ctx, req.Email)
+	if err := s.devices.trust(ctx, sighted, true); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	s.activity.Record(r, Activity{UserID: user.ID, Type: activityLogin, Detail: sighted.detail()})
+	s.issueLogin(w, r, user, []string{"pwd"})
+}
+
+// issueLogin answers a login with a token for user, signed in by amr.
+// Users whose tenant requires a second factor they don't have get one only
+// good for setting it up.
+func (s *UserService) issueLogin(w http.ResponseWriter, r *http.Request, user *User, amr []string) {
+	claims := auth.Claims{Subject: strconv.Itoa(user.ID), AMR: amr}
+	ttl := tokenTTL
+	setup := false
+	if !claims.SecondFactor() {
+		required, err := s.twoFactor.required(r.Context(), user)
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		if required {
+			claims, ttl, setup = enrollmentClaims(user), enrollmentTTL, true
+		}
+	}
+	token, err := s.tokens.Issue(claims, ttl)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loginResponse{
+		Token:                  token,
+		ExpiresIn:              int(ttl.Seconds()),
+		User:                   user,
+		TwoFactorSetupRequired: setup,
+	})
+}
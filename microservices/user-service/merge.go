@@ -0,0 +1,760 @@
+// user-service/merge.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Account merge statuses. A running merge that keeps failing a step is
+// failed until an admin resumes it.
+const (
+	MergeRunning   = "running"
+	MergeFailed    = "failed"
+	MergeCompleted = "completed"
+)
+
+const (
+	// mergeLease is how long a claimed merge is left to the replica
+	// running it before another may pick it up
+	mergeLease = 5 * time.Minute
+	// maxMergeAttempts of one step fail the merge
+	maxMergeAttempts = 5
+	mergeStepTimeout = 30 * time.Second
+)
+
+var (
+	errMergeConflict  = errors.New("account already merged or being merged")
+	errMergeCompleted = errors.New("merge already completed")
+	// errMergeMoved means another replica advanced the merge meanwhile
+	errMergeMoved = errors.New("merge moved on")
+)
+
+// AccountMerge folds a duplicate account (source) into the one kept
+// (target). Step is the number of saga steps done.
+type AccountMerge struct {
+	ID            int64      `json:"id"`
+	SourceID      int        `json:"source_id"`
+	TargetID      int        `json:"target_id"`
+	Status        string     `json:"status"`
+	Step          int        `json:"step"`
+	NextStep      string     `json:"next_step,omitempty"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+type MergeRepository interface {
+	// CreateMerge stores a running merge. Either account missing is
+	// ErrNotFound; either already merged away or in an unfinished merge
+	// is errMergeConflict.
+	CreateMerge(ctx context.Context, m *AccountMerge) error
+	Merge(ctx context.Context, id int64) (*AccountMerge, error)
+	// Merges lists merges, newest first; status "" lists all
+	Merges(ctx context.Context, status string) ([]AccountMerge, error)
+	// UpdateMerge locks the merge, lets fn change it and saves it
+	UpdateMerge(ctx context.Context, id int64, fn func(*AccountMerge) error) (*AccountMerge, error)
+	// ClaimDueMerges returns running merges due another attempt and
+	// pushes that back by lease, so other replicas skip them
+	ClaimDueMerges(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]AccountMerge, error)
+	// FoldUser moves what user-service keeps of source to target and
+	// makes source an alias of target. Running it again changes nothing.
+	FoldUser(ctx context.Context, sourceID, targetID int) error
+}
+
+const mergeColumns = `id, source_id, target_id, status, step, attempts, last_error, next_attempt_at,
+              created_at, updated_at, completed_at`
+
+func scanMerge(scan func(...any) error, m *AccountMerge) error {
+	return scan(&m.ID, &m.SourceID, &m.TargetID, &m.Status, &m.Step, &m.Attempts, &m.LastError,
+		&m.NextAttemptAt, &m.CreatedAt, &m.UpdatedAt, &m.CompletedAt)
+}
+
+func (r *PostgresUserRepository) queryMerges(ctx context.Context, query string, args ...any) ([]AccountMerge, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var merges []AccountMerge
+	for rows.Next() {
+		var m AccountMerge
+		if err := scanMerge(rows.Scan, &m); err != nil {
+			return nil, err
+		}
+		merges = append(merges, m)
+	}
+	return merges, rows.Err()
+}
+
+func (r *PostgresUserRepository) CreateMerge(ctx context.Context, m *AccountMerge) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		// Locking both accounts serializes merges that share one
+		var found int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM (
+                  SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE) u`,
+			m.SourceID, m.TargetID).Scan(&found); err != nil {
+			return err
+		}
+		if found != 2 {
+			return ErrNotFound
+		}
+		var busy bool
+		if err := tx.QueryRowContext(ctx, `SELECT
+                  EXISTS (SELECT 1 FROM user_aliases WHERE alias_id IN ($1, $2))
+                  OR EXISTS (SELECT 1 FROM account_merges WHERE status <> 'completed'
+                      AND (source_id IN ($1, $2) OR target_id IN ($1, $2)))`,
+			m.SourceID, m.TargetID).Scan(&busy); err != nil {
+			return err
+		}
+		if busy {
+			return errMergeConflict
+		}
+
+		err := scanMerge(tx.QueryRowContext(ctx, `INSERT INTO account_merges (source_id, target_id, status, next_attempt_at)
+              VALUES ($1, $2, $3, $4) RETURNING `+mergeColumns,
+			m.SourceID, m.TargetID, m.Status, m.NextAttemptAt).Scan, m)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *PostgresUserRepository) Merge(ctx context.Context, id int64) (*AccountMerge, error) {
+	var m AccountMerge
+	err := scanMerge(r.db.QueryRowContext(ctx, `SELECT `+mergeColumns+` FROM account_merges WHERE id = $1`, id).Scan, &m)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r *PostgresUserRepository) Merges(ctx context.Context, status string) ([]AccountMerge, error) {
+	return r.queryMerges(ctx, `SELECT `+mergeColumns+` FROM account_merges
+              WHERE $1 = '' OR status = $1 ORDER BY id DESC`, status)
+}
+
+func (r *PostgresUserRepository) UpdateMerge(ctx context.Context, id int64, fn func(*AccountMerge) error) (*AccountMerge, error) {
+	var merge *AccountMerge
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var m AccountMerge
+		err := scanMerge(tx.QueryRowContext(ctx, `SELECT `+mergeColumns+` FROM account_merges WHERE id = $1 FOR UPDATE`, id).Scan, &m)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&m); err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, `UPDATE account_merges
+              SET status = $2, step = $3, attempts = $4, last_error = $5, next_attempt_at = $6,
+                  completed_at = $7, updated_at = now()
+              WHERE id = $1 RETURNING updated_at`,
+			id, m.Status, m.Step, m.Attempts, m.LastError, m.NextAttemptAt, m.CompletedAt).Scan(&m.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		merge = &m
+		return nil
+	})
+	return merge, err
+}
+
+func (r *PostgresUserRepository) ClaimDueMerges(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]AccountMerge, error) {
+	// The outer SELECT sees the rows as they were before the lease
+	return r.queryMerges(ctx, `WITH leased AS (
+                  UPDATE account_merges SET next_attempt_at = $2
+                  WHERE id IN (
+                      SELECT id FROM account_merges
+                      WHERE status = 'running' AND next_attempt_at <= $1
+                      ORDER BY next_attempt_at LIMIT $3
+                      FOR UPDATE SKIP LOCKED)
+                  RETURNING id)
+              SELECT `+mergeColumns+` FROM account_merges WHERE id IN (SELECT id FROM leased)`,
+		now, now.Add(lease), limit)
+}
+
+func (r *PostgresUserRepository) FoldUser(ctx context.Context, sourceID, targetID int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		// The target's own profile wins; the source only fills its gaps.
+		// Marketing consent is the target's alone.
+		statements := []string{
+			`SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE`,
+			`UPDATE users t SET phone = COALESCE(t.phone, s.phone), locale = COALESCE(t.locale, s.locale),
+             timezone = COALESCE(t.timezone, s.timezone), address = COALESCE(t.address, s.address)
+         FROM users s WHERE s.id = $1 AND t.id = $2`,
+			`INSERT INTO wishlist_items (user_id, product, note, price, added_at)
+         SELECT $2, product, note, price, added_at FROM wishlist_items WHERE user_id = $1
+         ON CONFLICT (user_id, product) DO NOTHING`,
+			`DELETE FROM wishlist_items WHERE user_id = $1`,
+			`UPDATE users SET merged_into = $2, claim_token_hash = NULL WHERE id = $1`,
+			`UPDATE impersonations SET user_id = $2 WHERE user_id = $1`,
+			`UPDATE account_activity SET user_id = $2 WHERE user_id = $1`,
+			`INSERT INTO known_devices (user_id, fingerprint, network, device, first_seen, last_seen)
+         SELECT $2, fingerprint, network, device, first_seen, last_seen FROM known_devices WHERE user_id = $1
+         ON CONFLICT (user_id, fingerprint, network) DO NOTHING`,
+			`DELETE FROM known_devices WHERE user_id = $1`,
+			`DELETE FROM login_challenges WHERE user_id = $1`,
+			// The target signs in with its own second factor, if any
+			`DELETE FROM recovery_codes WHERE user_id = $1`,
+			`DELETE FROM two_factor WHERE user_id = $1`,
+			`INSERT INTO group_members (group_id, user_id)
+         SELECT group_id, $2 FROM group_members WHERE user_id = $1
+         ON CONFLICT DO NOTHING`,
+			`DELETE FROM group_members WHERE user_id = $1`,
+			// Organizations keep their owners when one is merged away
+			`INSERT INTO org_members (org_id, user_id, role, added_at)
+         SELECT org_id, $2, role, added_at FROM org_members WHERE user_id = $1
+         ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role WHERE EXCLUDED.role = 'owner'`,
+			`DELETE FROM org_members WHERE user_id = $1`,
+			`UPDATE user_aliases SET user_id = $2 WHERE user_id = $1`,
+			`INSERT INTO user_aliases (alias_id, user_id) VALUES ($1, $2)
+         ON CONFLICT (alias_id) DO UPDATE SET user_id = EXCLUDED.user_id`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt, sourceID, targetID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// busy reports whether id is merged away or in an unfinished merge; r.mu
+// must be held
+func (r *MemoryUserRepository) busy(id int) bool {
+	if _, ok := r.aliases[id]; ok {
+		return true
+	}
+	for _, m := range r.merges {
+		if m.Status != MergeCompleted && (m.SourceID == id || m.TargetID == id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MemoryUserRepository) CreateMerge(ctx context.Context, m *AccountMerge) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range []int{m.SourceID, m.TargetID} {
+		if _, ok := r.users[id]; !ok {
+			return ErrNotFound
+		}
+	}
+	if r.busy(m.SourceID) || r.busy(m.TargetID) {
+		return errMergeConflict
+	}
+	m.ID = int64(len(r.merges) + 1)
+	m.CreatedAt = clock.System.Now()
+	m.UpdatedAt = m.CreatedAt
+	c := *m
+	r.merges = append(r.merges, &c)
+	return nil
+}
+
+func (r *MemoryUserRepository) Merge(ctx context.Context, id int64) (*AccountMerge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id < 1 || id > int64(len(r.merges)) {
+		return nil, ErrNotFound
+	}
+	m := *r.merges[id-1]
+	return &m, nil
+}
+
+func (r *MemoryUserRepository) Merges(ctx context.Context, status string) ([]AccountMerge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var merges []AccountMerge
+	for i := len(r.merges) - 1; i >= 0; i-- {
+		if m := r.merges[i]; status == "" || m.Status == status {
+			merges = append(merges, *m)
+		}
+	}
+	return merges, nil
+}
+
+func (r *MemoryUserRepository) UpdateMerge(ctx context.Context, id int64, fn func(*AccountMerge) error) (*AccountMerge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > int64(len(r.merges)) {
+		return nil, ErrNotFound
+	}
+	m := *r.merges[id-1]
+	if err := fn(&m); err != nil {
+		return nil, err
+	}
+	m.UpdatedAt = clock.System.Now()
+	*r.merges[id-1] = m
+	return &m, nil
+}
+
+func (r *MemoryUserRepository) ClaimDueMerges(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]AccountMerge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []AccountMerge
+	for _, m := range r.merges {
+		if len(due) == limit {
+			break
+		}
+		if m.Status != MergeRunning || m.NextAttemptAt.After(now) {
+			continue
+		}
+		due = append(due, *m)
+		m.NextAttemptAt = now.Add(lease)
+	}
+	return due, nil
+}
+
+func (r *MemoryUserRepository) FoldUser(ctx context.Context, sourceID, targetID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	source, ok := r.users[sourceID]
+	target, ok2 := r.users[targetID]
+	if !ok || !ok2 {
+		return ErrNotFound
+	}
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&target.Profile.Phone, source.Profile.Phone)
+	fill(&target.Profile.Locale, source.Profile.Locale)
+	fill(&target.Profile.Timezone, source.Profile.Timezone)
+	fill(&target.Address, source.Address)
+	r.users[targetID] = target
+
+	var kept []WishlistItem
+	for _, item := range r.wishlist {
+		if item.UserID != sourceID {
+			kept = append(kept, item)
+		}
+	}
+	for _, item := range r.wishlist {
+		if item.UserID == sourceID && !slices.ContainsFunc(kept, func(w WishlistItem) bool {
+			return w.UserID == targetID && w.Product == item.Product
+		}) {
+			item.UserID = targetID
+			kept = append(kept, item)
+		}
+	}
+	r.wishlist = kept
+	for i := range r.impersonations {
+		if r.impersonations[i].UserID == sourceID {
+			r.impersonations[i].UserID = targetID
+		}
+	}
+	for i := range r.activity {
+		if r.activity[i].UserID == sourceID {
+			r.activity[i].UserID = targetID
+		}
+	}
+	var devices []KnownDevice
+	for _, d := range r.devices {
+		if d.UserID == sourceID {
+			if slices.ContainsFunc(r.devices, func(t KnownDevice) bool {
+				return t.UserID == targetID && t.Fingerprint == d.Fingerprint && t.Network == d.Network
+			}) {
+				continue
+			}
+			d.UserID = targetID
+		}
+		devices = append(devices, d)
+	}
+	r.devices = devices
+	for id, c := range r.challenges {
+		if c.UserID == sourceID {
+			delete(r.challenges, id)
+		}
+	}
+	delete(r.twoFactor, sourceID)
+	delete(r.recoveryCodes, sourceID)
+	for _, g := range r.groups {
+		for i, m := range g.Members {
+			if m.UserID == sourceID {
+				g.Members[i].UserID = targetID
+			}
+		}
+		g.Members = memberIDs(g.Members)
+	}
+	var orgMembers []Membership
+	for _, m := range r.orgMembers {
+		if m.UserID == sourceID {
+			continue
+		}
+		if m.UserID == targetID && m.Role != OrgOwner && slices.ContainsFunc(r.orgMembers, func(s Membership) bool {
+			return s.OrgID == m.OrgID && s.UserID == sourceID && s.Role == OrgOwner
+		}) {
+			m.Role = OrgOwner
+		}
+		orgMembers = append(orgMembers, m)
+	}
+	for _, m := range r.orgMembers {
+		if m.UserID == sourceID && !slices.ContainsFunc(r.orgMembers, func(t Membership) bool {
+			return t.OrgID == m.OrgID && t.UserID == targetID
+		}) {
+			m.UserID = targetID
+			orgMembers = append(orgMembers, m)
+		}
+	}
+	r.orgMembers = orgMembers
+
+	for hash, id := range r.claims {
+		if id == sourceID {
+			delete(r.claims, hash)
+		}
+	}
+	for alias, to := range r.aliases {
+		if to == sourceID {
+			r.aliases[alias] = targetID
+		}
+	}
+	r.aliases[sourceID] = targetID
+	return nil
+}
+
+// mergeStep is one step of the merge saga. Steps must be idempotent: one
+// that fails after its service acted is run again.
+type mergeStep struct {
+	name string
+	run  func(ctx context.Context, m *AccountMerge) error
+}
+
+// Merges runs account merges: each service holding user data re-points the
+// source's records to the target, then user-service folds the accounts
+// together. Progress is saved after each step, so a merge interrupted by a
+// failure or a restart carries on from where it stopped.
+type Merges struct {
+	repo   MergeRepository
+	events *events.Emitter
+	clock  clock.Clock
+	steps  []mergeStep
+	// tokens sign the admin token the services' merge endpoints want; nil
+	// when auth is off
+	tokens *auth.Tokens
+	client *http.Client
+}
+
+// NewMerges takes the base URLs of the services whose records follow the
+// merged account
+func NewMerges(repo MergeRepository, emitter *events.Emitter, tokens *auth.Tokens, orderServiceURL, paymentServiceURL, notificationServiceURL string) *Merges {
+	s := &Merges{
+		repo:   repo,
+		events: emitter,
+		clock:  clock.System,
+		tokens: tokens,
+		client: &http.Client{Timeout: mergeStepTimeout},
+	}
+	s.steps = []mergeStep{
+		s.remoteStep("orders", orderServiceURL, "/users/%d/merge"),
+		s.remoteStep("payments", paymentServiceURL, "/users/%d/merge"),
+		s.remoteStep("notifications", notificationServiceURL, "/notifications/users/%d/merge"),
+		{name: "users", run: func(ctx context.Context, m *AccountMerge) error {
+			return repo.FoldUser(ctx, m.SourceID, m.TargetID)
+		}},
+	}
+	return s
+}
+
+// remoteStep asks a service to move the source's records, posting
+// {"into": target} to path at baseURL as an admin
+func (s *Merges) remoteStep(service, baseURL, path string) mergeStep {
+	return mergeStep{name: service, run: func(ctx context.Context, m *AccountMerge) error {
+		if baseURL == "" {
+			return fmt.Errorf("no URL configured for %s", service)
+		}
+		body, _ := json.Marshal(map[string]int{"into": m.TargetID})
+		url := baseURL + fmt.Sprintf(path, m.SourceID)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.tokens != nil {
+			token, err := s.tokens.Issue(auth.Claims{Subject: "user-service", Roles: []string{"admin"}}, time.Minute)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		middleware.Propagate(ctx, req)
+
+		start := time.Now()
+		resp, err := s.client.Do(req)
+		middleware.RecordUpstream(ctx, service, time.Since(start))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s answered %s", service, resp.Status)
+		}
+		return nil
+	}}
+}
+
+// describe fills in the name of the step a merge is on
+func (s *Merges) describe(m *AccountMerge) *AccountMerge {
+	if m.Status != MergeCompleted && m.Step < len(s.steps) {
+		m.NextStep = s.steps[m.Step].name
+	}
+	return m
+}
+
+// Run carries on due merges every interval until ctx is done
+func (s *Merges) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			due, err := s.repo.ClaimDueMerges(ctx, s.clock.Now(), mergeLease, 20)
+			if err != nil {
+				log.Printf("claim due merges: %v", err)
+				continue
+			}
+			for _, m := range due {
+				if err := s.advance(ctx, &m); err != nil {
+					log.Printf("merge %d: %v", m.ID, err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// advance runs m's remaining steps, which the caller must hold the lease on
+func (s *Merges) advance(ctx context.Context, m *AccountMerge) error {
+	for m.Step < len(s.steps) {
+		step := s.steps[m.Step]
+		stepCtx, cancel := context.WithTimeout(ctx, mergeStepTimeout)
+		err := step.run(stepCtx, m)
+		cancel()
+		if err != nil {
+			return s.failed(ctx, m, step.name, err)
+		}
+
+		done := m.Step
+		updated, err := s.repo.UpdateMerge(ctx, m.ID, func(c *AccountMerge) error {
+			if c.Status != MergeRunning || c.Step != done {
+				return errMergeMoved
+			}
+			c.Step++
+			c.Attempts, c.LastError = 0, ""
+			if c.Step == len(s.steps) {
+				now := s.clock.Now()
+				c.Status, c.CompletedAt = MergeCompleted, &now
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		m = updated
+	}
+
+	s.events.Emit(ctx, "user.merged", fmt.Sprintf("user/%d", m.TargetID), map[string]any{
+		"merge_id":  m.ID,
+		"source_id": m.SourceID,
+		"target_id": m.TargetID,
+	})
+	return nil
+}
+
+// failed schedules another attempt at the step, backing off, or fails the
+// merge once the attempts are used up
+func (s *Merges) failed(ctx context.Context, m *AccountMerge, step string, cause error) error {
+	updated, err := s.repo.UpdateMerge(ctx, m.ID, func(c *AccountMerge) error {
+		if c.Status != MergeRunning || c.Step != m.Step {
+			return errMergeMoved
+		}
+		c.Attempts++
+		c.LastError = fmt.Sprintf("%s: %v", step, cause)
+		c.NextAttemptAt = s.clock.Now().Add(time.Duration(1<<min(c.Attempts-1, 6)) * 30 * time.Second)
+		if c.Attempts >= maxMergeAttempts {
+			c.Status = MergeFailed
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if updated.Status == MergeFailed {
+		s.events.Emit(ctx, "user.merge_failed", fmt.Sprintf("user/%d", m.TargetID), s.describe(updated))
+	}
+	return fmt.Errorf("%s: %w", step, cause)
+}
+
+// rearm readies an unfinished merge to run again from the step it stopped
+// at, leased to the caller
+func (s *Merges) rearm(c *AccountMerge) error {
+	if c.Status == MergeCompleted {
+		return errMergeCompleted
+	}
+	c.Status = MergeRunning
+	c.Attempts = 0
+	c.NextAttemptAt = s.clock.Now().Add(mergeLease)
+	return nil
+}
+
+// start runs a merge the caller just leased in the background, outliving
+// the request that started it
+func (s *Merges) start(ctx context.Context, m *AccountMerge) {
+	ctx = context.WithoutCancel(ctx)
+	c := *m
+	go func() {
+		if err := s.advance(ctx, &c); err != nil {
+			log.Printf("merge %d: %v", m.ID, err)
+		}
+	}()
+}
+
+// MergeAPI serves /account-merges to admins
+type MergeAPI struct {
+	repo   MergeRepository
+	merges *Merges
+}
+
+func (a *MergeAPI) writeMerge(w http.ResponseWriter, status int, m *AccountMerge) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(a.merges.describe(m))
+}
+
+// Create starts merging source_id into target_id. The merge runs in the
+// background; poll GET /account-merges/{id} for its progress.
+func (a *MergeAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var m AccountMerge
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.SourceID <= 0 || m.TargetID <= 0 || m.SourceID == m.TargetID {
+		i18n.Error(w, r, http.StatusBadRequest, "merge.invalid")
+		return
+	}
+
+	// Created leased to this replica, which starts it at once
+	m.Status = MergeRunning
+	m.NextAttemptAt = a.merges.clock.Now().Add(mergeLease)
+	err := a.repo.CreateMerge(r.Context(), &m)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if errors.Is(err, errMergeConflict) {
+		i18n.Error(w, r, http.StatusConflict, "merge.conflict")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	a.merges.start(r.Context(), &m)
+	a.writeMerge(w, http.StatusAccepted, &m)
+}
+
+// List takes an optional status filter
+func (a *MergeAPI) List(w http.ResponseWriter, r *http.Request) {
+	merges, err := a.repo.Merges(r.Context(), r.URL.Query().Get("status"))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	for i := range merges {
+		a.merges.describe(&merges[i])
+	}
+	if merges == nil {
+		merges = []AccountMerge{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merges)
+}
+
+func (a *MergeAPI) mergeID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(router.Param(r, "id"), 10, 64)
+	if err != nil {
+		i18n.Error(w, r, http.StatusNotFound, "merge.not_found")
+		return 0, false
+	}
+	return id, true
+}
+
+func (a *MergeAPI) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := a.mergeID(w, r)
+	if !ok {
+		return
+	}
+	m, err := a.repo.Merge(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "merge.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writeMerge(w, http.StatusOK, m)
+}
+
+// Resume retries a failed merge, or a running one now rather than at its
+// next attempt, from the step it stopped at
+func (a *MergeAPI) Resume(w http.ResponseWriter, r *http.Request) {
+	id, ok := a.mergeID(w, r)
+	if !ok {
+		return
+	}
+	m, err := a.repo.UpdateMerge(r.Context(), id, a.merges.rearm)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		i18n.Error(w, r, http.StatusNotFound, "merge.not_found")
+		return
+	case errors.Is(err, errMergeCompleted):
+		i18n.Error(w, r, http.StatusConflict, "merge.completed")
+		return
+	case err != nil:
+		dbretry.Error(w, err)
+		return
+	}
+
+	a.merges.start(r.Context(), m)
+	a.writeMerge(w, http.StatusAccepted, m)
+}
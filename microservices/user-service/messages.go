@@ -0,0 +1,18 @@
+// user-service/messages.go
+package main
+
+import (
+	"embed"
+	"io/fs"
+
+	"platform/i18n"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// loadMessages reads the embedded catalogs; English is the fallback
+func loadMessages() (*i18n.Bundle, error) {
+	sub, _ := fs.Sub(localeFiles, "locales")
+	return i18n.Load(sub, "en")
+}
@@ -0,0 +1,18 @@
+// user-service/migrations.go
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Schema owned by user-service; its migrations may not touch any other
+const schema = "users"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func migrations() fs.FS {
+	sub, _ := fs.Sub(migrationFiles, "migrations")
+	return sub
+}
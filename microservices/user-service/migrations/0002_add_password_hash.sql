@@ -0,0 +1,3 @@
+-- Users created before passwords existed have none and cannot log in
+-- until they set one.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
@@ -0,0 +1,12 @@
+-- Products a user saved for later. price is the last price they were told
+-- about; a catalog price below it notifies them.
+CREATE TABLE IF NOT EXISTS wishlist_items (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    product TEXT NOT NULL,
+    note TEXT NOT NULL DEFAULT '',
+    price NUMERIC(12, 2),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, product)
+);
+
+CREATE INDEX IF NOT EXISTS wishlist_items_product_idx ON wishlist_items (product);
@@ -0,0 +1,10 @@
+-- Guests check out without registering. A guest is claimed either by
+-- registering with its email, which turns it into a regular user, or by an
+-- existing account presenting its claim token, which merges it into them.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS guest BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS address TEXT,
+    ADD COLUMN IF NOT EXISTS claim_token_hash TEXT,
+    ADD COLUMN IF NOT EXISTS merged_into INTEGER REFERENCES users (id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_claim_token_hash_idx ON users (claim_token_hash);
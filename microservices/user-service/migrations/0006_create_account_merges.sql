@@ -0,0 +1,30 @@
+-- Admins merge duplicate accounts into one. A merge runs as a saga over
+-- the services holding user data; step is the next one to run, so a merge
+-- interrupted part way resumes there.
+CREATE TABLE IF NOT EXISTS account_merges (
+    id BIGSERIAL PRIMARY KEY,
+    source_id INTEGER NOT NULL REFERENCES users (id),
+    target_id INTEGER NOT NULL REFERENCES users (id),
+    status TEXT NOT NULL DEFAULT 'running',
+    step INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+-- An account takes part in one unfinished merge at a time
+CREATE UNIQUE INDEX IF NOT EXISTS account_merges_source_idx ON account_merges (source_id) WHERE status <> 'completed';
+CREATE UNIQUE INDEX IF NOT EXISTS account_merges_target_idx ON account_merges (target_id) WHERE status <> 'completed';
+CREATE INDEX IF NOT EXISTS account_merges_due_idx ON account_merges (next_attempt_at) WHERE status = 'running';
+
+-- Merged-away IDs keep resolving to the account they went into
+CREATE TABLE IF NOT EXISTS user_aliases (
+    alias_id INTEGER PRIMARY KEY REFERENCES users (id),
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_aliases_user_id_idx ON user_aliases (user_id);
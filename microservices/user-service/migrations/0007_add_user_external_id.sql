@@ -0,0 +1,8 @@
+-- Clients may give a user their own ID, unique within their tenant, so that
+-- syncing users from another system is safe to repeat
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS external_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_external_id_idx ON users (tenant, external_id)
+    WHERE external_id IS NOT NULL;
@@ -0,0 +1,20 @@
+-- Tenants are provisioned and deleted by sagas over the services; step is
+-- the next one to run, so a saga interrupted part way resumes there.
+-- Deleted tenants stay, so their IDs aren't reused.
+CREATE TABLE IF NOT EXISTS tenants (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    plan TEXT NOT NULL,
+    webhook_url TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'provisioning',
+    step INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    stalled BOOLEAN NOT NULL DEFAULT false,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS tenants_due_idx ON tenants (next_attempt_at)
+    WHERE status IN ('provisioning', 'deleting') AND NOT stalled;
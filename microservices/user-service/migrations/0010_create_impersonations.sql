@@ -0,0 +1,13 @@
+-- Support sessions in which an admin acted as a user. The user sees them
+-- in their account activity; the requests made are in the services' audit
+-- logs under the session's ID.
+CREATE TABLE IF NOT EXISTS impersonations (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    admin TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS impersonations_user_idx ON impersonations (user_id, created_at);
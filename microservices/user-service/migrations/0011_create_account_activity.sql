@@ -0,0 +1,24 @@
+-- Security-relevant events on accounts, for users to review their own:
+-- sign-ins, profile changes and support sessions, with who made them and
+-- from where.
+CREATE TABLE IF NOT EXISTS account_activity (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    session TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    detail JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS account_activity_user_idx ON account_activity (user_id, id);
+
+-- Support sessions so far were shown from impersonations
+INSERT INTO account_activity (user_id, type, actor, session, detail, created_at)
+SELECT user_id, 'impersonation', admin, id,
+       jsonb_build_object('reason', reason, 'until', expires_at), created_at
+FROM impersonations
+WHERE NOT EXISTS (SELECT 1 FROM account_activity)
+ORDER BY created_at;
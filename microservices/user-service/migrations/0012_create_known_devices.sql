@@ -0,0 +1,26 @@
+-- Devices and networks users signed in from, so a login from a new one can
+-- be told to the user or confirmed by them. A device seen on two networks
+-- has two rows.
+CREATE TABLE IF NOT EXISTS known_devices (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    fingerprint TEXT NOT NULL,
+    network TEXT NOT NULL,
+    device TEXT NOT NULL DEFAULT '',
+    first_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, fingerprint, network)
+);
+
+-- Logins from new devices waiting for the code emailed to the user
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    network TEXT NOT NULL,
+    device TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_challenges_user_idx ON login_challenges (user_id);
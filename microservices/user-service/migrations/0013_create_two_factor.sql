@@ -0,0 +1,24 @@
+-- TOTP second factors. A secret is enabled once a code from it has been
+-- confirmed; last_step is the time step of the last code used, so no code
+-- is used twice. Recovery codes are for when the authenticator is lost,
+-- and each is good once.
+CREATE TABLE IF NOT EXISTS two_factor (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    enabled_at TIMESTAMPTZ,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- Logins held back for a TOTP code rather than an emailed one
+ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS method TEXT NOT NULL DEFAULT 'email';
+
+-- Tenants can require their users to sign in with a second factor
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS require_two_factor BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,15 @@
+-- Partner integrations get tokens for a tenant with the OAuth2 client
+-- credentials grant. Secrets are kept hashed; scopes are space-separated,
+-- as in the token request. Revoked clients are kept for the record.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id TEXT PRIMARY KEY,
+    tenant TEXT NOT NULL REFERENCES tenants (id),
+    name TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    rate_limit INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_tenant_idx ON oauth_clients (tenant, created_at);
@@ -0,0 +1,412 @@
+// user-service/oauth.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/publicid"
+	"platform/quota"
+	"platform/router"
+)
+
+const (
+	defaultOAuthTokenTTL = time.Hour
+	// maxClientRateLimit is the most requests a minute a client can be let
+	// make
+	maxClientRateLimit = 100000
+)
+
+// OAuthClient is a partner integration acting for a tenant. It trades its
+// ID and secret for short-lived tokens limited to its scopes.
+type OAuthClient struct {
+	ID     string   `json:"client_id"`
+	Tenant string   `json:"tenant"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is requests a minute at the gateway, 0 for its default
+	RateLimit  int        `json:"rate_limit"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	SecretHash string     `json:"-"`
+	// Secret is returned once, when the client is registered
+	Secret string `json:"client_secret,omitempty"`
+}
+
+type OAuthClientRepository interface {
+	CreateOAuthClient(ctx context.Context, c *OAuthClient) error
+	OAuthClient(ctx context.Context, id string) (*OAuthClient, error)
+	// OAuthClients lists a tenant's clients, revoked ones too, oldest first
+	OAuthClients(ctx context.Context, tenant string) ([]OAuthClient, error)
+	// RevokeOAuthClient revokes the tenant's client; revoking it again
+	// keeps the first time
+	RevokeOAuthClient(ctx context.Context, tenant, id string, at time.Time) (*OAuthClient, error)
+}
+
+const oauthClientColumns = `id, tenant, name, secret_hash, scopes, rate_limit, created_at, revoked_at`
+
+func scanOAuthClient(scan func(...any) error, c *OAuthClient) error {
+	var scopes string
+	var revokedAt sql.NullTime
+	if err := scan(&c.ID, &c.Tenant, &c.Name, &c.SecretHash, &scopes, &c.RateLimit, &c.CreatedAt, &revokedAt); err != nil {
+		return err
+	}
+	c.Scopes = strings.Fields(scopes)
+	c.RevokedAt = nil
+	if revokedAt.Valid {
+		c.RevokedAt = &revokedAt.Time
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) CreateOAuthClient(ctx context.Context, c *OAuthClient) error {
+	c.ID = publicid.New()
+	return r.db.QueryRowContext(ctx, `INSERT INTO oauth_clients (id, tenant, name, secret_hash, scopes, rate_limit)
+              VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at`,
+		c.ID, c.Tenant, c.Name, c.SecretHash, strings.Join(c.Scopes, " "), c.RateLimit).Scan(&c.CreatedAt)
+}
+
+func (r *PostgresUserRepository) OAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	var c OAuthClient
+	err := scanOAuthClient(r.db.QueryRowContext(ctx, `SELECT `+oauthClientColumns+` FROM oauth_clients WHERE id = $1`, id).Scan, &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *PostgresUserRepository) OAuthClients(ctx context.Context, tenant string) ([]OAuthClient, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+oauthClientColumns+` FROM oauth_clients
+              WHERE tenant = $1 ORDER BY created_at, id`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []OAuthClient
+	for rows.Next() {
+		var c OAuthClient
+		if err := scanOAuthClient(rows.Scan, &c); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+func (r *PostgresUserRepository) RevokeOAuthClient(ctx context.Context, tenant, id string, at time.Time) (*OAuthClient, error) {
+	var c OAuthClient
+	err := scanOAuthClient(r.db.QueryRowContext(ctx, `UPDATE oauth_clients SET revoked_at = COALESCE(revoked_at, $3)
+              WHERE id = $1 AND tenant = $2 RETURNING `+oauthClientColumns, id, tenant, at).Scan, &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *MemoryUserRepository) CreateOAuthClient(ctx context.Context, c *OAuthClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c.ID = publicid.New()
+	c.CreatedAt = clock.System.Now()
+	stored := *c
+	stored.Scopes = slices.Clone(c.Scopes)
+	stored.Secret = ""
+	r.oauthClients = append(r.oauthClients, stored)
+	return nil
+}
+
+func (r *MemoryUserRepository) OAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.oauthClients {
+		if c.ID == id {
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryUserRepository) OAuthClients(ctx context.Context, tenant string) ([]OAuthClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var clients []OAuthClient
+	for _, c := range r.oauthClients {
+		if c.Tenant == tenant {
+			clients = append(clients, c)
+		}
+	}
+	return clients, nil
+}
+
+func (r *MemoryUserRepository) RevokeOAuthClient(ctx context.Context, tenant, id string, at time.Time) (*OAuthClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.oauthClients {
+		c := &r.oauthClients[i]
+		if c.ID == id && c.Tenant == tenant {
+			if c.RevokedAt == nil {
+				c.RevokedAt = &at
+			}
+			revoked := *c
+			return &revoked, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func writeOAuth(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newClientSecret returns a random 256-bit secret
+func newClientSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OAuthAPI registers partner clients for tenants, for admins, and serves
+// the client credentials grant (RFC 6749, section 4.4) at POST /oauth/token
+type OAuthAPI struct {
+	repo   Repository
+	tokens *auth.Tokens
+	events *events.Emitter
+	ttl    time.Duration
+	clock  clock.Clock
+}
+
+// oauthFromEnv issues tokens good for OAUTH_TOKEN_TTL (an hour by default)
+func oauthFromEnv(repo Repository, tokens *auth.Tokens, emitter *events.Emitter) *OAuthAPI {
+	a := &OAuthAPI{repo: repo, tokens: tokens, events: emitter, ttl: defaultOAuthTokenTTL, clock: clock.System}
+	if v := os.Getenv("OAUTH_TOKEN_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("invalid OAUTH_TOKEN_TTL %q", v)
+		}
+		a.ttl = ttl
+	}
+	return a
+}
+
+type createOAuthClientRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	RateLimit int      `json:"rate_limit"`
+}
+
+// CreateClient serves POST /tenants/{id}/oauth-clients, answering with the
+// client's secret, which isn't shown again
+func (a *OAuthAPI) CreateClient(w http.ResponseWriter, r *http.Request) {
+	var req createOAuthClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "oauth.name_required")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "oauth.scopes_required")
+		return
+	}
+	for _, s := range req.Scopes {
+		if _, ok := auth.OAuthScopes[s]; !ok {
+			i18n.Error(w, r, http.StatusUnprocessableEntity, "oauth.scope_unknown", s)
+			return
+		}
+	}
+	if req.RateLimit < 0 || req.RateLimit > maxClientRateLimit {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "oauth.rate_limit_invalid", maxClientRateLimit)
+		return
+	}
+
+	ctx := r.Context()
+	t, err := a.repo.Tenant(ctx, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "tenant.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if t.Status == TenantDeleting || t.Status == TenantDeleted {
+		i18n.Error(w, r, http.StatusConflict, "tenant.status", t.Status)
+		return
+	}
+	secret, err := newClientSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slices.Sort(req.Scopes)
+	c := &OAuthClient{Tenant: t.ID, Name: req.Name, Scopes: slices.Compact(req.Scopes), RateLimit: req.RateLimit,
+		// Random like claim tokens, so hashed the same way
+		SecretHash: hashClaimToken(secret)}
+	if err := a.repo.CreateOAuthClient(ctx, c); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.events.Emit(ctx, "oauth_client.created", "oauth_client/"+c.ID, c)
+	c.Secret = secret
+	writeOAuth(w, http.StatusCreated, c)
+}
+
+// ListClients serves GET /tenants/{id}/oauth-clients
+func (a *OAuthAPI) ListClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := a.repo.OAuthClients(r.Context(), router.Param(r, "id"))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if clients == nil {
+		clients = []OAuthClient{}
+	}
+	writeOAuth(w, http.StatusOK, clients)
+}
+
+// RevokeClient serves DELETE /tenants/{id}/oauth-clients/{client}. The
+// client gets no more tokens, and the gateway, hearing of it, refuses the
+// ones it has.
+func (a *OAuthAPI) RevokeClient(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, err := a.repo.RevokeOAuthClient(ctx, router.Param(r, "id"), router.Param(r, "client"), a.clock.Now())
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "oauth.client_not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.events.Emit(ctx, "oauth_client.revoked", "oauth_client/"+c.ID, c)
+	writeOAuth(w, http.StatusOK, c)
+}
+
+// tokenResponse is RFC 6749's, section 5.1
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// tokenError answers with an RFC 6749 error, section 5.2, describing it in
+// the caller's language
+func tokenError(w http.ResponseWriter, r *http.Request, status int, code, key string, args ...any) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeOAuth(w, status, struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}{code, i18n.FromContext(r.Context()).T(key, args...)})
+}
+
+// Token serves POST /oauth/token. The client authenticates with HTTP Basic
+// or client_id and client_secret in the form, and may ask for fewer scopes
+// than it has. The token acts for the client's tenant as an integrator.
+func (a *OAuthAPI) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, r, http.StatusBadRequest, "invalid_request", "oauth.request_invalid")
+		return
+	}
+	if grant := r.PostForm.Get("grant_type"); grant != "client_credentials" {
+		tokenError(w, r, http.StatusBadRequest, "unsupported_grant_type", "oauth.grant_unsupported", grant)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if a.tokens == nil {
+		tokenError(w, r, http.StatusServiceUnavailable, "temporarily_unavailable", "oauth.disabled")
+		return
+	}
+
+	ctx := r.Context()
+	c, err := a.repo.OAuthClient(ctx, id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		dbretry.Error(w, err)
+		return
+	}
+	if c == nil || c.RevokedAt != nil ||
+		subtle.ConstantTimeCompare([]byte(hashClaimToken(secret)), []byte(c.SecretHash)) != 1 {
+		tokenError(w, r, http.StatusUnauthorized, "invalid_client", "oauth.client_invalid")
+		return
+	}
+	t, err := a.repo.Tenant(ctx, c.Tenant)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		dbretry.Error(w, err)
+		return
+	}
+	if t == nil || t.Status != TenantActive {
+		tokenError(w, r, http.StatusUnauthorized, "invalid_client", "oauth.client_invalid")
+		return
+	}
+
+	scopes := c.Scopes
+	if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, s := range requested {
+			if !slices.Contains(c.Scopes, s) {
+				tokenError(w, r, http.StatusBadRequest, "invalid_scope", "oauth.scope_not_granted", s)
+				return
+			}
+		}
+		slices.Sort(requested)
+		scopes = slices.Compact(requested)
+	}
+	token, err := a.tokens.Issue(auth.Claims{
+		Subject:   quota.Subject(c.Tenant, ""),
+		Roles:     []string{"integrator"},
+		Tenant:    c.Tenant,
+		ClientID:  c.ID,
+		Scopes:    scopes,
+		RateLimit: c.RateLimit,
+	}, a.ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeOAuth(w, http.StatusOK, tokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(a.ttl.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,607 @@
+// user-service/orgs.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/publicid"
+	"platform/router"
+)
+
+// Organization roles, most trusted first
+const (
+	OrgOwner   = "owner"
+	OrgManager = "manager"
+	OrgMember  = "member"
+	OrgViewer  = "viewer"
+)
+
+// What roles allow; order-service checks the order permissions
+const (
+	permPlaceOrders   = "place_orders"
+	permViewOrders    = "view_orders"
+	permManageOrders  = "manage_orders"
+	permManageMembers = "manage_members"
+)
+
+// orgRoles maps roles to their permissions. Members order for the
+// organization but, like anyone, see only their own orders; viewers see
+// all of its orders but can't place any.
+var orgRoles = map[string][]string{
+	OrgOwner:   {permPlaceOrders, permViewOrders, permManageOrders, permManageMembers},
+	OrgManager: {permPlaceOrders, permViewOrders, permManageOrders},
+	OrgMember:  {permPlaceOrders},
+	OrgViewer:  {permViewOrders},
+}
+
+// errLastOwner refuses a change that would leave an organization without
+// an owner
+var errLastOwner = errors.New("organization needs an owner")
+
+// Organization is a team of users that orders together
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership is a user's role in an organization. The organization's and
+// user's names are filled in on reads.
+type Membership struct {
+	OrgID       string    `json:"org_id"`
+	OrgName     string    `json:"org_name,omitempty"`
+	UserID      int       `json:"user_id"`
+	UserName    string    `json:"user_name,omitempty"`
+	Role        string    `json:"role"`
+	Permissions []string  `json:"permissions"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+func (m *Membership) can(permission string) bool {
+	return slices.Contains(orgRoles[m.Role], permission)
+}
+
+// withPermissions fills in what m's role allows
+func (m *Membership) withPermissions() *Membership {
+	m.Permissions = slices.Clone(orgRoles[m.Role])
+	return m
+}
+
+type OrgRepository interface {
+	// CreateOrg creates org with ownerID as its owner
+	CreateOrg(ctx context.Context, org *Organization, ownerID int) error
+	Org(ctx context.Context, id string) (*Organization, error)
+	Membership(ctx context.Context, orgID string, userID int) (*Membership, error)
+	OrgMembers(ctx context.Context, orgID string) ([]Membership, error)
+	UserOrgs(ctx context.Context, userID int) ([]Membership, error)
+	// SetMembership adds a member or changes their role, and
+	// RemoveMembership takes them out; either fails with errLastOwner
+	// rather than leave the organization without an owner
+	SetMembership(ctx context.Context, m *Membership) error
+	RemoveMembership(ctx context.Context, orgID string, userID int) error
+}
+
+func (r *PostgresUserRepository) CreateOrg(ctx context.Context, org *Organization, ownerID int) error {
+	org.ID = publicid.New()
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `INSERT INTO organizations (id, name) VALUES ($1, $2) RETURNING created_at`,
+			org.ID, org.Name).Scan(&org.CreatedAt); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`,
+			org.ID, ownerID, OrgOwner)
+		return err
+	})
+}
+
+func (r *PostgresUserRepository) Org(ctx context.Context, id string) (*Organization, error) {
+	var org Organization
+	err := r.db.QueryRowContext(ctx, `SELECT id, name, created_at FROM organizations WHERE id = $1`, id).
+		Scan(&org.ID, &org.Name, &org.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+const membershipColumns = `m.org_id, o.name, m.user_id, u.name, m.role, m.added_at
+              FROM org_members m JOIN organizations o ON o.id = m.org_id JOIN users u ON u.id = m.user_id`
+
+func (r *PostgresUserRepository) queryMemberships(ctx context.Context, query string, args ...any) ([]Membership, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+membershipColumns+` `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []Membership
+	for rows.Next() {
+		var m Membership
+		if err := rows.Scan(&m.OrgID, &m.OrgName, &m.UserID, &m.UserName, &m.Role, &m.AddedAt); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, *m.withPermissions())
+	}
+	return memberships, rows.Err()
+}
+
+func (r *PostgresUserRepository) Membership(ctx context.Context, orgID string, userID int) (*Membership, error) {
+	memberships, err := r.queryMemberships(ctx, `WHERE m.org_id = $1 AND m.user_id = $2`, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(memberships) == 0 {
+		return nil, ErrNotFound
+	}
+	return &memberships[0], nil
+}
+
+func (r *PostgresUserRepository) OrgMembers(ctx context.Context, orgID string) ([]Membership, error) {
+	return r.queryMemberships(ctx, `WHERE m.org_id = $1 ORDER BY m.added_at, m.user_id`, orgID)
+}
+
+func (r *PostgresUserRepository) UserOrgs(ctx context.Context, userID int) ([]Membership, error) {
+	return r.queryMemberships(ctx, `WHERE m.user_id = $1 ORDER BY o.name, o.id`, userID)
+}
+
+// changeMembers runs change on an organization's members, holding its row
+// so concurrent changes can't take away its last owner between them
+func (r *PostgresUserRepository) changeMembers(ctx context.Context, orgID string, change func(tx *sql.Tx) error) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var id string
+		err := tx.QueryRowContext(ctx, `SELECT id FROM organizations WHERE id = $1 FOR UPDATE`, orgID).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		var owners int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM org_members WHERE org_id = $1 AND role = $2`,
+			orgID, OrgOwner).Scan(&owners); err != nil {
+			return err
+		}
+		if owners == 0 {
+			return errLastOwner
+		}
+		return nil
+	})
+}
+
+func (r *PostgresUserRepository) SetMembership(ctx context.Context, m *Membership) error {
+	return r.changeMembers(ctx, m.OrgID, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+                  ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role RETURNING added_at`,
+			m.OrgID, m.UserID, m.Role).Scan(&m.AddedAt)
+	})
+}
+
+func (r *PostgresUserRepository) RemoveMembership(ctx context.Context, orgID string, userID int) error {
+	return r.changeMembers(ctx, orgID, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM org_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) CreateOrg(ctx context.Context, org *Organization, ownerID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[ownerID]; !ok {
+		return ErrNotFound
+	}
+	org.ID = publicid.New()
+	org.CreatedAt = clock.System.Now()
+	stored := *org
+	r.orgs[org.ID] = &stored
+	r.orgMembers = append(r.orgMembers, Membership{OrgID: org.ID, UserID: ownerID, Role: OrgOwner, AddedAt: org.CreatedAt})
+	return nil
+}
+
+func (r *MemoryUserRepository) Org(ctx context.Context, id string) (*Organization, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	org, ok := r.orgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *org
+	return &c, nil
+}
+
+// memberships returns the memberships keep selects, names filled in; r.mu
+// must be held
+func (r *MemoryUserRepository) memberships(keep func(m *Membership) bool) []Membership {
+	var memberships []Membership
+	for _, m := range r.orgMembers {
+		if keep(&m) {
+			m.OrgName, m.UserName = r.orgs[m.OrgID].Name, r.users[m.UserID].Name
+			memberships = append(memberships, *m.withPermissions())
+		}
+	}
+	return memberships
+}
+
+func (r *MemoryUserRepository) Membership(ctx context.Context, orgID string, userID int) (*Membership, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	memberships := r.memberships(func(m *Membership) bool { return m.OrgID == orgID && m.UserID == userID })
+	if len(memberships) == 0 {
+		return nil, ErrNotFound
+	}
+	return &memberships[0], nil
+}
+
+func (r *MemoryUserRepository) OrgMembers(ctx context.Context, orgID string) ([]Membership, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.memberships(func(m *Membership) bool { return m.OrgID == orgID }), nil
+}
+
+func (r *MemoryUserRepository) UserOrgs(ctx context.Context, userID int) ([]Membership, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	memberships := r.memberships(func(m *Membership) bool { return m.UserID == userID })
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].OrgName < memberships[j].OrgName })
+	return memberships, nil
+}
+
+// owned reports whether the organization has an owner among members
+func owned(members []Membership, orgID string) bool {
+	return slices.ContainsFunc(members, func(m Membership) bool { return m.OrgID == orgID && m.Role == OrgOwner })
+}
+
+func (r *MemoryUserRepository) SetMembership(ctx context.Context, m *Membership) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orgs[m.OrgID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := r.users[m.UserID]; !ok {
+		return ErrNotFound
+	}
+	members := slices.Clone(r.orgMembers)
+	i := slices.IndexFunc(members, func(o Membership) bool { return o.OrgID == m.OrgID && o.UserID == m.UserID })
+	if i < 0 {
+		m.AddedAt = clock.System.Now()
+		members = append(members, Membership{OrgID: m.OrgID, UserID: m.UserID, Role: m.Role, AddedAt: m.AddedAt})
+	} else {
+		members[i].Role, m.AddedAt = m.Role, members[i].AddedAt
+	}
+	if !owned(members, m.OrgID) {
+		return errLastOwner
+	}
+	r.orgMembers = members
+	return nil
+}
+
+func (r *MemoryUserRepository) RemoveMembership(ctx context.Context, orgID string, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orgs[orgID]; !ok {
+		return ErrNotFound
+	}
+	members := slices.DeleteFunc(slices.Clone(r.orgMembers), func(m Membership) bool {
+		return m.OrgID == orgID && m.UserID == userID
+	})
+	if len(members) == len(r.orgMembers) {
+		return ErrNotFound
+	}
+	if !owned(members, orgID) {
+		return errLastOwner
+	}
+	r.orgMembers = members
+	return nil
+}
+
+// OrgAPI serves organizations and their members. Members see their
+// organization; owners, and admins, manage who is in it.
+type OrgAPI struct {
+	repo   Repository
+	events *events.Emitter
+}
+
+// caller is the user r acts for; admin when the caller is an admin or
+// auth is off
+func caller(r *http.Request) (userID int, admin bool) {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	if !ok || p.HasRole("admin") {
+		return 0, true
+	}
+	userID, _ = strconv.Atoi(p.Subject)
+	return userID, false
+}
+
+// org resolves the path's organization and the caller's membership of it,
+// nil for admins. It is not found for anyone else.
+func (a *OrgAPI) org(w http.ResponseWriter, r *http.Request) (*Organization, *Membership, bool) {
+	ctx := r.Context()
+	org, err := a.repo.Org(ctx, router.Param(r, "id"))
+	var m *Membership
+	userID, admin := caller(r)
+	if err == nil && !admin {
+		m, err = a.repo.Membership(ctx, org.ID, userID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "org.not_found")
+		return nil, nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, nil, false
+	}
+	return org, m, true
+}
+
+// member resolves the path's user, the account they were merged into if
+// they were
+func (a *OrgAPI) member(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	ctx := r.Context()
+	userID, err := resolveUserID(ctx, a.repo, router.Param(r, "user"))
+	var user *User
+	if err == nil {
+		user, err = a.repo.Get(ctx, userID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	return user, true
+}
+
+func (a *OrgAPI) membershipChanged(ctx context.Context, m *Membership) {
+	a.events.Emit(ctx, "org.membership_changed", "org/"+m.OrgID, m)
+}
+
+type createOrgRequest struct {
+	Name string `json:"name"`
+	// OwnerID is who owns the new organization; only admins may name
+	// someone, and users own the ones they create
+	OwnerID int `json:"owner_id"`
+}
+
+// Create serves POST /orgs
+func (a *OrgAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var req createOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 200 {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "org.name_required")
+		return
+	}
+	ownerID, admin := caller(r)
+	if admin {
+		ownerID = req.OwnerID
+	}
+	if ownerID == 0 {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "org.owner_required")
+		return
+	}
+
+	ctx := r.Context()
+	owner, err := a.repo.Get(ctx, ownerID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	org := &Organization{Name: req.Name}
+	if err := a.repo.CreateOrg(ctx, org, owner.ID); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.membershipChanged(ctx, (&Membership{OrgID: org.ID, OrgName: org.Name, UserID: owner.ID, UserName: owner.Name,
+		Role: OrgOwner, AddedAt: org.CreatedAt}).withPermissions())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// Get serves GET /orgs/{id}
+func (a *OrgAPI) Get(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := a.org(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// Members serves GET /orgs/{id}/members
+func (a *OrgAPI) Members(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := a.org(w, r)
+	if !ok {
+		return
+	}
+	members, err := a.repo.OrgMembers(r.Context(), org.ID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// GetMember serves GET /orgs/{id}/members/{user}: what the user may do in
+// the organization, which order-service asks before showing its orders
+func (a *OrgAPI) GetMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	org, err := a.repo.Org(ctx, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "org.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	user, ok := a.member(w, r)
+	if !ok {
+		return
+	}
+	m, err := a.repo.Membership(ctx, org.ID, user.ID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "org.member_not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	// Users see their own role, and members each other's
+	if callerID, admin := caller(r); !admin && callerID != user.ID {
+		if _, err := a.repo.Membership(ctx, org.ID, callerID); err != nil {
+			i18n.Error(w, r, http.StatusNotFound, "org.not_found")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+type membershipRequest struct {
+	Role string `json:"role"`
+}
+
+// SetMember serves PUT /orgs/{id}/members/{user}: adds the user with the
+// role, or gives them it
+func (a *OrgAPI) SetMember(w http.ResponseWriter, r *http.Request) {
+	org, caller, ok := a.org(w, r)
+	if !ok {
+		return
+	}
+	if caller != nil && !caller.can(permManageMembers) {
+		i18n.Error(w, r, http.StatusForbidden, "org.forbidden")
+		return
+	}
+	var req membershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := orgRoles[req.Role]; !ok {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "org.role_invalid")
+		return
+	}
+	user, ok := a.member(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	m := &Membership{OrgID: org.ID, OrgName: org.Name, UserID: user.ID, UserName: user.Name, Role: req.Role}
+	err := a.repo.SetMembership(ctx, m)
+	if errors.Is(err, errLastOwner) {
+		i18n.Error(w, r, http.StatusConflict, "org.last_owner")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.membershipChanged(ctx, m.withPermissions())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// RemoveMember serves DELETE /orgs/{id}/members/{user}, for owners and for
+// members leaving
+func (a *OrgAPI) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	org, caller, ok := a.org(w, r)
+	if !ok {
+		return
+	}
+	user, ok := a.member(w, r)
+	if !ok {
+		return
+	}
+	if caller != nil && caller.UserID != user.ID && !caller.can(permManageMembers) {
+		i18n.Error(w, r, http.StatusForbidden, "org.forbidden")
+		return
+	}
+
+	ctx := r.Context()
+	err := a.repo.RemoveMembership(ctx, org.ID, user.ID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "org.member_not_found")
+		return
+	}
+	if errors.Is(err, errLastOwner) {
+		i18n.Error(w, r, http.StatusConflict, "org.last_owner")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	// A removed member has no role, and so no permissions
+	a.membershipChanged(ctx, &Membership{OrgID: org.ID, OrgName: org.Name, UserID: user.ID, UserName: user.Name,
+		Permissions: []string{}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UserOrgs serves GET /users/{id}/orgs to the user and admins
+func (a *OrgAPI) UserOrgs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := resolveUserID(ctx, a.repo, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if callerID, admin := caller(r); !admin && callerID != userID {
+		i18n.Error(w, r, http.StatusForbidden, "org.forbidden")
+		return
+	}
+	memberships, err := a.repo.UserOrgs(ctx, userID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if memberships == nil {
+		memberships = []Membership{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memberships)
+}
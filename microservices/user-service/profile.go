@@ -0,0 +1,179 @@
+// user-service/profile.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezone validation must not depend on the host
+
+	"platform/dbretry"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// Profile holds the preferences other services act on, e.g. notification
+// language and whether marketing email may be sent
+type Profile struct {
+	Phone          string `json:"phone,omitempty"`
+	Locale         string `json:"locale,omitempty"`
+	Timezone       string `json:"timezone,omitempty"`
+	MarketingOptIn bool   `json:"marketing_opt_in"`
+}
+
+var (
+	phonePattern  = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	localePattern = regexp.MustCompile(`^([a-zA-Z]{2,3})(?:[-_]([a-zA-Z]{2}))?$`)
+)
+
+// profileFields validate and apply one field of a PATCH body; a JSON null
+// clears the field
+var profileFields = map[string]func(p *Profile, raw json.RawMessage) error{
+	"phone": func(p *Profile, raw json.RawMessage) error {
+		return setString(&p.Phone, raw, func(s string) (string, error) {
+			s = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(s)
+			if !phonePattern.MatchString(s) {
+				return "", i18n.NewError("profile.invalid_phone")
+			}
+			return s, nil
+		})
+	},
+	"locale": func(p *Profile, raw json.RawMessage) error {
+		return setString(&p.Locale, raw, func(s string) (string, error) {
+			m := localePattern.FindStringSubmatch(s)
+			if m == nil {
+				return "", i18n.NewError("profile.invalid_locale")
+			}
+			if m[2] == "" {
+				return strings.ToLower(m[1]), nil
+			}
+			return strings.ToLower(m[1]) + "-" + strings.ToUpper(m[2]), nil
+		})
+	},
+	"timezone": func(p *Profile, raw json.RawMessage) error {
+		return setString(&p.Timezone, raw, func(s string) (string, error) {
+			if _, err := time.LoadLocation(s); err != nil || s == "Local" {
+				return "", i18n.NewError("profile.invalid_timezone")
+			}
+			return s, nil
+		})
+	},
+	"marketing_opt_in": func(p *Profile, raw json.RawMessage) error {
+		if string(raw) == "null" {
+			p.MarketingOptIn = false
+			return nil
+		}
+		if err := json.Unmarshal(raw, &p.MarketingOptIn); err != nil {
+			return i18n.NewError("profile.invalid_bool")
+		}
+		return nil
+	},
+}
+
+func setString(field *string, raw json.RawMessage, normalize func(string) (string, error)) error {
+	if string(raw) == "null" {
+		*field = ""
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return i18n.NewError("profile.invalid_string")
+	}
+	if s = strings.TrimSpace(s); s == "" {
+		*field = ""
+		return nil
+	}
+	s, err := normalize(s)
+	if err != nil {
+		return err
+	}
+	*field = s
+	return nil
+}
+
+type validationErrors struct {
+	Errors map[string]string `json:"errors"`
+}
+
+// UpdateProfile applies a partial update: only the fields present in the
+// body change. Users may edit only their own profile unless they are admins.
+func (s *UserService) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := resolveUserID(r.Context(), s.repo, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok &&
+		p.Subject != strconv.Itoa(userID) && !p.HasRole("admin") {
+		i18n.Error(w, r, http.StatusForbidden, "profile.forbidden")
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := s.repo.Get(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+
+	profile := user.Profile
+	loc := i18n.FromContext(ctx)
+	invalid := validationErrors{Errors: make(map[string]string)}
+	changed := make([]string, 0, len(patch))
+	for name, raw := range patch {
+		apply, ok := profileFields[name]
+		if !ok {
+			invalid.Errors[name] = loc.T("profile.unknown_field")
+			continue
+		}
+		if err := apply(&profile, raw); err != nil {
+			invalid.Errors[name] = loc.Text(err)
+			continue
+		}
+		changed = append(changed, name)
+	}
+	if len(invalid.Errors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(invalid)
+		return
+	}
+
+	if err := s.repo.UpdateProfile(ctx, userID, profile); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	user.Profile = profile
+
+	slices.Sort(changed)
+	s.activity.Record(r, Activity{UserID: userID, Type: activityProfileUpdated, Detail: map[string]any{"changed": changed}})
+	s.events.Emit(ctx, "user.profile_updated", fmt.Sprintf("user/%d", userID), map[string]any{
+		"user_id": userID,
+		"changed": changed,
+		"profile": profile,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
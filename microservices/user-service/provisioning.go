@@ -0,0 +1,462 @@
+// user-service/provisioning.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/publicid"
+)
+
+var (
+	// errUserTaken means another user has the email or, in the tenant, the
+	// external ID
+	errUserTaken   = errors.New("email or external ID already used")
+	errGroupExists = errors.New("group already exists")
+)
+
+// UserFilter selects a tenant's users that aren't deleted, merged away or
+// guests, by ID
+type UserFilter struct {
+	Tenant string
+	// Email matches regardless of case
+	Email      string
+	ExternalID string
+	Offset     int
+	Limit      int
+}
+
+// Group is a set of a tenant's users, kept as its identity provider has it
+type Group struct {
+	ID          string
+	Tenant      string
+	DisplayName string
+	ExternalID  string
+	Members     []GroupMember
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// GroupMember is a user in a group; PublicID and Name are filled in on
+// reads
+type GroupMember struct {
+	UserID   int
+	PublicID string
+	Name     string
+}
+
+// GroupFilter selects a tenant's groups oldest first
+type GroupFilter struct {
+	Tenant      string
+	DisplayName string
+	ExternalID  string
+	Offset      int
+	Limit       int
+	// WithoutMembers leaves Members empty, for listings that don't want
+	// them
+	WithoutMembers bool
+}
+
+type ProvisioningRepository interface {
+	// TenantUsers returns a page of the users f selects and how many it
+	// selects in all
+	TenantUsers(ctx context.Context, f UserFilter) ([]User, int, error)
+	// UpdateUser saves what provisioning manages of a user: their name,
+	// email, external ID, and whether they are deactivated or deleted.
+	// Deleting them takes them out of their groups.
+	UpdateUser(ctx context.Context, user *User) error
+	Groups(ctx context.Context, f GroupFilter) ([]Group, int, error)
+	Group(ctx context.Context, tenant, id string) (*Group, error)
+	CreateGroup(ctx context.Context, g *Group) error
+	// UpdateGroup replaces the group's name, external ID and members
+	UpdateGroup(ctx context.Context, g *Group) error
+	DeleteGroup(ctx context.Context, tenant, id string) error
+	// UserGroups returns the groups a user is in, without their members
+	UserGroups(ctx context.Context, userID int) ([]Group, error)
+}
+
+const tenantUsersWhere = `tenant = $1 AND deleted_at IS NULL AND merged_into IS NULL AND NOT guest
+              AND ($2 = '' OR lower(email) = lower($2)) AND ($3 = '' OR external_id = $3)`
+
+func (r *PostgresUserRepository) TenantUsers(ctx context.Context, f UserFilter) ([]User, int, error) {
+	var total int
+	if err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM users WHERE `+tenantUsersWhere,
+		f.Tenant, f.Email, f.ExternalID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+tenantUsersWhere+`
+              ORDER BY id OFFSET $4 LIMIT $5`,
+		f.Tenant, f.Email, f.ExternalID, f.Offset, f.Limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+func (r *PostgresUserRepository) UpdateUser(ctx context.Context, user *User) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE users SET name = $2, email = $3, external_id = NULLIF($4, ''),
+                  deactivated_at = $5, deleted_at = $6 WHERE id = $1`,
+			user.ID, user.Name, user.Email, user.ExternalID, user.DeactivatedAt, user.DeletedAt)
+		if isUniqueViolation(err) {
+			return errUserTaken
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		if user.DeletedAt != nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM group_members WHERE user_id = $1`, user.ID)
+		}
+		return err
+	})
+}
+
+const groupColumns = `id, tenant, display_name, COALESCE(external_id, ''), created_at, updated_at`
+
+func scanGroup(row interface{ Scan(...any) error }, g *Group) error {
+	return row.Scan(&g.ID, &g.Tenant, &g.DisplayName, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt)
+}
+
+func (r *PostgresUserRepository) queryGroups(ctx context.Context, query string, args ...any) ([]Group, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		var g Group
+		if err := scanGroup(rows, &g); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (r *PostgresUserRepository) groupMembers(ctx context.Context, id string) ([]GroupMember, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT u.id, u.public_id, u.name
+              FROM group_members m JOIN users u ON u.id = m.user_id
+              WHERE m.group_id = $1 ORDER BY u.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []GroupMember
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.UserID, &m.PublicID, &m.Name); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+const groupsWhere = `tenant = $1 AND ($2 = '' OR display_name = $2) AND ($3 = '' OR external_id = $3)`
+
+func (r *PostgresUserRepository) Groups(ctx context.Context, f GroupFilter) ([]Group, int, error) {
+	var total int
+	if err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM groups WHERE `+groupsWhere,
+		f.Tenant, f.DisplayName, f.ExternalID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	groups, err := r.queryGroups(ctx, `SELECT `+groupColumns+` FROM groups WHERE `+groupsWhere+`
+              ORDER BY created_at, id OFFSET $4 LIMIT $5`,
+		f.Tenant, f.DisplayName, f.ExternalID, f.Offset, f.Limit)
+	if err != nil || f.WithoutMembers {
+		return groups, total, err
+	}
+	for i := range groups {
+		if groups[i].Members, err = r.groupMembers(ctx, groups[i].ID); err != nil {
+			return nil, 0, err
+		}
+	}
+	return groups, total, nil
+}
+
+func (r *PostgresUserRepository) Group(ctx context.Context, tenant, id string) (*Group, error) {
+	var g Group
+	err := scanGroup(r.db.QueryRowContext(ctx, `SELECT `+groupColumns+` FROM groups
+              WHERE tenant = $1 AND id = $2`, tenant, id), &g)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.Members, err = r.groupMembers(ctx, id); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// setMembers replaces the members of group id within tx
+func setMembers(ctx context.Context, tx *sql.Tx, id string, members []GroupMember) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM group_members WHERE group_id = $1`, id); err != nil {
+		return err
+	}
+	for _, m := range members {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO group_members (group_id, user_id) VALUES ($1, $2)
+                  ON CONFLICT DO NOTHING`, id, m.UserID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) CreateGroup(ctx context.Context, g *Group) error {
+	g.ID = publicid.New()
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `INSERT INTO groups (id, tenant, display_name, external_id)
+                  VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING created_at, updated_at`,
+			g.ID, g.Tenant, g.DisplayName, g.ExternalID).Scan(&g.CreatedAt, &g.UpdatedAt)
+		if isUniqueViolation(err) {
+			return errGroupExists
+		}
+		if err != nil {
+			return err
+		}
+		return setMembers(ctx, tx, g.ID, g.Members)
+	})
+}
+
+func (r *PostgresUserRepository) UpdateGroup(ctx context.Context, g *Group) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `UPDATE groups SET display_name = $3, external_id = NULLIF($4, ''),
+                  updated_at = now() WHERE tenant = $1 AND id = $2 RETURNING updated_at`,
+			g.Tenant, g.ID, g.DisplayName, g.ExternalID).Scan(&g.UpdatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if isUniqueViolation(err) {
+			return errGroupExists
+		}
+		if err != nil {
+			return err
+		}
+		return setMembers(ctx, tx, g.ID, g.Members)
+	})
+}
+
+func (r *PostgresUserRepository) DeleteGroup(ctx context.Context, tenant, id string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM groups WHERE tenant = $1 AND id = $2`, tenant, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) UserGroups(ctx context.Context, userID int) ([]Group, error) {
+	return r.queryGroups(ctx, `SELECT `+groupColumns+` FROM groups
+              WHERE id IN (SELECT group_id FROM group_members WHERE user_id = $1)
+              ORDER BY created_at, id`, userID)
+}
+
+// sortGroups orders groups oldest first, as Postgres does
+func sortGroups(groups []Group) {
+	sort.Slice(groups, func(i, j int) bool {
+		if !groups[i].CreatedAt.Equal(groups[j].CreatedAt) {
+			return groups[i].CreatedAt.Before(groups[j].CreatedAt)
+		}
+		return groups[i].ID < groups[j].ID
+	})
+}
+
+// page returns the part of items offset and limit select
+func page[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	return items[offset:min(offset+limit, len(items))]
+}
+
+func (r *MemoryUserRepository) TenantUsers(ctx context.Context, f UserFilter) ([]User, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var users []User
+	for id, u := range r.users {
+		if _, merged := r.aliases[id]; merged || u.Tenant != f.Tenant || u.DeletedAt != nil || u.Guest {
+			continue
+		}
+		if (f.Email != "" && !strings.EqualFold(u.Email, f.Email)) || (f.ExternalID != "" && u.ExternalID != f.ExternalID) {
+			continue
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return page(users, f.Offset, f.Limit), len(users), nil
+}
+
+func (r *MemoryUserRepository) UpdateUser(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	for id, u := range r.users {
+		if id != user.ID && (u.Email == user.Email ||
+			(user.ExternalID != "" && u.Tenant == existing.Tenant && u.ExternalID == user.ExternalID)) {
+			return errUserTaken
+		}
+	}
+	existing.Name, existing.Email, existing.ExternalID = user.Name, user.Email, user.ExternalID
+	existing.DeactivatedAt, existing.DeletedAt = user.DeactivatedAt, user.DeletedAt
+	r.users[user.ID] = existing
+	if user.DeletedAt != nil {
+		for _, g := range r.groups {
+			g.Members = slices.DeleteFunc(g.Members, func(m GroupMember) bool { return m.UserID == user.ID })
+		}
+	}
+	return nil
+}
+
+// group copies g with its members filled in; r.mu must be held
+func (r *MemoryUserRepository) group(g *Group, members bool) Group {
+	c := *g
+	c.Members = nil
+	if !members {
+		return c
+	}
+	for _, m := range g.Members {
+		u := r.users[m.UserID]
+		c.Members = append(c.Members, GroupMember{UserID: m.UserID, PublicID: u.PublicID, Name: u.Name})
+	}
+	return c
+}
+
+// nameTaken reports whether another of the tenant's groups has g's name;
+// r.mu must be held
+func (r *MemoryUserRepository) nameTaken(g *Group) bool {
+	for _, o := range r.groups {
+		if o.ID != g.ID && o.Tenant == g.Tenant && o.DisplayName == g.DisplayName {
+			return true
+		}
+	}
+	return false
+}
+
+// memberIDs keeps just the user IDs of members, sorted and once each
+func memberIDs(members []GroupMember) []GroupMember {
+	ids := make([]GroupMember, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, GroupMember{UserID: m.UserID})
+	}
+	slices.SortFunc(ids, func(a, b GroupMember) int { return a.UserID - b.UserID })
+	return slices.Compact(ids)
+}
+
+func (r *MemoryUserRepository) Groups(ctx context.Context, f GroupFilter) ([]Group, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var groups []Group
+	for _, g := range r.groups {
+		if g.Tenant != f.Tenant || (f.DisplayName != "" && g.DisplayName != f.DisplayName) ||
+			(f.ExternalID != "" && g.ExternalID != f.ExternalID) {
+			continue
+		}
+		groups = append(groups, r.group(g, !f.WithoutMembers))
+	}
+	sortGroups(groups)
+	return page(groups, f.Offset, f.Limit), len(groups), nil
+}
+
+func (r *MemoryUserRepository) Group(ctx context.Context, tenant, id string) (*Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	g, ok := r.groups[id]
+	if !ok || g.Tenant != tenant {
+		return nil, ErrNotFound
+	}
+	c := r.group(g, true)
+	return &c, nil
+}
+
+func (r *MemoryUserRepository) CreateGroup(ctx context.Context, g *Group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nameTaken(g) {
+		return errGroupExists
+	}
+	g.ID = publicid.New()
+	g.CreatedAt = clock.System.Now()
+	g.UpdatedAt = g.CreatedAt
+	stored := *g
+	stored.Members = memberIDs(g.Members)
+	r.groups[g.ID] = &stored
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdateGroup(ctx context.Context, g *Group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.groups[g.ID]
+	if !ok || stored.Tenant != g.Tenant {
+		return ErrNotFound
+	}
+	if r.nameTaken(g) {
+		return errGroupExists
+	}
+	stored.DisplayName, stored.ExternalID = g.DisplayName, g.ExternalID
+	stored.Members = memberIDs(g.Members)
+	stored.UpdatedAt = clock.System.Now()
+	g.UpdatedAt = stored.UpdatedAt
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteGroup(ctx context.Context, tenant, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.groups[id]
+	if !ok || g.Tenant != tenant {
+		return ErrNotFound
+	}
+	delete(r.groups, id)
+	return nil
+}
+
+func (r *MemoryUserRepository) UserGroups(ctx context.Context, userID int) ([]Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var groups []Group
+	for _, g := range r.groups {
+		if slices.ContainsFunc(g.Members, func(m GroupMember) bool { return m.UserID == userID }) {
+			groups = append(groups, r.group(g, false))
+		}
+	}
+	sortGroups(groups)
+	return groups, nil
+}
@@ -0,0 +1,48 @@
+// user-service/publicid.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"platform/publicid"
+)
+
+func (r *PostgresUserRepository) UserIDByPublicID(ctx context.Context, publicID string) (int, error) {
+	var id int
+	err := r.db.QueryRowContext(ctx, `SELECT id FROM users WHERE public_id = $1`, publicID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (r *MemoryUserRepository) UserIDByPublicID(ctx context.Context, publicID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	publicID = strings.ToLower(publicID)
+	for id, u := range r.users {
+		if u.PublicID == publicID {
+			return id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// resolveUserID reads a user ID from a path or query: either a user's
+// public ID or, until clients have moved over, their numeric one. Anything
+// else is ErrNotFound.
+func resolveUserID(ctx context.Context, repo UserRepository, param string) (int, error) {
+	if publicid.Valid(param) {
+		return repo.UserIDByPublicID(ctx, param)
+	}
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
@@ -0,0 +1,273 @@
+// user-service/repository.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"platform/dbretry"
+	"platform/migrate"
+	"platform/publicid"
+	"platform/startup"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// UserRepository hides the storage backend from the handlers
+type UserRepository interface {
+	Create(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	UpdateProfile(ctx context.Context, id int, profile Profile) error
+	// UserIDByPublicID maps a user's public ID to their numeric one
+	UserIDByPublicID(ctx context.Context, publicID string) (int, error)
+	// ByExternalID finds a user by the client's own ID for them, resolving
+	// merged-away accounts like Get
+	ByExternalID(ctx context.Context, tenant, externalID string) (*User, error)
+}
+
+// Repository is everything user-service stores
+type Repository interface {
+	UserRepository
+	WishlistRepository
+	GuestRepository
+	MergeRepository
+	TenantRepository
+	ImpersonationRepository
+	ActivityRepository
+	DeviceRepository
+	TwoFactorRepository
+	ProvisioningRepository
+	OrgRepository
+	OAuthClientRepository
+}
+
+// openRepository selects the backend: "postgres" (default) for production,
+// "memory" for running locally without any external dependencies. The
+// database dependency is readied by startup, which retries it until it is
+// up, and round-trips a query in self-tests; memory has none.
+func openRepository(storage, dbURL string) (Repository, *startup.Dependency, error) {
+	switch storage {
+	case "", "postgres":
+		db, err := dbretry.Open(dbURL, schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The database may still be coming up; startup retries this
+		database := &startup.Dependency{Name: "database", SelfTest: startup.SQL(db.DB), Check: func(ctx context.Context) error {
+			if err := db.PingContext(ctx); err != nil {
+				return err
+			}
+			return migrate.Run(ctx, db.DB, migrations(), schema)
+		}}
+		return &PostgresUserRepository{db: db}, database, nil
+	case "memory":
+		return NewMemoryUserRepository(), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+type PostgresUserRepository struct {
+	db *dbretry.DB
+}
+
+// Stats exposes connection pool statistics for load shedding
+func (r *PostgresUserRepository) Stats() sql.DBStats {
+	return r.db.Stats()
+}
+
+// Create registers a user. Registering with a guest's email and its claim
+// token turns that guest into the user, keeping its ID and so its orders.
+func (r *PostgresUserRepository) Create(ctx context.Context, user *User) error {
+	query := `INSERT INTO users (name, email, password_hash, created_at, tenant, external_id, deactivated_at) 
+              VALUES ($1, $2, NULLIF($3, ''), $4, $6, NULLIF($7, ''), $8)
+              ON CONFLICT (email) DO UPDATE
+              SET name = EXCLUDED.name, password_hash = EXCLUDED.password_hash, guest = false,
+                  address = NULL, claim_token_hash = NULL, merged_into = NULL,
+                  tenant = EXCLUDED.tenant, external_id = EXCLUDED.external_id
+              WHERE users.guest AND users.claim_token_hash = $5
+              RETURNING id, public_id`
+	err := r.db.QueryRowContext(ctx, query,
+		user.Name, user.Email, user.PasswordHash, user.CreatedAt, user.ClaimTokenHash,
+		user.Tenant, user.ExternalID, user.DeactivatedAt).Scan(&user.ID, &user.PublicID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errEmailRegistered
+	}
+	if isUniqueViolation(err) {
+		return errExternalIDTaken
+	}
+	return err
+}
+
+// userColumns are scanned by scanUser
+const userColumns = `id, name, email, COALESCE(password_hash, ''), created_at,
+	COALESCE(phone, ''), COALESCE(locale, ''), COALESCE(timezone, ''), marketing_opt_in,
+	guest, COALESCE(address, ''), tenant, COALESCE(external_id, ''), public_id,
+	deactivated_at, deleted_at`
+
+func scanUser(row interface{ Scan(...any) error }, user *User) error {
+	return row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.CreatedAt,
+		&user.Profile.Phone, &user.Profile.Locale, &user.Profile.Timezone, &user.Profile.MarketingOptIn,
+		&user.Guest, &user.Address, &user.Tenant, &user.ExternalID, &user.PublicID,
+		&user.DeactivatedAt, &user.DeletedAt)
+}
+
+// Get resolves the ID of a merged-away account to the account it went into
+func (r *PostgresUserRepository) Get(ctx context.Context, id int) (*User, error) {
+	var user User
+	err := scanUser(r.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users
+              WHERE id = COALESCE((SELECT user_id FROM user_aliases WHERE alias_id = $1), $1)`, id), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetByEmail also finds an account by the email of one merged into it
+func (r *PostgresUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	var user User
+	err := scanUser(r.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = (
+                  SELECT COALESCE(a.user_id, u.id) FROM users u LEFT JOIN user_aliases a ON a.alias_id = u.id
+                  WHERE u.email = $1)`, email), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *PostgresUserRepository) UpdateProfile(ctx context.Context, id int, p Profile) error {
+	query := `UPDATE users SET phone = NULLIF($1, ''), locale = NULLIF($2, ''),
+              timezone = NULLIF($3, ''), marketing_opt_in = $4 WHERE id = $5`
+	res, err := r.db.ExecContext(ctx, query, p.Phone, p.Locale, p.Timezone, p.MarketingOptIn, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MemoryUserRepository keeps users in process memory
+type MemoryUserRepository struct {
+	mu       sync.RWMutex
+	nextID   int
+	users    map[int]User
+	wishlist []WishlistItem
+	// claims maps guests' claim token hashes to their IDs
+	claims map[string]int
+	merges []*AccountMerge
+	// aliases maps merged-away IDs to the accounts they went into
+	aliases map[int]int
+	tenants map[string]*Tenant
+	// impersonations are kept oldest first
+	impersonations []Impersonation
+	// activity is kept oldest first
+	activity   []Activity
+	devices    []KnownDevice
+	challenges map[string]*LoginChallenge
+	twoFactor  map[int]*TwoFactor
+	// recoveryCodes maps users to their code hashes, true once used
+	recoveryCodes map[int]map[string]bool
+	groups        map[string]*Group
+	orgs          map[string]*Organization
+	orgMembers    []Membership
+	oauthClients  []OAuthClient
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		nextID:        1,
+		users:         make(map[int]User),
+		claims:        make(map[string]int),
+		aliases:       make(map[int]int),
+		tenants:       make(map[string]*Tenant),
+		challenges:    make(map[string]*LoginChallenge),
+		twoFactor:     make(map[int]*TwoFactor),
+		recoveryCodes: make(map[int]map[string]bool),
+		groups:        make(map[string]*Group),
+		orgs:          make(map[string]*Organization),
+	}
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user.ExternalID != "" {
+		for _, u := range r.users {
+			if u.Tenant == user.Tenant && u.ExternalID == user.ExternalID && u.Email != user.Email {
+				return errExternalIDTaken
+			}
+		}
+	}
+	for id, u := range r.users {
+		if u.Email != user.Email {
+			continue
+		}
+		if !u.Guest || user.ClaimTokenHash == "" || r.claims[user.ClaimTokenHash] != id {
+			return errEmailRegistered
+		}
+		delete(r.claims, user.ClaimTokenHash)
+		user.ID, user.PublicID, user.CreatedAt, user.ClaimTokenHash = id, u.PublicID, u.CreatedAt, ""
+		r.users[id] = *user
+		return nil
+	}
+	user.ID = r.nextID
+	r.nextID++
+	user.PublicID = publicid.New()
+	r.users[user.ID] = *user
+	return nil
+}
+
+func (r *MemoryUserRepository) Get(ctx context.Context, id int) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if to, ok := r.aliases[id]; ok {
+		id = to
+	}
+	user, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for id, u := range r.users {
+		if u.Email != email {
+			continue
+		}
+		if to, ok := r.aliases[id]; ok {
+			u = r.users[to]
+		}
+		return &u, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryUserRepository) UpdateProfile(ctx context.Context, id int, profile Profile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Profile = profile
+	r.users[id] = user
+	return nil
+}
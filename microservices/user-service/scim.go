@@ -0,0 +1,995 @@
+// user-service/scim.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/publicid"
+	"platform/router"
+)
+
+// SCIM 2.0 (RFCs 7643 and 7644) lets tenants' identity providers provision
+// their users: userName is the email users sign in with, and IDs are their
+// public IDs. Deactivating a user stops their logins; deleting one keeps
+// them, deactivated, for their orders, but SCIM no longer finds them.
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+const (
+	defaultSCIMPage = 100
+	maxSCIMPage     = 200
+)
+
+// Activity types for what identity providers do to accounts
+const (
+	activityAccountDeactivated = "account_deactivated"
+	activityAccountReactivated = "account_reactivated"
+	activityAccountDeleted     = "account_deleted"
+)
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// scimRef is a group's member or a user's group
+type scimRef struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      time.Time  `json:"created"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+// scimUser is a user as SCIM has it. Of what identity providers send we
+// keep the name, userName, externalId and active; emails and groups are
+// only answered.
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        scimName    `json:"name"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Groups      []scimRef   `json:"groups,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id,omitempty"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	DisplayName string    `json:"displayName"`
+	Members     []scimRef `json:"members,omitempty"`
+	Meta        *scimMeta `json:"meta,omitempty"`
+}
+
+type scimList struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    any      `json:"Resources"`
+}
+
+type scimPatch struct {
+	Operations []scimOp `json:"Operations"`
+}
+
+type scimOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SCIMAPI serves /scim/v2 to tenants' API keys, scoped to their tenant
+type SCIMAPI struct {
+	repo     Repository
+	events   *events.Emitter
+	activity *ActivityLog
+	clock    clock.Clock
+	// baseURL is where identity providers reach the API, for resources'
+	// locations
+	baseURL string
+}
+
+// scimFromEnv reads SCIM_BASE_URL, the API's address through the gateway
+func scimFromEnv(repo Repository, emitter *events.Emitter, activity *ActivityLog) *SCIMAPI {
+	baseURL := os.Getenv("SCIM_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080/scim/v2"
+	}
+	return &SCIMAPI{repo: repo, events: emitter, activity: activity, clock: clock.System,
+		baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// scimError answers with a SCIM error, localizing err if it is an
+// i18n.Message
+func scimError(w http.ResponseWriter, r *http.Request, status int, scimType string, err error) {
+	writeSCIM(w, status, struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{[]string{scimErrorSchema}, strconv.Itoa(status), scimType, i18n.FromContext(r.Context()).Text(err)})
+}
+
+// tenant is the tenant whose API key r carries, as long as it is active
+func (a *SCIMAPI) tenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	p, ok := middleware.PrincipalFromContext(r.Context())
+	if !ok || p.Tenant == "" {
+		scimError(w, r, http.StatusForbidden, "", i18n.NewError("scim.forbidden"))
+		return "", false
+	}
+	t, err := a.repo.Tenant(r.Context(), p.Tenant)
+	if errors.Is(err, ErrNotFound) {
+		scimError(w, r, http.StatusForbidden, "", i18n.NewError("scim.forbidden"))
+		return "", false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return "", false
+	}
+	if t.Status != TenantActive {
+		scimError(w, r, http.StatusForbidden, "", i18n.NewError("scim.tenant_inactive", t.Status))
+		return "", false
+	}
+	return t.ID, true
+}
+
+var scimFilterPattern = regexp.MustCompile(`(?i)^\s*([a-z.]+)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// scimFilter parses the one filter identity providers send to look a
+// resource up, attr eq "value", returning attr lowercased. No filter is
+// "", "".
+func scimFilter(r *http.Request) (attr, value string, err error) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		return "", "", nil
+	}
+	m := scimFilterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", i18n.NewError("scim.filter_invalid", filter)
+	}
+	if value, err = strconv.Unquote(m[2]); err != nil {
+		return "", "", i18n.NewError("scim.filter_invalid", filter)
+	}
+	return strings.ToLower(m[1]), value, nil
+}
+
+// scimPage reads startIndex, which counts from 1, and count
+func scimPage(r *http.Request) (start, count int, err error) {
+	start, count = 1, defaultSCIMPage
+	q := r.URL.Query()
+	if v := q.Get("startIndex"); v != "" {
+		if start, err = strconv.Atoi(v); err != nil {
+			return 0, 0, i18n.NewError("scim.value_invalid", "startIndex")
+		}
+		start = max(start, 1)
+	}
+	if v := q.Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil {
+			return 0, 0, i18n.NewError("scim.value_invalid", "count")
+		}
+		count = min(max(count, 0), maxSCIMPage)
+	}
+	return start, count, nil
+}
+
+// ServiceProviderConfig serves GET /scim/v2/ServiceProviderConfig
+func (a *SCIMAPI) ServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(ok bool) map[string]bool { return map[string]bool{"supported": ok} }
+	writeSCIM(w, http.StatusOK, map[string]any{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": maxSCIMPage},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type": "oauthbearertoken", "name": "OAuth Bearer Token",
+			"description": "The tenant's API key", "primary": true,
+		}},
+	})
+}
+
+// splitName guesses at given and family names; users have just the one
+func splitName(name string) (given, family string) {
+	given, family, _ = strings.Cut(strings.TrimSpace(name), " ")
+	return given, strings.TrimSpace(family)
+}
+
+func (a *SCIMAPI) userResource(user *User, groups []Group) scimUser {
+	active := user.DeactivatedAt == nil
+	given, family := splitName(user.Name)
+	su := scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          user.PublicID,
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		Name:        scimName{Formatted: user.Name, GivenName: given, FamilyName: family},
+		DisplayName: user.Name,
+		Emails:      []scimEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &scimMeta{ResourceType: "User", Created: user.CreatedAt,
+			Location: a.baseURL + "/Users/" + user.PublicID},
+	}
+	for _, g := range groups {
+		su.Groups = append(su.Groups, scimRef{Value: g.ID, Ref: a.baseURL + "/Groups/" + g.ID, Display: g.DisplayName})
+	}
+	return su
+}
+
+// writeUser answers with user and the groups they are in
+func (a *SCIMAPI) writeUser(w http.ResponseWriter, r *http.Request, status int, user *User) {
+	groups, err := a.repo.UserGroups(r.Context(), user.ID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	su := a.userResource(user, groups)
+	if status == http.StatusCreated {
+		w.Header().Set("Location", su.Meta.Location)
+	}
+	writeSCIM(w, status, su)
+}
+
+// apply sets what user keeps of su. Name parts win over the formatted
+// name, which wins over displayName.
+func (su *scimUser) apply(user *User) error {
+	addr, err := mail.ParseAddress(su.UserName)
+	if err != nil || addr.Address != su.UserName {
+		return i18n.NewError("scim.user_name_invalid")
+	}
+	if su.ExternalID != "" && !externalIDPattern.MatchString(su.ExternalID) {
+		return i18n.NewError("user.external_id_invalid")
+	}
+	name := strings.TrimSpace(su.Name.GivenName + " " + su.Name.FamilyName)
+	for _, n := range []string{su.Name.Formatted, su.DisplayName, su.UserName} {
+		if name == "" {
+			name = n
+		}
+	}
+	user.Name, user.Email, user.ExternalID = name, su.UserName, su.ExternalID
+	return nil
+}
+
+// activate deactivates user unless active, from now if they weren't already
+func (a *SCIMAPI) activate(user *User, active bool) {
+	switch {
+	case active:
+		user.DeactivatedAt = nil
+	case user.DeactivatedAt == nil:
+		now := a.clock.Now()
+		user.DeactivatedAt = &now
+	}
+}
+
+// tenantUser resolves the path's user among the tenant's
+func (a *SCIMAPI) tenantUser(w http.ResponseWriter, r *http.Request, tenant string) (*User, bool) {
+	ctx := r.Context()
+	id := router.Param(r, "id")
+	var user *User
+	err := ErrNotFound
+	if publicid.Valid(id) {
+		var userID int
+		if userID, err = a.repo.UserIDByPublicID(ctx, id); err == nil {
+			user, err = a.repo.Get(ctx, userID)
+		}
+		// Merged-away users are the account they went into
+		if err == nil && (user.ID != userID || user.Tenant != tenant || user.DeletedAt != nil) {
+			err = ErrNotFound
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		scimError(w, r, http.StatusNotFound, "", i18n.NewError("scim.user_not_found", id))
+		return nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// save writes user back, and records and announces it being deactivated,
+// reactivated or deleted
+func (a *SCIMAPI) save(w http.ResponseWriter, r *http.Request, before, user *User) bool {
+	err := a.repo.UpdateUser(r.Context(), user)
+	if errors.Is(err, errUserTaken) {
+		scimError(w, r, http.StatusConflict, "uniqueness", i18n.NewError("scim.user_exists"))
+		return false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return false
+	}
+
+	var event, activity string
+	switch {
+	case before.DeletedAt == nil && user.DeletedAt != nil:
+		event, activity = "user.deleted", activityAccountDeleted
+	case before.DeactivatedAt == nil && user.DeactivatedAt != nil:
+		event, activity = "user.deactivated", activityAccountDeactivated
+	case before.DeactivatedAt != nil && user.DeactivatedAt == nil:
+		event, activity = "user.reactivated", activityAccountReactivated
+	default:
+		return true
+	}
+	a.activity.Record(r, Activity{UserID: user.ID, Type: activity})
+	a.events.Emit(r.Context(), event, fmt.Sprintf("user/%d", user.ID), map[string]any{
+		"user_id": user.ID, "tenant": user.Tenant,
+	})
+	return true
+}
+
+// ListUsers serves GET /scim/v2/Users, filtered by userName, emails or
+// externalId
+func (a *SCIMAPI) ListUsers(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	start, count, err := scimPage(r)
+	if err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	attr, value, err := scimFilter(r)
+	if err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidFilter", err)
+		return
+	}
+	f := UserFilter{Tenant: tenant, Offset: start - 1, Limit: count}
+	switch attr {
+	case "":
+	case "username", "emails", "emails.value":
+		f.Email = value
+	case "externalid":
+		f.ExternalID = value
+	default:
+		scimError(w, r, http.StatusBadRequest, "invalidFilter", i18n.NewError("scim.filter_invalid", r.URL.Query().Get("filter")))
+		return
+	}
+
+	ctx := r.Context()
+	users, total, err := a.repo.TenantUsers(ctx, f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	resources := []scimUser{}
+	for i := range users {
+		groups, err := a.repo.UserGroups(ctx, users[i].ID)
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		resources = append(resources, a.userResource(&users[i], groups))
+	}
+	writeSCIM(w, http.StatusOK, scimList{Schemas: []string{scimListSchema}, TotalResults: total,
+		StartIndex: start, ItemsPerPage: len(resources), Resources: resources})
+}
+
+// CreateUser serves POST /scim/v2/Users. Provisioning a user the tenant
+// deleted brings them back.
+func (a *SCIMAPI) CreateUser(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	var su scimUser
+	if err := json.NewDecoder(r.Body).Decode(&su); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+	user := &User{Tenant: tenant, CreatedAt: a.clock.Now()}
+	if err := su.apply(user); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	active := su.Active == nil || *su.Active
+
+	ctx := r.Context()
+	existing, err := a.repo.GetByEmail(ctx, user.Email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		dbretry.Error(w, err)
+		return
+	}
+	if existing != nil {
+		if existing.Tenant != tenant || existing.DeletedAt == nil || !strings.EqualFold(existing.Email, user.Email) {
+			scimError(w, r, http.StatusConflict, "uniqueness", i18n.NewError("scim.user_exists"))
+			return
+		}
+		before := *existing
+		su.apply(existing)
+		existing.DeletedAt = nil
+		a.activate(existing, active)
+		if a.save(w, r, &before, existing) {
+			a.writeUser(w, r, http.StatusCreated, existing)
+		}
+		return
+	}
+
+	a.activate(user, active)
+	err = a.repo.Create(ctx, user)
+	if errors.Is(err, errEmailRegistered) || errors.Is(err, errExternalIDTaken) {
+		scimError(w, r, http.StatusConflict, "uniqueness", i18n.NewError("scim.user_exists"))
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.activity.Record(r, Activity{UserID: user.ID, Type: activityAccountCreated, Detail: map[string]any{"provisioned": true}})
+	a.writeUser(w, r, http.StatusCreated, user)
+}
+
+// GetUser serves GET /scim/v2/Users/{id}
+func (a *SCIMAPI) GetUser(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	if user, ok := a.tenantUser(w, r, tenant); ok {
+		a.writeUser(w, r, http.StatusOK, user)
+	}
+}
+
+// ReplaceUser serves PUT /scim/v2/Users/{id}
+func (a *SCIMAPI) ReplaceUser(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	user, ok := a.tenantUser(w, r, tenant)
+	if !ok {
+		return
+	}
+	var su scimUser
+	if err := json.NewDecoder(r.Body).Decode(&su); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+	before := *user
+	if err := su.apply(user); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	a.activate(user, su.Active == nil || *su.Active)
+	if a.save(w, r, &before, user) {
+		a.writeUser(w, r, http.StatusOK, user)
+	}
+}
+
+// PatchUser serves PATCH /scim/v2/Users/{id}; attributes we don't keep
+// are ignored
+func (a *SCIMAPI) PatchUser(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	user, ok := a.tenantUser(w, r, tenant)
+	if !ok {
+		return
+	}
+	var patch scimPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+	su := a.userResource(user, nil)
+	for _, op := range patch.Operations {
+		if err := patchUser(&su, op); err != nil {
+			scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+			return
+		}
+	}
+	before := *user
+	if err := su.apply(user); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	a.activate(user, *su.Active)
+	if a.save(w, r, &before, user) {
+		a.writeUser(w, r, http.StatusOK, user)
+	}
+}
+
+// DeleteUser serves DELETE /scim/v2/Users/{id}
+func (a *SCIMAPI) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	user, ok := a.tenantUser(w, r, tenant)
+	if !ok {
+		return
+	}
+	before := *user
+	now := a.clock.Now()
+	a.activate(user, false)
+	user.DeletedAt = &now
+	if a.save(w, r, &before, user) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// scimOpKind checks op is one of add, replace and remove, which identity
+// providers capitalize as they like
+func scimOpKind(op scimOp) (string, error) {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return "", i18n.NewError("scim.patch_invalid", op.Op)
+	}
+	return kind, nil
+}
+
+// patchUser applies op to su
+func patchUser(su *scimUser, op scimOp) error {
+	kind, err := scimOpKind(op)
+	if err != nil {
+		return err
+	}
+	if op.Path == "" {
+		var attrs map[string]json.RawMessage
+		if kind == "remove" || json.Unmarshal(op.Value, &attrs) != nil {
+			return i18n.NewError("scim.patch_invalid", op.Op)
+		}
+		paths := make([]string, 0, len(attrs))
+		for path := range attrs {
+			paths = append(paths, path)
+		}
+		// Whole names before their parts
+		sort.Strings(paths)
+		for _, path := range paths {
+			if err := setUserAttr(su, path, attrs[path]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if kind == "remove" {
+		switch strings.ToLower(op.Path) {
+		case "externalid":
+			su.ExternalID = ""
+		case "active":
+			return i18n.NewError("scim.patch_invalid", op.Op)
+		}
+		return nil
+	}
+	return setUserAttr(su, op.Path, op.Value)
+}
+
+// setUserAttr sets one attribute of su from a patch
+func setUserAttr(su *scimUser, path string, v json.RawMessage) error {
+	str := func(dst *string) error {
+		if json.Unmarshal(v, dst) != nil {
+			return i18n.NewError("scim.value_invalid", path)
+		}
+		return nil
+	}
+	switch strings.ToLower(path) {
+	case "active":
+		active, ok := scimBool(v)
+		if !ok {
+			return i18n.NewError("scim.value_invalid", path)
+		}
+		su.Active = &active
+	case "username":
+		return str(&su.UserName)
+	case "externalid":
+		return str(&su.ExternalID)
+	case "displayname":
+		su.Name = scimName{}
+		return str(&su.DisplayName)
+	case "name":
+		su.Name = scimName{}
+		if json.Unmarshal(v, &su.Name) != nil {
+			return i18n.NewError("scim.value_invalid", path)
+		}
+	case "name.formatted":
+		su.Name = scimName{}
+		return str(&su.Name.Formatted)
+	case "name.givenname":
+		return str(&su.Name.GivenName)
+	case "name.familyname":
+		return str(&su.Name.FamilyName)
+	}
+	return nil
+}
+
+// scimBool reads a boolean, which some identity providers send as "True"
+// or "False"
+func scimBool(v json.RawMessage) (bool, bool) {
+	var b bool
+	if json.Unmarshal(v, &b) == nil {
+		return b, true
+	}
+	var s string
+	if json.Unmarshal(v, &s) != nil {
+		return false, false
+	}
+	b, err := strconv.ParseBool(strings.ToLower(s))
+	return b, err == nil
+}
+
+func (a *SCIMAPI) groupResource(g *Group) scimGroup {
+	sg := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          g.ID,
+		ExternalID:  g.ExternalID,
+		DisplayName: g.DisplayName,
+		Meta: &scimMeta{ResourceType: "Group", Created: g.CreatedAt, LastModified: &g.UpdatedAt,
+			Location: a.baseURL + "/Groups/" + g.ID},
+	}
+	for _, m := range g.Members {
+		sg.Members = append(sg.Members, scimRef{Value: m.PublicID, Ref: a.baseURL + "/Users/" + m.PublicID, Display: m.Name})
+	}
+	return sg
+}
+
+// members resolves refs to the tenant's users
+func (a *SCIMAPI) members(ctx context.Context, tenant string, refs []scimRef) ([]GroupMember, error) {
+	members := make([]GroupMember, 0, len(refs))
+	for _, ref := range refs {
+		var user *User
+		err := ErrNotFound
+		if publicid.Valid(ref.Value) {
+			var userID int
+			if userID, err = a.repo.UserIDByPublicID(ctx, ref.Value); err == nil {
+				user, err = a.repo.Get(ctx, userID)
+			}
+			if err == nil && (user.ID != userID || user.Tenant != tenant || user.DeletedAt != nil) {
+				err = ErrNotFound
+			}
+		}
+		if errors.Is(err, ErrNotFound) {
+			return nil, i18n.NewError("scim.member_invalid", ref.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, GroupMember{UserID: user.ID, PublicID: user.PublicID, Name: user.Name})
+	}
+	return members, nil
+}
+
+// writeMembersError answers for a failure to resolve members
+func writeMembersError(w http.ResponseWriter, r *http.Request, err error) {
+	var m *i18n.Message
+	if errors.As(err, &m) {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	dbretry.Error(w, err)
+}
+
+// tenantGroup resolves the path's group among the tenant's
+func (a *SCIMAPI) tenantGroup(w http.ResponseWriter, r *http.Request, tenant string) (*Group, bool) {
+	id := router.Param(r, "id")
+	g, err := a.repo.Group(r.Context(), tenant, id)
+	if errors.Is(err, ErrNotFound) {
+		scimError(w, r, http.StatusNotFound, "", i18n.NewError("scim.group_not_found", id))
+		return nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	return g, true
+}
+
+// saveGroup creates g when it has no ID yet, and updates it otherwise
+func (a *SCIMAPI) saveGroup(w http.ResponseWriter, r *http.Request, g *Group) bool {
+	if g.DisplayName == "" {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", i18n.NewError("scim.group_name_required"))
+		return false
+	}
+	if g.ExternalID != "" && !externalIDPattern.MatchString(g.ExternalID) {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", i18n.NewError("user.external_id_invalid"))
+		return false
+	}
+	// Members added twice are there once
+	slices.SortFunc(g.Members, func(a, b GroupMember) int { return a.UserID - b.UserID })
+	g.Members = slices.CompactFunc(g.Members, func(a, b GroupMember) bool { return a.UserID == b.UserID })
+	var err error
+	if g.ID == "" {
+		err = a.repo.CreateGroup(r.Context(), g)
+	} else {
+		err = a.repo.UpdateGroup(r.Context(), g)
+	}
+	if errors.Is(err, errGroupExists) {
+		scimError(w, r, http.StatusConflict, "uniqueness", i18n.NewError("scim.group_exists", g.DisplayName))
+		return false
+	}
+	if errors.Is(err, ErrNotFound) {
+		scimError(w, r, http.StatusNotFound, "", i18n.NewError("scim.group_not_found", g.ID))
+		return false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return false
+	}
+	return true
+}
+
+// ListGroups serves GET /scim/v2/Groups, filtered by displayName or
+// externalId; excludedAttributes=members leaves the members out
+func (a *SCIMAPI) ListGroups(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	start, count, err := scimPage(r)
+	if err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	attr, value, err := scimFilter(r)
+	if err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidFilter", err)
+		return
+	}
+	f := GroupFilter{Tenant: tenant, Offset: start - 1, Limit: count}
+	switch attr {
+	case "":
+	case "displayname":
+		f.DisplayName = value
+	case "externalid":
+		f.ExternalID = value
+	default:
+		scimError(w, r, http.StatusBadRequest, "invalidFilter", i18n.NewError("scim.filter_invalid", r.URL.Query().Get("filter")))
+		return
+	}
+	excluded := strings.Split(strings.ToLower(r.URL.Query().Get("excludedAttributes")), ",")
+	f.WithoutMembers = slices.Contains(excluded, "members")
+
+	groups, total, err := a.repo.Groups(r.Context(), f)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	resources := []scimGroup{}
+	for i := range groups {
+		resources = append(resources, a.groupResource(&groups[i]))
+	}
+	writeSCIM(w, http.StatusOK, scimList{Schemas: []string{scimListSchema}, TotalResults: total,
+		StartIndex: start, ItemsPerPage: len(resources), Resources: resources})
+}
+
+// CreateGroup serves POST /scim/v2/Groups
+func (a *SCIMAPI) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	var sg scimGroup
+	if err := json.NewDecoder(r.Body).Decode(&sg); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+	members, err := a.members(r.Context(), tenant, sg.Members)
+	if err != nil {
+		writeMembersError(w, r, err)
+		return
+	}
+	g := &Group{Tenant: tenant, DisplayName: sg.DisplayName, ExternalID: sg.ExternalID, Members: members}
+	if !a.saveGroup(w, r, g) {
+		return
+	}
+	created := a.groupResource(g)
+	w.Header().Set("Location", created.Meta.Location)
+	writeSCIM(w, http.StatusCreated, created)
+}
+
+// GetGroup serves GET /scim/v2/Groups/{id}
+func (a *SCIMAPI) GetGroup(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	if g, ok := a.tenantGroup(w, r, tenant); ok {
+		writeSCIM(w, http.StatusOK, a.groupResource(g))
+	}
+}
+
+// ReplaceGroup serves PUT /scim/v2/Groups/{id}
+func (a *SCIMAPI) ReplaceGroup(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	g, ok := a.tenantGroup(w, r, tenant)
+	if !ok {
+		return
+	}
+	var sg scimGroup
+	if err := json.NewDecoder(r.Body).Decode(&sg); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+	members, err := a.members(r.Context(), tenant, sg.Members)
+	if err != nil {
+		writeMembersError(w, r, err)
+		return
+	}
+	g.DisplayName, g.ExternalID, g.Members = sg.DisplayName, sg.ExternalID, members
+	if a.saveGroup(w, r, g) {
+		writeSCIM(w, http.StatusOK, a.groupResource(g))
+	}
+}
+
+var memberPathPattern = regexp.MustCompile(`(?i)^members\[value eq "([^"]*)"\]$`)
+
+// PatchGroup serves PATCH /scim/v2/Groups/{id}: renames, and members
+// added, removed or replaced
+func (a *SCIMAPI) PatchGroup(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	g, ok := a.tenantGroup(w, r, tenant)
+	if !ok {
+		return
+	}
+	var patch scimPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		scimError(w, r, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+	for _, op := range patch.Operations {
+		if err := a.patchGroup(r.Context(), g, op); err != nil {
+			writeMembersError(w, r, err)
+			return
+		}
+	}
+	if a.saveGroup(w, r, g) {
+		writeSCIM(w, http.StatusOK, a.groupResource(g))
+	}
+}
+
+// patchGroup applies op to g
+func (a *SCIMAPI) patchGroup(ctx context.Context, g *Group, op scimOp) error {
+	kind, err := scimOpKind(op)
+	if err != nil {
+		return err
+	}
+	var refs []scimRef
+	members := func() ([]GroupMember, error) {
+		if len(op.Value) > 0 && json.Unmarshal(op.Value, &refs) != nil {
+			return nil, i18n.NewError("scim.value_invalid", "members")
+		}
+		return a.members(ctx, g.Tenant, refs)
+	}
+	without := func(drop []GroupMember) {
+		g.Members = slices.DeleteFunc(g.Members, func(m GroupMember) bool {
+			return slices.ContainsFunc(drop, func(d GroupMember) bool { return d.UserID == m.UserID })
+		})
+	}
+	path := strings.ToLower(op.Path)
+	if m := memberPathPattern.FindStringSubmatch(op.Path); m != nil && kind == "remove" {
+		g.Members = slices.DeleteFunc(g.Members, func(member GroupMember) bool {
+			return strings.EqualFold(member.PublicID, m[1])
+		})
+		return nil
+	}
+
+	switch {
+	case path == "" && kind != "remove":
+		var attrs struct {
+			DisplayName *string   `json:"displayName"`
+			ExternalID  *string   `json:"externalId"`
+			Members     []scimRef `json:"members,omitempty"`
+		}
+		if json.Unmarshal(op.Value, &attrs) != nil {
+			return i18n.NewError("scim.patch_invalid", op.Op)
+		}
+		if attrs.DisplayName != nil {
+			g.DisplayName = *attrs.DisplayName
+		}
+		if attrs.ExternalID != nil {
+			g.ExternalID = *attrs.ExternalID
+		}
+		if attrs.Members != nil {
+			added, err := a.members(ctx, g.Tenant, attrs.Members)
+			if err != nil {
+				return err
+			}
+			if kind == "replace" {
+				g.Members = nil
+			}
+			g.Members = append(g.Members, added...)
+		}
+	case path == "displayname" && kind != "remove":
+		if json.Unmarshal(op.Value, &g.DisplayName) != nil {
+			return i18n.NewError("scim.value_invalid", op.Path)
+		}
+	case path == "externalid":
+		g.ExternalID = ""
+		if kind != "remove" && json.Unmarshal(op.Value, &g.ExternalID) != nil {
+			return i18n.NewError("scim.value_invalid", op.Path)
+		}
+	case path == "members":
+		changed, err := members()
+		if err != nil {
+			return err
+		}
+		switch {
+		case kind == "add":
+			g.Members = append(g.Members, changed...)
+		case kind == "replace":
+			g.Members = changed
+		case len(refs) == 0:
+			g.Members = nil
+		default:
+			without(changed)
+		}
+	default:
+		return i18n.NewError("scim.patch_invalid", op.Op+" "+op.Path)
+	}
+	return nil
+}
+
+// DeleteGroup serves DELETE /scim/v2/Groups/{id}
+func (a *SCIMAPI) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenant(w, r)
+	if !ok {
+		return
+	}
+	id := router.Param(r, "id")
+	err := a.repo.DeleteGroup(r.Context(), tenant, id)
+	if errors.Is(err, ErrNotFound) {
+		scimError(w, r, http.StatusNotFound, "", i18n.NewError("scim.group_not_found", id))
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,761 @@
+// user-service/tenants.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/quota"
+	"platform/router"
+)
+
+// Tenant statuses. Provisioning and deleting tenants have a saga under
+// way; the gateway serves only active ones, and tenants it doesn't know.
+const (
+	TenantProvisioning = "provisioning"
+	TenantActive       = "active"
+	TenantSuspended    = "suspended"
+	TenantDeleting     = "deleting"
+	TenantDeleted      = "deleted"
+)
+
+const (
+	tenantLease       = 5 * time.Minute
+	maxTenantAttempts = 5
+	tenantStepTimeout = 30 * time.Second
+)
+
+var (
+	errTenantExists = errors.New("tenant already exists")
+	// errTenantStatus is a lifecycle change the tenant's status doesn't allow
+	errTenantStatus = errors.New("not allowed in the tenant's status")
+	// errTenantMoved means another replica advanced the tenant meanwhile
+	errTenantMoved = errors.New("tenant moved on")
+)
+
+// Tenant IDs end up in quota subjects and subscription IDs, so they are
+// kept to lowercase letters, digits and dashes
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is an integration or storefront acting through its own API keys,
+// whose tokens carry its ID as their tenant claim. Step is the number of
+// steps done of the saga its status runs.
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Plan string `json:"plan"`
+	// WebhookURL, if set, is subscribed to the tenant's webhook
+	// notifications when it is provisioned
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// RequireTwoFactor has the tenant's users sign in with a second factor,
+	// setting one up at their next login if they have none
+	RequireTwoFactor bool   `json:"require_two_factor,omitempty"`
+	Status           string `json:"status"`
+	Step             int    `json:"step"`
+	NextStep         string `json:"next_step,omitempty"`
+	Attempts         int    `json:"attempts"`
+	// Stalled sagas used up their attempts and wait for an admin to retry
+	Stalled       bool      `json:"stalled,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// APIKey is returned once, by the request that issued it
+	APIKey string `json:"api_key,omitempty"`
+}
+
+// busy reports whether a saga is running for t
+func (t *Tenant) busy() bool {
+	return (t.Status == TenantProvisioning || t.Status == TenantDeleting) && !t.Stalled
+}
+
+type TenantRepository interface {
+	// CreateTenant stores a new tenant; an ID ever used before, by a
+	// deleted tenant too, is errTenantExists
+	CreateTenant(ctx context.Context, t *Tenant) error
+	Tenant(ctx context.Context, id string) (*Tenant, error)
+	// Tenants lists tenants by ID; status "" lists all
+	Tenants(ctx context.Context, status string) ([]Tenant, error)
+	// UpdateTenant locks the tenant, lets fn change it and saves it
+	UpdateTenant(ctx context.Context, id string, fn func(*Tenant) error) (*Tenant, error)
+	// ClaimDueTenants returns tenants whose saga is due another attempt
+	// and pushes that back by lease, so other replicas skip them
+	ClaimDueTenants(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Tenant, error)
+}
+
+const tenantColumns = `id, name, plan, webhook_url, require_two_factor, status, step, attempts, stalled,
+              last_error, next_attempt_at, created_at, updated_at`
+
+func scanTenant(scan func(...any) error, t *Tenant) error {
+	return scan(&t.ID, &t.Name, &t.Plan, &t.WebhookURL, &t.RequireTwoFactor, &t.Status, &t.Step, &t.Attempts,
+		&t.Stalled, &t.LastError, &t.NextAttemptAt, &t.CreatedAt, &t.UpdatedAt)
+}
+
+func (r *PostgresUserRepository) queryTenants(ctx context.Context, query string, args ...any) ([]Tenant, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []Tenant
+	for rows.Next() {
+		var t Tenant
+		if err := scanTenant(rows.Scan, &t); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func (r *PostgresUserRepository) CreateTenant(ctx context.Context, t *Tenant) error {
+	err := scanTenant(r.db.QueryRowContext(ctx, `INSERT INTO tenants (id, name, plan, webhook_url, require_two_factor, status, next_attempt_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO NOTHING RETURNING `+tenantColumns,
+		t.ID, t.Name, t.Plan, t.WebhookURL, t.RequireTwoFactor, t.Status, t.NextAttemptAt).Scan, t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errTenantExists
+	}
+	return err
+}
+
+func (r *PostgresUserRepository) Tenant(ctx context.Context, id string) (*Tenant, error) {
+	var t Tenant
+	err := scanTenant(r.db.QueryRowContext(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE id = $1`, id).Scan, &t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *PostgresUserRepository) Tenants(ctx context.Context, status string) ([]Tenant, error) {
+	return r.queryTenants(ctx, `SELECT `+tenantColumns+` FROM tenants
+              WHERE $1 = '' OR status = $1 ORDER BY id`, status)
+}
+
+func (r *PostgresUserRepository) UpdateTenant(ctx context.Context, id string, fn func(*Tenant) error) (*Tenant, error) {
+	var tenant *Tenant
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		var t Tenant
+		err := scanTenant(tx.QueryRowContext(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE id = $1 FOR UPDATE`, id).Scan, &t)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&t); err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, `UPDATE tenants
+              SET name = $2, plan = $3, webhook_url = $4, status = $5, step = $6, attempts = $7,
+                  stalled = $8, last_error = $9, next_attempt_at = $10, require_two_factor = $11, updated_at = now()
+              WHERE id = $1 RETURNING updated_at`,
+			id, t.Name, t.Plan, t.WebhookURL, t.Status, t.Step, t.Attempts, t.Stalled, t.LastError,
+			t.NextAttemptAt, t.RequireTwoFactor).Scan(&t.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		tenant = &t
+		return nil
+	})
+	return tenant, err
+}
+
+func (r *PostgresUserRepository) ClaimDueTenants(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Tenant, error) {
+	// The outer SELECT sees the rows as they were before the lease
+	return r.queryTenants(ctx, `WITH leased AS (
+                  UPDATE tenants SET next_attempt_at = $2
+                  WHERE id IN (
+                      SELECT id FROM tenants
+                      WHERE status IN ('provisioning', 'deleting') AND NOT stalled AND next_attempt_at <= $1
+                      ORDER BY next_attempt_at LIMIT $3
+                      FOR UPDATE SKIP LOCKED)
+                  RETURNING id)
+              SELECT `+tenantColumns+` FROM tenants WHERE id IN (SELECT id FROM leased)`,
+		now, now.Add(lease), limit)
+}
+
+func (r *MemoryUserRepository) CreateTenant(ctx context.Context, t *Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.tenants[t.ID]; ok {
+		return errTenantExists
+	}
+	t.CreatedAt = clock.System.Now()
+	t.UpdatedAt = t.CreatedAt
+	c := *t
+	c.APIKey = ""
+	r.tenants[t.ID] = &c
+	return nil
+}
+
+func (r *MemoryUserRepository) Tenant(ctx context.Context, id string) (*Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.tenants[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+func (r *MemoryUserRepository) Tenants(ctx context.Context, status string) ([]Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var tenants []Tenant
+	for _, t := range r.tenants {
+		if status == "" || t.Status == status {
+			tenants = append(tenants, *t)
+		}
+	}
+	slices.SortFunc(tenants, func(a, b Tenant) int { return strings.Compare(a.ID, b.ID) })
+	return tenants, nil
+}
+
+func (r *MemoryUserRepository) UpdateTenant(ctx context.Context, id string, fn func(*Tenant) error) (*Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.tenants[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	t := *stored
+	if err := fn(&t); err != nil {
+		return nil, err
+	}
+	t.UpdatedAt = clock.System.Now()
+	t.APIKey = ""
+	*stored = t
+	return &t, nil
+}
+
+func (r *MemoryUserRepository) ClaimDueTenants(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []Tenant
+	for _, t := range r.tenants {
+		if len(due) == limit {
+			break
+		}
+		if !t.busy() || t.NextAttemptAt.After(now) {
+			continue
+		}
+		due = append(due, *t)
+		t.NextAttemptAt = now.Add(lease)
+	}
+	return due, nil
+}
+
+// tenantStep is one step of a tenant saga. Steps must be idempotent: one
+// that fails after its service acted is run again.
+type tenantStep struct {
+	name string
+	run  func(ctx context.Context, t *Tenant) error
+}
+
+// Tenants provisions and deletes tenants across the services. Provisioning
+// puts the tenant on its plan at the gateway and subscribes its webhook URL
+// at notification-service; deleting takes both away again. Like account
+// merges, progress is saved after each step, so a saga interrupted by a
+// failure or a restart carries on from where it stopped.
+type Tenants struct {
+	repo   TenantRepository
+	events *events.Emitter
+	clock  clock.Clock
+	// tokens sign the tenants' API keys, and the admin tokens steps call
+	// the other services with; nil when auth is off
+	tokens *auth.Tokens
+	keyTTL time.Duration
+	client *http.Client
+
+	provision []tenantStep
+	teardown  []tenantStep
+}
+
+// NewTenants takes the base URLs of the gateway, which keeps quota plans,
+// and of notification-service
+func NewTenants(repo TenantRepository, emitter *events.Emitter, tokens *auth.Tokens, keyTTL time.Duration, gatewayURL, notificationServiceURL string) *Tenants {
+	s := &Tenants{
+		repo:   repo,
+		events: emitter,
+		clock:  clock.System,
+		tokens: tokens,
+		keyTTL: keyTTL,
+		client: &http.Client{Timeout: tenantStepTimeout},
+	}
+	planURL := func(t *Tenant) string {
+		return gatewayURL + "/admin/quotas/subjects/" + quota.Subject(t.ID, "") + "/plan"
+	}
+	subscriptionsURL := notificationServiceURL + "/notifications/webhooks/subscriptions"
+	s.provision = []tenantStep{
+		{name: "plan", run: func(ctx context.Context, t *Tenant) error {
+			return s.call(ctx, "gateway", http.MethodPut, planURL(t), map[string]string{"plan": t.Plan}, nil)
+		}},
+		{name: "webhooks", run: func(ctx context.Context, t *Tenant) error {
+			if t.WebhookURL == "" {
+				return nil
+			}
+			return s.call(ctx, "notification-service", http.MethodPut, subscriptionsURL+"/"+t.ID+"-default",
+				map[string]string{"tenant": t.ID, "url": t.WebhookURL}, nil)
+		}},
+	}
+	s.teardown = []tenantStep{
+		{name: "webhooks", run: func(ctx context.Context, t *Tenant) error {
+			var subs []struct {
+				ID string `json:"id"`
+			}
+			if err := s.call(ctx, "notification-service", http.MethodGet, subscriptionsURL+"?tenant="+t.ID, nil, &subs); err != nil {
+				return err
+			}
+			for _, sub := range subs {
+				err := s.call(ctx, "notification-service", http.MethodDelete, subscriptionsURL+"/"+sub.ID, nil, nil)
+				if err != nil && !errors.Is(err, errUpstreamNotFound) {
+					return err
+				}
+			}
+			return nil
+		}},
+		{name: "plan", run: func(ctx context.Context, t *Tenant) error {
+			return s.call(ctx, "gateway", http.MethodPut, planURL(t), map[string]string{"plan": quota.DefaultPlan}, nil)
+		}},
+	}
+	return s
+}
+
+// errUpstreamNotFound is a service answering 404
+var errUpstreamNotFound = errors.New("not found upstream")
+
+// call makes one request of a saga step as an admin, sending body and
+// decoding the response into out when they are not nil
+func (s *Tenants) call(ctx context.Context, service, method, url string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.tokens != nil {
+		token, err := s.tokens.Issue(auth.Claims{Subject: "user-service", Roles: []string{"admin"}}, time.Minute)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	middleware.Propagate(ctx, req)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	middleware.RecordUpstream(ctx, service, time.Since(start))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, url, errUpstreamNotFound)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", service, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// steps are the saga t's status runs
+func (s *Tenants) steps(t *Tenant) []tenantStep {
+	if t.Status == TenantDeleting {
+		return s.teardown
+	}
+	return s.provision
+}
+
+// describe fills in the name of the step a tenant's saga is on
+func (s *Tenants) describe(t *Tenant) *Tenant {
+	if steps := s.steps(t); (t.Status == TenantProvisioning || t.Status == TenantDeleting) && t.Step < len(steps) {
+		t.NextStep = steps[t.Step].name
+	}
+	return t
+}
+
+// issueKey signs an API key for the tenant: a token with the integrator
+// role and the tenant's ID as its tenant claim
+func (s *Tenants) issueKey(t *Tenant) error {
+	if s.tokens == nil {
+		return nil
+	}
+	key, err := s.tokens.Issue(auth.Claims{Subject: quota.Subject(t.ID, ""), Roles: []string{"integrator"}, Tenant: t.ID}, s.keyTTL)
+	if err != nil {
+		return err
+	}
+	t.APIKey = key
+	return nil
+}
+
+// Run carries on due sagas every interval until ctx is done
+func (s *Tenants) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			due, err := s.repo.ClaimDueTenants(ctx, s.clock.Now(), tenantLease, 20)
+			if err != nil {
+				log.Printf("claim due tenants: %v", err)
+				continue
+			}
+			for _, t := range due {
+				if err := s.advance(ctx, &t); err != nil {
+					log.Printf("tenant %s: %v", t.ID, err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// advance runs t's remaining steps, which the caller must hold the lease on
+func (s *Tenants) advance(ctx context.Context, t *Tenant) error {
+	status := t.Status
+	steps := s.steps(t)
+	for t.Step < len(steps) {
+		step := steps[t.Step]
+		stepCtx, cancel := context.WithTimeout(ctx, tenantStepTimeout)
+		err := step.run(stepCtx, t)
+		cancel()
+		if err != nil {
+			return s.failed(ctx, t, step.name, err)
+		}
+
+		done := t.Step
+		updated, err := s.repo.UpdateTenant(ctx, t.ID, func(c *Tenant) error {
+			if c.Status != status || c.Step != done {
+				return errTenantMoved
+			}
+			c.Step++
+			c.Attempts, c.LastError = 0, ""
+			if c.Step == len(steps) {
+				c.Status = TenantActive
+				if status == TenantDeleting {
+					c.Status = TenantDeleted
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		t = updated
+	}
+
+	event := "tenant.provisioned"
+	if t.Status == TenantDeleted {
+		event = "tenant.deleted"
+	}
+	s.events.Emit(ctx, event, "tenant/"+t.ID, t)
+	return nil
+}
+
+// failed schedules another attempt at the step, backing off, or stalls the
+// saga once the attempts are used up
+func (s *Tenants) failed(ctx context.Context, t *Tenant, step string, cause error) error {
+	updated, err := s.repo.UpdateTenant(ctx, t.ID, func(c *Tenant) error {
+		if c.Status != t.Status || c.Step != t.Step {
+			return errTenantMoved
+		}
+		c.Attempts++
+		c.LastError = fmt.Sprintf("%s: %v", step, cause)
+		c.NextAttemptAt = s.clock.Now().Add(time.Duration(1<<min(c.Attempts-1, 6)) * 30 * time.Second)
+		c.Stalled = c.Attempts >= maxTenantAttempts
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if updated.Stalled {
+		s.events.Emit(ctx, "tenant.stalled", "tenant/"+t.ID, s.describe(updated))
+	}
+	return fmt.Errorf("%s: %w", step, cause)
+}
+
+// rearm readies a provisioning or deletion to run again from the step it
+// stopped at, leased to the caller
+func (s *Tenants) rearm(c *Tenant) error {
+	if c.Status != TenantProvisioning && c.Status != TenantDeleting {
+		return errTenantStatus
+	}
+	c.Stalled, c.Attempts = false, 0
+	c.NextAttemptAt = s.clock.Now().Add(tenantLease)
+	return nil
+}
+
+// tearDown starts deleting c from the first step, leased to the caller
+func (s *Tenants) tearDown(c *Tenant) {
+	c.Status, c.Step, c.Attempts, c.Stalled, c.LastError = TenantDeleting, 0, 0, false, ""
+	c.NextAttemptAt = s.clock.Now().Add(tenantLease)
+}
+
+// start runs a saga the caller just leased in the background, outliving
+// the request that started it
+func (s *Tenants) start(ctx context.Context, t *Tenant) {
+	ctx = context.WithoutCancel(ctx)
+	c := *t
+	go func() {
+		if err := s.advance(ctx, &c); err != nil {
+			log.Printf("tenant %s: %v", t.ID, err)
+		}
+	}()
+}
+
+// TenantAPI serves /tenants to admins
+type TenantAPI struct {
+	repo    TenantRepository
+	tenants *Tenants
+}
+
+func (a *TenantAPI) writeTenant(w http.ResponseWriter, status int, t *Tenant) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(a.tenants.describe(t))
+}
+
+// Create provisions a tenant and returns it with its first API key. The
+// provisioning runs in the background; the gateway turns the key away
+// until GET /tenants/{id} says the tenant is active.
+func (a *TenantAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var t Tenant
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !tenantIDPattern.MatchString(t.ID) || t.Name == "" || t.Plan == "" {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "tenant.invalid")
+		return
+	}
+
+	// Created leased to this replica, which starts it at once
+	t.Status, t.Step, t.Attempts, t.Stalled, t.LastError = TenantProvisioning, 0, 0, false, ""
+	t.NextAttemptAt = a.tenants.clock.Now().Add(tenantLease)
+	err := a.repo.CreateTenant(r.Context(), &t)
+	if errors.Is(err, errTenantExists) {
+		i18n.Error(w, r, http.StatusConflict, "tenant.exists")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if err := a.tenants.issueKey(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.tenants.start(r.Context(), &t)
+	a.writeTenant(w, http.StatusAccepted, &t)
+}
+
+// List takes an optional status filter
+func (a *TenantAPI) List(w http.ResponseWriter, r *http.Request) {
+	tenants, err := a.repo.Tenants(r.Context(), r.URL.Query().Get("status"))
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	for i := range tenants {
+		a.tenants.describe(&tenants[i])
+	}
+	if tenants == nil {
+		tenants = []Tenant{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenants)
+}
+
+func (a *TenantAPI) Get(w http.ResponseWriter, r *http.Request) {
+	t, err := a.repo.Tenant(r.Context(), router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "tenant.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.writeTenant(w, http.StatusOK, t)
+}
+
+// update applies a lifecycle change, answering with the tenant as it
+// left it; a change the tenant's status doesn't allow is a 409
+func (a *TenantAPI) update(w http.ResponseWriter, r *http.Request, fn func(*Tenant) error) (*Tenant, bool) {
+	t, err := a.repo.UpdateTenant(r.Context(), router.Param(r, "id"), fn)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		i18n.Error(w, r, http.StatusNotFound, "tenant.not_found")
+		return nil, false
+	case errors.Is(err, errTenantStatus):
+		current, err := a.repo.Tenant(r.Context(), router.Param(r, "id"))
+		if err != nil {
+			dbretry.Error(w, err)
+			return nil, false
+		}
+		i18n.Error(w, r, http.StatusConflict, "tenant.status", current.Status)
+		return nil, false
+	case err != nil:
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// Suspend turns the tenant's API keys away at the gateway until it is
+// resumed; what it stores is kept
+func (a *TenantAPI) Suspend(w http.ResponseWriter, r *http.Request) {
+	a.setActive(w, r, TenantActive, TenantSuspended, "tenant.suspended")
+}
+
+func (a *TenantAPI) Resume(w http.ResponseWriter, r *http.Request) {
+	a.setActive(w, r, TenantSuspended, TenantActive, "tenant.resumed")
+}
+
+func (a *TenantAPI) setActive(w http.ResponseWriter, r *http.Request, from, to, event string) {
+	t, ok := a.update(w, r, func(c *Tenant) error {
+		if c.Status == to {
+			return nil
+		}
+		if c.Status != from {
+			return errTenantStatus
+		}
+		c.Status = to
+		return nil
+	})
+	if !ok {
+		return
+	}
+	a.tenants.events.Emit(r.Context(), event, "tenant/"+t.ID, t)
+	a.writeTenant(w, http.StatusOK, t)
+}
+
+// Delete tears the tenant down in the background. Deleted tenants are kept,
+// so the gateway goes on turning their keys away and their ID isn't reused.
+func (a *TenantAPI) Delete(w http.ResponseWriter, r *http.Request) {
+	t, ok := a.update(w, r, func(c *Tenant) error {
+		if c.Status == TenantDeleted || c.busy() {
+			return errTenantStatus
+		}
+		a.tenants.tearDown(c)
+		return nil
+	})
+	if !ok {
+		return
+	}
+	a.tenants.start(r.Context(), t)
+	a.writeTenant(w, http.StatusAccepted, t)
+}
+
+// Retry runs a stalled saga again from the step it stopped at
+func (a *TenantAPI) Retry(w http.ResponseWriter, r *http.Request) {
+	t, ok := a.update(w, r, a.tenants.rearm)
+	if !ok {
+		return
+	}
+	a.tenants.start(r.Context(), t)
+	a.writeTenant(w, http.StatusAccepted, t)
+}
+
+type twoFactorPolicy struct {
+	Required bool `json:"required"`
+}
+
+// SetTwoFactorPolicy serves PUT /tenants/{id}/two-factor. Turning it on
+// holds the tenant's users without a second factor to setting one up at
+// their next login; tokens issued before last until they expire.
+func (a *TenantAPI) SetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy twoFactorPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := a.update(w, r, func(c *Tenant) error {
+		if c.Status == TenantDeleted {
+			return errTenantStatus
+		}
+		c.RequireTwoFactor = policy.Required
+		return nil
+	})
+	if !ok {
+		return
+	}
+	a.tenants.events.Emit(r.Context(), "tenant.two_factor_policy_changed", "tenant/"+t.ID, t)
+	a.writeTenant(w, http.StatusOK, t)
+}
+
+// IssueKey returns another API key for an active tenant. Keys aren't
+// stored, so one can't be revoked alone: suspending the tenant stops them
+// all.
+func (a *TenantAPI) IssueKey(w http.ResponseWriter, r *http.Request) {
+	t, err := a.repo.Tenant(r.Context(), router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "tenant.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if t.Status != TenantActive {
+		i18n.Error(w, r, http.StatusConflict, "tenant.status", t.Status)
+		return
+	}
+	if a.tenants.tokens == nil {
+		i18n.Error(w, r, http.StatusNotImplemented, "tenant.keys_unavailable")
+		return
+	}
+	if err := a.tenants.issueKey(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"api_key":    t.APIKey,
+		"expires_at": a.tenants.clock.Now().Add(a.tenants.keyTTL),
+	})
+}
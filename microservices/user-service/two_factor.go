@@ -0,0 +1,593 @@
+// user-service/two_factor.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"platform/auth"
+	"platform/clock"
+	"platform/dbretry"
+	"platform/events"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+const (
+	recoveryCodeCount = 10
+	// enrollmentTTL is how long a user whose tenant requires a second
+	// factor has to set one up with the token their login gets
+	enrollmentTTL = 15 * time.Minute
+)
+
+// Activity types for second factors
+const (
+	activityTwoFactorEnabled       = "two_factor_enabled"
+	activityTwoFactorDisabled      = "two_factor_disabled"
+	activityRecoveryCodesGenerated = "recovery_codes_generated"
+)
+
+var errTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+// TwoFactor is a user's TOTP second factor; EnabledAt is nil until a code
+// from it is confirmed
+type TwoFactor struct {
+	UserID            int
+	Secret            string
+	EnabledAt         *time.Time
+	LastStep          int64
+	RecoveryCodesLeft int
+}
+
+type TwoFactorRepository interface {
+	// TwoFactor returns the user's second factor, ErrNotFound without one
+	TwoFactor(ctx context.Context, userID int) (*TwoFactor, error)
+	// SetTwoFactorSecret starts over a setup not yet confirmed; an enabled
+	// factor is errTwoFactorEnabled
+	SetTwoFactorSecret(ctx context.Context, userID int, secret string) error
+	// EnableTwoFactor enables the factor, using up step, and replaces the
+	// recovery codes
+	EnableTwoFactor(ctx context.Context, userID int, step int64, codeHashes []string) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error
+	DisableTwoFactor(ctx context.Context, userID int) error
+	// UseTOTPStep says whether step is later than the last used, making it
+	// the last
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	// UseRecoveryCode says whether the code was unused, using it up
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+}
+
+func (r *PostgresUserRepository) TwoFactor(ctx context.Context, userID int) (*TwoFactor, error) {
+	tf := TwoFactor{UserID: userID}
+	var enabledAt sql.NullTime
+	err := r.db.QueryRowContext(ctx, `SELECT secret, enabled_at, last_step,
+                  (SELECT count(*) FROM recovery_codes c WHERE c.user_id = t.user_id AND c.used_at IS NULL)
+              FROM two_factor t WHERE user_id = $1`, userID).
+		Scan(&tf.Secret, &enabledAt, &tf.LastStep, &tf.RecoveryCodesLeft)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		tf.EnabledAt = &enabledAt.Time
+	}
+	return &tf, nil
+}
+
+func (r *PostgresUserRepository) SetTwoFactorSecret(ctx context.Context, userID int, secret string) error {
+	res, err := r.db.ExecContext(ctx, `INSERT INTO two_factor (user_id, secret) VALUES ($1, $2)
+              ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_step = 0, created_at = now()
+              WHERE two_factor.enabled_at IS NULL`, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errTwoFactorEnabled
+	}
+	return err
+}
+
+func insertRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) EnableTwoFactor(ctx context.Context, userID int, step int64, codeHashes []string) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE two_factor SET enabled_at = now(), last_step = $2
+              WHERE user_id = $1 AND enabled_at IS NULL`, userID, step)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return errors.Join(err, errTwoFactorEnabled)
+		}
+		return insertRecoveryCodes(ctx, tx, userID, codeHashes)
+	})
+}
+
+func (r *PostgresUserRepository) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		return insertRecoveryCodes(ctx, tx, userID, codeHashes)
+	})
+}
+
+func (r *PostgresUserRepository) DisableTwoFactor(ctx context.Context, userID int) error {
+	return r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM two_factor WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+func (r *PostgresUserRepository) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `UPDATE two_factor SET last_step = $2 WHERE user_id = $1 AND last_step < $2`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *PostgresUserRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `UPDATE recovery_codes SET used_at = now()
+              WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *MemoryUserRepository) TwoFactor(ctx context.Context, userID int) (*TwoFactor, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored, ok := r.twoFactor[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	tf := *stored
+	for _, used := range r.recoveryCodes[userID] {
+		if !used {
+			tf.RecoveryCodesLeft++
+		}
+	}
+	return &tf, nil
+}
+
+func (r *MemoryUserRepository) SetTwoFactorSecret(ctx context.Context, userID int, secret string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; !ok {
+		return ErrNotFound
+	}
+	if tf, ok := r.twoFactor[userID]; ok && tf.EnabledAt != nil {
+		return errTwoFactorEnabled
+	}
+	r.twoFactor[userID] = &TwoFactor{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (r *MemoryUserRepository) EnableTwoFactor(ctx context.Context, userID int, step int64, codeHashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tf, ok := r.twoFactor[userID]
+	if !ok || tf.EnabledAt != nil {
+		return errTwoFactorEnabled
+	}
+	now := clock.System.Now()
+	tf.EnabledAt, tf.LastStep = &now, step
+	r.setRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+// setRecoveryCodes needs r.mu held
+func (r *MemoryUserRepository) setRecoveryCodes(userID int, codeHashes []string) {
+	codes := make(map[string]bool, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes[hash] = false
+	}
+	r.recoveryCodes[userID] = codes
+}
+
+func (r *MemoryUserRepository) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+func (r *MemoryUserRepository) DisableTwoFactor(ctx context.Context, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.twoFactor, userID)
+	delete(r.recoveryCodes, userID)
+	return nil
+}
+
+func (r *MemoryUserRepository) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tf, ok := r.twoFactor[userID]
+	if !ok || tf.LastStep >= step {
+		return false, nil
+	}
+	tf.LastStep = step
+	return true, nil
+}
+
+func (r *MemoryUserRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	used, ok := r.recoveryCodes[userID][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	r.recoveryCodes[userID][codeHash] = true
+	return true, nil
+}
+
+// TwoFactorAPI lets users set up a TOTP second factor, and checks it at
+// login along with their tenant's policy
+type TwoFactorAPI struct {
+	repo     Repository
+	events   *events.Emitter
+	activity *ActivityLog
+	// guard counts wrong codes towards the account's login lockout
+	guard *LoginGuard
+	clock clock.Clock
+	// issuer names the account in authenticator apps
+	issuer string
+}
+
+// twoFactorFromEnv reads TWO_FACTOR_ISSUER, the name authenticator apps
+// show for accounts
+func twoFactorFromEnv(repo Repository, emitter *events.Emitter, activity *ActivityLog, guard *LoginGuard) *TwoFactorAPI {
+	issuer := os.Getenv("TWO_FACTOR_ISSUER")
+	if issuer == "" {
+		issuer = "Microservices"
+	}
+	return &TwoFactorAPI{repo: repo, events: emitter, activity: activity, guard: guard, clock: clock.System, issuer: issuer}
+}
+
+// enabled returns the user's second factor if it is enabled, else nil
+func (a *TwoFactorAPI) enabled(ctx context.Context, userID int) (*TwoFactor, error) {
+	tf, err := a.repo.TwoFactor(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && tf.EnabledAt == nil) {
+		return nil, nil
+	}
+	return tf, err
+}
+
+// required says whether user's tenant requires a second factor
+func (a *TwoFactorAPI) required(ctx context.Context, user *User) (bool, error) {
+	if user.Tenant == "" {
+		return false, nil
+	}
+	t, err := a.repo.Tenant(ctx, user.Tenant)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.RequireTwoFactor, nil
+}
+
+// check verifies code, from the authenticator or a recovery code, against
+// tf and uses it up, so it can't be replayed
+func (a *TwoFactorAPI) check(ctx context.Context, tf *TwoFactor, code string) (ok, recovery bool, err error) {
+	if step, match := totpMatch(tf.Secret, code, a.clock.Now()); match {
+		ok, err = a.repo.UseTOTPStep(ctx, tf.UserID, step)
+		return ok, false, err
+	}
+	ok, err = a.repo.UseRecoveryCode(ctx, tf.UserID, hashClaimToken(normalizeRecoveryCode(code)))
+	return ok, ok, err
+}
+
+// recoveryCodes returns fresh codes for the user and their hashes to store
+func recoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i], hashes[i] = code, hashClaimToken(normalizeRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// account resolves the path's user for the user themselves, and for
+// admins when adminToo, but never under an impersonation token
+func (a *TwoFactorAPI) account(w http.ResponseWriter, r *http.Request, adminToo bool) (*User, bool) {
+	if refuseImpersonation(w, r) {
+		return nil, false
+	}
+	ctx := r.Context()
+	userID, err := resolveUserID(ctx, a.repo, router.Param(r, "id"))
+	var user *User
+	if err == nil {
+		user, err = a.repo.Get(ctx, userID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return nil, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	p, ok := middleware.PrincipalFromContext(ctx)
+	if ok && p.Subject != strconv.Itoa(userID) && !(adminToo && p.HasRole("admin")) {
+		i18n.Error(w, r, http.StatusForbidden, "two_factor.forbidden")
+		return nil, false
+	}
+	return user, true
+}
+
+type twoFactorStatus struct {
+	Enabled           bool       `json:"enabled"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+	Required          bool       `json:"required"`
+}
+
+// Status serves GET /users/{id}/two-factor
+func (a *TwoFactorAPI) Status(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.account(w, r, true)
+	if !ok {
+		return
+	}
+	var status twoFactorStatus
+	tf, err := a.enabled(r.Context(), user.ID)
+	if err == nil {
+		status.Required, err = a.required(r.Context(), user)
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if tf != nil {
+		status.Enabled, status.EnabledAt, status.RecoveryCodesLeft = true, tf.EnabledAt, tf.RecoveryCodesLeft
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+type enrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// URI to show as a QR code
+	URI string `json:"uri"`
+}
+
+// Enroll serves POST /users/{id}/two-factor: a new secret for the user's
+// authenticator, enabled once Confirm gets a code from it
+func (a *TwoFactorAPI) Enroll(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.account(w, r, false)
+	if !ok {
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = a.repo.SetTwoFactorSecret(r.Context(), user.ID, secret)
+	if errors.Is(err, errTwoFactorEnabled) {
+		i18n.Error(w, r, http.StatusConflict, "two_factor.enabled")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(enrollment{Secret: secret, URI: totpURI(a.issuer, user.Email, secret)})
+}
+
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return req.Code, true
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Confirm serves POST /users/{id}/two-factor/confirm with a code from the
+// authenticator, enabling the factor; the recovery codes are shown once
+func (a *TwoFactorAPI) Confirm(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.account(w, r, false)
+	if !ok {
+		return
+	}
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	tf, err := a.repo.TwoFactor(ctx, user.ID)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusConflict, "two_factor.not_enrolled")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if tf.EnabledAt != nil {
+		i18n.Error(w, r, http.StatusConflict, "two_factor.enabled")
+		return
+	}
+	step, match := totpMatch(tf.Secret, code, a.clock.Now())
+	if !match {
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "two_factor.code_invalid")
+		return
+	}
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = a.repo.EnableTwoFactor(ctx, user.ID, step, hashes)
+	if errors.Is(err, errTwoFactorEnabled) {
+		i18n.Error(w, r, http.StatusConflict, "two_factor.enabled")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.activity.Record(r, Activity{UserID: user.ID, Type: activityTwoFactorEnabled})
+	a.events.Emit(ctx, "user.two_factor_enabled", fmt.Sprintf("user/%d", user.ID), map[string]any{"user_id": user.ID})
+	writeRecoveryCodes(w, codes)
+}
+
+// verified checks the request's code against the user's enabled factor,
+// answering for it when it doesn't pass. Wrong codes count towards the
+// login lockout, so a stolen session can't guess its way through.
+func (a *TwoFactorAPI) verified(w http.ResponseWriter, r *http.Request, user *User) (*TwoFactor, bool) {
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return nil, false
+	}
+	ip := a.guard.clientIP(r)
+	wait, err := a.guard.check(r.Context(), user.Email, ip, "")
+	if errors.Is(err, errLockedOut) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		i18n.Error(w, r, http.StatusTooManyRequests, "login.locked_out")
+		return nil, false
+	}
+	if err != nil && !errors.Is(err, errCaptchaRequired) {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	tf, err := a.enabled(r.Context(), user.ID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	if tf == nil {
+		i18n.Error(w, r, http.StatusConflict, "two_factor.not_enabled")
+		return nil, false
+	}
+	ok, _, err = a.check(r.Context(), tf, code)
+	if err != nil {
+		dbretry.Error(w, err)
+		return nil, false
+	}
+	if !ok {
+		a.guard.fail(r.Context(), user.Email, ip)
+		i18n.Error(w, r, http.StatusUnprocessableEntity, "two_factor.code_invalid")
+		return nil, false
+	}
+	return tf, true
+}
+
+// RegenerateRecoveryCodes serves POST /users/{id}/two-factor/recovery-codes
+// with a current code; the old recovery codes stop working
+func (a *TwoFactorAPI) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.account(w, r, false)
+	if !ok {
+		return
+	}
+	if _, ok := a.verified(w, r, user); !ok {
+		return
+	}
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.repo.ReplaceRecoveryCodes(r.Context(), user.ID, hashes); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.activity.Record(r, Activity{UserID: user.ID, Type: activityRecoveryCodesGenerated})
+	writeRecoveryCodes(w, codes)
+}
+
+// Disable serves DELETE /users/{id}/two-factor. The user confirms it with
+// a code, unless their tenant requires a second factor; admins reset it
+// for users who lost both authenticator and recovery codes, who then set
+// up a new one at their next login.
+func (a *TwoFactorAPI) Disable(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.account(w, r, true)
+	if !ok {
+		return
+	}
+	p, authed := middleware.PrincipalFromContext(r.Context())
+	if authed && p.Subject == strconv.Itoa(user.ID) {
+		required, err := a.required(r.Context(), user)
+		if err != nil {
+			dbretry.Error(w, err)
+			return
+		}
+		if required {
+			i18n.Error(w, r, http.StatusForbidden, "two_factor.required")
+			return
+		}
+		if _, ok := a.verified(w, r, user); !ok {
+			return
+		}
+	}
+	if err := a.repo.DisableTwoFactor(r.Context(), user.ID); err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	a.activity.Record(r, Activity{UserID: user.ID, Type: activityTwoFactorDisabled})
+	a.events.Emit(r.Context(), "user.two_factor_disabled", fmt.Sprintf("user/%d", user.ID), map[string]any{"user_id": user.ID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// enrollmentClaims limit a token to setting up the user's second factor
+func enrollmentClaims(user *User) auth.Claims {
+	return auth.Claims{
+		Subject: strconv.Itoa(user.ID),
+		AMR:     []string{"pwd"},
+		Scope:   fmt.Sprintf("/users/%d/two-factor", user.ID),
+	}
+}
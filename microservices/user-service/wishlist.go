@@ -0,0 +1,355 @@
+// user-service/wishlist.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/clock"
+	"platform/codec"
+	"platform/dbretry"
+	"platform/events"
+	"platform/fields"
+	"platform/i18n"
+	"platform/middleware"
+	"platform/router"
+)
+
+// WishlistItem is a product a user saved, with their note. Price is the
+// last price they saw; nil until the client or the catalog tells us one.
+type WishlistItem struct {
+	UserID  int       `json:"user_id"`
+	Product string    `json:"product"`
+	Note    string    `json:"note,omitempty"`
+	Price   *float64  `json:"price,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// PriceDrop is a wishlisted product now selling below what its user saw
+type PriceDrop struct {
+	Item     WishlistItem
+	OldPrice float64
+}
+
+type WishlistRepository interface {
+	Wishlist(ctx context.Context, userID int) ([]WishlistItem, error)
+	// SaveWishlistItem adds the product or replaces its note and price
+	SaveWishlistItem(ctx context.Context, item *WishlistItem) error
+	RemoveWishlistItem(ctx context.Context, userID int, product string) error
+	// PriceChanged records the product's new price on every wishlist
+	// holding it and returns the items it is a drop for
+	PriceChanged(ctx context.Context, product string, price float64) ([]PriceDrop, error)
+}
+
+func (r *PostgresUserRepository) Wishlist(ctx context.Context, userID int) ([]WishlistItem, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT user_id, product, note, price, added_at
+              FROM wishlist_items WHERE user_id = $1 ORDER BY added_at, product`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []WishlistItem
+	for rows.Next() {
+		var item WishlistItem
+		var price sql.NullFloat64
+		if err := rows.Scan(&item.UserID, &item.Product, &item.Note, &price, &item.AddedAt); err != nil {
+			return nil, err
+		}
+		if price.Valid {
+			item.Price = &price.Float64
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (r *PostgresUserRepository) SaveWishlistItem(ctx context.Context, item *WishlistItem) error {
+	query := `INSERT INTO wishlist_items (user_id, product, note, price)
+              SELECT id, $2, $3, $4 FROM users WHERE id = $1
+              ON CONFLICT (user_id, product) DO UPDATE
+              SET note = EXCLUDED.note, price = COALESCE(EXCLUDED.price, wishlist_items.price)
+              RETURNING price, added_at`
+	var price sql.NullFloat64
+	err := r.db.QueryRowContext(ctx, query, item.UserID, item.Product, item.Note, item.Price).Scan(&price, &item.AddedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if price.Valid {
+		item.Price = &price.Float64
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) RemoveWishlistItem(ctx context.Context, userID int, product string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM wishlist_items WHERE user_id = $1 AND product = $2`, userID, product)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) PriceChanged(ctx context.Context, product string, price float64) ([]PriceDrop, error) {
+	var dropped []PriceDrop
+	err := r.db.Tx(ctx, nil, func(tx *sql.Tx) error {
+		// The CTE reads each row's price from before the update
+		rows, err := tx.QueryContext(ctx, `WITH old AS (
+                  SELECT user_id, product, price FROM wishlist_items WHERE product = $1 FOR UPDATE
+              )
+              UPDATE wishlist_items w SET price = $2 FROM old
+              WHERE w.user_id = old.user_id AND w.product = old.product AND old.price > $2
+              RETURNING w.user_id, w.product, w.note, old.price, w.added_at`, product, price)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var drops []PriceDrop
+		for rows.Next() {
+			d := PriceDrop{Item: WishlistItem{Price: &price}}
+			if err := rows.Scan(&d.Item.UserID, &d.Item.Product, &d.Item.Note, &d.OldPrice, &d.Item.AddedAt); err != nil {
+				return err
+			}
+			drops = append(drops, d)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Items without a price, or below it, just learn the current one
+		if _, err := tx.ExecContext(ctx, `UPDATE wishlist_items SET price = $2
+              WHERE product = $1 AND (price IS NULL OR price < $2)`, product, price); err != nil {
+			return err
+		}
+		dropped = drops
+		return nil
+	})
+	return dropped, err
+}
+
+func (r *MemoryUserRepository) Wishlist(ctx context.Context, userID int) ([]WishlistItem, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var items []WishlistItem
+	for _, item := range r.wishlist {
+		if item.UserID == userID {
+			items = append(items, item.copy())
+		}
+	}
+	return items, nil
+}
+
+func (r *MemoryUserRepository) SaveWishlistItem(ctx context.Context, item *WishlistItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[item.UserID]; !ok {
+		return ErrNotFound
+	}
+	i := slices.IndexFunc(r.wishlist, func(w WishlistItem) bool {
+		return w.UserID == item.UserID && w.Product == item.Product
+	})
+	if i < 0 {
+		item.AddedAt = clock.System.Now()
+		r.wishlist = append(r.wishlist, item.copy())
+		return nil
+	}
+	saved := &r.wishlist[i]
+	saved.Note = item.Note
+	if item.Price != nil {
+		saved.Price = item.copy().Price
+	}
+	*item = saved.copy()
+	return nil
+}
+
+func (r *MemoryUserRepository) RemoveWishlistItem(ctx context.Context, userID int, product string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.wishlist)
+	r.wishlist = slices.DeleteFunc(r.wishlist, func(w WishlistItem) bool {
+		return w.UserID == userID && w.Product == product
+	})
+	if len(r.wishlist) == n {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) PriceChanged(ctx context.Context, product string, price float64) ([]PriceDrop, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var drops []PriceDrop
+	for i := range r.wishlist {
+		item := &r.wishlist[i]
+		if item.Product != product {
+			continue
+		}
+		old := item.Price
+		p := price
+		item.Price = &p
+		if old != nil && *old > price {
+			drops = append(drops, PriceDrop{Item: item.copy(), OldPrice: *old})
+		}
+	}
+	return drops, nil
+}
+
+func (w WishlistItem) copy() WishlistItem {
+	if w.Price != nil {
+		p := *w.Price
+		w.Price = &p
+	}
+	return w
+}
+
+// WishlistAPI serves /users/{id}/wishlist and turns catalog price changes
+// into wishlist.price_dropped events for notification-service
+type WishlistAPI struct {
+	repo   Repository
+	events *events.Emitter
+}
+
+// userID reads the path's user, who must be the caller unless they are an
+// admin
+func (a *WishlistAPI) userID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := resolveUserID(r.Context(), a.repo, router.Param(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return 0, false
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return 0, false
+	}
+	if p, ok := middleware.PrincipalFromContext(r.Context()); ok &&
+		p.Subject != strconv.Itoa(userID) && !p.HasRole("admin") {
+		i18n.Error(w, r, http.StatusForbidden, "wishlist.forbidden")
+		return 0, false
+	}
+	return userID, true
+}
+
+func (a *WishlistAPI) List(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.userID(w, r)
+	if !ok {
+		return
+	}
+	items, err := a.repo.Wishlist(r.Context(), userID)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	if items == nil {
+		items = []WishlistItem{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields.Select(w, r, items))
+}
+
+// Add saves a product; saving it again replaces the note
+func (a *WishlistAPI) Add(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.userID(w, r)
+	if !ok {
+		return
+	}
+	var item WishlistItem
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	item.UserID = userID
+	item.Product = strings.TrimSpace(item.Product)
+	item.Note = strings.TrimSpace(item.Note)
+	if item.Product == "" || (item.Price != nil && *item.Price < 0) {
+		i18n.Error(w, r, http.StatusBadRequest, "wishlist.invalid")
+		return
+	}
+
+	err := a.repo.SaveWishlistItem(r.Context(), &item)
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "user.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+func (a *WishlistAPI) Remove(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.userID(w, r)
+	if !ok {
+		return
+	}
+	err := a.repo.RemoveWishlistItem(r.Context(), userID, router.Param(r, "product"))
+	if errors.Is(err, ErrNotFound) {
+		i18n.Error(w, r, http.StatusNotFound, "wishlist.not_found")
+		return
+	}
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEvent receives events from the broker. catalog.price_changed,
+// carrying a product and its new price, notifies everyone whose wishlist
+// saw it dearer; other events are acknowledged and ignored.
+func (a *WishlistAPI) HandleEvent(w http.ResponseWriter, r *http.Request) {
+	var event events.Event
+	if err := codec.Decode(r, &event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if a.events.Received(event) || event.Type != "catalog.price_changed" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	data, _ := event.Data.(map[string]any)
+	product, _ := data["product"].(string)
+	price, ok := data["price"].(float64)
+	if product == "" || !ok || price < 0 {
+		http.Error(w, "event needs a product and price", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	drops, err := a.repo.PriceChanged(ctx, product, price)
+	if err != nil {
+		dbretry.Error(w, err)
+		return
+	}
+	for _, d := range drops {
+		a.events.Emit(ctx, "wishlist.price_dropped", fmt.Sprintf("user/%d", d.Item.UserID), map[string]any{
+			"user_id":   d.Item.UserID,
+			"product":   d.Item.Product,
+			"note":      d.Item.Note,
+			"old_price": d.OldPrice,
+			"price":     price,
+			"savings":   math.Round((d.OldPrice-price)*100) / 100,
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
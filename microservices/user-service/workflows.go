@@ -0,0 +1,132 @@
+// user-service/workflows.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"platform/workflow"
+)
+
+// watch has the watchdog look for merges that haven't finished: running
+// ones past their SLA, and failed ones waiting for an admin. Resuming
+// retries from the step that failed; merges can't be undone, so there is
+// no aborting one.
+func (s *Merges) watch(w *workflow.Watchdog) {
+	w.Add(workflow.Source{
+		Kind:    "account_merge",
+		Subject: "merge",
+		SLA:     time.Hour,
+		Find: func(ctx context.Context, before time.Time) ([]workflow.Workflow, error) {
+			var stuck []workflow.Workflow
+			for _, status := range []string{MergeRunning, MergeFailed} {
+				merges, err := s.repo.Merges(ctx, status)
+				if err != nil {
+					return nil, err
+				}
+				for _, m := range merges {
+					if m.UpdatedAt.Before(before) {
+						m := s.describe(&m)
+						stuck = append(stuck, workflow.Workflow{
+							ID:     strconv.FormatInt(m.ID, 10),
+							State:  m.Status,
+							Since:  m.UpdatedAt,
+							Detail: stepDetail(m.NextStep, m.LastError),
+						})
+					}
+				}
+			}
+			return stuck, nil
+		},
+		Resume: func(ctx context.Context, id string) error {
+			mergeID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return workflow.ErrNotFound
+			}
+			m, err := s.repo.UpdateMerge(ctx, mergeID, s.rearm)
+			switch {
+			case errors.Is(err, ErrNotFound):
+				return workflow.ErrNotFound
+			case errors.Is(err, errMergeCompleted):
+				return workflow.ErrNotStuck
+			case err != nil:
+				return err
+			}
+			s.start(ctx, m)
+			return nil
+		},
+	})
+}
+
+// watch has the watchdog look for tenants whose provisioning or deletion
+// hasn't finished. Resuming retries from the step that failed; aborting a
+// stalled provisioning tears down what it had set up.
+func (s *Tenants) watch(w *workflow.Watchdog) {
+	w.Add(workflow.Source{
+		Kind:    "tenant",
+		Subject: "tenant",
+		SLA:     30 * time.Minute,
+		Find: func(ctx context.Context, before time.Time) ([]workflow.Workflow, error) {
+			var stuck []workflow.Workflow
+			for _, status := range []string{TenantProvisioning, TenantDeleting} {
+				tenants, err := s.repo.Tenants(ctx, status)
+				if err != nil {
+					return nil, err
+				}
+				for _, t := range tenants {
+					if t.UpdatedAt.Before(before) {
+						t := s.describe(&t)
+						stuck = append(stuck, workflow.Workflow{
+							ID:     t.ID,
+							State:  t.Status,
+							Since:  t.UpdatedAt,
+							Detail: stepDetail(t.NextStep, t.LastError),
+						})
+					}
+				}
+			}
+			return stuck, nil
+		},
+		Resume: func(ctx context.Context, id string) error {
+			return s.restart(ctx, id, s.rearm)
+		},
+		Abort: func(ctx context.Context, id string) error {
+			return s.restart(ctx, id, func(c *Tenant) error {
+				if c.Status != TenantProvisioning || !c.Stalled {
+					return errTenantStatus
+				}
+				s.tearDown(c)
+				return nil
+			})
+		},
+	})
+}
+
+// restart changes the tenant with fn and runs its saga
+func (s *Tenants) restart(ctx context.Context, id string, fn func(*Tenant) error) error {
+	t, err := s.repo.UpdateTenant(ctx, id, fn)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return workflow.ErrNotFound
+	case errors.Is(err, errTenantStatus):
+		return workflow.ErrNotStuck
+	case err != nil:
+		return err
+	}
+	s.start(ctx, t)
+	return nil
+}
+
+// stepDetail says which step a saga is at and how it last failed
+func stepDetail(step, lastError string) string {
+	switch {
+	case step == "":
+		return lastError
+	case lastError == "":
+		return "at step " + step
+	}
+	return fmt.Sprintf("at step %s: %s", step, lastError)
+}
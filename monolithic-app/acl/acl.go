@@ -0,0 +1,167 @@
+// Package acl is the anti-corruption layer between the monolith's data model
+// and the microservice domain models. The monolith stores float amounts, free
+// form status strings and no timestamps; the services use integer money,
+// status enums and created_at. The CDC publisher translates every captured
+// row through here, so the rules live in one place.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const DefaultCurrency = "USD"
+
+// Monolith shapes, as stored in the monolith database
+
+type MonolithUser struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type MonolithOrder struct {
+	ID      int     `json:"id"`
+	UserID  int     `json:"user_id"`
+	Product string  `json:"product"`
+	Amount  float64 `json:"amount"`
+}
+
+type MonolithPayment struct {
+	ID      int     `json:"id"`
+	OrderID int     `json:"order_id"`
+	Amount  float64 `json:"amount"`
+	Status  string  `json:"status"`
+}
+
+// Microservice domain shapes
+
+// Money is an amount in minor units, avoiding float rounding errors
+type Money struct {
+	Cents    int64  `json:"cents"`
+	Currency string `json:"currency"`
+}
+
+type OrderStatus string
+
+const (
+	OrderPending       OrderStatus = "pending"
+	OrderCompleted     OrderStatus = "completed"
+	OrderPaymentFailed OrderStatus = "payment_failed"
+)
+
+type PaymentStatus string
+
+const (
+	PaymentPending   PaymentStatus = "pending"
+	PaymentCompleted PaymentStatus = "completed"
+	PaymentFailed    PaymentStatus = "failed"
+	// PaymentUnknown is a status the monolith wrote that isn't mapped yet;
+	// the raw row still carries it
+	PaymentUnknown PaymentStatus = "unknown"
+)
+
+type User struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Order struct {
+	ID        int         `json:"id"`
+	UserID    int         `json:"user_id"`
+	Product   string      `json:"product"`
+	Quantity  int         `json:"quantity"`
+	Amount    Money       `json:"amount"`
+	Status    OrderStatus `json:"status,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type Payment struct {
+	ID        int           `json:"id"`
+	OrderID   int           `json:"order_id"`
+	Amount    Money         `json:"amount"`
+	Status    PaymentStatus `json:"status"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+var ErrNegativeAmount = errors.New("amount must not be negative")
+
+// MoneyFromFloat converts a monolith amount to minor units, rounding half away from zero
+func MoneyFromFloat(amount float64) (Money, error) {
+	if amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return Money{}, ErrNegativeAmount
+	}
+	return Money{Cents: int64(math.Round(amount * 100)), Currency: DefaultCurrency}, nil
+}
+
+// The monolith has no timestamps, so callers pass the time the row was first
+// observed (e.g. the commit timestamp from CDC) as createdAt.
+
+func UserFromMonolith(m MonolithUser, createdAt time.Time) User {
+	return User{ID: m.ID, Name: m.Name, Email: m.Email, CreatedAt: createdAt.UTC()}
+}
+
+// OrderFromMonolith derives the order status from its payment; the monolith
+// only records status on the payment row, so without one the status is left
+// out rather than guessed.
+func OrderFromMonolith(m MonolithOrder, payment *MonolithPayment, createdAt time.Time) (Order, error) {
+	amount, err := MoneyFromFloat(m.Amount)
+	if err != nil {
+		return Order{}, fmt.Errorf("order %d: %w", m.ID, err)
+	}
+
+	var status OrderStatus
+	if payment != nil {
+		switch paymentStatus(payment.Status) {
+		case PaymentPending:
+			status = OrderPending
+		case PaymentCompleted:
+			status = OrderCompleted
+		case PaymentFailed:
+			status = OrderPaymentFailed
+		}
+	}
+
+	return Order{
+		ID:        m.ID,
+		UserID:    m.UserID,
+		Product:   m.Product,
+		Quantity:  1,
+		Amount:    amount,
+		Status:    status,
+		CreatedAt: createdAt.UTC(),
+	}, nil
+}
+
+func PaymentFromMonolith(m MonolithPayment, createdAt time.Time) (Payment, error) {
+	amount, err := MoneyFromFloat(m.Amount)
+	if err != nil {
+		return Payment{}, fmt.Errorf("payment %d: %w", m.ID, err)
+	}
+
+	return Payment{
+		ID:        m.ID,
+		OrderID:   m.OrderID,
+		Amount:    amount,
+		Status:    paymentStatus(m.Status),
+		CreatedAt: createdAt.UTC(),
+	}, nil
+}
+
+// paymentStatus maps the monolith's free form status, falling back to
+// PaymentUnknown so one odd row can't hold up the CDC stream behind it
+func paymentStatus(s string) PaymentStatus {
+	switch s {
+	case "", "pending":
+		return PaymentPending
+	case "completed", "captured", "succeeded":
+		return PaymentCompleted
+	case "failed", "declined":
+		return PaymentFailed
+	}
+	return PaymentUnknown
+}
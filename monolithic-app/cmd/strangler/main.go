@@ -0,0 +1,141 @@
+// cmd/strangler/main.go
+//
+// The strangler proxy sits in front of the monolith during the migration.
+// Paths already cut over (CUTOVER_PREFIXES) go to the microservices'
+// gateway; everything else goes to the monolith, and MIRROR_PERCENT of it
+// is also sent to the gateway in the background, whose answers are thrown
+// away after being compared with the monolith's. Divergences in status or
+// body are logged, and counted at /metrics on ADMIN_ADDR, so a domain can
+// be cut over once its mirrored traffic stops diverging.
+//
+// Only GET and HEAD are mirrored by default: writes already reach the
+// services through the CDC publisher, and mirroring them as well would
+// apply them twice. MIRROR_METHODS opts writes in against services that
+// don't share data with production.
+//
+//	MONOLITH_URL=http://localhost:8080 SERVICES_URL=http://localhost:8090 MIRROR_PERCENT=5 go run ./cmd/strangler
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// list splits a comma separated setting, dropping empty entries
+func list(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func newProxy(name, target string) *httputil.ReverseProxy {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		log.Fatalf("invalid %s URL %q", name, target)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("proxy %s %s %s: %v", name, r.Method, r.URL.Path, err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// Strangler routes each request to the monolith or, once its path is cut
+// over, to the services
+type Strangler struct {
+	monolith http.Handler
+	services http.Handler
+	cutover  []string
+}
+
+func (s *Strangler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range s.cutover {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(prefix, "/")+"/") {
+			s.services.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.monolith.ServeHTTP(w, r)
+}
+
+func main() {
+	monolithURL := getEnv("MONOLITH_URL", "http://localhost:8080")
+	servicesURL := os.Getenv("SERVICES_URL")
+
+	percent, err := strconv.ParseFloat(getEnv("MIRROR_PERCENT", "0"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		log.Fatalf("invalid MIRROR_PERCENT %q", os.Getenv("MIRROR_PERCENT"))
+	}
+	concurrency, err := strconv.Atoi(getEnv("MIRROR_CONCURRENCY", "32"))
+	if err != nil || concurrency < 1 {
+		log.Fatalf("invalid MIRROR_CONCURRENCY %q", os.Getenv("MIRROR_CONCURRENCY"))
+	}
+	timeout, err := time.ParseDuration(getEnv("MIRROR_TIMEOUT", "5s"))
+	if err != nil {
+		log.Fatalf("invalid MIRROR_TIMEOUT %q", os.Getenv("MIRROR_TIMEOUT"))
+	}
+	cutover := list(os.Getenv("CUTOVER_PREFIXES"))
+	if servicesURL == "" && (percent > 0 || len(cutover) > 0) {
+		log.Fatal("SERVICES_URL is needed to mirror or cut over")
+	}
+
+	mirror := NewMirror(MirrorConfig{
+		Target:      servicesURL,
+		Percent:     percent,
+		Methods:     list(strings.ToUpper(getEnv("MIRROR_METHODS", "GET,HEAD"))),
+		Ignore:      list(getEnv("MIRROR_IGNORE_FIELDS", "id,created_at,updated_at")),
+		Concurrency: concurrency,
+		Timeout:     timeout,
+	})
+	s := &Strangler{monolith: mirror.Handler(newProxy("monolith", monolithURL)), cutover: cutover}
+	if servicesURL != "" {
+		s.services = newProxy("services", servicesURL)
+	}
+
+	srv := &http.Server{Addr: getEnv("LISTEN_ADDR", ":8000"), Handler: s}
+	admin := http.NewServeMux()
+	admin.Handle("GET /metrics", mirror)
+	adminSrv := &http.Server{Addr: getEnv("ADMIN_ADDR", ":9000"), Handler: admin}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		if err := adminSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		adminSrv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("strangler proxy on %s: monolith %s, cut over %v, mirroring %g%% to %s", srv.Addr, monolithURL, cutover, percent, servicesURL)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	log.Println("strangler proxy stopped")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Bodies beyond this aren't mirrored, or compared
+const maxBody = 1 << 20
+
+// MirrorHeader marks mirrored requests, so the services can tell them from
+// real ones in their logs
+const MirrorHeader = "X-Mirrored-From"
+
+// Mirror sends a share of the monolith's requests on to the services as
+// well, throws their answers away, and logs where they differ from the
+// monolith's
+type Mirror struct {
+	target  string
+	client  *http.Client
+	percent float64
+	methods []string
+	// ignore names JSON fields expected to differ, ids and timestamps
+	ignore map[string]bool
+	// slots bounds the mirrored requests in flight; past it they're dropped
+	// rather than queued, so the services can't slow the monolith down
+	slots chan struct{}
+
+	matched, diverged, failed, dropped atomic.Int64
+}
+
+// MirrorConfig configures a Mirror
+type MirrorConfig struct {
+	Target      string
+	Percent     float64
+	Methods     []string
+	Ignore      []string
+	Concurrency int
+	Timeout     time.Duration
+}
+
+func NewMirror(cfg MirrorConfig) *Mirror {
+	m := &Mirror{
+		target:  strings.TrimSuffix(cfg.Target, "/"),
+		client:  &http.Client{Timeout: cfg.Timeout},
+		percent: cfg.Percent,
+		methods: cfg.Methods,
+		ignore:  make(map[string]bool),
+		slots:   make(chan struct{}, max(cfg.Concurrency, 1)),
+	}
+	for _, field := range cfg.Ignore {
+		m.ignore[field] = true
+	}
+	return m
+}
+
+// chosen reports whether r is to be mirrored
+func (m *Mirror) chosen(r *http.Request) bool {
+	return m.percent > 0 && slices.Contains(m.methods, r.Method) && rand.Float64()*100 < m.percent
+}
+
+// Divergence is a mirrored request the services answered differently
+type Divergence struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Monolith int       `json:"monolith_status"`
+	Services int       `json:"services_status,omitempty"`
+	// Fields lists the JSON paths whose values differ, Body is set when a
+	// body isn't JSON and the two differ
+	Fields []string `json:"fields,omitempty"`
+	Body   bool     `json:"body,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Handler serves r from next, the monolith, and mirrors it when chosen
+func (m *Mirror) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.chosen(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var reqBody []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			if reqBody, err = io.ReadAll(io.LimitReader(r.Body, maxBody+1)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+		}
+		// Both answers are compared as sent, so neither may be compressed
+		r.Header.Del("Accept-Encoding")
+		// Cloned now: the monolith's proxy changes the request it is given
+		shadow := r.Clone(context.Background())
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if len(reqBody) > maxBody || rec.body.Len() > maxBody {
+			m.dropped.Add(1)
+			return
+		}
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			m.dropped.Add(1)
+			return
+		}
+		go func() {
+			defer func() { <-m.slots }()
+			m.compare(shadow, reqBody, rec.status, rec.body.Bytes())
+		}()
+	})
+}
+
+// compare sends the mirrored request to the services and logs how their
+// answer differs from the monolith's
+func (m *Mirror) compare(r *http.Request, body []byte, status int, want []byte) {
+	d := Divergence{Time: time.Now().UTC(), Method: r.Method, Path: r.URL.RequestURI(), Monolith: status}
+
+	got, gotStatus, err := m.send(r, body)
+	if err != nil {
+		m.failed.Add(1)
+		d.Error = err.Error()
+		logDivergence(d)
+		return
+	}
+	d.Services = gotStatus
+	if gotStatus == status {
+		d.Fields, d.Body = m.diff(want, got)
+		if len(d.Fields) == 0 && !d.Body {
+			m.matched.Add(1)
+			return
+		}
+	}
+	m.diverged.Add(1)
+	logDivergence(d)
+}
+
+func (m *Mirror) send(r *http.Request, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(r.Method, m.target+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(MirrorHeader, "monolith")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, 0, err
+	}
+	return got, resp.StatusCode, nil
+}
+
+// diff compares two bodies: field by field when both are JSON, otherwise as
+// bytes
+func (m *Mirror) diff(want, got []byte) ([]string, bool) {
+	var w, g any
+	if json.Unmarshal(want, &w) != nil || json.Unmarshal(got, &g) != nil {
+		return nil, !bytes.Equal(bytes.TrimSpace(want), bytes.TrimSpace(got))
+	}
+	var fields []string
+	m.diffValue("$", w, g, &fields)
+	sort.Strings(fields)
+	return fields, false
+}
+
+func (m *Mirror) diffValue(path string, want, got any, fields *[]string) {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			*fields = append(*fields, path)
+			return
+		}
+		for k, v := range w {
+			if !m.ignore[k] {
+				m.diffValue(path+"."+k, v, g[k], fields)
+			}
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok && !m.ignore[k] {
+				*fields = append(*fields, path+"."+k)
+			}
+		}
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			*fields = append(*fields, path)
+			return
+		}
+		for i := range w {
+			m.diffValue(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], fields)
+		}
+	default:
+		if want != got {
+			*fields = append(*fields, path)
+		}
+	}
+}
+
+func logDivergence(d Divergence) {
+	line, _ := json.Marshal(d)
+	log.Printf("divergence %s", line)
+}
+
+// ServeHTTP reports the mirror's counters, in the Prometheus text format
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP strangler_mirrored_total Requests mirrored to the services, by outcome.")
+	fmt.Fprintln(w, "# TYPE strangler_mirrored_total counter")
+	for _, c := range []struct {
+		outcome string
+		n       *atomic.Int64
+	}{{"matched", &m.matched}, {"diverged", &m.diverged}, {"failed", &m.failed}} {
+		fmt.Fprintf(w, "strangler_mirrored_total{outcome=%q} %d\n", c.outcome, c.n.Load())
+	}
+	fmt.Fprintln(w, "# HELP strangler_mirror_dropped_total Requests chosen for mirroring but not sent.")
+	fmt.Fprintln(w, "# TYPE strangler_mirror_dropped_total counter")
+	fmt.Fprintf(w, "strangler_mirror_dropped_total %d\n", m.dropped.Load())
+}
+
+// recorder keeps a copy of the monolith's response, up to maxBody and a
+// byte over
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if room := maxBody + 1 - r.body.Len(); room > 0 {
+		r.body.Write(b[:min(len(b), room)])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}